@@ -12,6 +12,11 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// The app builds with the classic App Engine SDK, which sets the appengine
+// build tag, rather than as part of the module.
+
+//go:build appengine
+
 // Package main is responsible for orchestrating our App Engine app. It
 // provides functions for handling GCS and task queue notifications.
 package main
@@ -0,0 +1,95 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary generate-files duplicates an image into the indicated bucket with
+// the credentials of the Compute Engine instance it runs on, like
+// scripts/generate_files.go, using package gcsgen.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/credentials"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/retry"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/storage/v1"
+)
+
+const usage = `
+Usage:
+	generate-files [-files N] [-copiers N] [-kms-key KEY] [-billing-project PROJECT] [-public] BUCKET PATH/TO/IMAGE
+Where BUCKET is the GCS bucket in which to generate files and PATH/TO/IMAGE is
+the path to the image file we wish to duplicate.
+`
+
+func main() {
+	files := flag.Int("files", 10000, "Number of files to generate, including the original.")
+	copiers := flag.Int("copiers", 10, "Number of concurrent copies.")
+	kmsKey := flag.String("kms-key", "", "Cloud KMS key to encrypt the files with instead of the bucket's default key.")
+	billingProject := flag.String("billing-project", "", "Project billed for the calls, which requester pays buckets need.")
+	public := flag.Bool("public", false, "Make the files readable by anyone, through IAM on buckets with uniform bucket-level access.")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatalf("Please specify both required arguments." + usage)
+	}
+	bucket, imagePath := flag.Arg(0), flag.Arg(1)
+	f, err := os.Open(imagePath)
+	if err != nil {
+		log.Fatalf("Error opening image file: %v", err)
+	}
+	defer f.Close()
+	client, err := credentials.NewClient(context.Background(), credentials.TokenSource(google.ComputeTokenSource("")))
+	if err != nil {
+		log.Fatalf("Failed to authorize GCS client: %v", err)
+	}
+	s, err := storage.New(retry.Wrap(client, &retry.Transport{Policy: retry.DefaultPolicy}))
+	if err != nil {
+		log.Fatalf("Failed to create GCS client: %v", err)
+	}
+	opts := []gcsgen.Option{
+		gcsgen.WithFiles(*files),
+		gcsgen.WithConcurrency(*copiers),
+		// The client retries each call itself.
+		gcsgen.WithRetry(gcsgen.RetryPolicy{Attempts: 1}),
+		gcsgen.WithKMSKey(*kmsKey),
+		gcsgen.WithBillingProject(*billingProject),
+		gcsgen.WithProgress(func(p gcsgen.Progress) {
+			switch {
+			case p.Err != nil:
+				fmt.Printf("Could not copy to %v\n", p.Object)
+			case p.Done%100 == 0:
+				fmt.Printf("%v/%v copied.\n", p.Done-p.Failed, p.Total)
+			}
+		}),
+	}
+	if *public {
+		opt, err := gcsgen.PublicAccess(context.Background(), s, bucket, *billingProject)
+		if err != nil {
+			log.Fatalf("Unable to make the bucket public: %v", err)
+		}
+		opts = append(opts, opt)
+	}
+	g := gcsgen.New(s, bucket, path.Base(imagePath), f, opts...)
+	res, err := g.Run(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%v/%v copied.\n", res.Copied, *files)
+}
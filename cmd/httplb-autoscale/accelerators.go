@@ -0,0 +1,146 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// An acceleratorConfig attaches GPUs to each of the template's instances:
+//
+//	instanceTemplate:
+//	  machineType: n1-standard-8
+//	  accelerators:
+//	  - type: nvidia-tesla-t4
+//	    count: 1
+//
+// Instances with GPUs cannot be live migrated, so they are stopped for host
+// maintenance. The image must install the GPU driver, e.g. from a
+// deeplearning-platform-release image family.
+type acceleratorConfig struct {
+	Type  string `yaml:"type"`
+	Count int64  `yaml:"count"`
+}
+
+// Machine type prefixes which take attached GPUs. Other families either
+// have none or come with their GPUs built in, like a2 and g2.
+var acceleratorMachinePrefixes = []string{"n1-", "custom-"}
+
+// check verifies the accelerator config against the machine type.
+func (ac acceleratorConfig) check(machineType string) error {
+	switch {
+	case ac.Type == "":
+		return errors.New("accelerator type is not set")
+	case ac.Count <= 0 || ac.Count > 8 || ac.Count&(ac.Count-1) != 0:
+		return fmt.Errorf("%v count must be 1, 2, 4 or 8, not %d", ac.Type, ac.Count)
+	}
+	for _, p := range acceleratorMachinePrefixes {
+		if strings.HasPrefix(machineType, p) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v needs an N1 machine type, not %v", ac.Type, machineType)
+}
+
+// guestAccelerators converts the accelerator configs into their Compute API
+// representation. Templates name accelerator types without a zone.
+func guestAccelerators(accelerators []acceleratorConfig) []*compute.AcceleratorConfig {
+	var configs []*compute.AcceleratorConfig
+	for _, ac := range accelerators {
+		configs = append(configs, &compute.AcceleratorConfig{
+			AcceleratorType:  ac.Type,
+			AcceleratorCount: ac.Count,
+		})
+	}
+	return configs
+}
+
+// parseAccelerator parses a TYPE or TYPE:COUNT flag value.
+func parseAccelerator(s string) (acceleratorConfig, error) {
+	ac := acceleratorConfig{Type: s, Count: 1}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		n, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return ac, fmt.Errorf("invalid accelerator count in %q", s)
+		}
+		ac.Type, ac.Count = s[:i], n
+	}
+	return ac, nil
+}
+
+// groupZones returns the zones the config's group may place instances in:
+// its zone, its listed zones, or else every zone of its region.
+func groupZones(ctx context.Context, s *compute.Service, c *policyConfig) ([]string, error) {
+	switch {
+	case c.Zone != "":
+		return []string{c.Zone}, nil
+	case len(c.Zones) > 0:
+		return c.Zones, nil
+	}
+	r, err := s.Regions.Get(c.Project, c.Region).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get region %v: %v", c.Region, err)
+	}
+	zones := make([]string, 0, len(r.Zones))
+	for _, z := range r.Zones {
+		zones = append(zones, path.Base(z))
+	}
+	return zones, nil
+}
+
+// checkAcceleratorZones verifies that every accelerator type is offered, in
+// the requested count, in every zone of the group. A regional group would
+// otherwise fail to create instances in some of its zones.
+func checkAcceleratorZones(ctx context.Context, s *compute.Service, c *policyConfig, accelerators []acceleratorConfig) error {
+	if len(accelerators) == 0 {
+		return nil
+	}
+	zones, err := groupZones(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	pool := workerpool.New(ctx)
+	for _, zone := range zones {
+		for _, ac := range accelerators {
+			zone, ac := zone, ac
+			err := pool.Submit(ac.Type+" in "+zone, func(ctx context.Context) error {
+				at, err := s.AcceleratorTypes.Get(c.Project, zone, ac.Type).Context(ctx).Do()
+				if err != nil {
+					return fmt.Errorf("accelerator %v is not available in %v: %v", ac.Type, zone, err)
+				}
+				if at.MaximumCardsPerInstance > 0 && ac.Count > at.MaximumCardsPerInstance {
+					return fmt.Errorf("%v allows at most %d per instance, not %d", ac.Type, at.MaximumCardsPerInstance, ac.Count)
+				}
+				return nil
+			})
+			if err != nil {
+				break
+			}
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		return failures[0].Err
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// An atMaxDetector notices when a group has been held at its autoscaler's
+// maximum size for longer than a threshold. While that is true, the results
+// of a load test reflect the cap rather than the policy.
+type atMaxDetector struct {
+	threshold time.Duration
+	// webhook, if set, receives each alert as a JSON POST.
+	webhook string
+	since   time.Time
+	alerted bool
+}
+
+// check inspects a sample and returns an alert event if the group has just
+// crossed the threshold, or has just dropped below its maximum after an
+// alert. It returns nil otherwise.
+func (d *atMaxDetector) check(e *report.WatchEvent) *report.WatchEvent {
+	atMax := e.MaxSize > 0 && e.TargetSize >= e.MaxSize
+	switch {
+	case !atMax:
+		d.since = time.Time{}
+		if d.alerted {
+			d.alerted = false
+			return d.alert(e, "at-max-cleared", fmt.Sprintf("group %v dropped below its maximum of %d replicas",
+				e.Group, e.MaxSize))
+		}
+	case d.since.IsZero():
+		d.since = e.Time
+	case !d.alerted && e.Time.Sub(d.since) >= d.threshold:
+		d.alerted = true
+		return d.alert(e, "at-max", fmt.Sprintf("group %v has been at its maximum of %d replicas for %v; results are capacity limited",
+			e.Group, e.MaxSize, e.Time.Sub(d.since)))
+	}
+	return nil
+}
+
+// alert builds an alert event from a sample.
+func (d *atMaxDetector) alert(e *report.WatchEvent, kind, msg string) *report.WatchEvent {
+	return raiseAlert(d.webhook, e, kind, msg)
+}
+
+// raiseAlert builds an alert event from a sample, logs it prominently and
+// hands it to the webhook if one is given.
+func raiseAlert(webhook string, e *report.WatchEvent, kind, msg string) *report.WatchEvent {
+	a := *e
+	a.Type = kind
+	a.Message = msg
+	log.Printf("*** ALERT: %s ***", a.Message)
+	if webhook != "" {
+		if err := postWebhook(webhook, &a); err != nil {
+			log.Printf("Unable to deliver alert to webhook: %v", err)
+		}
+	}
+	return &a
+}
+
+// postWebhook sends an event to a webhook as a JSON POST.
+func postWebhook(url string, e *report.WatchEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// The Cloud Monitoring metric each scaling decision is written to. Its value
+// is the new target size; charts of it, or alerting policies on it, mark
+// scale outs and ins on dashboards.
+const scalingEventMetric = "custom.googleapis.com/httplb/scaling_event"
+
+// Cloud Monitoring rejects label values longer than this.
+const maxLabelLength = 1024
+
+// An annotator marks each scaling decision of the group on dashboards: as a
+// Grafana annotation, as a point of the scaling event metric in Cloud
+// Monitoring, or both.
+type annotator struct {
+	// grafanaURL is the base URL of a Grafana server; empty disables
+	// Grafana annotations.
+	grafanaURL   string
+	grafanaToken string
+	// dashboardUID limits the annotations to one dashboard; they are
+	// organization wide otherwise.
+	dashboardUID string
+	// m, if set, receives the scaling event metric of project.
+	m       *monitoring.Service
+	project string
+}
+
+// scalingReason describes why the autoscaler changed the target size, from
+// its status details or, lacking those, its recommendation.
+func scalingReason(e *report.WatchEvent) string {
+	var details []string
+	for _, d := range e.StatusDetails {
+		details = append(details, d.Message)
+	}
+	if len(details) > 0 {
+		return strings.Join(details, "; ")
+	}
+	return fmt.Sprintf("autoscaler %v recommended %d replicas", strings.ToLower(e.Status), e.RecommendedSize)
+}
+
+// annotate records a scaling decision if the target size changed between
+// two samples. Failures are returned but should not stop the watch.
+func (a *annotator) annotate(ctx context.Context, prev, e *report.WatchEvent) error {
+	if prev == nil || e.TargetSize == prev.TargetSize {
+		return nil
+	}
+	direction := "scale-out"
+	if e.TargetSize < prev.TargetSize {
+		direction = "scale-in"
+	}
+	reason := scalingReason(e)
+	text := fmt.Sprintf("%v %v: %d -> %d replicas (%s)", e.Group, direction, prev.TargetSize, e.TargetSize, reason)
+	var errs []string
+	if a.grafanaURL != "" {
+		if err := a.postGrafana(e.Time, []string{"autoscaling", direction, e.Group}, text); err != nil {
+			errs = append(errs, fmt.Sprintf("Grafana: %v", err))
+		}
+	}
+	if a.m != nil {
+		if err := a.writeMetric(ctx, e, direction, reason); err != nil {
+			errs = append(errs, fmt.Sprintf("Cloud Monitoring: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to annotate %v: %s", direction, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// postGrafana creates an annotation through Grafana's HTTP API.
+func (a *annotator) postGrafana(t time.Time, tags []string, text string) error {
+	body := map[string]interface{}{
+		"time": t.UnixNano() / int64(time.Millisecond),
+		"tags": tags,
+		"text": text,
+	}
+	if a.dashboardUID != "" {
+		body["dashboardUID"] = a.dashboardUID
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(a.grafanaURL, "/")+"/api/annotations", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.grafanaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.grafanaToken)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Grafana returned %v", resp.Status)
+	}
+	return nil
+}
+
+// writeMetric writes the new target size as a point of the scaling event
+// metric, labelled with the group, direction and reason.
+func (a *annotator) writeMetric(ctx context.Context, e *report.WatchEvent, direction, reason string) error {
+	if len(reason) > maxLabelLength {
+		reason = reason[:maxLabelLength]
+	}
+	size := e.TargetSize
+	ts := e.Time.UTC().Format(time.RFC3339Nano)
+	_, err := a.m.Projects.TimeSeries.Create("projects/"+a.project, &monitoring.CreateTimeSeriesRequest{
+		TimeSeries: []*monitoring.TimeSeries{{
+			Metric: &monitoring.Metric{
+				Type:   scalingEventMetric,
+				Labels: map[string]string{"group": e.Group, "direction": direction, "reason": reason},
+			},
+			Resource: &monitoring.MonitoredResource{
+				Type:   "global",
+				Labels: map[string]string{"project_id": a.project},
+			},
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{EndTime: ts},
+				Value:    &monitoring.TypedValue{Int64Value: &size},
+			}},
+		}},
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var auditDir = flag.String("audit-dir", "audit", "Directory of the per-run audit logs of mutating API calls; empty disables them.")
+
+// Name of the audit log of calls made before any run ID is known.
+const unknownRunAuditLog = "no-run-id"
+
+// An auditRecord describes one mutating API call. Records are appended to
+// AUDIT_DIR/RUN_ID.jsonl as one JSON object per line, and files are never
+// truncated or rewritten.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Service is the API called, e.g. compute.
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	// Resource is the path of the resource below projects/, e.g.
+	// "my-project/zones/us-central1-f/instanceGroupManagers/g/resize".
+	Resource string `json:"resource"`
+	// RequestSHA256 is a hash of the request body, so that a call can be
+	// matched to a request without logging its contents.
+	RequestSHA256 string `json:"requestSha256"`
+	// Status is the HTTP status of the response, or 0 if there was none.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	RunID  string `json:"runId,omitempty"`
+}
+
+// An auditLog appends records for the current run.
+type auditLog struct {
+	mu    sync.Mutex
+	runID string
+}
+
+// audit is the audit log of this invocation.
+var audit = &auditLog{}
+
+// setRun directs later records to the log of the given run. Commands learn
+// their run ID from the config or state file, or generate one.
+func (a *auditLog) setRun(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.runID = id
+}
+
+// record appends a record to the current run's log.
+func (a *auditLog) record(r *auditRecord) {
+	if *auditDir == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r.RunID = a.runID
+	name := a.runID
+	if name == "" {
+		name = unknownRunAuditLog
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Unable to audit %v %v: %v", r.Method, r.Resource, err)
+		return
+	}
+	if err := os.MkdirAll(*auditDir, 0700); err != nil {
+		log.Printf("Unable to audit %v %v: %v", r.Method, r.Resource, err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(*auditDir, name+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Unable to audit %v %v: %v", r.Method, r.Resource, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("Unable to audit %v %v: %v", r.Method, r.Resource, err)
+	}
+}
+
+// An auditTransport records every request which may change a resource,
+// that is everything but GET and HEAD, before returning its response.
+type auditTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return t.base.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	sum := sha256.Sum256(body)
+	r := &auditRecord{
+		Time:          time.Now().UTC(),
+		Service:       strings.TrimSuffix(req.URL.Host, ".googleapis.com"),
+		Method:        req.Method,
+		Resource:      req.URL.Path,
+		RequestSHA256: hex.EncodeToString(sum[:]),
+	}
+	if i := strings.Index(r.Resource, "/projects/"); i >= 0 {
+		r.Resource = r.Resource[i+len("/projects/"):]
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Status = resp.StatusCode
+	}
+	audit.record(r)
+	return resp, err
+}
+
+// audited makes a client record its mutating calls in the audit log. Every
+// client which can change resources, as opposed to reading metrics or logs,
+// must be wrapped.
+func audited(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &auditTransport{base: base}
+	return client
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"google.golang.org/api/compute/v1"
+)
+
+// createAutoscalerCmd creates a new autoscaler for the group named in the
+// policy config.
+func createAutoscalerCmd(ctx context.Context, args []string) error {
+	return applyAutoscaler(ctx, "create", args, insertAutoscaler)
+}
+
+// updateAutoscalerCmd replaces the policy of an existing autoscaler with the
+// one described by the policy config.
+func updateAutoscalerCmd(ctx context.Context, args []string) error {
+	return applyAutoscaler(ctx, "update", args, updateAutoscaler)
+}
+
+// applyAutoscaler parses the flags shared by the create and update commands,
+// builds the autoscaler resource and hands it to apply.
+func applyAutoscaler(ctx context.Context, name string, args []string, apply func(context.Context, *compute.Service, *policyConfig, *compute.Autoscaler) (*compute.Operation, error)) error {
+	fs := flag.NewFlagSet("autoscaler "+name, flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	backend := fs.String("backend", "", "Scale this group from the config's backends instead of the top level one.")
+	service := fs.String("service", "", "Scale the group of this service from the config's services instead of the top level one.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c, err = c.forService(*service); err != nil {
+		return err
+	}
+	if c, err = c.forBackend(*backend); err != nil {
+		return err
+	}
+	id, err := runID(c, *statePath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	mig, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	if err := checkSignalsAgainstProject(ctx, s, c, mig); err != nil {
+		return err
+	}
+	a := &compute.Autoscaler{
+		Name:              c.Autoscaler,
+		Description:       resourceDescription("Created by autoscaler "+name+".", id),
+		Target:            mig.SelfLink,
+		AutoscalingPolicy: c.autoscalingPolicy(),
+	}
+	op, err := apply(ctx, s, c, a)
+	if err != nil {
+		return fmt.Errorf("unable to %s autoscaler %v: %v", name, c.Autoscaler, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	log.Printf("Autoscaler %v now targets %v with %d-%d replicas.", c.Autoscaler, c.Group,
+		c.MinReplicas, c.MaxReplicas)
+	logSchedules(a.AutoscalingPolicy)
+	return nil
+}
+
+// logSchedules prints the scaling schedules attached to a policy, if any.
+func logSchedules(p *compute.AutoscalingPolicy) {
+	for _, line := range autoscale.DescribeSchedules(p) {
+		log.Print(line)
+	}
+}
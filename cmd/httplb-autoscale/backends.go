@@ -0,0 +1,191 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// A backendConfig declares one of several groups attached to the config's
+// backend service, each with its own template, location and capacity. The
+// top level group is always the first backend; more are declared with:
+//
+//	backends:
+//	- group: image-processing-large
+//	  zone: us-central1-b
+//	  template: image-processing-large
+//	  targetSize: 1
+//	  autoscaler: image-processing-large-autoscaler
+//	  balancingMode: UTILIZATION
+//	  maxUtilization: 0.8
+//	  capacityScaler: 1
+type backendConfig struct {
+	Group      string `yaml:"group"`
+	Zone       string `yaml:"zone"`
+	Region     string `yaml:"region"`
+	Template   string `yaml:"template"`
+	TargetSize int64  `yaml:"targetSize"`
+	Autoscaler string `yaml:"autoscaler"`
+	// The capacity settings of the backend, see the Compute API's Backend.
+	BalancingMode      string  `yaml:"balancingMode"`
+	MaxUtilization     float64 `yaml:"maxUtilization"`
+	MaxRatePerInstance float64 `yaml:"maxRatePerInstance"`
+	CapacityScaler     float64 `yaml:"capacityScaler"`
+}
+
+// Balancing modes accepted for instance group backends.
+var balancingModes = map[string]bool{
+	"UTILIZATION": true,
+	"RATE":        true,
+	"CONNECTION":  true,
+}
+
+// backendGroups returns a config for each group attached to the backend
+// service: the top level group first, then each declared backend. Backend
+// configs inherit every field they do not override.
+func (c *policyConfig) backendGroups() []*policyConfig {
+	configs := []*policyConfig{c}
+	for _, b := range c.Backends {
+		bc := *c
+		bc.Backends = nil
+		bc.Group = b.Group
+		if b.Zone != "" || b.Region != "" {
+			bc.Zone, bc.Region, bc.Zones = b.Zone, b.Region, nil
+		}
+		if b.Template != "" {
+			bc.Template = b.Template
+		}
+		if b.TargetSize > 0 {
+			bc.TargetSize = b.TargetSize
+		}
+		bc.Autoscaler = b.Autoscaler
+		if bc.Autoscaler == "" {
+			bc.Autoscaler = b.Group + "-autoscaler"
+		}
+		bc.BaseInstanceName = ""
+		capacity := b
+		bc.Capacity = &capacity
+		configs = append(configs, &bc)
+	}
+	return configs
+}
+
+// forBackend returns the config of the named backend group, or the config
+// itself if group is empty.
+func (c *policyConfig) forBackend(group string) (*policyConfig, error) {
+	if group == "" {
+		return c, nil
+	}
+	for _, bc := range c.backendGroups() {
+		if bc.Group == group {
+			return bc, nil
+		}
+	}
+	return nil, fmt.Errorf("config declares no backend group %v", group)
+}
+
+// backend converts a group's capacity settings into a backend of the
+// backend service.
+func (c *policyConfig) backend(instanceGroup string) *compute.Backend {
+	b := &compute.Backend{Group: instanceGroup, BalancingMode: "UTILIZATION", CapacityScaler: 1}
+	if capacity := c.Capacity; capacity != nil {
+		if capacity.BalancingMode != "" {
+			b.BalancingMode = capacity.BalancingMode
+		}
+		b.MaxUtilization = capacity.MaxUtilization
+		b.MaxRatePerInstance = capacity.MaxRatePerInstance
+		if capacity.CapacityScaler > 0 {
+			b.CapacityScaler = capacity.CapacityScaler
+		}
+	}
+	return b
+}
+
+// attachBackendsCmd attaches every group in the config to the backend
+// service with its capacity settings, and each service's group to the
+// service's backend service. Backends for groups which are already
+// attached are updated in place; other backends are left alone.
+func attachBackendsCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("lb attach", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.BackendService == "" {
+		return errors.New("config does not name a backend service")
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if err := attachBackends(ctx, s, c); err != nil {
+		return err
+	}
+	for _, sc := range c.serviceGroups() {
+		if err := attachBackends(ctx, s, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachBackends adds or updates the backend of every group in the config.
+func attachBackends(ctx context.Context, s *compute.Service, c *policyConfig) error {
+	bs, err := s.BackendServices.Get(c.Project, c.BackendService).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to get backend service %v: %v", c.BackendService, err)
+	}
+	backends := bs.Backends
+	for _, bc := range c.backendGroups() {
+		m, err := getGroupManager(ctx, s, bc)
+		if err != nil {
+			return err
+		}
+		b := bc.backend(m.InstanceGroup)
+		replaced := false
+		for i, old := range backends {
+			if path.Base(old.Group) == path.Base(m.InstanceGroup) && instanceZone(old.Group) == instanceZone(m.InstanceGroup) {
+				backends[i], replaced = b, true
+			}
+		}
+		if !replaced {
+			backends = append(backends, b)
+		}
+		log.Printf("%v in %v: %v, max utilization %v, max rate %v/instance, capacity %v.", bc.Group,
+			bc.location(), b.BalancingMode, b.MaxUtilization, b.MaxRatePerInstance, b.CapacityScaler)
+	}
+	op, err := s.BackendServices.Patch(c.Project, c.BackendService, &compute.BackendService{
+		Backends:    backends,
+		Fingerprint: bs.Fingerprint,
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to update backend service %v: %v", c.BackendService, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	log.Printf("Backend service %v has %d backends.", c.BackendService, len(backends))
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Line the builder writes to its serial console when the install steps
+// finish, followed by their exit status.
+const bakeDoneMarker = "httplb-autoscaling-bake-finished"
+
+var bakeDonePattern = regexp.MustCompile(bakeDoneMarker + ` (\d+)`)
+
+// A bakeConfig describes how to bake a custom image with the backend's
+// software preinstalled, so that new instances skip the install steps:
+//
+//	instanceTemplate:
+//	  bake:
+//	    installScript: compute/scripts/install.sh
+//	    runScript: compute/scripts/run.sh
+//	    family: image-processing-baked
+type bakeConfig struct {
+	// InstallScript is run once on the builder.
+	InstallScript string `yaml:"installScript"`
+	// RunScript is the startup script of instances booted from the baked
+	// image; it only has to start the server.
+	RunScript string `yaml:"runScript"`
+	// Family is the image family of the baked images. It defaults to the
+	// template name followed by "-baked".
+	Family string `yaml:"family"`
+}
+
+// bakeFamily returns the image family baked images of the config join.
+func (c *policyConfig) bakeFamily() string {
+	if t := c.InstanceTemplate; t != nil && t.Bake != nil && t.Bake.Family != "" {
+		return t.Bake.Family
+	}
+	return c.Template + "-baked"
+}
+
+// bakeZone returns the zone the builder runs in.
+func (c *policyConfig) bakeZone() string {
+	if c.Zone != "" {
+		return c.Zone
+	}
+	if len(c.Zones) > 0 {
+		return c.Zones[0]
+	}
+	return c.Region + "-b"
+}
+
+// builderInstance turns template properties into a builder instance.
+func builderInstance(zone, name string, p *compute.InstanceProperties) *compute.Instance {
+	for _, d := range p.Disks {
+		// The disk outlives the stopped builder until it is imaged, and goes
+		// with it when it is deleted.
+		d.AutoDelete = true
+		if d.InitializeParams != nil && d.InitializeParams.DiskType != "" {
+			d.InitializeParams.DiskType = fmt.Sprintf("zones/%s/diskTypes/%s", zone, d.InitializeParams.DiskType)
+		}
+	}
+	return &compute.Instance{
+		Name:              name,
+		MachineType:       fmt.Sprintf("zones/%s/machineTypes/%s", zone, p.MachineType),
+		Disks:             p.Disks,
+		NetworkInterfaces: p.NetworkInterfaces,
+		Metadata:          p.Metadata,
+		ServiceAccounts:   p.ServiceAccounts,
+		Tags:              p.Tags,
+		Labels:            p.Labels,
+	}
+}
+
+// waitForBake polls the builder's serial console until the install steps
+// report that they finished, returning an error if they failed.
+func waitForBake(ctx context.Context, s *compute.Service, project, zone, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var next int64
+	for {
+		out, err := s.Instances.GetSerialPortOutput(project, zone, name).Start(next).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to read serial console of %v: %v", name, err)
+		}
+		next = out.Next
+		if m := bakeDonePattern.FindStringSubmatch(out.Contents); m != nil {
+			endProgress()
+			if status, _ := strconv.Atoi(m[1]); status != 0 {
+				return fmt.Errorf("install script failed with status %d; see the serial console of %v", status, name)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("install script did not finish within %v", timeout)
+		}
+		progressf("Waiting for the install script on %v, %v left.", name, time.Until(deadline).Round(time.Second))
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// bakeCmd boots a builder instance, runs the install script on it, stops it
+// and images its disk into the bake family. Templates created with
+// template create -baked then boot from the newest image of the family.
+func bakeCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("template bake", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	timeout := fs.Duration("timeout", 20*time.Minute, "How long to wait for the install script.")
+	keep := fs.Bool("keep-builder", false, "Leave the builder instance running if the bake fails, for debugging.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.InstanceTemplate == nil || c.InstanceTemplate.Bake == nil || c.InstanceTemplate.Bake.InstallScript == "" {
+		return errors.New("config has no instanceTemplate.bake.installScript")
+	}
+	install, err := ioutil.ReadFile(c.InstanceTemplate.Bake.InstallScript)
+	if err != nil {
+		return fmt.Errorf("unable to read install script: %v", err)
+	}
+	id, err := runID(c, *statePath)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		id = time.Now().UTC().Format(runIDLayout)
+		audit.setRun(id)
+	}
+
+	// The builder boots from the template's usual image, running only the
+	// install script.
+	t := *c.InstanceTemplate
+	t.StartupScript, t.Server, t.Container, t.Scheduling = "", nil, nil, nil
+	t.Metadata = nil
+	t = t.withDefaults()
+	name := fmt.Sprintf("%s-builder-%s", c.Template, id)
+	it, err := t.instanceTemplate(c.Project, name, id)
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf("#!/bin/bash\n(\n%s\n)\necho \"%s $?\" > /dev/ttyS0\n", install, bakeDoneMarker)
+	it.Properties.Metadata.Items = append(it.Properties.Metadata.Items,
+		&compute.MetadataItems{Key: startupScriptKey, Value: &script})
+
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	zone := c.bakeZone()
+	op, err := s.Instances.Insert(c.Project, zone, builderInstance(zone, name, it.Properties)).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to create builder %v: %v", name, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	log.Printf("Builder %v started in %v; running %v.", name, zone, c.InstanceTemplate.Bake.InstallScript)
+	start := time.Now()
+	deleteBuilder := func() {
+		op, err := s.Instances.Delete(c.Project, zone, name).Context(ctx).Do()
+		if err == nil {
+			err = waitForOperation(ctx, s, c.Project, op)
+		}
+		if err != nil {
+			log.Printf("Unable to delete builder %v: %v", name, err)
+		}
+	}
+	if err := waitForBake(ctx, s, c.Project, zone, name, *timeout); err != nil {
+		if !*keep {
+			deleteBuilder()
+		}
+		return err
+	}
+	log.Printf("Install script finished after %v; stopping %v.", time.Since(start), name)
+	if op, err = s.Instances.Stop(c.Project, zone, name).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to stop builder %v: %v", name, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+
+	image := &compute.Image{
+		Name:        fmt.Sprintf("%s-%s", c.bakeFamily(), id),
+		Family:      c.bakeFamily(),
+		SourceDisk:  fmt.Sprintf("zones/%s/disks/%s", zone, name),
+		Description: resourceDescription("Baked by template bake.", id),
+		Labels:      resourceLabels(id),
+	}
+	if op, err = s.Images.Insert(c.Project, image).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to create image %v: %v", image.Name, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	deleteBuilder()
+	log.Printf("Baked image %v into family %v.", image.Name, image.Family)
+	log.Printf("Run template create -baked to boot from it.")
+	fmt.Println(image.Name)
+	return nil
+}
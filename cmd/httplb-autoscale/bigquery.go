@@ -0,0 +1,442 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	bigquery "google.golang.org/api/bigquery/v2"
+)
+
+// Rows sent to BigQuery per insertAll call; the API accepts up to 50,000
+// but recommends about 500.
+const bqInsertBatch = 500
+
+// The TIMESTAMP format accepted by streaming inserts.
+const bqTimestamp = "2006-01-02 15:04:05.000000"
+
+// A bqTable is one of the tables the export writes, with its schema. The
+// schema here is authoritative: missing tables are created from it and
+// columns added to it are added to existing tables. Columns are never
+// removed or retyped, so older rows stay readable.
+type bqTable struct {
+	name        string
+	description string
+	// partition is the TIMESTAMP column the table is partitioned on by day.
+	partition string
+	fields    []*bigquery.TableFieldSchema
+}
+
+// bqField returns a nullable column.
+func bqField(name, typ, description string) *bigquery.TableFieldSchema {
+	return &bigquery.TableFieldSchema{Name: name, Type: typ, Mode: "NULLABLE", Description: description}
+}
+
+// The tables of the export. Every row carries the run's ID and name so that
+// runs can be joined across tables and compared over time.
+var (
+	bqRunsTable = &bqTable{
+		name:        "runs",
+		description: "One row per run and predictive autoscaling method, as in report summary.",
+		partition:   "start_time",
+		fields: []*bigquery.TableFieldSchema{
+			bqField("run_id", "STRING", "Run ID the run's resources are labelled with."),
+			bqField("run_name", "STRING", "Name of the run, by default its watch file."),
+			bqField("group", "STRING", "Managed instance group."),
+			bqField("predictive_method", "STRING", "Predictive autoscaling method in effect."),
+			bqField("start_time", "TIMESTAMP", "First watch event of the run."),
+			bqField("end_time", "TIMESTAMP", "Last watch event of the run."),
+			bqField("duration_sec", "FLOAT", "Time spent under the predictive method."),
+			bqField("peak_target", "INTEGER", "Largest target size."),
+			bqField("mean_size", "FLOAT", "Time weighted mean number of instances."),
+			bqField("instance_hours", "FLOAT", "Instance hours used."),
+			bqField("scale_outs", "INTEGER", "Number of target size increases."),
+			bqField("scale_ins", "INTEGER", "Number of target size decreases."),
+			bqField("boots", "INTEGER", "Instances which started serving."),
+			bqField("boot_p50_sec", "FLOAT", "Median creation to serving time."),
+			bqField("boot_p90_sec", "FLOAT", "90th percentile creation to serving time."),
+			bqField("flapping", "INTEGER", "Instances flagged as flapping."),
+			bqField("requests", "INTEGER", "Requests sent by the load generator."),
+			bqField("errors", "INTEGER", "Requests which failed."),
+			bqField("p50_ms", "FLOAT", "Median latency; the worst interval's unless request samples were exported."),
+			bqField("p95_ms", "FLOAT", "95th percentile latency, likewise."),
+			bqField("p99_ms", "FLOAT", "99th percentile latency, likewise."),
+			bqField("exported_at", "TIMESTAMP", "When the row was exported."),
+		},
+	}
+	bqIntervalsTable = &bqTable{
+		name:        "intervals",
+		description: "The merged timeline of each run, as written by report merge.",
+		partition:   "time",
+		fields: []*bigquery.TableFieldSchema{
+			bqField("run_id", "STRING", ""),
+			bqField("run_name", "STRING", ""),
+			bqField("time", "TIMESTAMP", "Start of the interval."),
+			bqField("mode", "STRING", "Autoscaler mode."),
+			bqField("recommended_size", "INTEGER", ""),
+			bqField("target_size", "INTEGER", ""),
+			bqField("actual_size", "INTEGER", ""),
+			bqField("running_size", "INTEGER", ""),
+			bqField("requests", "INTEGER", ""),
+			bqField("errors", "INTEGER", ""),
+			bqField("p50_ms", "FLOAT", ""),
+			bqField("p95_ms", "FLOAT", ""),
+			bqField("p99_ms", "FLOAT", ""),
+			{Name: "metrics", Type: "RECORD", Mode: "REPEATED", Description: "Load balancer series at the end of the interval.",
+				Fields: []*bigquery.TableFieldSchema{bqField("name", "STRING", ""), bqField("value", "FLOAT", "")}},
+			{Name: "events", Type: "STRING", Mode: "REPEATED", Description: "Watch events during the interval."},
+		},
+	}
+	bqRequestsTable = &bqTable{
+		name:        "requests",
+		description: "Every request of a run, as written by autoscaler experiment -requests.",
+		partition:   "start",
+		fields: []*bigquery.TableFieldSchema{
+			bqField("run_id", "STRING", ""),
+			bqField("run_name", "STRING", ""),
+			bqField("start", "TIMESTAMP", ""),
+			bqField("latency_ms", "FLOAT", ""),
+			bqField("ok", "BOOLEAN", ""),
+			bqField("zone", "STRING", "Serving backend's zone."),
+		},
+	}
+)
+
+// A bqExporter writes rows to the tables of one dataset.
+type bqExporter struct {
+	bq       *bigquery.Service
+	project  string
+	dataset  string
+	location string
+	// prefix is prepended to every table name.
+	prefix string
+}
+
+// ensureDataset creates the dataset if it does not exist.
+func (x *bqExporter) ensureDataset(ctx context.Context) error {
+	_, err := x.bq.Datasets.Get(x.project, x.dataset).Context(ctx).Do()
+	if err == nil || !mig.IsNotFound(err) {
+		return err
+	}
+	log.Printf("Creating dataset %v in %v.", x.dataset, x.location)
+	_, err = x.bq.Datasets.Insert(x.project, &bigquery.Dataset{
+		DatasetReference: &bigquery.DatasetReference{ProjectId: x.project, DatasetId: x.dataset},
+		Location:         x.location,
+	}).Context(ctx).Do()
+	return err
+}
+
+// ensureTable creates the table if it does not exist, and otherwise adds
+// any columns of the schema it lacks. It fails if an existing column's type
+// differs from the schema's.
+func (x *bqExporter) ensureTable(ctx context.Context, t *bqTable) error {
+	name := x.prefix + t.name
+	existing, err := x.bq.Tables.Get(x.project, x.dataset, name).Context(ctx).Do()
+	if mig.IsNotFound(err) {
+		log.Printf("Creating table %v.%v.", x.dataset, name)
+		_, err = x.bq.Tables.Insert(x.project, x.dataset, &bigquery.Table{
+			TableReference:   &bigquery.TableReference{ProjectId: x.project, DatasetId: x.dataset, TableId: name},
+			Description:      t.description,
+			Schema:           &bigquery.TableSchema{Fields: t.fields},
+			TimePartitioning: &bigquery.TimePartitioning{Type: "DAY", Field: t.partition},
+		}).Context(ctx).Do()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	have := map[string]*bigquery.TableFieldSchema{}
+	var fields []*bigquery.TableFieldSchema
+	if existing.Schema != nil {
+		fields = existing.Schema.Fields
+	}
+	for _, f := range fields {
+		have[f.Name] = f
+	}
+	var added []string
+	for _, f := range t.fields {
+		h, ok := have[f.Name]
+		if !ok {
+			fields = append(fields, f)
+			added = append(added, f.Name)
+			continue
+		}
+		if h.Type != f.Type && !(h.Type == "FLOAT64" && f.Type == "FLOAT") && !(h.Type == "INT64" && f.Type == "INTEGER") {
+			return fmt.Errorf("column %v of %v.%v is %v, not %v", f.Name, x.dataset, name, h.Type, f.Type)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	log.Printf("Adding columns %s to %v.%v.", strings.Join(added, ", "), x.dataset, name)
+	_, err = x.bq.Tables.Patch(x.project, x.dataset, name, &bigquery.Table{
+		Schema: &bigquery.TableSchema{Fields: fields},
+	}).Context(ctx).Do()
+	return err
+}
+
+// insert streams rows into a table in batches. Each row's insert ID is
+// derived from idPrefix and its index, so exporting a run twice in quick
+// succession does not duplicate it.
+func (x *bqExporter) insert(ctx context.Context, t *bqTable, idPrefix string, rows []map[string]bigquery.JsonValue) error {
+	name := x.prefix + t.name
+	for first := 0; first < len(rows); first += bqInsertBatch {
+		last := first + bqInsertBatch
+		if last > len(rows) {
+			last = len(rows)
+		}
+		req := &bigquery.TableDataInsertAllRequest{}
+		for i := first; i < last; i++ {
+			req.Rows = append(req.Rows, &bigquery.TableDataInsertAllRequestRows{
+				InsertId: fmt.Sprintf("%s/%s/%d", idPrefix, t.name, i),
+				Json:     rows[i],
+			})
+		}
+		resp, err := x.bq.Tabledata.InsertAll(x.project, x.dataset, name, req).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to insert into %v.%v: %v", x.dataset, name, err)
+		}
+		if len(resp.InsertErrors) > 0 {
+			e := resp.InsertErrors[0]
+			msg := "unknown error"
+			if len(e.Errors) > 0 {
+				msg = e.Errors[0].Message
+			}
+			return fmt.Errorf("unable to insert %d rows into %v.%v, row %d: %v", len(resp.InsertErrors), x.dataset, name, first+int(e.Index), msg)
+		}
+	}
+	log.Printf("Inserted %d rows into %v.%v.", len(rows), x.dataset, name)
+	return nil
+}
+
+// bqTime formats a time for a TIMESTAMP column.
+func bqTime(t time.Time) string {
+	return t.UTC().Format(bqTimestamp)
+}
+
+// runRows builds the run summary rows of a run, one per predictive method.
+func runRows(base map[string]bigquery.JsonValue, group string, events []*report.WatchEvent, merged []*mergedRow, samples []*loadgen.RequestSample) []map[string]bigquery.JsonValue {
+	summaries := map[string]*report.ModeSummary{}
+	report.SummarizeRun(summaries, events)
+	var requests, errs int
+	var p50, p95, p99 float64
+	if samples != nil {
+		var latencies []time.Duration
+		for _, s := range samples {
+			requests++
+			if !s.OK {
+				errs++
+				continue
+			}
+			latencies = append(latencies, time.Duration(s.LatencyMs*float64(time.Millisecond)))
+		}
+		sort.Sort(report.Durations(latencies))
+		p50, p95, p99 = report.Millis(report.Percentile(latencies, 0.5)), report.Millis(report.Percentile(latencies, 0.95)), report.Millis(report.Percentile(latencies, 0.99))
+	} else {
+		for _, r := range merged {
+			requests += r.Requests
+			errs += r.Errors
+			p50, p95, p99 = maxFloat(p50, r.P50Ms), maxFloat(p95, r.P95Ms), maxFloat(p99, r.P99Ms)
+		}
+	}
+	start, end := eventsWindow(events)
+	now := bqTime(time.Now())
+	modes := make([]string, 0, len(summaries))
+	for mode := range summaries {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	var rows []map[string]bigquery.JsonValue
+	for _, mode := range modes {
+		m := summaries[mode]
+		sort.Sort(report.Durations(m.BootTimes))
+		row := map[string]bigquery.JsonValue{
+			"group":             group,
+			"predictive_method": m.Mode,
+			"start_time":        bqTime(start),
+			"end_time":          bqTime(end),
+			"duration_sec":      m.Duration.Seconds(),
+			"peak_target":       m.PeakTarget,
+			"mean_size":         m.MeanSize(),
+			"instance_hours":    m.InstanceHours,
+			"scale_outs":        m.ScaleOuts,
+			"scale_ins":         m.ScaleIns,
+			"boots":             len(m.BootTimes),
+			"boot_p50_sec":      report.Percentile(m.BootTimes, 0.5).Seconds(),
+			"boot_p90_sec":      report.Percentile(m.BootTimes, 0.9).Seconds(),
+			"flapping":          len(m.Flapping),
+			"exported_at":       now,
+		}
+		// Load covers the whole run, so it is reported once per run.
+		if len(modes) == 1 {
+			row["requests"], row["errors"] = requests, errs
+			row["p50_ms"], row["p95_ms"], row["p99_ms"] = p50, p95, p99
+		}
+		for k, v := range base {
+			row[k] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// intervalRows converts a merged timeline into rows.
+func intervalRows(base map[string]bigquery.JsonValue, merged []*mergedRow) []map[string]bigquery.JsonValue {
+	var rows []map[string]bigquery.JsonValue
+	for _, r := range merged {
+		names := make([]string, 0, len(r.Metrics))
+		for name := range r.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		metrics := make([]map[string]interface{}, len(names))
+		for i, name := range names {
+			metrics[i] = map[string]interface{}{"name": name, "value": r.Metrics[name]}
+		}
+		row := map[string]bigquery.JsonValue{
+			"time":             bqTime(r.Time),
+			"mode":             r.Mode,
+			"recommended_size": r.RecommendedSize,
+			"target_size":      r.TargetSize,
+			"actual_size":      r.ActualSize,
+			"running_size":     r.RunningSize,
+			"requests":         r.Requests,
+			"errors":           r.Errors,
+			"p50_ms":           r.P50Ms,
+			"p95_ms":           r.P95Ms,
+			"p99_ms":           r.P99Ms,
+			"metrics":          metrics,
+			"events":           r.Events,
+		}
+		for k, v := range base {
+			row[k] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// requestRows converts request samples into rows.
+func requestRows(base map[string]bigquery.JsonValue, samples []*loadgen.RequestSample) []map[string]bigquery.JsonValue {
+	rows := make([]map[string]bigquery.JsonValue, len(samples))
+	for i, s := range samples {
+		row := map[string]bigquery.JsonValue{
+			"start":      bqTime(s.Start),
+			"latency_ms": s.LatencyMs,
+			"ok":         s.OK,
+			"zone":       s.Zone,
+		}
+		for k, v := range base {
+			row[k] = v
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// reportBigQueryCmd exports a run to BigQuery for trending across runs: its
+// summary, its merged timeline and optionally every request. Tables are
+// created, or missing columns added, before rows are appended.
+func reportBigQueryCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report bigquery", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	watchPath := fs.String("watch", "", "Watch event file of the run.")
+	mergedPath := fs.String("merged", "", "Merged timeline of the run, as written by report merge or autoscaler experiment.")
+	requestsPath := fs.String("requests", "", "Request samples of the run, as written by autoscaler experiment -requests.")
+	name := fs.String("name", "", "Name of the run; defaults to the watch file's name.")
+	dataset := fs.String("dataset", "", "BigQuery dataset to write to; created if missing.")
+	location := fs.String("location", "US", "Location of the dataset, if it has to be created.")
+	prefix := fs.String("table-prefix", "", "Prefix of the table names.")
+	fs.Parse(args)
+	if *watchPath == "" || *dataset == "" {
+		return errors.New("-watch and -dataset are required")
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(*watchPath), filepath.Ext(*watchPath))
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	id, err := runID(c, defaultStatePath)
+	if err != nil {
+		return err
+	}
+	events, err := report.ReadWatchEvents(*watchPath)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%v has no events", *watchPath)
+	}
+	var merged []*mergedRow
+	if *mergedPath != "" {
+		if merged, err = readMergedRun(*mergedPath); err != nil {
+			return err
+		}
+	}
+	var samples []*loadgen.RequestSample
+	if *requestsPath != "" {
+		if samples, err = readRequestSamples(*requestsPath); err != nil {
+			return err
+		}
+	}
+
+	bq, err := newBigQueryService()
+	if err != nil {
+		return fmt.Errorf("failed to create BigQuery client: %v", err)
+	}
+	x := &bqExporter{bq: bq, project: c.projectFor(bigqueryProjects), dataset: *dataset, location: *location, prefix: *prefix}
+	if err := x.ensureDataset(ctx); err != nil {
+		return fmt.Errorf("unable to create dataset %v: %v", *dataset, err)
+	}
+	base := map[string]bigquery.JsonValue{"run_id": id, "run_name": *name}
+	idPrefix := *name
+	if id != "" {
+		idPrefix = id + "/" + *name
+	}
+	exports := []struct {
+		t    *bqTable
+		rows []map[string]bigquery.JsonValue
+	}{
+		{bqRunsTable, runRows(base, c.Group, events, merged, samples)},
+		{bqIntervalsTable, intervalRows(base, merged)},
+		{bqRequestsTable, requestRows(base, samples)},
+	}
+	for _, e := range exports {
+		if len(e.rows) == 0 {
+			continue
+		}
+		if err := x.ensureTable(ctx, e.t); err != nil {
+			return fmt.Errorf("unable to prepare table %v: %v", *prefix+e.t.name, err)
+		}
+		if err := x.insert(ctx, e.t, idPrefix, e.rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
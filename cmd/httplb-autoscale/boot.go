@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A bootTracker measures how long each instance the group creates takes to
+// pass the load balancer's health check, from the moment the group starts
+// creating it.
+type bootTracker struct {
+	// backendService is the load balancer backend service the group serves.
+	backendService string
+	// seen records every instance observed so far. Instances which already
+	// existed when tracking began are never measured.
+	seen    map[string]bool
+	pending map[string]time.Time
+	started bool
+	times   []time.Duration
+}
+
+// observe records the instances in the latest sample of the group. For each
+// instance which has just become healthy it returns an "instance-serving"
+// event based on e.
+func (b *bootTracker) observe(ctx context.Context, s *compute.Service, c *policyConfig, mig *compute.InstanceGroupManager, instances []*compute.ManagedInstance, e *report.WatchEvent) ([]*report.WatchEvent, error) {
+	if b.seen == nil {
+		b.seen = make(map[string]bool)
+		b.pending = make(map[string]time.Time)
+	}
+	for _, i := range instances {
+		name := path.Base(i.Instance)
+		if b.seen[name] {
+			continue
+		}
+		b.seen[name] = true
+		if b.started || i.CurrentAction == "CREATING" {
+			b.pending[name] = e.Time
+		}
+	}
+	b.started = true
+	if len(b.pending) == 0 {
+		return nil, nil
+	}
+
+	health, err := s.BackendServices.GetHealth(c.Project, b.backendService, &compute.ResourceGroupReference{
+		Group: mig.InstanceGroup,
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get health of %v: %v", b.backendService, err)
+	}
+	var events []*report.WatchEvent
+	for _, h := range health.HealthStatus {
+		name := path.Base(h.Instance)
+		created, ok := b.pending[name]
+		if !ok || h.HealthState != "HEALTHY" {
+			continue
+		}
+		delete(b.pending, name)
+		d := e.Time.Sub(created)
+		b.times = append(b.times, d)
+		ev := *e
+		ev.Type = "instance-serving"
+		ev.Instance = name
+		ev.ServingSeconds = d.Seconds()
+		ev.Message = fmt.Sprintf("instance %v began serving %v after creation", name, d)
+		events = append(events, &ev)
+	}
+	return events, nil
+}
+
+// logDistribution prints summary statistics of the measured boot times.
+func (b *bootTracker) logDistribution() {
+	if len(b.times) == 0 {
+		log.Printf("No new instances began serving.")
+		return
+	}
+	sorted := make([]time.Duration, len(b.times))
+	copy(sorted, b.times)
+	sort.Sort(report.Durations(sorted))
+	log.Printf("Creation to serving for %d instances: min %v, p50 %v, p90 %v, max %v.", len(sorted),
+		sorted[0], report.Percentile(sorted, 0.5), report.Percentile(sorted, 0.9), sorted[len(sorted)-1])
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A budgetConfig caps what a load test may spend on instances. Throughout
+// the run, the cost so far plus that of the group's current size until the
+// scenario ends is projected; once the projection exceeds the cap, the run
+// is aborted, or the autoscaler's maximum is lowered to the size the rest
+// of the budget affords:
+//
+//	budget:
+//	  maxCostUsd: 25
+//	  action: scale-down
+//
+// autoscaler experiment, demo run and autoscaler soak enforce it.
+type budgetConfig struct {
+	MaxCostUSD float64 `yaml:"maxCostUsd"`
+	// Action is abort, the default, or scale-down, which still aborts if
+	// not even the minimum size is affordable.
+	Action string `yaml:"action"`
+	// InstancePrice is the hourly price of one instance. It defaults to the
+	// estimate for the template's machine type.
+	InstancePrice float64 `yaml:"instancePrice"`
+}
+
+// check verifies that the budget can be enforced.
+func (b *budgetConfig) check() error {
+	switch {
+	case b.MaxCostUSD <= 0:
+		return errors.New("maxCostUsd must be positive")
+	case b.Action != "" && b.Action != "abort" && b.Action != "scale-down":
+		return fmt.Errorf("action must be abort or scale-down, not %q", b.Action)
+	case b.InstancePrice < 0:
+		return errors.New("instancePrice must not be negative")
+	}
+	return nil
+}
+
+// A budgetGuard enforces a config's budget on one run.
+type budgetGuard struct {
+	b     *budgetConfig
+	price float64
+	// end is when the scenario is due to finish.
+	end time.Time
+	// spent is what the instances have cost up to last, at lastSize
+	// instances since then.
+	spent    float64
+	last     time.Time
+	lastSize int64
+	// capped is the maximum size scale-down set, or zero.
+	capped int64
+	// abort stops the run; exceeded then says why.
+	abort    func()
+	exceeded string
+}
+
+// newBudgetGuard returns a guard for a run of the config ending at end,
+// which calls abort if the run has to stop.
+func newBudgetGuard(c *policyConfig, end time.Time, abort func()) (*budgetGuard, error) {
+	price := c.Budget.InstancePrice
+	if price == 0 {
+		var t templateConfig
+		if c.InstanceTemplate != nil {
+			t = *c.InstanceTemplate
+		}
+		var err error
+		if price, err = instanceHourlyPrice(t); err != nil {
+			return nil, fmt.Errorf("unable to enforce the budget: %v; set budget.instancePrice", err)
+		}
+	}
+	log.Printf("Enforcing a budget of $%.2f at $%.4f per instance hour.", c.Budget.MaxCostUSD, price)
+	return &budgetGuard{b: c.Budget, price: price, end: end, abort: abort}, nil
+}
+
+// observe accounts for a sample of the group and acts if the projected cost
+// of the run exceeds the budget, returning the alert it raised, if any.
+func (g *budgetGuard) observe(ctx context.Context, s *compute.Service, c *policyConfig, e *report.WatchEvent) *report.WatchEvent {
+	if !g.last.IsZero() {
+		g.spent += float64(g.lastSize) * e.Time.Sub(g.last).Hours() * g.price
+	}
+	// Instances being created are paid for as soon as they boot.
+	size := e.ActualSize
+	if e.TargetSize > size {
+		size = e.TargetSize
+	}
+	g.last, g.lastSize = e.Time, size
+	if g.exceeded != "" {
+		return nil
+	}
+	remaining := g.end.Sub(e.Time).Hours()
+	if remaining < 0 {
+		remaining = 0
+	}
+	projected := g.spent + float64(size)*g.price*remaining
+	if projected <= g.b.MaxCostUSD {
+		return nil
+	}
+	if g.b.Action == "scale-down" && remaining > 0 {
+		affordable := int64((g.b.MaxCostUSD - g.spent) / (g.price * remaining))
+		min := c.MinReplicas
+		if min < 1 {
+			min = 1
+		}
+		if affordable >= min {
+			if g.capped != 0 && affordable >= g.capped {
+				// The group is still shrinking to the earlier cap.
+				return nil
+			}
+			if err := capAutoscaler(ctx, s, c, affordable); err != nil {
+				log.Printf("Unable to scale down within the budget: %v", err)
+			} else {
+				g.capped = affordable
+				return raiseAlert("", e, "budget-scaled-down", fmt.Sprintf("projected cost $%.2f exceeds the budget of $%.2f; "+
+					"limited %v to %d replicas", projected, g.b.MaxCostUSD, c.Autoscaler, affordable))
+			}
+		}
+	}
+	g.exceeded = fmt.Sprintf("projected cost $%.2f of %d instances exceeds the budget of $%.2f, $%.2f spent so far",
+		projected, size, g.b.MaxCostUSD, g.spent)
+	g.abort()
+	return raiseAlert("", e, "budget-exceeded", "aborting: "+g.exceeded)
+}
+
+// capAutoscaler lowers the autoscaler's maximum number of replicas.
+func capAutoscaler(ctx context.Context, s *compute.Service, c *policyConfig, max int64) error {
+	patch := &compute.Autoscaler{
+		Name:              c.Autoscaler,
+		AutoscalingPolicy: &compute.AutoscalingPolicy{MaxNumReplicas: max},
+	}
+	op, err := patchAutoscaler(ctx, s, c, patch)
+	if err != nil {
+		return fmt.Errorf("unable to patch autoscaler %v: %v", c.Autoscaler, err)
+	}
+	return waitForOperation(ctx, s, c.Project, op)
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+)
+
+// Names of the group's versions. A group normally runs only the stable
+// version; during a canary a share of it runs the canary version.
+const (
+	stableVersion = "stable"
+	canaryVersion = "canary"
+)
+
+// groupVersions returns the templates of the group's stable and canary
+// versions. The canary is empty if none is running. Groups which were not
+// updated by these commands have a single unnamed version, which is treated
+// as the stable one.
+func groupVersions(m *compute.InstanceGroupManager) (stable, canary string) {
+	for _, v := range m.Versions {
+		switch v.Name {
+		case canaryVersion:
+			canary = v.InstanceTemplate
+		default:
+			if stable == "" {
+				stable = v.InstanceTemplate
+			}
+		}
+	}
+	if stable == "" {
+		stable = m.InstanceTemplate
+	}
+	return stable, canary
+}
+
+// canaryCommandSetup loads the config and the group shared by the canary
+// commands.
+func canaryCommandSetup(ctx context.Context, fs *flag.FlagSet, args []string, configPath *string) (*compute.Service, *policyConfig, *compute.InstanceGroupManager, error) {
+	fs.Parse(args)
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return s, c, m, nil
+}
+
+// canaryCmd moves a percentage of the group onto a second template, leaving
+// the rest on the current one. Running it again changes the percentage.
+func canaryCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig canary", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	template := fs.String("template", "", "Canary template. Defaults to the running canary, or else the newest one made by template create.")
+	percent := fs.Int64("percent", 10, "Percentage of the group to run on the canary template.")
+	uf := addUpdateFlags(fs)
+	s, c, m, err := canaryCommandSetup(ctx, fs, args, configPath)
+	if err != nil {
+		return err
+	}
+	if *percent < 1 || *percent > 99 {
+		return errors.New("-percent must be between 1 and 99; use mig rollout to move the whole group")
+	}
+	stable, canary := groupVersions(m)
+	if *template != "" {
+		canary = mig.TemplateURL(c.Project, *template)
+	}
+	if canary == "" {
+		t, err := currentTemplate(c, *statePath)
+		if err != nil {
+			return err
+		}
+		if t != "" {
+			canary = mig.TemplateURL(c.Project, t)
+		}
+	}
+	if canary == "" || path.Base(canary) == path.Base(stable) {
+		return errors.New("no canary template other than the one the group already runs; pass -template")
+	}
+	return applyVersions(ctx, s, c, uf, []*compute.InstanceGroupManagerVersion{
+		{Name: stableVersion, InstanceTemplate: stable},
+		{
+			Name:             canaryVersion,
+			InstanceTemplate: canary,
+			TargetSize:       &compute.FixedOrPercent{Percent: *percent},
+		},
+	})
+}
+
+// promoteCanaryCmd moves the whole group onto the canary template, which
+// becomes the stable version.
+func promoteCanaryCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig promote", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	uf := addUpdateFlags(fs)
+	s, c, m, err := canaryCommandSetup(ctx, fs, args, configPath)
+	if err != nil {
+		return err
+	}
+	_, canary := groupVersions(m)
+	if canary == "" {
+		return fmt.Errorf("group %v has no canary to promote", c.Group)
+	}
+	return applyVersions(ctx, s, c, uf, []*compute.InstanceGroupManagerVersion{
+		{Name: stableVersion, InstanceTemplate: canary},
+	})
+}
+
+// rollbackCanaryCmd moves the canary instances back onto the stable
+// template.
+func rollbackCanaryCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig rollback", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	uf := addUpdateFlags(fs)
+	s, c, m, err := canaryCommandSetup(ctx, fs, args, configPath)
+	if err != nil {
+		return err
+	}
+	stable, canary := groupVersions(m)
+	if canary == "" {
+		return fmt.Errorf("group %v has no canary to roll back", c.Group)
+	}
+	return applyVersions(ctx, s, c, uf, []*compute.InstanceGroupManagerVersion{
+		{Name: stableVersion, InstanceTemplate: stable},
+	})
+}
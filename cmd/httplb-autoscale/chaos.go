@@ -0,0 +1,147 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"path"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A chaosConfig makes a load test fail instances of the group on purpose,
+// to check that autohealing and autoscaling together keep it serving:
+//
+//	chaos:
+//	  action: delete
+//	  fraction: 0.2
+//	  interval: 3m
+//	  startAfter: 2m
+//
+// Deleting an instance behind the group's back makes the group recreate it,
+// like a crashed host; resetting it reboots it in place, failing its health
+// checks for a while. autoscaler experiment and demo run apply it to every
+// trial; autoscaler watch only with -chaos.
+type chaosConfig struct {
+	// Action is delete, the default, or reset.
+	Action string `yaml:"action"`
+	// Fraction of the running instances acted on every interval, rounded
+	// up, so at least one.
+	Fraction float64       `yaml:"fraction"`
+	Interval time.Duration `yaml:"interval"`
+	// StartAfter delays the first action from the start of the watch.
+	StartAfter time.Duration `yaml:"startAfter"`
+	// Seed makes the choice of instances repeatable; zero seeds from the
+	// clock.
+	Seed int64 `yaml:"seed"`
+}
+
+// check verifies that the chaos config can be acted on.
+func (cc *chaosConfig) check() error {
+	switch {
+	case cc.Action != "" && cc.Action != "delete" && cc.Action != "reset":
+		return fmt.Errorf("action must be delete or reset, not %q", cc.Action)
+	case cc.Fraction <= 0 || cc.Fraction > 1:
+		return errors.New("fraction must be more than 0 and at most 1")
+	case cc.Interval <= 0:
+		return errors.New("interval must be positive")
+	case cc.StartAfter < 0:
+		return errors.New("startAfter must not be negative")
+	}
+	return nil
+}
+
+// chaosDone describes each chaos action once done, for logs and events.
+var chaosDone = map[string]string{"delete": "deleted", "reset": "reset"}
+
+// A chaosController fails a fraction of the group's instances at intervals
+// while the watcher polls, and returns a "chaos-delete" or "chaos-reset"
+// event for each instance it acts on.
+type chaosController struct {
+	cc   chaosConfig
+	rand *rand.Rand
+	// next is when the next round of actions is due.
+	next time.Time
+}
+
+// newChaosController returns a controller acting on cc, or an error if cc
+// is invalid.
+func newChaosController(cc *chaosConfig) (*chaosController, error) {
+	if err := cc.check(); err != nil {
+		return nil, fmt.Errorf("invalid chaos config: %v", err)
+	}
+	seed := cc.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ch := &chaosController{cc: *cc, rand: rand.New(rand.NewSource(seed))}
+	if ch.cc.Action == "" {
+		ch.cc.Action = "delete"
+	}
+	return ch, nil
+}
+
+// observe acts on the instances of the latest sample if a round is due, and
+// returns an event based on e for every instance acted on.
+func (ch *chaosController) observe(ctx context.Context, s *compute.Service, c *policyConfig, instances []*compute.ManagedInstance, e *report.WatchEvent) ([]*report.WatchEvent, error) {
+	if ch.next.IsZero() {
+		ch.next = e.Time.Add(ch.cc.StartAfter)
+	}
+	if e.Time.Before(ch.next) {
+		return nil, nil
+	}
+	ch.next = e.Time.Add(ch.cc.Interval)
+
+	// Only act on instances which are serving, or a round could keep
+	// hitting the ones still being recreated from the last.
+	var running []*compute.ManagedInstance
+	for _, i := range instances {
+		if i.InstanceStatus == "RUNNING" && i.CurrentAction == "NONE" {
+			running = append(running, i)
+		}
+	}
+	if len(running) == 0 {
+		return nil, nil
+	}
+	n := int(math.Ceil(ch.cc.Fraction * float64(len(running))))
+	var events []*report.WatchEvent
+	for _, k := range ch.rand.Perm(len(running))[:n] {
+		i := running[k]
+		name, zone := path.Base(i.Instance), instanceZone(i.Instance)
+		var err error
+		if ch.cc.Action == "reset" {
+			_, err = s.Instances.Reset(c.Project, zone, name).Context(ctx).Do()
+		} else {
+			_, err = s.Instances.Delete(c.Project, zone, name).Context(ctx).Do()
+		}
+		if err != nil {
+			return events, fmt.Errorf("unable to %v instance %v: %v", ch.cc.Action, name, err)
+		}
+		log.Printf("Chaos: %v instance %v.", chaosDone[ch.cc.Action], name)
+		ev := *e
+		ev.Type = "chaos-" + ch.cc.Action
+		ev.Instance = name
+		ev.Message = fmt.Sprintf("chaos %v %v (%d of %d running)", chaosDone[ch.cc.Action], name, n, len(running))
+		events = append(events, &ev)
+	}
+	return events, nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runMetrics are the key metrics of a run, computed from its merged
+// timeline.
+type runMetrics struct {
+	// kneeQPS is the highest request rate per running instance at which a
+	// row's p95 stayed within the knee factor of the run's median p95: the
+	// load an instance takes before latency climbs.
+	kneeQPS float64
+	// scaleOutP99Ms is the worst p99 of the rows in which the group was
+	// still growing towards its target.
+	scaleOutP99Ms float64
+	// timeToScale is the mean time from a rise of the target size to the
+	// running instances reaching it.
+	timeToScale time.Duration
+	// scaleOuts counts the rises measured by timeToScale.
+	scaleOuts     int
+	p99Ms         float64
+	errorRate     float64
+	instanceHours float64
+}
+
+// measureRun computes the key metrics of a merged timeline.
+func measureRun(rows []*mergedRow, kneeFactor float64) *runMetrics {
+	m := &runMetrics{}
+	width := rowWidth(rows)
+	var p95s []float64
+	var requests, errs int
+	for _, r := range rows {
+		requests += r.Requests
+		errs += r.Errors
+		m.instanceHours += float64(r.RunningSize) * width.Hours()
+		m.p99Ms = math.Max(m.p99Ms, r.P99Ms)
+		if r.Requests > 0 {
+			p95s = append(p95s, r.P95Ms)
+		}
+		if r.TargetSize > r.RunningSize {
+			m.scaleOutP99Ms = math.Max(m.scaleOutP99Ms, r.P99Ms)
+		}
+	}
+	if requests > 0 {
+		m.errorRate = float64(errs) / float64(requests)
+	}
+
+	if len(p95s) > 0 {
+		sort.Float64s(p95s)
+		limit := kneeFactor * p95s[len(p95s)/2]
+		for _, r := range rows {
+			if r.Requests == 0 || r.RunningSize == 0 || r.P95Ms > limit {
+				continue
+			}
+			qps := float64(r.Requests) / width.Seconds() / float64(r.RunningSize)
+			m.kneeQPS = math.Max(m.kneeQPS, qps)
+		}
+	}
+
+	var total time.Duration
+	for i := 1; i < len(rows); i++ {
+		target := rows[i].TargetSize
+		if target <= rows[i-1].TargetSize {
+			continue
+		}
+		for j := i; j < len(rows); j++ {
+			if rows[j].RunningSize >= target {
+				total += rows[j].Time.Sub(rows[i].Time)
+				m.scaleOuts++
+				break
+			}
+		}
+	}
+	if m.scaleOuts > 0 {
+		m.timeToScale = total / time.Duration(m.scaleOuts)
+	}
+	return m
+}
+
+// A comparedMetric is one of the metrics report compare diffs.
+type comparedMetric struct {
+	name string
+	unit string
+	// lowerIsWorse is set for metrics which regress by falling.
+	lowerIsWorse bool
+	value        func(m *runMetrics) float64
+}
+
+// comparedMetrics returns the metrics report compare diffs, with cost if
+// the hourly price of an instance is known.
+func comparedMetrics(instancePrice float64) []comparedMetric {
+	metrics := []comparedMetric{
+		{"knee", "QPS/instance", true, func(m *runMetrics) float64 { return m.kneeQPS }},
+		{"scale-out-p99", "ms", false, func(m *runMetrics) float64 { return m.scaleOutP99Ms }},
+		{"time-to-scale", "s", false, func(m *runMetrics) float64 { return m.timeToScale.Seconds() }},
+		{"p99", "ms", false, func(m *runMetrics) float64 { return m.p99Ms }},
+		{"error-rate", "%", false, func(m *runMetrics) float64 { return 100 * m.errorRate }},
+		{"instance-hours", "h", false, func(m *runMetrics) float64 { return m.instanceHours }},
+	}
+	if instancePrice > 0 {
+		metrics = append(metrics, comparedMetric{"cost", "USD", false,
+			func(m *runMetrics) float64 { return m.instanceHours * instancePrice }})
+	}
+	return metrics
+}
+
+// tolerancesFlag maps metric names to tolerances in percent, given as a
+// comma separated list of NAME=PERCENT.
+type tolerancesFlag map[string]float64
+
+func (f tolerancesFlag) String() string {
+	var s []string
+	for k, v := range f {
+		s = append(s, fmt.Sprintf("%v=%g", k, v))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (f tolerancesFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("tolerance %q is not NAME=PERCENT", s)
+		}
+		pct, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return fmt.Errorf("tolerance %q is not NAME=PERCENT", s)
+		}
+		f[kv[0]] = pct
+	}
+	return nil
+}
+
+// A metricDiff is one metric of a run comparison.
+type metricDiff struct {
+	Metric string  `json:"metric"`
+	Unit   string  `json:"unit"`
+	A      float64 `json:"a"`
+	B      float64 `json:"b"`
+	// ChangePercent is the change from A to B relative to A, or zero if A
+	// is zero.
+	ChangePercent    float64 `json:"changePercent"`
+	TolerancePercent float64 `json:"tolerancePercent"`
+	Regression       bool    `json:"regression"`
+}
+
+// A compareResult is the result of report compare.
+type compareResult struct {
+	RunA        string       `json:"runA"`
+	RunB        string       `json:"runB"`
+	Metrics     []metricDiff `json:"metrics"`
+	Regressions int          `json:"regressions"`
+}
+
+// diffMetric compares a metric of two runs, flagging run B if it is worse
+// than run A by more than tolerance percent. The error rate is compared in
+// percentage points instead, as relative changes of tiny rates are noise.
+func diffMetric(cm comparedMetric, a, b *runMetrics, tolerance float64) metricDiff {
+	d := metricDiff{Metric: cm.name, Unit: cm.unit, A: cm.value(a), B: cm.value(b), TolerancePercent: tolerance}
+	if d.A != 0 {
+		d.ChangePercent = 100 * (d.B - d.A) / d.A
+	}
+	worse := d.ChangePercent
+	switch {
+	case cm.name == "error-rate":
+		worse = d.B - d.A
+	case d.A == 0 && d.B > 0:
+		// Anything is infinitely more than nothing.
+		worse = math.Inf(1)
+	}
+	if cm.lowerIsWorse {
+		worse = -worse
+	}
+	d.Regression = worse > tolerance
+	return d
+}
+
+// reportCompareCmd diffs the key metrics of two runs of the same scenario,
+// given as merged timelines, and fails if run B regressed from run A beyond
+// the tolerances, so that it can gate infrastructure changes.
+func reportCompareCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report compare", flag.ExitOnError)
+	tolerance := fs.Float64("tolerance", 10, "Tolerance, in percent, of the metrics not in -tolerances.")
+	tolerances := tolerancesFlag{"error-rate": 0.5}
+	fs.Var(tolerances, "tolerances", "Comma separated METRIC=PERCENT overriding -tolerance for knee, scale-out-p99, time-to-scale, p99, error-rate (in percentage points), instance-hours or cost.")
+	kneeFactor := fs.Float64("knee-factor", 2, "How many times the run's median p95 a row's p95 may reach and still count towards the capacity knee.")
+	instancePrice := fs.Float64("instance-price", 0, "Hourly price of one instance, to compare costs; 0 compares instance hours only.")
+	junitPath := fs.String("junit", "", "Also write each metric as a test case of a JUnit XML report to this file, failing on regressions.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: report compare [flags] RUN_A.merged.jsonl RUN_B.merged.jsonl")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("give the merged timelines of two runs")
+	}
+	metrics := comparedMetrics(*instancePrice)
+	for name := range tolerances {
+		known := false
+		for _, cm := range metrics {
+			known = known || cm.name == name
+		}
+		if !known {
+			return fmt.Errorf("-tolerances names unknown metric %q", name)
+		}
+	}
+
+	var runs [2]*runMetrics
+	for i, path := range fs.Args() {
+		rows, err := readMergedRun(path)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("%v has no rows", path)
+		}
+		runs[i] = measureRun(rows, *kneeFactor)
+	}
+	res := &compareResult{RunA: fs.Arg(0), RunB: fs.Arg(1)}
+	for _, cm := range metrics {
+		tol, ok := tolerances[cm.name]
+		if !ok {
+			tol = *tolerance
+		}
+		d := diffMetric(cm, runs[0], runs[1], tol)
+		if d.Regression {
+			res.Regressions++
+		}
+		res.Metrics = append(res.Metrics, d)
+	}
+	if *junitPath != "" {
+		suite := junitSuite{Name: "compare"}
+		for _, d := range res.Metrics {
+			c := junitCase{Name: d.Metric, ClassName: "compare",
+				SystemOut: fmt.Sprintf("%.2f %s to %.2f %s, %+.1f%%", d.A, d.Unit, d.B, d.Unit, d.ChangePercent)}
+			if d.Regression {
+				c.Failure = &junitFailure{Type: "Regression", Message: fmt.Sprintf("%v regressed beyond the tolerance of %g%%",
+					d.Metric, d.TolerancePercent), Text: c.SystemOut}
+			}
+			suite.add(c)
+		}
+		if err := writeJUnit(*junitPath, suite); err != nil {
+			return err
+		}
+	}
+	err := printResult(res, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "METRIC\tA\tB\tCHANGE\tTOLERANCE\t")
+		for _, d := range res.Metrics {
+			status := ""
+			if d.Regression {
+				status = "REGRESSION"
+			}
+			fmt.Fprintf(tw, "%s\t%.2f %s\t%.2f %s\t%+.1f%%\t%g%%\t%s\n", d.Metric, d.A, d.Unit, d.B, d.Unit,
+				d.ChangePercent, d.TolerancePercent, status)
+		}
+		return tw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if res.Regressions > 0 {
+		return fmt.Errorf("%v regressed from %v in %d metrics", res.RunB, res.RunA, res.Regressions)
+	}
+	return nil
+}
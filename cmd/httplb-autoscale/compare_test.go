@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasureRun(t *testing.T) {
+	row := func(i int, running, target int64, requests, errs int, p95, p99 float64) *mergedRow {
+		return &mergedRow{Time: runStart.Add(time.Duration(i) * time.Minute), RunningSize: running, TargetSize: target,
+			Requests: requests, Errors: errs, P95Ms: p95, P99Ms: p99}
+	}
+	rows := []*mergedRow{
+		row(0, 2, 2, 600, 0, 100, 150),
+		// The group scales out to 4, and latency climbs until it does.
+		row(1, 2, 4, 1200, 6, 120, 400),
+		row(2, 3, 4, 1200, 0, 500, 900),
+		row(3, 4, 4, 1200, 0, 110, 200),
+		row(4, 4, 4, 0, 0, 0, 0),
+	}
+	m := measureRun(rows, 2)
+	// The median p95 is 120ms, so rows up to 240ms count towards the knee,
+	// the highest of which takes 10 QPS per instance.
+	if m.kneeQPS != 10 {
+		t.Errorf("knee = %v QPS per instance, want 10", m.kneeQPS)
+	}
+	if m.scaleOutP99Ms != 900 || m.p99Ms != 900 {
+		t.Errorf("p99 = %vms, %vms while scaling out; want 900ms", m.p99Ms, m.scaleOutP99Ms)
+	}
+	if m.scaleOuts != 1 || m.timeToScale != 2*time.Minute {
+		t.Errorf("%d scale outs taking %v, want 1 taking 2m", m.scaleOuts, m.timeToScale)
+	}
+	if !near(m.errorRate, 6.0/4200) {
+		t.Errorf("error rate = %v, want %v", m.errorRate, 6.0/4200)
+	}
+	if !near(m.instanceHours, 0.25) {
+		t.Errorf("instance hours = %v, want 15 instance minutes", m.instanceHours)
+	}
+}
+
+func TestMeasureRunNeverScaled(t *testing.T) {
+	rows := []*mergedRow{
+		{Time: runStart, RunningSize: 1, TargetSize: 1},
+		// The group never reaches its new target.
+		{Time: runStart.Add(time.Minute), RunningSize: 1, TargetSize: 3},
+	}
+	if m := measureRun(rows, 2); m.scaleOuts != 0 || m.timeToScale != 0 || m.kneeQPS != 0 || m.errorRate != 0 {
+		t.Errorf("measureRun = %+v, want no scale outs and no load", m)
+	}
+}
+
+// comparedMetricNamed returns the compared metric of the given name.
+func comparedMetricNamed(t *testing.T, name string) comparedMetric {
+	t.Helper()
+	for _, cm := range comparedMetrics(0.5) {
+		if cm.name == name {
+			return cm
+		}
+	}
+	t.Fatalf("no compared metric %v", name)
+	return comparedMetric{}
+}
+
+func TestDiffMetric(t *testing.T) {
+	for _, c := range []struct {
+		metric     string
+		a, b       runMetrics
+		tolerance  float64
+		change     float64
+		regression bool
+	}{
+		{"p99", runMetrics{p99Ms: 100}, runMetrics{p99Ms: 115}, 10, 15, true},
+		{"p99", runMetrics{p99Ms: 100}, runMetrics{p99Ms: 105}, 10, 5, false},
+		{"p99", runMetrics{p99Ms: 100}, runMetrics{p99Ms: 50}, 10, -50, false},
+		// The knee regresses by falling.
+		{"knee", runMetrics{kneeQPS: 10}, runMetrics{kneeQPS: 8}, 10, -20, true},
+		{"knee", runMetrics{kneeQPS: 10}, runMetrics{kneeQPS: 12}, 10, 20, false},
+		// Error rates are compared in percentage points.
+		{"error-rate", runMetrics{errorRate: 0.001}, runMetrics{errorRate: 0.007}, 0.5, 600, true},
+		{"error-rate", runMetrics{errorRate: 0.001}, runMetrics{errorRate: 0.005}, 0.5, 400, false},
+		// Anything is more than nothing.
+		{"time-to-scale", runMetrics{}, runMetrics{timeToScale: 30 * time.Second}, 10, 0, true},
+		{"time-to-scale", runMetrics{}, runMetrics{}, 10, 0, false},
+		{"cost", runMetrics{instanceHours: 10}, runMetrics{instanceHours: 12}, 10, 20, true},
+	} {
+		d := diffMetric(comparedMetricNamed(t, c.metric), &c.a, &c.b, c.tolerance)
+		if !near(d.ChangePercent, c.change) || d.Regression != c.regression || d.TolerancePercent != c.tolerance {
+			t.Errorf("%v from %v to %v: change %v%%, regression %v; want %v%% and %v",
+				c.metric, d.A, d.B, d.ChangePercent, d.Regression, c.change, c.regression)
+		}
+	}
+}
+
+func TestComparedMetricsCost(t *testing.T) {
+	for _, cm := range comparedMetrics(0) {
+		if cm.name == "cost" {
+			t.Error("cost is compared without an instance price")
+		}
+	}
+	cm := comparedMetricNamed(t, "cost")
+	if v := cm.value(&runMetrics{instanceHours: 4}); v != 2 {
+		t.Errorf("cost of 4 instance hours at 0.5 USD = %v, want 2", v)
+	}
+}
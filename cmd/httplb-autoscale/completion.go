@@ -0,0 +1,334 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The hidden command the completion scripts run to list candidates.
+const completeCommand = "__complete"
+
+// Zone whose machine types are offered when gcloud names none.
+const completionZone = "us-central1-a"
+
+// completionScripts holds the script for each supported shell. Each passes
+// the words typed so far, the last being the one under the cursor, to the
+// hidden __complete command and offers what it prints, falling back to file
+// names.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for httplb-autoscale.
+# Load with: source <(httplb-autoscale completion bash)
+_httplb_autoscale() {
+	local line=${COMP_LINE:0:COMP_POINT}
+	local -a words
+	read -ra words <<< "$line"
+	[[ $line == *" " ]] && words+=("")
+	# bash splits KEY=VALUE at the "="; print only what follows it.
+	local word=${words[${#words[@]}-1]}
+	local strip=${word%"${COMP_WORDS[COMP_CWORD]}"}
+	local c
+	COMPREPLY=()
+	while IFS= read -r c; do
+		[[ -n $c ]] && COMPREPLY+=("${c#"$strip"}")
+	done < <("${words[0]}" __complete "${words[@]:1}" 2>/dev/null)
+	[[ ${#COMPREPLY[@]} == 1 && ${COMPREPLY[0]} == *= ]] && compopt -o nospace
+}
+complete -o default -F _httplb_autoscale httplb-autoscale
+`,
+	"zsh": `#compdef httplb-autoscale
+# zsh completion for httplb-autoscale.
+# Load with: source <(httplb-autoscale completion zsh)
+_httplb_autoscale() {
+	local -a candidates
+	candidates=("${(@f)$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	candidates=(${candidates:#})
+	if (( ${#candidates} == 0 )); then
+		_files
+		return
+	fi
+	compadd -S '' -- ${(M)candidates:#*=}
+	compadd -- ${candidates:#*=}
+}
+compdef _httplb_autoscale httplb-autoscale
+`,
+	"fish": `# fish completion for httplb-autoscale.
+# Load with: httplb-autoscale completion fish | source
+function __httplb_autoscale_complete
+	set -l words (commandline -opc)
+	set -l current (commandline -ct)
+	$words[1] __complete $words[2..-1] "$current" 2>/dev/null
+end
+complete -c httplb-autoscale -a '(__httplb_autoscale_complete)'
+`,
+}
+
+// completionCmd prints the completion script for a shell.
+func completionCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: completion bash|zsh|fish")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("a shell, bash, zsh or fish, is required")
+	}
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q; use bash, zsh or fish", fs.Arg(0))
+	}
+	_, err := fmt.Print(script)
+	return err
+}
+
+// Flags whose values are completed, and the values offered for them.
+var completedFlagValues = map[string]func(ctx context.Context) []string{
+	"machine-type": machineTypeCandidates,
+	"run-id":       runIDCandidates,
+}
+
+// Config fields whose -set values are completed, and the values offered.
+var completedSetValues = map[string]func(ctx context.Context) []string{
+	"zone":                         zoneCandidates,
+	"instanceTemplate.machineType": machineTypeCandidates,
+	"runId":                        runIDCandidates,
+}
+
+// takesValue reports whether a flag is followed by a separate value.
+func takesValue(f *flag.Flag) bool {
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return !ok || !b.IsBoolFlag()
+}
+
+// completeArgs returns the candidates for the last of the words typed after
+// the binary's name.
+func completeArgs(ctx context.Context, words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current, done := words[len(words)-1], words[:len(words)-1]
+
+	// Skip over the global flags and their values.
+	i := 0
+	for i < len(done) && strings.HasPrefix(done[i], "-") {
+		name := strings.TrimLeft(done[i], "-")
+		if f := flag.Lookup(name); f != nil && takesValue(f) && !strings.Contains(name, "=") {
+			i++
+		}
+		i++
+	}
+	if i > len(done) {
+		// The current word is the value of a global flag.
+		if strings.TrimLeft(done[len(done)-1], "-") == "set" {
+			return setCandidates(ctx, current)
+		}
+		return nil
+	}
+	done = done[i:]
+	if len(done) == 0 {
+		if strings.HasPrefix(current, "-") {
+			var names []string
+			flag.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+			return names
+		}
+		return commandCandidates("")
+	}
+	name := done[0]
+	if _, ok := commands[name]; !ok {
+		if len(done) == 1 {
+			return commandCandidates(name)
+		}
+		name = strings.Join(done[:2], " ")
+		if _, ok := commands[name]; !ok {
+			return nil
+		}
+		done = done[2:]
+	} else {
+		done = done[1:]
+	}
+
+	if len(done) > 0 {
+		prev := strings.TrimLeft(done[len(done)-1], "-")
+		if values, ok := completedFlagValues[prev]; ok && strings.HasPrefix(done[len(done)-1], "-") {
+			return values(ctx)
+		}
+	}
+	if strings.HasPrefix(current, "-") {
+		return commandFlags(name)
+	}
+	return nil
+}
+
+// commandCandidates lists the single word commands and groups, or, given a
+// group, the commands in it.
+func commandCandidates(group string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for name := range commands {
+		words := strings.SplitN(name, " ", 2)
+		candidate := words[0]
+		if group != "" {
+			if words[0] != group || len(words) < 2 {
+				continue
+			}
+			candidate = words[1]
+		}
+		if !seen[candidate] {
+			seen[candidate] = true
+			names = append(names, candidate)
+		}
+	}
+	return names
+}
+
+// flagUsageLine matches a flag in the usage message the flag package prints.
+var flagUsageLine = regexp.MustCompile(`^\s+-([^\s=]+)`)
+
+// commandFlags lists the flags of a command by running it with -h, since
+// each command defines its flags only when it runs.
+func commandFlags(name string) []string {
+	args := append(strings.Fields(name), "-h")
+	out, _ := exec.Command(os.Args[0], args...).CombinedOutput()
+	var flags []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := flagUsageLine.FindStringSubmatch(line); m != nil {
+			flags = append(flags, "-"+m[1])
+		}
+	}
+	return flags
+}
+
+// setCandidates completes a -set KEY=VALUE: the config fields, or the values
+// of a field which has known values.
+func setCandidates(ctx context.Context, current string) []string {
+	kv := strings.SplitN(current, "=", 2)
+	if len(kv) == 2 {
+		values, ok := completedSetValues[kv[0]]
+		if !ok {
+			return nil
+		}
+		var candidates []string
+		for _, v := range values(ctx) {
+			candidates = append(candidates, kv[0]+"="+v)
+		}
+		return candidates
+	}
+	var keys []string
+	for _, path := range configPaths(reflect.TypeOf(policyConfig{}), "") {
+		keys = append(keys, path+"=")
+	}
+	return keys
+}
+
+// zoneCandidates lists the zones of the gcloud project.
+func zoneCandidates(ctx context.Context) []string {
+	project := gcloudProperty(gcloudProperties(), "core/project")
+	if project == "" {
+		return nil
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return nil
+	}
+	var zones []string
+	for token := ""; ; {
+		resp, err := s.Zones.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return zones
+		}
+		for _, z := range resp.Items {
+			zones = append(zones, z.Name)
+		}
+		if token = resp.NextPageToken; token == "" {
+			return zones
+		}
+	}
+}
+
+// machineTypeCandidates lists the machine types of the gcloud zone.
+func machineTypeCandidates(ctx context.Context) []string {
+	props := gcloudProperties()
+	project := gcloudProperty(props, "core/project")
+	if project == "" {
+		return nil
+	}
+	zone := gcloudProperty(props, "compute/zone")
+	if zone == "" {
+		zone = completionZone
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return nil
+	}
+	var types []string
+	for token := ""; ; {
+		resp, err := s.MachineTypes.List(project, zone).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return types
+		}
+		for _, mt := range resp.Items {
+			types = append(types, mt.Name)
+		}
+		if token = resp.NextPageToken; token == "" {
+			return types
+		}
+	}
+}
+
+// runIDCandidates lists the run IDs recorded in the state file.
+func runIDCandidates(ctx context.Context) []string {
+	st, err := loadState(defaultStatePath)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var ids []string
+	for _, id := range st.RunIDs {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// completeCmd prints the candidates for the word under the cursor which
+// start with it, one per line, for the completion scripts.
+func completeCmd(ctx context.Context, args []string) error {
+	current := ""
+	if len(args) > 0 {
+		current = args[len(args)-1]
+	}
+	candidates := completeArgs(ctx, args)
+	sort.Strings(candidates)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, current) {
+			fmt.Println(c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Time zone of scaling schedules which do not name one.
+const defaultScheduleTimeZone = "UTC"
+
+// A policyConfig describes an autoscaler and the managed instance group it
+// scales. Exactly one of zone and region must be set; a region yields a
+// regional group spread over the listed zones. It is read from a YAML or
+// JSON file such as the one below, which describes both the topology and
+// the load test run against it. Scalar fields may be overridden by
+// environment variables named after them, e.g. HTTPLB_MIN_REPLICAS, and
+// those by -set flags, e.g. -set minReplicas=2; a -profile is layered over
+// the file before either. A project, zone or region
+// left unset by all of them is taken from the active gcloud configuration.
+//
+//	project: my-project
+//	zone: us-central1-f
+//	group: image-processing-group
+//	template: image-processing-template
+//	targetSize: 2
+//	namedPorts:
+//	  http: 80
+//	perInstanceMetadata:
+//	  shard: "{{.Index}}"
+//	  seed: "{{.Seed}}"
+//	backendService: image-processing-backend
+//	autohealing:
+//	  healthCheck: image-processing-health-check
+//	  initialDelaySec: 300
+//	stateful:
+//	  disks: [data-disk]
+//	autoscaler: image-processing-autoscaler
+//	minReplicas: 1
+//	maxReplicas: 10
+//	coolDownPeriodSec: 60
+//	cpuUtilization: 0.6
+//	predictiveMethod: OPTIMIZE_AVAILABILITY
+//	loadBalancingUtilization: 0.8
+//	customMetrics:
+//	- metric: custom.googleapis.com/imagemagick/queue_length
+//	  target: 5
+//	  targetType: GAUGE
+//	schedules:
+//	- name: business-hours
+//	  schedule: "0 8 * * MON-FRI"
+//	  durationSec: 36000
+//	  minRequiredReplicas: 5
+//	  timeZone: America/New_York
+//	scenario:
+//	  url: http://203.0.113.10/
+//	  phases:
+//	  - duration: 5m
+//	    qps: 20
+//	projects:
+//	  serving:
+//	    credentials: serving-sa.json
+//	  monitoring:
+//	    project: my-ops-project
+//	profiles:
+//	  smoke:
+//	    maxReplicas: 3
+//	    scenario:
+//	      phases:
+//	      - duration: 1m
+//	        qps: 5
+type policyConfig struct {
+	Project     string   `yaml:"project"`
+	Zone        string   `yaml:"zone"`
+	Region      string   `yaml:"region"`
+	Zones       []string `yaml:"zones"`
+	TargetShape string   `yaml:"targetShape"`
+	Group       string   `yaml:"group"`
+	Template    string   `yaml:"template"`
+	// RunID labels every resource created from the config. It defaults to
+	// the run of the newest template made by template create.
+	RunID      string `yaml:"runId"`
+	TargetSize int64  `yaml:"targetSize"`
+	// InstanceTemplate describes the templates made by template create.
+	InstanceTemplate *templateConfig `yaml:"instanceTemplate"`
+	BaseInstanceName string          `yaml:"baseInstanceName"`
+	// NamedPorts maps port names, such as http, to the ports the load
+	// balancer sends them to.
+	NamedPorts map[string]int64 `yaml:"namedPorts"`
+	// PerInstanceMetadata holds metadata templates rendered separately for
+	// each instance created by mig add-instances. Templates may use
+	// {{.Index}}, {{.Name}}, {{.RunID}} and {{.Seed}}. Instances read the
+	// values from the metadata server like any other attribute, e.g.
+	//	curl -H Metadata-Flavor:Google \
+	//	  http://metadata.google.internal/computeMetadata/v1/instance/attributes/shard
+	PerInstanceMetadata map[string]string `yaml:"perInstanceMetadata"`
+	BackendService      string            `yaml:"backendService"`
+	// HTTPS adds an HTTPS frontend to the load balancer setup-lb creates.
+	HTTPS *httpsConfig `yaml:"https"`
+	// Capacity holds the group's capacity settings as a backend of the
+	// backend service; only its balancing and capacity fields are used.
+	Capacity *backendConfig `yaml:"capacity"`
+	// Backends declares more groups attached to the same backend service.
+	Backends []backendConfig `yaml:"backends"`
+	// Services declares more services behind the load balancer, each
+	// autoscaled separately and routed its own URL paths.
+	Services    []serviceConfig `yaml:"services"`
+	Autohealing *autohealing    `yaml:"autohealing"`
+	// Stateful preserves instance disks and addresses across recreation.
+	Stateful          *statefulConfig `yaml:"stateful"`
+	Autoscaler        string          `yaml:"autoscaler"`
+	MinReplicas       int64           `yaml:"minReplicas"`
+	MaxReplicas       int64           `yaml:"maxReplicas"`
+	CoolDownPeriodSec int64           `yaml:"coolDownPeriodSec"`
+	// The scaling signals below may be combined freely; the autoscaler
+	// chooses the largest size any of them recommends.
+	CPUUtilization           float64          `yaml:"cpuUtilization"`
+	PredictiveMethod         string           `yaml:"predictiveMethod"`
+	LoadBalancingUtilization float64          `yaml:"loadBalancingUtilization"`
+	CustomMetrics            []customMetric   `yaml:"customMetrics"`
+	Schedules                []scheduleConfig `yaml:"schedules"`
+	// Scenario is the load loadgen run offers when given the config.
+	Scenario *loadgen.Scenario `yaml:"scenario"`
+	// Chaos fails instances during load tests.
+	Chaos *chaosConfig `yaml:"chaos"`
+	// Budget caps what load tests may spend on instances.
+	Budget *budgetConfig `yaml:"budget"`
+	// Notifications announces the end of load tests.
+	Notifications *notificationsConfig `yaml:"notifications"`
+	// Demo is the corpus demo run generates.
+	Demo *demoConfig `yaml:"demo"`
+	// Projects moves resource groups, keyed by serving, monitoring or
+	// bigquery, to other projects or gives them their own credentials.
+	Projects map[string]*projectConfig `yaml:"projects"`
+	// Profiles holds named presets, each a partial config which -profile
+	// layers over the rest of the file.
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// namedPorts converts the config's named ports into their Compute API
+// representation, in name order.
+func (c *policyConfig) namedPorts() []*compute.NamedPort {
+	names := make([]string, 0, len(c.NamedPorts))
+	for name := range c.NamedPorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ports := make([]*compute.NamedPort, 0, len(names))
+	for _, name := range names {
+		ports = append(ports, &compute.NamedPort{Name: name, Port: c.NamedPorts[name]})
+	}
+	return ports
+}
+
+// A customMetric scales the group to keep a Cloud Monitoring metric, written
+// per instance, near a target. The agent in compute/agent writes suitable
+// metrics.
+type customMetric struct {
+	Metric     string  `yaml:"metric"`
+	Target     float64 `yaml:"target"`
+	TargetType string  `yaml:"targetType"`
+	Filter     string  `yaml:"filter"`
+	// SingleInstanceAssignment scales on a metric describing the whole group,
+	// such as a queue depth, by the amount of work each instance can take.
+	// It replaces target.
+	SingleInstanceAssignment float64 `yaml:"singleInstanceAssignment"`
+}
+
+// autohealing configures the group to recreate instances which fail a
+// health check, once they have had initialDelaySec to boot.
+type autohealing struct {
+	HealthCheck     string `yaml:"healthCheck"`
+	InitialDelaySec int64  `yaml:"initialDelaySec"`
+}
+
+// policies converts the autohealing config into its Compute API
+// representation.
+func (a *autohealing) policies(project string) []*compute.InstanceGroupManagerAutoHealingPolicy {
+	hc := a.HealthCheck
+	if !strings.Contains(hc, "/") {
+		hc = fmt.Sprintf("projects/%s/global/healthChecks/%s", project, hc)
+	}
+	return []*compute.InstanceGroupManagerAutoHealingPolicy{{
+		HealthCheck:     hc,
+		InitialDelaySec: a.InitialDelaySec,
+	}}
+}
+
+// A scheduleConfig describes a scaling schedule which holds the group at or
+// above a minimum size for a period starting at each cron trigger.
+type scheduleConfig struct {
+	Name                string `yaml:"name"`
+	Schedule            string `yaml:"schedule"`
+	DurationSec         int64  `yaml:"durationSec"`
+	MinRequiredReplicas int64  `yaml:"minRequiredReplicas"`
+	TimeZone            string `yaml:"timeZone"`
+	Description         string `yaml:"description"`
+	Disabled            bool   `yaml:"disabled"`
+}
+
+// loadPolicyConfig reads and checks the policy config at the given path.
+func loadPolicyConfig(path string) (*policyConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &policyConfig{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %v", path, err)
+	}
+	if err := c.applyProfile(false); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := c.applyOverrides(); err != nil {
+		return nil, err
+	}
+	c.applyGcloudDefaults()
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", path, err)
+	}
+	c.useCredentials()
+	// Audit under the config's run until the command finds out otherwise,
+	// e.g. from a -state flag.
+	runID(c, defaultStatePath)
+	return c, nil
+}
+
+// autoscalingPolicy converts the config into its Compute API representation.
+func (c *policyConfig) autoscalingPolicy() *compute.AutoscalingPolicy {
+	p := &compute.AutoscalingPolicy{
+		MinNumReplicas:    c.MinReplicas,
+		MaxNumReplicas:    c.MaxReplicas,
+		CoolDownPeriodSec: c.CoolDownPeriodSec,
+	}
+	if c.CPUUtilization > 0 {
+		p.CpuUtilization = &compute.AutoscalingPolicyCpuUtilization{
+			UtilizationTarget: c.CPUUtilization,
+			PredictiveMethod:  c.PredictiveMethod,
+		}
+	}
+	if c.LoadBalancingUtilization > 0 {
+		p.LoadBalancingUtilization = &compute.AutoscalingPolicyLoadBalancingUtilization{
+			UtilizationTarget: c.LoadBalancingUtilization,
+		}
+	}
+	for _, m := range c.CustomMetrics {
+		p.CustomMetricUtilizations = append(p.CustomMetricUtilizations,
+			&compute.AutoscalingPolicyCustomMetricUtilization{
+				Metric:                   m.Metric,
+				UtilizationTarget:        m.Target,
+				UtilizationTargetType:    m.TargetType,
+				Filter:                   m.Filter,
+				SingleInstanceAssignment: m.SingleInstanceAssignment,
+			})
+	}
+	if len(c.Schedules) > 0 {
+		p.ScalingSchedules = make(map[string]compute.AutoscalingPolicyScalingSchedule)
+		for _, s := range c.Schedules {
+			tz := s.TimeZone
+			if tz == "" {
+				tz = defaultScheduleTimeZone
+			}
+			p.ScalingSchedules[s.Name] = compute.AutoscalingPolicyScalingSchedule{
+				Schedule:            s.Schedule,
+				DurationSec:         s.DurationSec,
+				MinRequiredReplicas: s.MinRequiredReplicas,
+				TimeZone:            tz,
+				Description:         s.Description,
+				Disabled:            s.Disabled,
+			}
+		}
+	}
+	return p
+}
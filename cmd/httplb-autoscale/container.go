@@ -0,0 +1,121 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Defaults for templates which run a container.
+const (
+	cosImageFamily  = "cos-stable"
+	cosImageProject = "cos-cloud"
+	// Metadata key read by the container agent on Container-Optimized OS.
+	containerDeclarationKey = "gce-container-declaration"
+)
+
+// A containerConfig runs the backend as a Docker image on Container-Optimized
+// OS instead of with a startup script:
+//
+//	instanceTemplate:
+//	  container:
+//	    image: gcr.io/my-project/image-server:v3
+//	    port: 8080
+//	    env:
+//	      BUCKET: my-project-images
+type containerConfig struct {
+	Image string   `yaml:"image"`
+	Args  []string `yaml:"args"`
+	// Port is the port the container listens on. Containers share the
+	// instance's network, so it is passed to the container as $PORT and
+	// should match the group's named port.
+	Port int               `yaml:"port"`
+	Env  map[string]string `yaml:"env"`
+}
+
+// check verifies that the container config can be declared.
+func (cc *containerConfig) check() error {
+	switch {
+	case cc.Image == "":
+		return errors.New("container image is required")
+	case cc.Port < 0 || cc.Port > 65535:
+		return fmt.Errorf("container port %d is out of range", cc.Port)
+	}
+	if _, ok := cc.Env["PORT"]; ok && cc.Port > 0 {
+		return errors.New("set either port or env PORT for the container, not both")
+	}
+	return nil
+}
+
+// The format of the gce-container-declaration metadata value.
+type containerDeclaration struct {
+	Spec containerSpec `yaml:"spec"`
+}
+
+type containerSpec struct {
+	Containers    []declaredContainer `yaml:"containers"`
+	RestartPolicy string              `yaml:"restartPolicy"`
+}
+
+type declaredContainer struct {
+	Name  string        `yaml:"name"`
+	Image string        `yaml:"image"`
+	Args  []string      `yaml:"args,omitempty"`
+	Env   []envVariable `yaml:"env,omitempty"`
+	Stdin bool          `yaml:"stdin"`
+	TTY   bool          `yaml:"tty"`
+}
+
+type envVariable struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// declaration renders the gce-container-declaration metadata value for the
+// container, naming it after the template.
+func (cc *containerConfig) declaration(name string) (string, error) {
+	if err := cc.check(); err != nil {
+		return "", err
+	}
+	env := map[string]string{}
+	for k, v := range cc.Env {
+		env[k] = v
+	}
+	if cc.Port > 0 {
+		env["PORT"] = strconv.Itoa(cc.Port)
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	c := declaredContainer{Name: name, Image: cc.Image, Args: cc.Args}
+	for _, k := range keys {
+		c.Env = append(c.Env, envVariable{Name: k, Value: env[k]})
+	}
+	b, err := yaml.Marshal(containerDeclaration{Spec: containerSpec{
+		Containers:    []declaredContainer{c},
+		RestartPolicy: "Always",
+	}})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
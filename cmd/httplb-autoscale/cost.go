@@ -0,0 +1,287 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// On-demand hourly prices in USD of common predefined machine types in
+// us-central1. They are only meant for estimates; pass -instance-price for
+// other regions, types or negotiated prices.
+var machineHourlyPrices = map[string]float64{
+	"n1-standard-1":  0.0475,
+	"n1-standard-2":  0.0950,
+	"n1-standard-4":  0.1900,
+	"n1-standard-8":  0.3800,
+	"n1-highcpu-2":   0.0709,
+	"n1-highcpu-4":   0.1418,
+	"n1-highcpu-8":   0.2836,
+	"e2-micro":       0.0084,
+	"e2-small":       0.0168,
+	"e2-medium":      0.0335,
+	"e2-standard-2":  0.0670,
+	"e2-standard-4":  0.1340,
+	"e2-standard-8":  0.2681,
+	"n2-standard-2":  0.0971,
+	"n2-standard-4":  0.1942,
+	"n2-standard-8":  0.3885,
+	"n2d-standard-2": 0.0845,
+	"n2d-standard-4": 0.1690,
+	"n2d-standard-8": 0.3380,
+	"c2d-standard-2": 0.0908,
+	"c2d-standard-4": 0.1816,
+}
+
+// Hourly prices in USD of a vCPU and a GB of memory of custom machine types
+// in us-central1, by family.
+var customMachinePrices = map[string]struct{ vcpu, memoryGb float64 }{
+	"n1":  {0.033174, 0.004446},
+	"n2":  {0.033174, 0.004446},
+	"n2d": {0.028877, 0.003870},
+	"e2":  {0.022890, 0.003067},
+}
+
+// Spot prices change over time; they are typically 60 to 91% below
+// on-demand, and estimates assume the shallower discount.
+const spotPriceFactor = 0.4
+
+// instanceHourlyPrice estimates the hourly price of one instance made from
+// the template. Attached GPUs are not included.
+func instanceHourlyPrice(t templateConfig) (float64, error) {
+	t = t.withDefaults()
+	var price float64
+	if m := t.CustomMachine; m != nil {
+		p, ok := customMachinePrices[m.family()]
+		if !ok {
+			return 0, fmt.Errorf("no price known for custom %v machines", m.family())
+		}
+		price = float64(m.VCPUs)*p.vcpu + float64(m.MemoryMb)/1024*p.memoryGb
+	} else {
+		p, ok := machineHourlyPrices[t.MachineType]
+		if !ok {
+			return 0, fmt.Errorf("no price known for machine type %v", t.MachineType)
+		}
+		price = p
+	}
+	if t.Scheduling != nil && t.Scheduling.ProvisioningModel == "SPOT" {
+		price *= spotPriceFactor
+	}
+	return price, nil
+}
+
+// instanceHours returns the instance hours of a watch run, assuming the
+// group's size is constant between events.
+func instanceHours(events []*report.WatchEvent) float64 {
+	var hours float64
+	for i := 1; i < len(events); i++ {
+		hours += float64(events[i-1].ActualSize) * events[i].Time.Sub(events[i-1].Time).Hours()
+	}
+	return hours
+}
+
+// A costLine is one item of a cost estimate.
+type costLine struct {
+	item     string
+	quantity float64
+	unit     string
+	price    float64
+}
+
+// cost returns the line's cost in USD.
+func (l costLine) cost() float64 {
+	return l.quantity * l.price
+}
+
+// A costReport is the result of report cost.
+type costReport struct {
+	Start    time.Time  `json:"start"`
+	End      time.Time  `json:"end"`
+	Items    []costItem `json:"items"`
+	TotalUSD float64    `json:"totalUsd"`
+}
+
+// A costItem is one line of a costReport.
+type costItem struct {
+	Item         string  `json:"item"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit"`
+	UnitPriceUSD float64 `json:"unitPriceUsd"`
+	CostUSD      float64 `json:"costUsd"`
+}
+
+// sumSeries returns the sum of every point of the series matching filter
+// between start and end, for delta metrics such as byte and request counts.
+// If key is set, sums are returned per value of that metric label.
+func sumSeries(ctx context.Context, m *monitoring.Service, project, filter, key string, start, end time.Time) (map[string]float64, error) {
+	series, err := listAllTimeSeries(ctx, m, project, filter, start, end)
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]float64{}
+	for _, ts := range series {
+		k := ""
+		if key != "" && ts.Metric != nil {
+			k = ts.Metric.Labels[key]
+		}
+		for _, p := range ts.Points {
+			sums[k] += pointValue(p.Value)
+		}
+	}
+	return sums, nil
+}
+
+// Prefixes of the Cloud Storage API methods billed as Class A operations.
+// Deletes are free and everything else is Class B.
+var classAMethodPrefixes = []string{"Write", "Insert", "List", "Compose", "Copy", "Rewrite", "Update", "Patch", "Create", "Set"}
+
+// storageOperationClass returns "A", "B" or "" (free) for an API method as
+// reported by storage.googleapis.com/api/request_count.
+func storageOperationClass(method string) string {
+	if strings.HasPrefix(method, "Delete") {
+		return ""
+	}
+	for _, p := range classAMethodPrefixes {
+		if strings.HasPrefix(method, p) {
+			return "A"
+		}
+	}
+	return "B"
+}
+
+// reportCostCmd estimates what a run cost: instance hours, priced by the
+// machine type of the config's template, data processed by the load
+// balancer, and operations and egress of the corpus bucket, both read from
+// Cloud Monitoring. The reported prices are list prices and only an
+// estimate; the billing export is authoritative.
+func reportCostCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report cost", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	watchPath := fs.String("watch", "", "Watch event file of the run.")
+	bucket := fs.String("bucket", "", "Bucket the backends serve from. Defaults to the template's server bucket.")
+	instancePrice := fs.Float64("instance-price", 0, "Hourly price of one instance; 0 looks up the template's machine type.")
+	lbPerGb := fs.Float64("lb-per-gb", 0.008, "Price per GB of data processed by the load balancer.")
+	lbEgressPerGb := fs.Float64("lb-egress-per-gb", 0.085, "Price per GB of responses sent by the load balancer.")
+	ruleHourly := fs.Float64("rule-price", 0.025, "Hourly price of the forwarding rule.")
+	classAPer10k := fs.Float64("class-a-per-10k", 0.05, "Price per 10,000 Class A Cloud Storage operations.")
+	classBPer10k := fs.Float64("class-b-per-10k", 0.004, "Price per 10,000 Class B Cloud Storage operations.")
+	gcsEgressPerGb := fs.Float64("gcs-egress-per-gb", 0, "Price per GB sent by the bucket; reads from the bucket's own region are free.")
+	fs.Parse(args)
+	if *watchPath == "" {
+		return errors.New("-watch is required")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	events, err := report.ReadWatchEvents(*watchPath)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%v has no events", *watchPath)
+	}
+	start, end := eventsWindow(events)
+
+	var t templateConfig
+	if c.InstanceTemplate != nil {
+		t = *c.InstanceTemplate
+	}
+	price := *instancePrice
+	if price == 0 {
+		if price, err = instanceHourlyPrice(t); err != nil {
+			return fmt.Errorf("%v; pass -instance-price", err)
+		}
+	}
+	if len(t.Accelerators) > 0 {
+		log.Printf("The estimate does not include the instances' GPUs.")
+	}
+	lines := []costLine{{
+		item:     "instances (" + t.withDefaults().MachineType + ")",
+		quantity: instanceHours(events),
+		unit:     "instance hours",
+		price:    price,
+	}}
+
+	m, err := newMonitoringService()
+	if err != nil {
+		return fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	if c.BackendService != "" {
+		filter := lbFilter(c.BackendService)
+		var bytes [2]float64
+		for i, mt := range []string{"request_bytes_count", "response_bytes_count"} {
+			sums, err := sumSeries(ctx, m, c.projectFor(monitoringProjects), fmt.Sprintf(`metric.type = "loadbalancing.googleapis.com/https/%s" AND %s`, mt, filter), "", start, end)
+			if err != nil {
+				return fmt.Errorf("unable to query %v: %v", mt, err)
+			}
+			bytes[i] = sums[""]
+		}
+		lines = append(lines,
+			costLine{"forwarding rule", end.Sub(start).Hours(), "hours", *ruleHourly},
+			costLine{"load balancer data processed", (bytes[0] + bytes[1]) / 1e9, "GB", *lbPerGb},
+			costLine{"load balancer egress", bytes[1] / 1e9, "GB", *lbEgressPerGb})
+	}
+	if *bucket == "" && t.Server != nil {
+		*bucket = t.Server.Bucket
+	}
+	if *bucket != "" {
+		filter := fmt.Sprintf(`resource.type = "gcs_bucket" AND resource.labels.bucket_name = %q`, *bucket)
+		requests, err := sumSeries(ctx, m, c.projectFor(monitoringProjects), `metric.type = "storage.googleapis.com/api/request_count" AND `+filter, "method", start, end)
+		if err != nil {
+			return fmt.Errorf("unable to query Cloud Storage requests: %v", err)
+		}
+		ops := map[string]float64{}
+		for method, n := range requests {
+			ops[storageOperationClass(method)] += n
+		}
+		sent, err := sumSeries(ctx, m, c.projectFor(monitoringProjects), `metric.type = "storage.googleapis.com/network/sent_bytes_count" AND `+filter, "", start, end)
+		if err != nil {
+			return fmt.Errorf("unable to query Cloud Storage egress: %v", err)
+		}
+		lines = append(lines,
+			costLine{"Cloud Storage Class A operations", ops["A"] / 1e4, "10k operations", *classAPer10k},
+			costLine{"Cloud Storage Class B operations", ops["B"] / 1e4, "10k operations", *classBPer10k},
+			costLine{"Cloud Storage egress", sent[""] / 1e9, "GB", *gcsEgressPerGb})
+	}
+
+	r := &costReport{Start: start, End: end}
+	for _, l := range lines {
+		r.Items = append(r.Items, costItem{l.item, l.quantity, l.unit, l.price, l.cost()})
+		r.TotalUSD += l.cost()
+	}
+	return printResult(r, func(w io.Writer) error {
+		fmt.Fprintf(w, "Estimated cost of the run from %v to %v (%v):\n\n", start.Format(time.RFC3339), end.Format(time.RFC3339),
+			end.Sub(start).Round(time.Second))
+		tw := newTable(w)
+		fmt.Fprintln(tw, "ITEM\tQUANTITY\tUNIT\tUNIT PRICE\tCOST")
+		for _, i := range r.Items {
+			fmt.Fprintf(tw, "%s\t%.3f\t%s\t$%.4f\t$%.2f\n", i.Item, i.Quantity, i.Unit, i.UnitPriceUSD, i.CostUSD)
+		}
+		fmt.Fprintf(tw, "TOTAL\t\t\t\t$%.2f\n", r.TotalUSD)
+		return tw.Flush()
+	})
+}
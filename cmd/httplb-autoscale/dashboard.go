@@ -0,0 +1,273 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// The types below are the parts of Grafana's dashboard JSON model used by
+// metrics dashboard. Panels read either the Prometheus exporter of metrics
+// serve or the Google Cloud Monitoring datasource, each chosen through a
+// datasource variable when the dashboard is imported.
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	Time          grafanaTimeRange  `json:"time"`
+	Refresh       string            `json:"refresh"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Templating    grafanaTemplating `json:"templating"`
+	Panels        []*grafanaPanel   `json:"panels"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []*grafanaVariable `json:"list"`
+}
+
+// A grafanaVariable is a dashboard variable: either a datasource picker or a
+// constant holding one of the run's parameters.
+type grafanaVariable struct {
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"`
+	Type  string `json:"type"`
+	// Query is the datasource plugin of a datasource variable, or the value
+	// of a constant.
+	Query string `json:"query"`
+	Hide  int    `json:"hide"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Title       string             `json:"title"`
+	Type        string             `json:"type"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Datasource  grafanaDatasource  `json:"datasource"`
+	FieldConfig grafanaFieldConfig `json:"fieldConfig"`
+	Targets     []interface{}      `json:"targets"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults grafanaFieldDefaults `json:"defaults"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit string `json:"unit"`
+}
+
+// A prometheusTarget is a PromQL query of a panel.
+type prometheusTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// A monitoringTarget is a Cloud Monitoring time series query of a panel.
+type monitoringTarget struct {
+	RefID          string                `json:"refId"`
+	QueryType      string                `json:"queryType"`
+	TimeSeriesList monitoringSeriesQuery `json:"timeSeriesList"`
+}
+
+type monitoringSeriesQuery struct {
+	ProjectName        string   `json:"projectName"`
+	Filters            []string `json:"filters"`
+	PerSeriesAligner   string   `json:"perSeriesAligner"`
+	CrossSeriesReducer string   `json:"crossSeriesReducer"`
+	AlignmentPeriod    string   `json:"alignmentPeriod"`
+	GroupBys           []string `json:"groupBys,omitempty"`
+}
+
+// Datasources of the panels, resolved through the dashboard's variables.
+var (
+	prometheusDatasource = grafanaDatasource{Type: "prometheus", UID: "${prometheus}"}
+	monitoringDatasource = grafanaDatasource{Type: "stackdriver", UID: "${monitoring}"}
+)
+
+// monitoringFilter splits a conjunction of equalities into the token list
+// the Cloud Monitoring datasource expects, e.g. ["metric.type", "=", "x",
+// "AND", ...].
+func monitoringFilter(pairs ...string) []string {
+	var tokens []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			tokens = append(tokens, "AND")
+		}
+		tokens = append(tokens, pairs[i], "=", pairs[i+1])
+	}
+	return tokens
+}
+
+// lbQuery queries one of the load balancer series streamed by
+// lb metrics-watch.
+func lbQuery(project, refID, backendService string, lm lbMetric) *monitoringTarget {
+	filters := []string{"metric.type", "=", lm.Type, "AND", "resource.type", "=", "https_lb_rule",
+		"AND", "resource.label.backend_target_name", "=", backendService}
+	if lm.Filter != "" {
+		// The filters of lbMetrics are single equalities.
+		parts := strings.SplitN(lm.Filter, " = ", 2)
+		filters = append(filters, "AND", strings.Replace(parts[0], ".labels.", ".label.", 1), "=", parts[1])
+	}
+	return &monitoringTarget{
+		RefID:     refID,
+		QueryType: "timeSeriesList",
+		TimeSeriesList: monitoringSeriesQuery{
+			ProjectName:        project,
+			Filters:            filters,
+			PerSeriesAligner:   lm.Aligner,
+			CrossSeriesReducer: lm.Reducer,
+			AlignmentPeriod:    "cloud-monitoring-auto",
+		},
+	}
+}
+
+// runDashboard builds the dashboard of one run of the config's group.
+func runDashboard(c *policyConfig, runID string) *grafanaDashboard {
+	title := fmt.Sprintf("%s %s", c.Group, runID)
+	uid := strings.ToLower(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, "httplb-"+runID))
+	if len(uid) > 40 {
+		uid = uid[:40]
+	}
+	d := &grafanaDashboard{
+		UID:           uid,
+		Title:         title,
+		Tags:          []string{managedByValue, runIDLabel + ":" + runID},
+		Time:          grafanaTimeRange{From: "now-1h", To: "now"},
+		Refresh:       "30s",
+		SchemaVersion: 36,
+		Templating: grafanaTemplating{List: []*grafanaVariable{
+			{Name: "prometheus", Label: "Prometheus", Type: "datasource", Query: "prometheus"},
+			{Name: "monitoring", Label: "Cloud Monitoring", Type: "datasource", Query: "stackdriver"},
+			{Name: "run_id", Type: "constant", Query: runID, Hide: 2},
+			{Name: "group", Type: "constant", Query: c.Group, Hide: 2},
+		}},
+	}
+	add := func(title, unit string, ds grafanaDatasource, targets ...interface{}) {
+		n := len(d.Panels)
+		d.Panels = append(d.Panels, &grafanaPanel{
+			ID:          n + 1,
+			Title:       title,
+			Type:        "timeseries",
+			GridPos:     grafanaGridPos{H: 8, W: 12, X: 12 * (n % 2), Y: 8 * (n / 2)},
+			Datasource:  ds,
+			FieldConfig: grafanaFieldConfig{Defaults: grafanaFieldDefaults{Unit: unit}},
+			Targets:     targets,
+		})
+	}
+
+	sel := `group="$group"`
+	add("Replicas", "short", prometheusDatasource,
+		&prometheusTarget{RefID: "A", Expr: exporterPrefix + "mig_target_size{" + sel + "}", LegendFormat: "target {{group}}"},
+		&prometheusTarget{RefID: "B", Expr: exporterPrefix + "mig_running_size{" + sel + "}", LegendFormat: "running {{group}}"},
+		&prometheusTarget{RefID: "C", Expr: exporterPrefix + "autoscaler_recommended_size{" + sel + "}", LegendFormat: "recommended {{group}}"},
+		&prometheusTarget{RefID: "D", Expr: exporterPrefix + "backend_healthy{" + sel + "}", LegendFormat: "healthy {{group}}"})
+	add("CPU utilization", "percentunit", monitoringDatasource, &monitoringTarget{
+		RefID:     "A",
+		QueryType: "timeSeriesList",
+		TimeSeriesList: monitoringSeriesQuery{
+			ProjectName: c.projectFor(monitoringProjects),
+			Filters: monitoringFilter("metric.type", "compute.googleapis.com/instance/cpu/utilization",
+				"resource.type", "gce_instance", `metadata.user_labels."`+runIDLabel+`"`, "$run_id"),
+			PerSeriesAligner:   "ALIGN_MEAN",
+			CrossSeriesReducer: "REDUCE_MEAN",
+			AlignmentPeriod:    "cloud-monitoring-auto",
+		},
+	})
+	if c.BackendService != "" {
+		var qps, latency []interface{}
+		for _, lm := range lbMetrics {
+			if strings.HasSuffix(lm.Name, "_per_sec") {
+				qps = append(qps, lbQuery(c.projectFor(monitoringProjects), string(rune('A'+len(qps))), c.BackendService, lm))
+			} else {
+				latency = append(latency, lbQuery(c.projectFor(monitoringProjects), string(rune('A'+len(latency))), c.BackendService, lm))
+			}
+		}
+		add("Requests and 5xx", "reqps", monitoringDatasource, qps...)
+		add("Backend latency", "ms", monitoringDatasource, latency...)
+	}
+	return d
+}
+
+// dashboardCmd writes a Grafana dashboard for one run of the config's group,
+// to be imported alongside a Prometheus datasource scraping metrics serve
+// and a Google Cloud Monitoring datasource.
+func dashboardCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("metrics dashboard", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	runIDFlag := fs.String("run-id", "", "Run to show. Defaults to the config's runId, or else the run of the newest template.")
+	outPath := fs.String("out", "", "Write the dashboard to this file instead of stdout.")
+	from := fs.String("from", "now-1h", "Start of the dashboard's time range, e.g. now-6h or an RFC 3339 time.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	id := *runIDFlag
+	if id == "" {
+		if id, err = runID(c, *statePath); err != nil {
+			return err
+		}
+	}
+	if id == "" {
+		return errors.New("no run ID is known; pass -run-id or create a template first")
+	}
+	d := runDashboard(c, id)
+	d.Time.From = *from
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *outPath == "" {
+		_, err := os.Stdout.Write(append(b, '\n'))
+		return err
+	}
+	if err := ioutil.WriteFile(*outPath, b, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote dashboard %q to %v.", d.Title, *outPath)
+	return nil
+}
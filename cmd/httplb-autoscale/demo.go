@@ -0,0 +1,614 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/lb"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// Time between requests to the load balancer while waiting for it to serve.
+const demoServePollInterval = 10 * time.Second
+
+// A demoConfig describes the corpus demo run generates before provisioning
+// the serving stack:
+//
+//	demo:
+//	  image: eiffel.jpg
+//	  files: 1000
+//
+// The corpus goes to the bucket of instanceTemplate.server. Without an
+// image, the corpus is assumed to exist already.
+type demoConfig struct {
+	Image string `yaml:"image"`
+	// Files defaults to the default of generate files.
+	Files int `yaml:"files"`
+}
+
+// A demoCheckpoint is the progress of a demo run through its steps, kept in
+// the state file so that a run whose command died can be resumed with
+// -resume. Each step goes from pending, without a record, to running, and
+// then to done, skipped or failed; a step left running by a dead command
+// runs again.
+type demoCheckpoint struct {
+	// Out is the output directory of the run; a resumed run must use the
+	// same one.
+	Out   string                     `json:"out"`
+	Steps map[string]*demoStepRecord `json:"steps"`
+	// LBAddress is the load balancer's IP address once the lb step ran.
+	LBAddress string `json:"lbAddress,omitempty"`
+	// RunID labels the run's resources, from their first step on.
+	RunID string `json:"runId,omitempty"`
+	// LeaseExpires is when a run with -max-duration is reaped; a resumed
+	// run keeps the deadline of the first.
+	LeaseExpires time.Time `json:"leaseExpires,omitempty"`
+}
+
+// The statuses of a step of a demo run.
+const (
+	demoStepRunning = "running"
+	demoStepDone    = "done"
+	demoStepSkipped = "skipped"
+	demoStepFailed  = "failed"
+)
+
+// A demoStepRecord is the status of a step of a demo run.
+type demoStepRecord struct {
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	// Error is why a failed step failed.
+	Error string `json:"error,omitempty"`
+}
+
+// done reports whether the named step completed, doing its work or
+// skipping it.
+func (cp *demoCheckpoint) done(step string) bool {
+	rec := cp.Steps[step]
+	return rec != nil && (rec.Status == demoStepDone || rec.Status == demoStepSkipped)
+}
+
+// loadDemoCheckpoint returns the progress of the demo run of a config from
+// the state file at path, or nil if there is none.
+func loadDemoCheckpoint(path, config string) (*demoCheckpoint, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	st, err := loadState(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %v", err)
+	}
+	cp := st.Demos[config]
+	if cp != nil && cp.Steps == nil {
+		cp.Steps = map[string]*demoStepRecord{}
+	}
+	return cp, nil
+}
+
+// saveDemoCheckpoint records the progress of the demo run of a config in
+// the state file at path, or deletes it if cp is nil.
+func saveDemoCheckpoint(path, config string, cp *demoCheckpoint) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	st, err := loadState(path)
+	if err != nil {
+		return fmt.Errorf("unable to read state file: %v", err)
+	}
+	if st.Demos == nil {
+		st.Demos = map[string]*demoCheckpoint{}
+	}
+	if cp == nil {
+		delete(st.Demos, config)
+	} else {
+		st.Demos[config] = cp
+	}
+	if err := st.save(path); err != nil {
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	return nil
+}
+
+// errSkipped is returned by a demo step which has nothing to do.
+var errSkipped = errors.New("skipped")
+
+// A demoRun is the state shared by the steps of a demo run.
+type demoRun struct {
+	s          *compute.Service
+	c          *policyConfig
+	configPath string
+	outDir     string
+	// mu guards cp, as independent steps run at once.
+	mu        sync.Mutex
+	cp        *demoCheckpoint
+	interval  time.Duration
+	serveWait time.Duration
+	nt        *notifier
+	// compute reads and changes the group and autoscaler in the load step.
+	compute provision.Compute
+}
+
+// A demoStep is one stage of the pipeline.
+type demoStep struct {
+	name    string
+	summary string
+	run     func(d *demoRun, ctx context.Context) error
+	// after names the steps which must complete first.
+	after []string
+}
+
+// demoSteps is the pipeline run by demo run. Each step starts as soon as
+// those it comes after are done: the corpus is generated while the serving
+// stack is provisioned, and the load balancer is set up alongside the
+// autoscalers.
+var demoSteps = []demoStep{
+	{"generate", "Generate the corpus", (*demoRun).generate, nil},
+	{"template", "Create the instance template", (*demoRun).template, nil},
+	{"groups", "Create the managed instance groups", (*demoRun).groups, []string{"template"}},
+	{"autoscalers", "Create the autoscalers", (*demoRun).autoscalers, []string{"groups"}},
+	{"lb", "Set up the load balancer", (*demoRun).lb, []string{"groups"}},
+	{"load", "Offer the load ramp while watching the group scale", (*demoRun).load, []string{"generate", "autoscalers", "lb"}},
+}
+
+// demoParallelism bounds the steps, and the groups within a step, which demo
+// run provisions at once.
+const demoParallelism = 4
+
+// runConcurrently runs a task per argument list, at most demoParallelism at
+// once, and returns the first error.
+func runConcurrently(ctx context.Context, name string, cmd func(ctx context.Context, args []string) error, argLists [][]string) error {
+	pool := workerpool.New(ctx, workerpool.WithWorkers(demoParallelism))
+	for i, args := range argLists {
+		args := args
+		err := pool.Submit(fmt.Sprintf("%v %d", name, i), func(ctx context.Context) error { return cmd(ctx, args) })
+		if err != nil {
+			break
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		return failures[0].Err
+	}
+	return err
+}
+
+// demoRunCmd runs the whole story from one config: it generates the corpus,
+// provisions the template, groups, autoscalers and load balancer, offers the
+// config's scenario while watching the group scale, tears everything down
+// and prints a report. With -max-duration the run is time-boxed by a lease,
+// which tears it down even if this command is killed. Independent steps run
+// at once. The status of each step is kept in the state file, so that
+// -resume continues a run which failed or whose command died from the
+// steps which did not complete.
+func demoRunCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("demo run", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config, with a scenario and optionally a demo section.")
+	outDir := fs.String("out", "demo", "Directory for the watch events, load and merged timeline files and the report.")
+	interval := fs.Duration("interval", 5*time.Second, "Time between watch polls, and width of the load intervals.")
+	serveWait := fs.Duration("serve-timeout", 15*time.Minute, "How long to wait for the load balancer to start serving before offering load.")
+	resume := fs.Bool("resume", false, "Continue the config's interrupted run from the steps which did not complete.")
+	restart := fs.Bool("restart", false, "Discard the config's interrupted run and run every step again.")
+	keep := fs.Bool("keep", false, "Leave the serving stack in place at the end instead of tearing it down.")
+	teardownOnFailure := fs.Bool("teardown-on-failure", false, "Tear the serving stack down if a step fails, instead of leaving it for a resumed run.")
+	skipQuota := fs.Bool("skip-quota-check", false, "Provision even if the quotas cannot hold every group at maxReplicas.")
+	maxDuration := fs.Duration("max-duration", 0, "Tear down, or scale to zero, the run's resources this long after it first started, even if this command is killed by then, through a lease enforced by cleanup leases; 0 leaves them.")
+	onExpiry := fs.String("on-expiry", leaseTeardown, "What -max-duration does to the resources: teardown or scale-to-zero.")
+	fs.Parse(args)
+
+	if err := checkLeaseAction(*onExpiry); err != nil {
+		return err
+	}
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.Scenario == nil {
+		return fmt.Errorf("%v has no scenario to offer", *configPath)
+	}
+	if err := checkHTTPSScenario(c); err != nil {
+		return fmt.Errorf("%v: %v", *configPath, err)
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	if *resume && *restart {
+		return errors.New("give at most one of -resume and -restart")
+	}
+	cp, err := loadDemoCheckpoint(defaultStatePath, *configPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cp != nil && *restart:
+		log.Printf("Discarding the interrupted run %v.", cp.RunID)
+		cp = nil
+	case cp != nil && !*resume:
+		return fmt.Errorf("the run %v of %v was interrupted; continue it with -resume, or start over with -restart", cp.RunID, *configPath)
+	case cp == nil && *resume:
+		return fmt.Errorf("no run of %v to resume", *configPath)
+	case cp != nil && cp.Out != *outDir:
+		return fmt.Errorf("the run %v wrote to %v; resume it with the same -out", cp.RunID, cp.Out)
+	}
+	if cp == nil {
+		cp = &demoCheckpoint{Out: *outDir, Steps: map[string]*demoStepRecord{}}
+	}
+	// save records the run's progress; steps call it with d.mu held.
+	save := func() error { return saveDemoCheckpoint(defaultStatePath, *configPath, cp) }
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if !cp.done("groups") && !*skipQuota {
+		// Fail before provisioning anything rather than halfway through, and before
+		// recording a run to resume.
+		if err := preflightQuotas(ctx, s, c, append(c.backendGroups(), c.serviceGroups()...), true); err != nil {
+			return err
+		}
+	}
+	switch {
+	case cp.RunID != "":
+		// Resumed.
+	case c.RunID != "":
+		cp.RunID = c.RunID
+	case cp.done("template"):
+		// The template step of an earlier run recorded its run ID.
+		if cp.RunID, err = runID(c, defaultStatePath); err != nil {
+			return err
+		}
+	default:
+		cp.RunID = time.Now().UTC().Format(runIDLayout)
+	}
+	audit.setRun(cp.RunID)
+	if *maxDuration > 0 && cp.LeaseExpires.IsZero() {
+		cp.LeaseExpires = time.Now().Add(*maxDuration).UTC()
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	var guard *leaseGuard
+	if *maxDuration > 0 {
+		l := &runLease{RunID: cp.RunID, Expires: cp.LeaseExpires, Action: *onExpiry, Holder: "demo run"}
+		var cancel context.CancelFunc
+		parent := ctx
+		if guard, ctx, cancel, err = takeLease(ctx, s, c.Project, l); err != nil {
+			return err
+		}
+		defer cancel()
+		defer func() {
+			if guard.expired() {
+				if err := guard.reap(parent); err != nil {
+					log.Printf("Unable to reap the run; cleanup leases will retry: %v", err)
+				}
+			}
+		}()
+	}
+	d := &demoRun{s: s, compute: provision.NewCompute(s), c: c, configPath: *configPath, outDir: *outDir, cp: cp, interval: *interval, serveWait: *serveWait,
+		nt: newNotifier(c.Notifications, "demo run", *configPath, cp.RunID)}
+
+	g := workerpool.NewGraph()
+	for i, step := range demoSteps {
+		i, step := i, step
+		if cp.done(step.name) {
+			log.Printf("Step %d/%d, %v: done in an earlier run.", i+1, len(demoSteps), step.name)
+			g.Add(step.name, func(context.Context) error { return nil }, step.after...)
+			continue
+		}
+		if rec := cp.Steps[step.name]; rec != nil && rec.Status == demoStepRunning {
+			log.Printf("Step %d/%d, %v: interrupted in an earlier run; it runs again.", i+1, len(demoSteps), step.name)
+		}
+		// record sets the step's status and saves the progress.
+		record := func(rec *demoStepRecord) error {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			cp.Steps[step.name] = rec
+			return save()
+		}
+		g.Add(step.name, func(ctx context.Context) error {
+			log.Printf("Step %d/%d, %v: %v.", i+1, len(demoSteps), step.name, step.summary)
+			rec := &demoStepRecord{Status: demoStepRunning, Started: time.Now().UTC()}
+			if err := record(rec); err != nil {
+				return err
+			}
+			end := otel.phase("demo "+step.name, "config", *configPath)
+			err := step.run(d, ctx)
+			end(err)
+			done := *rec
+			done.Finished = time.Now().UTC()
+			switch {
+			case err == errSkipped:
+				done.Status = demoStepSkipped
+			case err != nil:
+				done.Status, done.Error = demoStepFailed, err.Error()
+				if rerr := record(&done); rerr != nil {
+					log.Print(rerr)
+				}
+				return fmt.Errorf("step %v failed: %v", step.name, err)
+			default:
+				done.Status = demoStepDone
+			}
+			return record(&done)
+		}, step.after...)
+	}
+	failures, err := g.Run(ctx, workerpool.WithWorkers(demoParallelism))
+	if len(failures) > 0 {
+		err = failures[0].Err
+	}
+	if err != nil && guard.expired() {
+		// The deferred reap leaves nothing to resume.
+		if err := saveDemoCheckpoint(defaultStatePath, *configPath, nil); err != nil {
+			log.Print(err)
+		}
+		err = fmt.Errorf("run exceeded -max-duration of %v: %v", *maxDuration, err)
+		d.nt.send(context.Background(), notifyAborted, err.Error(), nil)
+		return err
+	}
+	if err != nil {
+		d.nt.send(context.Background(), notifyAborted, "demo run failed: "+err.Error(), nil)
+		log.Printf("Demo run failed; rerun it with -resume to continue from the steps which did not complete, or run teardown.")
+		if *teardownOnFailure {
+			if terr := d.teardown(ctx); terr != nil {
+				log.Printf("Unable to tear down after the failure: %v", terr)
+			} else {
+				// Nothing is left to resume.
+				if err := saveDemoCheckpoint(defaultStatePath, *configPath, nil); err != nil {
+					log.Print(err)
+				}
+				if err := guard.release(ctx); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+		return err
+	}
+	if !*keep {
+		log.Printf("Tearing down.")
+		if err := d.teardown(ctx); err != nil {
+			return err
+		}
+		if err := guard.release(ctx); err != nil {
+			return err
+		}
+	}
+	rep, err := d.printReport()
+	if err != nil {
+		return err
+	}
+	d.nt.send(ctx, notifyCompleted, "demo run finished", rep)
+	// The run is complete; a new one starts from scratch.
+	return saveDemoCheckpoint(defaultStatePath, *configPath, nil)
+}
+
+// generate uploads the demo image and duplicates it into the corpus.
+func (d *demoRun) generate(ctx context.Context) error {
+	dc := d.c.Demo
+	if dc == nil || dc.Image == "" {
+		log.Printf("The config has no demo image; using the existing corpus.")
+		return errSkipped
+	}
+	if d.c.InstanceTemplate == nil || d.c.InstanceTemplate.Server == nil {
+		return errors.New("demo.image needs instanceTemplate.server for the bucket to generate the corpus in")
+	}
+	args := []string{"-bucket", d.c.InstanceTemplate.Server.Bucket, "-image", dc.Image}
+	if dc.Files > 0 {
+		args = append(args, "-files", strconv.Itoa(dc.Files))
+	}
+	return generateFilesCmd(ctx, args)
+}
+
+// template creates the run's instance template, then those of the services
+// at once, under the checkpointed run ID.
+func (d *demoRun) template(ctx context.Context) error {
+	if err := createTemplateCmd(ctx, []string{"-config", d.configPath, "-run-id", d.cp.RunID}); err != nil {
+		return err
+	}
+	var argLists [][]string
+	for _, sv := range d.c.Services {
+		argLists = append(argLists, []string{"-config", d.configPath, "-service", sv.Name, "-run-id", d.cp.RunID})
+	}
+	return runConcurrently(ctx, "template", createTemplateCmd, argLists)
+}
+
+// groupArgs returns the arguments selecting the top level group, every
+// backend group and the group of every service.
+func (d *demoRun) groupArgs(extra ...string) [][]string {
+	base := append(extra, "-config", d.configPath)
+	argLists := [][]string{base}
+	for _, b := range d.c.Backends {
+		argLists = append(argLists, append(base[:len(base):len(base)], "-backend", b.Group))
+	}
+	for _, sv := range d.c.Services {
+		argLists = append(argLists, append(base[:len(base):len(base)], "-service", sv.Name))
+	}
+	return argLists
+}
+
+// groups creates the top level group, every backend group and the group of
+// every service at once, waiting for each to be healthy. Their quotas were
+// checked together before the first step.
+func (d *demoRun) groups(ctx context.Context) error {
+	return runConcurrently(ctx, "group", createGroupCmd, d.groupArgs("-skip-quota-check"))
+}
+
+// autoscalers creates the autoscaler of every group at once.
+func (d *demoRun) autoscalers(ctx context.Context) error {
+	return runConcurrently(ctx, "autoscaler", createAutoscalerCmd, d.groupArgs())
+}
+
+// lb sets up the load balancer and records its address for the load step.
+func (d *demoRun) lb(ctx context.Context) error {
+	if d.c.BackendService == "" {
+		log.Printf("The config names no backend service; the scenario's URL must reach the groups.")
+		return errSkipped
+	}
+	// The load balancer is labelled with the checkpointed run, like the
+	// template and groups, even when the demo is resumed.
+	ip, err := lb.Setup(ctx, d.s, lbSpec(d.s, d.c, d.cp.RunID))
+	if err != nil {
+		return err
+	}
+	log.Printf("Load balancer is at %v.", lbURL(d.c, ip))
+	d.mu.Lock()
+	d.cp.LBAddress = ip
+	d.mu.Unlock()
+	return nil
+}
+
+// load waits for the scenario's URL to serve, offers the scenario while
+// watching the group and writes its timeline and summary to the output
+// directory.
+func (d *demoRun) load(ctx context.Context) error {
+	sc := *d.c.Scenario
+	if sc.URL == "" {
+		if d.cp.LBAddress == "" {
+			return errors.New("the scenario has no url and there is no load balancer to default it to")
+		}
+		sc.URL = lbURL(d.c, d.cp.LBAddress)
+	}
+	if err := sc.Check(); err != nil {
+		return err
+	}
+	if err := waitForServing(ctx, sc.URL, d.serveWait); err != nil {
+		return err
+	}
+	eventsPath := filepath.Join(d.outDir, "watch.jsonl")
+	r, err := runTrial(ctx, d.compute, d.s, d.c, &sc, eventsPath, d.interval)
+	if err != nil {
+		return err
+	}
+	r.name = d.c.Autoscaler
+	if d.c.InstanceTemplate != nil {
+		if r.pricePerHour, err = instanceHourlyPrice(*d.c.InstanceTemplate); err != nil {
+			log.Printf("Unable to estimate the cost of the run: %v", err)
+		}
+	}
+	if err := writeTrialTimeline(r, eventsPath, filepath.Join(d.outDir, "run"), d.interval, false); err != nil {
+		return fmt.Errorf("unable to write the timeline: %v", err)
+	}
+	cmp := r.comparison()
+	d.nt.checkSLO(ctx, cmp.ErrorRate, cmp.P95Ms, cmp)
+	b, err := json.MarshalIndent(cmp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.outDir, "summary.json"), b, 0644)
+}
+
+// teardown deletes the serving stack with teardown.
+func (d *demoRun) teardown(ctx context.Context) error {
+	return teardownCmd(ctx, []string{"-config", d.configPath})
+}
+
+// waitForServing requests url until it answers with a success, for at most
+// timeout; a new load balancer takes a few minutes to start serving.
+func waitForServing(ctx context.Context, url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	defer endProgress()
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		status := ""
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			status = resp.Status
+		} else {
+			status = err.Error()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v was not serving after %v: %v", url, timeout, status)
+		}
+		progressf("Waiting for %v to serve, %v left: %v", url, time.Until(deadline).Round(time.Second), status)
+		if err := sleep(ctx, demoServePollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// A demoStepReport is a step's row of the demo report.
+type demoStepReport struct {
+	Step     string  `json:"step"`
+	Seconds  float64 `json:"seconds"`
+	Skipped  bool    `json:"skipped,omitempty"`
+	Finished string  `json:"finished"`
+}
+
+// A demoReport is the final report of a demo run.
+type demoReport struct {
+	Steps []demoStepReport `json:"steps"`
+	Run   trialComparison  `json:"run"`
+}
+
+// printReport prints how long each step took and the summary of the load
+// step, saves the report to the output directory and returns it.
+func (d *demoRun) printReport() (*demoReport, error) {
+	rep := &demoReport{}
+	for _, step := range demoSteps {
+		if !d.cp.done(step.name) {
+			continue
+		}
+		rec := d.cp.Steps[step.name]
+		rep.Steps = append(rep.Steps, demoStepReport{step.name, rec.Finished.Sub(rec.Started).Seconds(),
+			rec.Status == demoStepSkipped, rec.Finished.Format(time.RFC3339)})
+	}
+	b, err := ioutil.ReadFile(filepath.Join(d.outDir, "summary.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &rep.Run); err != nil {
+		return nil, err
+	}
+	if b, err = json.MarshalIndent(rep, "", "  "); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.outDir, "report.json"), b, 0644); err != nil {
+		return nil, err
+	}
+	err = printResult(rep, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "STEP\tDURATION\tFINISHED")
+		for _, st := range rep.Steps {
+			took := (time.Duration(st.Seconds) * time.Second).String()
+			if st.Skipped {
+				took = "skipped"
+			}
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", st.Step, took, st.Finished)
+		}
+		fmt.Fprintln(tw)
+		writeComparisonTable(tw, []trialComparison{rep.Run})
+		return tw.Flush()
+	})
+	return rep, err
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+)
+
+// compressSchedules returns the config's scaling schedules compressed like
+// a diurnal run starting at start: each fires once, at the wall clock time
+// the run reaches the simulated hour of its cron expression, for its
+// duration compressed the same way, but at least the five minutes a
+// schedule must last. Only daily schedules, "M H * * *", can
+// be compressed; their time zone is taken to be that of the simulated day.
+func compressSchedules(schedules []scheduleConfig, d *loadgen.Diurnal, start time.Time) ([]scheduleConfig, error) {
+	var out []scheduleConfig
+	for _, s := range schedules {
+		fields := strings.Fields(s.Schedule)
+		if len(fields) != 5 || fields[2] != "*" || fields[3] != "*" || fields[4] != "*" {
+			return nil, fmt.Errorf("schedule %v: only daily schedules such as \"0 8 * * *\" can be compressed, not %q", s.Name, s.Schedule)
+		}
+		minute, merr := strconv.Atoi(fields[0])
+		hour, herr := strconv.Atoi(fields[1])
+		if merr != nil || herr != nil {
+			return nil, fmt.Errorf("schedule %v: only a single minute and hour can be compressed, not %q", s.Name, s.Schedule)
+		}
+		// Cron fires on whole minutes; round up so as not to miss the trigger.
+		t := start.Add(d.Offset(float64(hour) + float64(minute)/60)).UTC()
+		if t.Truncate(time.Minute) != t {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+		}
+		s.Schedule = fmt.Sprintf("%d %d %d %d *", t.Minute(), t.Hour(), t.Day(), int(t.Month()))
+		s.DurationSec = int64(d.Compress(time.Duration(s.DurationSec) * time.Second).Seconds())
+		if s.DurationSec < minScheduleDurationSec {
+			s.DurationSec = minScheduleDurationSec
+		}
+		s.TimeZone = "UTC"
+		out = append(out, s)
+	}
+	return out, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"google.golang.org/api/compute/v1"
+)
+
+// findManagedInstance returns the instance of the group with the given name.
+func findManagedInstance(ctx context.Context, s *compute.Service, c *policyConfig, name string) (*compute.ManagedInstance, error) {
+	instances, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range instances {
+		if path.Base(i.Instance) == name {
+			return i, nil
+		}
+	}
+	return nil, fmt.Errorf("group %v has no instance %v", c.Group, name)
+}
+
+// drainingTimeout returns the connection draining timeout of the config's
+// backend service, or zero if there is none.
+func drainingTimeout(ctx context.Context, s *compute.Service, c *policyConfig) (time.Duration, error) {
+	if c.BackendService == "" {
+		return 0, nil
+	}
+	bs, err := s.BackendServices.Get(c.Project, c.BackendService).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get backend service %v: %v", c.BackendService, err)
+	}
+	if bs.ConnectionDraining == nil {
+		return 0, nil
+	}
+	return time.Duration(bs.ConnectionDraining.DrainingTimeoutSec) * time.Second, nil
+}
+
+// deleteInstanceCmd removes one instance from the group and reports how long
+// the group takes to backfill it. With -drain the instance is first taken
+// out of the group, and so out of the load balancer, and only deleted once
+// its connections have had the draining timeout to finish.
+func deleteInstanceCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig delete-instance", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	name := fs.String("instance", "", "Name of the instance to remove.")
+	drain := fs.Bool("drain", false, "Wait for connection draining before deleting the instance.")
+	drainTimeout := fs.Duration("drain-timeout", 0, "How long to drain; defaults to the backend service's draining timeout.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long to wait for the group to backfill the instance.")
+	fs.Parse(args)
+	if *name == "" {
+		return errors.New("-instance is required")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	size := m.TargetSize
+	mi, err := findManagedInstance(ctx, s, c, *name)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if *drain {
+		d := *drainTimeout
+		if d == 0 {
+			if d, err = drainingTimeout(ctx, s, c); err != nil {
+				return err
+			}
+		}
+		op, err := abandonGroupInstances(ctx, s, c, []string{mi.Instance})
+		if err != nil {
+			return fmt.Errorf("unable to remove %v from %v: %v", *name, c.Group, err)
+		}
+		if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+			return err
+		}
+		log.Printf("Removed %v from %v; draining for %v.", *name, c.Group, d)
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+		op, err = s.Instances.Delete(c.Project, instanceZone(mi.Instance), *name).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to delete instance %v: %v", *name, err)
+		}
+		if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+			return err
+		}
+	} else {
+		op, err := deleteGroupInstances(ctx, s, c, []string{mi.Instance})
+		if err != nil {
+			return fmt.Errorf("unable to delete %v from %v: %v", *name, c.Group, err)
+		}
+		if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+			return err
+		}
+	}
+	log.Printf("Deleted %v after %v.", *name, time.Since(start))
+
+	// Removing the instance lowered the target size. An active autoscaler
+	// will raise it again when it next evaluates the group; otherwise the
+	// size is restored here.
+	if a, err := getAutoscaler(ctx, s, c); err == nil && autoscale.Mode(a) != "OFF" {
+		log.Printf("Leaving the backfill to autoscaler %v.", c.Autoscaler)
+	} else {
+		op, err := resizeGroupManager(ctx, s, c, size)
+		if err != nil {
+			return fmt.Errorf("unable to restore the size of %v: %v", c.Group, err)
+		}
+		if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+			return err
+		}
+	}
+	if err := waitForHealthy(ctx, s, c, size, *timeout); err != nil {
+		return err
+	}
+	log.Printf("%v backfilled to %d healthy instances %v after the deletion started.", c.Group, size, time.Since(start))
+	return nil
+}
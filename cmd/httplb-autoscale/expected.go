@@ -0,0 +1,448 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// A scalingSignal is one of the policy's utilization signals, observed
+// minute by minute.
+type scalingSignal struct {
+	name string
+	// target is the policy's utilization target for the signal.
+	target float64
+	// perGroup marks signals which describe the whole group, such as a
+	// queue depth, rather than the mean of its instances. Their target is
+	// the work one instance takes.
+	perGroup bool
+	// values holds the observed value at the end of each minute.
+	values map[time.Time]float64
+}
+
+// recommend returns the size the signal asks for: the current size scaled by
+// how far the observed value is from the target, rounded up, or the total
+// work divided by each instance's share for per group signals.
+func (sig *scalingSignal) recommend(size int64, value float64) int64 {
+	if sig.perGroup {
+		return int64(math.Ceil(value / sig.target))
+	}
+	return int64(math.Ceil(float64(size) * value / sig.target))
+}
+
+// An expectedMinute compares one minute of a run with the policy formula.
+type expectedMinute struct {
+	row *mergedRow
+	// size is the number of instances the formula scales from.
+	size int64
+	// values holds the observed value of each signal, by signal name.
+	values map[string]float64
+	// recommended is the largest size any signal asks for, within the
+	// group's limits.
+	recommended int64
+	// expected is the recommendation after scale in stabilization.
+	expected int64
+}
+
+// deviation returns how far the group's target size was from the expected
+// size; it is positive when the group was larger.
+func (e *expectedMinute) deviation() int64 {
+	return e.row.TargetSize - e.expected
+}
+
+// expectSizes applies the documented autoscaler formula to each minute: every
+// signal recommends ceil(size * observed / target), the largest
+// recommendation wins, it is clamped to minReplicas and maxReplicas, and the
+// group only scales in as far as the largest recommendation of the last ten
+// minutes. Minutes in which no signal was observed are skipped.
+func expectSizes(c *policyConfig, rows []*mergedRow, signals []*scalingSignal) []*expectedMinute {
+	width := rowWidth(rows)
+	var minutes []*expectedMinute
+	for _, r := range rows {
+		e := &expectedMinute{row: r, size: r.RunningSize, values: map[string]float64{}}
+		if e.size == 0 {
+			e.size = r.ActualSize
+		}
+		var recommended int64
+		for _, sig := range signals {
+			v, ok := sig.values[r.Time.Add(width)]
+			if !ok {
+				continue
+			}
+			e.values[sig.name] = v
+			if n := sig.recommend(e.size, v); n > recommended {
+				recommended = n
+			}
+		}
+		if len(e.values) == 0 {
+			continue
+		}
+		if recommended < c.MinReplicas {
+			recommended = c.MinReplicas
+		}
+		if c.MaxReplicas > 0 && recommended > c.MaxReplicas {
+			recommended = c.MaxReplicas
+		}
+		e.recommended = recommended
+		e.expected = recommended
+		for i := len(minutes) - 1; i >= 0 && r.Time.Sub(minutes[i].row.Time) < scaleInStabilization; i-- {
+			e.expected = maxInt64(e.expected, minutes[i].recommended)
+		}
+		minutes = append(minutes, e)
+	}
+	return minutes
+}
+
+// maxInt64 returns the larger of a and b.
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// scalingLag is how long the group took to reach one expected size.
+type scalingLag struct {
+	at       time.Time
+	from, to int64
+	// lag is the time from the expected size changing until the group's
+	// target size reached it; it is negative if it never did before the
+	// expected size changed again or the run ended.
+	lag time.Duration
+}
+
+// lags measures, for each change of the expected size, how long the group's
+// target size took to follow.
+func lags(minutes []*expectedMinute) []*scalingLag {
+	var out []*scalingLag
+	for i := 1; i < len(minutes); i++ {
+		prev, cur := minutes[i-1], minutes[i]
+		if cur.expected == prev.expected {
+			continue
+		}
+		l := &scalingLag{at: cur.row.Time, from: prev.expected, to: cur.expected, lag: -1}
+		for j := i; j < len(minutes) && minutes[j].expected == cur.expected; j++ {
+			if minutes[j].row.TargetSize == cur.expected {
+				l.lag = minutes[j].row.Time.Sub(cur.row.Time)
+				break
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// groupInstancesFilter returns a Cloud Monitoring filter matching the
+// series of the group's instances.
+func groupInstancesFilter(mig *compute.InstanceGroupManager) string {
+	return fmt.Sprintf(`resource.type = "gce_instance" AND metric.labels.instance_name = starts_with("%s-")`, mig.BaseInstanceName)
+}
+
+// queryGroupCPU queries the mean CPU utilization of the group's instances,
+// between 0 and 1, one point per minute.
+func queryGroupCPU(ctx context.Context, m *monitoring.Service, c *policyConfig, mig *compute.InstanceGroupManager, start, end time.Time) ([]*metricPoint, error) {
+	w := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), period: time.Minute, filter: groupInstancesFilter(mig)}
+	points, err := w.query(ctx, lbMetric{Name: "cpu", Type: "compute.googleapis.com/instance/cpu/utilization",
+		Aligner: "ALIGN_MEAN", Reducer: "REDUCE_MEAN"}, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query CPU utilization of %v: %v", c.Group, err)
+	}
+	return points, nil
+}
+
+// observeSignals queries the observed value of each of the policy's
+// utilization signals, one point per minute.
+func observeSignals(ctx context.Context, s *compute.Service, m *monitoring.Service, c *policyConfig, start, end time.Time) ([]*scalingSignal, []string, error) {
+	mig, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signals []*scalingSignal
+	var skipped []string
+	if c.CPUUtilization > 0 {
+		points, err := queryGroupCPU(ctx, m, c, mig, start, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		signals = append(signals, &scalingSignal{name: "cpu", target: c.CPUUtilization, values: pointsByTime(points)})
+		if c.PredictiveMethod != "" && c.PredictiveMethod != "NONE" {
+			skipped = append(skipped, "predictive CPU scaling, which may scale out ahead of the formula")
+		}
+	}
+	if c.LoadBalancingUtilization > 0 {
+		if c.BackendService == "" {
+			return nil, nil, errors.New("config does not name a backend service")
+		}
+		bs, err := s.BackendServices.Get(c.Project, c.BackendService).Context(ctx).Do()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get backend service %v: %v", c.BackendService, err)
+		}
+		var backend *compute.Backend
+		for _, b := range bs.Backends {
+			if path.Base(b.Group) == c.Group {
+				backend = b
+			}
+		}
+		if backend == nil {
+			return nil, nil, fmt.Errorf("%v is not a backend of %v", c.Group, c.BackendService)
+		}
+		h, err := measureHeadroom(ctx, s, m, c, backend, start, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		sig := &scalingSignal{name: "lb", target: c.LoadBalancingUtilization, values: map[time.Time]float64{}}
+		for i, u := range h.used {
+			sig.values[h.times[i]] = u
+		}
+		signals = append(signals, sig)
+	}
+	for _, cm := range c.CustomMetrics {
+		lm := lbMetric{Name: path.Base(cm.Metric), Type: cm.Metric, Aligner: "ALIGN_MEAN", Reducer: "REDUCE_MEAN"}
+		scale := 1.0
+		switch cm.TargetType {
+		case "DELTA_PER_SECOND":
+			lm.Aligner = "ALIGN_RATE"
+		case "DELTA_PER_MINUTE":
+			lm.Aligner = "ALIGN_RATE"
+			scale = 60
+		}
+		sig := &scalingSignal{name: lm.Name, target: cm.Target, values: map[time.Time]float64{}}
+		filter := groupInstancesFilter(mig)
+		if cm.SingleInstanceAssignment > 0 {
+			if cm.Filter == "" {
+				skipped = append(skipped, fmt.Sprintf("custom metric %v, which needs a filter to be queried for the whole group", cm.Metric))
+				continue
+			}
+			sig.perGroup = true
+			sig.target = cm.SingleInstanceAssignment
+			lm.Reducer = "REDUCE_SUM"
+			filter = cm.Filter
+		} else if cm.Filter != "" {
+			filter += " AND " + cm.Filter
+		}
+		w := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), period: time.Minute, filter: filter}
+		points, err := w.query(ctx, lm, start, end)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to query %v: %v", cm.Metric, err)
+		}
+		for _, p := range points {
+			sig.values[p.Time] = p.Value * scale
+		}
+		signals = append(signals, sig)
+	}
+	if len(c.Schedules) > 0 {
+		skipped = append(skipped, "scaling schedules, whose minimums the formula does not include")
+	}
+	return signals, skipped, nil
+}
+
+// reportExpectedCmd checks how closely the autoscaler followed its documented
+// formula during a run. Each minute it computes the size the policy's
+// signals call for from the observed utilization and the configured targets,
+// then compares it with the group's actual target size from the merged
+// timeline, reporting the deviation and how long the group took to follow
+// each change of the expected size.
+func reportExpectedCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report expected", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	mergedPath := fs.String("merged", "", "Merged timeline of the run with one-minute intervals, as written by report merge.")
+	showMinutes := fs.Bool("minutes", false, "Print the comparison for every minute.")
+	fs.Parse(args)
+	if *mergedPath == "" {
+		return errors.New("-merged is required")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	rows, err := readMergedRun(*mergedPath)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("%v has no rows", *mergedPath)
+	}
+	if rowWidth(rows) != time.Minute {
+		return fmt.Errorf("%v has %v intervals; merge it with -interval 1m", *mergedPath, rowWidth(rows))
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := newMonitoringService()
+	if err != nil {
+		return fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	start, end := rows[0].Time, rows[len(rows)-1].Time.Add(2*time.Minute)
+	signals, skipped, err := observeSignals(ctx, s, m, c, start, end)
+	if err != nil {
+		return err
+	}
+	if len(signals) == 0 {
+		return errors.New("the policy has no utilization signals to compare with")
+	}
+	minutes := expectSizes(c, rows, signals)
+	if len(minutes) == 0 {
+		return errors.New("no signal was observed during the run")
+	}
+
+	r := &expectedReport{ComparedMinutes: len(minutes), NotModeled: skipped}
+	if *showMinutes {
+		for _, e := range minutes {
+			r.Minutes = append(r.Minutes, expectedMinuteResult{
+				Time: e.row.Time, Size: e.size, Signals: e.values, Expected: e.expected,
+				Recommended: e.row.RecommendedSize, Target: e.row.TargetSize, Deviation: e.deviation(),
+			})
+		}
+	}
+	var absSum int64
+	for _, e := range minutes {
+		d := e.deviation()
+		switch {
+		case d == 0:
+			r.MatchedMinutes++
+		case d > 0:
+			r.MaxOver = maxInt64(r.MaxOver, d)
+		default:
+			r.MaxUnder = maxInt64(r.MaxUnder, -d)
+		}
+		if d < 0 {
+			d = -d
+		}
+		absSum += d
+	}
+	r.MeanDeviation = float64(absSum) / float64(len(minutes))
+
+	changes := lags(minutes)
+	var reached []time.Duration
+	for _, l := range changes {
+		if l.lag >= 0 {
+			reached = append(reached, l.lag)
+			continue
+		}
+		r.NotReached = append(r.NotReached, expectedChange{l.at, l.from, l.to})
+	}
+	r.ExpectedChanges, r.FollowedChanges = len(changes), len(reached)
+	if len(reached) > 0 {
+		sort.Slice(reached, func(i, j int) bool { return reached[i] < reached[j] })
+		var sum time.Duration
+		for _, d := range reached {
+			sum += d
+		}
+		r.MeanLagSec = (sum / time.Duration(len(reached))).Seconds()
+		r.MedianLagSec = reached[len(reached)/2].Seconds()
+		r.MaxLagSec = reached[len(reached)-1].Seconds()
+	}
+	return printResult(r, func(w io.Writer) error { return r.printTable(w, signals) })
+}
+
+// An expectedReport is the result of report expected.
+type expectedReport struct {
+	// Minutes is only filled in with -minutes.
+	Minutes         []expectedMinuteResult `json:"minutes,omitempty"`
+	ComparedMinutes int                    `json:"comparedMinutes"`
+	MatchedMinutes  int                    `json:"matchedMinutes"`
+	MeanDeviation   float64                `json:"meanDeviation"`
+	MaxOver         int64                  `json:"maxOver"`
+	MaxUnder        int64                  `json:"maxUnder"`
+	ExpectedChanges int                    `json:"expectedChanges"`
+	FollowedChanges int                    `json:"followedChanges"`
+	MeanLagSec      float64                `json:"meanLagSec"`
+	MedianLagSec    float64                `json:"medianLagSec"`
+	MaxLagSec       float64                `json:"maxLagSec"`
+	NotReached      []expectedChange       `json:"notReached,omitempty"`
+	NotModeled      []string               `json:"notModeled,omitempty"`
+}
+
+// An expectedMinuteResult compares one minute of a run with the formula.
+type expectedMinuteResult struct {
+	Time        time.Time          `json:"time"`
+	Size        int64              `json:"size"`
+	Signals     map[string]float64 `json:"signals"`
+	Expected    int64              `json:"expected"`
+	Recommended int64              `json:"recommended"`
+	Target      int64              `json:"target"`
+	Deviation   int64              `json:"deviation"`
+}
+
+// An expectedChange is a change of the expected size the group never
+// followed.
+type expectedChange struct {
+	Time time.Time `json:"time"`
+	From int64     `json:"from"`
+	To   int64     `json:"to"`
+}
+
+// printTable writes the report for people.
+func (r *expectedReport) printTable(w io.Writer, signals []*scalingSignal) error {
+	if len(r.Minutes) > 0 {
+		tw := newTable(w)
+		header := []string{"TIME", "SIZE"}
+		for _, sig := range signals {
+			header = append(header, strings.ToUpper(sig.name))
+		}
+		fmt.Fprintln(tw, strings.Join(append(header, "EXPECTED", "RECOMMENDED", "TARGET", "DEVIATION"), "\t"))
+		for _, e := range r.Minutes {
+			fields := []string{e.Time.Format("15:04"), fmt.Sprint(e.Size)}
+			for _, sig := range signals {
+				v, ok := e.Signals[sig.name]
+				switch {
+				case !ok:
+					fields = append(fields, "-")
+				case sig.perGroup:
+					fields = append(fields, fmt.Sprintf("%.1f", v))
+				default:
+					fields = append(fields, fmt.Sprintf("%.0f%%", 100*v))
+				}
+			}
+			fields = append(fields, fmt.Sprint(e.Expected), fmt.Sprint(e.Recommended),
+				fmt.Sprint(e.Target), fmt.Sprintf("%+d", e.Deviation))
+			fmt.Fprintln(tw, strings.Join(fields, "\t"))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Compared %d minutes: target size matched the formula in %d (%.0f%%).\n",
+		r.ComparedMinutes, r.MatchedMinutes, 100*float64(r.MatchedMinutes)/float64(r.ComparedMinutes))
+	fmt.Fprintf(w, "Deviation: mean %.2f instances, at most %d over and %d under.\n", r.MeanDeviation, r.MaxOver, r.MaxUnder)
+	fmt.Fprintf(w, "Expected size changed %d times; the group followed %d of them.\n", r.ExpectedChanges, r.FollowedChanges)
+	if r.FollowedChanges > 0 {
+		sec := func(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+		fmt.Fprintf(w, "Lag: mean %v, median %v, max %v.\n", sec(r.MeanLagSec), sec(r.MedianLagSec), sec(r.MaxLagSec))
+	}
+	for _, c := range r.NotReached {
+		fmt.Fprintf(w, "  %v: expected %d -> %d, not reached\n", c.Time.Format("15:04"), c.From, c.To)
+	}
+	for _, s := range r.NotModeled {
+		fmt.Fprintf(w, "Not modeled: %s.\n", s)
+	}
+	return nil
+}
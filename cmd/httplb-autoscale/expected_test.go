@@ -0,0 +1,106 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// cpuRun returns a run of a group of two instances, a row per minute with
+// the given target sizes, and its CPU utilization at the end of each
+// minute against a target of 50%. A negative utilization is a minute
+// without a point.
+func cpuRun(cpu []float64, targets []int64) ([]*mergedRow, *scalingSignal) {
+	sig := &scalingSignal{name: "cpu", target: 0.5, values: map[time.Time]float64{}}
+	var rows []*mergedRow
+	for i, u := range cpu {
+		r := &mergedRow{Time: runStart.Add(time.Duration(i) * time.Minute), RunningSize: 2, ActualSize: 2, TargetSize: targets[i]}
+		rows = append(rows, r)
+		if u >= 0 {
+			sig.values[r.Time.Add(time.Minute)] = u
+		}
+	}
+	return rows, sig
+}
+
+func TestExpectSizes(t *testing.T) {
+	c := &policyConfig{MinReplicas: 1, MaxReplicas: 6}
+	cpu := []float64{0.5, 1, 2, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, -1}
+	targets := []int64{2, 2, 4, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+	rows, sig := cpuRun(cpu, targets)
+	// The first minute scales from the instances which exist, none of
+	// which run yet.
+	rows[0].RunningSize = 0
+
+	minutes := expectSizes(c, rows, []*scalingSignal{sig})
+	if len(minutes) != 13 {
+		t.Fatalf("compared %d minutes, want the 13 with a CPU point", len(minutes))
+	}
+	// 2 instances at 100% need 4, at 200% the maximum of 6 and at 25% the
+	// minimum of 1, which the group only scales in to 10 minutes after it
+	// needed 6.
+	wantRecommended := []int64{2, 4, 6, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	wantExpected := []int64{2, 4, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 1}
+	for i, e := range minutes {
+		if e.recommended != wantRecommended[i] || e.expected != wantExpected[i] {
+			t.Errorf("minute %d recommends %d and expects %d, want %d and %d",
+				i, e.recommended, e.expected, wantRecommended[i], wantExpected[i])
+		}
+		if e.size != 2 {
+			t.Errorf("minute %d scales from %d instances, want 2", i, e.size)
+		}
+	}
+	if d := minutes[1].deviation(); d != -2 {
+		t.Errorf("deviation of minute 1 = %d, want the group 2 under", d)
+	}
+	if d := minutes[12].deviation(); d != 5 {
+		t.Errorf("deviation of minute 12 = %d, want the group 5 over", d)
+	}
+}
+
+func TestLags(t *testing.T) {
+	c := &policyConfig{MinReplicas: 1, MaxReplicas: 6}
+	cpu := []float64{0.5, 1, 2, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25, 0.25}
+	targets := []int64{2, 2, 4, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+	rows, sig := cpuRun(cpu, targets)
+	got := lags(expectSizes(c, rows, []*scalingSignal{sig}))
+	want := []scalingLag{
+		// The group never reached 4 before 6 was expected.
+		{at: runStart.Add(time.Minute), from: 2, to: 4, lag: -1},
+		{at: runStart.Add(2 * time.Minute), from: 4, to: 6, lag: time.Minute},
+		// The run ended before the group scaled in.
+		{at: runStart.Add(12 * time.Minute), from: 6, to: 1, lag: -1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("found %d changes of the expected size, want %d", len(got), len(want))
+	}
+	for i, l := range got {
+		if w := want[i]; !l.at.Equal(w.at) || l.from != w.from || l.to != w.to || l.lag != w.lag {
+			t.Errorf("change %d = %+v, want %+v", i, *l, w)
+		}
+	}
+}
+
+func TestPerGroupSignalRecommends(t *testing.T) {
+	sig := &scalingSignal{name: "queue", target: 10, perGroup: true}
+	if n := sig.recommend(3, 45); n != 5 {
+		t.Errorf("a queue of 45 at 10 per instance recommends %d, want 5", n)
+	}
+	sig = &scalingSignal{name: "cpu", target: 0.6}
+	if n := sig.recommend(3, 0.9); n != 5 {
+		t.Errorf("3 instances at 90%% of a 60%% target recommend %d, want 5", n)
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v2"
+)
+
+// An experimentConfig describes a load scenario to be run once against each
+// of several autoscaler policies. It is read from a YAML file such as:
+//
+//	scenario:
+//	  url: http://203.0.113.10/
+//	  phases:
+//	  - {duration: 5m, qps: 20}
+//	  - {duration: 10m, qps: 80}
+//	  traceSampleRate: 0.01
+//	resetSize: 1
+//	costPerInstanceHour: 0.0475
+//	policies:
+//	- {name: cpu-60, config: cpu-60.yaml}
+//	- {name: cpu-80, config: cpu-80.yaml}
+//
+// Every policy config must name the same group. Without costPerInstanceHour,
+// the cost is estimated from the machine type of each policy's template.
+type experimentConfig struct {
+	Scenario            loadgen.Scenario `yaml:"scenario"`
+	ResetSize           int64            `yaml:"resetSize"`
+	CostPerInstanceHour float64          `yaml:"costPerInstanceHour"`
+	Policies            []policyTrial    `yaml:"policies"`
+	// Notifications announces the end of the experiment, and each trial
+	// which broke the SLO.
+	Notifications *notificationsConfig `yaml:"notifications"`
+
+	// configs are the policy configs, in the order of Policies.
+	configs []*policyConfig
+}
+
+// A policyTrial names one of the policies under comparison.
+type policyTrial struct {
+	Name   string `yaml:"name"`
+	Config string `yaml:"config"`
+}
+
+// A trialResult summarizes the run of the scenario against one policy.
+type trialResult struct {
+	name         string
+	load         *loadgen.Result
+	run          *report.ModeSummary
+	finalSize    int64
+	pricePerHour float64
+}
+
+// cost estimates what the run's instances cost.
+func (r *trialResult) cost() float64 {
+	return r.run.InstanceHours * r.pricePerHour
+}
+
+// experimentCmd runs the scenario against each policy in turn, resetting the
+// group between runs, and prints a side by side comparison.
+func experimentCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler experiment", flag.ExitOnError)
+	configPath := fs.String("config", "experiment.yaml", "Path to the experiment config.")
+	outDir := fs.String("out", "experiment", "Directory for per-policy watch event, load and merged timeline files.")
+	interval := fs.Duration("interval", 5*time.Second, "Time between watch polls.")
+	settle := fs.Duration("settle", 10*time.Minute, "How long to wait for the group to stabilize after a reset.")
+	requests := fs.Bool("requests", false, "Also write every request of each trial to PREFIX.requests.jsonl.")
+	fs.Parse(args)
+
+	ec, err := loadExperimentConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	pc := provision.NewCompute(s)
+	nt := newNotifier(ec.Notifications, "autoscaler experiment", *configPath, "")
+	var results []*trialResult
+	for i, t := range ec.Policies {
+		c := ec.configs[i]
+		log.Printf("Running scenario against policy %v.", t.Name)
+		end := otel.phase("reset group", "policy", t.Name)
+		err = resetGroup(ctx, pc, c, ec.ResetSize, *settle)
+		end(err)
+		if err != nil {
+			return fmt.Errorf("unable to reset group before %v: %v", t.Name, err)
+		}
+		eventsPath := filepath.Join(*outDir, t.Name+".jsonl")
+		end = otel.phase("trial", "policy", t.Name)
+		r, err := runTrial(ctx, pc, s, c, &ec.Scenario, eventsPath, *interval)
+		end(err)
+		if err != nil {
+			err = fmt.Errorf("trial %v failed: %v", t.Name, err)
+			nt.send(context.Background(), notifyAborted, err.Error(), comparisons(results))
+			return err
+		}
+		if err := writeTrialTimeline(r, eventsPath, filepath.Join(*outDir, t.Name), *interval, *requests); err != nil {
+			return fmt.Errorf("unable to write timeline of %v: %v", t.Name, err)
+		}
+		r.name = t.Name
+		r.pricePerHour = ec.CostPerInstanceHour
+		if r.pricePerHour == 0 && c.InstanceTemplate != nil {
+			if r.pricePerHour, err = instanceHourlyPrice(*c.InstanceTemplate); err != nil {
+				log.Printf("Unable to estimate the cost of %v: %v", t.Name, err)
+			}
+		}
+		results = append(results, r)
+		// Each trial is judged on its own.
+		cmp := r.comparison()
+		nt.checkSLO(ctx, cmp.ErrorRate, cmp.P95Ms, cmp)
+	}
+	nt.send(ctx, notifyCompleted, fmt.Sprintf("experiment of %d policies finished", len(results)), comparisons(results))
+	return printComparison(results)
+}
+
+// loadExperimentConfig reads and checks the experiment config at path.
+func loadExperimentConfig(path string) (*experimentConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ec := &experimentConfig{}
+	if err := yaml.Unmarshal(b, ec); err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %v", path, err)
+	}
+	if err := ec.Scenario.Check(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", path, err)
+	}
+	if len(ec.Policies) == 0 {
+		return nil, errors.New("experiment has no policies")
+	}
+	if ec.Notifications != nil {
+		if err := ec.Notifications.check(); err != nil {
+			return nil, fmt.Errorf("invalid config %v: notifications: %v", path, err)
+		}
+	}
+	for _, t := range ec.Policies {
+		c, err := loadPolicyConfig(t.Config)
+		if err != nil {
+			return nil, err
+		}
+		if len(ec.configs) > 0 {
+			if err := sameGroup(ec.configs[0], c); err != nil {
+				return nil, fmt.Errorf("invalid config %v: policy %v: %v", path, t.Name, err)
+			}
+		}
+		ec.configs = append(ec.configs, c)
+	}
+	return ec, nil
+}
+
+// sameGroup reports whether c names the group first does, in the same
+// project and location, so that the trials reset and scale one group.
+func sameGroup(first, c *policyConfig) error {
+	for _, f := range []struct{ name, want, got string }{
+		{"project", first.Project, c.Project},
+		{"zone", first.Zone, c.Zone},
+		{"region", first.Region, c.Region},
+		{"group", first.Group, c.Group},
+	} {
+		if f.got != f.want {
+			return fmt.Errorf("%v is %q, but the first policy's is %q; every policy must name the same group", f.name, f.got, f.want)
+		}
+	}
+	return nil
+}
+
+// resetGroup turns autoscaling off and returns the group to a known size so
+// that every trial starts from the same state.
+func resetGroup(ctx context.Context, pc provision.Compute, c *policyConfig, size int64, settle time.Duration) error {
+	a, err := pc.GetAutoscaler(ctx, c.autoscaler())
+	if err != nil {
+		return err
+	}
+	if autoscale.Mode(a) != "OFF" {
+		policy := compute.AutoscalingPolicy{}
+		if a.AutoscalingPolicy != nil {
+			policy = *a.AutoscalingPolicy
+		}
+		policy.Mode = "OFF"
+		a.AutoscalingPolicy = &policy
+		op, err := pc.UpdateAutoscaler(ctx, c.autoscaler(), a)
+		if err == nil {
+			err = pc.WaitForOperation(ctx, c.Project, op)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to set mode of %v to OFF: %v", c.Autoscaler, err)
+		}
+	}
+	p := &provision.Provisioner{Compute: pc, Reporter: progressReporter{}}
+	return p.ResizeGroup(ctx, c.group(), size, settle)
+}
+
+// runTrial applies the policy, offers the scenario's load while watching the
+// group and summarizes the result. For a diurnal scenario the policy's daily
+// scaling schedules are compressed along with the simulated day. The group
+// and autoscaler are read and changed through pc; s is only needed by the
+// config's chaos and budget sections, and the watcher's preemption checks.
+func runTrial(ctx context.Context, pc provision.Compute, s *compute.Service, c *policyConfig, sc *loadgen.Scenario, eventsPath string, interval time.Duration) (*trialResult, error) {
+	mig, err := pc.GetGroup(ctx, c.group())
+	if err != nil {
+		return nil, err
+	}
+	policy := c.autoscalingPolicy()
+	if sc.Diurnal != nil && len(c.Schedules) > 0 {
+		// Fire the schedules at the simulated hours they were written for.
+		compressed := *c
+		if compressed.Schedules, err = compressSchedules(c.Schedules, sc.Diurnal, time.Now()); err != nil {
+			return nil, err
+		}
+		for _, cs := range compressed.Schedules {
+			log.Printf("Compressed schedule %v to %q UTC for %ds.", cs.Name, cs.Schedule, cs.DurationSec)
+		}
+		policy = compressed.autoscalingPolicy()
+	}
+	a := &compute.Autoscaler{
+		Name:              c.Autoscaler,
+		Target:            mig.SelfLink,
+		AutoscalingPolicy: policy,
+	}
+	op, err := pc.UpdateAutoscaler(ctx, c.autoscaler(), a)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply policy: %v", err)
+	}
+	if err := pc.WaitForOperation(ctx, c.Project, op); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(eventsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := &watcher{compute: pc, s: s, c: c, out: f}
+	if c.Chaos != nil {
+		if w.chaos, err = newChaosController(c.Chaos); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.Budget != nil {
+		if w.budget, err = newBudgetGuard(c, time.Now().Add(sc.Duration()), cancel); err != nil {
+			return nil, err
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx, interval, stop)
+		close(done)
+	}()
+	load, err := runLoad(ctx, sc)
+	close(stop)
+	<-done
+	if w.budget != nil && w.budget.exceeded != "" {
+		return nil, fmt.Errorf("aborted: %v", w.budget.exceeded)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := report.ReadWatchEvents(eventsPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no watch events were recorded")
+	}
+	// Extend the last observed state to the end of the run.
+	last := *events[len(events)-1]
+	last.Time = time.Now().UTC()
+	events = append(events, &last)
+	summaries := map[string]*report.ModeSummary{}
+	report.SummarizeRun(summaries, events)
+	run := &report.ModeSummary{}
+	for _, m := range summaries {
+		run.Duration += m.Duration
+		run.InstanceHours += m.InstanceHours
+		run.ScaleOuts += m.ScaleOuts
+		run.ScaleIns += m.ScaleIns
+		if m.PeakTarget > run.PeakTarget {
+			run.PeakTarget = m.PeakTarget
+		}
+	}
+	return &trialResult{load: load, run: run, finalSize: last.TargetSize}, nil
+}
+
+// writeTrialTimeline saves the trial's load intervals to PREFIX.load.jsonl,
+// its latency by serving zone and region to PREFIX.zones.jsonl, and merges
+// the intervals with its watch events into PREFIX.merged.jsonl. With
+// requests set it also saves each request to PREFIX.requests.jsonl. Load
+// balancer metrics arrive too late to include; report merge -query-metrics
+// and report zones add them afterwards.
+func writeTrialTimeline(r *trialResult, eventsPath, prefix string, width time.Duration, requests bool) error {
+	load := r.load.Intervals(width)
+	if err := loadgen.WriteIntervals(prefix+".load.jsonl", load); err != nil {
+		return err
+	}
+	if err := writeScopeLatencies(prefix+".zones.jsonl", scopeLatencies(r.load)); err != nil {
+		return err
+	}
+	if requests {
+		if err := r.load.WriteRequestSamples(prefix + ".requests.jsonl"); err != nil {
+			return err
+		}
+	}
+	events, err := report.ReadWatchEvents(eventsPath)
+	if err != nil {
+		return err
+	}
+	return writeMergedRun(prefix+".merged.jsonl", mergeRun(events, load, nil, width))
+}
+
+// A trialComparison is one policy's row of the experiment's comparison.
+type trialComparison struct {
+	Policy        string  `json:"policy"`
+	Requests      int     `json:"requests"`
+	ErrorRate     float64 `json:"errorRate"`
+	P50Ms         float64 `json:"p50Ms"`
+	P95Ms         float64 `json:"p95Ms"`
+	P99Ms         float64 `json:"p99Ms"`
+	PeakSize      int64   `json:"peakSize"`
+	MeanSize      float64 `json:"meanSize"`
+	FinalSize     int64   `json:"finalSize"`
+	ScaleOuts     int     `json:"scaleOuts"`
+	InstanceHours float64 `json:"instanceHours"`
+	CostUSD       float64 `json:"costUsd"`
+}
+
+// comparisons returns the comparison rows of the trials.
+func comparisons(results []*trialResult) []trialComparison {
+	rows := []trialComparison{}
+	for _, r := range results {
+		rows = append(rows, r.comparison())
+	}
+	return rows
+}
+
+// printComparison writes one row per trial so the policies can be compared
+// side by side.
+func printComparison(results []*trialResult) error {
+	rows := comparisons(results)
+	return printResult(rows, func(w io.Writer) error {
+		tw := newTable(w)
+		writeComparisonTable(tw, rows)
+		return tw.Flush()
+	})
+}
+
+// comparison returns the trial's row of the comparison.
+func (r *trialResult) comparison() trialComparison {
+	return trialComparison{r.name, r.load.Requests(), r.load.ErrorRate(),
+		report.Millis(r.load.Percentile(0.5)), report.Millis(r.load.Percentile(0.95)),
+		report.Millis(r.load.Percentile(0.99)), r.run.PeakTarget, r.run.MeanSize(), r.finalSize,
+		r.run.ScaleOuts, r.run.InstanceHours, r.cost()}
+}
+
+// writeComparisonTable writes a header and one line per row to a table.
+func writeComparisonTable(w io.Writer, rows []trialComparison) {
+	fmt.Fprintln(w, "POLICY\tREQUESTS\tERRORS\tP50\tP95\tP99\tPEAK SIZE\tMEAN SIZE\tFINAL SIZE\tSCALE OUTS\tINSTANCE HOURS\tCOST")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%.1fms\t%.1fms\t%.1fms\t%d\t%.2f\t%d\t%d\t%.2f\t$%.2f\n", row.Policy,
+			row.Requests, 100*row.ErrorRate, row.P50Ms, row.P95Ms, row.P99Ms, row.PeakSize, row.MeanSize,
+			row.FinalSize, row.ScaleOuts, row.InstanceHours, row.CostUSD)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision/provisiontest"
+	"google.golang.org/api/compute/v1"
+)
+
+// The time the tests give a group to reach a size.
+const testSettle = 5 * time.Second
+
+// testConfig scales the group web between one and six instances at 60% CPU.
+func testConfig() *policyConfig {
+	return &policyConfig{
+		Project:        "p",
+		Zone:           "us-central1-f",
+		Group:          "web",
+		Autoscaler:     "web-as",
+		MinReplicas:    1,
+		MaxReplicas:    6,
+		CPUUtilization: 0.6,
+	}
+}
+
+// newTestSimulator returns a Simulator offering load to c's group of size
+// instances, whose autoscaler is in mode. Its instances boot in 100ms, and
+// the group is polled every 5ms while it is waited on. opts configure the
+// Simulator further.
+func newTestSimulator(t *testing.T, c *policyConfig, size int64, mode string, load float64, opts ...provisiontest.SimOption) *provisiontest.Simulator {
+	t.Helper()
+	poll := mig.PollInterval
+	mig.PollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { mig.PollInterval = poll })
+
+	ctx := context.Background()
+	sim := provisiontest.NewSimulator(append([]provisiontest.SimOption{
+		provisiontest.WithOperationLatency(5 * time.Millisecond),
+		provisiontest.WithBootTime(100*time.Millisecond, 0),
+		provisiontest.WithDeleteTime(10 * time.Millisecond),
+		provisiontest.WithAutoscalerInterval(10 * time.Millisecond),
+		provisiontest.WithStabilization(200 * time.Millisecond),
+		provisiontest.WithLoad(func(time.Time) float64 { return load }),
+	}, opts...)...)
+	op, err := sim.InsertGroup(ctx, c.group(), &compute.InstanceGroupManager{TargetSize: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WaitForOperation(ctx, c.Project, op); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sim.GetGroup(ctx, c.group())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := c.autoscalingPolicy()
+	policy.Mode = mode
+	op, err = sim.InsertAutoscaler(ctx, c.autoscaler(), &compute.Autoscaler{Name: c.Autoscaler, Target: m.SelfLink, AutoscalingPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WaitForOperation(ctx, c.Project, op); err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func TestResetGroup(t *testing.T) {
+	c := testConfig()
+	// 2.7 busy instances at 60% need 5.
+	clock := &provisiontest.Clock{}
+	sim := newTestSimulator(t, c, 1, "ON", 2.7, provisiontest.WithClock(clock.Now))
+	ctx := context.Background()
+	deadline := time.Now().Add(testSettle)
+	for {
+		if _, target := sim.Serving(c.Group); target == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the autoscaler did not scale the group out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := resetGroup(ctx, sim, c, 2, testSettle); err != nil {
+		t.Fatal(err)
+	}
+	if serving, target := sim.Serving(c.Group); serving != 2 || target != 2 {
+		t.Errorf("after the reset, %d of %d instances serve; want 2 of 2", serving, target)
+	}
+	a, err := sim.GetAutoscaler(ctx, c.autoscaler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := autoscale.Mode(a); mode != "OFF" {
+		t.Errorf("autoscaler mode = %v after the reset, want OFF", mode)
+	}
+	if a.AutoscalingPolicy.MaxNumReplicas != c.MaxReplicas {
+		t.Errorf("the reset changed the maximum to %d", a.AutoscalingPolicy.MaxNumReplicas)
+	}
+	clock.Advance(time.Second)
+	if _, target := sim.Serving(c.Group); target != 2 {
+		t.Errorf("target size = %d after the reset, want the autoscaler to leave it at 2", target)
+	}
+}
+
+func TestResetGroupWithoutAutoscaler(t *testing.T) {
+	c := testConfig()
+	sim := newTestSimulator(t, c, 1, "OFF", 0)
+	c.Autoscaler = "missing"
+	if err := resetGroup(context.Background(), sim, c, 2, testSettle); !mig.IsNotFound(err) {
+		t.Errorf("resetGroup = %v, want the autoscaler not found", err)
+	}
+}
+
+func TestRunTrialScalesOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	c := testConfig()
+	// The trial turns the autoscaler on, and 2.0 busy instances at 60%
+	// need 4.
+	sim := newTestSimulator(t, c, 1, "OFF", 2.0)
+	sc := &loadgen.Scenario{URL: srv.URL, Phases: []loadgen.Phase{{Duration: time.Second, QPS: 20}}}
+
+	r, err := runTrial(context.Background(), sim, nil, c, sc, filepath.Join(t.TempDir(), "events.jsonl"), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.finalSize != 4 {
+		t.Errorf("final size = %d, want 4", r.finalSize)
+	}
+	if r.run.ScaleOuts == 0 || r.run.PeakTarget != 4 {
+		t.Errorf("run had %d scale outs peaking at %d, want some peaking at 4", r.run.ScaleOuts, r.run.PeakTarget)
+	}
+	if r.load == nil || r.load.Requests() == 0 {
+		t.Error("the trial offered no load")
+	}
+	if serving, _ := sim.Serving(c.Group); serving != 4 {
+		t.Errorf("%d instances serve after the trial, want 4", serving)
+	}
+}
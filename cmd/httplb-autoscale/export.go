@@ -0,0 +1,267 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Metric types exported by metrics export unless -metrics is given.
+var defaultExportMetrics = []string{
+	"loadbalancing.googleapis.com/https/request_count",
+	"loadbalancing.googleapis.com/https/backend_latencies",
+	"loadbalancing.googleapis.com/https/total_latencies",
+	"compute.googleapis.com/instance/cpu/utilization",
+	"custom.googleapis.com/imagemagick/queue_length",
+	"custom.googleapis.com/imagemagick/in_flight",
+}
+
+// exportFilter returns the filter selecting the run's series of a metric
+// type: load balancer metrics of the config's backend service, and instance
+// metrics of the instances labelled with the run ID.
+func exportFilter(c *policyConfig, metricType, runID string) string {
+	filter := fmt.Sprintf("metric.type = %q", metricType)
+	switch {
+	case strings.HasPrefix(metricType, "loadbalancing.googleapis.com/"):
+		if c.BackendService != "" {
+			filter += " AND " + lbFilter(c.BackendService)
+		}
+	case runID != "":
+		filter += fmt.Sprintf(` AND metadata.user_labels.%q = %q`, runIDLabel, runID)
+	}
+	return filter
+}
+
+// listAllTimeSeries returns every raw point of the series matching filter
+// between start and end, following pagination.
+func listAllTimeSeries(ctx context.Context, m *monitoring.Service, project, filter string, start, end time.Time) ([]*monitoring.TimeSeries, error) {
+	var series []*monitoring.TimeSeries
+	token := ""
+	for {
+		call := m.Projects.TimeSeries.List("projects/" + project).
+			Filter(filter).
+			IntervalStartTime(start.UTC().Format(time.RFC3339)).
+			IntervalEndTime(end.UTC().Format(time.RFC3339))
+		if token != "" {
+			call = call.PageToken(token)
+		}
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, resp.TimeSeries...)
+		if token = resp.NextPageToken; token == "" {
+			return series, nil
+		}
+	}
+}
+
+// writeSeriesCSV writes the points of the series as a tidy CSV file: one
+// row per point, with a column for each resource and metric label. For
+// distribution metrics, value is the mean and count the number of samples.
+func writeSeriesCSV(path string, series []*monitoring.TimeSeries) (int, error) {
+	labelSet := map[string]bool{}
+	for _, ts := range series {
+		for k := range ts.Resource.Labels {
+			labelSet["resource."+k] = true
+		}
+		if ts.Metric != nil {
+			for k := range ts.Metric.Labels {
+				labelSet["metric."+k] = true
+			}
+		}
+	}
+	labels := make([]string, 0, len(labelSet))
+	for k := range labelSet {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"start_time", "end_time", "value", "count"}, labels...))
+	rows := 0
+	for _, ts := range series {
+		values := make([]string, len(labels))
+		for i, k := range labels {
+			if strings.HasPrefix(k, "resource.") {
+				values[i] = ts.Resource.Labels[strings.TrimPrefix(k, "resource.")]
+			} else if ts.Metric != nil {
+				values[i] = ts.Metric.Labels[strings.TrimPrefix(k, "metric.")]
+			}
+		}
+		for _, p := range ts.Points {
+			count := ""
+			if p.Value != nil && p.Value.DistributionValue != nil {
+				count = strconv.FormatInt(p.Value.DistributionValue.Count, 10)
+			}
+			row := []string{p.Interval.StartTime, p.Interval.EndTime,
+				strconv.FormatFloat(pointValue(p.Value), 'g', -1, 64), count}
+			if err := w.Write(append(row, values...)); err != nil {
+				f.Close()
+				return rows, err
+			}
+			rows++
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return rows, err
+	}
+	return rows, f.Close()
+}
+
+// csvName turns a metric type into a file name, e.g.
+// "loadbalancing.googleapis.com/https/request_count" into
+// "loadbalancing_https_request_count.csv".
+func csvName(metricType string) string {
+	parts := strings.Split(metricType, "/")
+	parts[0] = strings.TrimSuffix(parts[0], ".googleapis.com")
+	return strings.Join(parts, "_") + ".csv"
+}
+
+// runWindow returns the time covered by a watch event file.
+func runWindow(path string) (time.Time, time.Time, error) {
+	events, err := report.ReadWatchEvents(path)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if len(events) == 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("%v has no events", path)
+	}
+	start, end := eventsWindow(events)
+	return start, end, nil
+}
+
+// eventsWindow returns the times of the first and last of the events.
+func eventsWindow(events []*report.WatchEvent) (time.Time, time.Time) {
+	start, end := events[0].Time, events[0].Time
+	for _, e := range events {
+		if e.Time.Before(start) {
+			start = e.Time
+		}
+		if e.Time.After(end) {
+			end = e.Time
+		}
+	}
+	return start, end
+}
+
+// windowFlags select the time window of a run, shared by the commands which
+// read a run back from Cloud Monitoring or Cloud Logging.
+type windowFlags struct {
+	watch *string
+	start *string
+	end   *string
+}
+
+// addWindowFlags registers the window flags on fs.
+func addWindowFlags(fs *flag.FlagSet) *windowFlags {
+	return &windowFlags{
+		watch: fs.String("watch", "", "Watch event file whose time span is used, instead of -start and -end."),
+		start: fs.String("start", "", "Start of the window, as an RFC 3339 time."),
+		end:   fs.String("end", "", "End of the window, as an RFC 3339 time. Defaults to now."),
+	}
+}
+
+// window returns the window selected by the flags.
+func (f *windowFlags) window() (start, end time.Time, err error) {
+	switch {
+	case *f.watch != "":
+		return runWindow(*f.watch)
+	case *f.start != "":
+		if start, err = time.Parse(time.RFC3339, *f.start); err != nil {
+			return start, end, fmt.Errorf("invalid -start: %v", err)
+		}
+		end = time.Now()
+		if *f.end != "" {
+			if end, err = time.Parse(time.RFC3339, *f.end); err != nil {
+				return start, end, fmt.Errorf("invalid -end: %v", err)
+			}
+		}
+		return start, end, nil
+	}
+	return start, end, errors.New("either -watch or -start is required")
+}
+
+// metricsExportCmd downloads the raw points of the run's metrics into one CSV
+// file per metric type, for analysis outside these tools.
+func metricsExportCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("metrics export", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	runIDFlag := fs.String("run-id", "", "Run whose instance metrics to export. Defaults to the config's runId, or else the run of the newest template.")
+	metrics := fs.String("metrics", strings.Join(defaultExportMetrics, ","), "Comma separated metric types to export.")
+	wf := addWindowFlags(fs)
+	outDir := fs.String("out", "metrics", "Directory for the CSV files.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	id := *runIDFlag
+	if id == "" {
+		if id, err = runID(c, *statePath); err != nil {
+			return err
+		}
+	}
+	start, end, err := wf.window()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	m, err := newMonitoringService()
+	if err != nil {
+		return fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	for _, mt := range strings.Split(*metrics, ",") {
+		mt = strings.TrimSpace(mt)
+		if mt == "" {
+			continue
+		}
+		series, err := listAllTimeSeries(ctx, m, c.projectFor(monitoringProjects), exportFilter(c, mt, id), start, end)
+		if err != nil {
+			return fmt.Errorf("unable to list %v: %v", mt, err)
+		}
+		path := filepath.Join(*outDir, csvName(mt))
+		rows, err := writeSeriesCSV(path, series)
+		if err != nil {
+			return fmt.Errorf("unable to write %v: %v", path, err)
+		}
+		log.Printf("Wrote %d points of %d series of %v to %v.", rows, len(series), mt, path)
+	}
+	return nil
+}
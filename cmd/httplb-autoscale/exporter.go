@@ -0,0 +1,217 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"google.golang.org/api/compute/v1"
+)
+
+// Prefix of every metric served by metrics serve.
+const exporterPrefix = "httplb_"
+
+// A gauge is one metric family in the Prometheus text format, with its
+// samples keyed by their rendered label set.
+type gauge struct {
+	name    string
+	help    string
+	samples map[string]float64
+}
+
+// A gaugeSet collects the gauges of one poll.
+type gaugeSet struct {
+	gauges map[string]*gauge
+}
+
+// newGaugeSet returns an empty gauge set.
+func newGaugeSet() *gaugeSet {
+	return &gaugeSet{gauges: map[string]*gauge{}}
+}
+
+// set records a sample of the named gauge. Labels are given as name, value
+// pairs.
+func (gs *gaugeSet) set(name, help string, value float64, labels ...string) {
+	g, ok := gs.gauges[name]
+	if !ok {
+		g = &gauge{name: exporterPrefix + name, help: help, samples: map[string]float64{}}
+		gs.gauges[name] = g
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	g.samples["{"+strings.Join(pairs, ",")+"}"] = value
+}
+
+// write renders the gauges in the Prometheus text exposition format, in name
+// order so that scrapes are stable.
+func (gs *gaugeSet) write(b *bytes.Buffer) {
+	names := make([]string, 0, len(gs.gauges))
+	for name := range gs.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := gs.gauges[name]
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		labelSets := make([]string, 0, len(g.samples))
+		for l := range g.samples {
+			labelSets = append(labelSets, l)
+		}
+		sort.Strings(labelSets)
+		for _, l := range labelSets {
+			fmt.Fprintf(b, "%s%s %v\n", g.name, l, g.samples[l])
+		}
+	}
+}
+
+// An exporter polls the config's groups and serves the latest results.
+type exporter struct {
+	s *compute.Service
+	c *policyConfig
+
+	mu      sync.Mutex
+	metrics []byte
+}
+
+// poll samples every group once and replaces the served metrics.
+func (x *exporter) poll(ctx context.Context) {
+	gs := newGaugeSet()
+	for _, bc := range x.c.backendGroups() {
+		labels := []string{"project", bc.Project, "location", bc.location(), "group", bc.Group}
+		err := x.sampleGroup(ctx, gs, bc, labels)
+		up := 1.0
+		if err != nil {
+			log.Printf("Unable to sample %v: %v", bc.Group, err)
+			up = 0
+		}
+		gs.set("poll_success", "Whether the last poll of the group succeeded.", up, labels...)
+	}
+	gs.set("last_poll_timestamp_seconds", "Time of the last poll.", float64(time.Now().Unix()))
+	var b bytes.Buffer
+	gs.write(&b)
+	x.mu.Lock()
+	x.metrics = b.Bytes()
+	x.mu.Unlock()
+}
+
+// sampleGroup adds the gauges of one group.
+func (x *exporter) sampleGroup(ctx context.Context, gs *gaugeSet, c *policyConfig, labels []string) error {
+	m, err := getGroupManager(ctx, x.s, c)
+	if err != nil {
+		return err
+	}
+	instances, err := listManagedInstances(ctx, x.s, c)
+	if err != nil {
+		return err
+	}
+	running := 0
+	for _, i := range instances {
+		if i.InstanceStatus == "RUNNING" && i.CurrentAction == "NONE" {
+			running++
+		}
+	}
+	gs.set("mig_target_size", "Target size of the managed instance group.", float64(m.TargetSize), labels...)
+	gs.set("mig_actual_size", "Instances in the group, in any state.", float64(len(instances)), labels...)
+	gs.set("mig_running_size", "Instances which are running with no pending action.", float64(running), labels...)
+
+	if c.Autoscaler != "" {
+		a, err := getAutoscaler(ctx, x.s, c)
+		if err != nil {
+			return err
+		}
+		al := append(labels[:len(labels):len(labels)], "autoscaler", a.Name)
+		gs.set("autoscaler_recommended_size", "Size the autoscaler currently recommends.", float64(a.RecommendedSize), al...)
+		current := autoscale.Mode(a)
+		for mode := range autoscalerModes {
+			v := 0.0
+			if mode == current {
+				v = 1
+			}
+			gs.set("autoscaler_mode", "1 for the autoscaler's current mode, 0 for the others.", v,
+				append(al[:len(al):len(al)], "mode", mode)...)
+		}
+		gs.set("autoscaler_status", "1 for the autoscaler's current status.", 1,
+			append(al[:len(al):len(al)], "status", a.Status)...)
+	}
+
+	if c.BackendService != "" {
+		health, err := x.s.BackendServices.GetHealth(c.Project, c.BackendService, &compute.ResourceGroupReference{
+			Group: m.InstanceGroup,
+		}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to get health of %v: %v", c.BackendService, err)
+		}
+		healthy := 0
+		for _, h := range health.HealthStatus {
+			if h.HealthState == "HEALTHY" {
+				healthy++
+			}
+		}
+		gs.set("backend_healthy", "Instances of the group the backend service reports healthy.", float64(healthy),
+			append(labels[:len(labels):len(labels)], "backend_service", c.BackendService)...)
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics of the latest poll.
+func (x *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	x.mu.Lock()
+	b := x.metrics
+	x.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b)
+}
+
+// metricsServeCmd runs a Prometheus exporter for every group in the config,
+// polling the Compute API at a fixed interval rather than on each scrape so
+// that scrapes neither wait on nor multiply API calls.
+func metricsServeCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("metrics serve", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	listen := fs.String("listen", ":9464", "Address to serve /metrics on.")
+	interval := fs.Duration("interval", 15*time.Second, "Time between polls of the Compute API.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	x := &exporter{s: s, c: c}
+	x.poll(ctx)
+	go func() {
+		for range time.Tick(*interval) {
+			x.poll(ctx)
+		}
+	}()
+	http.Handle("/metrics", x)
+	log.Printf("Serving metrics of %d groups on %v/metrics.", len(c.backendGroups()), *listen)
+	return http.ListenAndServe(*listen, nil)
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A flapDetector notices instances whose load balancer health check result
+// keeps changing. Such an instance takes traffic, fails, and takes traffic
+// again, which makes utilization based autoscaling oscillate with it.
+type flapDetector struct {
+	backendService string
+	// threshold is the number of health changes within window which makes
+	// an instance flapping.
+	threshold int
+	window    time.Duration
+	// webhook, if set, receives each alert as a JSON POST.
+	webhook string
+	// states holds the latest health state of each instance.
+	states map[string]string
+	// changes holds the times of each instance's recent health changes.
+	changes map[string][]time.Time
+	// flagged holds the instances reported as flapping, with their total
+	// number of health changes.
+	flagged map[string]int
+}
+
+// observe compares the health of the group's instances with the previous
+// sample and returns an "instance-flapping" alert for each instance which
+// has just crossed the threshold.
+func (d *flapDetector) observe(ctx context.Context, s *compute.Service, c *policyConfig, mig *compute.InstanceGroupManager, e *report.WatchEvent) ([]*report.WatchEvent, error) {
+	if d.states == nil {
+		d.states = make(map[string]string)
+		d.changes = make(map[string][]time.Time)
+		d.flagged = make(map[string]int)
+	}
+	health, err := s.BackendServices.GetHealth(c.Project, d.backendService, &compute.ResourceGroupReference{
+		Group: mig.InstanceGroup,
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get health of %v: %v", d.backendService, err)
+	}
+	var alerts []*report.WatchEvent
+	for _, h := range health.HealthStatus {
+		name := path.Base(h.Instance)
+		prev, ok := d.states[name]
+		d.states[name] = h.HealthState
+		if !ok || prev == h.HealthState {
+			continue
+		}
+		recent := append(d.changes[name], e.Time)
+		for len(recent) > 0 && e.Time.Sub(recent[0]) > d.window {
+			recent = recent[1:]
+		}
+		d.changes[name] = recent
+		if n, ok := d.flagged[name]; ok {
+			d.flagged[name] = n + 1
+			continue
+		}
+		if len(recent) >= d.threshold {
+			d.flagged[name] = len(recent)
+			ev := *e
+			ev.Instance = name
+			alerts = append(alerts, raiseAlert(d.webhook, &ev, "instance-flapping",
+				fmt.Sprintf("instance %v changed health %d times in %v, now %v", name, len(recent), d.window, h.HealthState)))
+		}
+	}
+	return alerts, nil
+}
+
+// logFlapping prints the instances found flapping during the watch.
+func (d *flapDetector) logFlapping() {
+	if len(d.flagged) == 0 {
+		return
+	}
+	names := make([]string, 0, len(d.flagged))
+	for name := range d.flagged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%v (%d changes)", name, d.flagged[name])
+	}
+	log.Printf("Flapping instances: %s.", strings.Join(names, ", "))
+}
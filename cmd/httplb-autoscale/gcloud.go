@@ -0,0 +1,121 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// gcloudConfigDir returns the directory holding the gcloud configurations.
+func gcloudConfigDir() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud")
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud")
+}
+
+// gcloudProperties reads the properties of the active gcloud configuration,
+// keyed by "SECTION/NAME" as in "gcloud config get compute/zone". It returns
+// an empty map if gcloud is not configured.
+func gcloudProperties() map[string]string {
+	props := map[string]string{}
+	dir := gcloudConfigDir()
+	if dir == "" {
+		return props
+	}
+	name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if name == "" {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "active_config"))
+		if err == nil {
+			name = strings.TrimSpace(string(b))
+		}
+	}
+	if name == "" {
+		name = "default"
+	}
+	f, err := os.Open(filepath.Join(dir, "configurations", "config_"+name))
+	if err != nil {
+		return props
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) == 2 {
+				props[section+"/"+strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return props
+}
+
+// gcloudProperty returns a gcloud property, preferring its CLOUDSDK_
+// environment variable, e.g. CLOUDSDK_COMPUTE_ZONE for compute/zone, over
+// the active configuration as gcloud itself does.
+func gcloudProperty(props map[string]string, name string) string {
+	env := "CLOUDSDK_" + strings.ToUpper(strings.Replace(name, "/", "_", 1))
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return props[name]
+}
+
+// applyGcloudDefaults fills in the project and location from the gcloud
+// configuration when the config, the environment and the flags leave them
+// unset. A zone is preferred over a region, as in gcloud, unless the config
+// lists zones, which makes the group regional.
+func (c *policyConfig) applyGcloudDefaults() {
+	if c.Project != "" && (c.Zone != "" || c.Region != "") {
+		return
+	}
+	props := gcloudProperties()
+	if c.Project == "" {
+		if c.Project = gcloudProperty(props, "core/project"); c.Project != "" {
+			log.Printf("Using project %v from the gcloud configuration.", c.Project)
+		}
+	}
+	if c.Zone != "" || c.Region != "" {
+		return
+	}
+	if len(c.Zones) == 0 {
+		if c.Zone = gcloudProperty(props, "compute/zone"); c.Zone != "" {
+			log.Printf("Using zone %v from the gcloud configuration.", c.Zone)
+			return
+		}
+	}
+	if c.Region = gcloudProperty(props, "compute/region"); c.Region != "" {
+		log.Printf("Using region %v from the gcloud configuration.", c.Region)
+	}
+}
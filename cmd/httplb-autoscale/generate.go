@@ -0,0 +1,388 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"google.golang.org/api/storage/v1"
+)
+
+// generateFilesCmd uploads an image to a bucket and duplicates it into the
+// corpus the file servers read, using several concurrent copiers. It does
+// what scripts/generate_files.go does, with the application default
+// credentials rather than only those of a Compute Engine instance.
+//
+// With -regions the corpus is generated in a bucket of each location at
+// once, BUCKET-LOCATION, which is created in -project if it does not exist,
+// for tests of a global load balancer with backend buckets; -manifest then
+// records the URLs of each location's objects. -sample-verify then GETs a
+// random sample of the files, from Cloud Storage or through -verify-url,
+// so that a load test only starts on a corpus readable end to end.
+func generateFilesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("generate files", flag.ExitOnError)
+	bucket := fs.String("bucket", "", "Cloud Storage bucket to generate the files in.")
+	imagePath := fs.String("image", "", "Path of the image file to duplicate.")
+	files := fs.Int("files", 10000, "Number of files to generate, including the original.")
+	copiers := fs.Int("copiers", 10, "Number of concurrent copies.")
+	attempts := fs.Int("attempts", 1, "Attempts made at each copy before it is reported as failed. The client already retries each call under -api-attempts, so more attempts multiply those.")
+	backoff := fs.Duration("backoff", 0, "Wait before retrying a failed copy, doubling with every further attempt.")
+	regions := fs.String("regions", "", "Comma-separated bucket locations, e.g. US,EU,ASIA, to generate the corpus in the bucket BUCKET-LOCATION of each at once.")
+	project := fs.String("project", "", "Project to create the -regions buckets in when they do not exist.")
+	manifestPath := fs.String("manifest", "", "Path to write the manifest of each location's URLs to, with -regions.")
+	kmsKey := fs.String("kms-key", "", "Cloud KMS key, projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY, to encrypt the files with instead of the bucket's default key.")
+	billingProject := fs.String("billing-project", "", "Project billed for the Cloud Storage calls, which requester pays buckets need.")
+	benchmarkPath := fs.String("benchmark", "", "Path to write the benchmark of the copies to: their throughput over time, call latencies and retry and error rates; defaults to next to the -manifest.")
+	public := fs.Bool("public", false, "Make the files readable by anyone, as the file servers fetch them: with an IAM binding on buckets with uniform bucket-level access, and object ACLs on the others.")
+	sampleVerify := fs.Int("sample-verify", 0, "GET this many generated files at random afterwards, and report the success rate, latency and cache headers; 0 does not.")
+	verifyURL := fs.String("verify-url", "", "URL to -sample-verify through, e.g. that of the load balancer; defaults to Cloud Storage itself.")
+	fs.Parse(args)
+	if *bucket == "" || *imagePath == "" {
+		return errors.New("-bucket and -image are required")
+	}
+	if *files < 1 || *copiers < 1 || *attempts < 1 {
+		return errors.New("-files, -copiers and -attempts must be positive")
+	}
+	if *regions == "" && (*project != "" || *manifestPath != "") {
+		return errors.New("-project and -manifest need -regions")
+	}
+	if *sampleVerify < 0 || *sampleVerify == 0 && *verifyURL != "" {
+		return errors.New("-sample-verify must be positive, and is needed by -verify-url")
+	}
+	if *benchmarkPath == "" && *manifestPath != "" {
+		*benchmarkPath = strings.TrimSuffix(*manifestPath, filepath.Ext(*manifestPath)) + ".benchmark.json"
+	}
+	if *kmsKey != "" {
+		if err := checkKMSKey(*kmsKey); err != nil {
+			return err
+		}
+		if strings.Contains(*regions, ",") {
+			// A key only serves buckets in its own location.
+			return errors.New("-kms-key cannot encrypt the buckets of several -regions")
+		}
+	}
+
+	s, err := newStorageService()
+	if err != nil {
+		return fmt.Errorf("failed to create Cloud Storage client: %v", err)
+	}
+	opts := []gcsgen.Option{
+		gcsgen.WithFiles(*files),
+		gcsgen.WithConcurrency(*copiers),
+		gcsgen.WithRetry(gcsgen.RetryPolicy{Attempts: *attempts, Backoff: *backoff}),
+		gcsgen.WithProgress(func(p gcsgen.Progress) {
+			switch {
+			case p.Err != nil:
+				log.Print(p.Err)
+			case p.Done%100 == 0:
+				progressf("Copying %v", progressBar(p.Done, p.Total))
+			}
+		}),
+		gcsgen.WithKMSKey(*kmsKey),
+		gcsgen.WithBillingProject(*billingProject),
+	}
+	sv := sampleVerification{n: *sampleVerify, url: *verifyURL, concurrency: *copiers, billingProject: *billingProject}
+	if *regions != "" {
+		return generateRegions(ctx, s, *bucket, strings.Split(*regions, ","), *project, *billingProject, *public, *imagePath, *manifestPath, *benchmarkPath, sv, opts)
+	}
+	if *public {
+		opt, err := publicAccess(ctx, s, *bucket, *billingProject)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, opt)
+	}
+
+	f, err := os.Open(*imagePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	g := gcsgen.New(s, *bucket, path.Base(*imagePath), f, opts...)
+	res, err := g.Run(ctx)
+	endProgress()
+	if err != nil {
+		return err
+	}
+	log.Printf("%v/%v copied in %v.", res.Copied, *files, res.Duration.Round(time.Second))
+	logBenchmark(res.Benchmark)
+	if *benchmarkPath != "" {
+		if err := writeBenchmark(*benchmarkPath, res.Benchmark); err != nil {
+			return err
+		}
+	}
+	if len(res.Failures) > 0 {
+		return fmt.Errorf("%d copies failed", len(res.Failures))
+	}
+	return sv.run(ctx, "https://storage.googleapis.com/"+*bucket, g.Generated(res))
+}
+
+// A sampleVerification is the -sample-verify step of generate files.
+type sampleVerification struct {
+	// n is the number of GETs, zero for none, url the URL to make them
+	// through rather than that of the bucket, and concurrency the number
+	// made at once.
+	n           int
+	url         string
+	concurrency int
+	// billingProject, if set, is billed for the GETs made of Cloud
+	// Storage itself.
+	billingProject string
+}
+
+// run GETs a sample of the objects under base, unless through sv.url, and
+// fails unless every GET succeeds. The GETs of Cloud Storage itself are
+// authorized and billed to sv.billingProject, so that private and requester
+// pays buckets verify too; those through sv.url are anonymous, like the
+// load test's.
+func (sv sampleVerification) run(ctx context.Context, base string, objects []string) error {
+	if sv.n == 0 {
+		return nil
+	}
+	var client *http.Client
+	if sv.url != "" {
+		base = sv.url
+	} else {
+		c, err := groupClient(servingProjects, storage.DevstorageReadOnlyScope)
+		if err != nil {
+			return err
+		}
+		if sv.billingProject != "" {
+			c.Transport = &userProjectTransport{base: c.Transport, project: sv.billingProject}
+		}
+		client = traced(c)
+	}
+	log.Printf("Verifying %d random files through %v.", sv.n, base)
+	v, err := gcsgen.Verify(ctx, client, base, objects, sv.n, sv.concurrency)
+	if err != nil {
+		return err
+	}
+	err = printResult(v, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "BASE\tREQUESTS\tSUCCESS\tP50\tP95\tP99\tMAX\tAGED")
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%.0fms\t%.0fms\t%.0fms\t%.0fms\t%d\n", v.Base, v.Requests, 100*v.SuccessRate,
+			v.P50Ms, v.P95Ms, v.P99Ms, v.MaxMs, v.Aged)
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "HEADER\tVALUE\tRESPONSES")
+		var headers []string
+		for h := range v.CacheHeaders {
+			headers = append(headers, h)
+		}
+		sort.Strings(headers)
+		for _, h := range headers {
+			var values []string
+			for value := range v.CacheHeaders[h] {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			for _, value := range values {
+				shown := value
+				if shown == "" {
+					shown = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%d\n", h, shown, v.CacheHeaders[h][value])
+			}
+		}
+		return tw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range v.Failures {
+		log.Print(f)
+	}
+	if v.Succeeded < v.Requests {
+		return fmt.Errorf("%d of %d sampled GETs failed", v.Requests-v.Succeeded, v.Requests)
+	}
+	return nil
+}
+
+// logBenchmark logs the gist of a run's benchmark.
+func logBenchmark(b *gcsgen.Benchmark) {
+	if b == nil {
+		return
+	}
+	line := fmt.Sprintf("%v: %.0f copies/s", b.Bucket, b.CopiesPerSecond)
+	for _, op := range []string{"copy", "rewrite"} {
+		if cs := b.Calls[op]; cs != nil {
+			line += fmt.Sprintf(", %v p50 %.0fms p95 %.0fms p99 %.0fms", op, cs.P50Ms, cs.P95Ms, cs.P99Ms)
+		}
+	}
+	log.Printf("%v, %.1f%% retried, %.2f%% failed.", line, 100*b.RetryRate, 100*b.ErrorRate)
+}
+
+// writeBenchmark writes the benchmark, or benchmarks, of a run as JSON.
+func writeBenchmark(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("unable to write the benchmark: %v", err)
+	}
+	log.Printf("Wrote the benchmark to %v.", path)
+	return nil
+}
+
+// publicAccess returns the option making the files generated in a bucket
+// public, granting access to the bucket first if it uses uniform
+// bucket-level access.
+func publicAccess(ctx context.Context, s *storage.Service, bucket, billingProject string) (gcsgen.Option, error) {
+	opt, err := gcsgen.PublicAccess(ctx, s, bucket, billingProject)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make bucket %v public: %v", bucket, err)
+	}
+	return opt, nil
+}
+
+// checkKMSKey verifies the value of a -kms-key flag names a Cloud KMS key.
+func checkKMSKey(key string) error {
+	parts := strings.Split(key, "/")
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" || parts[6] != "cryptoKeys" {
+		return fmt.Errorf("-kms-key %q is not projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY", key)
+	}
+	return nil
+}
+
+// generateRegions generates the corpus in the bucket of each location at
+// once, creating the buckets which do not exist, and writes the manifest of
+// their URLs to manifestPath and the benchmarks of the locations to
+// benchmarkPath, if set, then verifies samples of each as sv says, or one
+// through sv.url. billingProject, if set, is billed for the calls on the
+// buckets, and public makes their files readable by anyone.
+func generateRegions(ctx context.Context, s *storage.Service, bucket string, locations []string, project, billingProject string, public bool, imagePath, manifestPath, benchmarkPath string, sv sampleVerification, opts []gcsgen.Option) error {
+	image, err := ioutil.ReadFile(imagePath)
+	if err != nil {
+		return err
+	}
+	var replicas []gcsgen.Replica
+	for _, loc := range locations {
+		loc = strings.ToUpper(strings.TrimSpace(loc))
+		if loc == "" {
+			return errors.New("-regions has an empty location")
+		}
+		r := gcsgen.Replica{Location: loc, Bucket: bucket + "-" + strings.ToLower(loc)}
+		if err := ensureBucket(ctx, s, project, billingProject, r); err != nil {
+			return err
+		}
+		if public {
+			opt, err := publicAccess(ctx, s, r.Bucket, billingProject)
+			if err != nil {
+				return err
+			}
+			r.Options = append(r.Options, opt)
+		}
+		replicas = append(replicas, r)
+	}
+	m, err := gcsgen.Replicate(ctx, s, replicas, path.Base(imagePath), image, opts...)
+	endProgress()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	var benchmarks []*gcsgen.Benchmark
+	for _, rm := range m.Regions {
+		log.Printf("%v: %v/%v copied to %v in %v.", rm.Location, len(rm.URLs), m.Files, rm.Bucket,
+			(time.Duration(rm.Duration) * time.Second).Round(time.Second))
+		logBenchmark(rm.Benchmark)
+		failed += rm.Failed
+		benchmarks = append(benchmarks, rm.Benchmark)
+	}
+	if benchmarkPath != "" {
+		if err := writeBenchmark(benchmarkPath, benchmarks); err != nil {
+			return err
+		}
+	}
+	if manifestPath != "" {
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(manifestPath, b, 0644); err != nil {
+			return fmt.Errorf("unable to write the manifest: %v", err)
+		}
+		log.Printf("Wrote the manifest to %v.", manifestPath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d copies failed", failed)
+	}
+	for _, rm := range m.Regions {
+		if err := sv.run(ctx, "https://storage.googleapis.com/"+rm.Bucket, rm.Objects); err != nil {
+			return fmt.Errorf("%v: %v", rm.Location, err)
+		}
+		if sv.url != "" {
+			// The load balancer serves one corpus, whichever location.
+			break
+		}
+	}
+	return nil
+}
+
+// ensureBucket creates a replica's bucket in its location if it does not
+// exist, and verifies an existing one is in that location.
+func ensureBucket(ctx context.Context, s *storage.Service, project, billingProject string, r gcsgen.Replica) error {
+	get := s.Buckets.Get(r.Bucket)
+	if billingProject != "" {
+		get = get.UserProject(billingProject)
+	}
+	b, err := get.Context(ctx).Do()
+	switch {
+	case err == nil:
+		if !strings.EqualFold(b.Location, r.Location) {
+			return fmt.Errorf("bucket %v is in %v, not %v", r.Bucket, b.Location, r.Location)
+		}
+		return nil
+	case gcperr.KindOf(err) != gcperr.ErrNotFound:
+		return fmt.Errorf("unable to get bucket %v: %v", r.Bucket, err)
+	case project == "":
+		return fmt.Errorf("bucket %v does not exist; give -project to create it", r.Bucket)
+	}
+	if _, err := s.Buckets.Insert(project, &storage.Bucket{Name: r.Bucket, Location: r.Location}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("unable to create bucket %v: %v", r.Bucket, err)
+	}
+	log.Printf("Created bucket %v in %v.", r.Bucket, r.Location)
+	return nil
+}
+
+// A userProjectTransport bills a project for the Cloud Storage requests it
+// makes, which requester pays buckets refuse otherwise, with the
+// x-goog-user-project header the object URLs take in place of the API's
+// userProject parameter.
+type userProjectTransport struct {
+	base    http.RoundTripper
+	project string
+}
+
+func (t *userProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("x-goog-user-project", t.project)
+	return t.base.RoundTrip(req)
+}
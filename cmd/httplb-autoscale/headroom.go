@@ -0,0 +1,267 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Fraction of its capacity above which a backend counts as saturated.
+const saturationThreshold = 0.9
+
+// The load balancer's default maxUtilization for UTILIZATION backends.
+const defaultMaxUtilization = 0.8
+
+// A backendHeadroom is how much of its configured capacity one backend group
+// used during a run, minute by minute.
+type backendHeadroom struct {
+	group string
+	mode  string
+	// capacity is what each instance may take before the load balancer
+	// sends traffic elsewhere: requests per second for RATE backends, CPU
+	// utilization for UTILIZATION backends. It includes the capacity scaler.
+	capacity float64
+	// target is the autoscaler's target as a fraction of capacity, or 0 if
+	// it does not scale on load balancing utilization.
+	target float64
+	// used holds the fraction of capacity used in each minute.
+	used []float64
+	// times holds the end of the minute of each entry of used.
+	times    []time.Time
+	peakSize float64
+}
+
+// peak returns the largest fraction of capacity used in any minute.
+func (h *backendHeadroom) peak() float64 {
+	var peak float64
+	for _, u := range h.used {
+		peak = maxFloat(peak, u)
+	}
+	return peak
+}
+
+// mean returns the mean fraction of capacity used.
+func (h *backendHeadroom) mean() float64 {
+	if len(h.used) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, u := range h.used {
+		sum += u
+	}
+	return sum / float64(len(h.used))
+}
+
+// saturatedMinutes counts the minutes above the saturation threshold.
+func (h *backendHeadroom) saturatedMinutes() int {
+	n := 0
+	for _, u := range h.used {
+		if u >= saturationThreshold {
+			n++
+		}
+	}
+	return n
+}
+
+// pointsByTime indexes points by their time.
+func pointsByTime(points []*metricPoint) map[time.Time]float64 {
+	values := make(map[time.Time]float64, len(points))
+	for _, p := range points {
+		values[p.Time] = p.Value
+	}
+	return values
+}
+
+// measureHeadroom computes the headroom of one backend of the backend
+// service, using the live backend's capacity settings and the group's
+// instance count, request rate and CPU utilization from Cloud Monitoring.
+func measureHeadroom(ctx context.Context, s *compute.Service, m *monitoring.Service, c *policyConfig, b *compute.Backend, start, end time.Time) (*backendHeadroom, error) {
+	mig, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+	scaler := b.CapacityScaler
+	h := &backendHeadroom{group: c.Group, mode: b.BalancingMode, target: c.LoadBalancingUtilization}
+	sizeWatcher := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), period: time.Minute,
+		filter: fmt.Sprintf(`resource.type = "instance_group" AND resource.labels.instance_group_name = %q`, c.Group)}
+	sizes, err := sizeWatcher.query(ctx, lbMetric{Name: "size", Type: "compute.googleapis.com/instance_group/size",
+		Aligner: "ALIGN_MEAN", Reducer: "REDUCE_SUM"}, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query size of %v: %v", c.Group, err)
+	}
+
+	var load map[time.Time]float64
+	switch b.BalancingMode {
+	case "RATE":
+		h.capacity = b.MaxRatePerInstance * scaler
+		w := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), period: time.Minute,
+			filter: fmt.Sprintf(`%s AND resource.labels.backend_name = %q`, lbFilter(c.BackendService), c.Group)}
+		points, err := w.query(ctx, lbMetrics[0], start, end)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query request rate of %v: %v", c.Group, err)
+		}
+		load = pointsByTime(points)
+	case "UTILIZATION":
+		maxUtilization := b.MaxUtilization
+		if maxUtilization == 0 {
+			maxUtilization = defaultMaxUtilization
+		}
+		h.capacity = maxUtilization * scaler
+		if h.target == 0 && c.CPUUtilization > 0 {
+			h.target = c.CPUUtilization / h.capacity
+		}
+		w := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), period: time.Minute,
+			filter: fmt.Sprintf(`resource.type = "gce_instance" AND metric.labels.instance_name = starts_with("%s-")`, mig.BaseInstanceName)}
+		points, err := w.query(ctx, lbMetric{Name: "cpu", Type: "compute.googleapis.com/instance/cpu/utilization",
+			Aligner: "ALIGN_MEAN", Reducer: "REDUCE_MEAN"}, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query CPU utilization of %v: %v", c.Group, err)
+		}
+		load = pointsByTime(points)
+	default:
+		return h, nil
+	}
+	if h.capacity <= 0 {
+		return h, nil
+	}
+	for _, p := range sizes {
+		h.peakSize = maxFloat(h.peakSize, p.Value)
+		l, ok := load[p.Time]
+		if !ok || p.Value <= 0 {
+			continue
+		}
+		if b.BalancingMode == "RATE" {
+			// Rates are for the whole group; capacity is per instance.
+			l /= p.Value
+		}
+		h.used = append(h.used, l/h.capacity)
+		h.times = append(h.times, p.Time)
+	}
+	return h, nil
+}
+
+// reportHeadroomCmd reports, for each group attached to the backend service,
+// how much of its configured capacity (maxRatePerInstance or maxUtilization,
+// times capacityScaler) it used during a run. It shows how close each group
+// came to the autoscaler's target and to saturation, where the load balancer
+// starts sending its traffic to other backends or queueing it.
+func reportHeadroomCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report headroom", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	wf := addWindowFlags(fs)
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.BackendService == "" {
+		return errors.New("config does not name a backend service")
+	}
+	start, end, err := wf.window()
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := newMonitoringService()
+	if err != nil {
+		return fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	bs, err := s.BackendServices.Get(c.Project, c.BackendService).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to get backend service %v: %v", c.BackendService, err)
+	}
+	backends := map[string]*compute.Backend{}
+	for _, b := range bs.Backends {
+		backends[path.Base(b.Group)] = b
+	}
+
+	rows := []headroomResult{}
+	for _, bc := range c.backendGroups() {
+		b, ok := backends[bc.Group]
+		if !ok {
+			rows = append(rows, headroomResult{Group: bc.Group})
+			continue
+		}
+		h, err := measureHeadroom(ctx, s, m, bc, b, start, end)
+		if err != nil {
+			return err
+		}
+		r := headroomResult{
+			Group: h.group, Attached: true, Mode: h.mode, Capacity: h.capacity, PeakSize: h.peakSize,
+			Target: h.target, Minutes: len(h.used),
+		}
+		if len(h.used) > 0 {
+			r.MeanUsed, r.PeakUsed, r.SaturatedMinutes = h.mean(), h.peak(), h.saturatedMinutes()
+		}
+		rows = append(rows, r)
+	}
+	return printResult(rows, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "GROUP\tMODE\tCAPACITY/INSTANCE\tPEAK SIZE\tMEAN USED\tPEAK USED\tTARGET\tPEAK VS TARGET\tSATURATED")
+		for _, r := range rows {
+			if !r.Attached {
+				fmt.Fprintf(tw, "%s\tnot attached\n", r.Group)
+				continue
+			}
+			capacity := "-"
+			switch r.Mode {
+			case "RATE":
+				capacity = fmt.Sprintf("%.1f req/s", r.Capacity)
+			case "UTILIZATION":
+				capacity = fmt.Sprintf("%.0f%% CPU", 100*r.Capacity)
+			}
+			if r.Minutes == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f\t-\t-\t-\t-\t-\n", r.Group, r.Mode, capacity, r.PeakSize)
+				continue
+			}
+			target, vsTarget := "-", "-"
+			if r.Target > 0 {
+				target = fmt.Sprintf("%.0f%%", 100*r.Target)
+				vsTarget = fmt.Sprintf("%+.0f%%", 100*(r.PeakUsed-r.Target))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f\t%.0f%%\t%.0f%%\t%s\t%s\t%d of %d min\n", r.Group, r.Mode, capacity,
+				r.PeakSize, 100*r.MeanUsed, 100*r.PeakUsed, target, vsTarget, r.SaturatedMinutes, r.Minutes)
+		}
+		return tw.Flush()
+	})
+}
+
+// A headroomResult is one group's row of report headroom. Used capacity and
+// the target are fractions of the per instance capacity.
+type headroomResult struct {
+	Group            string  `json:"group"`
+	Attached         bool    `json:"attached"`
+	Mode             string  `json:"mode,omitempty"`
+	Capacity         float64 `json:"capacity,omitempty"`
+	PeakSize         float64 `json:"peakSize"`
+	MeanUsed         float64 `json:"meanUsed"`
+	PeakUsed         float64 `json:"peakUsed"`
+	Target           float64 `json:"target"`
+	SaturatedMinutes int     `json:"saturatedMinutes"`
+	Minutes          int     `json:"minutes"`
+}
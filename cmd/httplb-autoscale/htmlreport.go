@@ -0,0 +1,369 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cpuUtilizationMetric is the key under which report html adds the group's
+// CPU utilization to the rows of a merged timeline.
+const cpuUtilizationMetric = "cpu_utilization"
+
+// A chartSeries is one line of a chart.
+type chartSeries struct {
+	name  string
+	color string
+	// values holds one value per row; NaN leaves a gap.
+	values []float64
+}
+
+// The layout of a chart, in pixels.
+const (
+	chartWidth, chartHeight           = 900, 240
+	chartLeft, chartRight             = 60, 20
+	chartTop, chartBottom             = 30, 40
+	chartPlotWidth, chartPlotHeight   = chartWidth - chartLeft - chartRight, chartHeight - chartTop - chartBottom
+	chartLegendSpacing, chartFontSize = 130, 12
+)
+
+// svgChart draws series over the times of the rows as an inline SVG line
+// chart, with a dashed line at each row index in marks.
+func svgChart(title, unit string, times []time.Time, series []chartSeries, marks []int) template.HTML {
+	max := 0.0
+	for _, s := range series {
+		for _, v := range s.values {
+			if !math.IsNaN(v) {
+				max = math.Max(max, v)
+			}
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	x := func(i int) float64 {
+		if len(times) < 2 {
+			return chartLeft
+		}
+		return chartLeft + chartPlotWidth*float64(i)/float64(len(times)-1)
+	}
+	y := func(v float64) float64 {
+		return chartTop + chartPlotHeight*(1-v/max)
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="%d">`,
+		chartWidth, chartHeight, chartFontSize)
+	fmt.Fprintf(b, `<text x="%d" y="18" font-weight="bold">%s (%s)</text>`, chartLeft,
+		template.HTMLEscapeString(title), template.HTMLEscapeString(unit))
+	for k, s := range series {
+		fmt.Fprintf(b, `<text x="%d" y="18" fill="%s">&#9632; %s</text>`, chartWidth-chartRight-chartLegendSpacing*(len(series)-k),
+			s.color, template.HTMLEscapeString(s.name))
+	}
+	for _, f := range []float64{0, 0.5, 1} {
+		fmt.Fprintf(b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#ddd"/>`, chartLeft, chartWidth-chartRight, y(f*max), y(f*max))
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end">%.3g</text>`, chartLeft-6, y(f*max)+4, f*max)
+	}
+	for _, i := range marks {
+		fmt.Fprintf(b, `<line x1="%.1f" x2="%.1f" y1="%d" y2="%d" stroke="#999" stroke-dasharray="3,3"/>`, x(i), x(i),
+			chartTop, chartTop+chartPlotHeight)
+	}
+	if len(times) > 0 {
+		for _, i := range []int{0, len(times) / 2, len(times) - 1} {
+			fmt.Fprintf(b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, x(i), chartHeight-chartBottom+18,
+				times[i].Format("15:04:05"))
+		}
+	}
+	for _, s := range series {
+		var points []string
+		line := func() {
+			if len(points) > 0 {
+				fmt.Fprintf(b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`, s.color, strings.Join(points, " "))
+			}
+			points = nil
+		}
+		for i, v := range s.values {
+			if math.IsNaN(v) {
+				line()
+				continue
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(i), y(v)))
+		}
+		line()
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// rowValues returns one value per row.
+func rowValues(rows []*mergedRow, value func(r *mergedRow) float64) []float64 {
+	values := make([]float64, len(rows))
+	for i, r := range rows {
+		values[i] = value(r)
+	}
+	return values
+}
+
+// addRowMetric sets the named metric of each row to the newest of the
+// points at or before the row's end, like report merge does for load
+// balancer series.
+func addRowMetric(rows []*mergedRow, name string, points []*metricPoint) {
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	width := rowWidth(rows)
+	pi := 0
+	var last *metricPoint
+	for _, r := range rows {
+		for ; pi < len(points) && !points[pi].Time.After(r.Time.Add(width)); pi++ {
+			last = points[pi]
+		}
+		if last == nil {
+			continue
+		}
+		if r.Metrics == nil {
+			r.Metrics = map[string]float64{}
+		}
+		r.Metrics[name] = last.Value
+	}
+}
+
+// An htmlEvent is one line of the report's event timeline.
+type htmlEvent struct {
+	Time time.Time
+	Text string
+}
+
+// An htmlReport is the data of the HTML report template.
+type htmlReport struct {
+	Title      string
+	Generated  time.Time
+	Start, End time.Time
+	Requests   int
+	ErrorRate  float64
+	P99Ms      float64
+	PeakSize   int64
+	Charts     []template.HTML
+	Scenario   string
+	SLOs       []sloResult
+	Events     []htmlEvent
+}
+
+// htmlReportTemplate lays out a report as a single page which needs nothing
+// but itself to be viewed: styles are inline and charts are SVG.
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct":   func(f float64) string { return fmt.Sprintf("%.3f%%", 100*f) },
+	"time":  func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+	"clock": func(t time.Time) string { return t.Format("15:04:05") },
+	"width": func(sec float64) time.Duration { return time.Duration(sec) * time.Second },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; font-size: 14px; }
+pre { background: #f6f6f6; padding: 1em; }
+.breach { color: #c00; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>From {{time .Start}} to {{time .End}}. Generated {{time .Generated}}.</p>
+<table>
+<tr><th>Requests</th><td>{{.Requests}}</td></tr>
+<tr><th>Errors</th><td>{{pct .ErrorRate}}</td></tr>
+<tr><th>Worst p99</th><td>{{printf "%.1f" .P99Ms}} ms</td></tr>
+<tr><th>Peak target size</th><td>{{.PeakSize}}</td></tr>
+</table>
+<h2>Charts</h2>
+<p>Dashed lines mark events; see the timeline below.</p>
+{{range .Charts}}<div>{{.}}</div>
+{{end}}
+{{if .SLOs}}<h2>SLOs</h2>
+<table>
+<tr><th>SLO</th><th>Good</th><th>Budget used</th><th>Windows</th></tr>
+{{range .SLOs}}<tr><td>{{.Name}}</td><td>{{pct .Good}}</td><td>{{pct .BudgetUsed}}</td><td>
+{{range .Windows}}{{width .WidthSec}}: peak burn {{printf "%.1f" .PeakBurn}}{{if .Breaches}}, <span class="breach">{{len .Breaches}} breaches above {{printf "%.1f" .Threshold}}</span>{{end}}<br>
+{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Scenario}}<h2>Scenario</h2>
+<pre>{{.Scenario}}</pre>
+{{end}}
+<h2>Events</h2>
+{{if .Events}}<table>
+<tr><th>Time</th><th>Event</th></tr>
+{{range .Events}}<tr><td>{{clock .Time}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{else}}<p>No events other than state samples were recorded.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// reportHTMLCmd renders a run's merged timeline as a single self-contained
+// HTML page to share: charts of load, latency, group size and utilization,
+// the scenario, SLO results and the event timeline.
+func reportHTMLCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report html", flag.ExitOnError)
+	mergedPath := fs.String("merged", "", "Merged timeline of the run, as written by report merge.")
+	configPath := fs.String("config", "", "Autoscaler policy config of the run, to include its scenario and, with -query-utilization, its group's CPU utilization.")
+	query := fs.Bool("query-utilization", false, "Query Cloud Monitoring for the group's CPU utilization during the run.")
+	outPath := fs.String("out", "report.html", "Write the report to this file.")
+	title := fs.String("title", "", "Title of the report; defaults to one naming the group or the timeline.")
+	sf := addSLOFlags(fs)
+	fs.Parse(args)
+	switch {
+	case *mergedPath == "":
+		return errors.New("-merged is required")
+	case *query && *configPath == "":
+		return errors.New("-query-utilization needs -config")
+	}
+	if err := sf.check(); err != nil {
+		return err
+	}
+	rows, err := readMergedRun(*mergedPath)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("%v has no rows", *mergedPath)
+	}
+	width := rowWidth(rows)
+
+	r := &htmlReport{Title: *title, Generated: time.Now().UTC(), Start: rows[0].Time,
+		End: rows[len(rows)-1].Time.Add(width)}
+	if r.Title == "" {
+		r.Title = "Run report for " + filepath.Base(*mergedPath)
+	}
+	if *configPath != "" {
+		c, err := loadPolicyConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if *title == "" {
+			r.Title = "Run report for " + c.Group
+		}
+		if c.Scenario != nil {
+			b, err := yaml.Marshal(c.Scenario)
+			if err != nil {
+				return err
+			}
+			r.Scenario = string(b)
+		}
+		if *query {
+			s, err := newComputeService()
+			if err != nil {
+				return fmt.Errorf("failed to create Compute client: %v", err)
+			}
+			m, err := newMonitoringService()
+			if err != nil {
+				return fmt.Errorf("failed to create Monitoring client: %v", err)
+			}
+			mig, err := getGroupManager(ctx, s, c)
+			if err != nil {
+				return err
+			}
+			points, err := queryGroupCPU(ctx, m, c, mig, r.Start, r.End)
+			if err != nil {
+				return err
+			}
+			addRowMetric(rows, cpuUtilizationMetric, points)
+		}
+	}
+
+	var errs int
+	var times []time.Time
+	var marks []int
+	for i, row := range rows {
+		r.Requests += row.Requests
+		errs += row.Errors
+		r.P99Ms = math.Max(r.P99Ms, row.P99Ms)
+		if row.TargetSize > r.PeakSize {
+			r.PeakSize = row.TargetSize
+		}
+		times = append(times, row.Time)
+		if len(row.Events) > 0 {
+			marks = append(marks, i)
+		}
+		for _, e := range row.Events {
+			r.Events = append(r.Events, htmlEvent{row.Time, e})
+		}
+	}
+	if r.Requests > 0 {
+		r.ErrorRate = float64(errs) / float64(r.Requests)
+		if r.SLOs, err = sf.evaluate(rows); err != nil {
+			return err
+		}
+	}
+
+	perSecond := func(n int) float64 { return float64(n) / width.Seconds() }
+	r.Charts = append(r.Charts,
+		svgChart("Load", "requests/s", times, []chartSeries{
+			{"requests", "#1a73e8", rowValues(rows, func(row *mergedRow) float64 { return perSecond(row.Requests) })},
+			{"errors", "#d93025", rowValues(rows, func(row *mergedRow) float64 { return perSecond(row.Errors) })},
+		}, marks),
+		svgChart("Latency", "ms", times, []chartSeries{
+			{"p50", "#1e8e3e", rowValues(rows, func(row *mergedRow) float64 { return row.P50Ms })},
+			{"p95", "#f9ab00", rowValues(rows, func(row *mergedRow) float64 { return row.P95Ms })},
+			{"p99", "#d93025", rowValues(rows, func(row *mergedRow) float64 { return row.P99Ms })},
+		}, marks),
+		svgChart("Replicas", "instances", times, []chartSeries{
+			{"recommended", "#9334e6", rowValues(rows, func(row *mergedRow) float64 { return float64(row.RecommendedSize) })},
+			{"target", "#1a73e8", rowValues(rows, func(row *mergedRow) float64 { return float64(row.TargetSize) })},
+			{"running", "#1e8e3e", rowValues(rows, func(row *mergedRow) float64 { return float64(row.RunningSize) })},
+		}, marks))
+	utilization := rowValues(rows, func(row *mergedRow) float64 {
+		if v, ok := row.Metrics[cpuUtilizationMetric]; ok {
+			return 100 * v
+		}
+		return math.NaN()
+	})
+	for _, v := range utilization {
+		if !math.IsNaN(v) {
+			r.Charts = append(r.Charts, svgChart("CPU utilization", "%", times,
+				[]chartSeries{{"mean", "#e8710a", utilization}}, marks))
+			break
+		}
+	}
+
+	f, err := os.Create(*outPath)
+	if err != nil {
+		return err
+	}
+	if err := htmlReportTemplate.Execute(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to render the report: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("Wrote %v.", *outPath)
+	return nil
+}
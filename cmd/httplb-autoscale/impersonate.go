@@ -0,0 +1,37 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/credentials"
+)
+
+// impersonate names the service account every client acts as, optionally
+// through a chain of delegates.
+var impersonate = flag.String("impersonate-service-account", "",
+	"Act as this service account, with short-lived tokens from the IAM Credentials API; a comma separated list delegates through each account to the last.")
+
+// impersonated returns a Provider of the -impersonate-service-account's
+// tokens, minted with base, the caller's own credentials.
+func impersonated(base credentials.Provider) credentials.Provider {
+	chain := strings.Split(*impersonate, ",")
+	for i := range chain {
+		chain[i] = strings.TrimSpace(chain[i])
+	}
+	return credentials.Impersonation(base, chain[len(chain)-1], chain[:len(chain)-1]...)
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// An instanceInfo describes one instance of the group, combining what the
+// group, the instance and the load balancer know about it.
+type instanceInfo struct {
+	Name          string `json:"name"`
+	Zone          string `json:"zone"`
+	Created       string `json:"created"`
+	Status        string `json:"status"`
+	CurrentAction string `json:"currentAction"`
+	Template      string `json:"template"`
+	// Autohealing is the state reported by the group's health check, if it
+	// has autohealing.
+	Autohealing string `json:"autohealing,omitempty"`
+	// Serving is the state reported by the backend service, if the config
+	// names one.
+	Serving string `json:"serving,omitempty"`
+	// PreservedState is what a stateful group keeps across recreation.
+	PreservedState *report.PreservedState `json:"report.PreservedState,omitempty"`
+}
+
+// describeInstances returns an instanceInfo for every instance of the group,
+// in name order.
+func describeInstances(ctx context.Context, s *compute.Service, c *policyConfig) ([]*instanceInfo, error) {
+	m, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+	serving := map[string]string{}
+	if c.BackendService != "" {
+		health, err := s.BackendServices.GetHealth(c.Project, c.BackendService, &compute.ResourceGroupReference{
+			Group: m.InstanceGroup,
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get health of %v: %v", c.BackendService, err)
+		}
+		for _, h := range health.HealthStatus {
+			serving[path.Base(h.Instance)] = h.HealthState
+		}
+	}
+	var infos []*instanceInfo
+	for _, mi := range managed {
+		info := &instanceInfo{
+			Name:           path.Base(mi.Instance),
+			Zone:           instanceZone(mi.Instance),
+			Status:         mi.InstanceStatus,
+			CurrentAction:  mi.CurrentAction,
+			Serving:        serving[path.Base(mi.Instance)],
+			PreservedState: instancePreservedState(mi),
+		}
+		if mi.Version != nil {
+			info.Template = path.Base(mi.Version.InstanceTemplate)
+		}
+		for _, h := range mi.InstanceHealth {
+			info.Autohealing = h.DetailedHealthState
+		}
+		if c.BackendService != "" && info.Serving == "" {
+			info.Serving = "UNKNOWN"
+		}
+		// Instances being created have no instance resource yet.
+		if mi.InstanceStatus != "" {
+			i, err := s.Instances.Get(c.Project, info.Zone, info.Name).Context(ctx).Do()
+			if err != nil && !mig.IsNotFound(err) {
+				return nil, fmt.Errorf("unable to get instance %v: %v", info.Name, err)
+			}
+			if err == nil {
+				info.Created = i.CreationTimestamp
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// listInstancesCmd prints every instance of the group with its zone,
+// creation time, current action and health, in the -output format.
+func listInstancesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig list-instances", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	asJSON := fs.Bool("json", false, "Same as -output json.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	infos, err := describeInstances(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		*outputFormat = "json"
+	}
+	if infos == nil {
+		infos = []*instanceInfo{}
+	}
+	return printResult(infos, func(out io.Writer) error {
+		w := newTable(out)
+		fmt.Fprintln(w, "NAME\tZONE\tCREATED\tSTATUS\tACTION\tTEMPLATE\tAUTOHEALING\tSERVING")
+		for _, i := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.Name, i.Zone, orDash(i.Created), orDash(i.Status),
+				i.CurrentAction, i.Template, orDash(i.Autohealing), orDash(i.Serving))
+		}
+		return w.Flush()
+	})
+}
+
+// orDash returns s, or "-" if it is empty, for table cells.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
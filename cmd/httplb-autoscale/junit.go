@@ -0,0 +1,112 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A junitSuites is the root of a JUnit XML report, in the dialect that CI
+// systems and test result viewers read.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+// A junitSuite groups the assertions made on one run.
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Time      float64     `xml:"time,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+// A junitCase is one assertion, which failed if Failure is set.
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	// SystemOut holds the measured values, shown with passing cases too.
+	SystemOut string `xml:"system-out,omitempty"`
+}
+
+// A junitFailure explains a failed assertion.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// add appends a case to the suite, counting it.
+func (s *junitSuite) add(c junitCase) {
+	s.Tests++
+	if c.Failure != nil {
+		s.Failures++
+	}
+	s.Cases = append(s.Cases, c)
+}
+
+// writeJUnit writes the suites to path as a JUnit XML report.
+func writeJUnit(path string, suites ...junitSuite) error {
+	root := junitSuites{Suites: suites}
+	for _, s := range suites {
+		root.Tests += s.Tests
+		root.Failures += s.Failures
+	}
+	b, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(b, '\n')...), 0644)
+}
+
+// sloSuite turns the SLO results of a run from start to end into JUnit
+// assertions: one that each SLO's objective was met over the run, and one
+// per window width that its burn rate never broke the threshold.
+func sloSuite(name string, start, end time.Time, results []sloResult) junitSuite {
+	s := junitSuite{Name: name, Timestamp: start.UTC().Format("2006-01-02T15:04:05"), Time: end.Sub(start).Seconds()}
+	for _, res := range results {
+		c := junitCase{Name: res.Name + " objective", ClassName: name,
+			SystemOut: fmt.Sprintf("%.3f%% good, %.0f%% of the error budget used", 100*res.Good, 100*res.BudgetUsed)}
+		if res.Good < res.Objective {
+			c.Failure = &junitFailure{Type: "SLOMissed", Message: fmt.Sprintf("%.3f%% good, below the objective of %.3f%%",
+				100*res.Good, 100*res.Objective), Text: c.SystemOut}
+		}
+		s.add(c)
+		for _, w := range res.Windows {
+			width := time.Duration(w.WidthSec) * time.Second
+			c := junitCase{Name: fmt.Sprintf("%v %v burn rate", res.Name, width), ClassName: name,
+				SystemOut: fmt.Sprintf("peak burn rate %.1f, threshold %.1f", w.PeakBurn, w.Threshold)}
+			if len(w.Breaches) > 0 {
+				text := ""
+				for _, b := range w.Breaches {
+					text += fmt.Sprintf("%v to %v, peak burn rate %.1f\n", b.Start.Format(time.RFC3339),
+						b.End.Format(time.RFC3339), b.PeakBurn)
+				}
+				c.Failure = &junitFailure{Type: "BurnRateBreached", Message: fmt.Sprintf("%d breaches above a burn rate of %.1f",
+					len(w.Breaches), w.Threshold), Text: text}
+			}
+			s.add(c)
+		}
+	}
+	return s
+}
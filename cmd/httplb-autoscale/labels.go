@@ -0,0 +1,335 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Labels applied to every resource these commands create. Resources which
+// do not support labels, such as groups and autoscalers, carry them in their
+// description instead.
+const (
+	managedByLabel = "managed-by"
+	managedByValue = "httplb-autoscaling"
+	runIDLabel     = "run-id"
+	// Network tag given to every instance, so that firewall rules can target
+	// the backends.
+	managedByTag = "httplb-autoscaling"
+)
+
+// descriptionLabels matches the labels resourceDescription appends.
+var descriptionLabels = regexp.MustCompile(`\[managed-by=(\S+) run-id=(\S*)\]$`)
+
+// resourceLabels returns the labels of a resource created for a run.
+func resourceLabels(runID string) map[string]string {
+	return map[string]string{managedByLabel: managedByValue, runIDLabel: runID}
+}
+
+// resourceDescription returns a description for a resource which cannot
+// carry labels, with the labels appended in a form descriptionRunID parses.
+func resourceDescription(summary, runID string) string {
+	return fmt.Sprintf("%s [%s=%s %s=%s]", summary, managedByLabel, managedByValue, runIDLabel, runID)
+}
+
+// descriptionRunID returns the run ID recorded in a description by
+// resourceDescription. It reports false if the resource is not ours.
+func descriptionRunID(description string) (string, bool) {
+	m := descriptionLabels.FindStringSubmatch(description)
+	if m == nil || m[1] != managedByValue {
+		return "", false
+	}
+	return m[2], true
+}
+
+// labelsRunID returns the run ID in a resource's labels. It reports false if
+// the resource is not ours.
+func labelsRunID(labels map[string]string) (string, bool) {
+	if labels[managedByLabel] != managedByValue {
+		return "", false
+	}
+	return labels[runIDLabel], true
+}
+
+// runID returns the run ID to label resources created from the config: the
+// config's runId if set, or else the run of the newest template made by
+// template create. Later mutating calls are audited under that run.
+func runID(c *policyConfig, statePath string) (string, error) {
+	if c.RunID != "" {
+		audit.setRun(c.RunID)
+		return c.RunID, nil
+	}
+	st, err := loadState(statePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read state file: %v", err)
+	}
+	id := st.RunIDs[templateKey(c)]
+	audit.setRun(id)
+	return id, nil
+}
+
+// A managedResource is a resource created by these commands.
+type managedResource struct {
+	kind, name, location, runID string
+	// regional is set for groups and autoscalers in a region rather than a
+	// zone.
+	regional bool
+	created  time.Time
+}
+
+// scopeLocation turns an aggregated list scope such as "zones/us-central1-f"
+// into a location, or "global".
+func scopeLocation(scope string) string {
+	if scope == "" {
+		return "global"
+	}
+	return path.Base(scope)
+}
+
+// listManagedResources returns every resource in the project created by
+// these commands, restricted to one run if runID is not empty.
+func listManagedResources(ctx context.Context, s *compute.Service, project, runID string) ([]managedResource, error) {
+	var found []managedResource
+	// add records a resource found in an aggregated list scope, or "" for
+	// global resources.
+	add := func(kind, name, scope, id, created string, ours bool) {
+		if !ours || (runID != "" && id != runID) {
+			return
+		}
+		t, _ := time.Parse(time.RFC3339, created)
+		found = append(found, managedResource{kind, name, scopeLocation(scope), id, strings.HasPrefix(scope, "regions/"), t})
+	}
+	for token := ""; ; {
+		resp, err := s.InstanceTemplates.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list instance templates: %v", err)
+		}
+		for _, t := range resp.Items {
+			var id string
+			ours := false
+			if t.Properties != nil {
+				id, ours = labelsRunID(t.Properties.Labels)
+			}
+			add("instanceTemplate", t.Name, "", id, t.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.InstanceGroupManagers.AggregatedList(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list instance group managers: %v", err)
+		}
+		for scope, l := range resp.Items {
+			for _, m := range l.InstanceGroupManagers {
+				id, ours := descriptionRunID(m.Description)
+				add("instanceGroupManager", m.Name, scope, id, m.CreationTimestamp, ours)
+			}
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.Autoscalers.AggregatedList(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list autoscalers: %v", err)
+		}
+		for scope, l := range resp.Items {
+			for _, a := range l.Autoscalers {
+				id, ours := descriptionRunID(a.Description)
+				add("autoscaler", a.Name, scope, id, a.CreationTimestamp, ours)
+			}
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	filter := fmt.Sprintf("labels.%s = %s", managedByLabel, managedByValue)
+	for token := ""; ; {
+		resp, err := s.Instances.AggregatedList(project).Filter(filter).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list instances: %v", err)
+		}
+		for scope, l := range resp.Items {
+			for _, i := range l.Instances {
+				id, ours := labelsRunID(i.Labels)
+				add("instance", i.Name, scope, id, i.CreationTimestamp, ours)
+			}
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	// The load balancer's resources carry their labels in their
+	// descriptions, like groups.
+	for token := ""; ; {
+		resp, err := s.GlobalForwardingRules.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list forwarding rules: %v", err)
+		}
+		for _, r := range resp.Items {
+			id, ours := descriptionRunID(r.Description)
+			add("forwardingRule", r.Name, "", id, r.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.GlobalAddresses.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list global addresses: %v", err)
+		}
+		for _, a := range resp.Items {
+			id, ours := descriptionRunID(a.Description)
+			add("address", a.Name, "", id, a.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.TargetHttpProxies.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list target HTTP proxies: %v", err)
+		}
+		for _, p := range resp.Items {
+			id, ours := descriptionRunID(p.Description)
+			add("targetHttpProxy", p.Name, "", id, p.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.TargetHttpsProxies.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list target HTTPS proxies: %v", err)
+		}
+		for _, p := range resp.Items {
+			id, ours := descriptionRunID(p.Description)
+			add("targetHttpsProxy", p.Name, "", id, p.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.UrlMaps.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list URL maps: %v", err)
+		}
+		for _, m := range resp.Items {
+			id, ours := descriptionRunID(m.Description)
+			add("urlMap", m.Name, "", id, m.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.BackendServices.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list backend services: %v", err)
+		}
+		for _, b := range resp.Items {
+			id, ours := descriptionRunID(b.Description)
+			add("backendService", b.Name, "", id, b.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.HealthChecks.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list health checks: %v", err)
+		}
+		for _, hc := range resp.Items {
+			id, ours := descriptionRunID(hc.Description)
+			add("healthCheck", hc.Name, "", id, hc.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		resp, err := s.Firewalls.List(project).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list firewall rules: %v", err)
+		}
+		for _, f := range resp.Items {
+			id, ours := descriptionRunID(f.Description)
+			add("firewall", f.Name, "", id, f.CreationTimestamp, ours)
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	return found, nil
+}
+
+// listResourcesCmd prints every resource in the project created by these
+// commands, optionally restricted to one run.
+func listResourcesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("resources list", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	run := fs.String("run-id", "", "Only list resources of this run.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	found, err := listManagedResources(ctx, s, c.Project, *run)
+	if err != nil {
+		return err
+	}
+	rows := []resourceResult{}
+	for _, r := range found {
+		rows = append(rows, resourceResult{r.kind, r.name, r.location, r.runID})
+	}
+	return printResult(rows, func(out io.Writer) error {
+		w := newTable(out)
+		fmt.Fprintln(w, "KIND\tNAME\tLOCATION\tRUN-ID")
+		for _, r := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Kind, r.Name, r.Location, r.RunID)
+		}
+		return w.Flush()
+	})
+}
+
+// A resourceResult is one row of resources list.
+type resourceResult struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	RunID    string `json:"runId"`
+}
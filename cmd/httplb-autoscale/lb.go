@@ -0,0 +1,175 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/lb"
+	"google.golang.org/api/compute/v1"
+)
+
+// An httpsConfig adds an HTTPS frontend on port 443 to the load balancer,
+// sharing a reserved address with port 80, e.g.
+//
+//	https:
+//	  certificates: [files-cert]
+//	  redirectHTTP: true
+type httpsConfig struct {
+	// Certificates are the names of existing SSL certificates, such as
+	// Google-managed ones for the demo's domain.
+	Certificates []string `yaml:"certificates"`
+	// RedirectHTTP makes port 80 redirect to HTTPS instead of serving, as
+	// production frontends do.
+	RedirectHTTP bool `yaml:"redirectHTTP"`
+}
+
+// check reports whether the HTTPS frontend can be created.
+func (h *httpsConfig) check() error {
+	if len(h.Certificates) == 0 {
+		return errors.New("certificates are required to serve HTTPS")
+	}
+	return nil
+}
+
+// servingPorts returns the group's named ports as strings, defaulting to 80.
+func servingPorts(c *policyConfig) []string {
+	var ports []string
+	for _, p := range c.NamedPorts {
+		ports = append(ports, strconv.FormatInt(p, 10))
+	}
+	if len(ports) == 0 {
+		ports = []string{"80"}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// lbSpec describes the external HTTP load balancer for the config's groups,
+// whose resources are described as created by a run.
+func lbSpec(s *compute.Service, c *policyConfig, runID string) *lb.Spec {
+	sp := &lb.Spec{
+		Project:        c.Project,
+		BackendService: c.BackendService,
+		Ports:          servingPorts(c),
+		TargetTags:     []string{managedByTag},
+		PathRules:      c.pathRules(),
+		Describe: func(purpose string) string {
+			return resourceDescription(purpose, runID)
+		},
+		AttachBackends: func(ctx context.Context) error {
+			if err := attachBackends(ctx, s, c); err != nil {
+				return err
+			}
+			for _, sc := range c.serviceGroups() {
+				if err := attachBackends(ctx, s, sc); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Wait: func(ctx context.Context, op *compute.Operation) error {
+			return waitForOperation(ctx, s, c.Project, op)
+		},
+	}
+	if h := c.HTTPS; h != nil {
+		sp.HTTPS = &lb.HTTPS{Certificates: h.Certificates, RedirectHTTP: h.RedirectHTTP}
+	}
+	return sp
+}
+
+// setupLB creates an external HTTP load balancer for the config's groups:
+// a firewall rule admitting the load balancer, a health check, the backend
+// service with every group attached, one more per service, a URL map routing
+// each service's paths, a target proxy and a global forwarding rule on port
+// 80, and with https a frontend on port 443 of a reserved address, which
+// port 80 redirects to with https.redirectHTTP. Resources which already
+// exist are kept, so it can be rerun after adding groups.
+func setupLB(ctx context.Context, s *compute.Service, c *policyConfig, runID string) error {
+	ip, err := lb.Setup(ctx, s, lbSpec(s, c, runID))
+	if err != nil {
+		return err
+	}
+	log.Printf("Load balancer is at %v; it may take a few minutes to start serving.", lbURL(c, ip))
+	if c.HTTPS != nil && c.HTTPS.RedirectHTTP {
+		log.Printf("Port 80 redirects to HTTPS, so load tests should use the https:// URL.")
+	}
+	return nil
+}
+
+// lbURL returns the URL of the load balancer at ip, which is an HTTPS URL
+// when the config adds an HTTPS frontend.
+func lbURL(c *policyConfig, ip string) string {
+	if c.HTTPS != nil {
+		return "https://" + ip + "/"
+	}
+	return "http://" + ip + "/"
+}
+
+// checkHTTPSScenario reports whether the scenario can reach a load balancer
+// serving HTTPS. Its certificate names a host rather than the address, and
+// with redirectHTTP port 80 only redirects, so the scenario must request an
+// https:// URL of the certificate's host.
+func checkHTTPSScenario(c *policyConfig) error {
+	if c.HTTPS == nil || c.Scenario == nil {
+		return nil
+	}
+	if u, err := url.Parse(c.Scenario.URL); err != nil || u.Scheme != "https" || net.ParseIP(u.Hostname()) != nil {
+		return errors.New("with https, scenario.url must be an https:// URL of the certificate's host, resolving to the load balancer's address")
+	}
+	return nil
+}
+
+// teardownLB deletes the load balancer's resources in the reverse order of
+// setupLB. Resources which are missing, or which these commands did not
+// create, are left alone.
+func teardownLB(ctx context.Context, s *compute.Service, c *policyConfig) error {
+	return lb.Teardown(ctx, s, lbSpec(s, c, ""), func(desc string) bool {
+		_, ours := descriptionRunID(desc)
+		return ours
+	})
+}
+
+// setupLBCmd creates the load balancer in front of the config's groups.
+func setupLBCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("setup-lb", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.BackendService == "" {
+		return errors.New("config does not name a backend service")
+	}
+	id, err := runID(c, defaultStatePath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	return setupLB(ctx, s, c, id)
+}
@@ -0,0 +1,285 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+	logging "google.golang.org/api/logging/v2"
+)
+
+// Upper bounds of the latency buckets of lb logs; the last bucket holds
+// everything slower.
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// A logSummary aggregates load balancer request log entries.
+type logSummary struct {
+	requests int
+	// statuses counts requests by status class: 2xx, 3xx, 4xx, 5xx, or
+	// "none" when the load balancer sent no response.
+	statuses map[string]int
+	// cache counts requests by "hit", "miss", or "none" when Cloud CDN did
+	// not look them up.
+	cache     map[string]int
+	latencies []time.Duration
+	buckets   []int
+}
+
+// newLogSummary returns an empty summary.
+func newLogSummary() *logSummary {
+	return &logSummary{
+		statuses: map[string]int{},
+		cache:    map[string]int{},
+		buckets:  make([]int, len(latencyBuckets)+1),
+	}
+}
+
+// add folds one request into the summary.
+func (ls *logSummary) add(r *logging.HttpRequest) {
+	ls.requests++
+	class := "none"
+	if r.Status > 0 {
+		class = fmt.Sprintf("%dxx", r.Status/100)
+	}
+	ls.statuses[class]++
+	switch {
+	case !r.CacheLookup:
+		ls.cache["none"]++
+	case r.CacheHit:
+		ls.cache["hit"]++
+	default:
+		ls.cache["miss"]++
+	}
+	if d, err := time.ParseDuration(r.Latency); err == nil {
+		ls.latencies = append(ls.latencies, d)
+		i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+		ls.buckets[i]++
+	}
+}
+
+// percentile returns the latency below which the given fraction of
+// requests completed.
+func (ls *logSummary) percentile(p float64) time.Duration {
+	sorted := make([]time.Duration, len(ls.latencies))
+	copy(sorted, ls.latencies)
+	sort.Sort(report.Durations(sorted))
+	return report.Percentile(sorted, p)
+}
+
+// instanceIPs maps the internal IPs of the project's managed instances to
+// their names, so that log entries, which only record the backend's IP, can
+// be attributed to instances.
+func instanceIPs(ctx context.Context, s *compute.Service, project string) (map[string]string, error) {
+	names := map[string]string{}
+	filter := fmt.Sprintf("labels.%s = %s", managedByLabel, managedByValue)
+	for token := ""; ; {
+		resp, err := s.Instances.AggregatedList(project).Filter(filter).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range resp.Items {
+			for _, i := range l.Instances {
+				for _, n := range i.NetworkInterfaces {
+					names[n.NetworkIP] = i.Name
+				}
+			}
+		}
+		if token = resp.NextPageToken; token == "" {
+			return names, nil
+		}
+	}
+}
+
+// listRequestLogs calls fn with every request log entry of the backend
+// service between start and end, stopping after limit entries.
+func listRequestLogs(ctx context.Context, l *logging.Service, project, backendService string, start, end time.Time, limit int, fn func(*logging.LogEntry)) (bool, error) {
+	filter := fmt.Sprintf(`resource.type = "http_load_balancer" AND resource.labels.backend_service_name = %q`+
+		` AND timestamp >= %q AND timestamp <= %q`,
+		backendService, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	req := &logging.ListLogEntriesRequest{
+		ResourceNames: []string{"projects/" + project},
+		Filter:        filter,
+		OrderBy:       "timestamp asc",
+		PageSize:      1000,
+	}
+	n := 0
+	for {
+		resp, err := l.Entries.List(req).Context(ctx).Do()
+		if err != nil {
+			return false, err
+		}
+		for _, e := range resp.Entries {
+			if n == limit {
+				return true, nil
+			}
+			if e.HttpRequest != nil {
+				fn(e)
+				n++
+			}
+		}
+		if resp.NextPageToken == "" {
+			return false, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+// lbLogsCmd pulls the load balancer's request logs for a run and summarizes
+// them overall and by backend instance: status classes, cache lookups and
+// latency. Request logging must be enabled on the backend service.
+func lbLogsCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("lb logs", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	limit := fs.Int("limit", 200000, "Summarize at most this many requests.")
+	wf := addWindowFlags(fs)
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.BackendService == "" {
+		return errors.New("config does not name a backend service")
+	}
+	start, end, err := wf.window()
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	ips, err := instanceIPs(ctx, s, c.Project)
+	if err != nil {
+		return fmt.Errorf("unable to list instances: %v", err)
+	}
+	l, err := newLoggingService()
+	if err != nil {
+		return fmt.Errorf("failed to create Logging client: %v", err)
+	}
+
+	total := newLogSummary()
+	byBackend := map[string]*logSummary{}
+	truncated, err := listRequestLogs(ctx, l, c.projectFor(monitoringProjects), c.BackendService, start, end, *limit, func(e *logging.LogEntry) {
+		backend := e.HttpRequest.ServerIp
+		if name, ok := ips[backend]; ok {
+			backend = name
+		}
+		if backend == "" {
+			backend = "(none)"
+		}
+		if byBackend[backend] == nil {
+			byBackend[backend] = newLogSummary()
+		}
+		byBackend[backend].add(e.HttpRequest)
+		total.add(e.HttpRequest)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list request logs: %v", err)
+	}
+	if truncated {
+		log.Printf("Stopped after %d requests; raise -limit to summarize more.", *limit)
+	}
+	if total.requests == 0 {
+		log.Printf("No request logs found for %v between %v and %v; is logging enabled on the backend service?",
+			c.BackendService, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		return nil
+	}
+
+	backends := make([]string, 0, len(byBackend))
+	for b := range byBackend {
+		backends = append(backends, b)
+	}
+	sort.Strings(backends)
+	rows := []logSummaryResult{}
+	for _, b := range backends {
+		rows = append(rows, byBackend[b].result(b))
+	}
+	rows = append(rows, total.result("TOTAL"))
+	return printResult(rows, func(w io.Writer) error {
+		tw := newTable(w)
+		header := "BACKEND\tREQUESTS\t2XX\t3XX\t4XX\t5XX\tNO RESPONSE\tCACHE HIT\tCACHE MISS\tP50\tP95\tP99"
+		for _, b := range latencyBuckets {
+			header += fmt.Sprintf("\t<=%v", b)
+		}
+		header += fmt.Sprintf("\t>%v", latencyBuckets[len(latencyBuckets)-1])
+		fmt.Fprintln(tw, header)
+		row := func(name string, ls *logSummary) {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%v\t%v\t%v", name, ls.requests,
+				ls.statuses["2xx"], ls.statuses["3xx"], ls.statuses["4xx"], ls.statuses["5xx"], ls.statuses["none"],
+				ls.cache["hit"], ls.cache["miss"], ls.percentile(0.5), ls.percentile(0.95), ls.percentile(0.99))
+			for _, n := range ls.buckets {
+				fmt.Fprintf(tw, "\t%d", n)
+			}
+			fmt.Fprintln(tw)
+		}
+		for _, b := range backends {
+			row(b, byBackend[b])
+		}
+		row("TOTAL", total)
+		return tw.Flush()
+	})
+}
+
+// A logSummaryResult is one backend's row of lb logs, or the total.
+type logSummaryResult struct {
+	Backend  string         `json:"backend"`
+	Requests int            `json:"requests"`
+	Statuses map[string]int `json:"statuses"`
+	Cache    map[string]int `json:"cache"`
+	P50Ms    float64        `json:"p50Ms"`
+	P95Ms    float64        `json:"p95Ms"`
+	P99Ms    float64        `json:"p99Ms"`
+	// Buckets counts requests by latency; the last bucket has no upper
+	// bound.
+	Buckets []latencyBucketCount `json:"buckets"`
+}
+
+// A latencyBucketCount counts the requests no slower than MaxMs.
+type latencyBucketCount struct {
+	MaxMs    float64 `json:"maxMs,omitempty"`
+	Requests int     `json:"requests"`
+}
+
+// result returns the summary as a row of lb logs.
+func (ls *logSummary) result(backend string) logSummaryResult {
+	r := logSummaryResult{
+		Backend: backend, Requests: ls.requests, Statuses: ls.statuses, Cache: ls.cache,
+		P50Ms: report.Millis(ls.percentile(0.5)), P95Ms: report.Millis(ls.percentile(0.95)), P99Ms: report.Millis(ls.percentile(0.99)),
+	}
+	for i, n := range ls.buckets {
+		b := latencyBucketCount{Requests: n}
+		if i < len(latencyBuckets) {
+			b.MaxMs = report.Millis(latencyBuckets[i])
+		}
+		r.Buckets = append(r.Buckets, b)
+	}
+	return r
+}
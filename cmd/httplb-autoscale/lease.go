@@ -0,0 +1,324 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Prefix of the project metadata keys holding the leases of runs, followed
+// by the run ID.
+const leaseMetadataPrefix = "httplb-autoscaling-lease-"
+
+// What is done to a run whose lease expired.
+const (
+	leaseTeardown    = "teardown"
+	leaseScaleToZero = "scale-to-zero"
+)
+
+// leaseOutcomes describes what each action does to a run's resources.
+var leaseOutcomes = map[string]string{leaseTeardown: "torn down", leaseScaleToZero: "scaled to zero"}
+
+// Attempts made at changing the project metadata while other writers change
+// it too.
+const metadataAttempts = 5
+
+// A runLease is a deadline by which a run's resources are to be torn down or
+// scaled to zero. Leases live in the project metadata rather than in the
+// process or the state file, so that cleanup leases can enforce them after
+// the command which took one was killed.
+type runLease struct {
+	RunID   string    `json:"runId"`
+	Expires time.Time `json:"expires"`
+	// Action is leaseTeardown or leaseScaleToZero.
+	Action string `json:"action"`
+	// Holder is the command which took the lease, e.g. demo run.
+	Holder string `json:"holder"`
+}
+
+// checkLeaseAction verifies the value of an -on-expiry flag.
+func checkLeaseAction(action string) error {
+	if action != leaseTeardown && action != leaseScaleToZero {
+		return fmt.Errorf("-on-expiry must be %v or %v, not %q", leaseTeardown, leaseScaleToZero, action)
+	}
+	return nil
+}
+
+// setProjectMetadata sets a key of the project metadata to value, or
+// deletes it if value is nil, retrying when another writer changed the
+// metadata first.
+func setProjectMetadata(ctx context.Context, s *compute.Service, project, key string, value *string) error {
+	for attempt := 1; ; attempt++ {
+		p, err := s.Projects.Get(project).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to get the metadata of project %v: %v", project, err)
+		}
+		md := p.CommonInstanceMetadata
+		if md == nil {
+			md = &compute.Metadata{}
+		}
+		var items []*compute.MetadataItems
+		for _, item := range md.Items {
+			if item.Key != key {
+				items = append(items, item)
+			}
+		}
+		if value != nil {
+			items = append(items, &compute.MetadataItems{Key: key, Value: value})
+		}
+		md.Items = items
+		op, err := s.Projects.SetCommonInstanceMetadata(project, md).Context(ctx).Do()
+		var ae *googleapi.Error
+		if errors.As(err, &ae) && ae.Code == http.StatusPreconditionFailed && attempt < metadataAttempts {
+			// The fingerprint is stale.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to set the metadata of project %v: %v", project, err)
+		}
+		return waitForOperation(ctx, s, project, op)
+	}
+}
+
+// putLease records a lease in the project metadata, replacing any earlier
+// lease of the run.
+func putLease(ctx context.Context, s *compute.Service, project string, l *runLease) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	v := string(b)
+	if err := setProjectMetadata(ctx, s, project, leaseMetadataPrefix+l.RunID, &v); err != nil {
+		return fmt.Errorf("unable to record the lease of run %v: %v", l.RunID, err)
+	}
+	log.Printf("Run %v is leased until %v, then its resources are %v.", l.RunID, l.Expires.Format(time.RFC3339),
+		leaseOutcomes[l.Action])
+	return nil
+}
+
+// releaseLease deletes a run's lease, once its resources are gone.
+func releaseLease(ctx context.Context, s *compute.Service, project, runID string) error {
+	if err := setProjectMetadata(ctx, s, project, leaseMetadataPrefix+runID, nil); err != nil {
+		return fmt.Errorf("unable to release the lease of run %v: %v", runID, err)
+	}
+	return nil
+}
+
+// listLeases returns the leases in the project metadata, soonest to expire
+// first.
+func listLeases(ctx context.Context, s *compute.Service, project string) ([]*runLease, error) {
+	p, err := s.Projects.Get(project).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the metadata of project %v: %v", project, err)
+	}
+	if p.CommonInstanceMetadata == nil {
+		return nil, nil
+	}
+	var leases []*runLease
+	for _, item := range p.CommonInstanceMetadata.Items {
+		if !strings.HasPrefix(item.Key, leaseMetadataPrefix) || item.Value == nil {
+			continue
+		}
+		l := &runLease{}
+		if err := json.Unmarshal([]byte(*item.Value), l); err != nil {
+			return nil, fmt.Errorf("unable to parse lease %v: %v", item.Key, err)
+		}
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Expires.Before(leases[j].Expires) })
+	return leases, nil
+}
+
+// reapRun does what a run's expired lease says to its resources, then
+// releases the lease: it deletes every resource labelled with the run, or
+// turns its autoscalers off and resizes its groups to zero.
+func reapRun(ctx context.Context, s *compute.Service, project string, l *runLease) error {
+	resources, err := listManagedResources(ctx, s, project, l.RunID)
+	if err != nil {
+		return err
+	}
+	switch l.Action {
+	case leaseTeardown:
+		if err := deleteManagedResources(ctx, s, project, resources); err != nil {
+			return err
+		}
+		log.Printf("Tore down the %d resources of run %v.", len(resources), l.RunID)
+	case leaseScaleToZero:
+		if err := scaleRunToZero(ctx, s, project, resources); err != nil {
+			return err
+		}
+		log.Printf("Scaled the groups of run %v to zero.", l.RunID)
+	default:
+		return fmt.Errorf("lease of run %v has unknown action %q", l.RunID, l.Action)
+	}
+	return releaseLease(ctx, s, project, l.RunID)
+}
+
+// scaleRunToZero turns a run's autoscalers off, so that they do not scale
+// its groups out again, then resizes the groups to zero.
+func scaleRunToZero(ctx context.Context, s *compute.Service, project string, resources []managedResource) error {
+	for _, kind := range []string{"autoscaler", "instanceGroupManager"} {
+		for _, r := range resources {
+			if r.kind != kind {
+				continue
+			}
+			loc := mig.Location{Project: project, Zone: r.location}
+			if r.regional {
+				loc = mig.Location{Project: project, Region: r.location}
+			}
+			var op *compute.Operation
+			var err error
+			if kind == "autoscaler" {
+				op, err = (&autoscale.Autoscaler{Location: loc, Name: r.name}).Patch(ctx, s,
+					&compute.Autoscaler{Name: r.name, AutoscalingPolicy: &compute.AutoscalingPolicy{Mode: "OFF"}})
+			} else {
+				op, err = (&mig.Group{Location: loc, Name: r.name}).Resize(ctx, s, 0)
+			}
+			if mig.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := waitForOperation(ctx, s, project, op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A leaseGuard time-boxes a command: it holds the lease of the command's
+// run and cancels the command's context when the lease expires.
+type leaseGuard struct {
+	s       *compute.Service
+	project string
+	lease   *runLease
+}
+
+// takeLease records a lease of the run expiring at expires and returns its
+// guard with a context which is done by then.
+func takeLease(ctx context.Context, s *compute.Service, project string, l *runLease) (*leaseGuard, context.Context, context.CancelFunc, error) {
+	if err := putLease(ctx, s, project, l); err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithDeadline(ctx, l.Expires)
+	return &leaseGuard{s: s, project: project, lease: l}, ctx, cancel, nil
+}
+
+// expired reports whether the lease ran out, which the command's error err
+// may be a consequence of.
+func (g *leaseGuard) expired() bool {
+	return g != nil && !time.Now().Before(g.lease.Expires)
+}
+
+// reap enforces the expired lease from within the command, with ctx rather
+// than the command's expired context.
+func (g *leaseGuard) reap(ctx context.Context) error {
+	log.Printf("Run %v reached its -max-duration; its resources are %v now.", g.lease.RunID, leaseOutcomes[g.lease.Action])
+	return reapRun(ctx, g.s, g.project, g.lease)
+}
+
+// release releases the lease, if any, once the run's resources are gone.
+func (g *leaseGuard) release(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	return releaseLease(ctx, g.s, g.project, g.lease.RunID)
+}
+
+// A leaseResult is a row of cleanup leases.
+type leaseResult struct {
+	RunID   string `json:"runId"`
+	Expires string `json:"expires"`
+	Action  string `json:"action"`
+	Holder  string `json:"holder"`
+	Status  string `json:"status"`
+}
+
+// cleanupLeasesCmd enforces the leases of time-boxed runs: the resources of
+// every run whose lease expired are torn down or scaled to zero, after
+// which the lease is released. Run it on a schedule to catch the runs whose
+// command was killed before it could reap them itself.
+func cleanupLeasesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cleanup leases", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config, for its project.")
+	dryRun := fs.Bool("dry-run", false, "Only list the leases.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	leases, err := listLeases(ctx, s, c.Project)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	rows := []leaseResult{}
+	var expired []*runLease
+	for _, l := range leases {
+		status := "active"
+		if !now.Before(l.Expires) {
+			status = "expired"
+			expired = append(expired, l)
+		}
+		rows = append(rows, leaseResult{l.RunID, l.Expires.UTC().Format(time.RFC3339), l.Action, l.Holder, status})
+	}
+	err = printResult(rows, func(out io.Writer) error {
+		w := newTable(out)
+		fmt.Fprintln(w, "RUN-ID\tEXPIRES\tACTION\tHOLDER\tSTATUS")
+		for _, r := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.RunID, r.Expires, r.Action, r.Holder, r.Status)
+		}
+		return w.Flush()
+	})
+	if err != nil || *dryRun {
+		return err
+	}
+	var failed []string
+	for _, l := range expired {
+		if err := reapRun(ctx, s, c.Project, l); err != nil {
+			log.Printf("Unable to reap run %v: %v", l.RunID, err)
+			failed = append(failed, l.RunID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to reap runs %v", strings.Join(failed, ", "))
+	}
+	if len(expired) == 0 {
+		log.Printf("No expired leases in %v.", c.Project)
+	}
+	return nil
+}
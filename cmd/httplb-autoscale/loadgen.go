@@ -0,0 +1,194 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+)
+
+// loadgenRunCmd offers a scenario's load to a URL without touching the
+// group, and saves the results in the files autoscaler experiment writes
+// for each trial, so that the report commands can be used on them.
+func loadgenRunCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("loadgen run", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config whose scenario to run; -url, -qps and -duration override it.")
+	scenarioPath := fs.String("scenario", "", "YAML scenario with url, phases and traceSampleRate; overrides -url, -qps and -duration.")
+	url := fs.String("url", "", "URL to request, for a single phase scenario.")
+	qps := fs.Float64("qps", 10, "Request rate of the single phase.")
+	duration := fs.Duration("duration", 5*time.Minute, "Length of the single phase.")
+	outPrefix := fs.String("out", "", "Write PREFIX.load.jsonl and PREFIX.zones.jsonl for the run.")
+	width := fs.Duration("interval", 10*time.Second, "Width of each load interval.")
+	requests := fs.Bool("requests", false, "Also write every request to PREFIX.requests.jsonl.")
+	flashCrowd := fs.Float64("flash-crowd", 0, "Run a flash crowd instead: -qps for -duration, then at once this many times -qps for -hold, then -qps for -duration again.")
+	hold := fs.Duration("hold", 10*time.Minute, "How long the -flash-crowd holds.")
+	maxDuration := fs.Duration("max-duration", 0, "Stop, and tear down or scale to zero the -config's run, this long from now, even if this command is killed by then, through a lease enforced by cleanup leases; 0 leaves the run.")
+	onExpiry := fs.String("on-expiry", leaseTeardown, "What -max-duration does to the run's resources: teardown or scale-to-zero.")
+	fs.Parse(args)
+
+	if err := checkLeaseAction(*onExpiry); err != nil {
+		return err
+	}
+	var c *policyConfig
+	if *configPath != "" {
+		var err error
+		if c, err = loadPolicyConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	if *maxDuration > 0 {
+		if c == nil {
+			return errors.New("-max-duration needs the -config of the run to lease")
+		}
+		id, err := runID(c, defaultStatePath)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return errors.New("-max-duration needs a run, made by template create or named by the config's runId")
+		}
+		s, err := newComputeService()
+		if err != nil {
+			return fmt.Errorf("failed to create Compute client: %v", err)
+		}
+		l := &runLease{RunID: id, Expires: time.Now().Add(*maxDuration).UTC(), Action: *onExpiry, Holder: "loadgen run"}
+		parent := ctx
+		guard, leased, cancel, err := takeLease(ctx, s, c.Project, l)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		defer func() {
+			if guard.expired() {
+				if err := guard.reap(parent); err != nil {
+					log.Printf("Unable to reap the run; cleanup leases will retry: %v", err)
+				}
+			}
+		}()
+		ctx = leased
+	}
+	sc, err := chooseScenario(fs, c, *scenarioPath, *url, *qps, *duration)
+	if err != nil {
+		return err
+	}
+	if *flashCrowd > 0 {
+		sc.Phases = nil
+		sc.FlashCrowd = &loadgen.FlashCrowd{Baseline: *qps, Magnitude: *flashCrowd, Before: *duration, Hold: *hold, After: *duration}
+		if err := sc.Check(); err != nil {
+			return err
+		}
+	}
+	res, err := runLoad(ctx, sc)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d requests, %.2f%% errors, p50 %v, p95 %v, p99 %v.", res.Requests(), 100*res.ErrorRate(),
+		res.Percentile(0.5), res.Percentile(0.95), res.Percentile(0.99))
+	if *outPrefix == "" {
+		return nil
+	}
+	if err := loadgen.WriteIntervals(*outPrefix+".load.jsonl", res.Intervals(*width)); err != nil {
+		return err
+	}
+	if err := writeScopeLatencies(*outPrefix+".zones.jsonl", scopeLatencies(res)); err != nil {
+		return err
+	}
+	if *requests {
+		return res.WriteRequestSamples(*outPrefix + ".requests.jsonl")
+	}
+	return nil
+}
+
+// chooseScenario returns the scenario of a load command: the -scenario
+// file, else the config's scenario with the single phase flags given
+// explicitly in fs overriding it, else the single phase flags alone.
+func chooseScenario(fs *flag.FlagSet, c *policyConfig, scenarioPath, url string, qps float64, duration time.Duration) (*loadgen.Scenario, error) {
+	sc := &loadgen.Scenario{URL: url, Phases: []loadgen.Phase{{Duration: duration, QPS: qps}}}
+	switch {
+	case scenarioPath != "":
+		var err error
+		if sc, err = loadgen.LoadScenario(scenarioPath); err != nil {
+			return nil, err
+		}
+	case c != nil:
+		if c.Scenario == nil {
+			return nil, errors.New("the config has no scenario")
+		}
+		file := *c.Scenario
+		// Flags given explicitly win over the file.
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "url":
+				file.URL = url
+			case "qps", "duration":
+				file.Phases = sc.Phases
+				file.FlashCrowd = nil
+			}
+		})
+		sc = &file
+	}
+	if err := sc.Check(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Thresholds above which an interval of a flash crowd counts as
+// overloaded: its p95 as a multiple of the baseline's, and its error rate.
+const (
+	overloadLatencyFactor = 2
+	overloadErrorRate     = 0.01
+)
+
+// runLoad offers a scenario's load, logging each phase as it starts and
+// showing each interval's latency as progress. For a flash crowd it also
+// logs how long the backends were overloaded once the crowd arrived.
+// Further options are passed to the Runner.
+func runLoad(ctx context.Context, sc *loadgen.Scenario, opts ...loadgen.RunnerOption) (*loadgen.Result, error) {
+	var crowdArrived time.Time
+	opts = append([]loadgen.RunnerOption{
+		loadgen.OnPhaseStart(func(i int, p loadgen.Phase) {
+			endProgress()
+			log.Printf("Phase %d: %.1f QPS for %v.", i, p.QPS, p.Duration)
+			if sc.FlashCrowd != nil && i == 1 {
+				crowdArrived = time.Now()
+			}
+		}),
+		loadgen.OnInterval(func(in *loadgen.Interval) {
+			progressf("%v: %d requests, %d errors, p50 %.0fms, p95 %.0fms, p99 %.0fms.", in.Start.Format("15:04:05"),
+				in.Requests, in.Errors, in.P50Ms, in.P95Ms, in.P99Ms)
+		}),
+		loadgen.OnComplete(func(*loadgen.Result) { endProgress() }),
+	}, opts...)
+	res, err := loadgen.NewRunner(&http.Client{Timeout: 30 * time.Second}, sc, opts...).Run(ctx)
+	if res != nil && !crowdArrived.IsZero() {
+		w := loadgen.FindOverload(res.Intervals(loadgen.DefaultIntervalWidth), crowdArrived, overloadLatencyFactor, overloadErrorRate)
+		if w.Overloaded == 0 {
+			log.Printf("The backends kept up with the flash crowd.")
+		} else {
+			log.Printf("Overload window: %v from %v, %d overloaded intervals (p95 over %.0fms or errors over %.0f%%).",
+				w.Length(), w.Start.Format("15:04:05"), w.Overloaded, overloadLatencyFactor*w.BaselineP95Ms,
+				100*overloadErrorRate)
+		}
+	}
+	return res, err
+}
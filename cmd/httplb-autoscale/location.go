@@ -0,0 +1,150 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+)
+
+// The functions in this file hide whether a group and its autoscaler are
+// zonal or regional, through the mig and autoscale packages, based on the
+// policy config.
+
+// location returns the zone or region the group lives in.
+func (c *policyConfig) location() string {
+	return c.migLocation().String()
+}
+
+// regional reports whether the config describes a regional group.
+func (c *policyConfig) regional() bool {
+	return c.Region != ""
+}
+
+// migLocation returns the location of the config's group and autoscaler.
+func (c *policyConfig) migLocation() mig.Location {
+	return mig.Location{Project: c.Project, Zone: c.Zone, Region: c.Region}
+}
+
+// group returns the group named in the config.
+func (c *policyConfig) group() *mig.Group {
+	return &mig.Group{Location: c.migLocation(), Name: c.Group}
+}
+
+// autoscaler returns the autoscaler named in the config.
+func (c *policyConfig) autoscaler() *autoscale.Autoscaler {
+	return &autoscale.Autoscaler{Location: c.migLocation(), Name: c.Autoscaler}
+}
+
+// getAutoscaler fetches the autoscaler named in the config.
+func getAutoscaler(ctx context.Context, s *compute.Service, c *policyConfig) (*compute.Autoscaler, error) {
+	return c.autoscaler().Get(ctx, s)
+}
+
+// insertAutoscaler creates a new autoscaler.
+func insertAutoscaler(ctx context.Context, s *compute.Service, c *policyConfig, a *compute.Autoscaler) (*compute.Operation, error) {
+	return c.autoscaler().Insert(ctx, s, a)
+}
+
+// updateAutoscaler replaces an existing autoscaler.
+func updateAutoscaler(ctx context.Context, s *compute.Service, c *policyConfig, a *compute.Autoscaler) (*compute.Operation, error) {
+	return c.autoscaler().Update(ctx, s, a)
+}
+
+// patchAutoscaler changes only the fields set in a.
+func patchAutoscaler(ctx context.Context, s *compute.Service, c *policyConfig, a *compute.Autoscaler) (*compute.Operation, error) {
+	return c.autoscaler().Patch(ctx, s, a)
+}
+
+// deleteAutoscaler deletes the autoscaler named in the config.
+func deleteAutoscaler(ctx context.Context, s *compute.Service, c *policyConfig) (*compute.Operation, error) {
+	return c.autoscaler().Delete(ctx, s)
+}
+
+// getGroupManager fetches the instance group manager named in the config.
+func getGroupManager(ctx context.Context, s *compute.Service, c *policyConfig) (*compute.InstanceGroupManager, error) {
+	return c.group().Get(ctx, s)
+}
+
+// insertGroupManager creates a new instance group manager.
+func insertGroupManager(ctx context.Context, s *compute.Service, c *policyConfig, m *compute.InstanceGroupManager) (*compute.Operation, error) {
+	return c.group().Insert(ctx, s, m)
+}
+
+// deleteGroupManager deletes the instance group manager named in the config,
+// along with all of its instances.
+func deleteGroupManager(ctx context.Context, s *compute.Service, c *policyConfig) (*compute.Operation, error) {
+	return c.group().Delete(ctx, s)
+}
+
+// listManagedInstances returns every instance in the group named in the
+// config.
+func listManagedInstances(ctx context.Context, s *compute.Service, c *policyConfig) ([]*compute.ManagedInstance, error) {
+	return c.group().ListManagedInstances(ctx, s)
+}
+
+// waitForOperation polls an operation until it completes and returns any
+// error it reports, recording the wait as a trace span and logging every
+// poll with -v.
+func waitForOperation(ctx context.Context, s *compute.Service, project string, op *compute.Operation) (err error) {
+	end := otel.phase("wait "+op.OperationType, "target", path.Base(op.TargetLink))
+	defer func() { end(err) }()
+	return mig.WaitForOperation(ctx, s, project, op, debugReporter{})
+}
+
+// sleep waits for d, or returns the context's error if it is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// resizeGroupManager sets the target size of the group named in the config.
+func resizeGroupManager(ctx context.Context, s *compute.Service, c *policyConfig, size int64) (*compute.Operation, error) {
+	return c.group().Resize(ctx, s, size)
+}
+
+// patchGroupManager changes only the fields set in m.
+func patchGroupManager(ctx context.Context, s *compute.Service, c *policyConfig, m *compute.InstanceGroupManager) (*compute.Operation, error) {
+	return c.group().Patch(ctx, s, m)
+}
+
+// deleteGroupInstances deletes instances of the group, given by URL, and
+// lowers its target size to match.
+func deleteGroupInstances(ctx context.Context, s *compute.Service, c *policyConfig, instances []string) (*compute.Operation, error) {
+	return c.group().DeleteInstances(ctx, s, instances)
+}
+
+// abandonGroupInstances removes instances, given by URL, from the group
+// without deleting them, and lowers its target size to match.
+func abandonGroupInstances(ctx context.Context, s *compute.Service, c *policyConfig, instances []string) (*compute.Operation, error) {
+	return c.group().AbandonInstances(ctx, s, instances)
+}
+
+// createGroupInstances creates named instances in the group, each with its
+// own per-instance config, and raises the target size to match.
+func createGroupInstances(ctx context.Context, s *compute.Service, c *policyConfig, configs []*compute.PerInstanceConfig) (*compute.Operation, error) {
+	return c.group().CreateInstances(ctx, s, configs)
+}
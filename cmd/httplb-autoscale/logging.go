@@ -0,0 +1,239 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/progress"
+)
+
+// Largest body logged by -vv, in bytes.
+const maxLoggedBody = 2048
+
+// Width of the progress bars, in characters.
+const progressBarWidth = 30
+
+var (
+	quiet       = flag.Bool("q", false, "Only print results and the error a command fails with.")
+	verbose     = flag.Bool("v", false, "Also log every API call and operation poll.")
+	veryVerbose = flag.Bool("vv", false, "Like -v, also logging request and response bodies.")
+	noProgress  = flag.Bool("no-progress", false, "Do not show progress while waiting on long operations.")
+)
+
+// errorLog reports the error a command fails with, which -q does not
+// silence.
+var errorLog = log.New(os.Stderr, "httplb-autoscale: ", log.LstdFlags)
+
+// verbosity returns -1 with -q, 1 with -v and 2 with -vv, and 0 otherwise.
+func verbosity() int {
+	switch {
+	case *quiet:
+		return -1
+	case *veryVerbose:
+		return 2
+	case *verbose:
+		return 1
+	}
+	return 0
+}
+
+// setupLogging points the standard logger, which every command logs through,
+// at stderr or nowhere depending on the verbosity.
+func setupLogging() {
+	log.SetPrefix("httplb-autoscale: ")
+	if verbosity() < 0 {
+		log.SetOutput(ioutil.Discard)
+		return
+	}
+	log.SetOutput(stderr)
+}
+
+// debugf logs a message when the verbosity is at least level.
+func debugf(level int, format string, args ...interface{}) {
+	if verbosity() >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// A progressWriter writes to stderr, where a progress line may be showing.
+// It clears the line before anything else is written, and progressf draws
+// it again on its next update.
+type progressWriter struct {
+	mu sync.Mutex
+	// showing is set while the cursor is at the end of a progress line.
+	showing bool
+}
+
+// stderr is where logs and progress go.
+var stderr = &progressWriter{}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clear()
+	return os.Stderr.Write(b)
+}
+
+// clear erases the progress line, if one is showing.
+func (w *progressWriter) clear() {
+	if w.showing {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		w.showing = false
+	}
+}
+
+// isTerminal reports whether stderr is a terminal, where progress lines are
+// redrawn in place rather than logged.
+func isTerminal() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressf reports the state of a long wait. On a terminal it replaces the
+// previous progress line; elsewhere it is logged. -q and -no-progress
+// silence it.
+func progressf(format string, args ...interface{}) {
+	if *noProgress || verbosity() < 0 {
+		return
+	}
+	if !isTerminal() {
+		log.Printf(format, args...)
+		return
+	}
+	stderr.mu.Lock()
+	defer stderr.mu.Unlock()
+	stderr.clear()
+	fmt.Fprint(os.Stderr, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+	stderr.showing = true
+}
+
+// endProgress leaves the last progress line on screen and moves on to the
+// next line.
+func endProgress() {
+	stderr.mu.Lock()
+	defer stderr.mu.Unlock()
+	if stderr.showing {
+		fmt.Fprintln(os.Stderr)
+		stderr.showing = false
+	}
+}
+
+// progressBar renders done out of total as a bar, e.g. "[=====>    ] 5/10".
+func progressBar(done, total int) string {
+	if total <= 0 {
+		return fmt.Sprintf("%d", done)
+	}
+	n := done * progressBarWidth / total
+	bar := strings.Repeat("=", n)
+	if n < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-n-1)
+	}
+	return fmt.Sprintf("[%s] %d/%d", bar, done, total)
+}
+
+// A progressReporter shows the progress of a library operation with
+// progressf, as a bar when its total is known.
+type progressReporter struct{}
+
+func (progressReporter) Report(u progress.Update) {
+	line := u.Operation
+	if u.Total > 0 {
+		line += " " + progressBar(int(u.Done), int(u.Total))
+	}
+	if u.Message != "" {
+		line += ", " + u.Message
+	}
+	if u.Remaining > 0 {
+		line += fmt.Sprintf(", %v left", u.Remaining.Round(time.Second))
+	}
+	progressf("%v.", line)
+}
+
+func (progressReporter) Finish(string, error) {
+	endProgress()
+}
+
+// A debugReporter logs the progress of a library operation with -v, for
+// waits too short to be worth a progress line.
+type debugReporter struct{}
+
+func (debugReporter) Report(u progress.Update) {
+	debugf(1, "%v: %v, %d/%d.", u.Operation, u.Message, u.Done, u.Total)
+}
+
+func (debugReporter) Finish(string, error) {}
+
+// A loggingTransport logs the API calls made through it with -v, and their
+// bodies with -vv.
+type loggingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	if verbosity() >= 2 && req.Body != nil {
+		if b, err := httputil.DumpRequestOut(req, true); err == nil {
+			debugf(2, "%s", truncateBody(b))
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		debugf(1, "%v %v: %v after %v", req.Method, req.URL.Path, err, time.Since(start).Round(time.Millisecond))
+		return resp, err
+	}
+	debugf(1, "%v %v: %v in %v", req.Method, req.URL.Path, resp.Status, time.Since(start).Round(time.Millisecond))
+	if verbosity() >= 2 {
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		if err == nil {
+			debugf(2, "%s", truncateBody(b))
+		}
+	}
+	return resp, nil
+}
+
+// truncateBody shortens a body to at most maxLoggedBody bytes.
+func truncateBody(b []byte) string {
+	if len(b) <= maxLoggedBody {
+		return string(b)
+	}
+	return string(b[:maxLoggedBody]) + fmt.Sprintf("... (%d more bytes)", len(b)-maxLoggedBody)
+}
+
+// logged wraps a client's transport so that -v and -vv log its calls. It is
+// a no-op at lower verbosities.
+func logged(client *http.Client) *http.Client {
+	if verbosity() < 1 {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &loggingTransport{base: base}
+	return client
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// A customMachine describes a custom machine type as an alternative to
+// naming one in machineType:
+//
+//	instanceTemplate:
+//	  customMachine:
+//	    family: n2
+//	    vcpus: 4
+//	    memoryMb: 16384
+type customMachine struct {
+	// Family is n1, the default, n2, n2d or e2.
+	Family   string `yaml:"family"`
+	VCPUs    int64  `yaml:"vcpus"`
+	MemoryMb int64  `yaml:"memoryMb"`
+	// ExtendedMemory lifts the per vCPU memory limit, at a higher price.
+	ExtendedMemory bool `yaml:"extendedMemory"`
+}
+
+// A machineFamily holds the limits on custom machine types of one family.
+type machineFamily struct {
+	// validVCPUs reports whether a vCPU count is allowed.
+	validVCPUs func(n int64) bool
+	vcpuRule   string
+	// Memory per vCPU, in MB.
+	minMemoryPerVCPU, maxMemoryPerVCPU int64
+	// maxMemory is the total memory limit in MB, or 0 for none beyond the
+	// per vCPU limit.
+	maxMemory int64
+}
+
+// Custom machine type limits per family, from the Compute Engine
+// documentation. Memory must always be a multiple of 256MB.
+var machineFamilies = map[string]machineFamily{
+	"n1": {
+		validVCPUs:       func(n int64) bool { return n == 1 || n > 0 && n <= 96 && n%2 == 0 },
+		vcpuRule:         "1 or an even number up to 96",
+		minMemoryPerVCPU: 922, maxMemoryPerVCPU: 6656,
+	},
+	"n2": {
+		validVCPUs: func(n int64) bool {
+			return n >= 2 && (n <= 32 && n%2 == 0 || n <= 80 && n%4 == 0 || n <= 128 && n%8 == 0)
+		},
+		vcpuRule:         "a multiple of 2 up to 32, of 4 up to 80 or of 8 up to 128",
+		minMemoryPerVCPU: 512, maxMemoryPerVCPU: 8192,
+	},
+	"n2d": {
+		validVCPUs: func(n int64) bool {
+			switch n {
+			case 2, 4, 8, 16, 32, 48, 64, 80, 96:
+				return true
+			}
+			return false
+		},
+		vcpuRule:         "2, 4, 8, 16, 32, 48, 64, 80 or 96",
+		minMemoryPerVCPU: 512, maxMemoryPerVCPU: 8192,
+	},
+	"e2": {
+		validVCPUs:       func(n int64) bool { return n >= 2 && n <= 32 && n%2 == 0 },
+		vcpuRule:         "an even number from 2 to 32",
+		minMemoryPerVCPU: 512, maxMemoryPerVCPU: 8192,
+		maxMemory: 128 * 1024,
+	},
+}
+
+var (
+	// customMachinePattern matches custom machine type names such as
+	// "custom-4-8192" (N1) or "n2-custom-4-16384-ext".
+	customMachinePattern = regexp.MustCompile(`^(?:([a-z0-9]+)-)?custom-(\d+)-(\d+)(-ext)?$`)
+	// predefinedMachinePattern matches predefined machine type names such as
+	// "n1-standard-1" or "e2-medium".
+	predefinedMachinePattern = regexp.MustCompile(`^[a-z][a-z0-9]*-[a-z]+(-\d+)?$`)
+)
+
+// name returns the machine type name of the custom machine.
+func (m *customMachine) name() string {
+	n := fmt.Sprintf("custom-%d-%d", m.VCPUs, m.MemoryMb)
+	if f := m.family(); f != "n1" {
+		n = f + "-" + n
+	}
+	if m.ExtendedMemory {
+		n += "-ext"
+	}
+	return n
+}
+
+// family returns the machine's family, defaulting to n1.
+func (m *customMachine) family() string {
+	if m.Family == "" {
+		return "n1"
+	}
+	return m.Family
+}
+
+// check verifies the custom machine against the limits of its family.
+func (m *customMachine) check() error {
+	family := m.family()
+	f, ok := machineFamilies[family]
+	if !ok {
+		return fmt.Errorf("custom machine types are not supported for family %q; use n1, n2, n2d or e2", family)
+	}
+	if !f.validVCPUs(m.VCPUs) {
+		return fmt.Errorf("%s custom machines need a vCPU count of %s, not %d", family, f.vcpuRule, m.VCPUs)
+	}
+	if m.MemoryMb%256 != 0 {
+		return fmt.Errorf("memory must be a multiple of 256MB, not %dMB", m.MemoryMb)
+	}
+	if min := f.minMemoryPerVCPU * m.VCPUs; m.MemoryMb < min {
+		return fmt.Errorf("%d vCPUs need at least %dMB of memory on %s, not %dMB", m.VCPUs, roundUp256(min), family, m.MemoryMb)
+	}
+	if m.ExtendedMemory {
+		if family == "e2" {
+			return fmt.Errorf("e2 custom machines do not support extended memory")
+		}
+		return nil
+	}
+	if max := f.maxMemoryPerVCPU * m.VCPUs; m.MemoryMb > max {
+		return fmt.Errorf("%d vCPUs allow at most %dMB of memory on %s, not %dMB; set extendedMemory for more",
+			m.VCPUs, max, family, m.MemoryMb)
+	}
+	if f.maxMemory > 0 && m.MemoryMb > f.maxMemory {
+		return fmt.Errorf("%s custom machines allow at most %dMB of memory", family, f.maxMemory)
+	}
+	return nil
+}
+
+// roundUp256 rounds a memory size up to a whole number of 256MB units.
+func roundUp256(mb int64) int64 {
+	return (mb + 255) / 256 * 256
+}
+
+// parseCustomMachine parses a custom machine type name. It reports false if
+// the name is not a custom machine type.
+func parseCustomMachine(name string) (*customMachine, bool) {
+	p := customMachinePattern.FindStringSubmatch(name)
+	if p == nil {
+		return nil, false
+	}
+	m := &customMachine{Family: p[1], ExtendedMemory: p[4] != ""}
+	m.VCPUs, _ = strconv.ParseInt(p[2], 10, 64)
+	m.MemoryMb, _ = strconv.ParseInt(p[3], 10, 64)
+	return m, true
+}
+
+// checkMachineType verifies a machine type name before it is sent to the
+// API: custom types must respect their family's limits, and other names must
+// look like predefined types.
+func checkMachineType(name string) error {
+	if m, ok := parseCustomMachine(name); ok {
+		return m.check()
+	}
+	if !predefinedMachinePattern.MatchString(name) {
+		return fmt.Errorf("%q is neither a predefined machine type such as n1-standard-1 nor a custom one such as n2-custom-4-16384", name)
+	}
+	return nil
+}
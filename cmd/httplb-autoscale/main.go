@@ -0,0 +1,269 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary httplb-autoscale sets up the image processing pool behind the HTTP
+// load balancer, configures the Compute Engine Autoscaler attached to its
+// managed instance group, drives load at it and reports on the results.
+// Most actions are exposed as a GROUP COMMAND pair, e.g. "autoscaler
+// create"; the most common ones, such as "watch", also stand alone. Every
+// command shares the same per project credentials, audit log and telemetry.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	bigquery "google.golang.org/api/bigquery/v2"
+	cloudtrace "google.golang.org/api/cloudtrace/v1"
+	"google.golang.org/api/compute/v1"
+	logging "google.golang.org/api/logging/v2"
+	monitoring "google.golang.org/api/monitoring/v3"
+	pubsub "google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/storage/v1"
+)
+
+const usage = `
+Usage:
+	httplb-autoscale [-audit-dir DIR] [-otlp-endpoint URL] [-impersonate-service-account EMAIL] [-q | -v | -vv] [-no-progress]
+		[-output table|json|yaml] [-profile NAME] [-set KEY=VALUE]... COMMAND [flags]
+Where COMMAND is one of:
+%s
+Run a command with -h to see its flags. Every mutating API call is recorded
+in DIR/RUN_ID.jsonl, by default in the audit directory. With -otlp-endpoint,
+or OTEL_EXPORTER_OTLP_ENDPOINT, traces and metrics of the tool's own API
+calls and phases are sent to that OpenTelemetry collector.
+
+Config fields are read from the -config file, then from the file's -profile
+preset, then from HTTPLB_ environment variables such as HTTPLB_MIN_REPLICAS,
+then from -set flags such as -set minReplicas=2; later sources win.
+
+Every API client uses the application default credentials, or those of its
+resource group in the config, unless -impersonate-service-account is given,
+in which case those credentials only mint the account's short-lived tokens.
+
+Progress and other messages go to stderr: -q leaves only the error a command
+fails with, -no-progress drops progress updates, -v adds every API call and
+-vv their bodies.
+
+Reports and listings print a table by default. With -output json or yaml
+they print the same data with stable field names, for scripts.
+`
+
+// A command is a single action exposed by this binary.
+type command struct {
+	// summary is a one line description shown in the usage message.
+	summary string
+	// run performs the action using the remaining command line arguments.
+	run func(ctx context.Context, args []string) error
+}
+
+// commands maps "GROUP COMMAND" and single word command names to their
+// implementations.
+var commands = map[string]command{
+	"autoscaler create":       {"Create an autoscaler from a policy config file.", createAutoscalerCmd},
+	"autoscaler update":       {"Update an autoscaler from a policy config file.", updateAutoscalerCmd},
+	"autoscaler experiment":   {"Compare policies by running one load scenario against each.", experimentCmd},
+	"autoscaler pause":        {"Freeze the group size, remembering the current mode.", pauseAutoscalerCmd},
+	"autoscaler resume":       {"Restore the mode saved by autoscaler pause.", resumeAutoscalerCmd},
+	"autoscaler set-mode":     {"Set the autoscaler mode to ON, OFF or ONLY_SCALE_OUT.", setModeCmd},
+	"autoscaler simulate":     {"Replay a load trace against a policy offline.", simulateCmd},
+	"autoscaler soak":         {"Offer load for hours with rolled-up reports every few minutes and a final aggregate.", soakCmd},
+	"autoscaler validate":     {"Check a policy config and print actionable diagnostics.", validateCmd},
+	"autoscaler watch":        {"Stream autoscaler and group state as JSON events.", watchCmd},
+	"cleanup bucket":          {"Delete every generation of a bucket's objects with concurrent deleters, reporting their throughput.", cleanupBucketCmd},
+	"cleanup leases":          {"Tear down or scale to zero the runs whose -max-duration lease expired.", cleanupLeasesCmd},
+	"cleanup orphans":         {"Delete resources left by failed runs: those of runs in no state file, or older than a TTL.", cleanupOrphansCmd},
+	"completion":              {"Print a bash, zsh or fish completion script.", completionCmd},
+	"config show":             {"Print the config after environment and -set overrides.", configShowCmd},
+	"config validate":         {"Check the whole config, topology and load scenario, and print diagnostics.", configValidateCmd},
+	"demo run":                {"Generate, provision, load, watch and tear down from one config, resumable with -resume.", demoRunCmd},
+	"generate files":          {"Upload an image to a bucket and duplicate it into the file servers' corpus.", generateFilesCmd},
+	"loadgen run":             {"Offer a load scenario to a URL and save its latency timeline.", loadgenRunCmd},
+	"setup-lb":                {"Create the HTTP load balancer in front of the config's groups.", setupLBCmd},
+	"teardown":                {"Delete the load balancer, groups and templates of the config's run.", teardownCmd},
+	"watch":                   {"Stream autoscaler and group state as JSON events; same as autoscaler watch.", watchCmd},
+	"init":                    {"Ask a few questions and write a starter config with the commands to run it.", initCmd},
+	"lb attach":               {"Attach every group in the config to the backend service.", attachBackendsCmd},
+	"lb logs":                 {"Summarize the load balancer's request logs for a run by backend instance.", lbLogsCmd},
+	"lb metrics-watch":        {"Stream the load balancer's request rate, 5xx rate and latency from Cloud Monitoring.", metricsWatchCmd},
+	"mig create":              {"Create the zonal or regional managed instance group.", createGroupCmd},
+	"mig delete":              {"Delete the autoscaler and its managed instance group.", deleteGroupCmd},
+	"mig delete-instance":     {"Remove one instance, optionally draining it, and wait for the backfill.", deleteInstanceCmd},
+	"mig degrade-network":     {"Add latency or packet loss to instances of the group for a window with tc netem.", degradeNetworkCmd},
+	"mig list-instances":      {"List the group's instances with their health and serving status.", listInstancesCmd},
+	"mig resize":              {"Resize the group and wait until it is stable and healthy.", resizeGroupCmd},
+	"mig rollout":             {"Roll the group out to a new template, streaming progress.", rolloutCmd},
+	"mig zone-outage":         {"Take one zone of a regional group out and time the recovery of its capacity.", zoneOutageCmd},
+	"metrics dashboard":       {"Write a Grafana dashboard for a run of the group.", dashboardCmd},
+	"metrics export":          {"Download a run's Cloud Monitoring time series as CSV files.", metricsExportCmd},
+	"metrics top":             {"Show live sparklines of group size, CPU utilization and request rate.", topCmd},
+	"metrics serve":           {"Serve group size, autoscaler and backend health gauges to Prometheus.", metricsServeCmd},
+	"mig add-instances":       {"Create instances with distinct per-instance metadata.", addInstancesCmd},
+	"mig canary":              {"Run a percentage of the group on a canary template.", canaryCmd},
+	"mig promote":             {"Move the whole group onto the canary template.", promoteCanaryCmd},
+	"mig rollback":            {"Move the canary instances back onto the stable template.", rollbackCanaryCmd},
+	"mig set-autohealing":     {"Apply the config's autohealing policy to the group.", setAutohealingCmd},
+	"mig ssh":                 {"Open an SSH session to an instance, or run a command on all of them.", sshCmd},
+	"quota check":             {"Compare the quotas the config's groups need at maxReplicas with those available.", quotaCheckCmd},
+	"report bigquery":         {"Export a run's summary, timeline and requests to BigQuery tables.", reportBigQueryCmd},
+	"report compare":          {"Diff the key metrics of two runs of a scenario and flag regressions beyond tolerances.", reportCompareCmd},
+	"report cost":             {"Estimate what a run cost in instances, load balancing and Cloud Storage.", reportCostCmd},
+	"report expected":         {"Compare a run's target sizes with the autoscaler formula applied to observed utilization.", reportExpectedCmd},
+	"report headroom":         {"Show how much of its configured capacity each backend group used in a run.", reportHeadroomCmd},
+	"report html":             {"Render a run as one shareable HTML page with charts, scenario, SLOs and events.", reportHTMLCmd},
+	"report merge":            {"Merge a run's watch events, load and load balancer metrics into one timeline.", reportMergeCmd},
+	"report traces":           {"Summarize the sampled Cloud Trace traces of a run, slowest first.", reportTracesCmd},
+	"report slo":              {"Compute availability and latency SLO burn rates over a run's merged timeline.", reportSLOCmd},
+	"report summary":          {"Summarize watch runs by predictive autoscaling method.", reportSummaryCmd},
+	"report zones":            {"Break a run's latency down by serving zone and region.", reportZonesCmd},
+	"resources list":          {"List the resources created by these commands, by run ID.", listResourcesCmd},
+	"template bake":           {"Bake a custom image with the backend preinstalled, for templates made with -baked.", bakeCmd},
+	"template create":         {"Create a run-versioned instance template from the config.", createTemplateCmd},
+	"template diff":           {"Print the differences between two instance templates.", diffTemplateCmd},
+	"template startup-script": {"Print the startup script generated for the file server.", startupScriptCmd},
+}
+
+// printUsage writes the top level usage message, listing every command.
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("\t%-24s %s", name, commands[name].summary))
+	}
+	fmt.Fprintf(os.Stderr, usage, strings.Join(lines, "\n"))
+}
+
+// newComputeService builds a Compute Engine API client using the serving
+// resource group's credentials.
+func newComputeService() (*compute.Service, error) {
+	client, err := groupClient(servingProjects, compute.ComputeScope)
+	if err != nil {
+		return nil, err
+	}
+	return compute.New(traced(audited(client)))
+}
+
+// newMonitoringService builds a read-only Cloud Monitoring API client using
+// the monitoring resource group's credentials.
+func newMonitoringService() (*monitoring.Service, error) {
+	client, err := groupClient(monitoringProjects, monitoring.MonitoringReadScope)
+	if err != nil {
+		return nil, err
+	}
+	return monitoring.New(traced(client))
+}
+
+// newMonitoringWriteService builds a Cloud Monitoring API client which may
+// write custom metrics, using the monitoring resource group's credentials.
+func newMonitoringWriteService() (*monitoring.Service, error) {
+	client, err := groupClient(monitoringProjects, monitoring.MonitoringWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	return monitoring.New(traced(audited(client)))
+}
+
+// newLoggingService builds a read-only Cloud Logging API client using the
+// monitoring resource group's credentials.
+func newLoggingService() (*logging.Service, error) {
+	client, err := groupClient(monitoringProjects, logging.LoggingReadScope)
+	if err != nil {
+		return nil, err
+	}
+	return logging.New(traced(client))
+}
+
+// newTraceService builds a read-only Cloud Trace API client using the
+// monitoring resource group's credentials.
+func newTraceService() (*cloudtrace.Service, error) {
+	client, err := groupClient(monitoringProjects, cloudtrace.TraceReadonlyScope)
+	if err != nil {
+		return nil, err
+	}
+	return cloudtrace.New(traced(client))
+}
+
+// newStorageService builds a Cloud Storage API client using the serving
+// resource group's credentials.
+func newStorageService() (*storage.Service, error) {
+	client, err := groupClient(servingProjects, storage.DevstorageReadWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	return storage.New(traced(audited(client)))
+}
+
+// newBigQueryService builds a BigQuery API client using the bigquery
+// resource group's credentials.
+func newBigQueryService() (*bigquery.Service, error) {
+	client, err := groupClient(bigqueryProjects, bigquery.BigqueryScope)
+	if err != nil {
+		return nil, err
+	}
+	return bigquery.New(traced(audited(client)))
+}
+
+// newPubSubService builds a Pub/Sub API client using the monitoring
+// resource group's credentials, for publishing notifications.
+func newPubSubService() (*pubsub.Service, error) {
+	client, err := groupClient(monitoringProjects, pubsub.PubsubScope)
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.New(traced(audited(client)))
+}
+
+func main() {
+	flag.Usage = printUsage
+	flag.Parse()
+	setupLogging()
+	if err := checkOutputFormat(); err != nil {
+		errorLog.Fatal(err)
+	}
+	if flag.NArg() < 1 {
+		printUsage()
+		os.Exit(2)
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	if name == completeCommand {
+		completeCmd(context.Background(), args)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok && flag.NArg() >= 2 {
+		name, args = strings.Join(flag.Args()[:2], " "), flag.Args()[2:]
+		cmd, ok = commands[name]
+	}
+	if !ok {
+		errorLog.Printf("Unknown command %q.", name)
+		printUsage()
+		os.Exit(2)
+	}
+	end := otel.phase(name)
+	err := cmd.run(context.Background(), args)
+	endProgress()
+	end(err)
+	otel.shutdown()
+	if err != nil {
+		errorLog.Fatalf("%s failed: %v", name, err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// A mergedRow is one interval of a run, combining the group's state from
+// the watch events, the load offered by the load generator and the load
+// balancer's view from Cloud Monitoring. Rows are written as one JSON object
+// per line, one row per interval from the first record of the run to the
+// last, so they can be plotted directly.
+type mergedRow struct {
+	// Time is the start of the interval.
+	Time time.Time `json:"time"`
+	// The group's state as of the end of the interval.
+	Mode            string `json:"mode,omitempty"`
+	RecommendedSize int64  `json:"recommendedSize"`
+	TargetSize      int64  `json:"targetSize"`
+	ActualSize      int64  `json:"actualSize"`
+	RunningSize     int64  `json:"runningSize"`
+	// The requests the load generator started during the interval. When an
+	// interval spans several load intervals, latencies are the largest.
+	Requests int     `json:"requests"`
+	Errors   int     `json:"errors"`
+	P50Ms    float64 `json:"p50Ms"`
+	P95Ms    float64 `json:"p95Ms"`
+	P99Ms    float64 `json:"p99Ms"`
+	// Metrics holds the newest value of each load balancer series as of the
+	// end of the interval.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+	// Events lists the watch events other than state samples which happened
+	// during the interval, as "type: message".
+	Events []string `json:"events,omitempty"`
+}
+
+// mergeRun aligns the records of a run on intervals of the given width.
+// Any of the inputs may be empty.
+func mergeRun(events []*report.WatchEvent, load []*loadgen.Interval, points []*metricPoint, width time.Duration) []*mergedRow {
+	var start, end time.Time
+	extend := func(t time.Time) {
+		if start.IsZero() || t.Before(start) {
+			start = t
+		}
+		if t.After(end) {
+			end = t
+		}
+	}
+	for _, e := range events {
+		extend(e.Time)
+	}
+	for _, in := range load {
+		extend(in.Start)
+	}
+	for _, p := range points {
+		extend(p.Time)
+	}
+	if start.IsZero() {
+		return nil
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	sort.SliceStable(load, func(i, j int) bool { return load[i].Start.Before(load[j].Start) })
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+
+	var rows []*mergedRow
+	var state *report.WatchEvent
+	metrics := map[string]float64{}
+	ei, li, pi := 0, 0, 0
+	for t := start.UTC().Truncate(width); !t.After(end); t = t.Add(width) {
+		next := t.Add(width)
+		row := &mergedRow{Time: t}
+		for ; ei < len(events) && events[ei].Time.Before(next); ei++ {
+			e := events[ei]
+			if e.Type == "state" {
+				state = e
+				continue
+			}
+			desc := e.Type
+			if e.Message != "" {
+				desc += ": " + e.Message
+			}
+			row.Events = append(row.Events, desc)
+		}
+		if state != nil {
+			row.Mode = state.Mode
+			row.RecommendedSize = state.RecommendedSize
+			row.TargetSize = state.TargetSize
+			row.ActualSize = state.ActualSize
+			row.RunningSize = state.RunningSize
+		}
+		for ; li < len(load) && load[li].Start.Before(next); li++ {
+			in := load[li]
+			row.Requests += in.Requests
+			row.Errors += in.Errors
+			row.P50Ms = maxFloat(row.P50Ms, in.P50Ms)
+			row.P95Ms = maxFloat(row.P95Ms, in.P95Ms)
+			row.P99Ms = maxFloat(row.P99Ms, in.P99Ms)
+		}
+		for ; pi < len(points) && points[pi].Time.Before(next); pi++ {
+			metrics[points[pi].Metric] = points[pi].Value
+		}
+		if len(metrics) > 0 {
+			row.Metrics = make(map[string]float64, len(metrics))
+			for k, v := range metrics {
+				row.Metrics[k] = v
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// maxFloat returns the larger of a and b.
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// writeMergedRun writes the rows to path as JSON lines.
+func writeMergedRun(path string, rows []*mergedRow) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONLines(f, rows); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeJSONLines writes each row as a line of JSON.
+func writeJSONLines(w io.Writer, rows []*mergedRow) error {
+	enc := json.NewEncoder(w)
+	for _, r := range rows {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJSONLines calls decode with each line of the file at path, prefixing
+// any error with the position of the line.
+func readJSONLines(path string, decode func(line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if err := decode(scanner.Bytes()); err != nil {
+			return fmt.Errorf("%v:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// readLoadIntervals reads a file written by loadgen.WriteIntervals.
+func readLoadIntervals(path string) ([]*loadgen.Interval, error) {
+	var intervals []*loadgen.Interval
+	err := readJSONLines(path, func(line []byte) error {
+		in := &loadgen.Interval{}
+		intervals = append(intervals, in)
+		return json.Unmarshal(line, in)
+	})
+	return intervals, err
+}
+
+// readRequestSamples reads a file written by loadgen.Result.WriteRequestSamples.
+func readRequestSamples(path string) ([]*loadgen.RequestSample, error) {
+	var samples []*loadgen.RequestSample
+	err := readJSONLines(path, func(line []byte) error {
+		s := &loadgen.RequestSample{}
+		samples = append(samples, s)
+		return json.Unmarshal(line, s)
+	})
+	return samples, err
+}
+
+// readMetricPoints reads a file written by lb metrics-watch -out.
+func readMetricPoints(path string) ([]*metricPoint, error) {
+	var points []*metricPoint
+	err := readJSONLines(path, func(line []byte) error {
+		p := &metricPoint{}
+		points = append(points, p)
+		return json.Unmarshal(line, p)
+	})
+	return points, err
+}
+
+// queryRunMetrics fetches every load balancer series of the config's backend
+// service for the time covered by the watch events.
+func queryRunMetrics(ctx context.Context, c *policyConfig, events []*report.WatchEvent, period time.Duration) ([]*metricPoint, error) {
+	if c.BackendService == "" {
+		return nil, errors.New("config does not name a backend service")
+	}
+	if len(events) == 0 {
+		return nil, errors.New("the time of the run is only known from watch events")
+	}
+	start, end := eventsWindow(events)
+	m, err := newMonitoringService()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	w := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), filter: lbFilter(c.BackendService), period: period}
+	var points []*metricPoint
+	for _, lm := range lbMetrics {
+		p, err := w.query(ctx, lm, start, end.Add(period))
+		if err != nil {
+			return nil, fmt.Errorf("unable to query %v: %v", lm.Name, err)
+		}
+		points = append(points, p...)
+	}
+	return points, nil
+}
+
+// reportMergeCmd aligns the records of one run into a single timeline: the
+// watch events of the group, the intervals of the load generator and the
+// load balancer series, either streamed by lb metrics-watch or queried from
+// Cloud Monitoring afterwards.
+func reportMergeCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report merge", flag.ExitOnError)
+	watchPath := fs.String("watch", "", "Watch event file of the run.")
+	loadPath := fs.String("load", "", "Load interval file of the run, as written by autoscaler experiment.")
+	metricsPath := fs.String("metrics", "", "Load balancer metrics file of the run, as written by lb metrics-watch -out.")
+	query := fs.Bool("query-metrics", false, "Query Cloud Monitoring for the run's load balancer metrics instead of reading -metrics.")
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config, for -query-metrics.")
+	width := fs.Duration("interval", 10*time.Second, "Width of each row of the timeline.")
+	outPath := fs.String("out", "", "Write the timeline to this file instead of stdout.")
+	fs.Parse(args)
+	if *watchPath == "" && *loadPath == "" && *metricsPath == "" {
+		return errors.New("at least one of -watch, -load and -metrics is required")
+	}
+	if *width <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	var (
+		events []*report.WatchEvent
+		load   []*loadgen.Interval
+		points []*metricPoint
+		err    error
+	)
+	if *watchPath != "" {
+		if events, err = report.ReadWatchEvents(*watchPath); err != nil {
+			return err
+		}
+	}
+	if *loadPath != "" {
+		if load, err = readLoadIntervals(*loadPath); err != nil {
+			return err
+		}
+	}
+	switch {
+	case *query:
+		c, err := loadPolicyConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if points, err = queryRunMetrics(ctx, c, events, time.Minute); err != nil {
+			return err
+		}
+	case *metricsPath != "":
+		if points, err = readMetricPoints(*metricsPath); err != nil {
+			return err
+		}
+	}
+
+	rows := mergeRun(events, load, points, *width)
+	if *outPath == "" {
+		return writeJSONLines(os.Stdout, rows)
+	}
+	if err := writeMergedRun(*outPath, rows); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d rows to %v.", len(rows), *outPath)
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// An lbMetric is one of the load balancer time series streamed by
+// lb metrics-watch, aggregated over all of the backend service's traffic.
+type lbMetric struct {
+	// Name identifies the series in the output.
+	Name string
+	// Type is the Cloud Monitoring metric type.
+	Type string
+	// Filter narrows the metric further, e.g. to one response code class.
+	Filter  string
+	Aligner string
+	Reducer string
+	// GroupBy keeps the series apart by these labels instead of reducing
+	// them all into one, e.g. resource.label.backend_scope for one series
+	// per zone.
+	GroupBy []string
+}
+
+// The load balancer series streamed by lb metrics-watch. Request counts are
+// per second rates; latencies are in milliseconds.
+var lbMetrics = []lbMetric{
+	{Name: "requests_per_sec", Type: "loadbalancing.googleapis.com/https/request_count",
+		Aligner: "ALIGN_RATE", Reducer: "REDUCE_SUM"},
+	{Name: "5xx_per_sec", Type: "loadbalancing.googleapis.com/https/request_count",
+		Filter:  `metric.labels.response_code_class = 500`,
+		Aligner: "ALIGN_RATE", Reducer: "REDUCE_SUM"},
+	{Name: "backend_latency_p50_ms", Type: "loadbalancing.googleapis.com/https/backend_latencies",
+		Aligner: "ALIGN_DELTA", Reducer: "REDUCE_PERCENTILE_50"},
+	{Name: "backend_latency_p95_ms", Type: "loadbalancing.googleapis.com/https/backend_latencies",
+		Aligner: "ALIGN_DELTA", Reducer: "REDUCE_PERCENTILE_95"},
+	{Name: "backend_latency_p99_ms", Type: "loadbalancing.googleapis.com/https/backend_latencies",
+		Aligner: "ALIGN_DELTA", Reducer: "REDUCE_PERCENTILE_99"},
+}
+
+// A metricPoint is one aligned point of a load balancer series. Points are
+// written as one JSON object per line.
+type metricPoint struct {
+	// Time is the end of the alignment period the point covers.
+	Time   time.Time `json:"time"`
+	Metric string    `json:"metric"`
+	Value  float64   `json:"value"`
+	// Labels holds the resource and metric labels of the series, for
+	// metrics with GroupBy.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// How far back each query reaches. Load balancer metrics arrive a few
+// minutes late, so each poll rereads recent periods and emits only the
+// points newer than the last one emitted.
+const metricsLookback = 10 * time.Minute
+
+// A metricsWatcher polls Cloud Monitoring for the load balancer series of a
+// backend service, emitting each new point once.
+type metricsWatcher struct {
+	m       *monitoring.Service
+	project string
+	filter  string
+	period  time.Duration
+	out     io.Writer
+	// last holds the time of the newest point emitted for each series.
+	last map[string]time.Time
+}
+
+// poll queries every series once and emits the points not seen before, in
+// time order within each series.
+func (w *metricsWatcher) poll(ctx context.Context) error {
+	end := time.Now().UTC()
+	start := end.Add(-metricsLookback)
+	for _, lm := range lbMetrics {
+		points, err := w.query(ctx, lm, start, end)
+		if err != nil {
+			return fmt.Errorf("unable to query %v: %v", lm.Name, err)
+		}
+		for _, p := range points {
+			if !p.Time.After(w.last[lm.Name]) {
+				continue
+			}
+			w.last[lm.Name] = p.Time
+			b, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w.out, "%s\n", b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// query returns the aligned points of one series between start and end,
+// oldest first.
+func (w *metricsWatcher) query(ctx context.Context, lm lbMetric, start, end time.Time) ([]*metricPoint, error) {
+	filter := fmt.Sprintf(`metric.type = %q AND %s`, lm.Type, w.filter)
+	if lm.Filter != "" {
+		filter += " AND " + lm.Filter
+	}
+	call := w.m.Projects.TimeSeries.List("projects/" + w.project).
+		Filter(filter).
+		IntervalStartTime(start.Format(time.RFC3339)).
+		IntervalEndTime(end.Format(time.RFC3339)).
+		AggregationAlignmentPeriod(fmt.Sprintf("%ds", int64(w.period/time.Second))).
+		AggregationPerSeriesAligner(lm.Aligner).
+		AggregationCrossSeriesReducer(lm.Reducer)
+	if len(lm.GroupBy) > 0 {
+		call = call.AggregationGroupByFields(lm.GroupBy...)
+	}
+	resp, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	var points []*metricPoint
+	for _, ts := range resp.TimeSeries {
+		var labels map[string]string
+		if len(lm.GroupBy) > 0 {
+			labels = map[string]string{}
+			if ts.Resource != nil {
+				for k, v := range ts.Resource.Labels {
+					labels[k] = v
+				}
+			}
+			if ts.Metric != nil {
+				for k, v := range ts.Metric.Labels {
+					labels[k] = v
+				}
+			}
+		}
+		// The API returns points newest first.
+		for i := len(ts.Points) - 1; i >= 0; i-- {
+			p := ts.Points[i]
+			t, err := time.Parse(time.RFC3339, p.Interval.EndTime)
+			if err != nil {
+				return nil, fmt.Errorf("invalid point time %q: %v", p.Interval.EndTime, err)
+			}
+			points = append(points, &metricPoint{Time: t, Metric: lm.Name, Value: pointValue(p.Value), Labels: labels})
+		}
+	}
+	return points, nil
+}
+
+// lbFilter selects the load balancer series of a backend service.
+func lbFilter(backendService string) string {
+	return fmt.Sprintf(`resource.type = "https_lb_rule" AND resource.labels.backend_target_name = %q`, backendService)
+}
+
+// pointValue returns a numeric point value as a float.
+func pointValue(v *monitoring.TypedValue) float64 {
+	switch {
+	case v == nil:
+		return 0
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.Int64Value != nil:
+		return float64(*v.Int64Value)
+	case v.DistributionValue != nil:
+		return v.DistributionValue.Mean
+	}
+	return 0
+}
+
+// metricsWatchCmd streams request rate, 5xx rate and backend latency of the
+// config's backend service from Cloud Monitoring until interrupted or until
+// the requested duration elapses.
+func metricsWatchCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("lb metrics-watch", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	period := fs.Duration("period", time.Minute, "Alignment period of the points; at least one minute.")
+	duration := fs.Duration("duration", 0, "Stop after this long; 0 watches until interrupted.")
+	outPath := fs.String("out", "", "Also append points to this file.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.BackendService == "" {
+		return errors.New("config does not name a backend service")
+	}
+	if *period < time.Minute || *period%time.Second != 0 {
+		return errors.New("-period must be a whole number of seconds, at least one minute")
+	}
+	m, err := newMonitoringService()
+	if err != nil {
+		return fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	w := &metricsWatcher{
+		m:       m,
+		project: c.projectFor(monitoringProjects),
+		filter:  lbFilter(c.BackendService),
+		period:  *period,
+		out:     os.Stdout,
+		last:    map[string]time.Time{},
+	}
+	if *outPath != "" {
+		f, err := os.OpenFile(*outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w.out = io.MultiWriter(os.Stdout, f)
+	}
+
+	log.Printf("Streaming load balancer metrics of %v at %v alignment.", c.BackendService, *period)
+	stop := stopChannel(*duration)
+	ticker := time.NewTicker(*period)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(ctx); err != nil {
+			log.Printf("Poll failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
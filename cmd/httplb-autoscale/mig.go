@@ -0,0 +1,318 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+)
+
+// createGroupCmd creates the managed instance group described by the policy
+// config. Regional groups are spread across the configured zones using the
+// configured target distribution shape. Unless -timeout is zero it blocks
+// until every instance is running and healthy.
+func createGroupCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig create", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	template := fs.String("template", "", "Instance template to use. Defaults to the newest one made by template create, "+
+		"or else the config's template.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long to wait for the group to become healthy; 0 to not wait.")
+	backend := fs.String("backend", "", "Create this group from the config's backends instead of the top level one.")
+	service := fs.String("service", "", "Create the group of this service from the config's services instead of the top level one.")
+	skipQuota := fs.Bool("skip-quota-check", false, "Create the group even if the region's quotas cannot hold it at maxReplicas.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c, err = c.forService(*service); err != nil {
+		return err
+	}
+	if c, err = c.forBackend(*backend); err != nil {
+		return err
+	}
+	if *template == "" {
+		if *template, err = currentTemplate(c, *statePath); err != nil {
+			return err
+		}
+	}
+	if *template == "" {
+		return errors.New("config does not name an instance template")
+	}
+	id, err := runID(c, *statePath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if !*skipQuota {
+		if err := preflightQuotas(ctx, s, c, []*policyConfig{c}, false); err != nil {
+			return err
+		}
+	}
+	m := &compute.InstanceGroupManager{
+		Name:             c.Group,
+		Description:      resourceDescription("Created by mig create.", id),
+		BaseInstanceName: c.BaseInstanceName,
+		InstanceTemplate: mig.TemplateURL(c.Project, *template),
+		TargetSize:       c.TargetSize,
+		NamedPorts:       c.namedPorts(),
+		// A size of zero must still be sent, or the API defaults it.
+		ForceSendFields: []string{"TargetSize"},
+	}
+	if m.BaseInstanceName == "" {
+		m.BaseInstanceName = c.Group
+	}
+	if c.Autohealing != nil {
+		m.AutoHealingPolicies = c.Autohealing.policies(c.Project)
+	}
+	if c.Stateful != nil {
+		m.StatefulPolicy = c.Stateful.policy()
+	}
+	if c.regional() {
+		m.DistributionPolicy = &compute.DistributionPolicy{TargetShape: c.TargetShape}
+		for _, z := range c.Zones {
+			m.DistributionPolicy.Zones = append(m.DistributionPolicy.Zones,
+				&compute.DistributionPolicyZoneConfiguration{Zone: mig.ZoneURL(c.Project, z)})
+		}
+	}
+	op, err := insertGroupManager(ctx, s, c, m)
+	if err != nil {
+		return err
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	log.Printf("Created group %v in %v from %v with target size %d.", c.Group, c.location(), *template, c.TargetSize)
+	if *timeout == 0 {
+		return nil
+	}
+	return waitForHealthy(ctx, s, c, c.TargetSize, *timeout)
+}
+
+// currentTemplate returns the newest template template create made for the
+// config, falling back to the config's template if there is none.
+func currentTemplate(c *policyConfig, statePath string) (string, error) {
+	st, err := loadState(statePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read state file: %v", err)
+	}
+	if name := st.Templates[templateKey(c)]; name != "" {
+		return name, nil
+	}
+	return c.Template, nil
+}
+
+// setAutohealingCmd applies the config's autohealing policy to an existing
+// group, or removes autohealing if the config has none.
+func setAutohealingCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig set-autohealing", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	patch := &compute.InstanceGroupManager{
+		// An empty list must still be sent to clear autohealing.
+		ForceSendFields:     []string{"AutoHealingPolicies"},
+		AutoHealingPolicies: []*compute.InstanceGroupManagerAutoHealingPolicy{},
+	}
+	if c.Autohealing != nil {
+		patch.AutoHealingPolicies = c.Autohealing.policies(c.Project)
+	}
+	op, err := patchGroupManager(ctx, s, c, patch)
+	if err != nil {
+		return fmt.Errorf("unable to set autohealing on %v: %v", c.Group, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	if c.Autohealing == nil {
+		log.Printf("Removed autohealing from %v.", c.Group)
+	} else {
+		log.Printf("Group %v now autoheals using %v after %ds.", c.Group, c.Autohealing.HealthCheck,
+			c.Autohealing.InitialDelaySec)
+	}
+	return nil
+}
+
+// deleteGroupCmd tears down the autoscaler and managed instance group
+// described by the policy config. A missing autoscaler is not an error, so
+// the command may be rerun after a partial failure.
+func deleteGroupCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig delete", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	return deleteGroup(ctx, s, c)
+}
+
+// deleteGroup deletes the config's autoscaler and then its group, waiting
+// for each. Either may already be gone.
+func deleteGroup(ctx context.Context, s *compute.Service, c *policyConfig) error {
+	// The autoscaler must go first; a group cannot be deleted while it is
+	// still being scaled.
+	op, err := deleteAutoscaler(ctx, s, c)
+	switch {
+	case mig.IsNotFound(err):
+		log.Printf("Autoscaler %v does not exist.", c.Autoscaler)
+	case err != nil:
+		return fmt.Errorf("unable to delete autoscaler %v: %v", c.Autoscaler, err)
+	default:
+		if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+			return err
+		}
+		log.Printf("Deleted autoscaler %v.", c.Autoscaler)
+	}
+	op, err = deleteGroupManager(ctx, s, c)
+	switch {
+	case mig.IsNotFound(err):
+		log.Printf("Group %v does not exist.", c.Group)
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to delete instance group manager %v: %v", c.Group, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	log.Printf("Deleted group %v.", c.Group)
+	return nil
+}
+
+// resizeGroupCmd sets the group's target size and blocks until the group is
+// stable with every instance healthy, so baseline runs start from a known
+// size.
+func resizeGroupCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig resize", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	size := fs.Int64("size", -1, "New target size of the group.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long to wait for the group to become stable and healthy.")
+	fs.Parse(args)
+	if *size < 0 {
+		return errors.New("-size is required")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if a, err := getAutoscaler(ctx, s, c); err == nil && autoscale.Mode(a) != "OFF" {
+		log.Printf("Warning: autoscaler %v is in mode %v and may override the new size; "+
+			"consider autoscaler pause first.", c.Autoscaler, autoscale.Mode(a))
+	}
+	op, err := resizeGroupManager(ctx, s, c, *size)
+	if err != nil {
+		return err
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	log.Printf("Resized %v to %d; waiting for it to become stable and healthy.", c.Group, *size)
+	return waitForHealthy(ctx, s, c, *size, *timeout)
+}
+
+// waitForHealthy polls the group until it is stable and has exactly size
+// running instances, each of which passes the autohealing health check if
+// the config has one, or else the load balancer's if the config names a
+// backend service. Progress is reported on every poll.
+func waitForHealthy(ctx context.Context, s *compute.Service, c *policyConfig, size int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := getGroupManager(ctx, s, c)
+		if err != nil {
+			return err
+		}
+		instances, err := listManagedInstances(ctx, s, c)
+		if err != nil {
+			return err
+		}
+		var running int64
+		for _, i := range instances {
+			if i.InstanceStatus == "RUNNING" && i.CurrentAction == "NONE" {
+				running++
+			}
+		}
+		healthy := running
+		switch {
+		case c.Autohealing != nil:
+			healthy = mig.CountAutohealingHealthy(instances)
+		case c.BackendService != "":
+			if healthy, err = countHealthy(ctx, s, c, m); err != nil {
+				return err
+			}
+		}
+		stable := m.Status != nil && m.Status.IsStable
+		progressf("%v: %d/%d running, %d/%d healthy, stable=%v.", c.Group, running, size, healthy,
+			size, stable)
+		if stable && int64(len(instances)) == size && running == size && healthy == size {
+			endProgress()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("group %v was not stable and healthy after %v", c.Group, timeout)
+		}
+		if err := sleep(ctx, mig.PollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// countHealthy returns how many instances of the group the config's backend
+// service considers healthy.
+func countHealthy(ctx context.Context, s *compute.Service, c *policyConfig, m *compute.InstanceGroupManager) (int64, error) {
+	health, err := s.BackendServices.GetHealth(c.Project, c.BackendService, &compute.ResourceGroupReference{
+		Group: m.InstanceGroup,
+	}).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get health of %v: %v", c.BackendService, err)
+	}
+	var n int64
+	for _, h := range health.HealthStatus {
+		if h.HealthState == "HEALTHY" {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"google.golang.org/api/compute/v1"
+)
+
+// Autoscaler modes which may be set without touching the rest of the policy.
+var autoscalerModes = map[string]bool{
+	"ON":             true,
+	"OFF":            true,
+	"ONLY_SCALE_OUT": true,
+}
+
+// pauseAutoscalerCmd switches an autoscaler to a mode which freezes the group
+// size (OFF, or ONLY_SCALE_OUT to still allow growth), remembering the mode
+// it was in so that resume can restore it.
+func pauseAutoscalerCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler pause", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	mode := fs.String("mode", "OFF", "Mode to pause in: OFF or ONLY_SCALE_OUT.")
+	fs.Parse(args)
+	if *mode != "OFF" && *mode != "ONLY_SCALE_OUT" {
+		return fmt.Errorf("cannot pause in mode %q", *mode)
+	}
+
+	c, st, s, err := modeCommandSetup(*configPath, *statePath)
+	if err != nil {
+		return err
+	}
+	a, err := getAutoscaler(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	previous := autoscale.Mode(a)
+	key := autoscalerKey(c)
+	if saved, ok := st.Autoscalers[key]; ok {
+		// Pausing twice must not overwrite the mode we want to return to.
+		previous = saved.PreviousMode
+	}
+	if err := setAutoscalerMode(ctx, s, c, *mode); err != nil {
+		return err
+	}
+	if st.Autoscalers == nil {
+		st.Autoscalers = make(map[string]*autoscalerState)
+	}
+	st.Autoscalers[key] = &autoscalerState{PreviousMode: previous}
+	if err := st.save(*statePath); err != nil {
+		return fmt.Errorf("paused %v but could not save its previous mode %v: %v", c.Autoscaler, previous, err)
+	}
+	log.Printf("Autoscaler %v paused in mode %v; resume will restore %v.", c.Autoscaler, *mode, previous)
+	return nil
+}
+
+// resumeAutoscalerCmd restores the mode an autoscaler was in before it was
+// paused.
+func resumeAutoscalerCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler resume", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	fs.Parse(args)
+
+	c, st, s, err := modeCommandSetup(*configPath, *statePath)
+	if err != nil {
+		return err
+	}
+	key := autoscalerKey(c)
+	saved, ok := st.Autoscalers[key]
+	if !ok {
+		return fmt.Errorf("autoscaler %v was not paused by this tool", c.Autoscaler)
+	}
+	if err := setAutoscalerMode(ctx, s, c, saved.PreviousMode); err != nil {
+		return err
+	}
+	delete(st.Autoscalers, key)
+	if err := st.save(*statePath); err != nil {
+		return err
+	}
+	log.Printf("Autoscaler %v resumed in mode %v.", c.Autoscaler, saved.PreviousMode)
+	return nil
+}
+
+// setModeCmd sets an autoscaler's mode directly, without recording the
+// previous one.
+func setModeCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler set-mode", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	mode := fs.String("mode", "", "Mode to set: ON, OFF or ONLY_SCALE_OUT.")
+	fs.Parse(args)
+	if !autoscalerModes[*mode] {
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if err := setAutoscalerMode(ctx, s, c, *mode); err != nil {
+		return err
+	}
+	log.Printf("Autoscaler %v is now in mode %v.", c.Autoscaler, *mode)
+	return nil
+}
+
+// modeCommandSetup loads everything the pause and resume commands need.
+func modeCommandSetup(configPath, statePath string) (*policyConfig, *state, *compute.Service, error) {
+	c, err := loadPolicyConfig(configPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	st, err := loadState(statePath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to read state file %v: %v", statePath, err)
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	return c, st, s, nil
+}
+
+// setAutoscalerMode patches only the mode of an autoscaler's policy, leaving
+// the rest of the policy as it is.
+func setAutoscalerMode(ctx context.Context, s *compute.Service, c *policyConfig, mode string) error {
+	if mode == "" {
+		return errors.New("no mode given")
+	}
+	patch := &compute.Autoscaler{
+		Name:              c.Autoscaler,
+		AutoscalingPolicy: &compute.AutoscalingPolicy{Mode: mode},
+	}
+	op, err := patchAutoscaler(ctx, s, c, patch)
+	if err != nil {
+		return fmt.Errorf("unable to set mode of %v to %v: %v", c.Autoscaler, mode, err)
+	}
+	return waitForOperation(ctx, s, c.Project, op)
+}
@@ -0,0 +1,271 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// Shell expression naming the interface of an instance's default route,
+// which the load balancer's traffic comes in on.
+const defaultInterface = "$(ip route show default | awk '{print $5; exit}')"
+
+// A netemSpec is the degradation tc netem applies to an interface's
+// outgoing traffic, which includes every response a backend serves.
+type netemSpec struct {
+	delay, jitter time.Duration
+	// loss is the percentage of packets dropped.
+	loss float64
+	// rate limits the bandwidth, in tc's notation, e.g. "10mbit".
+	rate string
+}
+
+// String describes the degradation, e.g. "100ms±10ms delay, 1% loss".
+func (n netemSpec) String() string {
+	var parts []string
+	if n.delay > 0 {
+		d := n.delay.String()
+		if n.jitter > 0 {
+			d += "±" + n.jitter.String()
+		}
+		parts = append(parts, d+" delay")
+	}
+	if n.loss > 0 {
+		parts = append(parts, fmt.Sprintf("%g%% loss", n.loss))
+	}
+	if n.rate != "" {
+		parts = append(parts, n.rate+" rate")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// applyCommand returns the shell command which degrades iface.
+func (n netemSpec) applyCommand(iface string) string {
+	cmd := "sudo tc qdisc replace dev " + iface + " root netem"
+	if n.delay > 0 {
+		cmd += fmt.Sprintf(" delay %dms", n.delay.Milliseconds())
+		if n.jitter > 0 {
+			cmd += fmt.Sprintf(" %dms", n.jitter.Milliseconds())
+		}
+	}
+	if n.loss > 0 {
+		cmd += fmt.Sprintf(" loss %g%%", n.loss)
+	}
+	if n.rate != "" {
+		cmd += " rate " + n.rate
+	}
+	return cmd
+}
+
+// clearCommand returns the shell command which removes the degradation of
+// iface. It succeeds if there is none.
+func clearCommand(iface string) string {
+	return "sudo tc qdisc del dev " + iface + " root 2>/dev/null || true"
+}
+
+// degradeNetworkCmd adds latency, packet loss or a bandwidth limit to
+// selected instances of the group with tc netem over SSH, for a window,
+// then removes it. The start and end of the window are appended to -out as
+// "network-degraded" and "network-restored" events, which report merge
+// takes like the watch's, and posted as Grafana annotations with
+// -grafana-url.
+func degradeNetworkCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig degrade-network", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	names := fs.String("instances", "", "Comma separated names of the instances to degrade; defaults to the first -count in name order.")
+	count := fs.Int("count", 1, "Number of instances to degrade without -instances.")
+	delay := fs.Duration("delay", 100*time.Millisecond, "Latency added to every packet.")
+	jitter := fs.Duration("jitter", 0, "Random variation of the added latency.")
+	loss := fs.Float64("loss", 0, "Percentage of packets dropped.")
+	rate := fs.String("rate", "", "Bandwidth limit in tc's notation, e.g. 10mbit; empty for none.")
+	duration := fs.Duration("duration", 5*time.Minute, "How long to keep the instances degraded; interrupting ends the window early.")
+	iface := fs.String("interface", defaultInterface, "Network interface to degrade on each instance; defaults to that of the default route.")
+	iap := fs.Bool("iap", false, "Connect through an IAP tunnel, for instances without external addresses.")
+	outPath := fs.String("out", "", "Append the window's events to this file, e.g. the watch's -out.")
+	grafanaURL := fs.String("grafana-url", "", "Also annotate the start and end of the window through this Grafana server's API.")
+	grafanaToken := fs.String("grafana-token", "", "Grafana service account token; defaults to $GRAFANA_TOKEN.")
+	grafanaDashboard := fs.String("grafana-dashboard", "", "UID of the Grafana dashboard to annotate; all dashboards if empty.")
+	fs.Parse(args)
+
+	n := netemSpec{delay: *delay, jitter: *jitter, loss: *loss, rate: *rate}
+	switch {
+	case n.String() == "":
+		return errors.New("give a -delay, -loss or -rate to degrade the network with")
+	case *loss < 0 || *loss > 100:
+		return errors.New("-loss must be a percentage")
+	case *duration <= 0:
+		return errors.New("-duration must be positive")
+	}
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	targets, err := selectInstances(ctx, s, c, *names, *count)
+	if err != nil {
+		return err
+	}
+	if *grafanaToken == "" {
+		*grafanaToken = os.Getenv("GRAFANA_TOKEN")
+	}
+	rec := &degradationRecorder{
+		c:        c,
+		annotate: &annotator{grafanaURL: *grafanaURL, grafanaToken: *grafanaToken, dashboardUID: *grafanaDashboard},
+		out:      ioutil.Discard,
+	}
+	if *outPath != "" {
+		f, err := os.OpenFile(*outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rec.out = f
+	}
+
+	log.Printf("Degrading %d instances with %v for %v.", len(targets), n, *duration)
+	end := otel.phase("degrade network", "degradation", n.String())
+	err = onInstances(ctx, c, targets, *iap, n.applyCommand(*iface))
+	end(err)
+	if err != nil {
+		// Some instances may have been degraded before the failure.
+		if cerr := onInstances(context.Background(), c, targets, *iap, clearCommand(*iface)); cerr != nil {
+			log.Printf("Unable to clear the degradation: %v", cerr)
+		}
+		return err
+	}
+	rec.record("network-degraded", targets, "network degraded: "+n.String())
+
+	<-stopChannel(*duration)
+	// Clear the degradation even if the window was interrupted.
+	if err := onInstances(context.Background(), c, targets, *iap, clearCommand(*iface)); err != nil {
+		return fmt.Errorf("unable to clear the degradation, run mig ssh -all -- %q: %v", clearCommand(*iface), err)
+	}
+	rec.record("network-restored", targets, "network restored")
+	log.Printf("Restored the network of %d instances.", len(targets))
+	return nil
+}
+
+// selectInstances returns the URLs of the named instances of the group, or
+// of the first count in name order if names is empty.
+func selectInstances(ctx context.Context, s *compute.Service, c *policyConfig, names string, count int) ([]string, error) {
+	instances, err := sortedInstances(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	if names == "" {
+		if count < 1 || count > len(instances) {
+			return nil, fmt.Errorf("-count must be between 1 and the group's %d instances", len(instances))
+		}
+		for _, i := range instances[:count] {
+			urls = append(urls, i.Instance)
+		}
+		return urls, nil
+	}
+	byName := map[string]string{}
+	for _, i := range instances {
+		byName[path.Base(i.Instance)] = i.Instance
+	}
+	for _, name := range strings.Split(names, ",") {
+		url, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("group %v has no instance %v", c.Group, name)
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+// onInstances runs a shell command over SSH on every instance, given by
+// URL, at once.
+func onInstances(ctx context.Context, c *policyConfig, instances []string, iap bool, command string) error {
+	pool := workerpool.New(ctx, workerpool.WithWorkers(len(instances)))
+	for _, url := range instances {
+		name, zone := path.Base(url), instanceZone(url)
+		err := pool.Submit(name, func(ctx context.Context) error {
+			out, err := exec.CommandContext(ctx, "gcloud", sshArgs(c, zone, name, iap, command)...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%v: %v: %s", name, err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		var msgs []string
+		for _, f := range failures {
+			msgs = append(msgs, f.Err.Error())
+		}
+		return fmt.Errorf("command failed on %d of %d instances: %v", len(failures), len(instances), strings.Join(msgs, "; "))
+	}
+	return err
+}
+
+// A degradationRecorder records the start and end of a degradation window
+// as events and annotations.
+type degradationRecorder struct {
+	c        *policyConfig
+	annotate *annotator
+	out      io.Writer
+}
+
+// record writes one event per instance and one annotation for the window's
+// edge. Failures are logged, as the window goes on regardless.
+func (r *degradationRecorder) record(typ string, instances []string, message string) {
+	now := time.Now().UTC()
+	for _, url := range instances {
+		e := &report.WatchEvent{Time: now, Type: typ, Autoscaler: r.c.Autoscaler, Group: r.c.Group,
+			Instance: path.Base(url), Message: message}
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		fmt.Fprintf(r.out, "%s\n", b)
+	}
+	if r.annotate.grafanaURL == "" {
+		return
+	}
+	var names []string
+	for _, url := range instances {
+		names = append(names, path.Base(url))
+	}
+	text := fmt.Sprintf("%v %v on %v", r.c.Group, message, strings.Join(names, ", "))
+	if err := r.annotate.postGrafana(now, []string{"network", typ, r.c.Group}, text); err != nil {
+		log.Printf("Unable to annotate %v: %v", typ, err)
+	}
+}
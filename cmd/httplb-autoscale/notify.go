@@ -0,0 +1,284 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// The events notifications are sent for.
+const (
+	notifyCompleted   = "completed"
+	notifySLOViolated = "slo-violated"
+	notifyAborted     = "aborted"
+)
+
+// A notificationsConfig says where to announce the end of long runs, and
+// their SLO violations, so that nobody has to watch a soak test finish at
+// 3am:
+//
+//	notifications:
+//	  webhooks: [https://example.com/hooks/load-tests]
+//	  slack: [https://hooks.slack.com/services/T000/B000/XXXX]
+//	  pubsubTopics: [projects/my-project/topics/load-tests]
+//	  events: [completed, aborted]
+//	  slo:
+//	    maxErrorRate: 0.01
+//	    maxP95Ms: 500
+//
+// autoscaler soak and demo run send those of their config, and autoscaler
+// experiment those of the experiment config, with the run's summary
+// attached.
+type notificationsConfig struct {
+	// Webhooks receive each notification as a JSON POST.
+	Webhooks []string `yaml:"webhooks"`
+	// Slack lists incoming webhook URLs of Slack, or of anything accepting
+	// its payload.
+	Slack []string `yaml:"slack"`
+	// PubSubTopics receive each notification as a message whose data is
+	// the JSON and whose attributes are the event and the run ID.
+	PubSubTopics []string `yaml:"pubsubTopics"`
+	// Events restricts the notifications to some of completed, slo-violated
+	// and aborted; empty sends all of them.
+	Events []string `yaml:"events"`
+	// SLO, if set, is checked against each rolled-up report of a soak test,
+	// and against the result of each trial.
+	SLO *notifySLO `yaml:"slo"`
+}
+
+// A notifySLO is the service level a run's reports must keep to.
+type notifySLO struct {
+	// MaxErrorRate is the largest fraction of failed requests; zero does
+	// not check it.
+	MaxErrorRate float64 `yaml:"maxErrorRate"`
+	// MaxP95Ms is the largest p95 latency; zero does not check it.
+	MaxP95Ms float64 `yaml:"maxP95Ms"`
+}
+
+// violation returns how a report's error rate and p95 break the SLO, or ""
+// if they do not.
+func (o *notifySLO) violation(errorRate, p95Ms float64) string {
+	var broken []string
+	if o.MaxErrorRate > 0 && errorRate > o.MaxErrorRate {
+		broken = append(broken, fmt.Sprintf("error rate %.2f%% is over %.2f%%", 100*errorRate, 100*o.MaxErrorRate))
+	}
+	if o.MaxP95Ms > 0 && p95Ms > o.MaxP95Ms {
+		broken = append(broken, fmt.Sprintf("p95 %.0fms is over %.0fms", p95Ms, o.MaxP95Ms))
+	}
+	return strings.Join(broken, ", ")
+}
+
+// check verifies the notifications can be sent.
+func (n *notificationsConfig) check() error {
+	for _, e := range n.Events {
+		if e != notifyCompleted && e != notifySLOViolated && e != notifyAborted {
+			return fmt.Errorf("events must be %v, %v or %v, not %q", notifyCompleted, notifySLOViolated, notifyAborted, e)
+		}
+	}
+	for _, t := range n.PubSubTopics {
+		if parts := strings.Split(t, "/"); len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" {
+			return fmt.Errorf("pubsub topic %q is not projects/PROJECT/topics/TOPIC", t)
+		}
+	}
+	if o := n.SLO; o != nil && (o.MaxErrorRate < 0 || o.MaxErrorRate > 1 || o.MaxP95Ms < 0) {
+		return errors.New("slo needs a maxErrorRate between 0 and 1 and a positive maxP95Ms")
+	}
+	return nil
+}
+
+// A notification announces an event of a run.
+type notification struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Config  string    `json:"config"`
+	RunID   string    `json:"runId,omitempty"`
+	Message string    `json:"message"`
+	// Summary is the run's summary, or that of the report which broke the
+	// SLO.
+	Summary interface{} `json:"summary,omitempty"`
+}
+
+// A notifier sends a command's notifications. A nil notifier sends none.
+type notifier struct {
+	n       *notificationsConfig
+	command string
+	config  string
+	runID   string
+	// violated is set while the SLO is broken, so that a violation is sent
+	// once rather than with every report.
+	violated bool
+}
+
+// newNotifier returns the notifier of a command's run, or nil if n is nil.
+func newNotifier(n *notificationsConfig, command, configPath, runID string) *notifier {
+	if n == nil {
+		return nil
+	}
+	return &notifier{n: n, command: command, config: configPath, runID: runID}
+}
+
+// wants reports whether the event is to be sent.
+func (nt *notifier) wants(event string) bool {
+	if len(nt.n.Events) == 0 {
+		return true
+	}
+	for _, e := range nt.n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers a notification everywhere the config says. Failures are
+// logged, as they must not fail the run they announce.
+func (nt *notifier) send(ctx context.Context, event, msg string, summary interface{}) {
+	if nt == nil || !nt.wants(event) {
+		return
+	}
+	n := &notification{Event: event, Time: time.Now().UTC(), Command: nt.command, Config: nt.config,
+		RunID: nt.runID, Message: msg, Summary: summary}
+	b, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Unable to encode the %v notification: %v", event, err)
+		return
+	}
+	for _, url := range nt.n.Webhooks {
+		if err := postJSON(ctx, url, b); err != nil {
+			log.Printf("Unable to notify webhook: %v", err)
+		}
+	}
+	if len(nt.n.Slack) > 0 {
+		sb, err := json.Marshal(slackPayload(n))
+		if err != nil {
+			log.Printf("Unable to encode the %v notification: %v", event, err)
+			return
+		}
+		for _, url := range nt.n.Slack {
+			if err := postJSON(ctx, url, sb); err != nil {
+				log.Printf("Unable to notify Slack: %v", err)
+			}
+		}
+	}
+	if len(nt.n.PubSubTopics) > 0 {
+		if err := publish(ctx, nt.n.PubSubTopics, n, b); err != nil {
+			log.Printf("Unable to notify Pub/Sub: %v", err)
+		}
+	}
+	debugf(1, "Sent the %v notification.", event)
+}
+
+// observeSLO sends an slo-violated notification when a report of a run
+// first breaks the SLO, and rearms once a report keeps to it again.
+func (nt *notifier) observeSLO(ctx context.Context, errorRate, p95Ms float64, report interface{}) {
+	if nt == nil || nt.n.SLO == nil {
+		return
+	}
+	if nt.n.SLO.violation(errorRate, p95Ms) == "" {
+		nt.violated = false
+		return
+	}
+	if !nt.violated {
+		nt.violated = nt.checkSLO(ctx, errorRate, p95Ms, report)
+	}
+}
+
+// checkSLO sends an slo-violated notification if a result breaks the SLO,
+// and reports whether it does.
+func (nt *notifier) checkSLO(ctx context.Context, errorRate, p95Ms float64, result interface{}) bool {
+	if nt == nil || nt.n.SLO == nil {
+		return false
+	}
+	v := nt.n.SLO.violation(errorRate, p95Ms)
+	if v == "" {
+		return false
+	}
+	nt.send(ctx, notifySLOViolated, "SLO violated: "+v, result)
+	return true
+}
+
+// Colors of the Slack attachments of each event.
+var slackColors = map[string]string{notifyCompleted: "good", notifySLOViolated: "warning", notifyAborted: "danger"}
+
+// slackPayload returns a notification as an incoming webhook message of
+// Slack: the message as text, and the summary as an attached code block.
+func slackPayload(n *notification) map[string]interface{} {
+	text := fmt.Sprintf("*%v %v*: %v", n.Command, n.Event, n.Message)
+	if n.RunID != "" {
+		text += fmt.Sprintf(" (run %v)", n.RunID)
+	}
+	p := map[string]interface{}{"text": text}
+	if n.Summary != nil {
+		b, err := json.MarshalIndent(n.Summary, "", "  ")
+		if err == nil {
+			p["attachments"] = []map[string]interface{}{{
+				"color":     slackColors[n.Event],
+				"text":      "```" + string(b) + "```",
+				"mrkdwn_in": []string{"text"},
+			}}
+		}
+	}
+	return p
+}
+
+// postJSON POSTs a JSON body to a URL.
+func postJSON(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%v returned %v", url, resp.Status)
+	}
+	return nil
+}
+
+// publish sends a notification, encoded as b, to Pub/Sub topics.
+func publish(ctx context.Context, topics []string, n *notification, b []byte) error {
+	s, err := newPubSubService()
+	if err != nil {
+		return err
+	}
+	msg := &pubsub.PubsubMessage{
+		Data:       base64.StdEncoding.EncodeToString(b),
+		Attributes: map[string]string{"event": n.Event, "runId": n.RunID},
+	}
+	for _, t := range topics {
+		_, err := s.Projects.Topics.Publish(t, &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{msg}}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to publish to %v: %v", t, err)
+		}
+	}
+	return nil
+}
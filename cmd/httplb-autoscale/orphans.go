@@ -0,0 +1,265 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// orphanDeleteOrder lists the kinds of managed resources in the order they
+// can be deleted, dependents first. Instances come after their groups, which
+// delete most of them.
+var orphanDeleteOrder = []string{
+	"forwardingRule",
+	"address",
+	"targetHttpProxy",
+	"targetHttpsProxy",
+	"urlMap",
+	"backendService",
+	"healthCheck",
+	"firewall",
+	"autoscaler",
+	"instanceGroupManager",
+	"instance",
+	"instanceTemplate",
+}
+
+// An orphanResult is one resource cleanup orphans found.
+type orphanResult struct {
+	resourceResult
+	Created string `json:"created,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// knownRuns returns the run IDs recorded in the state files.
+func knownRuns(statePaths []string) (map[string]bool, error) {
+	runs := map[string]bool{}
+	for _, p := range statePaths {
+		if _, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("unable to read state file %v: %v", p, err)
+		}
+		st, err := loadState(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read state file %v: %v", p, err)
+		}
+		for _, id := range st.RunIDs {
+			runs[id] = true
+		}
+		for id := range st.RunProjects {
+			runs[id] = true
+		}
+	}
+	return runs, nil
+}
+
+// orphanReason returns why a managed resource is an orphan, or "" if it is
+// not: its run is in no state file, or it is older than ttl, if positive.
+func orphanReason(r managedResource, runs map[string]bool, ttl time.Duration, now time.Time) string {
+	switch {
+	case r.runID == "":
+		return "no run ID"
+	case !runs[r.runID]:
+		return "run in no state file"
+	case ttl > 0 && !r.created.IsZero() && now.Sub(r.created) > ttl:
+		return fmt.Sprintf("older than %v", ttl)
+	}
+	return ""
+}
+
+// deleteManagedResource deletes one resource found by listManagedResources
+// and waits for the deletion. A resource which is already gone, such as an
+// instance deleted with its group, is not an error.
+func deleteManagedResource(ctx context.Context, s *compute.Service, project string, r managedResource) error {
+	loc := mig.Location{Project: project, Zone: r.location}
+	if r.regional {
+		loc = mig.Location{Project: project, Region: r.location}
+	}
+	var op *compute.Operation
+	var err error
+	switch r.kind {
+	case "forwardingRule":
+		op, err = s.GlobalForwardingRules.Delete(project, r.name).Context(ctx).Do()
+	case "address":
+		op, err = s.GlobalAddresses.Delete(project, r.name).Context(ctx).Do()
+	case "targetHttpProxy":
+		op, err = s.TargetHttpProxies.Delete(project, r.name).Context(ctx).Do()
+	case "targetHttpsProxy":
+		op, err = s.TargetHttpsProxies.Delete(project, r.name).Context(ctx).Do()
+	case "urlMap":
+		op, err = s.UrlMaps.Delete(project, r.name).Context(ctx).Do()
+	case "backendService":
+		op, err = s.BackendServices.Delete(project, r.name).Context(ctx).Do()
+	case "healthCheck":
+		op, err = s.HealthChecks.Delete(project, r.name).Context(ctx).Do()
+	case "firewall":
+		op, err = s.Firewalls.Delete(project, r.name).Context(ctx).Do()
+	case "autoscaler":
+		op, err = (&autoscale.Autoscaler{Location: loc, Name: r.name}).Delete(ctx, s)
+	case "instanceGroupManager":
+		op, err = (&mig.Group{Location: loc, Name: r.name}).Delete(ctx, s)
+	case "instance":
+		op, err = s.Instances.Delete(project, r.location, r.name).Context(ctx).Do()
+	case "instanceTemplate":
+		op, err = s.InstanceTemplates.Delete(project, r.name).Context(ctx).Do()
+	default:
+		return fmt.Errorf("unable to delete %v %v: unknown kind", r.kind, r.name)
+	}
+	switch {
+	case mig.IsNotFound(err):
+		log.Printf("%v %v is already gone.", r.kind, r.name)
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to delete %v %v: %v", r.kind, r.name, err)
+	}
+	if err := waitForOperation(ctx, s, project, op); err != nil {
+		return err
+	}
+	log.Printf("Deleted %v %v in %v.", r.kind, r.name, r.location)
+	return nil
+}
+
+// deleteManagedResources deletes resources found by listManagedResources
+// in orphanDeleteOrder, those of each kind at once.
+func deleteManagedResources(ctx context.Context, s *compute.Service, project string, resources []managedResource) error {
+	for _, kind := range orphanDeleteOrder {
+		pool := workerpool.New(ctx)
+		for _, r := range resources {
+			if r.kind != kind {
+				continue
+			}
+			r := r
+			err := pool.Submit(r.kind+" "+r.name, func(ctx context.Context) error {
+				return deleteManagedResource(ctx, s, project, r)
+			})
+			if err != nil {
+				break
+			}
+		}
+		failures, err := pool.Wait()
+		if len(failures) > 0 {
+			return failures[0].Err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupOrphansCmd finds the resources carrying these commands' labels
+// whose run is recorded in none of the given state files, or which are older
+// than -ttl, lists them and, once confirmed, deletes them in dependency
+// order. Failed runs leave such resources behind.
+func cleanupOrphansCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cleanup orphans", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config, for its project.")
+	statePaths := fs.String("state", defaultStatePath, "Comma separated state files whose runs are kept.")
+	ttl := fs.Duration("ttl", 0, "Also delete resources of known runs older than this; 0 keeps them regardless of age.")
+	yes := fs.Bool("yes", false, "Delete without asking for confirmation.")
+	dryRun := fs.Bool("dry-run", false, "Only list the orphans.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	runs, err := knownRuns(strings.Split(*statePaths, ","))
+	if err != nil {
+		return err
+	}
+	if c.RunID != "" {
+		runs[c.RunID] = true
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	found, err := listManagedResources(ctx, s, c.Project, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var orphans []managedResource
+	rows := []orphanResult{}
+	for _, r := range found {
+		reason := orphanReason(r, runs, *ttl, now)
+		if reason == "" {
+			continue
+		}
+		orphans = append(orphans, r)
+		row := orphanResult{resourceResult: resourceResult{r.kind, r.name, r.location, r.runID}, Reason: reason}
+		if !r.created.IsZero() {
+			row.Created = r.created.UTC().Format(time.RFC3339)
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Kind != rows[j].Kind {
+			return rows[i].Kind < rows[j].Kind
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	err = printResult(rows, func(out io.Writer) error {
+		w := newTable(out)
+		fmt.Fprintln(w, "KIND\tNAME\tLOCATION\tRUN-ID\tCREATED\tREASON")
+		for _, r := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Kind, r.Name, r.Location, r.RunID, r.Created, r.Reason)
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		log.Printf("No orphaned resources in %v.", c.Project)
+		return nil
+	}
+	if *dryRun {
+		return nil
+	}
+	if !*yes {
+		p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+		a, err := p.askValid(fmt.Sprintf("Delete these %d resources? (y/n)", len(orphans)), "n", func(a string) error {
+			_, err := yesNo(a)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if ok, _ := yesNo(a); !ok {
+			log.Printf("Nothing deleted.")
+			return nil
+		}
+	}
+	if err := deleteManagedResources(ctx, s, c.Project, orphans); err != nil {
+		return err
+	}
+	log.Printf("Deleted %d orphaned resources.", len(orphans))
+	return nil
+}
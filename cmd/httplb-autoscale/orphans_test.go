@@ -0,0 +1,146 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/lb"
+	"google.golang.org/api/compute/v1"
+)
+
+// fakeCompute is a Compute Engine server holding global resources by
+// collection and name, which refuses to delete a resource another one
+// still refers to.
+type fakeCompute struct {
+	mu sync.Mutex
+	// descriptions holds the description of each resource, keyed by
+	// collection and name, such as "urlMaps/bs-map".
+	descriptions map[string]string
+	// refs lists the resources each resource refers to.
+	refs map[string][]string
+}
+
+// newFakeCompute starts a fakeCompute and returns a client of it.
+func newFakeCompute(t *testing.T) (*fakeCompute, *compute.Service) {
+	t.Helper()
+	f := &fakeCompute{descriptions: map[string]string{}, refs: map[string][]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s, err := compute.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.BasePath = srv.URL + "/"
+	return f, s
+}
+
+// add creates the resource key, of the given description, referring to
+// refs.
+func (f *fakeCompute) add(key, description string, refs ...string) {
+	f.descriptions[key] = description
+	f.refs[key] = refs
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/projects/p/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "aggregated":
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": map[string]interface{}{}})
+	case len(parts) == 2 && parts[0] == "global" && r.Method == http.MethodGet:
+		items := []map[string]string{}
+		for key, d := range f.descriptions {
+			if collection, name, _ := strings.Cut(key, "/"); collection == parts[1] {
+				items = append(items, map[string]string{"name": name, "description": d})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	case len(parts) == 3 && parts[0] == "global" && r.Method == http.MethodDelete:
+		key := parts[1] + "/" + parts[2]
+		if _, ok := f.descriptions[key]; !ok {
+			http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+			return
+		}
+		for other, refs := range f.refs {
+			for _, ref := range refs {
+				if ref == key {
+					http.Error(w, `{"error":{"code":400,"message":"`+key+` is in use by `+other+`"}}`, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		delete(f.descriptions, key)
+		delete(f.refs, key)
+		json.NewEncoder(w).Encode(&compute.Operation{Name: "delete-" + parts[2], Status: "DONE"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// remaining returns the resources left, sorted.
+func (f *fakeCompute) remaining() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.descriptions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeleteManagedResourcesOfHTTPSRun(t *testing.T) {
+	f, s := newFakeCompute(t)
+	// The load balancer of a run serving HTTPS and redirecting HTTP to it.
+	n := lb.Names("bs")
+	d := resourceDescription("Load balancer of the file servers.", "r1")
+	f.add("forwardingRules/"+n.ForwardingRule, d, "targetHttpProxies/"+n.RedirectProxy, "addresses/"+n.Address)
+	f.add("forwardingRules/"+n.HTTPSForwardingRule, d, "targetHttpsProxies/"+n.HTTPSProxy, "addresses/"+n.Address)
+	f.add("addresses/"+n.Address, d)
+	f.add("targetHttpProxies/"+n.RedirectProxy, d, "urlMaps/"+n.RedirectURLMap)
+	f.add("targetHttpsProxies/"+n.HTTPSProxy, d, "urlMaps/"+n.URLMap)
+	f.add("urlMaps/"+n.RedirectURLMap, d)
+	f.add("urlMaps/"+n.URLMap, d, "backendServices/"+n.BackendService)
+	f.add("backendServices/"+n.BackendService, d, "healthChecks/"+n.HealthCheck)
+	f.add("healthChecks/"+n.HealthCheck, d)
+	f.add("firewalls/"+n.Firewall, d)
+	// Another run's, and one which is not ours.
+	f.add("urlMaps/other-map", resourceDescription("Load balancer of the file servers.", "r2"))
+	f.add("addresses/mine", "Reserved by hand.")
+
+	ctx := context.Background()
+	resources, err := listManagedResources(ctx, s, "p", "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 10 {
+		t.Fatalf("listed %d resources of run r1, want its 10", len(resources))
+	}
+	if err := deleteManagedResources(ctx, s, "p", resources); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(f.remaining(), ","), "addresses/mine,urlMaps/other-map"; got != want {
+		t.Errorf("after the deletion %v remain, want %v", got, want)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+var otlpEndpoint = flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+	"Export traces and metrics of the tool's own API calls and phases to this OTLP/HTTP collector, e.g. http://localhost:4318.")
+
+// Name under which the tool reports itself to the collector.
+const otelServiceName = "httplb-autoscaling"
+
+// Spans are exported in batches of this many, and at exit.
+const otelBatchSize = 512
+
+// Upper bounds of the buckets of the API call duration histogram, in
+// milliseconds.
+var otelDurationBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// An otelSpan is one timed operation: a command, an orchestration phase or
+// an API call.
+type otelSpan struct {
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// An apiCallStats aggregates the API calls with the same attributes.
+type apiCallStats struct {
+	attrs   map[string]string
+	count   int64
+	sum     float64
+	buckets []int64
+}
+
+// An otelExporter collects the tool's spans and metrics and sends them to
+// an OTLP/HTTP collector as JSON. It needs only the standard library; the
+// protocol is documented at https://opentelemetry.io/docs/specs/otlp/.
+type otelExporter struct {
+	mu      sync.Mutex
+	traceID string
+	// phases is the stack of phases in progress; API calls are children of
+	// the innermost.
+	phases []*otelSpan
+	spans  []*otelSpan
+	calls  map[string]*apiCallStats
+	start  time.Time
+}
+
+// otel is the exporter of this invocation. It is inert unless
+// -otlp-endpoint is set.
+var otel = &otelExporter{calls: map[string]*apiCallStats{}, start: time.Now()}
+
+// enabled reports whether telemetry is exported.
+func (x *otelExporter) enabled() bool {
+	return *otlpEndpoint != ""
+}
+
+// randomID returns n random bytes in hex.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// phase starts a span for an orchestration phase and returns the function
+// ending it. Phases nest.
+func (x *otelExporter) phase(name string, attrs ...string) func(err error) {
+	if !x.enabled() {
+		return func(error) {}
+	}
+	x.mu.Lock()
+	if x.traceID == "" {
+		x.traceID = randomID(16)
+	}
+	s := &otelSpan{name: name, traceID: x.traceID, spanID: randomID(8), start: time.Now(), attrs: map[string]string{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	if n := len(x.phases); n > 0 {
+		s.parentID = x.phases[n-1].spanID
+	}
+	x.phases = append(x.phases, s)
+	x.mu.Unlock()
+	return func(err error) {
+		x.mu.Lock()
+		s.end, s.err = time.Now(), err
+		for i := len(x.phases) - 1; i >= 0; i-- {
+			if x.phases[i] == s {
+				x.phases = append(x.phases[:i], x.phases[i+1:]...)
+				break
+			}
+		}
+		x.mu.Unlock()
+		x.add(s)
+	}
+}
+
+// apiCall records a finished API call as a span and in the call metrics.
+func (x *otelExporter) apiCall(req *http.Request, start time.Time, status int, err error) {
+	service := strings.TrimSuffix(req.URL.Host, ".googleapis.com")
+	method := req.Method + " " + apiMethod(req.URL.Path)
+	x.mu.Lock()
+	if x.traceID == "" {
+		x.traceID = randomID(16)
+	}
+	s := &otelSpan{
+		name:    service + " " + method,
+		traceID: x.traceID,
+		spanID:  randomID(8),
+		start:   start,
+		end:     time.Now(),
+		err:     err,
+		attrs: map[string]string{
+			"rpc.service":      service,
+			"http.method":      req.Method,
+			"url.path":         req.URL.Path,
+			"http.status_code": strconv.Itoa(status),
+		},
+	}
+	if n := len(x.phases); n > 0 {
+		s.parentID = x.phases[n-1].spanID
+	}
+	key := fmt.Sprintf("%s|%s|%d", service, method, status)
+	st, ok := x.calls[key]
+	if !ok {
+		st = &apiCallStats{
+			attrs:   map[string]string{"rpc.service": service, "rpc.method": method, "http.status_code": strconv.Itoa(status)},
+			buckets: make([]int64, len(otelDurationBounds)+1),
+		}
+		x.calls[key] = st
+	}
+	ms := report.Millis(s.end.Sub(start))
+	st.count++
+	st.sum += ms
+	st.buckets[sort.SearchFloat64s(otelDurationBounds, ms)]++
+	x.mu.Unlock()
+	x.add(s)
+}
+
+// apiMethod names the API method of a request path without the names of
+// the resources, which would make every call distinct: e.g.
+// ".../projects/p/zones/z/instanceGroupManagers/g/resize" is
+// instanceGroupManagers.resize and ".../global/instanceTemplates/t" is
+// instanceTemplates.
+func apiMethod(p string) string {
+	elems := strings.Split(strings.Trim(p, "/"), "/")
+	i := 0
+	for i < len(elems) && elems[i] != "projects" {
+		i++
+	}
+	if i+2 > len(elems) {
+		return path.Base(p)
+	}
+	elems = elems[i+2:]
+	switch {
+	case len(elems) >= 2 && (elems[0] == "zones" || elems[0] == "regions"):
+		elems = elems[2:]
+	case len(elems) >= 1 && elems[0] == "global":
+		elems = elems[1:]
+	}
+	switch {
+	case len(elems) == 0:
+		return path.Base(p)
+	case len(elems)%2 == 1 && len(elems) >= 3:
+		return elems[len(elems)-3] + "." + elems[len(elems)-1]
+	case len(elems)%2 == 1:
+		return elems[len(elems)-1]
+	}
+	return elems[len(elems)-2]
+}
+
+// add queues a finished span, exporting the queue once it is full.
+func (x *otelExporter) add(s *otelSpan) {
+	x.mu.Lock()
+	x.spans = append(x.spans, s)
+	var batch []*otelSpan
+	if len(x.spans) >= otelBatchSize {
+		batch, x.spans = x.spans, nil
+	}
+	x.mu.Unlock()
+	if batch != nil {
+		if err := x.exportSpans(batch); err != nil {
+			log.Printf("Unable to export %d spans: %v", len(batch), err)
+		}
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key values, in key order.
+func otlpAttributes(attrs map[string]string) []interface{} {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, map[string]interface{}{"key": k, "value": map[string]string{"stringValue": attrs[k]}})
+	}
+	return kvs
+}
+
+// otlpResource describes the tool to the collector.
+func otlpResource() map[string]interface{} {
+	return map[string]interface{}{"attributes": otlpAttributes(map[string]string{"service.name": otelServiceName})}
+}
+
+// unixNano formats a time as OTLP expects.
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// exportSpans sends spans to the collector.
+func (x *otelExporter) exportSpans(spans []*otelSpan) error {
+	out := make([]interface{}, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              1,
+			"startTimeUnixNano": unixNano(s.start),
+			"endTimeUnixNano":   unixNano(s.end),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != "" {
+			span["parentSpanId"] = s.parentID
+		}
+		if s.err != nil {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		out = append(out, span)
+	}
+	return x.post("/v1/traces", map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   otlpResource(),
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": otelServiceName}, "spans": out}},
+		}},
+	})
+}
+
+// exportMetrics sends the cumulative API call count and duration metrics
+// to the collector.
+func (x *otelExporter) exportMetrics() error {
+	x.mu.Lock()
+	now := time.Now()
+	var counts, histograms []interface{}
+	for _, st := range x.calls {
+		base := map[string]interface{}{
+			"attributes":        otlpAttributes(st.attrs),
+			"startTimeUnixNano": unixNano(x.start),
+			"timeUnixNano":      unixNano(now),
+		}
+		count := map[string]interface{}{"asInt": strconv.FormatInt(st.count, 10)}
+		hist := map[string]interface{}{
+			"count":          strconv.FormatInt(st.count, 10),
+			"sum":            st.sum,
+			"explicitBounds": otelDurationBounds,
+		}
+		buckets := make([]string, len(st.buckets))
+		for i, n := range st.buckets {
+			buckets[i] = strconv.FormatInt(n, 10)
+		}
+		hist["bucketCounts"] = buckets
+		for k, v := range base {
+			count[k], hist[k] = v, v
+		}
+		counts = append(counts, count)
+		histograms = append(histograms, hist)
+	}
+	x.mu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+	return x.post("/v1/metrics", map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": otlpResource(),
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": otelServiceName},
+				"metrics": []interface{}{
+					map[string]interface{}{"name": "httplb.api.calls", "unit": "{call}",
+						"sum": map[string]interface{}{"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": counts}},
+					map[string]interface{}{"name": "httplb.api.duration", "unit": "ms",
+						"histogram": map[string]interface{}{"aggregationTemporality": 2, "dataPoints": histograms}},
+				},
+			}},
+		}},
+	})
+}
+
+// post sends an OTLP/HTTP JSON request to the collector.
+func (x *otelExporter) post(signal string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(strings.TrimSuffix(*otlpEndpoint, "/")+signal, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %v", resp.Status)
+	}
+	return nil
+}
+
+// shutdown exports everything still queued. It is called once the command
+// has finished.
+func (x *otelExporter) shutdown() {
+	if !x.enabled() {
+		return
+	}
+	x.mu.Lock()
+	batch := x.spans
+	x.spans = nil
+	x.mu.Unlock()
+	if len(batch) > 0 {
+		if err := x.exportSpans(batch); err != nil {
+			log.Printf("Unable to export %d spans: %v", len(batch), err)
+		}
+	}
+	if err := x.exportMetrics(); err != nil {
+		log.Printf("Unable to export metrics: %v", err)
+	}
+}
+
+// A tracedTransport records every request as an API call span.
+type tracedTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	otel.apiCall(req, start, status, err)
+	return resp, err
+}
+
+// traced makes a client record its calls when telemetry is exported.
+func traced(client *http.Client) *http.Client {
+	if !otel.enabled() {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &tracedTransport{base: base}
+	return client
+}
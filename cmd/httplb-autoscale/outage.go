@@ -0,0 +1,313 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// The ways zone-outage takes a zone out.
+const (
+	// outageStop stops every instance of the group in the zone.
+	outageStop = "stop"
+	// outageAbandon takes the zone's instances out of the group, and so out
+	// of the load balancer, and deletes them once the outage is over.
+	outageAbandon = "abandon"
+	// outageRemoveZone drops the zone from the group's distribution policy,
+	// so that the group moves its instances to the other zones.
+	outageRemoveZone = "remove-zone"
+)
+
+// A zoneOutageSample is the capacity of the group at one poll.
+type zoneOutageSample struct {
+	Time time.Time `json:"time"`
+	// Healthy counts the instances the backend service finds healthy
+	// outside the zone, and InZone those inside it.
+	Healthy int64 `json:"healthy"`
+	InZone  int64 `json:"inZone"`
+}
+
+// A zoneOutageResult describes how the group recovered from the outage.
+type zoneOutageResult struct {
+	Group  string `json:"group"`
+	Zone   string `json:"zone"`
+	Method string `json:"method"`
+	// Instances counts the instances taken out.
+	Instances int `json:"instances"`
+	// HealthyBefore is the capacity the group had before the outage,
+	// which the other zones must reach for it to count as restored.
+	HealthyBefore int64 `json:"healthyBefore"`
+	// MinHealthy is the lowest capacity during the outage.
+	MinHealthy int64 `json:"minHealthy"`
+	Restored   bool  `json:"restored"`
+	// RestoreSeconds is the time from the outage to full capacity in the
+	// other zones, or to giving up if it never got there.
+	RestoreSeconds float64            `json:"restoreSeconds"`
+	Samples        []zoneOutageSample `json:"samples"`
+}
+
+// zoneOutageCmd takes one zone of a regional group out while the load
+// balancer keeps serving, and measures how long the group takes to bring
+// the healthy capacity of its other zones back to what the group had
+// before. It then undoes the outage unless -restore=false.
+func zoneOutageCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig zone-outage", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	zone := fs.String("zone", "", "Zone of the group to take out.")
+	method := fs.String("method", outageStop, "How to take the zone out: stop its instances, abandon them from the group, or remove-zone from the group's distribution policy.")
+	timeout := fs.Duration("timeout", 30*time.Minute, "How long to wait for full capacity in the other zones.")
+	restore := fs.Bool("restore", true, "Undo the outage once measured: start the stopped instances, delete the abandoned ones or add the zone back.")
+	backend := fs.String("backend", "", "Take the zone out of this group from the config's backends instead of the top level one.")
+	fs.Parse(args)
+
+	switch {
+	case *zone == "":
+		return errors.New("-zone is required")
+	case *method != outageStop && *method != outageAbandon && *method != outageRemoveZone:
+		return fmt.Errorf("-method must be %v, %v or %v", outageStop, outageAbandon, outageRemoveZone)
+	}
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c, err = c.forBackend(*backend); err != nil {
+		return err
+	}
+	switch {
+	case !c.regional():
+		return fmt.Errorf("group %v is zonal; a zone outage needs a regional group", c.Group)
+	case c.BackendService == "":
+		return errors.New("config does not name a backend service to measure capacity with")
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	instances, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	var victims []string
+	for _, i := range instances {
+		if instanceZone(i.Instance) == *zone {
+			victims = append(victims, i.Instance)
+		}
+	}
+	if len(victims) == 0 && *method != outageRemoveZone {
+		return fmt.Errorf("group %v has no instances in %v", c.Group, *zone)
+	}
+	elsewhere, inZone, err := zoneHealth(ctx, s, c, m, *zone)
+	if err != nil {
+		return err
+	}
+	res := &zoneOutageResult{Group: c.Group, Zone: *zone, Method: *method, Instances: len(victims),
+		HealthyBefore: elsewhere + inZone, MinHealthy: elsewhere + inZone}
+
+	log.Printf("Taking %v out of %v (%v, %d instances); %d instances are healthy.", *zone, c.Group, *method,
+		len(victims), res.HealthyBefore)
+	end := otel.phase("zone outage", "zone", *zone, "method", *method)
+	restoreZone, err := startOutage(ctx, s, c, m, *zone, *method, victims)
+	end(err)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = waitForCapacity(ctx, s, c, *zone, *timeout, res)
+	res.RestoreSeconds = time.Since(start).Seconds()
+	if err != nil {
+		log.Print(err)
+	}
+
+	if *restore {
+		if rerr := restoreZone(ctx); rerr != nil {
+			return fmt.Errorf("unable to restore %v: %v", *zone, rerr)
+		}
+	} else {
+		log.Printf("Leaving %v out; rerun without -restore=false, or restore it by hand.", *zone)
+	}
+	return printResult(res, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintf(tw, "Group\t%v\n", res.Group)
+		fmt.Fprintf(tw, "Zone\t%v (%v, %d instances)\n", res.Zone, res.Method, res.Instances)
+		fmt.Fprintf(tw, "Healthy before\t%d\n", res.HealthyBefore)
+		fmt.Fprintf(tw, "Lowest healthy\t%d\n", res.MinHealthy)
+		took := (time.Duration(res.RestoreSeconds) * time.Second).String()
+		if !res.Restored {
+			took = "not restored after " + took
+		}
+		fmt.Fprintf(tw, "Full capacity elsewhere\t%v\n", took)
+		return tw.Flush()
+	})
+}
+
+// startOutage takes the zone out of the group and returns a function which
+// undoes it.
+func startOutage(ctx context.Context, s *compute.Service, c *policyConfig, m *compute.InstanceGroupManager, zone, method string, victims []string) (func(context.Context) error, error) {
+	switch method {
+	case outageStop:
+		if err := eachInstance(ctx, s, c, "stop", victims); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			log.Printf("Starting the %d stopped instances.", len(victims))
+			return eachInstance(ctx, s, c, "start", victims)
+		}, nil
+	case outageAbandon:
+		op, err := abandonGroupInstances(ctx, s, c, victims)
+		if err != nil {
+			return nil, fmt.Errorf("unable to abandon the instances in %v: %v", zone, err)
+		}
+		if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			log.Printf("Deleting the %d abandoned instances.", len(victims))
+			return eachInstance(ctx, s, c, "delete", victims)
+		}, nil
+	}
+	if m.DistributionPolicy == nil {
+		return nil, fmt.Errorf("group %v has no distribution policy", c.Group)
+	}
+	original := m.DistributionPolicy.Zones
+	var rest []*compute.DistributionPolicyZoneConfiguration
+	for _, z := range original {
+		if path.Base(z.Zone) != zone {
+			rest = append(rest, z)
+		}
+	}
+	if len(rest) == len(original) {
+		return nil, fmt.Errorf("%v is not one of the zones of %v", zone, c.Group)
+	}
+	setZones := func(ctx context.Context, zones []*compute.DistributionPolicyZoneConfiguration) error {
+		op, err := patchGroupManager(ctx, s, c, &compute.InstanceGroupManager{
+			DistributionPolicy: &compute.DistributionPolicy{Zones: zones, TargetShape: m.DistributionPolicy.TargetShape},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set the zones of %v: %v", c.Group, err)
+		}
+		return waitForOperation(ctx, s, c.Project, op)
+	}
+	if err := setZones(ctx, rest); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		log.Printf("Adding %v back to %v.", zone, c.Group)
+		return setZones(ctx, original)
+	}, nil
+}
+
+// eachInstance stops, starts or deletes instances, given by URL, and waits
+// for every operation.
+func eachInstance(ctx context.Context, s *compute.Service, c *policyConfig, verb string, instances []string) error {
+	pool := workerpool.New(ctx)
+	for _, url := range instances {
+		name, zone := path.Base(url), instanceZone(url)
+		err := pool.Submit(name, func(ctx context.Context) error {
+			var op *compute.Operation
+			var err error
+			switch verb {
+			case "stop":
+				op, err = s.Instances.Stop(c.Project, zone, name).Context(ctx).Do()
+			case "start":
+				op, err = s.Instances.Start(c.Project, zone, name).Context(ctx).Do()
+			default:
+				op, err = s.Instances.Delete(c.Project, zone, name).Context(ctx).Do()
+			}
+			if err != nil {
+				return fmt.Errorf("unable to %v instance %v: %v", verb, name, err)
+			}
+			return waitForOperation(ctx, s, c.Project, op)
+		})
+		if err != nil {
+			break
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		return failures[0].Err
+	}
+	return err
+}
+
+// waitForCapacity polls the backend service until the group's instances
+// outside the zone are as many healthy as res.HealthyBefore, for at most
+// timeout, recording every poll in res.
+func waitForCapacity(ctx context.Context, s *compute.Service, c *policyConfig, zone string, timeout time.Duration, res *zoneOutageResult) error {
+	deadline := time.Now().Add(timeout)
+	defer endProgress()
+	for {
+		m, err := getGroupManager(ctx, s, c)
+		if err != nil {
+			return err
+		}
+		elsewhere, inZone, err := zoneHealth(ctx, s, c, m, zone)
+		if err != nil {
+			return err
+		}
+		res.Samples = append(res.Samples, zoneOutageSample{Time: time.Now().UTC(), Healthy: elsewhere, InZone: inZone})
+		if elsewhere < res.MinHealthy {
+			res.MinHealthy = elsewhere
+		}
+		if elsewhere >= res.HealthyBefore {
+			res.Restored = true
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the other zones of %v had %d of %d healthy instances after %v", c.Group, elsewhere,
+				res.HealthyBefore, timeout)
+		}
+		progressf("%v: %d/%d healthy outside %v, %v left.", c.Group, elsewhere, res.HealthyBefore, zone,
+			time.Until(deadline).Round(time.Second))
+		if err := sleep(ctx, mig.PollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// zoneHealth returns how many instances of the group the config's backend
+// service finds healthy outside the zone and in it.
+func zoneHealth(ctx context.Context, s *compute.Service, c *policyConfig, m *compute.InstanceGroupManager, zone string) (elsewhere, inZone int64, err error) {
+	health, err := s.BackendServices.GetHealth(c.Project, c.BackendService, &compute.ResourceGroupReference{
+		Group: m.InstanceGroup,
+	}).Context(ctx).Do()
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get health of %v: %v", c.BackendService, err)
+	}
+	for _, h := range health.HealthStatus {
+		switch {
+		case h.HealthState != "HEALTHY":
+		case instanceZone(h.Instance) == zone:
+			inZone++
+		default:
+			elsewhere++
+		}
+	}
+	return elsewhere, inZone, nil
+}
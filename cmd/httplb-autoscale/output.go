@@ -0,0 +1,77 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// outputFormat selects how commands print their results.
+var outputFormat = flag.String("output", "table", "Format of command results: table, json or yaml.")
+
+// checkOutputFormat rejects an unknown -output.
+func checkOutputFormat() error {
+	switch *outputFormat {
+	case "table", "json", "yaml":
+		return nil
+	}
+	return fmt.Errorf("unknown -output %q; use table, json or yaml", *outputFormat)
+}
+
+// newTable returns a tab writer laid out like every table this binary
+// prints.
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+}
+
+// printResult writes a command's result to stdout in the -output format.
+// For json and yaml, v is marshalled with its json field names, which are
+// the stable names scripts should rely on; for table, the table function
+// writes the human readable form, which may change between releases.
+func printResult(v interface{}, table func(w io.Writer) error) error {
+	switch *outputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		// Go through JSON so that YAML has the same field names.
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var generic interface{}
+		if err := dec.Decode(&generic); err != nil {
+			return err
+		}
+		b, err = yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return table(os.Stdout)
+}
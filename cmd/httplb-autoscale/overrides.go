@@ -0,0 +1,249 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Prefix of the environment variables which override config fields.
+const envPrefix = "HTTPLB_"
+
+// settingsFlag collects repeated KEY=VALUE flags.
+type settingsFlag []string
+
+func (f *settingsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *settingsFlag) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("%q is not KEY=VALUE", v)
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// settings holds the -set flags, which override config fields of every
+// command's config.
+var settings settingsFlag
+
+func init() {
+	flag.Var(&settings, "set", "Override a config field, e.g. -set minReplicas=2 -set capacity.balancingMode=RATE; may be repeated.")
+}
+
+// envName returns the environment variable overriding a dotted config path,
+// e.g. HTTPLB_CAPACITY_BALANCING_MODE for capacity.balancingMode.
+func envName(path string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range path {
+		switch {
+		case r == '.':
+			b.WriteByte('_')
+		case unicode.IsUpper(r) && i > 0 && path[i-1] != '.':
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// yamlName returns the name a struct field has in the config file.
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// configPaths lists the dotted paths of every scalar field reachable from a
+// struct type through nested structs, which are the fields overrides can
+// set. Lists and maps can only be set in the file.
+func configPaths(t reflect.Type, prefix string) []string {
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := yamlName(f)
+		if name == "" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.Struct:
+			paths = append(paths, configPaths(ft, prefix+name+".")...)
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+			paths = append(paths, prefix+name)
+		}
+	}
+	return paths
+}
+
+// setConfigField sets the field at a dotted path of a config struct from its
+// string form, allocating nested structs as needed.
+func setConfigField(v reflect.Value, path, value string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		var field reflect.Value
+		for j := 0; j < v.NumField(); j++ {
+			if yamlName(v.Type().Field(j)) == name {
+				field = v.Field(j)
+				break
+			}
+		}
+		if !field.IsValid() {
+			return fmt.Errorf("unknown config field %v", path)
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if i < len(names)-1 {
+			if field.Kind() != reflect.Struct {
+				return fmt.Errorf("config field %v has no field %v", strings.Join(names[:i+1], "."), names[i+1])
+			}
+			v = field
+			continue
+		}
+		return setScalar(field, path, value)
+	}
+	return nil
+}
+
+// setScalar parses a value into a scalar field.
+func setScalar(field reflect.Value, path, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		field.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int64:
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%v: %v", path, err)
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		field.SetInt(n)
+		return nil
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		field.SetFloat(f)
+		return nil
+	}
+	return fmt.Errorf("config field %v cannot be overridden; set it in the config file", path)
+}
+
+// applyOverrides applies the environment variables and then the -set
+// flags to a config read from a file, so that flags win over the
+// environment, which wins over the file. Commands' own flags, such as
+// -state, win over all three.
+func (c *policyConfig) applyOverrides() error {
+	v := reflect.ValueOf(c).Elem()
+	for _, path := range configPaths(v.Type(), "") {
+		value, ok := os.LookupEnv(envName(path))
+		if !ok {
+			continue
+		}
+		if err := setConfigField(v, path, value); err != nil {
+			return fmt.Errorf("%v: %v", envName(path), err)
+		}
+	}
+	for _, s := range settings {
+		kv := strings.SplitN(s, "=", 2)
+		if err := setConfigField(v, kv[0], kv[1]); err != nil {
+			return fmt.Errorf("-set %v: %v", s, err)
+		}
+	}
+	return nil
+}
+
+// configShowCmd prints the config as commands see it, after the environment
+// and -set overrides. It is YAML unless -output is json; either way fields
+// have their config file names.
+func configShowCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if *outputFormat != "json" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	var generic interface{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return printResult(stringKeys(generic), nil)
+}
+
+// stringKeys converts the maps YAML decodes into, which have interface{}
+// keys, into maps JSON can encode.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = stringKeys(e)
+		}
+	}
+	return v
+}
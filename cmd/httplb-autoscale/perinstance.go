@@ -0,0 +1,140 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"sort"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// The values available to perInstanceMetadata templates.
+type instanceParams struct {
+	// Index counts the instances created by add-instances, from zero.
+	Index int
+	// Name is the name of the instance.
+	Name  string
+	RunID string
+	// Seed is a random number, different for every instance.
+	Seed int64
+}
+
+// perInstanceMetadata renders the config's per-instance metadata templates
+// for one instance.
+func (c *policyConfig) perInstanceMetadata(p instanceParams) (map[string]string, error) {
+	md := map[string]string{}
+	keys := make([]string, 0, len(c.PerInstanceMetadata))
+	for k := range c.PerInstanceMetadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t, err := template.New(k).Parse(c.PerInstanceMetadata[k])
+		if err != nil {
+			return nil, fmt.Errorf("bad perInstanceMetadata %v: %v", k, err)
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, p); err != nil {
+			return nil, fmt.Errorf("bad perInstanceMetadata %v: %v", k, err)
+		}
+		md[k] = b.String()
+	}
+	return md, nil
+}
+
+// addInstancesCmd creates instances in the group, each with distinct
+// metadata rendered from the config's perInstanceMetadata. The group keeps
+// the metadata as per-instance state, so an instance which is recreated by
+// autohealing gets the same values again.
+func addInstancesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig add-instances", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	count := fs.Int("count", 1, "Number of instances to create.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long to wait for the new instances to become healthy; 0 to not wait.")
+	fs.Parse(args)
+	if *count < 1 {
+		return errors.New("-count must be at least 1")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if len(c.PerInstanceMetadata) == 0 {
+		return errors.New("config has no perInstanceMetadata")
+	}
+	id, err := runID(c, *statePath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	existing, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	taken := map[string]bool{}
+	for _, i := range existing {
+		taken[path.Base(i.Instance)] = true
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var configs []*compute.PerInstanceConfig
+	for index := 0; len(configs) < *count; index++ {
+		name := fmt.Sprintf("%s-%04d", m.BaseInstanceName, index)
+		if taken[name] {
+			continue
+		}
+		md, err := c.perInstanceMetadata(instanceParams{Index: index, Name: name, RunID: id, Seed: rng.Int63()})
+		if err != nil {
+			return err
+		}
+		configs = append(configs, &compute.PerInstanceConfig{
+			Name:           name,
+			PreservedState: &compute.PreservedState{Metadata: md},
+		})
+		log.Printf("%v: %v", name, md)
+	}
+	op, err := createGroupInstances(ctx, s, c, configs)
+	if err != nil {
+		return err
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	size := m.TargetSize + int64(len(configs))
+	log.Printf("Created %d instances in %v; target size is now %d.", len(configs), c.Group, size)
+	if *timeout == 0 {
+		return nil
+	}
+	return waitForHealthy(ctx, s, c, size, *timeout)
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// profile names the config profile layered over the base config.
+var profile = flag.String("profile", os.Getenv("HTTPLB_PROFILE"), "Config profile to layer over the base config, e.g. smoke; defaults to $HTTPLB_PROFILE.")
+
+// applyProfile layers the -profile over the config read from its file.
+// Fields the profile sets replace the base config's, nested fields one by
+// one and lists as a whole. With strict, unknown profile fields are errors as
+// they are in config validate.
+func (c *policyConfig) applyProfile(strict bool) error {
+	profiles := c.Profiles
+	c.Profiles = nil
+	if *profile == "" {
+		return nil
+	}
+	p, ok := profiles[*profile]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("unknown profile %q; the config defines none", *profile)
+		}
+		return fmt.Errorf("unknown profile %q; the config defines %s", *profile, strings.Join(names, ", "))
+	}
+	if _, nested := p["profiles"]; nested {
+		return fmt.Errorf("profile %v: profiles cannot define profiles", *profile)
+	}
+	b, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	unmarshal := yaml.Unmarshal
+	if strict {
+		unmarshal = yaml.UnmarshalStrict
+	}
+	if err := unmarshal(b, c); err != nil {
+		return fmt.Errorf("profile %v: %v", *profile, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/credentials"
+)
+
+// Resource groups which may live in a project of their own, see
+// policyConfig.Projects.
+const (
+	servingProjects    = "serving"
+	monitoringProjects = "monitoring"
+	bigqueryProjects   = "bigquery"
+)
+
+// resourceGroups describes what each resource group holds.
+var resourceGroups = map[string]string{
+	servingProjects:    "instance templates, groups, autoscalers and the load balancer",
+	monitoringProjects: "the Cloud Monitoring, Logging and Trace data reports read and watch annotates",
+	bigqueryProjects:   "the datasets report bigquery exports to",
+}
+
+// A projectConfig moves a resource group to another project, or gives it
+// credentials of its own, e.g. when the load generator runs as a service
+// account of its own project and needs another to reach the serving stack.
+type projectConfig struct {
+	// Project defaults to the config's project. The serving group is always
+	// in the config's project.
+	Project string `yaml:"project"`
+	// Credentials is a service account key or authorized user file; empty
+	// uses the application default credentials.
+	Credentials string `yaml:"credentials"`
+}
+
+// projectFor returns the project of a resource group. The monitoring group
+// must be set to a project whose metrics scope includes the serving project
+// when it is moved, so that the serving stack's metrics can be read there.
+func (c *policyConfig) projectFor(group string) string {
+	if pc := c.Projects[group]; pc != nil && pc.Project != "" {
+		return pc.Project
+	}
+	return c.Project
+}
+
+// credentialsFiles maps each resource group to the credentials its clients
+// use, as given by the loaded config. Groups which are not listed use the
+// application default credentials.
+var credentialsFiles = map[string]string{}
+
+// useCredentials makes the clients of each resource group use the
+// credentials the config gives it. A group left in the serving project
+// shares the serving group's credentials.
+func (c *policyConfig) useCredentials() {
+	serving := ""
+	if pc := c.Projects[servingProjects]; pc != nil {
+		serving = pc.Credentials
+	}
+	for group := range resourceGroups {
+		pc := c.Projects[group]
+		switch {
+		case pc != nil && pc.Credentials != "":
+			credentialsFiles[group] = pc.Credentials
+		case c.projectFor(group) == c.Project && serving != "":
+			credentialsFiles[group] = serving
+		}
+	}
+}
+
+// groupClient returns an HTTP client authorized for scope with the
+// credentials of a resource group, or, with -impersonate-service-account, as
+// that account with tokens minted by the group's credentials. Its calls are
+// logged with -v.
+func groupClient(group, scope string) (*http.Client, error) {
+	p := groupCredentials(group)
+	if *impersonate != "" {
+		p = impersonated(p)
+	}
+	client, err := credentials.NewClient(context.Background(), p, scope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authorize the clients of the %v projects: %v", group, err)
+	}
+	return retried(logged(client)), nil
+}
+
+// groupCredentials returns the Provider of a resource group's own
+// credentials.
+func groupCredentials(group string) credentials.Provider {
+	if path := credentialsFiles[group]; path != "" {
+		return credentials.KeyFile(path)
+	}
+	return credentials.ADC()
+}
+
+// diagnoseProjects checks the resource group overrides.
+func (c *policyConfig) diagnoseProjects(ds *diagnostics) {
+	groups := make([]string, 0, len(c.Projects))
+	for group := range c.Projects {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		pc := c.Projects[group]
+		field := "projects." + group
+		switch {
+		case resourceGroups[group] == "":
+			ds.errorf(field, "use serving, monitoring or bigquery", "unknown resource group %q", group)
+		case pc == nil:
+			ds.errorf(field, "", "is empty")
+		case group == servingProjects && pc.Project != "" && pc.Project != c.Project:
+			ds.errorf(field+".project", "set project instead", "the serving resources are always in the config's project")
+		case pc.Credentials != "":
+			if _, err := ioutil.ReadFile(pc.Credentials); err != nil {
+				ds.errorf(field+".credentials", "", "%v", err)
+			}
+		}
+	}
+}
+
+// runProjects returns the project of every resource group of the config, to
+// be recorded with a run.
+func (c *policyConfig) runProjects() map[string]string {
+	projects := map[string]string{}
+	for group := range resourceGroups {
+		projects[group] = c.projectFor(group)
+	}
+	return projects
+}
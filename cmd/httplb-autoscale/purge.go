@@ -0,0 +1,98 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+)
+
+// A purgeResult is the report of cleanup bucket.
+type purgeResult struct {
+	Bucket  string  `json:"bucket"`
+	Prefix  string  `json:"prefix,omitempty"`
+	Listed  int     `json:"listed"`
+	Deleted int     `json:"deleted"`
+	Failed  int     `json:"failed"`
+	Seconds float64 `json:"seconds"`
+	// PerSecond is the deletion throughput.
+	PerSecond float64 `json:"perSecond"`
+}
+
+// cleanupBucketCmd deletes the corpus of a bucket, every generation of each
+// object included, with -deleters concurrent deletions fed by the paginated
+// listing, and reports the deletion throughput. It copes with buckets of
+// millions of objects, which listing first and deleting afterwards does not.
+func cleanupBucketCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cleanup bucket", flag.ExitOnError)
+	bucket := fs.String("bucket", "", "Cloud Storage bucket to purge.")
+	prefix := fs.String("prefix", "", "Only delete the objects starting with this prefix.")
+	deleters := fs.Int("deleters", 100, "Number of concurrent deletions.")
+	billingProject := fs.String("billing-project", "", "Project billed for the calls, which requester pays buckets need.")
+	yes := fs.Bool("yes", false, "Delete without asking for confirmation.")
+	fs.Parse(args)
+	if *bucket == "" {
+		return errors.New("-bucket is required")
+	}
+	if *deleters < 1 {
+		return errors.New("-deleters must be positive")
+	}
+	if !*yes {
+		p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+		a, err := p.askValid(fmt.Sprintf("Delete every object of gs://%v/%v*, all generations? (y/n)", *bucket, *prefix), "n", func(a string) error {
+			_, err := yesNo(a)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if ok, _ := yesNo(a); !ok {
+			log.Printf("Nothing deleted.")
+			return nil
+		}
+	}
+
+	s, err := newStorageService()
+	if err != nil {
+		return fmt.Errorf("failed to create Cloud Storage client: %v", err)
+	}
+	p := &provision.Provisioner{Storage: provision.NewStorage(s, gcsgen.ObjectsConfig{BillingProject: *billingProject}), Concurrency: *deleters, Reporter: progressReporter{}}
+	res, err := p.DeleteCorpus(ctx, *bucket, *prefix)
+	log.Printf("Deleted %d of %d object generations in %v, %.0f per second.", res.Deleted, res.Listed,
+		res.Duration.Round(time.Second), res.Rate())
+	row := purgeResult{*bucket, *prefix, res.Listed, res.Deleted, res.Failed, res.Duration.Seconds(), res.Rate()}
+	if perr := printResult(row, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "BUCKET\tLISTED\tDELETED\tFAILED\tSECONDS\tPER-SECOND")
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.0f\t%.0f\n", row.Bucket, row.Listed, row.Deleted, row.Failed, row.Seconds, row.PerSecond)
+		return tw.Flush()
+	}); perr != nil {
+		return perr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to purge bucket %v: %v", *bucket, err)
+	}
+	return nil
+}
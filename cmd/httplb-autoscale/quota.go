@@ -0,0 +1,292 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// A quotaNeed is how much of one quota the config needs, by region, or
+// "global" for project-wide quotas.
+type quotaNeed struct {
+	region string
+	metric string
+	need   float64
+}
+
+// cpuQuotaMetric returns the regional quota a machine family's vCPUs count
+// against. The older general purpose families share CPUS; every other
+// family has a quota of its own, such as N2_CPUS.
+func cpuQuotaMetric(machineType string) string {
+	family := strings.SplitN(machineType, "-", 2)[0]
+	switch family {
+	case "n1", "e2", "f1", "g1", "custom":
+		return "CPUS"
+	}
+	return strings.ToUpper(family) + "_CPUS"
+}
+
+// gpuQuotaMetric returns the regional quota of an accelerator type, such as
+// NVIDIA_T4_GPUS for nvidia-tesla-t4.
+func gpuQuotaMetric(acceleratorType string, spot bool) string {
+	model := strings.TrimPrefix(strings.TrimPrefix(acceleratorType, "nvidia-"), "tesla-")
+	metric := "NVIDIA_" + strings.ToUpper(strings.Replace(model, "-", "_", -1)) + "_GPUS"
+	if spot {
+		metric = "PREEMPTIBLE_" + metric
+	}
+	return metric
+}
+
+// diskQuotaMetric returns the regional quota a persistent disk type counts
+// against.
+func diskQuotaMetric(diskType string) string {
+	if diskType == "pd-standard" {
+		return "DISKS_TOTAL_GB"
+	}
+	return "SSD_TOTAL_GB"
+}
+
+// groupVCPUs returns the vCPUs of one instance of the group's template.
+func groupVCPUs(ctx context.Context, s *compute.Service, c *policyConfig, t templateConfig) (int64, error) {
+	if t.CustomMachine != nil {
+		return t.CustomMachine.VCPUs, nil
+	}
+	zones, err := groupZones(ctx, s, c)
+	if err != nil {
+		return 0, err
+	}
+	if len(zones) == 0 {
+		return 0, fmt.Errorf("region %v has no zones", c.Region)
+	}
+	mt, err := s.MachineTypes.Get(c.Project, zones[0], t.MachineType).Context(ctx).Do()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get machine type %v: %v", t.MachineType, err)
+	}
+	return mt.GuestCpus, nil
+}
+
+// requiredQuotas returns what the groups need with every group at its
+// maximum size, and with withLB the config's load balancer.
+func requiredQuotas(ctx context.Context, s *compute.Service, c *policyConfig, groups []*policyConfig, withLB bool) ([]quotaNeed, error) {
+	needs := map[[2]string]float64{}
+	add := func(region, metric string, n float64) {
+		needs[[2]string{region, metric}] += n
+	}
+	for _, gc := range groups {
+		var t templateConfig
+		if gc.InstanceTemplate != nil {
+			t = *gc.InstanceTemplate
+		}
+		t = t.withDefaults()
+		region := gc.Region
+		if region == "" {
+			region = zoneRegion(gc.Zone)
+		}
+		n := float64(gc.MaxReplicas)
+		if n < float64(gc.TargetSize) {
+			n = float64(gc.TargetSize)
+		}
+		vcpus, err := groupVCPUs(ctx, s, gc, t)
+		if err != nil {
+			return nil, err
+		}
+		spot := t.Scheduling != nil && t.Scheduling.ProvisioningModel == "SPOT"
+		if spot {
+			// Spot instances count against PREEMPTIBLE_CPUS where the project
+			// has that quota; checkQuotas falls back to the regular one.
+			add(region, "PREEMPTIBLE_CPUS", n*float64(vcpus))
+		} else {
+			add(region, cpuQuotaMetric(t.MachineType), n*float64(vcpus))
+		}
+		// Every instance gets an ephemeral external address.
+		add(region, "IN_USE_ADDRESSES", n)
+		add(region, diskQuotaMetric(t.DiskType), n*float64(t.DiskSizeGb))
+		for _, ac := range t.Accelerators {
+			add(region, gpuQuotaMetric(ac.Type, spot), n*float64(ac.Count))
+		}
+		add(region, "INSTANCE_GROUP_MANAGERS", 1)
+		add(region, "AUTOSCALERS", 1)
+	}
+	if withLB && c.BackendService != "" {
+		services := float64(1 + len(c.Services))
+		add("global", "BACKEND_SERVICES", services)
+		add("global", "HEALTH_CHECKS", 1)
+		add("global", "URL_MAPS", 1)
+		add("global", "TARGET_HTTP_PROXIES", 1)
+		add("global", "FIREWALLS", 1)
+		if h := c.HTTPS; h != nil {
+			// The HTTPS frontend's proxy and reserved address, and the URL
+			// map of the redirect, which may be turned on later.
+			add("global", "TARGET_HTTPS_PROXIES", 1)
+			add("global", "URL_MAPS", 1)
+			add("global", "STATIC_ADDRESSES", 1)
+			if h.RedirectHTTP {
+				// The redirect's proxy replaces the one serving port 80,
+				// which setup-lb leaves in place if it created it earlier.
+				add("global", "TARGET_HTTP_PROXIES", 1)
+			}
+		}
+	}
+	var out []quotaNeed
+	for k, n := range needs {
+		out = append(out, quotaNeed{region: k[0], metric: k[1], need: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].region != out[j].region {
+			return out[i].region < out[j].region
+		}
+		return out[i].metric < out[j].metric
+	})
+	return out, nil
+}
+
+// A quotaResult is one quota compared by quota check.
+type quotaResult struct {
+	Region    string  `json:"region"`
+	Metric    string  `json:"metric"`
+	Need      float64 `json:"need"`
+	Limit     float64 `json:"limit"`
+	Usage     float64 `json:"usage"`
+	Available float64 `json:"available"`
+	Shortfall float64 `json:"shortfall"`
+}
+
+// checkQuotas compares what the groups need at their maximum sizes, and with
+// withLB what the load balancer needs, with the quotas left in their regions
+// and the project. It returns every quota compared and how many fall short.
+// Quotas the API does not report are taken to be unlimited.
+func checkQuotas(ctx context.Context, s *compute.Service, c *policyConfig, groups []*policyConfig, withLB bool) ([]quotaResult, int, error) {
+	needs, err := requiredQuotas(ctx, s, c, groups, withLB)
+	if err != nil {
+		return nil, 0, err
+	}
+	quotas := map[string]map[string]*compute.Quota{}
+	for _, n := range needs {
+		if quotas[n.region] != nil {
+			continue
+		}
+		var qs []*compute.Quota
+		if n.region == "global" {
+			p, err := s.Projects.Get(c.Project).Context(ctx).Do()
+			if err != nil {
+				return nil, 0, fmt.Errorf("unable to get the quotas of project %v: %v", c.Project, err)
+			}
+			qs = p.Quotas
+		} else {
+			r, err := s.Regions.Get(c.Project, n.region).Context(ctx).Do()
+			if err != nil {
+				return nil, 0, fmt.Errorf("unable to get the quotas of region %v: %v", n.region, err)
+			}
+			qs = r.Quotas
+		}
+		quotas[n.region] = map[string]*compute.Quota{}
+		for _, q := range qs {
+			quotas[n.region][q.Metric] = q
+		}
+	}
+	var results []quotaResult
+	short := 0
+	for _, n := range needs {
+		q := quotas[n.region][n.metric]
+		if q == nil && n.metric == "PREEMPTIBLE_CPUS" {
+			q = quotas[n.region]["CPUS"]
+		}
+		if q == nil {
+			debugf(1, "No %v quota is reported for %v; assuming it is unlimited.", n.metric, n.region)
+			continue
+		}
+		r := quotaResult{Region: n.region, Metric: q.Metric, Need: n.need, Limit: q.Limit, Usage: q.Usage,
+			Available: q.Limit - q.Usage}
+		if r.Need > r.Available {
+			r.Shortfall = r.Need - r.Available
+			short++
+		}
+		results = append(results, r)
+	}
+	return results, short, nil
+}
+
+// preflightQuotas fails if the groups, or with withLB the load balancer,
+// would run out of quota before the groups reach their maximum sizes,
+// logging each shortfall.
+func preflightQuotas(ctx context.Context, s *compute.Service, c *policyConfig, groups []*policyConfig, withLB bool) error {
+	results, short, err := checkQuotas(ctx, s, c, groups, withLB)
+	if err != nil {
+		return err
+	}
+	if short == 0 {
+		debugf(1, "Quotas suffice for every group at its maximum size.")
+		return nil
+	}
+	for _, r := range results {
+		if r.Shortfall > 0 {
+			log.Printf("Quota %v in %v: need %g, only %g of %g available, %g short.", r.Metric, r.Region,
+				r.Need, r.Available, r.Limit, r.Shortfall)
+		}
+	}
+	return fmt.Errorf("%d quotas are insufficient for the groups at their maximum sizes; "+
+		"request more quota, lower maxReplicas or pass -skip-quota-check", short)
+}
+
+// quotaCheckCmd prints what the config's groups need of each quota at their
+// maximum sizes next to what is available, and fails on any shortfall.
+func quotaCheckCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("quota check", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	results, short, err := checkQuotas(ctx, s, c, append(c.backendGroups(), c.serviceGroups()...), true)
+	if err != nil {
+		return err
+	}
+	if results == nil {
+		results = []quotaResult{}
+	}
+	err = printResult(results, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "REGION\tQUOTA\tNEED\tAVAILABLE\tLIMIT\tSHORTFALL")
+		for _, r := range results {
+			shortfall := ""
+			if r.Shortfall > 0 {
+				shortfall = fmt.Sprintf("%g", r.Shortfall)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%g\t%g\t%g\t%s\n", r.Region, r.Metric, r.Need, r.Available, r.Limit, shortfall)
+		}
+		return tw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if short > 0 {
+		return fmt.Errorf("%d quotas are insufficient for the groups at their maximum sizes", short)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// reportSummaryCmd summarizes one or more watch event files, breaking the
+// results out by predictive autoscaling method.
+func reportSummaryCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report summary", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: report summary WATCH_FILE...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("at least one watch event file is required")
+	}
+
+	summaries := map[string]*report.ModeSummary{}
+	for _, path := range fs.Args() {
+		events, err := report.ReadWatchEvents(path)
+		if err != nil {
+			return err
+		}
+		report.SummarizeRun(summaries, events)
+	}
+
+	modes := make([]string, 0, len(summaries))
+	for mode := range summaries {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	rows := []modeSummaryResult{}
+	for _, mode := range modes {
+		m := summaries[mode]
+		sort.Sort(report.Durations(m.BootTimes))
+		flapping := []string{}
+		for name := range m.Flapping {
+			flapping = append(flapping, name)
+		}
+		sort.Strings(flapping)
+		rows = append(rows, modeSummaryResult{
+			PredictiveMethod: m.Mode,
+			Runs:             m.Runs,
+			DurationSec:      m.Duration.Seconds(),
+			PeakTarget:       m.PeakTarget,
+			MeanSize:         m.MeanSize(),
+			InstanceHours:    m.InstanceHours,
+			ScaleOuts:        m.ScaleOuts,
+			ScaleIns:         m.ScaleIns,
+			Boots:            len(m.BootTimes),
+			BootP50Sec:       report.Percentile(m.BootTimes, 0.5).Seconds(),
+			BootP90Sec:       report.Percentile(m.BootTimes, 0.9).Seconds(),
+			Flapping:         flapping,
+		})
+	}
+	return printResult(rows, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "PREDICTIVE METHOD\tRUNS\tDURATION\tPEAK TARGET\tMEAN SIZE\tINSTANCE HOURS\tSCALE OUTS\tSCALE INS\tBOOTS\tBOOT P50\tBOOT P90\tFLAPPING")
+		for _, mode := range modes {
+			m := summaries[mode]
+			fmt.Fprintf(tw, "%s\t%d\t%v\t%d\t%.2f\t%.2f\t%d\t%d\t%d\t%v\t%v\t%d\n", m.Mode, m.Runs,
+				m.Duration.Round(time.Second), m.PeakTarget, m.MeanSize(), m.InstanceHours, m.ScaleOuts,
+				m.ScaleIns, len(m.BootTimes), report.Percentile(m.BootTimes, 0.5).Round(time.Second),
+				report.Percentile(m.BootTimes, 0.9).Round(time.Second), len(m.Flapping))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if len(r.Flapping) > 0 {
+				fmt.Fprintf(w, "Flapping under %v: %s\n", r.PredictiveMethod, strings.Join(r.Flapping, ", "))
+			}
+		}
+		return nil
+	})
+}
+
+// A modeSummaryResult is one predictive method's row of report summary.
+type modeSummaryResult struct {
+	PredictiveMethod string   `json:"predictiveMethod"`
+	Runs             int      `json:"runs"`
+	DurationSec      float64  `json:"durationSec"`
+	PeakTarget       int64    `json:"peakTarget"`
+	MeanSize         float64  `json:"meanSize"`
+	InstanceHours    float64  `json:"instanceHours"`
+	ScaleOuts        int      `json:"scaleOuts"`
+	ScaleIns         int      `json:"scaleIns"`
+	Boots            int      `json:"boots"`
+	BootP50Sec       float64  `json:"bootP50Sec"`
+	BootP90Sec       float64  `json:"bootP90Sec"`
+	Flapping         []string `json:"flapping"`
+}
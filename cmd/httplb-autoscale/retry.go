@@ -0,0 +1,87 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/retry"
+)
+
+var (
+	apiAttempts    = flag.Int("api-attempts", retry.DefaultPolicy.Attempts, "Attempts made at each API call before its error is returned.")
+	apiRetryBudget = flag.Duration("api-retry-budget", retry.DefaultPolicy.Budget, "Longest an API call is retried for; 0 retries until -api-attempts are used.")
+	apiBudgets     = operationBudgetsFlag{}
+)
+
+func init() {
+	flag.Var(apiBudgets, "api-retry-budgets", "Comma separated METHOD_ID=DURATION overriding -api-retry-budget for some calls, e.g. compute.instanceGroupManagers.resize=10m.")
+}
+
+// operationBudgetsFlag maps API method IDs to retry budgets, given as a
+// comma separated list of METHOD_ID=DURATION.
+type operationBudgetsFlag map[string]time.Duration
+
+func (f operationBudgetsFlag) String() string {
+	var s []string
+	for k, v := range f {
+		s = append(s, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (f operationBudgetsFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("retry budget %q is not METHOD_ID=DURATION", s)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return fmt.Errorf("retry budget %q is not METHOD_ID=DURATION", s)
+		}
+		f[kv[0]] = d
+	}
+	return nil
+}
+
+// Waits between retries of API calls.
+const (
+	apiRetryBackoff    = time.Second
+	apiRetryMaxBackoff = 30 * time.Second
+)
+
+// retried makes a client retry its calls under the policy of the -api-*
+// flags. Every Google Cloud API client of these commands is wrapped, by
+// groupClient, so that commands need not retry calls of their own: generate
+// files makes one attempt at each copy unless -attempts asks for more, and
+// provisioning only retries operations which failed after they started.
+func retried(client *http.Client) *http.Client {
+	p := retry.Policy{Attempts: *apiAttempts, Backoff: apiRetryBackoff, MaxBackoff: apiRetryMaxBackoff, Budget: *apiRetryBudget}
+	ops := map[string]retry.Policy{}
+	for op, budget := range apiBudgets {
+		ops[op] = retry.Policy{Attempts: p.Attempts, Backoff: p.Backoff, MaxBackoff: p.MaxBackoff, Budget: budget}
+	}
+	return retry.Wrap(client, &retry.Transport{Policy: p, Operations: ops,
+		OnRetry: func(req *http.Request, op string, attempt int, wait time.Duration, reason string) {
+			debugf(1, "Retrying %v in %v, attempt %d: %v", op, wait.Round(time.Millisecond), attempt, reason)
+		}})
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+)
+
+// parseFixedOrPercent parses a rolling update limit given either as a number
+// of instances, e.g. "3", or as a percentage of the group, e.g. "20%".
+func parseFixedOrPercent(s string) (*compute.FixedOrPercent, error) {
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseInt(strings.TrimSuffix(s, "%"), 10, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("%q is not a percentage", s)
+		}
+		return &compute.FixedOrPercent{Percent: p, ForceSendFields: []string{"Percent"}}, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%q is not a number of instances", s)
+	}
+	// Zero is meaningful here, e.g. a surge of zero.
+	return &compute.FixedOrPercent{Fixed: n, ForceSendFields: []string{"Fixed"}}, nil
+}
+
+// updateFlags are the rolling update flags shared by the rollout and canary
+// commands.
+type updateFlags struct {
+	maxSurge       *string
+	maxUnavailable *string
+	minimalAction  *string
+	timeout        *time.Duration
+}
+
+// addUpdateFlags registers the rolling update flags on fs.
+func addUpdateFlags(fs *flag.FlagSet) *updateFlags {
+	return &updateFlags{
+		maxSurge:       fs.String("max-surge", "1", "Instances, or percentage of the group, created above the target size during the update."),
+		maxUnavailable: fs.String("max-unavailable", "0", "Instances, or percentage of the group, which may be unavailable during the update."),
+		minimalAction:  fs.String("minimal-action", "REPLACE", "Least disruptive action applied to each instance: REPLACE or RESTART."),
+		timeout:        fs.Duration("timeout", 30*time.Minute, "How long to wait for the update to finish."),
+	}
+}
+
+// policy converts the flags into a proactive update policy.
+func (f *updateFlags) policy() (*compute.InstanceGroupManagerUpdatePolicy, error) {
+	surge, err := parseFixedOrPercent(*f.maxSurge)
+	if err != nil {
+		return nil, fmt.Errorf("bad -max-surge: %v", err)
+	}
+	unavailable, err := parseFixedOrPercent(*f.maxUnavailable)
+	if err != nil {
+		return nil, fmt.Errorf("bad -max-unavailable: %v", err)
+	}
+	if *f.minimalAction != "REPLACE" && *f.minimalAction != "RESTART" {
+		return nil, fmt.Errorf("unknown -minimal-action %q", *f.minimalAction)
+	}
+	return &compute.InstanceGroupManagerUpdatePolicy{
+		Type:           "PROACTIVE",
+		MinimalAction:  *f.minimalAction,
+		MaxSurge:       surge,
+		MaxUnavailable: unavailable,
+	}, nil
+}
+
+// applyVersions replaces the group's versions using the update policy in
+// the flags, then follows the update until it finishes.
+func applyVersions(ctx context.Context, s *compute.Service, c *policyConfig, f *updateFlags, versions []*compute.InstanceGroupManagerVersion) error {
+	p, err := f.policy()
+	if err != nil {
+		return err
+	}
+	op, err := patchGroupManager(ctx, s, c, &compute.InstanceGroupManager{Versions: versions, UpdatePolicy: p})
+	if err != nil {
+		return fmt.Errorf("unable to update versions of %v: %v", c.Group, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	for _, v := range versions {
+		target := "the rest"
+		if v.TargetSize != nil {
+			target = fmt.Sprintf("%d%%", v.TargetSize.Percent)
+		}
+		log.Printf("Version %v: %v on %v.", v.Name, target, path.Base(v.InstanceTemplate))
+	}
+	log.Printf("Updating %v (surge %v, unavailable %v, %v).", c.Group, *f.maxSurge, *f.maxUnavailable,
+		*f.minimalAction)
+	return watchRollout(ctx, s, c, *f.timeout)
+}
+
+// rolloutCmd starts a proactive rolling update of the group to a new
+// instance template and streams per-instance progress until the group is
+// stable with every instance on the new template. Regional groups need a
+// surge and unavailability of either zero or at least the number of zones.
+func rolloutCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig rollout", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	template := fs.String("template", "", "Template to roll out. Defaults to the newest one made by template create.")
+	uf := addUpdateFlags(fs)
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *template == "" {
+		if *template, err = currentTemplate(c, *statePath); err != nil {
+			return err
+		}
+	}
+	if *template == "" {
+		return errors.New("no template to roll out; pass -template")
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	return applyVersions(ctx, s, c, uf, []*compute.InstanceGroupManagerVersion{{
+		Name:             stableVersion,
+		InstanceTemplate: mig.TemplateURL(c.Project, *template),
+	}})
+}
+
+// watchRollout logs every change in an instance's status, current action or
+// template until the group reports that it has reached its version target
+// and is stable.
+func watchRollout(ctx context.Context, s *compute.Service, c *policyConfig, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	last := map[string]string{}
+	for {
+		instances, err := listManagedInstances(ctx, s, c)
+		if err != nil {
+			return err
+		}
+		for _, i := range instances {
+			name := path.Base(i.Instance)
+			template := ""
+			if i.Version != nil {
+				template = path.Base(i.Version.InstanceTemplate)
+			}
+			desc := fmt.Sprintf("%v %v on %v", i.InstanceStatus, i.CurrentAction, template)
+			if last[name] != desc {
+				log.Printf("%v: %v", name, desc)
+				last[name] = desc
+			}
+		}
+		m, err := getGroupManager(ctx, s, c)
+		if err != nil {
+			return err
+		}
+		if m.Status != nil && m.Status.IsStable && m.Status.VersionTarget != nil && m.Status.VersionTarget.IsReached {
+			log.Printf("Rollout of %v is complete.", c.Group)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("rollout of %v did not finish within %v", c.Group, timeout)
+		}
+		if err := sleep(ctx, mig.PollInterval); err != nil {
+			return err
+		}
+	}
+}
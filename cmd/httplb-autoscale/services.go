@@ -0,0 +1,192 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/lb"
+)
+
+// A serviceConfig declares one of several services behind the load balancer,
+// each with its own instance template, group, autoscaler and backend
+// service, which the URL map routes the service's paths to. Requests for any
+// other path go to the top level backend service:
+//
+//	services:
+//	- name: thumbnails
+//	  paths: ["/thumbnails", "/thumbnails/*"]
+//	  instanceTemplate:
+//	    machineType: e2-small
+//	  minReplicas: 1
+//	  maxReplicas: 5
+//	  cpuUtilization: 0.5
+//
+// The service's template, group and backend service default to its name and
+// its autoscaler to NAME-autoscaler. Every other field it does not set is
+// inherited from the top level, and its instanceTemplate replaces the top
+// level one as a whole.
+type serviceConfig struct {
+	Name  string   `yaml:"name"`
+	Paths []string `yaml:"paths"`
+	// BackendService, Group, Template and Autoscaler override the names
+	// derived from the service's.
+	BackendService   string          `yaml:"backendService"`
+	Group            string          `yaml:"group"`
+	Template         string          `yaml:"template"`
+	Autoscaler       string          `yaml:"autoscaler"`
+	InstanceTemplate *templateConfig `yaml:"instanceTemplate"`
+	TargetSize       int64           `yaml:"targetSize"`
+	// Capacity holds the group's capacity settings as a backend of the
+	// service's backend service.
+	Capacity                 *backendConfig `yaml:"capacity"`
+	MinReplicas              int64          `yaml:"minReplicas"`
+	MaxReplicas              int64          `yaml:"maxReplicas"`
+	CPUUtilization           float64        `yaml:"cpuUtilization"`
+	LoadBalancingUtilization float64        `yaml:"loadBalancingUtilization"`
+}
+
+// serviceGroups returns the config of each declared service, in order.
+func (c *policyConfig) serviceGroups() []*policyConfig {
+	var configs []*policyConfig
+	for _, sv := range c.Services {
+		sc := *c
+		sc.Backends, sc.Services = nil, nil
+		sc.BaseInstanceName = ""
+		sc.BackendService = firstNonEmpty(sv.BackendService, sv.Name)
+		sc.Group = firstNonEmpty(sv.Group, sv.Name)
+		sc.Template = firstNonEmpty(sv.Template, sv.Name)
+		sc.Autoscaler = firstNonEmpty(sv.Autoscaler, sv.Name+"-autoscaler")
+		if sv.InstanceTemplate != nil {
+			sc.InstanceTemplate = sv.InstanceTemplate
+		}
+		if sv.TargetSize > 0 {
+			sc.TargetSize = sv.TargetSize
+		}
+		if sv.Capacity != nil {
+			sc.Capacity = sv.Capacity
+		}
+		if sv.MinReplicas > 0 {
+			sc.MinReplicas = sv.MinReplicas
+		}
+		if sv.MaxReplicas > 0 {
+			sc.MaxReplicas = sv.MaxReplicas
+		}
+		if sv.CPUUtilization > 0 {
+			sc.CPUUtilization = sv.CPUUtilization
+		}
+		if sv.LoadBalancingUtilization > 0 {
+			sc.LoadBalancingUtilization = sv.LoadBalancingUtilization
+		}
+		configs = append(configs, &sc)
+	}
+	return configs
+}
+
+// forService returns the config of the named service, or the config itself
+// if name is empty.
+func (c *policyConfig) forService(name string) (*policyConfig, error) {
+	if name == "" {
+		return c, nil
+	}
+	for i, sc := range c.serviceGroups() {
+		if c.Services[i].Name == name {
+			return sc, nil
+		}
+	}
+	return nil, fmt.Errorf("config declares no service %v", name)
+}
+
+// pathRules returns the URL map's rules routing each service's paths to its
+// backend service.
+func (c *policyConfig) pathRules() []lb.PathRule {
+	var rules []lb.PathRule
+	for i, sc := range c.serviceGroups() {
+		rules = append(rules, lb.PathRule{Paths: c.Services[i].Paths, BackendService: sc.BackendService})
+	}
+	return rules
+}
+
+// firstNonEmpty returns the first of its arguments which is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// diagnoseServices checks the declared services and that their names do not
+// collide with each other's or the top level ones.
+func (c *policyConfig) diagnoseServices(ds *diagnostics) {
+	if len(c.Services) == 0 {
+		return
+	}
+	if c.BackendService == "" {
+		ds.errorf("services", "set backendService for the requests matching no service's paths",
+			"services require a default backend service")
+	}
+	names := map[string]bool{}
+	backendServices := map[string]bool{c.BackendService: true}
+	groups := map[string]bool{c.Group: true}
+	for _, b := range c.Backends {
+		groups[b.Group] = true
+	}
+	paths := map[string]bool{}
+	for i, sc := range c.serviceGroups() {
+		sv := &c.Services[i]
+		field := fmt.Sprintf("services[%d]", i)
+		switch {
+		case sv.Name == "":
+			ds.errorf(field+".name", "", "is required")
+			continue
+		case names[sv.Name]:
+			ds.errorf(field+".name", "", "service %v is declared more than once", sv.Name)
+		}
+		names[sv.Name] = true
+		if backendServices[sc.BackendService] {
+			ds.errorf(field+".backendService", "give each service a backend service of its own",
+				"backend service %v is already used", sc.BackendService)
+		}
+		backendServices[sc.BackendService] = true
+		if groups[sc.Group] {
+			ds.errorf(field+".group", "", "group %v is declared more than once", sc.Group)
+		}
+		groups[sc.Group] = true
+		if len(sv.Paths) == 0 {
+			ds.errorf(field+".paths", "list the paths routed to the service, such as /thumbnails/*", "is required")
+		}
+		for _, p := range sv.Paths {
+			switch {
+			case !strings.HasPrefix(p, "/"):
+				ds.errorf(field+".paths", "", "path %q does not start with /", p)
+			case strings.Contains(strings.TrimSuffix(p, "/*"), "*"):
+				ds.errorf(field+".paths", "", "path %q may only end in /*, not hold * elsewhere", p)
+			case paths[p]:
+				ds.errorf(field+".paths", "", "path %v is routed to more than one service", p)
+			}
+			paths[p] = true
+		}
+		if sc.MinReplicas > sc.MaxReplicas {
+			ds.errorf(field+".minReplicas", "lower minReplicas or raise maxReplicas",
+				"minReplicas (%d) is greater than maxReplicas (%d)", sc.MinReplicas, sc.MaxReplicas)
+		}
+		if sv.Capacity != nil {
+			diagnoseCapacity(ds, field+".capacity", sv.Capacity)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// A securityConfig enables Shielded VM and Confidential VM features on the
+// template's instances:
+//
+//	instanceTemplate:
+//	  security:
+//	    secureBoot: true
+//	    vtpm: true
+//	    integrityMonitoring: true
+//	    confidentialCompute: false
+type securityConfig struct {
+	SecureBoot          bool `yaml:"secureBoot"`
+	VTPM                bool `yaml:"vtpm"`
+	IntegrityMonitoring bool `yaml:"integrityMonitoring"`
+	// ConfidentialCompute encrypts instance memory. It needs an AMD machine
+	// type, such as n2d-standard-2.
+	ConfidentialCompute bool `yaml:"confidentialCompute"`
+}
+
+// Machine type prefixes which support Confidential VM.
+var confidentialMachinePrefixes = []string{"n2d-", "c2d-"}
+
+// check verifies the security config against the machine type.
+func (sc *securityConfig) check(machineType string) error {
+	if sc.IntegrityMonitoring && !sc.VTPM {
+		return fmt.Errorf("integrityMonitoring requires vtpm")
+	}
+	if !sc.ConfidentialCompute {
+		return nil
+	}
+	for _, p := range confidentialMachinePrefixes {
+		if strings.HasPrefix(machineType, p) {
+			return nil
+		}
+	}
+	return fmt.Errorf("confidentialCompute needs an N2D or C2D machine type, not %v", machineType)
+}
+
+// shieldedConfig converts the Shielded VM part of the config into its
+// Compute API representation. Fields are always sent, so that false turns a
+// feature off rather than leaving the API default.
+func (sc *securityConfig) shieldedConfig() *compute.ShieldedInstanceConfig {
+	return &compute.ShieldedInstanceConfig{
+		EnableSecureBoot:          sc.SecureBoot,
+		EnableVtpm:                sc.VTPM,
+		EnableIntegrityMonitoring: sc.IntegrityMonitoring,
+		ForceSendFields:           []string{"EnableSecureBoot", "EnableVtpm", "EnableIntegrityMonitoring"},
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Load balancer balancing modes which report utilization the autoscaler can
+// scale on.
+var utilizationBalancingModes = map[string]bool{
+	"UTILIZATION": true,
+	"RATE":        true,
+}
+
+// checkSignalsAgainstProject verifies the parts of the signal combination
+// which depend on resources in the project: load balancing utilization only
+// works when the group is a backend whose balancing mode reports it.
+func checkSignalsAgainstProject(ctx context.Context, s *compute.Service, c *policyConfig, mig *compute.InstanceGroupManager) error {
+	if c.LoadBalancingUtilization <= 0 {
+		return nil
+	}
+	bs, err := s.BackendServices.Get(c.Project, c.BackendService).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to get backend service %v: %v", c.BackendService, err)
+	}
+	for _, b := range bs.Backends {
+		if path.Base(b.Group) != path.Base(mig.InstanceGroup) {
+			continue
+		}
+		if !utilizationBalancingModes[b.BalancingMode] {
+			return fmt.Errorf("loadBalancingUtilization needs balancing mode UTILIZATION or RATE, but %v uses %v in %v",
+				c.Group, b.BalancingMode, c.BackendService)
+		}
+		return nil
+	}
+	return fmt.Errorf("loadBalancingUtilization requires %v to be a backend of %v", c.Group, c.BackendService)
+}
@@ -0,0 +1,267 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The autoscaler only scales in to the largest size it recommended over this
+// window, which damps oscillation.
+const scaleInStabilization = 10 * time.Minute
+
+// A tracePoint is one row of a load trace: the offered load starting at a
+// given offset into the run.
+type tracePoint struct {
+	offset time.Duration
+	qps    float64
+	// demand is the CPU the load needs, in fully busy instances.
+	demand float64
+}
+
+// A simStep is the simulated state of the group at one point in time.
+type simStep struct {
+	Seconds     float64 `json:"seconds"`
+	QPS         float64 `json:"qps"`
+	Demand      float64 `json:"demand"`
+	Utilization float64 `json:"utilization"`
+	Recommended int64   `json:"recommendedSize"`
+	TargetSize  int64   `json:"targetSize"`
+	Serving     int64   `json:"servingSize"`
+}
+
+// A simulator replays a load trace against a model of the autoscaler and of
+// instance boot times.
+type simulator struct {
+	policy     *policyConfig
+	step       time.Duration
+	bootTime   time.Duration
+	bootJitter time.Duration
+	rand       *rand.Rand
+}
+
+// simulateCmd runs the simulator over a trace and writes the replica count
+// timeline.
+func simulateCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler simulate", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	tracePath := fs.String("trace", "", "CSV load trace with rows of SECONDS,QPS[,CPU_INSTANCES].")
+	qpsPerInstance := fs.Float64("qps-per-instance", 10, "QPS one fully busy instance serves; used when the trace has no CPU column.")
+	step := fs.Duration("step", 15*time.Second, "Simulation time step.")
+	bootTime := fs.Duration("boot-time", 90*time.Second, "Time from creation until an instance serves.")
+	bootJitter := fs.Duration("boot-jitter", 15*time.Second, "Maximum random extra boot time per instance.")
+	seed := fs.Int64("seed", 1, "Random seed for boot jitter.")
+	format := fs.String("format", "csv", "Output format: csv or json.")
+	fs.Parse(args)
+	if *tracePath == "" {
+		return errors.New("-trace is required")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.CPUUtilization <= 0 {
+		return errors.New("the simulator models the CPU utilization signal; set cpuUtilization")
+	}
+	trace, err := readTrace(*tracePath, *qpsPerInstance)
+	if err != nil {
+		return err
+	}
+	sim := &simulator{
+		policy:     c,
+		step:       *step,
+		bootTime:   *bootTime,
+		bootJitter: *bootJitter,
+		rand:       rand.New(rand.NewSource(*seed)),
+	}
+	steps := sim.run(trace)
+	switch *format {
+	case "csv":
+		return writeSimCSV(os.Stdout, steps)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for _, s := range steps {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+// readTrace parses a CSV load trace. Rows must be ordered by offset. When a
+// row has no CPU column its demand is derived from qpsPerInstance.
+func readTrace(path string, qpsPerInstance float64) ([]tracePoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	var trace []tracePoint
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("%v:%d: expected at least 2 columns", path, line)
+		}
+		secs, err := strconv.ParseFloat(rec[0], 64)
+		if err != nil {
+			if line == 1 {
+				continue // Header row.
+			}
+			return nil, fmt.Errorf("%v:%d: bad offset: %v", path, line, err)
+		}
+		p := tracePoint{offset: time.Duration(secs * float64(time.Second))}
+		if p.qps, err = strconv.ParseFloat(rec[1], 64); err != nil {
+			return nil, fmt.Errorf("%v:%d: bad qps: %v", path, line, err)
+		}
+		p.demand = p.qps / qpsPerInstance
+		if len(rec) > 2 {
+			if p.demand, err = strconv.ParseFloat(rec[2], 64); err != nil {
+				return nil, fmt.Errorf("%v:%d: bad cpu: %v", path, line, err)
+			}
+		}
+		if n := len(trace); n > 0 && p.offset < trace[n-1].offset {
+			return nil, fmt.Errorf("%v:%d: trace is not ordered by offset", path, line)
+		}
+		trace = append(trace, p)
+	}
+	if len(trace) == 0 {
+		return nil, fmt.Errorf("%v: trace is empty", path)
+	}
+	return trace, nil
+}
+
+// run steps through the trace, returning the state of the group after each
+// step. The group starts at its minimum size with every instance serving.
+func (sim *simulator) run(trace []tracePoint) []simStep {
+	p := sim.policy
+	target := p.MinReplicas
+	if target < 1 {
+		target = 1
+	}
+	// readyAt holds, for each instance, the offset at which it starts serving.
+	readyAt := make([]time.Duration, target)
+	var history []simStep
+	end := trace[len(trace)-1].offset
+	next := 0
+	var load tracePoint
+	for now := time.Duration(0); now <= end; now += sim.step {
+		for next < len(trace) && trace[next].offset <= now {
+			load = trace[next]
+			next++
+		}
+		var serving int64
+		for _, t := range readyAt {
+			if t <= now {
+				serving++
+			}
+		}
+		var util float64
+		switch {
+		case serving > 0:
+			util = math.Min(load.demand/float64(serving), 1)
+		case load.demand > 0:
+			util = 1
+		}
+
+		recommended := int64(math.Ceil(load.demand / p.CPUUtilization))
+		if recommended < p.MinReplicas {
+			recommended = p.MinReplicas
+		}
+		if recommended > p.MaxReplicas {
+			recommended = p.MaxReplicas
+		}
+		// Scale in only as far as the largest recent recommendation allows.
+		newTarget := recommended
+		for i := len(history) - 1; i >= 0 && now-sim.offset(history[i]) < scaleInStabilization; i-- {
+			if history[i].Recommended > newTarget {
+				newTarget = history[i].Recommended
+			}
+		}
+		target = newTarget
+		for int64(len(readyAt)) < target {
+			readyAt = append(readyAt, now+sim.bootDelay())
+		}
+		if int64(len(readyAt)) > target {
+			readyAt = readyAt[:target]
+		}
+
+		history = append(history, simStep{
+			Seconds:     now.Seconds(),
+			QPS:         load.qps,
+			Demand:      load.demand,
+			Utilization: util,
+			Recommended: recommended,
+			TargetSize:  target,
+			Serving:     serving,
+		})
+	}
+	return history
+}
+
+// offset returns the time into the run of a step.
+func (sim *simulator) offset(s simStep) time.Duration {
+	return time.Duration(s.Seconds * float64(time.Second))
+}
+
+// bootDelay returns how long a newly created instance takes to serve.
+func (sim *simulator) bootDelay() time.Duration {
+	d := sim.bootTime
+	if sim.bootJitter > 0 {
+		d += time.Duration(sim.rand.Int63n(int64(sim.bootJitter)))
+	}
+	return d
+}
+
+// writeSimCSV writes the simulated timeline as CSV with a header row.
+func writeSimCSV(out io.Writer, steps []simStep) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"seconds", "qps", "demand", "utilization", "recommended_size", "target_size", "serving_size"})
+	for _, s := range steps {
+		w.Write([]string{
+			strconv.FormatFloat(s.Seconds, 'f', -1, 64),
+			strconv.FormatFloat(s.QPS, 'f', 2, 64),
+			strconv.FormatFloat(s.Demand, 'f', 2, 64),
+			strconv.FormatFloat(s.Utilization, 'f', 3, 64),
+			strconv.FormatInt(s.Recommended, 10),
+			strconv.FormatInt(s.TargetSize, 10),
+			strconv.FormatInt(s.Serving, 10),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
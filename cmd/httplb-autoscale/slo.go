@@ -0,0 +1,310 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An slo is a service level objective: the fraction of requests which must
+// be good.
+type slo struct {
+	name      string
+	objective float64
+	// total counts the requests of a row the objective holds to, and bad
+	// estimates how many of them were bad.
+	total func(r *mergedRow) float64
+	bad   func(r *mergedRow) float64
+}
+
+// allRequests counts all of a row's requests.
+func allRequests(r *mergedRow) float64 {
+	return float64(r.Requests)
+}
+
+// successfulRequests counts the requests of a row which did not fail.
+func successfulRequests(r *mergedRow) float64 {
+	return float64(r.Requests - r.Errors)
+}
+
+// budget returns the fraction of requests allowed to be bad.
+func (o *slo) budget() float64 {
+	return 1 - o.objective
+}
+
+// slowRequests estimates how many of a row's requests took longer than the
+// threshold from its latency percentiles. Rows only record p50, p95 and
+// p99, so this is a lower bound: a row whose p99 is over the threshold has
+// at least 1% slow requests.
+func slowRequests(r *mergedRow, thresholdMs float64) float64 {
+	ok := successfulRequests(r)
+	switch {
+	case r.P50Ms > thresholdMs:
+		return 0.5 * ok
+	case r.P95Ms > thresholdMs:
+		return 0.05 * ok
+	case r.P99Ms > thresholdMs:
+		return 0.01 * ok
+	}
+	return 0
+}
+
+// A breach is a stretch of the run during which an SLO burned its error
+// budget faster than allowed.
+type breach struct {
+	start, end time.Time
+	peakBurn   float64
+}
+
+// burnRates slides a window of the given width over the rows, one row at a
+// time, and returns the burn rate at the end of each position: the fraction
+// of the window's requests held to the SLO which were bad, divided by the
+// error budget. A burn rate of
+// 1 uses the budget up exactly over the SLO period.
+func burnRates(o *slo, rows []*mergedRow, window time.Duration) []float64 {
+	rates := make([]float64, len(rows))
+	width := rowWidth(rows)
+	var bad, total float64
+	first := 0
+	for i, r := range rows {
+		bad += o.bad(r)
+		total += o.total(r)
+		for first < i && rows[first].Time.Add(window).Before(r.Time.Add(width)) {
+			bad -= o.bad(rows[first])
+			total -= o.total(rows[first])
+			first++
+		}
+		if total > 0 {
+			rates[i] = bad / total / o.budget()
+		}
+	}
+	return rates
+}
+
+// rowWidth returns the width of the rows of a merged timeline.
+func rowWidth(rows []*mergedRow) time.Duration {
+	if len(rows) < 2 {
+		return time.Minute
+	}
+	return rows[1].Time.Sub(rows[0].Time)
+}
+
+// breaches returns the stretches in which the burn rate exceeded the
+// threshold.
+func breaches(rows []*mergedRow, rates []float64, threshold float64) []*breach {
+	width := rowWidth(rows)
+	var out []*breach
+	var cur *breach
+	for i, rate := range rates {
+		if rate <= threshold {
+			cur = nil
+			continue
+		}
+		if cur == nil {
+			cur = &breach{start: rows[i].Time}
+			out = append(out, cur)
+		}
+		cur.end = rows[i].Time.Add(width)
+		cur.peakBurn = maxFloat(cur.peakBurn, rate)
+	}
+	return out
+}
+
+// durationsFlag is a comma separated list of durations.
+type durationsFlag []time.Duration
+
+func (f *durationsFlag) String() string {
+	s := make([]string, len(*f))
+	for i, d := range *f {
+		s[i] = d.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *durationsFlag) Set(v string) error {
+	*f = nil
+	for _, s := range strings.Split(v, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		*f = append(*f, d)
+	}
+	return nil
+}
+
+// readMergedRun reads a file written by report merge.
+func readMergedRun(path string) ([]*mergedRow, error) {
+	var rows []*mergedRow
+	err := readJSONLines(path, func(line []byte) error {
+		r := &mergedRow{}
+		rows = append(rows, r)
+		return json.Unmarshal(line, r)
+	})
+	return rows, err
+}
+
+// sloFlags are the flags defining the SLOs a run is held to, shared by
+// the commands which evaluate them.
+type sloFlags struct {
+	availability, latencyObjective, latencyMs, threshold *float64
+	windows                                              durationsFlag
+}
+
+// addSLOFlags defines the SLO flags on fs.
+func addSLOFlags(fs *flag.FlagSet) *sloFlags {
+	f := &sloFlags{
+		availability:     fs.Float64("availability", 0.999, "Availability objective: the fraction of requests which must succeed."),
+		latencyObjective: fs.Float64("latency", 0.99, "Latency objective: the fraction of successful requests which must be faster than -latency-ms."),
+		latencyMs:        fs.Float64("latency-ms", 500, "Latency threshold of the latency objective, in milliseconds."),
+		threshold:        fs.Float64("burn-threshold", 2, "Burn rate above which a window is a breach."),
+		windows:          durationsFlag{5 * time.Minute, 30 * time.Minute},
+	}
+	fs.Var(&f.windows, "windows", "Comma separated widths of the sliding windows.")
+	return f
+}
+
+// check verifies the objectives.
+func (f *sloFlags) check() error {
+	for _, o := range []float64{*f.availability, *f.latencyObjective} {
+		if o <= 0 || o >= 1 {
+			return errors.New("objectives must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// evaluate holds the rows of a merged timeline to the SLOs.
+func (f *sloFlags) evaluate(rows []*mergedRow) ([]sloResult, error) {
+	latencyMs := *f.latencyMs
+	slos := []*slo{
+		{name: fmt.Sprintf("availability %.2f%%", 100**f.availability), objective: *f.availability,
+			total: allRequests, bad: func(r *mergedRow) float64 { return float64(r.Errors) }},
+		{name: fmt.Sprintf("latency %.2f%% < %vms", 100**f.latencyObjective, latencyMs), objective: *f.latencyObjective,
+			total: successfulRequests, bad: func(r *mergedRow) float64 { return slowRequests(r, latencyMs) }},
+	}
+	results := []sloResult{}
+	for _, o := range slos {
+		var bad, total float64
+		for _, r := range rows {
+			bad += o.bad(r)
+			total += o.total(r)
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("the timeline records no requests held to %v", o.name)
+		}
+		res := sloResult{Name: o.name, Objective: o.objective, Good: 1 - bad/total, BudgetUsed: bad / total / o.budget()}
+		for _, w := range f.windows {
+			rates := burnRates(o, rows, w)
+			sw := sloWindow{WidthSec: w.Seconds(), Threshold: *f.threshold, Breaches: []sloBreach{}}
+			for _, r := range rates {
+				sw.PeakBurn = maxFloat(sw.PeakBurn, r)
+			}
+			for _, b := range breaches(rows, rates, *f.threshold) {
+				sw.Breaches = append(sw.Breaches, sloBreach{b.start, b.end, b.peakBurn})
+			}
+			res.Windows = append(res.Windows, sw)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// reportSLOCmd computes how fast a run burned the error budgets of an
+// availability and a latency SLO, over sliding windows of the merged
+// timeline, and lists the windows in which the burn rate broke the
+// threshold. With -junit the same results are written for CI systems, each
+// SLO assertion passing or failing as a test case.
+func reportSLOCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report slo", flag.ExitOnError)
+	mergedPath := fs.String("merged", "", "Merged timeline of the run, as written by report merge.")
+	junitPath := fs.String("junit", "", "Also write each objective and burn rate window as a test case of a JUnit XML report to this file.")
+	sf := addSLOFlags(fs)
+	fs.Parse(args)
+	if *mergedPath == "" {
+		return errors.New("-merged is required")
+	}
+	if err := sf.check(); err != nil {
+		return err
+	}
+
+	rows, err := readMergedRun(*mergedPath)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("%v has no rows", *mergedPath)
+	}
+	results, err := sf.evaluate(rows)
+	if err != nil {
+		return fmt.Errorf("%v: %v", *mergedPath, err)
+	}
+	if *junitPath != "" {
+		name := "slo." + strings.TrimSuffix(filepath.Base(*mergedPath), ".merged.jsonl")
+		suite := sloSuite(name, rows[0].Time, rows[len(rows)-1].Time.Add(rowWidth(rows)), results)
+		if err := writeJUnit(*junitPath, suite); err != nil {
+			return err
+		}
+	}
+	return printResult(results, func(w io.Writer) error {
+		for _, res := range results {
+			fmt.Fprintf(w, "SLO %s: %.3f%% good, %.0f%% of the error budget used over the run.\n", res.Name,
+				100*res.Good, 100*res.BudgetUsed)
+			for _, sw := range res.Windows {
+				fmt.Fprintf(w, "  %v windows: peak burn rate %.1f, %d breaches above %.1f\n",
+					time.Duration(sw.WidthSec)*time.Second, sw.PeakBurn, len(sw.Breaches), sw.Threshold)
+				for _, b := range sw.Breaches {
+					fmt.Fprintf(w, "    %v to %v, peak burn rate %.1f\n", b.Start.Format("15:04:05"), b.End.Format("15:04:05"), b.PeakBurn)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// An sloResult is how a run fared against one SLO.
+type sloResult struct {
+	Name      string  `json:"name"`
+	Objective float64 `json:"objective"`
+	// Good is the fraction of the requests held to the SLO over the run
+	// which were good, and BudgetUsed the fraction of the error budget the
+	// bad ones used.
+	Good       float64     `json:"good"`
+	BudgetUsed float64     `json:"budgetUsed"`
+	Windows    []sloWindow `json:"windows"`
+}
+
+// An sloWindow holds the burn rates over windows of one width.
+type sloWindow struct {
+	WidthSec  float64     `json:"widthSec"`
+	PeakBurn  float64     `json:"peakBurn"`
+	Threshold float64     `json:"threshold"`
+	Breaches  []sloBreach `json:"breaches"`
+}
+
+// An sloBreach is a stretch of windows whose burn rate broke the threshold.
+type sloBreach struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	PeakBurn float64   `json:"peakBurn"`
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"math"
+	"testing"
+	"time"
+)
+
+var runStart = time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// errorRows returns a row per minute from runStart, of 1000 requests with
+// the given errors.
+func errorRows(errs ...int) []*mergedRow {
+	rows := make([]*mergedRow, len(errs))
+	for i, e := range errs {
+		rows[i] = &mergedRow{Time: runStart.Add(time.Duration(i) * time.Minute), Requests: 1000, Errors: e}
+	}
+	return rows
+}
+
+// availability is a 99.9% availability SLO.
+var availability = &slo{name: "availability", objective: 0.999,
+	total: allRequests, bad: func(r *mergedRow) float64 { return float64(r.Errors) }}
+
+// near reports whether a and b agree to within rounding.
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestSlowRequests(t *testing.T) {
+	r := &mergedRow{Requests: 1100, Errors: 100, P50Ms: 100, P95Ms: 400, P99Ms: 900}
+	for _, c := range []struct {
+		thresholdMs, want float64
+	}{
+		{50, 500},
+		{200, 50},
+		{500, 10},
+		{1000, 0},
+	} {
+		if got := slowRequests(r, c.thresholdMs); !near(got, c.want) {
+			t.Errorf("slowRequests over %vms = %v, want %v of the 1000 successful requests", c.thresholdMs, got, c.want)
+		}
+	}
+}
+
+func TestBurnRates(t *testing.T) {
+	// The budget allows 1 error in 1000 requests.
+	rows := errorRows(0, 1, 4, 1, 0, 0)
+	rates := burnRates(availability, rows, 2*time.Minute)
+	want := []float64{0, 0.5, 2.5, 2.5, 0.5, 0}
+	for i := range want {
+		if !near(rates[i], want[i]) {
+			t.Errorf("burn rates over 2 minute windows = %v, want %v", rates, want)
+			break
+		}
+	}
+
+	// A window no wider than a row holds that row alone.
+	rates = burnRates(availability, rows, time.Minute)
+	for i, r := range rows {
+		if want := float64(r.Errors); !near(rates[i], want) {
+			t.Errorf("burn rate of minute %d = %v, want %v", i, rates[i], want)
+		}
+	}
+}
+
+func TestBurnRatesSkipIdleWindows(t *testing.T) {
+	rows := errorRows(0, 0)
+	rows[0].Requests = 0
+	rows[1].Requests = 0
+	for i, rate := range burnRates(availability, rows, 5*time.Minute) {
+		if rate != 0 {
+			t.Errorf("burn rate of minute %d without requests = %v, want 0", i, rate)
+		}
+	}
+}
+
+func TestBreaches(t *testing.T) {
+	rows := errorRows(0, 0, 0, 0, 0, 0, 0)
+	rates := []float64{1, 3, 5, 2, 0, 4, 2.5}
+	got := breaches(rows, rates, 2)
+	if len(got) != 2 {
+		t.Fatalf("found %d breaches, want 2", len(got))
+	}
+	for i, want := range []breach{
+		{start: runStart.Add(time.Minute), end: runStart.Add(3 * time.Minute), peakBurn: 5},
+		{start: runStart.Add(5 * time.Minute), end: runStart.Add(7 * time.Minute), peakBurn: 4},
+	} {
+		if b := got[i]; !b.start.Equal(want.start) || !b.end.Equal(want.end) || b.peakBurn != want.peakBurn {
+			t.Errorf("breach %d = %v to %v peaking at %v, want %v to %v peaking at %v",
+				i, b.start, b.end, b.peakBurn, want.start, want.end, want.peakBurn)
+		}
+	}
+}
+
+func TestEvaluateLatencyOfSuccessfulRequests(t *testing.T) {
+	fs := flag.NewFlagSet("slo", flag.ContinueOnError)
+	f := addSLOFlags(fs)
+	// A minute of 1000 requests, half of which fail, whose p99 is slow.
+	rows := errorRows(500)
+	rows[0].P99Ms = 900
+	results, err := f.evaluate(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1% of the 500 successful requests were slow, which uses the whole
+	// budget of the 99% objective.
+	latency := results[1]
+	if !near(latency.Good, 0.99) || !near(latency.BudgetUsed, 1) {
+		t.Errorf("%v: good %v using %v of the budget, want 0.99 using all of it", latency.Name, latency.Good, latency.BudgetUsed)
+	}
+	if rate := latency.Windows[0].PeakBurn; !near(rate, 1) {
+		t.Errorf("%v: peak burn rate = %v, want 1", latency.Name, rate)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A soakReport rolls up one window of a soak test, or the whole of it.
+type soakReport struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Requests  int64     `json:"requests"`
+	Errors    int64     `json:"errors"`
+	ErrorRate float64   `json:"errorRate"`
+	// The latencies of successful requests are known within 5%.
+	P50Ms float64 `json:"p50Ms"`
+	P95Ms float64 `json:"p95Ms"`
+	P99Ms float64 `json:"p99Ms"`
+	MaxMs float64 `json:"maxMs"`
+	// MinSize and MaxSize bound the number of instances in the group.
+	MinSize int `json:"minSize"`
+	MaxSize int `json:"maxSize"`
+	// InstancesAdded and InstancesRemoved count the instances which joined
+	// and left the group, its churn.
+	InstancesAdded   int     `json:"instancesAdded"`
+	InstancesRemoved int     `json:"instancesRemoved"`
+	InstanceHours    float64 `json:"instanceHours"`
+	// CostSoFarUSD estimates what the instances and the forwarding rule
+	// cost from the start of the soak test to End.
+	CostSoFarUSD float64 `json:"costSoFarUsd"`
+}
+
+// A soakSummary is the final aggregate of a soak test.
+type soakSummary struct {
+	soakReport
+	// Reports counts the rolled-up reports, and the worst fields are the
+	// worst of any of them.
+	Reports        int     `json:"reports"`
+	WorstP95Ms     float64 `json:"worstP95Ms"`
+	WorstErrorRate float64 `json:"worstErrorRate"`
+}
+
+// A soakWindow accumulates the requests and group observations of one
+// window in constant memory.
+type soakWindow struct {
+	start            time.Time
+	requests, errors int64
+	latencies        loadgen.LatencyHistogram
+	// sized is set once the group has been observed in the window.
+	sized            bool
+	minSize, maxSize int
+	added, removed   int
+	instanceHours    float64
+}
+
+// observeSize widens the window's size range to include size.
+func (w *soakWindow) observeSize(size int) {
+	if !w.sized || size < w.minSize {
+		w.minSize = size
+	}
+	if !w.sized || size > w.maxSize {
+		w.maxSize = size
+	}
+	w.sized = true
+}
+
+// report returns the window's report ending at end.
+func (w *soakWindow) report(end time.Time, cost float64) *soakReport {
+	r := &soakReport{
+		Start:            w.start,
+		End:              end,
+		Requests:         w.requests,
+		Errors:           w.errors,
+		P50Ms:            report.Millis(w.latencies.Percentile(0.5)),
+		P95Ms:            report.Millis(w.latencies.Percentile(0.95)),
+		P99Ms:            report.Millis(w.latencies.Percentile(0.99)),
+		MaxMs:            report.Millis(w.latencies.Max()),
+		MinSize:          w.minSize,
+		MaxSize:          w.maxSize,
+		InstancesAdded:   w.added,
+		InstancesRemoved: w.removed,
+		InstanceHours:    w.instanceHours,
+		CostSoFarUSD:     cost,
+	}
+	if w.requests > 0 {
+		r.ErrorRate = float64(w.errors) / float64(w.requests)
+	}
+	return r
+}
+
+// A soakAggregator feeds the requests and group observations of a soak test
+// into the current window and the whole run. It is safe for concurrent use.
+type soakAggregator struct {
+	mu            sync.Mutex
+	start         time.Time
+	window, total *soakWindow
+	// instances holds the group's instances at the last observation.
+	instances map[string]bool
+	lastSeen  time.Time
+	// instancePrice and rulePrice are hourly prices in USD.
+	instancePrice, rulePrice float64
+	summary                  soakSummary
+}
+
+// newSoakAggregator returns an aggregator of a soak test starting at start.
+func newSoakAggregator(start time.Time, instancePrice, rulePrice float64) *soakAggregator {
+	return &soakAggregator{
+		start:         start,
+		window:        &soakWindow{start: start},
+		total:         &soakWindow{start: start},
+		instancePrice: instancePrice,
+		rulePrice:     rulePrice,
+	}
+}
+
+// addSample counts one request.
+func (a *soakAggregator) addSample(s loadgen.Sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, w := range []*soakWindow{a.window, a.total} {
+		w.requests++
+		if !s.OK {
+			w.errors++
+			continue
+		}
+		w.latencies.Add(s.Latency)
+	}
+}
+
+// observe records the group's instances at t, counting those which joined
+// or left since the last observation and the instance hours in between.
+func (a *soakAggregator) observe(t time.Time, instances []*compute.ManagedInstance) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current := map[string]bool{}
+	for _, i := range instances {
+		current[i.Instance] = true
+	}
+	var added, removed int
+	var hours float64
+	if a.instances != nil {
+		for i := range current {
+			if !a.instances[i] {
+				added++
+			}
+		}
+		for i := range a.instances {
+			if !current[i] {
+				removed++
+			}
+		}
+		hours = float64(len(a.instances)) * t.Sub(a.lastSeen).Hours()
+	}
+	for _, w := range []*soakWindow{a.window, a.total} {
+		w.added += added
+		w.removed += removed
+		w.instanceHours += hours
+		w.observeSize(len(current))
+	}
+	a.instances, a.lastSeen = current, t
+}
+
+// cost estimates the cost of the soak test up to end. a.mu must be held.
+func (a *soakAggregator) cost(end time.Time) float64 {
+	return a.total.instanceHours*a.instancePrice + end.Sub(a.start).Hours()*a.rulePrice
+}
+
+// roll ends the current window at end and returns its report.
+func (a *soakAggregator) roll(end time.Time) *soakReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := a.window.report(end, a.cost(end))
+	a.summary.Reports++
+	if r.P95Ms > a.summary.WorstP95Ms {
+		a.summary.WorstP95Ms = r.P95Ms
+	}
+	if r.ErrorRate > a.summary.WorstErrorRate {
+		a.summary.WorstErrorRate = r.ErrorRate
+	}
+	a.window = &soakWindow{start: end}
+	if a.instances != nil {
+		a.window.observeSize(len(a.instances))
+	}
+	return r
+}
+
+// pending reports whether the current window has seen any request.
+func (a *soakAggregator) pending() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.window.requests > 0
+}
+
+// final returns the aggregate of the whole soak test, ending at end.
+func (a *soakAggregator) final(end time.Time) *soakSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.summary
+	s.soakReport = *a.total.report(end, a.cost(end))
+	return &s
+}
+
+// soakCmd offers a scenario's load for hours and, instead of one report of
+// the whole run, logs a rolled-up report of latency, errors, group churn
+// and cost so far every -report-every, then a final aggregate. Requests are
+// counted in constant memory as they complete, so runs of any length fit.
+// Interrupting the test ends it early with the final aggregate.
+func soakCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler soak", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config; its scenario is offered unless -scenario or -url is given.")
+	scenarioPath := fs.String("scenario", "", "YAML scenario with url, phases and traceSampleRate; overrides -url, -qps and -duration.")
+	url := fs.String("url", "", "URL to request, for a single phase scenario.")
+	qps := fs.Float64("qps", 10, "Request rate of the single phase.")
+	duration := fs.Duration("duration", 8*time.Hour, "Length of the single phase.")
+	every := fs.Duration("report-every", 15*time.Minute, "Interval between rolled-up reports.")
+	pollEvery := fs.Duration("poll", 30*time.Second, "Interval between observations of the group's instances.")
+	outPrefix := fs.String("out", "", "Append each rolled-up report to PREFIX.soak.jsonl and write the final aggregate to PREFIX.soak-final.json.")
+	instancePrice := fs.Float64("instance-price", 0, "Hourly price of one instance; 0 looks up the template's machine type.")
+	ruleHourly := fs.Float64("rule-price", 0.025, "Hourly price of the forwarding rule.")
+	fs.Parse(args)
+	if *every <= 0 || *pollEvery <= 0 {
+		return errors.New("-report-every and -poll must be positive")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	var scenarioConfig *policyConfig
+	if *url == "" {
+		scenarioConfig = c
+	}
+	sc, err := chooseScenario(fs, scenarioConfig, *scenarioPath, *url, *qps, *duration)
+	if err != nil {
+		return err
+	}
+	var t templateConfig
+	if c.InstanceTemplate != nil {
+		t = *c.InstanceTemplate
+	}
+	price := *instancePrice
+	if price == 0 {
+		if price, err = instanceHourlyPrice(t); err != nil {
+			return fmt.Errorf("%v; pass -instance-price", err)
+		}
+	}
+	if c.BackendService == "" {
+		*ruleHourly = 0
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+
+	var out io.Writer = ioutil.Discard
+	if *outPrefix != "" {
+		f, err := os.OpenFile(*outPrefix+".soak.jsonl", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+
+	agg := newSoakAggregator(time.Now().UTC(), price, *ruleHourly)
+	instances, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	agg.observe(time.Now().UTC(), instances)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var budget *budgetGuard
+	if c.Budget != nil {
+		if budget, err = newBudgetGuard(c, time.Now().Add(sc.Duration()), cancel); err != nil {
+			return err
+		}
+	}
+	id, err := runID(c, defaultStatePath)
+	if err != nil {
+		return err
+	}
+	nt := newNotifier(c.Notifications, "autoscaler soak", *configPath, id)
+	interrupted := stopChannel(0)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+	emit := func(r *soakReport) {
+		endProgress()
+		log.Printf("%v to %v: %d requests, %.2f%% errors, p95 %.0fms, p99 %.0fms, %d to %d instances, %d added, %d removed, $%.2f so far.",
+			r.Start.Format("15:04"), r.End.Format("15:04"), r.Requests, 100*r.ErrorRate, r.P95Ms, r.P99Ms,
+			r.MinSize, r.MaxSize, r.InstancesAdded, r.InstancesRemoved, r.CostSoFarUSD)
+		if err := enc.Encode(r); err != nil {
+			log.Printf("Unable to write the report: %v", err)
+		}
+		nt.observeSLO(ctx, r.ErrorRate, r.P95Ms, r)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		poll := time.NewTicker(*pollEvery)
+		defer poll.Stop()
+		roll := time.NewTicker(*every)
+		defer roll.Stop()
+		for {
+			select {
+			case <-poll.C:
+				instances, err := listManagedInstances(ctx, s, c)
+				if err != nil {
+					debugf(1, "Unable to observe %v: %v", c.Group, err)
+					continue
+				}
+				now := time.Now().UTC()
+				agg.observe(now, instances)
+				if budget != nil {
+					budget.observe(ctx, s, c, &report.WatchEvent{Time: now, Type: "state", Autoscaler: c.Autoscaler,
+						Group: c.Group, ActualSize: int64(len(instances))})
+				}
+			case now := <-roll.C:
+				emit(agg.roll(now.UTC()))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	log.Printf("Soaking %v for %v, reporting every %v.", sc.URL, sc.Duration(), *every)
+	_, err = runLoad(ctx, sc, loadgen.OnSample(agg.addSample), loadgen.Retain(time.Minute))
+	close(stop)
+	<-done
+	// The run's context may be done; notifications are sent regardless.
+	event, msg := notifyCompleted, fmt.Sprintf("soak test of %v finished", sc.URL)
+	if err != nil {
+		select {
+		case <-interrupted:
+			log.Printf("Interrupted; reporting the soak test so far.")
+			event, msg = notifyAborted, fmt.Sprintf("soak test of %v was interrupted", sc.URL)
+		default:
+			if budget == nil || budget.exceeded == "" {
+				nt.send(context.Background(), notifyAborted, fmt.Sprintf("soak test of %v failed: %v", sc.URL, err), nil)
+				return err
+			}
+			log.Printf("Aborted over budget; reporting the soak test so far.")
+			event, msg = notifyAborted, "soak test aborted: "+budget.exceeded
+		}
+	}
+
+	end := time.Now().UTC()
+	if instances, err := listManagedInstances(context.Background(), s, c); err == nil {
+		agg.observe(end, instances)
+	}
+	if agg.pending() {
+		emit(agg.roll(end))
+	}
+	sum := agg.final(end)
+	nt.send(context.Background(), event, msg, sum)
+	if *outPrefix != "" {
+		b, err := json.MarshalIndent(sum, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*outPrefix+".soak-final.json", b, 0644); err != nil {
+			return err
+		}
+	}
+	return printResult(sum, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintf(tw, "Duration\t%v (%d reports)\n", sum.End.Sub(sum.Start).Round(time.Second), sum.Reports)
+		fmt.Fprintf(tw, "Requests\t%d, %.2f%% errors (worst report %.2f%%)\n", sum.Requests, 100*sum.ErrorRate,
+			100*sum.WorstErrorRate)
+		fmt.Fprintf(tw, "Latency\tp50 %.1fms, p95 %.1fms, p99 %.1fms, max %.1fms\n", sum.P50Ms, sum.P95Ms,
+			sum.P99Ms, sum.MaxMs)
+		fmt.Fprintf(tw, "Worst report p95\t%.1fms\n", sum.WorstP95Ms)
+		fmt.Fprintf(tw, "Instances\t%d to %d, %d added, %d removed\n", sum.MinSize, sum.MaxSize,
+			sum.InstancesAdded, sum.InstancesRemoved)
+		fmt.Fprintf(tw, "Instance hours\t%.2f\n", sum.InstanceHours)
+		fmt.Fprintf(tw, "Estimated cost\t$%.2f\n", sum.CostSoFarUSD)
+		return tw.Flush()
+	})
+}
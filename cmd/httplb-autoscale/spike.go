@@ -0,0 +1,153 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// How close to a 5xx spike a scaling action must be to be blamed for it.
+// Load balancer metrics are aligned on whole minutes, so an action late in
+// the previous minute can still cause errors in the spike's.
+const spikeCorrelationWindow = 2 * time.Minute
+
+// A scalingAction is a change of the group observed by the watcher.
+type scalingAction struct {
+	time time.Time
+	desc string
+}
+
+// An errorSpikeDetector flags minutes in which the load balancer served more
+// 5xx responses than a threshold allows, and names the scaling actions which
+// happened around them. Scale-in in particular can drop connections to
+// instances which are still serving, which shows up as 502s. Any spike marks
+// the run as degraded.
+type errorSpikeDetector struct {
+	w *metricsWatcher
+	// maxRate is the largest acceptable fraction of 5xx responses.
+	maxRate float64
+	// minQPS ignores minutes with too little traffic to judge.
+	minQPS float64
+	// webhook, if set, receives each alert as a JSON POST.
+	webhook string
+
+	lastQuery time.Time
+	// checked is the end of the newest minute already judged.
+	checked  time.Time
+	spiking  bool
+	spikes   int
+	prev     *report.WatchEvent
+	actions  []scalingAction
+	degraded bool
+}
+
+// observe records the scaling actions revealed by a sample: changes of the
+// target size and instances being recreated.
+func (d *errorSpikeDetector) observe(e *report.WatchEvent) {
+	switch {
+	case e.Type == "instance-recreating" || e.Type == "instance-preempted" || strings.HasPrefix(e.Type, "chaos-"):
+		d.actions = append(d.actions, scalingAction{e.Time, e.Message})
+	case e.Type != "state":
+	case d.prev != nil && e.TargetSize < d.prev.TargetSize:
+		d.actions = append(d.actions, scalingAction{e.Time, fmt.Sprintf("scale-in %d→%d", d.prev.TargetSize, e.TargetSize)})
+	case d.prev != nil && e.TargetSize > d.prev.TargetSize:
+		d.actions = append(d.actions, scalingAction{e.Time, fmt.Sprintf("scale-out %d→%d", d.prev.TargetSize, e.TargetSize)})
+	}
+	if e.Type == "state" {
+		d.prev = e
+	}
+	// Forget actions too old to correlate with any minute still to be
+	// judged.
+	for len(d.actions) > 0 && d.actions[0].time.Before(d.checked.Add(-metricsLookback-spikeCorrelationWindow)) {
+		d.actions = d.actions[1:]
+	}
+}
+
+// check queries the load balancer's request and 5xx rates, at most once a
+// minute, and returns an alert event for each minute starting or ending a
+// spike.
+func (d *errorSpikeDetector) check(ctx context.Context, e *report.WatchEvent) []*report.WatchEvent {
+	if e.Time.Sub(d.lastQuery) < time.Minute {
+		return nil
+	}
+	if d.lastQuery.IsZero() {
+		// Only judge minutes which end after the watch started.
+		d.checked = e.Time
+	}
+	d.lastQuery = e.Time
+	end := e.Time
+	start := end.Add(-metricsLookback)
+	requests, err := d.w.query(ctx, lbMetrics[0], start, end)
+	if err != nil {
+		log.Printf("Unable to query %v: %v", lbMetrics[0].Name, err)
+		return nil
+	}
+	errors, err := d.w.query(ctx, lbMetrics[1], start, end)
+	if err != nil {
+		log.Printf("Unable to query %v: %v", lbMetrics[1].Name, err)
+		return nil
+	}
+	errorRates := map[time.Time]float64{}
+	for _, p := range errors {
+		errorRates[p.Time] = p.Value
+	}
+	var alerts []*report.WatchEvent
+	for _, p := range requests {
+		if !p.Time.After(d.checked) {
+			continue
+		}
+		d.checked = p.Time
+		if p.Value < d.minQPS {
+			continue
+		}
+		rate := errorRates[p.Time] / p.Value
+		switch {
+		case rate > d.maxRate && !d.spiking:
+			d.spiking, d.degraded = true, true
+			d.spikes++
+			msg := fmt.Sprintf("5xx responses were %.1f%% of %.1f req/s in the minute to %v, above %.1f%%",
+				100*rate, p.Value, p.Time.Format("15:04"), 100*d.maxRate)
+			if causes := d.nearbyActions(p.Time); len(causes) > 0 {
+				msg += "; concurrent scaling: " + strings.Join(causes, ", ")
+			} else {
+				msg += "; no concurrent scaling"
+			}
+			alerts = append(alerts, raiseAlert(d.webhook, e, "5xx-spike", msg))
+		case rate <= d.maxRate && d.spiking:
+			d.spiking = false
+			alerts = append(alerts, raiseAlert(d.webhook, e, "5xx-spike-cleared",
+				fmt.Sprintf("5xx responses fell to %.1f%% in the minute to %v", 100*rate, p.Time.Format("15:04"))))
+		}
+	}
+	return alerts
+}
+
+// nearbyActions describes the scaling actions within the correlation
+// window of the minute ending at t.
+func (d *errorSpikeDetector) nearbyActions(t time.Time) []string {
+	var descs []string
+	for _, a := range d.actions {
+		if a.time.After(t.Add(-time.Minute-spikeCorrelationWindow)) && a.time.Before(t.Add(spikeCorrelationWindow)) {
+			descs = append(descs, fmt.Sprintf("%s at %v", a.desc, a.time.Format("15:04:05")))
+		}
+	}
+	return descs
+}
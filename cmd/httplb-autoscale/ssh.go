@@ -0,0 +1,166 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// sshArgs returns the gcloud arguments which open an SSH session to an
+// instance. gcloud takes care of OS Login and of IAP tunnelling, which
+// reaches instances without external addresses.
+func sshArgs(c *policyConfig, zone, name string, iap bool, command string) []string {
+	args := []string{"compute", "ssh", name, "--project", c.Project, "--zone", zone}
+	if iap {
+		args = append(args, "--tunnel-through-iap")
+	}
+	if command != "" {
+		args = append(args, "--command", command)
+	}
+	return args
+}
+
+// sortedInstances returns the group's instances sorted by name, so that an
+// index picks the same instance between calls while the group is unchanged.
+func sortedInstances(ctx context.Context, s *compute.Service, c *policyConfig) ([]*compute.ManagedInstance, error) {
+	instances, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Instance < instances[j].Instance })
+	return instances, nil
+}
+
+// prefixLines copies r to w, prefixing every line, so that the output of
+// several instances can be told apart.
+func prefixLines(w io.Writer, mu *sync.Mutex, prefix string, r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		mu.Lock()
+		fmt.Fprintf(w, "%s: %s\n", prefix, sc.Text())
+		mu.Unlock()
+	}
+}
+
+// sshCmd opens an SSH session to one instance of the group, chosen by name
+// or by its index in name order, or runs a command on every instance.
+func sshCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("mig ssh", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	name := fs.String("instance", "", "Name of the instance to connect to.")
+	index := fs.Int("index", 0, "Index, in name order, of the instance to connect to if -instance is not set.")
+	all := fs.Bool("all", false, "Run the command on every instance instead of opening a session.")
+	iap := fs.Bool("iap", false, "Connect through an IAP tunnel, for instances without external addresses.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mig ssh [flags] [-- COMMAND...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	command := strings.Join(fs.Args(), " ")
+	if *all && command == "" {
+		return errors.New("-all needs a command to run")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	instances, err := sortedInstances(ctx, s, c)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return fmt.Errorf("group %v has no instances", c.Group)
+	}
+
+	if !*all {
+		var target *compute.ManagedInstance
+		for _, i := range instances {
+			if path.Base(i.Instance) == *name {
+				target = i
+			}
+		}
+		switch {
+		case *name != "" && target == nil:
+			return fmt.Errorf("group %v has no instance %v", c.Group, *name)
+		case *name == "" && (*index < 0 || *index >= len(instances)):
+			return fmt.Errorf("-index must be between 0 and %d", len(instances)-1)
+		case *name == "":
+			target = instances[*index]
+		}
+		cmd := exec.Command("gcloud", sshArgs(c, instanceZone(target.Instance), path.Base(target.Instance), *iap, command)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return cmd.Run()
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for _, i := range instances {
+		n := path.Base(i.Instance)
+		cmd := exec.Command("gcloud", sshArgs(c, instanceZone(i.Instance), n, *iap, command)...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("unable to run gcloud: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var copying sync.WaitGroup
+			copying.Add(2)
+			go func() { prefixLines(os.Stdout, &mu, n, stdout); copying.Done() }()
+			go func() { prefixLines(os.Stderr, &mu, n, stderr); copying.Done() }()
+			copying.Wait()
+			if err := cmd.Wait(); err != nil {
+				mu.Lock()
+				failed = append(failed, n)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("command failed on %d of %d instances: %v", len(failed), len(instances),
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+// Defaults for the generated file server.
+const (
+	defaultServerPort = 80
+	// Go release installed on the backends to run the file server.
+	serverGoVersion = "1.21.6"
+)
+
+// A serverConfig describes the file server which the generated startup
+// script runs on each backend. It serves the corpus written to the bucket by
+// generate_files.go, burning CPU on every request so that the autoscaler has
+// something to scale on:
+//
+//	instanceTemplate:
+//	  server:
+//	    bucket: my-project-images
+//	    port: 80
+//	    burnMillis: 50
+//	    trace: true
+type serverConfig struct {
+	Bucket string `yaml:"bucket"`
+	Port   int    `yaml:"port"`
+	// BurnMillis is the CPU time spent on each request, in milliseconds.
+	BurnMillis int `yaml:"burnMillis"`
+	// Trace writes a span for each request sampled by the load generator,
+	// with child spans for the CPU burn and the Cloud Storage fetch, to
+	// Cloud Trace.
+	Trace bool `yaml:"trace"`
+}
+
+// check verifies that the server config can be turned into a script.
+func (sc *serverConfig) check() error {
+	switch {
+	case sc.Bucket == "":
+		return errors.New("server bucket is required")
+	case sc.Port < 0 || sc.Port > 65535:
+		return fmt.Errorf("server port %d is out of range", sc.Port)
+	case sc.BurnMillis < 0:
+		return errors.New("server burnMillis must not be negative")
+	}
+	return nil
+}
+
+// startupScript renders the startup script for the server.
+func (sc *serverConfig) startupScript() (string, error) {
+	if err := sc.check(); err != nil {
+		return "", err
+	}
+	params := *sc
+	if params.Port == 0 {
+		params.Port = defaultServerPort
+	}
+	var b bytes.Buffer
+	err := startupScriptTemplate.Execute(&b, struct {
+		serverConfig
+		GoVersion string
+		Source    string
+	}{params, serverGoVersion, fileServerSource})
+	return b.String(), err
+}
+
+// startupScriptTemplate installs Go, writes the file server to disk and runs
+// it, restarting it if it exits.
+var startupScriptTemplate = template.Must(template.New("startup").Parse(`#!/bin/bash
+# Generated by autoscaling template create. Serves gs://{{.Bucket}} on port
+# {{.Port}}, burning {{.BurnMillis}}ms of CPU per request.
+
+curl -sSL -o /tmp/go.tar.gz https://storage.googleapis.com/golang/go{{.GoVersion}}.linux-amd64.tar.gz
+tar -C /usr/local -xzf /tmp/go.tar.gz
+export PATH=$PATH:/usr/local/go/bin
+export HOME=/root GOCACHE=/tmp/gocache
+
+mkdir -p /opt/fileserver
+cat > /opt/fileserver/main.go <<'EOF'
+{{.Source}}EOF
+
+cd /opt/fileserver
+go build -o fileserver main.go
+while :
+do
+  ./fileserver -bucket={{.Bucket}} -port={{.Port}} -burn={{.BurnMillis}}ms -trace={{.Trace}}
+  sleep 1
+done
+`))
+
+// fileServerSource is the program run by the startup script. It needs only
+// the standard library, so it builds without network access to module
+// proxies.
+const fileServerSource = `// Command fileserver serves objects from a public Cloud Storage bucket,
+// identifying the instance which served each response. With -trace it
+// writes spans of the requests its callers sampled to Cloud Trace.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	bucket = flag.String("bucket", "", "Bucket to serve.")
+	port   = flag.Int("port", 80, "Port to listen on.")
+	burn   = flag.Duration("burn", 0, "CPU time to spend on each request.")
+	trace  = flag.Bool("trace", false, "Write spans of sampled requests to Cloud Trace.")
+)
+
+func metadata(key string) string {
+	req, _ := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/"+key, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "unknown"
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func spin(d time.Duration) {
+	for end := time.Now().Add(d); time.Now().Before(end); {
+	}
+}
+
+// traceContext returns the trace and parent span of a request from its
+// traceparent or X-Cloud-Trace-Context header, and whether it was sampled.
+func traceContext(r *http.Request) (string, string, bool) {
+	if tp := strings.Split(r.Header.Get("traceparent"), "-"); len(tp) == 4 {
+		return tp[1], tp[2], tp[3] == "01"
+	}
+	h := r.Header.Get("X-Cloud-Trace-Context")
+	i := strings.Index(h, "/")
+	if i < 0 || !strings.HasSuffix(h, ";o=1") {
+		return "", "", false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(h[i+1:], ";o=1"), 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	return h[:i], fmt.Sprintf("%016x", id), true
+}
+
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// A tracer batches finished spans and writes them to Cloud Trace with the
+// instance's service account.
+type tracer struct {
+	project string
+	mu      sync.Mutex
+	spans   []map[string]interface{}
+	token   string
+	expiry  time.Time
+}
+
+func (t *tracer) add(traceID, id, parent, name string, start, end time.Time, labels map[string]string) {
+	attrs := map[string]interface{}{}
+	for k, v := range labels {
+		attrs[k] = map[string]interface{}{"stringValue": map[string]string{"value": v}}
+	}
+	s := map[string]interface{}{
+		"name":        fmt.Sprintf("projects/%s/traces/%s/spans/%s", t.project, traceID, id),
+		"spanId":      id,
+		"displayName": map[string]string{"value": name},
+		"startTime":   start.UTC().Format(time.RFC3339Nano),
+		"endTime":     end.UTC().Format(time.RFC3339Nano),
+		"attributes":  map[string]interface{}{"attributeMap": attrs},
+	}
+	if parent != "" {
+		s["parentSpanId"] = parent
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+}
+
+func (t *tracer) accessToken() (string, error) {
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+	var tok map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata("instance/service-accounts/default/token")), &tok); err != nil {
+		return "", err
+	}
+	token, _ := tok["access_token"].(string)
+	expiresIn, _ := tok["expires_in"].(float64)
+	t.token, t.expiry = token, time.Now().Add(time.Duration(expiresIn)*time.Second-time.Minute)
+	return t.token, nil
+}
+
+func (t *tracer) flushLoop() {
+	for range time.Tick(5 * time.Second) {
+		t.mu.Lock()
+		spans := t.spans
+		t.spans = nil
+		t.mu.Unlock()
+		if len(spans) == 0 {
+			continue
+		}
+		if err := t.write(spans); err != nil {
+			log.Printf("Unable to write %d spans: %v", len(spans), err)
+		}
+	}
+}
+
+func (t *tracer) write(spans []map[string]interface{}) error {
+	token, err := t.accessToken()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(map[string]interface{}{"spans": spans})
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest("POST", "https://cloudtrace.googleapis.com/v2/projects/"+t.project+"/traces:batchWrite", bytes.NewReader(b))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Cloud Trace returned %s", resp.Status)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	name, _ := os.Hostname()
+	zone := path.Base(metadata("instance/zone"))
+	var tr *tracer
+	if *trace {
+		tr = &tracer{project: metadata("project/project-id")}
+		go tr.flushLoop()
+	}
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		traceID, parent, sampled := traceContext(r)
+		sampled = sampled && tr != nil
+		root := newSpanID()
+		status := http.StatusOK
+		if sampled {
+			defer func() {
+				tr.add(traceID, root, parent, "fileserver "+r.URL.Path, start, time.Now(), map[string]string{
+					"/http/status_code": strconv.Itoa(status), "instance": name, "zone": zone})
+			}()
+		}
+		spin(*burn)
+		if sampled {
+			tr.add(traceID, newSpanID(), root, "burn", start, time.Now(), nil)
+		}
+		w.Header().Set("X-Instance", name)
+		w.Header().Set("X-Zone", zone)
+		if r.URL.Path == "/" {
+			fmt.Fprintf(w, "%s in %s serving gs://%s\n", name, zone, *bucket)
+			return
+		}
+		fetchStart := time.Now()
+		resp, err := http.Get("https://storage.googleapis.com/" + *bucket + r.URL.Path)
+		if err != nil {
+			status = http.StatusBadGateway
+			http.Error(w, err.Error(), status)
+			return
+		}
+		defer resp.Body.Close()
+		status = resp.StatusCode
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		if sampled {
+			tr.add(traceID, newSpanID(), root, "gcs-fetch", fetchStart, time.Now(), map[string]string{
+				"/http/status_code": strconv.Itoa(status)})
+		}
+	})
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
+`
+
+// startupScriptCmd prints the startup script generated from the server
+// section of the config, so that it can be inspected before template create
+// embeds it.
+func startupScriptCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("template startup-script", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c.InstanceTemplate == nil || c.InstanceTemplate.Server == nil {
+		return errors.New("config has no instanceTemplate.server section")
+	}
+	script, err := c.InstanceTemplate.Server.startupScript()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.WriteString(script)
+	return err
+}
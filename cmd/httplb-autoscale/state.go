@@ -0,0 +1,92 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Default location of the local state file.
+const defaultStatePath = ".autoscaling-state.json"
+
+// stateMu serializes the commands which read, modify and save the state
+// file, as demo run runs several of them at once.
+var stateMu sync.Mutex
+
+// A state records what the commands in this binary have changed, so that a
+// later command can undo it.
+type state struct {
+	// Autoscalers maps an autoscaler key (see autoscalerKey) to what we saved
+	// about it.
+	Autoscalers map[string]*autoscalerState `json:"autoscalers,omitempty"`
+	// Templates maps a template key (see templateKey) to the name of the
+	// newest versioned template created from it.
+	Templates map[string]string `json:"templates,omitempty"`
+	// RunIDs maps a template key to the run ID of its newest template.
+	RunIDs map[string]string `json:"runIds,omitempty"`
+	// RunProjects maps a run ID to the project of each of its resource
+	// groups when the run started, so that teardown finds them even if the
+	// config has changed since.
+	RunProjects map[string]map[string]string `json:"runProjects,omitempty"`
+	// Demos maps a config path to the progress of its demo run, while the
+	// run is incomplete.
+	Demos map[string]*demoCheckpoint `json:"demos,omitempty"`
+}
+
+// An autoscalerState records the mode an autoscaler was in before it was
+// paused.
+type autoscalerState struct {
+	PreviousMode string `json:"previousMode"`
+}
+
+// autoscalerKey identifies an autoscaler within the state file.
+func autoscalerKey(c *policyConfig) string {
+	return strings.Join([]string{c.Project, c.location(), c.Autoscaler}, "/")
+}
+
+// templateKey identifies the templates of a config within the state file.
+func templateKey(c *policyConfig) string {
+	return strings.Join([]string{c.Project, c.Template}, "/")
+}
+
+// loadState reads the state file at path. A missing file yields an empty
+// state.
+func loadState(path string) (*state, error) {
+	st := &state{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// save writes the state to path, replacing any previous contents.
+func (st *state) save(path string) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A statefulConfig makes the group preserve disks and addresses of its
+// instances when they are recreated by autohealing or updates:
+//
+//	stateful:
+//	  disks: [data-disk]
+//	  internalIPs: [nic0]
+//	  externalIPs: [nic0]
+//	  autoDelete: NEVER
+//
+// Disks are named by their device name in the template. Preserved metadata
+// is set per instance, through perInstanceMetadata and mig add-instances.
+type statefulConfig struct {
+	Disks       []string `yaml:"disks"`
+	InternalIPs []string `yaml:"internalIPs"`
+	ExternalIPs []string `yaml:"externalIPs"`
+	// AutoDelete is NEVER, which keeps preserved resources after their
+	// instance is deleted, or ON_PERMANENT_INSTANCE_DELETION. It defaults to
+	// NEVER.
+	AutoDelete string `yaml:"autoDelete"`
+}
+
+// Accepted values of autoDelete.
+var statefulAutoDeletes = map[string]bool{"NEVER": true, "ON_PERMANENT_INSTANCE_DELETION": true}
+
+// check verifies the stateful config against what the API accepts.
+func (sc *statefulConfig) check() error {
+	if sc.AutoDelete != "" && !statefulAutoDeletes[sc.AutoDelete] {
+		return fmt.Errorf("unknown autoDelete %q", sc.AutoDelete)
+	}
+	if len(sc.Disks)+len(sc.InternalIPs)+len(sc.ExternalIPs) == 0 {
+		return errors.New("no disks or addresses are preserved")
+	}
+	return nil
+}
+
+// policy converts the config into its Compute API representation.
+func (sc *statefulConfig) policy() *compute.StatefulPolicy {
+	autoDelete := sc.AutoDelete
+	if autoDelete == "" {
+		autoDelete = "NEVER"
+	}
+	ps := &compute.StatefulPolicyPreservedState{}
+	for _, d := range sc.Disks {
+		if ps.Disks == nil {
+			ps.Disks = map[string]compute.StatefulPolicyPreservedStateDiskDevice{}
+		}
+		ps.Disks[d] = compute.StatefulPolicyPreservedStateDiskDevice{AutoDelete: autoDelete}
+	}
+	for _, nic := range sc.InternalIPs {
+		if ps.InternalIPs == nil {
+			ps.InternalIPs = map[string]compute.StatefulPolicyPreservedStateNetworkIp{}
+		}
+		ps.InternalIPs[nic] = compute.StatefulPolicyPreservedStateNetworkIp{AutoDelete: autoDelete}
+	}
+	for _, nic := range sc.ExternalIPs {
+		if ps.ExternalIPs == nil {
+			ps.ExternalIPs = map[string]compute.StatefulPolicyPreservedStateNetworkIp{}
+		}
+		ps.ExternalIPs[nic] = compute.StatefulPolicyPreservedStateNetworkIp{AutoDelete: autoDelete}
+	}
+	return &compute.StatefulPolicy{PreservedState: ps}
+}
+
+// instancePreservedState returns the preserved state of a managed instance,
+// or nil if it has none. Disks map device names to disk names and addresses
+// map interfaces to IPs; per-instance values override the policy's.
+func instancePreservedState(i *compute.ManagedInstance) *report.PreservedState {
+	ps := &report.PreservedState{}
+	for _, s := range []*compute.PreservedState{i.PreservedStateFromPolicy, i.PreservedStateFromConfig} {
+		if s == nil {
+			continue
+		}
+		for device, d := range s.Disks {
+			setPreserved(&ps.Disks, device, path.Base(d.Source))
+		}
+		for k, v := range s.Metadata {
+			setPreserved(&ps.Metadata, k, v)
+		}
+		for nic, ip := range s.InternalIPs {
+			setPreserved(&ps.InternalIPs, nic, preservedIP(ip))
+		}
+		for nic, ip := range s.ExternalIPs {
+			setPreserved(&ps.ExternalIPs, nic, preservedIP(ip))
+		}
+	}
+	if ps.Disks == nil && ps.Metadata == nil && ps.InternalIPs == nil && ps.ExternalIPs == nil {
+		return nil
+	}
+	return ps
+}
+
+// setPreserved sets a key of a lazily allocated map.
+func setPreserved(m *map[string]string, k, v string) {
+	if *m == nil {
+		*m = map[string]string{}
+	}
+	(*m)[k] = v
+}
+
+// preservedIP returns the literal address of a preserved IP, or the name of
+// the reserved address it refers to.
+func preservedIP(ip compute.PreservedStatePreservedNetworkIp) string {
+	if ip.IpAddress == nil {
+		return ""
+	}
+	if ip.IpAddress.Literal != "" {
+		return ip.IpAddress.Literal
+	}
+	return path.Base(ip.IpAddress.Address)
+}
+
+// preservedStates returns the preserved state of every instance which has
+// any, keyed by instance name.
+func preservedStates(instances []*compute.ManagedInstance) map[string]*report.PreservedState {
+	var states map[string]*report.PreservedState
+	for _, i := range instances {
+		ps := instancePreservedState(i)
+		if ps == nil {
+			continue
+		}
+		if states == nil {
+			states = map[string]*report.PreservedState{}
+		}
+		states[path.Base(i.Instance)] = ps
+	}
+	return states
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// deleteRunTemplates deletes the instance templates labelled with a run ID.
+func deleteRunTemplates(ctx context.Context, s *compute.Service, project, runID string) error {
+	found, err := listManagedResources(ctx, s, project, runID)
+	if err != nil {
+		return err
+	}
+	pool := workerpool.New(ctx)
+	for _, r := range found {
+		if r.kind != "instanceTemplate" {
+			continue
+		}
+		name := r.name
+		err := pool.Submit(name, func(ctx context.Context) error {
+			op, err := s.InstanceTemplates.Delete(project, name).Context(ctx).Do()
+			if err != nil {
+				return fmt.Errorf("unable to delete instance template %v: %v", name, err)
+			}
+			if err := waitForOperation(ctx, s, project, op); err != nil {
+				return err
+			}
+			log.Printf("Deleted instance template %v.", name)
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		return failures[0].Err
+	}
+	return err
+}
+
+// checkRunProjects refuses to tear a run down from a config whose serving
+// project is not the one the run was created in, and notes the data the run
+// left in the projects of its other resource groups, which teardown keeps.
+func checkRunProjects(c *policyConfig, id, statePath string) error {
+	if id == "" {
+		return nil
+	}
+	st, err := loadState(statePath)
+	if err != nil {
+		return fmt.Errorf("unable to read state file: %v", err)
+	}
+	projects := st.RunProjects[id]
+	if p := projects[servingProjects]; p != "" && p != c.Project {
+		return fmt.Errorf("run %v was created in project %v, not %v; tear it down with its original config", id, p, c.Project)
+	}
+	for _, group := range []string{monitoringProjects, bigqueryProjects} {
+		if p := projects[group]; p != "" && p != c.Project {
+			log.Printf("Keeping %v of run %v in project %v.", resourceGroups[group], id, p)
+		}
+	}
+	return nil
+}
+
+// teardownCmd deletes everything the config's run set up, in dependency
+// order: the load balancer made by setup-lb, then the autoscaler and group
+// of every backend and service, then the run's instance templates.
+func teardownCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("teardown", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	keepLB := fs.Bool("keep-lb", false, "Leave the load balancer in place; its backends must then be detached by hand.")
+	keepTemplates := fs.Bool("keep-templates", false, "Leave the run's instance templates in place.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	id, err := runID(c, defaultStatePath)
+	if err != nil {
+		return err
+	}
+	if err := checkRunProjects(c, id, defaultStatePath); err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if c.BackendService != "" && !*keepLB {
+		if err := teardownLB(ctx, s, c); err != nil {
+			return err
+		}
+	}
+	for _, bc := range append(c.backendGroups(), c.serviceGroups()...) {
+		if err := deleteGroup(ctx, s, bc); err != nil {
+			return err
+		}
+	}
+	if *keepTemplates {
+		return nil
+	}
+	if id == "" {
+		log.Printf("No run ID is known; keeping instance templates.")
+		return nil
+	}
+	return deleteRunTemplates(ctx, s, c.Project, id)
+}
@@ -0,0 +1,521 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Defaults for instance templates which the config leaves unset. They match
+// the instances described in the tutorial.
+const (
+	defaultMachineType  = "n1-standard-1"
+	defaultImageFamily  = "debian-11"
+	defaultImageProject = "debian-cloud"
+	defaultDiskSizeGb   = 10
+	defaultDiskType     = "pd-standard"
+	defaultNetwork      = "default"
+	// Layout of the run IDs generated when none is given.
+	runIDLayout = "20060102-150405"
+)
+
+// Scopes granted to the instances' service account: the image server reads
+// and writes Cloud Storage and writes Cloud Trace spans, and the metrics
+// agent writes Cloud Monitoring.
+var instanceScopes = []string{
+	"https://www.googleapis.com/auth/devstorage.read_write",
+	"https://www.googleapis.com/auth/monitoring.write",
+	"https://www.googleapis.com/auth/trace.append",
+}
+
+// A templateConfig describes the instance template of the group. The
+// template created from it is named after the config's template field plus
+// a run ID, so each run gets a fresh template and old ones are left for
+// rollback. It is read from the instanceTemplate section of the policy
+// config:
+//
+//	instanceTemplate:
+//	  machineType: n1-standard-2
+//	  imageFamily: debian-11
+//	  imageProject: debian-cloud
+//	  diskSizeGb: 20
+//	  network: default
+//	  tags: [http-server]
+//	  startupScript: compute/scripts/startup-test-go.sh
+//	  metadata:
+//	    goprog: http://storage.googleapis.com/imagemagick/compute/web-process-image.go
+type templateConfig struct {
+	MachineType string `yaml:"machineType"`
+	// CustomMachine describes a custom machine type instead of machineType.
+	CustomMachine *customMachine `yaml:"customMachine"`
+	ImageFamily   string         `yaml:"imageFamily"`
+	ImageProject  string         `yaml:"imageProject"`
+	DiskSizeGb    int64          `yaml:"diskSizeGb"`
+	DiskType      string         `yaml:"diskType"`
+	Network       string         `yaml:"network"`
+	Subnetwork    string         `yaml:"subnetwork"`
+	Tags          []string       `yaml:"tags"`
+	// StartupScript is the path of a local file uploaded as the
+	// startup-script metadata value.
+	StartupScript string `yaml:"startupScript"`
+	// Server generates a startup script running a file server instead. It
+	// may not be combined with startupScript.
+	Server *serverConfig `yaml:"server"`
+	// Container runs a Docker image on Container-Optimized OS instead of a
+	// startup script. The image family defaults to cos-stable.
+	Container *containerConfig  `yaml:"container"`
+	Metadata  map[string]string `yaml:"metadata"`
+	// Scheduling selects Spot capacity, which is much cheaper but may be
+	// preempted at any time.
+	Scheduling *schedulingConfig `yaml:"scheduling"`
+	// Security enables Shielded VM and Confidential VM features.
+	Security *securityConfig `yaml:"security"`
+	// Accelerators attaches GPUs to each instance.
+	Accelerators []acceleratorConfig `yaml:"accelerators"`
+	// Bake describes the custom image made by template bake.
+	Bake *bakeConfig `yaml:"bake"`
+}
+
+// A schedulingConfig describes how instances are provisioned:
+//
+//	scheduling:
+//	  provisioningModel: SPOT
+//	  terminationAction: DELETE
+//	  maxRunDuration: 4h
+type schedulingConfig struct {
+	// ProvisioningModel is STANDARD or SPOT.
+	ProvisioningModel string `yaml:"provisioningModel"`
+	// TerminationAction is what happens to a preempted or expired Spot
+	// instance: STOP or DELETE. The group recreates deleted instances.
+	TerminationAction string `yaml:"terminationAction"`
+	// MaxRunDuration, if set, terminates instances after running this long.
+	MaxRunDuration time.Duration `yaml:"maxRunDuration"`
+}
+
+// Accepted values of the scheduling fields.
+var (
+	provisioningModels = map[string]bool{"STANDARD": true, "SPOT": true}
+	terminationActions = map[string]bool{"STOP": true, "DELETE": true}
+)
+
+// check verifies the scheduling config against what the API accepts.
+func (sc *schedulingConfig) check() error {
+	switch {
+	case sc.ProvisioningModel != "" && !provisioningModels[sc.ProvisioningModel]:
+		return fmt.Errorf("unknown provisioningModel %q", sc.ProvisioningModel)
+	case sc.TerminationAction != "" && !terminationActions[sc.TerminationAction]:
+		return fmt.Errorf("unknown terminationAction %q", sc.TerminationAction)
+	case sc.MaxRunDuration < 0 || sc.MaxRunDuration%time.Second != 0:
+		return errors.New("maxRunDuration must be a positive whole number of seconds")
+	case sc.TerminationAction != "" && sc.ProvisioningModel != "SPOT" && sc.MaxRunDuration == 0:
+		return errors.New("terminationAction requires SPOT provisioning or a maxRunDuration")
+	}
+	return nil
+}
+
+// scheduling converts the config into its Compute API representation.
+func (sc *schedulingConfig) scheduling() *compute.Scheduling {
+	s := &compute.Scheduling{
+		ProvisioningModel:         sc.ProvisioningModel,
+		InstanceTerminationAction: sc.TerminationAction,
+	}
+	if sc.ProvisioningModel == "SPOT" {
+		// Spot instances cannot be live migrated or restarted in place.
+		s.Preemptible = true
+		s.OnHostMaintenance = "TERMINATE"
+		f := false
+		s.AutomaticRestart = &f
+		if s.InstanceTerminationAction == "" {
+			// The group can only replace instances which are deleted.
+			s.InstanceTerminationAction = "DELETE"
+		}
+	}
+	if sc.MaxRunDuration > 0 {
+		s.MaxRunDuration = &compute.Duration{Seconds: int64(sc.MaxRunDuration / time.Second)}
+	}
+	return s
+}
+
+// withDefaults returns a copy of the config with every unset field filled in.
+func (t templateConfig) withDefaults() templateConfig {
+	if t.MachineType == "" && t.CustomMachine != nil {
+		t.MachineType = t.CustomMachine.name()
+	}
+	if t.MachineType == "" {
+		t.MachineType = defaultMachineType
+	}
+	if t.ImageFamily == "" && t.ImageProject == "" && t.Container != nil {
+		t.ImageFamily, t.ImageProject = cosImageFamily, cosImageProject
+	}
+	if t.ImageFamily == "" {
+		t.ImageFamily = defaultImageFamily
+	}
+	if t.ImageProject == "" {
+		t.ImageProject = defaultImageProject
+	}
+	if t.DiskSizeGb == 0 {
+		t.DiskSizeGb = defaultDiskSizeGb
+	}
+	if t.DiskType == "" {
+		t.DiskType = defaultDiskType
+	}
+	if t.Network == "" {
+		t.Network = defaultNetwork
+	}
+	return t
+}
+
+// instanceTemplate converts the config into its Compute API representation,
+// reading the startup script from disk.
+func (t templateConfig) instanceTemplate(project, name, runID string) (*compute.InstanceTemplate, error) {
+	metadata := &compute.Metadata{}
+	keys := make([]string, 0, len(t.Metadata))
+	for k := range t.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := t.Metadata[k]
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: k, Value: &v})
+	}
+	var script string
+	switch {
+	case countSet(t.StartupScript != "", t.Server != nil, t.Container != nil) > 1:
+		return nil, errors.New("only one of startupScript, server and container may be set")
+	case t.StartupScript != "":
+		b, err := ioutil.ReadFile(t.StartupScript)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read startup script: %v", err)
+		}
+		script = string(b)
+	case t.Server != nil:
+		var err error
+		if script, err = t.Server.startupScript(); err != nil {
+			return nil, fmt.Errorf("unable to generate startup script: %v", err)
+		}
+	case t.Container != nil:
+		decl, err := t.Container.declaration(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to declare container: %v", err)
+		}
+		logging := "true"
+		metadata.Items = append(metadata.Items,
+			&compute.MetadataItems{Key: containerDeclarationKey, Value: &decl},
+			&compute.MetadataItems{Key: "google-logging-enabled", Value: &logging})
+	}
+	if script != "" {
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: startupScriptKey, Value: &script})
+	}
+	if err := checkMachineType(t.MachineType); err != nil {
+		return nil, err
+	}
+	var scheduling *compute.Scheduling
+	if t.Scheduling != nil {
+		if err := t.Scheduling.check(); err != nil {
+			return nil, err
+		}
+		scheduling = t.Scheduling.scheduling()
+	}
+	var shielded *compute.ShieldedInstanceConfig
+	var confidential *compute.ConfidentialInstanceConfig
+	if t.Security != nil {
+		if err := t.Security.check(t.MachineType); err != nil {
+			return nil, err
+		}
+		shielded = t.Security.shieldedConfig()
+		if t.Security.ConfidentialCompute {
+			confidential = &compute.ConfidentialInstanceConfig{EnableConfidentialCompute: true}
+			// Confidential VMs cannot be live migrated.
+			if scheduling == nil {
+				scheduling = &compute.Scheduling{}
+			}
+			scheduling.OnHostMaintenance = "TERMINATE"
+		}
+	}
+	for _, ac := range t.Accelerators {
+		if err := ac.check(t.MachineType); err != nil {
+			return nil, err
+		}
+	}
+	if len(t.Accelerators) > 0 {
+		// Instances with GPUs cannot be live migrated.
+		if scheduling == nil {
+			scheduling = &compute.Scheduling{}
+		}
+		scheduling.OnHostMaintenance = "TERMINATE"
+	}
+	network := &compute.NetworkInterface{
+		Network:    globalURL(project, "networks", t.Network),
+		Subnetwork: t.Subnetwork,
+		// An external address lets instances fetch packages without a NAT.
+		AccessConfigs: []*compute.AccessConfig{{Name: "External NAT", Type: "ONE_TO_ONE_NAT"}},
+	}
+	return &compute.InstanceTemplate{
+		Name:        name,
+		Description: resourceDescription("Created by template create.", runID),
+		Properties: &compute.InstanceProperties{
+			MachineType: t.MachineType,
+			Disks: []*compute.AttachedDisk{{
+				Boot:       true,
+				AutoDelete: true,
+				Type:       "PERSISTENT",
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					SourceImage: fmt.Sprintf("projects/%s/global/images/family/%s", t.ImageProject, t.ImageFamily),
+					DiskSizeGb:  t.DiskSizeGb,
+					DiskType:    t.DiskType,
+					Labels:      resourceLabels(runID),
+				},
+			}},
+			NetworkInterfaces: []*compute.NetworkInterface{network},
+			Tags:              &compute.Tags{Items: append([]string{managedByTag}, t.Tags...)},
+			Metadata:          metadata,
+			ServiceAccounts: []*compute.ServiceAccount{{
+				Email:  "default",
+				Scopes: instanceScopes,
+			}},
+			GuestAccelerators:          guestAccelerators(t.Accelerators),
+			Scheduling:                 scheduling,
+			ShieldedInstanceConfig:     shielded,
+			ConfidentialInstanceConfig: confidential,
+			Labels:                     resourceLabels(runID),
+		},
+	}, nil
+}
+
+// countSet returns how many of its arguments are true.
+func countSet(set ...bool) int {
+	n := 0
+	for _, b := range set {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// globalURL returns the partial URL of a global resource. Values which
+// already look like URLs are returned unchanged.
+func globalURL(project, collection, name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return fmt.Sprintf("projects/%s/global/%s/%s", project, collection, name)
+}
+
+// versionedTemplateName returns the name of the template created for a run.
+func versionedTemplateName(base, runID string) string {
+	return base + "-" + runID
+}
+
+// A keyValueFlag collects repeated KEY=VALUE flags into a map.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", s)
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
+
+// createTemplateCmd creates an instance template from the instanceTemplate
+// section of the policy config, with flags overriding individual fields. The
+// template is versioned by run ID and its name is printed on stdout, and
+// recorded in the state file, so that later commands can use it.
+func createTemplateCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("template create", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	runID := fs.String("run-id", "", "Run ID appended to the template name. Defaults to the config's runId, or else the current UTC time.")
+	machineType := fs.String("machine-type", "", "Machine type, overriding the config.")
+	imageFamily := fs.String("image-family", "", "Boot image family, overriding the config.")
+	imageProject := fs.String("image-project", "", "Project of the boot image family, overriding the config.")
+	diskSize := fs.Int64("disk-size", 0, "Boot disk size in GB, overriding the config.")
+	network := fs.String("network", "", "Network, overriding the config.")
+	tags := fs.String("tags", "", "Comma separated network tags, overriding the config.")
+	containerImage := fs.String("container-image", "", "Docker image run on Container-Optimized OS, overriding the config.")
+	spot := fs.Bool("spot", false, "Use Spot provisioning, overriding the config.")
+	startupScript := fs.String("startup-script", "", "Path of the startup script, overriding the config.")
+	bucket := fs.String("server-bucket", "", "Bucket served by the generated file server, overriding the config.")
+	port := fs.Int("server-port", 0, "Port of the generated file server, overriding the config.")
+	burn := fs.Int("server-burn-ms", -1, "CPU milliseconds the generated file server burns per request, overriding the config.")
+	metadata := keyValueFlag{}
+	fs.Var(metadata, "metadata", "KEY=VALUE metadata item, added to those in the config. May be repeated.")
+	accelerator := fs.String("accelerator", "", "GPU attached to each instance as TYPE or TYPE:COUNT, replacing those in the config.")
+	baked := fs.Bool("baked", false, "Boot from the newest image baked by template bake, running the bake's runScript.")
+	service := fs.String("service", "", "Create the template of this service from the config's services instead of the top level one.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if c, err = c.forService(*service); err != nil {
+		return err
+	}
+	if c.Template == "" {
+		return errors.New("config does not name an instance template")
+	}
+	t := templateConfig{}
+	if c.InstanceTemplate != nil {
+		t = *c.InstanceTemplate
+	}
+	override := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	if *machineType != "" {
+		t.MachineType, t.CustomMachine = *machineType, nil
+	}
+	if *baked {
+		// Baked images already hold the server, so only the run script is
+		// needed at boot.
+		if t.Bake == nil || t.Bake.RunScript == "" {
+			return errors.New("-baked needs instanceTemplate.bake.runScript in the config")
+		}
+		t.ImageFamily, t.ImageProject = c.bakeFamily(), c.Project
+		t.StartupScript, t.Server, t.Container = t.Bake.RunScript, nil, nil
+	}
+	override(&t.ImageFamily, *imageFamily)
+	override(&t.ImageProject, *imageProject)
+	override(&t.Network, *network)
+	override(&t.StartupScript, *startupScript)
+	if *bucket != "" || *port > 0 || *burn >= 0 {
+		sc := serverConfig{}
+		if t.Server != nil {
+			sc = *t.Server
+		}
+		override(&sc.Bucket, *bucket)
+		if *port > 0 {
+			sc.Port = *port
+		}
+		if *burn >= 0 {
+			sc.BurnMillis = *burn
+		}
+		t.Server = &sc
+	}
+	if *containerImage != "" {
+		cc := containerConfig{}
+		if t.Container != nil {
+			cc = *t.Container
+		}
+		cc.Image = *containerImage
+		t.Container = &cc
+	}
+	if *spot {
+		sc := schedulingConfig{}
+		if t.Scheduling != nil {
+			sc = *t.Scheduling
+		}
+		sc.ProvisioningModel = "SPOT"
+		t.Scheduling = &sc
+	}
+	if *diskSize > 0 {
+		t.DiskSizeGb = *diskSize
+	}
+	if *accelerator != "" {
+		ac, err := parseAccelerator(*accelerator)
+		if err != nil {
+			return err
+		}
+		t.Accelerators = []acceleratorConfig{ac}
+	}
+	if *tags != "" {
+		t.Tags = strings.Split(*tags, ",")
+	}
+	if len(metadata) > 0 {
+		merged := map[string]string{}
+		for k, v := range t.Metadata {
+			merged[k] = v
+		}
+		for k, v := range metadata {
+			merged[k] = v
+		}
+		t.Metadata = merged
+	}
+	if *runID == "" {
+		*runID = c.RunID
+	}
+	if *runID == "" {
+		*runID = time.Now().UTC().Format(runIDLayout)
+	}
+	audit.setRun(*runID)
+	t = t.withDefaults()
+	name := versionedTemplateName(c.Template, *runID)
+	it, err := t.instanceTemplate(c.Project, name, *runID)
+	if err != nil {
+		return err
+	}
+
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	if err := checkAcceleratorZones(ctx, s, c, t.Accelerators); err != nil {
+		return err
+	}
+	op, err := s.InstanceTemplates.Insert(c.Project, it).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to create instance template %v: %v", name, err)
+	}
+	if err := waitForOperation(ctx, s, c.Project, op); err != nil {
+		return err
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	st, err := loadState(*statePath)
+	if err != nil {
+		return fmt.Errorf("unable to read state file: %v", err)
+	}
+	if st.Templates == nil {
+		st.Templates = map[string]string{}
+	}
+	if st.RunIDs == nil {
+		st.RunIDs = map[string]string{}
+	}
+	if st.RunProjects == nil {
+		st.RunProjects = map[string]map[string]string{}
+	}
+	st.Templates[templateKey(c)] = name
+	st.RunIDs[templateKey(c)] = *runID
+	st.RunProjects[*runID] = c.runProjects()
+	if err := st.save(*statePath); err != nil {
+		return fmt.Errorf("unable to write state file: %v", err)
+	}
+	log.Printf("Created instance template %v (%v, %v/%v).", name, t.MachineType, t.ImageProject, t.ImageFamily)
+	fmt.Println(name)
+	return nil
+}
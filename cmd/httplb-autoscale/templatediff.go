@@ -0,0 +1,281 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Metadata key holding the startup script, which is diffed line by line
+// rather than as a single field.
+const startupScriptKey = "startup-script"
+
+// templateFields flattens the parts of an instance template worth comparing
+// into field names and printable values. It also returns the startup script.
+func templateFields(t *compute.InstanceTemplate) (map[string]string, string) {
+	f := map[string]string{}
+	p := t.Properties
+	if p == nil {
+		return f, ""
+	}
+	f["machineType"] = p.MachineType
+	for i, d := range p.Disks {
+		prefix := fmt.Sprintf("disks[%d].", i)
+		f[prefix+"boot"] = fmt.Sprint(d.Boot)
+		if ip := d.InitializeParams; ip != nil {
+			f[prefix+"sourceImage"] = ip.SourceImage
+			f[prefix+"diskSizeGb"] = fmt.Sprint(ip.DiskSizeGb)
+			f[prefix+"diskType"] = ip.DiskType
+		}
+	}
+	for i, n := range p.NetworkInterfaces {
+		prefix := fmt.Sprintf("networkInterfaces[%d].", i)
+		f[prefix+"network"] = path.Base(n.Network)
+		if n.Subnetwork != "" {
+			f[prefix+"subnetwork"] = path.Base(n.Subnetwork)
+		}
+		f[prefix+"externalAddress"] = fmt.Sprint(len(n.AccessConfigs) > 0)
+	}
+	if p.Tags != nil {
+		f["tags"] = strings.Join(p.Tags.Items, ",")
+	}
+	for i, sa := range p.ServiceAccounts {
+		prefix := fmt.Sprintf("serviceAccounts[%d].", i)
+		f[prefix+"email"] = sa.Email
+		f[prefix+"scopes"] = strings.Join(sa.Scopes, ",")
+	}
+	for k, v := range p.Labels {
+		f["labels."+k] = v
+	}
+	var script string
+	if p.Metadata != nil {
+		for _, item := range p.Metadata.Items {
+			v := ""
+			if item.Value != nil {
+				v = *item.Value
+			}
+			if item.Key == startupScriptKey {
+				script = v
+				continue
+			}
+			f["metadata."+item.Key] = v
+		}
+	}
+	return f, script
+}
+
+// A fieldChange is a template field which differs between two templates.
+// Old or New is nil when the field is only set in the other template.
+type fieldChange struct {
+	Field string  `json:"field"`
+	Old   *string `json:"old"`
+	New   *string `json:"new"`
+}
+
+// fieldChanges returns every field which differs between a and b, in name
+// order.
+func fieldChanges(a, b map[string]string) []fieldChange {
+	names := map[string]bool{}
+	for k := range a {
+		names[k] = true
+	}
+	for k := range b {
+		names[k] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	changes := []fieldChange{}
+	for _, k := range sorted {
+		va, inA := a[k]
+		vb, inB := b[k]
+		if inA && inB && va == vb {
+			continue
+		}
+		c := fieldChange{Field: k}
+		if inA {
+			c.Old = &va
+		}
+		if inB {
+			c.New = &vb
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// writeFieldDiff prints field changes using - for the old value and + for
+// the new one.
+func writeFieldDiff(w io.Writer, changes []fieldChange) {
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s:\n", c.Field)
+		if c.Old != nil {
+			fmt.Fprintf(w, "\t- %s\n", *c.Old)
+		}
+		if c.New != nil {
+			fmt.Fprintf(w, "\t+ %s\n", *c.New)
+		}
+	}
+}
+
+// lineDiff returns the lines of a unified style diff between a and b, with
+// every line prefixed by " ", "-" or "+". It uses the longest common
+// subsequence of lines, which is plenty for startup scripts.
+func lineDiff(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
+
+// Unchanged lines shown around each change in a line diff.
+const diffContextLines = 3
+
+// writeContext prints the changed lines of a line diff and the unchanged
+// lines near them, eliding the rest.
+func writeContext(w io.Writer, diff []string) {
+	near := make([]bool, len(diff))
+	for i, l := range diff {
+		if l[0] == ' ' {
+			continue
+		}
+		for j := i - diffContextLines; j <= i+diffContextLines; j++ {
+			if j >= 0 && j < len(diff) {
+				near[j] = true
+			}
+		}
+	}
+	elided := false
+	for i, l := range diff {
+		if !near[i] {
+			if !elided {
+				fmt.Fprintln(w, "\t...")
+				elided = true
+			}
+			continue
+		}
+		fmt.Fprintf(w, "\t%s\n", l)
+		elided = false
+	}
+}
+
+// diffTemplateCmd fetches two instance templates and prints the fields which
+// differ between them, followed by a line diff of their startup scripts.
+func diffTemplateCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("template diff", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: template diff [flags] OLD_TEMPLATE NEW_TEMPLATE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected two template names")
+	}
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	var fields [2]map[string]string
+	var scripts [2]string
+	for i, name := range fs.Args() {
+		t, err := s.InstanceTemplates.Get(c.Project, path.Base(name)).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to get instance template %v: %v", name, err)
+		}
+		fields[i], scripts[i] = templateFields(t)
+	}
+
+	d := &templateDiff{Old: fs.Arg(0), New: fs.Arg(1), Fields: fieldChanges(fields[0], fields[1])}
+	if scripts[0] != scripts[1] {
+		d.StartupScript = lineDiff(strings.Split(scripts[0], "\n"), strings.Split(scripts[1], "\n"))
+	}
+	return printResult(d, func(w io.Writer) error {
+		fmt.Fprintf(w, "--- %s\n+++ %s\n", d.Old, d.New)
+		writeFieldDiff(w, d.Fields)
+		if d.StartupScript != nil {
+			fmt.Fprintf(w, "metadata.%s:\n", startupScriptKey)
+			writeContext(w, d.StartupScript)
+		}
+		if len(d.Fields) == 0 && d.StartupScript == nil {
+			fmt.Fprintln(w, "Templates are identical.")
+		}
+		return nil
+	})
+}
+
+// A templateDiff is the result of template diff. StartupScript holds the
+// whole line diff of the startup scripts, each line prefixed by " ", "-" or
+// "+", and is empty when they are identical.
+type templateDiff struct {
+	Old           string        `json:"old"`
+	New           string        `json:"new"`
+	Fields        []fieldChange `json:"fields"`
+	StartupScript []string      `json:"startupScript,omitempty"`
+}
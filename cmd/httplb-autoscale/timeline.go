@@ -0,0 +1,106 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// Version of the timeline document format. It is described by the JSON
+// Schema in timeline.schema.json and must be bumped whenever a field changes
+// meaning or is removed.
+const timelineSchemaVersion = 1
+
+// A timeline is the complete record of a watch run: a sample of the
+// autoscaler and group taken at every poll, plus every event other than a
+// plain state change (alerts, recreations, boot measurements). Unlike the
+// event stream it keeps unchanged samples, so it can be plotted directly.
+type timeline struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Project       string    `json:"project"`
+	Location      string    `json:"location"`
+	Autoscaler    string    `json:"autoscaler"`
+	Group         string    `json:"group"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	// Degraded is set when the load balancer served too many 5xx responses
+	// at some point of the run; the "5xx-spike" events say when.
+	Degraded bool                 `json:"degraded"`
+	Samples  []*timelineSample    `json:"samples"`
+	Events   []*report.WatchEvent `json:"events"`
+}
+
+// A timelineSample is the state of the autoscaler and group at one poll.
+type timelineSample struct {
+	Time            time.Time `json:"time"`
+	Status          string    `json:"status"`
+	Mode            string    `json:"mode"`
+	RecommendedSize int64     `json:"recommendedSize"`
+	TargetSize      int64     `json:"targetSize"`
+	ActualSize      int64     `json:"actualSize"`
+	RunningSize     int64     `json:"runningSize"`
+	MaxSize         int64     `json:"maxSize"`
+	// Reasons are the autoscaler's status details at the time of the sample.
+	Reasons []report.StatusDetail `json:"reasons"`
+}
+
+// newTimeline starts an empty timeline for the group in the config.
+func newTimeline(c *policyConfig) *timeline {
+	return &timeline{
+		SchemaVersion: timelineSchemaVersion,
+		Project:       c.Project,
+		Location:      c.location(),
+		Autoscaler:    c.Autoscaler,
+		Group:         c.Group,
+		Samples:       []*timelineSample{},
+		Events:        []*report.WatchEvent{},
+	}
+}
+
+// addSample appends a state sample to the timeline.
+func (t *timeline) addSample(e *report.WatchEvent) {
+	if t.Start.IsZero() {
+		t.Start = e.Time
+	}
+	t.End = e.Time
+	reasons := e.StatusDetails
+	if reasons == nil {
+		reasons = []report.StatusDetail{}
+	}
+	t.Samples = append(t.Samples, &timelineSample{
+		Time:            e.Time,
+		Status:          e.Status,
+		Mode:            e.Mode,
+		RecommendedSize: e.RecommendedSize,
+		TargetSize:      e.TargetSize,
+		ActualSize:      e.ActualSize,
+		RunningSize:     e.RunningSize,
+		MaxSize:         e.MaxSize,
+		Reasons:         reasons,
+	})
+}
+
+// write saves the timeline to path as indented JSON.
+func (t *timeline) write(path string) error {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
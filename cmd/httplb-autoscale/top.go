@@ -0,0 +1,206 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Characters of a sparkline, from lowest to highest.
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+// A series is the most recent samples of one quantity shown by metrics top.
+type series struct {
+	name   string
+	unit   string
+	values []float64
+	// max, if positive, fixes the top of the scale, e.g. 1 for utilization.
+	max float64
+}
+
+// add appends a sample, dropping the oldest beyond width samples. NaN marks
+// a sample which could not be taken.
+func (s *series) add(v float64, width int) {
+	s.values = append(s.values, v)
+	if len(s.values) > width {
+		s.values = s.values[len(s.values)-width:]
+	}
+}
+
+// sparkline renders the samples scaled between 0 and the largest sample, or
+// the fixed maximum. Missing samples are blank.
+func (s *series) sparkline() string {
+	top := s.max
+	if top <= 0 {
+		for _, v := range s.values {
+			if !math.IsNaN(v) && v > top {
+				top = v
+			}
+		}
+	}
+	var b bytes.Buffer
+	for _, v := range s.values {
+		switch {
+		case math.IsNaN(v):
+			b.WriteRune(' ')
+		case top <= 0:
+			b.WriteRune(sparkLevels[0])
+		default:
+			i := int(v / top * float64(len(sparkLevels)-1))
+			if i < 0 {
+				i = 0
+			}
+			if i >= len(sparkLevels) {
+				i = len(sparkLevels) - 1
+			}
+			b.WriteRune(sparkLevels[i])
+		}
+	}
+	return b.String()
+}
+
+// last returns the newest sample, or NaN if there is none.
+func (s *series) last() float64 {
+	if len(s.values) == 0 {
+		return math.NaN()
+	}
+	return s.values[len(s.values)-1]
+}
+
+// latestValue returns the newest aligned point of a series, or NaN if it has
+// none yet.
+func latestValue(ctx context.Context, w *metricsWatcher, lm lbMetric) float64 {
+	end := time.Now().UTC()
+	points, err := w.query(ctx, lm, end.Add(-metricsLookback), end)
+	if err != nil {
+		log.Printf("Unable to query %v: %v", lm.Name, err)
+		return math.NaN()
+	}
+	if len(points) == 0 {
+		return math.NaN()
+	}
+	return points[len(points)-1].Value
+}
+
+// groupSize returns the target and running sizes of the group.
+func groupSize(ctx context.Context, s *compute.Service, c *policyConfig) (float64, float64) {
+	m, err := getGroupManager(ctx, s, c)
+	if err != nil {
+		log.Printf("Unable to get instance group manager %v: %v", c.Group, err)
+		return math.NaN(), math.NaN()
+	}
+	instances, err := listManagedInstances(ctx, s, c)
+	if err != nil {
+		log.Printf("Unable to list instances of %v: %v", c.Group, err)
+		return float64(m.TargetSize), math.NaN()
+	}
+	running := 0
+	for _, i := range instances {
+		if i.InstanceStatus == "RUNNING" && i.CurrentAction == "NONE" {
+			running++
+		}
+	}
+	return float64(m.TargetSize), float64(running)
+}
+
+// topCmd shows a live terminal view of the group: sparklines of its size,
+// its instances' CPU utilization and the load balancer's request rate. It
+// only uses ANSI escapes, so it works in any terminal without extra
+// dependencies. Cloud Monitoring series run a few minutes behind the group
+// size.
+func topCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("metrics top", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	statePath := fs.String("state", defaultStatePath, "Path to the local state file.")
+	interval := fs.Duration("interval", 5*time.Second, "Time between refreshes.")
+	width := fs.Int("width", 60, "Number of samples shown in each sparkline.")
+	duration := fs.Duration("duration", 0, "Stop after this long; 0 runs until interrupted.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	id, err := runID(c, *statePath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	m, err := newMonitoringService()
+	if err != nil {
+		return fmt.Errorf("failed to create Monitoring client: %v", err)
+	}
+	cpuFilter := `resource.type = "gce_instance"`
+	if id != "" {
+		cpuFilter += fmt.Sprintf(` AND metadata.user_labels.%q = %q`, runIDLabel, id)
+	}
+	cpuWatcher := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), filter: cpuFilter, period: time.Minute}
+	cpuMetric := lbMetric{Name: "cpu", Type: "compute.googleapis.com/instance/cpu/utilization",
+		Aligner: "ALIGN_MEAN", Reducer: "REDUCE_MEAN"}
+	var lbWatcher *metricsWatcher
+	if c.BackendService != "" {
+		lbWatcher = &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), filter: lbFilter(c.BackendService), period: time.Minute}
+	}
+
+	target := &series{name: "target size", unit: "instances"}
+	running := &series{name: "running", unit: "instances"}
+	cpu := &series{name: "cpu", unit: "%", max: 1}
+	qps := &series{name: "requests", unit: "req/s"}
+	stop := stopChannel(*duration)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		t, r := groupSize(ctx, s, c)
+		target.add(t, *width)
+		running.add(r, *width)
+		cpu.add(latestValue(ctx, cpuWatcher, cpuMetric), *width)
+		if lbWatcher != nil {
+			qps.add(latestValue(ctx, lbWatcher, lbMetrics[0]), *width)
+		}
+
+		var b bytes.Buffer
+		b.WriteString("\x1b[H\x1b[2J")
+		fmt.Fprintf(&b, "%v in %v, %v\n\n", c.Group, c.location(), time.Now().Format("15:04:05"))
+		for _, sr := range []*series{target, running, cpu, qps} {
+			if sr == qps && lbWatcher == nil {
+				continue
+			}
+			v := sr.last()
+			if sr == cpu {
+				v *= 100
+			}
+			fmt.Fprintf(&b, "%-12s %s %8.1f %s\n", sr.name, sr.sparkline(), v, sr.unit)
+		}
+		os.Stdout.Write(b.Bytes())
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
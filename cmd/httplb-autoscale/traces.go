@@ -0,0 +1,245 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	cloudtrace "google.golang.org/api/cloudtrace/v1"
+)
+
+// Name prefix of the root span written by the generated file server.
+const fileServerSpan = "fileserver"
+
+// A traceSummary is one sampled request as recorded by the file server.
+type traceSummary struct {
+	id       string
+	start    time.Time
+	total    time.Duration
+	instance string
+	zone     string
+	// spans holds the time spent in each child span, by name.
+	spans map[string]time.Duration
+}
+
+// spanTimes parses the start and end of a span.
+func spanTimes(s *cloudtrace.TraceSpan) (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339Nano, s.StartTime)
+	if err != nil {
+		return start, start, err
+	}
+	end, err := time.Parse(time.RFC3339Nano, s.EndTime)
+	return start, end, err
+}
+
+// summarizeTrace finds the file server's span of a trace and its children.
+// It returns nil for traces without one.
+func summarizeTrace(t *cloudtrace.Trace) *traceSummary {
+	var root *cloudtrace.TraceSpan
+	for _, s := range t.Spans {
+		if strings.HasPrefix(s.Name, fileServerSpan) {
+			root = s
+			break
+		}
+	}
+	if root == nil {
+		return nil
+	}
+	start, end, err := spanTimes(root)
+	if err != nil {
+		return nil
+	}
+	ts := &traceSummary{
+		id:       t.TraceId,
+		start:    start,
+		total:    end.Sub(start),
+		instance: root.Labels["instance"],
+		zone:     root.Labels["zone"],
+		spans:    map[string]time.Duration{},
+	}
+	for _, s := range t.Spans {
+		if s.ParentSpanId != root.SpanId {
+			continue
+		}
+		if start, end, err := spanTimes(s); err == nil {
+			ts.spans[s.Name] += end.Sub(start)
+		}
+	}
+	return ts
+}
+
+// listTraces returns the summaries of the file server traces between start
+// and end, stopping after limit traces.
+func listTraces(ctx context.Context, t *cloudtrace.Service, project string, start, end time.Time, limit int) ([]*traceSummary, bool, error) {
+	var traces []*traceSummary
+	for token := ""; ; {
+		resp, err := t.Projects.Traces.List(project).
+			StartTime(start.UTC().Format(time.RFC3339)).
+			EndTime(end.UTC().Format(time.RFC3339)).
+			Filter("span:" + fileServerSpan).
+			View("COMPLETE").
+			PageToken(token).
+			Context(ctx).Do()
+		if err != nil {
+			return nil, false, err
+		}
+		for _, tr := range resp.Traces {
+			if len(traces) == limit {
+				return traces, true, nil
+			}
+			if ts := summarizeTrace(tr); ts != nil {
+				traces = append(traces, ts)
+			}
+		}
+		if token = resp.NextPageToken; token == "" {
+			return traces, false, nil
+		}
+	}
+}
+
+// reportTracesCmd pulls the traces the load generator sampled during a run
+// and shows where the time of the slowest requests went: in the file
+// server's CPU burn, in its Cloud Storage fetch, or elsewhere. Traces are
+// only written by backends whose template sets server.trace, for scenarios
+// with a traceSampleRate.
+func reportTracesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report traces", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	top := fs.Int("top", 20, "Number of slowest traces to list.")
+	limit := fs.Int("limit", 5000, "Read at most this many traces.")
+	wf := addWindowFlags(fs)
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	start, end, err := wf.window()
+	if err != nil {
+		return err
+	}
+	t, err := newTraceService()
+	if err != nil {
+		return fmt.Errorf("failed to create Trace client: %v", err)
+	}
+	traces, truncated, err := listTraces(ctx, t, c.projectFor(monitoringProjects), start, end, *limit)
+	if err != nil {
+		return fmt.Errorf("unable to list traces: %v", err)
+	}
+	if truncated {
+		log.Printf("Stopped after %d traces; raise -limit to read more.", *limit)
+	}
+	if len(traces) == 0 {
+		log.Printf("No file server traces found between %v and %v; do the scenario and template enable tracing?",
+			start.Format(time.RFC3339), end.Format(time.RFC3339))
+		return nil
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].total > traces[j].total })
+
+	totals := make([]time.Duration, len(traces))
+	var all time.Duration
+	spanTotals := map[string]time.Duration{}
+	for i, tr := range traces {
+		totals[i] = tr.total
+		all += tr.total
+		for name, d := range tr.spans {
+			spanTotals[name] += d
+		}
+	}
+	sort.Sort(report.Durations(totals))
+	names := make([]string, 0, len(spanTotals))
+	for name := range spanTotals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	r := &traceReport{
+		Traces: len(traces), P50Ms: report.Millis(report.Percentile(totals, 0.5)), P95Ms: report.Millis(report.Percentile(totals, 0.95)),
+		P99Ms: report.Millis(report.Percentile(totals, 0.99)), MaxMs: report.Millis(totals[len(totals)-1]), SpanShares: map[string]float64{},
+	}
+	var inSpans time.Duration
+	for _, name := range names {
+		r.SpanShares[name] = float64(spanTotals[name]) / float64(all)
+		inSpans += spanTotals[name]
+	}
+	r.SpanShares["other"] = float64(all-inSpans) / float64(all)
+	for i, tr := range traces {
+		if i == *top {
+			break
+		}
+		st := slowTrace{
+			Start: tr.start, TotalMs: report.Millis(tr.total), Instance: tr.instance, Zone: tr.zone, SpansMs: map[string]float64{},
+			URL: fmt.Sprintf("https://console.cloud.google.com/traces/list?project=%s&tid=%s", c.projectFor(monitoringProjects), tr.id),
+		}
+		for _, name := range names {
+			st.SpansMs[name] = report.Millis(tr.spans[name])
+		}
+		r.Slowest = append(r.Slowest, st)
+	}
+	return printResult(r, func(w io.Writer) error {
+		fmt.Fprintf(w, "%d traces: p50 %v, p95 %v, p99 %v, max %v.\n", len(traces), report.Percentile(totals, 0.5),
+			report.Percentile(totals, 0.95), report.Percentile(totals, 0.99), totals[len(totals)-1])
+		for _, name := range append(names, "other") {
+			fmt.Fprintf(w, "  %-12s %5.1f%% of server time\n", name, 100*r.SpanShares[name])
+		}
+		fmt.Fprintln(w)
+
+		tw := newTable(w)
+		fmt.Fprintf(tw, "START\tTOTAL\tINSTANCE\tZONE")
+		for _, name := range names {
+			fmt.Fprintf(tw, "\t%s", strings.ToUpper(name))
+		}
+		fmt.Fprintln(tw, "\tTRACE")
+		for i, st := range r.Slowest {
+			tr := traces[i]
+			fmt.Fprintf(tw, "%s\t%v\t%s\t%s", st.Start.Format("15:04:05.000"), tr.total.Round(time.Millisecond), st.Instance, st.Zone)
+			for _, name := range names {
+				fmt.Fprintf(tw, "\t%v", tr.spans[name].Round(time.Millisecond))
+			}
+			fmt.Fprintf(tw, "\t%s\n", st.URL)
+		}
+		return tw.Flush()
+	})
+}
+
+// A traceReport is the result of report traces.
+type traceReport struct {
+	Traces int     `json:"traces"`
+	P50Ms  float64 `json:"p50Ms"`
+	P95Ms  float64 `json:"p95Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	MaxMs  float64 `json:"maxMs"`
+	// SpanShares is the fraction of all server time spent in each span,
+	// and outside them as "other".
+	SpanShares map[string]float64 `json:"spanShares"`
+	Slowest    []slowTrace        `json:"slowest"`
+}
+
+// A slowTrace is one of the slowest traces of a run.
+type slowTrace struct {
+	Start    time.Time          `json:"start"`
+	TotalMs  float64            `json:"totalMs"`
+	Instance string             `json:"instance"`
+	Zone     string             `json:"zone"`
+	SpansMs  map[string]float64 `json:"spansMs"`
+	URL      string             `json:"url"`
+}
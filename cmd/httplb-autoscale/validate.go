@@ -0,0 +1,511 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Limits the Compute API places on autoscaling policies.
+const (
+	// Scaling schedules must last at least five minutes.
+	minScheduleDurationSec = 300
+	minCoolDownPeriodSec   = 15
+	maxCoolDownPeriodSec   = 3600
+	maxZonalReplicas       = 1000
+	maxRegionalReplicas    = 2000
+	// Below this the autoscaler reacts to instances which are still booting.
+	recommendedCoolDownPeriodSec = 60
+)
+
+// Distribution shapes accepted for regional groups.
+var targetShapes = map[string]bool{
+	"EVEN":     true,
+	"BALANCED": true,
+	"ANY":      true,
+}
+
+// Predictive methods accepted by the autoscaler's CPU utilization signal.
+var predictiveMethods = map[string]bool{
+	"NONE":                  true,
+	"OPTIMIZE_AVAILABILITY": true,
+}
+
+// Target types accepted for custom metric signals.
+var metricTargetTypes = map[string]bool{
+	"GAUGE":            true,
+	"DELTA_PER_SECOND": true,
+	"DELTA_PER_MINUTE": true,
+}
+
+// metricNamePattern matches Cloud Monitoring metric types such as
+// "custom.googleapis.com/imagemagick/queue_length".
+var metricNamePattern = regexp.MustCompile(`^[a-z0-9.-]+\.googleapis\.com/[A-Za-z0-9_./-]+$`)
+
+// Severities of a diagnostic.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// A diagnostic describes one problem found in a policy config, and what to
+// do about it.
+type diagnostic struct {
+	severity string
+	field    string
+	message  string
+	hint     string
+}
+
+func (d diagnostic) String() string {
+	s := fmt.Sprintf("%s: %s: %s", d.severity, d.field, d.message)
+	if d.hint != "" {
+		s += "\n\thint: " + d.hint
+	}
+	return s
+}
+
+// A diagnostics collects the problems found in a config.
+type diagnostics []diagnostic
+
+func (ds *diagnostics) errorf(field, hint, format string, args ...interface{}) {
+	*ds = append(*ds, diagnostic{severityError, field, fmt.Sprintf(format, args...), hint})
+}
+
+func (ds *diagnostics) warnf(field, hint, format string, args ...interface{}) {
+	*ds = append(*ds, diagnostic{severityWarning, field, fmt.Sprintf(format, args...), hint})
+}
+
+// check returns the first error level problem in the config, if any.
+func (c *policyConfig) check() error {
+	for _, d := range c.diagnose() {
+		if d.severity == severityError {
+			return fmt.Errorf("%s: %s", d.field, d.message)
+		}
+	}
+	return nil
+}
+
+// diagnose checks the config against the constraints the Compute API places
+// on groups and autoscaling policies, returning every problem found.
+func (c *policyConfig) diagnose() diagnostics {
+	var ds diagnostics
+	if c.Project == "" {
+		ds.errorf("project", "", "is required")
+	}
+	c.diagnoseProjects(&ds)
+	switch {
+	case c.Zone == "" && c.Region == "":
+		ds.errorf("zone", "set zone for a zonal group or region for a regional one", "one of zone or region is required")
+	case c.Zone != "" && c.Region != "":
+		ds.errorf("zone", "remove zone and list the zones of a regional group under zones", "only one of zone or region may be set")
+	}
+	if c.Region == "" && (len(c.Zones) > 0 || c.TargetShape != "") {
+		ds.errorf("zones", "set region instead of zone", "zones and targetShape require a region")
+	}
+	if c.TargetShape != "" && !targetShapes[c.TargetShape] {
+		ds.errorf("targetShape", "use EVEN, BALANCED or ANY", "unknown shape %q", c.TargetShape)
+	}
+	for _, z := range c.Zones {
+		if !strings.HasPrefix(z, c.Region+"-") {
+			ds.errorf("zones", "", "zone %v is not in region %v", z, c.Region)
+		}
+	}
+	if c.Autohealing != nil && c.Autohealing.HealthCheck == "" {
+		ds.errorf("autohealing.healthCheck", "", "autohealing requires a health check")
+	}
+	if c.Stateful != nil {
+		if err := c.Stateful.check(); err != nil {
+			ds.errorf("stateful", "", "%v", err)
+		}
+	}
+	if c.Chaos != nil {
+		if err := c.Chaos.check(); err != nil {
+			ds.errorf("chaos", "", "%v", err)
+		}
+	}
+	if b := c.Budget; b != nil {
+		if err := b.check(); err != nil {
+			ds.errorf("budget", "", "%v", err)
+		} else if b.InstancePrice == 0 {
+			var t templateConfig
+			if c.InstanceTemplate != nil {
+				t = *c.InstanceTemplate
+			}
+			if _, err := instanceHourlyPrice(t); err != nil {
+				ds.errorf("budget.instancePrice", "set the hourly price of one instance", "%v", err)
+			}
+		}
+	}
+	if c.HTTPS != nil {
+		if err := c.HTTPS.check(); err != nil {
+			ds.errorf("https", "list the SSL certificates under https.certificates", "%v", err)
+		}
+		if err := checkHTTPSScenario(c); err != nil {
+			ds.warnf("scenario.url", "point a DNS name of the certificate at the load balancer's address", "%v", err)
+		}
+	}
+	if c.Notifications != nil {
+		if err := c.Notifications.check(); err != nil {
+			ds.errorf("notifications", "", "%v", err)
+		}
+	}
+	for name, port := range c.NamedPorts {
+		if port < 1 || port > 65535 {
+			ds.errorf("namedPorts."+name, "", "port %d is out of range", port)
+		}
+	}
+	if len(c.PerInstanceMetadata) > 0 {
+		if _, err := c.perInstanceMetadata(instanceParams{}); err != nil {
+			ds.errorf("perInstanceMetadata", "templates may use {{.Index}}, {{.Name}}, {{.RunID}} and {{.Seed}}", "%v", err)
+		}
+	}
+	if c.Group == "" {
+		ds.errorf("group", "", "is required")
+	}
+	if c.Autoscaler == "" {
+		ds.errorf("autoscaler", "", "is required")
+	}
+	if t := c.InstanceTemplate; t != nil {
+		if countSet(t.StartupScript != "", t.Server != nil, t.Container != nil) > 1 {
+			ds.errorf("instanceTemplate", "keep only the way of running the backend you want",
+				"only one of startupScript, server and container may be set")
+		}
+		if t.Container != nil {
+			if err := t.Container.check(); err != nil {
+				ds.errorf("instanceTemplate.container", "", "%v", err)
+			}
+		}
+		if t.Server != nil {
+			if err := t.Server.check(); err != nil {
+				ds.errorf("instanceTemplate.server", "", "%v", err)
+			}
+		}
+		switch {
+		case t.MachineType != "" && t.CustomMachine != nil:
+			ds.errorf("instanceTemplate.customMachine", "remove machineType to use the custom machine",
+				"only one of machineType and customMachine may be set")
+		case t.CustomMachine != nil:
+			if err := t.CustomMachine.check(); err != nil {
+				ds.errorf("instanceTemplate.customMachine", "", "%v", err)
+			}
+		case t.MachineType != "":
+			if err := checkMachineType(t.MachineType); err != nil {
+				ds.errorf("instanceTemplate.machineType", "", "%v", err)
+			}
+		}
+		if t.Security != nil {
+			if err := t.Security.check(t.withDefaults().MachineType); err != nil {
+				ds.errorf("instanceTemplate.security", "", "%v", err)
+			}
+		}
+		if t.Scheduling != nil {
+			if err := t.Scheduling.check(); err != nil {
+				ds.errorf("instanceTemplate.scheduling", "", "%v", err)
+			}
+		}
+		for i, ac := range t.Accelerators {
+			if err := ac.check(t.withDefaults().MachineType); err != nil {
+				ds.errorf(fmt.Sprintf("instanceTemplate.accelerators[%d]", i), "", "%v", err)
+			}
+		}
+		if len(t.Accelerators) > 0 && t.Security != nil && t.Security.ConfidentialCompute {
+			ds.errorf("instanceTemplate.accelerators", "", "cannot be combined with confidentialCompute")
+		}
+		if b := t.Bake; b != nil {
+			if b.InstallScript == "" {
+				ds.errorf("instanceTemplate.bake.installScript", "", "must name the script run on the builder")
+			}
+			if b.RunScript == "" {
+				ds.warnf("instanceTemplate.bake.runScript", "template create -baked needs it", "is not set")
+			}
+		}
+	}
+	c.diagnoseBackends(&ds)
+	c.diagnoseServices(&ds)
+	c.diagnoseSize(&ds)
+	c.diagnoseSignals(&ds)
+	c.diagnoseSchedules(&ds)
+	return ds
+}
+
+// diagnoseBackends checks the capacity settings of the group and the
+// groups declared as backends.
+func (c *policyConfig) diagnoseBackends(ds *diagnostics) {
+	if len(c.Backends) > 0 && c.BackendService == "" {
+		ds.errorf("backends", "set backendService", "backends require a backend service to attach to")
+	}
+	if c.Capacity != nil {
+		diagnoseCapacity(ds, "capacity", c.Capacity)
+	}
+	groups := map[string]bool{c.Group: true}
+	for i := range c.Backends {
+		b := &c.Backends[i]
+		field := fmt.Sprintf("backends[%d]", i)
+		switch {
+		case b.Group == "":
+			ds.errorf(field+".group", "", "is required")
+		case groups[b.Group]:
+			ds.errorf(field+".group", "", "group %v is declared more than once", b.Group)
+		}
+		groups[b.Group] = true
+		if b.Zone != "" && b.Region != "" {
+			ds.errorf(field+".zone", "", "only one of zone or region may be set")
+		}
+		diagnoseCapacity(ds, field, b)
+	}
+}
+
+// diagnoseCapacity checks the capacity settings of one backend.
+func diagnoseCapacity(ds *diagnostics, field string, b *backendConfig) {
+	if b.BalancingMode != "" && !balancingModes[b.BalancingMode] {
+		ds.errorf(field+".balancingMode", "use UTILIZATION, RATE or CONNECTION", "unknown mode %q", b.BalancingMode)
+	}
+	if b.MaxUtilization < 0 || b.MaxUtilization > 1 {
+		ds.errorf(field+".maxUtilization", "", "must be between 0 and 1")
+	}
+	if b.BalancingMode == "RATE" && b.MaxRatePerInstance <= 0 {
+		ds.errorf(field+".maxRatePerInstance", "", "RATE balancing needs a positive maxRatePerInstance")
+	}
+	if b.CapacityScaler < 0 || b.CapacityScaler > 1 {
+		ds.errorf(field+".capacityScaler", "", "must be between 0 and 1")
+	}
+}
+
+// diagnoseSize checks the replica limits and cool down period.
+func (c *policyConfig) diagnoseSize(ds *diagnostics) {
+	limit := int64(maxZonalReplicas)
+	if c.regional() {
+		limit = maxRegionalReplicas
+	}
+	switch {
+	case c.MaxReplicas < 1:
+		ds.errorf("maxReplicas", "", "must be at least 1")
+	case c.MaxReplicas > limit:
+		ds.errorf("maxReplicas", "", "must be at most %d for this kind of group", limit)
+	}
+	if c.MinReplicas < 0 {
+		ds.errorf("minReplicas", "", "must not be negative")
+	}
+	if c.MinReplicas > c.MaxReplicas {
+		ds.errorf("minReplicas", "lower minReplicas or raise maxReplicas",
+			"minReplicas (%d) is greater than maxReplicas (%d)", c.MinReplicas, c.MaxReplicas)
+	}
+	if c.TargetSize > c.MaxReplicas && c.MaxReplicas > 0 {
+		ds.warnf("targetSize", "", "targetSize (%d) is above maxReplicas; the autoscaler will shrink the group", c.TargetSize)
+	}
+	switch {
+	case c.CoolDownPeriodSec == 0:
+		// The API default applies.
+	case c.CoolDownPeriodSec < minCoolDownPeriodSec || c.CoolDownPeriodSec > maxCoolDownPeriodSec:
+		ds.errorf("coolDownPeriodSec", "", "must be between %d and %d", minCoolDownPeriodSec, maxCoolDownPeriodSec)
+	case c.CoolDownPeriodSec < recommendedCoolDownPeriodSec:
+		ds.warnf("coolDownPeriodSec", "set it to at least the time an instance takes to start serving",
+			"%ds is shorter than a typical boot; booting instances will skew utilization", c.CoolDownPeriodSec)
+	}
+}
+
+// diagnoseSignals checks each scaling signal and the combination of them.
+func (c *policyConfig) diagnoseSignals(ds *diagnostics) {
+	cpu := c.CPUUtilization > 0
+	lb := c.LoadBalancingUtilization > 0
+	if !cpu && !lb && len(c.CustomMetrics) == 0 && len(c.Schedules) == 0 {
+		ds.errorf("cpuUtilization", "set cpuUtilization, loadBalancingUtilization, customMetrics or schedules",
+			"policy declares no scaling signals")
+	}
+	if c.CPUUtilization < 0 || c.CPUUtilization > 1 {
+		ds.errorf("cpuUtilization", "targets are fractions, e.g. 0.6 for 60%", "must be between 0 and 1")
+	}
+	if c.LoadBalancingUtilization < 0 || c.LoadBalancingUtilization > 1 {
+		ds.errorf("loadBalancingUtilization", "targets are fractions, e.g. 0.8 for 80%", "must be between 0 and 1")
+	}
+	if c.PredictiveMethod != "" && !predictiveMethods[c.PredictiveMethod] {
+		ds.errorf("predictiveMethod", "use NONE or OPTIMIZE_AVAILABILITY", "unknown method %q", c.PredictiveMethod)
+	}
+	if c.PredictiveMethod != "" && c.PredictiveMethod != "NONE" && !cpu {
+		ds.errorf("predictiveMethod", "predictive autoscaling only forecasts CPU; set cpuUtilization",
+			"requires cpuUtilization")
+	}
+	if lb && c.BackendService == "" {
+		ds.errorf("loadBalancingUtilization", "set backendService to the service the group serves",
+			"requires backendService, so the group's balancing mode can be checked")
+	}
+	seen := map[string]bool{}
+	for i, m := range c.CustomMetrics {
+		field := fmt.Sprintf("customMetrics[%d]", i)
+		key := m.Metric + " " + m.Filter
+		switch {
+		case m.Metric == "":
+			ds.errorf(field+".metric", "", "is required")
+		case !metricNamePattern.MatchString(m.Metric):
+			ds.errorf(field+".metric", "metric types look like custom.googleapis.com/NAME",
+				"%q is not a Cloud Monitoring metric type", m.Metric)
+		case seen[key]:
+			ds.errorf(field+".metric", "remove the duplicate or give it a different filter",
+				"%v is declared more than once", m.Metric)
+		}
+		seen[key] = true
+		switch {
+		case m.SingleInstanceAssignment > 0 && m.Target > 0:
+			ds.errorf(field, "use target for per-instance metrics and singleInstanceAssignment for group wide ones",
+				"sets both target and singleInstanceAssignment")
+		case m.SingleInstanceAssignment <= 0 && m.Target <= 0:
+			ds.errorf(field, "", "needs a positive target or singleInstanceAssignment")
+		case m.SingleInstanceAssignment > 0 && m.TargetType != "":
+			ds.errorf(field+".targetType", "remove targetType", "does not apply with singleInstanceAssignment")
+		}
+		if m.TargetType != "" && !metricTargetTypes[m.TargetType] {
+			ds.errorf(field+".targetType", "use GAUGE, DELTA_PER_SECOND or DELTA_PER_MINUTE",
+				"unknown type %q", m.TargetType)
+		}
+	}
+	if cpu && c.CPUUtilization < 0.1 {
+		ds.warnf("cpuUtilization", "", "a target of %v will keep the group near maxReplicas", c.CPUUtilization)
+	}
+}
+
+// diagnoseSchedules checks the scaling schedules.
+func (c *policyConfig) diagnoseSchedules(ds *diagnostics) {
+	seen := map[string]bool{}
+	for i, s := range c.Schedules {
+		field := fmt.Sprintf("schedules[%d]", i)
+		switch {
+		case s.Name == "":
+			ds.errorf(field+".name", "", "is required")
+		case seen[s.Name]:
+			ds.errorf(field+".name", "", "schedule %q is declared more than once", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Schedule == "" {
+			ds.errorf(field+".schedule", "", "a cron expression is required")
+		} else if n := len(strings.Fields(s.Schedule)); n != 5 {
+			ds.errorf(field+".schedule", `use five fields: minute hour day-of-month month day-of-week, e.g. "0 8 * * MON-FRI"`,
+				"%q has %d fields", s.Schedule, n)
+		}
+		if s.DurationSec < minScheduleDurationSec {
+			ds.errorf(field+".durationSec", "", "must be at least %d", minScheduleDurationSec)
+		}
+		if s.TimeZone != "" {
+			if _, err := time.LoadLocation(s.TimeZone); err != nil {
+				ds.errorf(field+".timeZone", "use an IANA name such as America/New_York", "unknown time zone %q", s.TimeZone)
+			}
+		}
+		if s.MinRequiredReplicas > c.MaxReplicas {
+			ds.warnf(field+".minRequiredReplicas", "raise maxReplicas",
+				"%d is above maxReplicas and will be capped at %d", s.MinRequiredReplicas, c.MaxReplicas)
+		}
+	}
+}
+
+// validateCmd checks a policy config without touching the project and prints
+// every problem found. It exits non-zero if any problem is an error.
+func validateCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler validate", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	fs.Parse(args)
+	return validateConfigFile(*configPath)
+}
+
+// configValidateCmd checks the whole config, topology and load scenario,
+// after applying the environment and -set overrides.
+func configValidateCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the config.")
+	fs.Parse(args)
+	return validateConfigFile(*configPath)
+}
+
+// validateConfigFile prints the diagnostics of a config file, failing if
+// any is an error.
+func validateConfigFile(configPath string) error {
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	c := &policyConfig{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		// Unknown fields are most likely typos, which would otherwise be
+		// silently ignored.
+		return fmt.Errorf("%v: %v", configPath, err)
+	}
+	if err := c.applyProfile(true); err != nil {
+		return fmt.Errorf("%v: %v", configPath, err)
+	}
+	if err := c.applyOverrides(); err != nil {
+		return err
+	}
+	c.applyGcloudDefaults()
+	ds := c.diagnose()
+	if c.Scenario != nil {
+		if err := c.Scenario.Check(); err != nil {
+			ds.errorf("scenario", "give the scenario a url and either phases with positive durations and qps, a flashCrowd or a diurnal pattern", "%v", err)
+		} else if d := c.Scenario.Diurnal; d != nil && len(c.Schedules) > 0 {
+			if _, err := compressSchedules(c.Schedules, d, time.Now()); err != nil {
+				ds.warnf("schedules", "write the schedules as daily cron expressions so that experiments can compress them with the simulated day", "%v", err)
+			}
+		}
+	}
+	r := &validationResult{Config: configPath, Diagnostics: []diagnosticResult{}}
+	errs := 0
+	for _, d := range ds {
+		r.Diagnostics = append(r.Diagnostics, diagnosticResult{d.severity, d.field, d.message, d.hint})
+		if d.severity == severityError {
+			errs++
+		}
+	}
+	r.Valid = errs == 0
+	// Diagnostics are for people, so the table form goes to stderr.
+	err = printResult(r, func(io.Writer) error {
+		for _, d := range ds {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if len(ds) == 0 {
+			fmt.Fprintf(os.Stderr, "%v is valid.\n", configPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if errs > 0 {
+		return fmt.Errorf("%v has %d error(s)", configPath, errs)
+	}
+	return nil
+}
+
+// A validationResult is the result of config validate.
+type validationResult struct {
+	Config      string             `json:"config"`
+	Valid       bool               `json:"valid"`
+	Diagnostics []diagnosticResult `json:"diagnostics"`
+}
+
+// A diagnosticResult is one diagnostic of a validationResult.
+type diagnosticResult struct {
+	Severity string `json:"severity"`
+	Field    string `json:"field"`
+	Message  string `json:"message"`
+	Hint     string `json:"hint,omitempty"`
+}
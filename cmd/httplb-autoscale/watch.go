@@ -0,0 +1,450 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+// A watcher polls an autoscaler and the group it scales, emitting an event
+// whenever something changes.
+type watcher struct {
+	// compute reads the autoscaler and the group.
+	compute provision.Compute
+	// s serves the detectors and preemption checks, which need more of the
+	// API than compute has. It may be nil if none of the detectors is set,
+	// in which case every recreation is reported as one, preempted or not.
+	s    *compute.Service
+	c    *policyConfig
+	out  io.Writer
+	last *report.WatchEvent
+	// atMax, if set, raises alerts when the group is pinned at its maximum.
+	atMax *atMaxDetector
+	// spikes, if set, raises alerts when the load balancer serves too many
+	// 5xx responses.
+	spikes *errorSpikeDetector
+	// boot, if set, measures how long new instances take to serve.
+	boot *bootTracker
+	// flaps, if set, raises alerts for instances whose health keeps
+	// changing.
+	flaps *flapDetector
+	// annotations, if set, marks each scaling decision on dashboards.
+	annotations *annotator
+	// recreating holds the instances currently being recreated.
+	recreating map[string]bool
+	// timeline, if set, records every sample and event for later analysis.
+	timeline *timeline
+	// chaos, if set, fails instances on purpose.
+	chaos *chaosController
+	// budget, if set, stops the run from spending more than its budget.
+	budget *budgetGuard
+}
+
+// watchCmd streams autoscaler and group state until interrupted or until the
+// requested duration elapses.
+func watchCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("autoscaler watch", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	interval := fs.Duration("interval", 5*time.Second, "Time between polls.")
+	duration := fs.Duration("duration", 0, "Stop after this long; 0 watches until interrupted.")
+	outPath := fs.String("out", "", "Also append events to this file.")
+	atMaxAfter := fs.Duration("at-max-after", 2*time.Minute, "Alert once the group has been at its maximum size this long.")
+	webhook := fs.String("webhook", "", "POST alerts as JSON to this URL.")
+	max5xxRate := fs.Float64("max-5xx-rate", 0.01, "Alert when 5xx responses exceed this fraction of requests in any minute; 0 disables the check.")
+	min5xxQPS := fs.Float64("min-5xx-qps", 1, "Ignore minutes with fewer requests per second than this when checking 5xx responses.")
+	flapThreshold := fs.Int("flap-threshold", 4, "Alert when an instance's health changes this many times within -flap-window; 0 disables the check.")
+	flapWindow := fs.Duration("flap-window", 10*time.Minute, "Window over which health changes are counted.")
+	timelinePath := fs.String("timeline", "", "Write every sample and event to this file as a timeline JSON document when the watch ends.")
+	grafanaURL := fs.String("grafana-url", "", "Create a Grafana annotation for each scale out and in through this server's API.")
+	grafanaToken := fs.String("grafana-token", "", "Grafana service account token; defaults to $GRAFANA_TOKEN.")
+	grafanaDashboard := fs.String("grafana-dashboard", "", "UID of the Grafana dashboard to annotate; all dashboards if empty.")
+	chaos := fs.Bool("chaos", false, "Fail instances as the config's chaos section says while watching.")
+	annotateMetric := fs.Bool("annotate-metric", false, "Write each scale out and in to the "+scalingEventMetric+" metric.")
+	fs.Parse(args)
+
+	c, err := loadPolicyConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	s, err := newComputeService()
+	if err != nil {
+		return fmt.Errorf("failed to create Compute client: %v", err)
+	}
+	w := &watcher{
+		compute: provision.NewCompute(s),
+		s:       s,
+		c:       c,
+		out:     os.Stdout,
+		atMax:   &atMaxDetector{threshold: *atMaxAfter, webhook: *webhook},
+	}
+	if c.BackendService != "" {
+		w.boot = &bootTracker{backendService: c.BackendService}
+	}
+	if c.BackendService != "" && *flapThreshold > 0 {
+		w.flaps = &flapDetector{backendService: c.BackendService, threshold: *flapThreshold, window: *flapWindow, webhook: *webhook}
+	}
+	if c.BackendService != "" && *max5xxRate > 0 {
+		m, err := newMonitoringService()
+		if err != nil {
+			return fmt.Errorf("failed to create Monitoring client: %v", err)
+		}
+		w.spikes = &errorSpikeDetector{
+			w:       &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), filter: lbFilter(c.BackendService), period: time.Minute},
+			maxRate: *max5xxRate,
+			minQPS:  *min5xxQPS,
+			webhook: *webhook,
+		}
+	}
+	if *grafanaURL != "" || *annotateMetric {
+		if *grafanaToken == "" {
+			*grafanaToken = os.Getenv("GRAFANA_TOKEN")
+		}
+		w.annotations = &annotator{grafanaURL: *grafanaURL, grafanaToken: *grafanaToken, dashboardUID: *grafanaDashboard, project: c.projectFor(monitoringProjects)}
+		if *annotateMetric {
+			if w.annotations.m, err = newMonitoringWriteService(); err != nil {
+				return fmt.Errorf("failed to create Monitoring client: %v", err)
+			}
+		}
+	}
+	if *timelinePath != "" {
+		w.timeline = newTimeline(c)
+	}
+	if *chaos {
+		if c.Chaos == nil {
+			return errors.New("-chaos needs a chaos section in the config")
+		}
+		if w.chaos, err = newChaosController(c.Chaos); err != nil {
+			return err
+		}
+	}
+	if *outPath != "" {
+		f, err := os.OpenFile(*outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w.out = io.MultiWriter(os.Stdout, f)
+	}
+
+	w.run(ctx, *interval, stopChannel(*duration))
+	if w.boot != nil {
+		w.boot.logDistribution()
+	}
+	if w.flaps != nil {
+		w.flaps.logFlapping()
+	}
+	if w.spikes != nil && w.spikes.degraded {
+		log.Printf("Run degraded: the load balancer served too many 5xx responses in %d windows.", w.spikes.spikes)
+	}
+	if w.timeline != nil {
+		w.timeline.Degraded = w.spikes != nil && w.spikes.degraded
+		if err := w.timeline.write(*timelinePath); err != nil {
+			return fmt.Errorf("unable to write timeline: %v", err)
+		}
+		log.Printf("Wrote %d samples to %v.", len(w.timeline.Samples), *timelinePath)
+	}
+	return nil
+}
+
+// stopChannel returns a channel which is closed on interrupt, or once the
+// duration elapses if it is positive.
+func stopChannel(duration time.Duration) <-chan struct{} {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if duration > 0 {
+		deadline = time.After(duration)
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-deadline:
+		case <-interrupt:
+		}
+		close(stop)
+	}()
+	return stop
+}
+
+// run polls at the given interval until stop is closed.
+func (w *watcher) run(ctx context.Context, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.poll(ctx); err != nil {
+			log.Printf("Poll failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// poll samples the autoscaler and group once and emits an event if their
+// state differs from the previous sample.
+func (w *watcher) poll(ctx context.Context) error {
+	e, mig, instances, err := w.sample(ctx)
+	if err != nil {
+		return err
+	}
+	if w.timeline != nil {
+		w.timeline.addSample(e)
+	}
+	if w.boot != nil {
+		events, err := w.boot.observe(ctx, w.s, w.c, mig, instances, e)
+		if err != nil {
+			log.Printf("Unable to track instance boot times: %v", err)
+		}
+		for _, b := range events {
+			if err := w.emit(b); err != nil {
+				return err
+			}
+		}
+	}
+	if w.flaps != nil {
+		alerts, err := w.flaps.observe(ctx, w.s, w.c, mig, e)
+		if err != nil {
+			log.Printf("Unable to track instance health: %v", err)
+		}
+		for _, a := range alerts {
+			if err := w.emit(a); err != nil {
+				return err
+			}
+		}
+	}
+	if w.chaos != nil {
+		actions, err := w.chaos.observe(ctx, w.s, w.c, instances, e)
+		if err != nil {
+			log.Printf("Chaos action failed: %v", err)
+		}
+		for _, a := range actions {
+			if w.spikes != nil {
+				w.spikes.observe(a)
+			}
+			if err := w.emit(a); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range w.recreations(ctx, instances, e) {
+		if w.spikes != nil {
+			w.spikes.observe(r)
+		}
+		if err := w.emit(r); err != nil {
+			return err
+		}
+	}
+	if w.spikes != nil {
+		w.spikes.observe(e)
+		for _, a := range w.spikes.check(ctx, e) {
+			if err := w.emit(a); err != nil {
+				return err
+			}
+		}
+	}
+	if w.atMax != nil {
+		if a := w.atMax.check(e); a != nil {
+			if err := w.emit(a); err != nil {
+				return err
+			}
+		}
+	}
+	if w.budget != nil {
+		if a := w.budget.observe(ctx, w.s, w.c, e); a != nil {
+			if err := w.emit(a); err != nil {
+				return err
+			}
+		}
+	}
+	if e.SameState(w.last) {
+		return nil
+	}
+	if w.annotations != nil {
+		if err := w.annotations.annotate(ctx, w.last, e); err != nil {
+			log.Print(err)
+		}
+	}
+	w.last = e
+	return w.emit(e)
+}
+
+// sample reads the current state of the autoscaler and its group. Along with
+// the event it returns the group and instances it was built from.
+func (w *watcher) sample(ctx context.Context) (*report.WatchEvent, *compute.InstanceGroupManager, []*compute.ManagedInstance, error) {
+	c := w.c
+	a, err := w.compute.GetAutoscaler(ctx, c.autoscaler())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mig, err := w.compute.GetGroup(ctx, c.group())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	instances, err := w.compute.ListManagedInstances(ctx, c.group())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	e := &report.WatchEvent{
+		Time:             time.Now().UTC(),
+		Type:             "state",
+		Autoscaler:       a.Name,
+		Group:            mig.Name,
+		Status:           a.Status,
+		Mode:             autoscale.Mode(a),
+		PredictiveMethod: predictiveMethod(a.AutoscalingPolicy),
+		RecommendedSize:  a.RecommendedSize,
+		TargetSize:       mig.TargetSize,
+		ActualSize:       int64(len(instances)),
+	}
+	if a.AutoscalingPolicy != nil {
+		e.MaxSize = a.AutoscalingPolicy.MaxNumReplicas
+	}
+	for _, d := range a.StatusDetails {
+		e.StatusDetails = append(e.StatusDetails, report.StatusDetail{Type: d.Type, Message: d.Message})
+	}
+	for _, i := range instances {
+		if i.InstanceStatus == "RUNNING" && i.CurrentAction == "NONE" {
+			e.RunningSize++
+		}
+		if c.regional() {
+			if e.ZoneSizes == nil {
+				e.ZoneSizes = make(map[string]int64)
+			}
+			e.ZoneSizes[instanceZone(i.Instance)]++
+		}
+	}
+	e.PreservedState = preservedStates(instances)
+	return e, mig, instances, nil
+}
+
+// recreations returns an event for each instance which has started being
+// recreated since the previous sample. The group recreates instances when
+// autohealing finds them unhealthy, and Spot instances after they are
+// preempted; unlike autoscaling this leaves the target size unchanged, so it
+// is reported separately. Preemptions are reported as "instance-preempted"
+// and other recreations as "instance-recreating".
+func (w *watcher) recreations(ctx context.Context, instances []*compute.ManagedInstance, e *report.WatchEvent) []*report.WatchEvent {
+	now := make(map[string]bool)
+	var events []*report.WatchEvent
+	for _, i := range instances {
+		if i.CurrentAction != "RECREATING" {
+			continue
+		}
+		name := path.Base(i.Instance)
+		now[name] = true
+		if w.recreating[name] {
+			continue
+		}
+		r := *e
+		r.Instance = name
+		var preempted bool
+		if w.s != nil {
+			var err error
+			preempted, err = wasPreempted(ctx, w.s, w.c.Project, instanceZone(i.Instance), name, time.Now().Add(-preemptionWindow))
+			if err != nil {
+				log.Printf("Unable to check whether %v was preempted: %v", name, err)
+			}
+		}
+		if preempted {
+			r.Type = "instance-preempted"
+			r.Message = fmt.Sprintf("instance %v was preempted and is being recreated", name)
+		} else {
+			r.Type = "instance-recreating"
+			r.Message = fmt.Sprintf("instance %v is being recreated", name)
+			for _, h := range i.InstanceHealth {
+				r.Message += fmt.Sprintf("; %v reports %v", path.Base(h.HealthCheck), h.DetailedHealthState)
+			}
+		}
+		events = append(events, &r)
+	}
+	w.recreating = now
+	return events
+}
+
+// How recently an instance must have been preempted for its recreation to
+// be attributed to the preemption.
+const preemptionWindow = 10 * time.Minute
+
+// wasPreempted reports whether Compute Engine preempted the named instance
+// since the given time.
+func wasPreempted(ctx context.Context, s *compute.Service, project, zone, name string, since time.Time) (bool, error) {
+	filter := fmt.Sprintf(`operationType="compute.instances.preempted" AND targetLink:"%s"`, name)
+	ops, err := s.ZoneOperations.List(project, zone).Filter(filter).Context(ctx).Do()
+	if err != nil {
+		return false, err
+	}
+	for _, op := range ops.Items {
+		if path.Base(op.TargetLink) != name {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, op.InsertTime); err == nil && t.After(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// instanceZone extracts the zone from an instance URL of the form
+// ".../zones/ZONE/instances/NAME".
+func instanceZone(instanceURL string) string {
+	parts := strings.Split(instanceURL, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "zones" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// predictiveMethod returns the predictive method of a policy's CPU signal,
+// treating an unset method as "NONE".
+func predictiveMethod(p *compute.AutoscalingPolicy) string {
+	if p == nil || p.CpuUtilization == nil || p.CpuUtilization.PredictiveMethod == "" {
+		return "NONE"
+	}
+	return p.CpuUtilization.PredictiveMethod
+}
+
+// emit writes an event as a single line of JSON.
+func (w *watcher) emit(e *report.WatchEvent) error {
+	if w.timeline != nil && e.Type != "state" {
+		w.timeline.Events = append(w.timeline.Events, e)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.out, "%s\n", b)
+	return err
+}
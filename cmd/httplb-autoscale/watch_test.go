@@ -0,0 +1,108 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestWatcherSamplesBootingGroup(t *testing.T) {
+	c := testConfig()
+	sim := newTestSimulator(t, c, 3, "OFF", 0)
+	w := &watcher{compute: sim, c: c}
+	ctx := context.Background()
+
+	e, _, instances, err := w.sample(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 3 || e.ActualSize != 3 || e.TargetSize != 3 || e.RunningSize != 0 {
+		t.Errorf("while booting, sampled %d instances, %+v; want 3 of 3 none running", len(instances), e)
+	}
+	if e.Mode != "OFF" || e.MaxSize != c.MaxReplicas || e.Group != c.Group || e.Autoscaler != c.Autoscaler {
+		t.Errorf("sampled %+v, want the group and autoscaler of the config", e)
+	}
+
+	for deadline := time.Now().Add(testSettle); e.RunningSize != 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("after booting, %d instances run, want 3", e.RunningSize)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if e, _, _, err = w.sample(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcherEmitsScaleOut(t *testing.T) {
+	c := testConfig()
+	// 2.0 busy instances at 60% need 4.
+	sim := newTestSimulator(t, c, 1, "ON", 2.0)
+	var out bytes.Buffer
+	w := &watcher{compute: sim, c: c, out: &out}
+	ctx := context.Background()
+	for deadline := time.Now().Add(testSettle); w.last == nil || w.last.RunningSize != 4; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the group did not scale out to 4 running instances; last event %+v", w.last)
+		}
+		if err := w.poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var events []*report.WatchEvent
+	d := json.NewDecoder(&out)
+	for d.More() {
+		var e report.WatchEvent
+		if err := d.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &e)
+	}
+	if len(events) < 2 {
+		t.Fatalf("emitted %d events, want one per change of state", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].SameState(events[i-1]) {
+			t.Errorf("event %d repeats the state of the one before: %+v", i, events[i])
+		}
+	}
+	if first := events[0]; first.TargetSize != 1 {
+		t.Errorf("first event %+v, want the group at its size of 1", first)
+	}
+	if last := events[len(events)-1]; last.TargetSize != 4 || last.RecommendedSize != 4 {
+		t.Errorf("last event %+v, want the group scaled out to the recommended 4", last)
+	}
+}
+
+func TestWatcherRecreationsWithoutService(t *testing.T) {
+	w := &watcher{c: testConfig()}
+	instances := []*compute.ManagedInstance{
+		{Instance: "zones/us-central1-f/instances/web-1", CurrentAction: "RECREATING"},
+		{Instance: "zones/us-central1-f/instances/web-2", CurrentAction: "NONE"},
+	}
+	events := w.recreations(context.Background(), instances, &report.WatchEvent{Group: "web"})
+	if len(events) != 1 || events[0].Instance != "web-1" || events[0].Type != "instance-recreating" {
+		t.Errorf("recreations = %+v, want web-1 recreating, unchecked for a preemption", events)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// CPU time the generated file server burns per request, which sets how many
+// requests an instance can serve.
+const wizardBurnMillis = 50
+
+// vCPUs of the shared core machine types, which cannot be read from their
+// names.
+var sharedCoreVCPUs = map[string]float64{
+	"e2-micro": 0.25, "e2-small": 0.5, "e2-medium": 1, "f1-micro": 0.2, "g1-small": 0.5,
+}
+
+// machineVCPUs returns the number of vCPUs of a machine type, from its name.
+func machineVCPUs(name string) (float64, error) {
+	if m, ok := parseCustomMachine(name); ok {
+		return float64(m.VCPUs), nil
+	}
+	if n, ok := sharedCoreVCPUs[name]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("unable to tell the vCPUs of %v", name)
+	}
+	return float64(n), nil
+}
+
+// A wizardAnswers holds what the wizard learned, and what it derived from it.
+type wizardAnswers struct {
+	Project, Region, Zone, MachineType, Bucket string
+	PeakQPS                                    float64
+	HTTPS                                      bool
+	// Derived values.
+	CPUTarget             float64
+	BurnMillis            int
+	MinReplicas           int64
+	MaxReplicas           int64
+	QPSPerInstance        float64
+	RampQPS               float64
+	Group, Template       string
+	Autoscaler, Backend   string
+	ConfigPath, ImagePath string
+}
+
+// A prompter asks questions on a terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints a question with its default and returns the answer, or the
+// default if the answer is empty.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("no answer given")
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// askValid repeats a question until check accepts the answer.
+func (p *prompter) askValid(question, def string, check func(string) error) (string, error) {
+	for {
+		a, err := p.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if err := check(a); err != nil {
+			fmt.Fprintf(p.out, "  %v\n", err)
+			continue
+		}
+		return a, nil
+	}
+}
+
+// nonEmpty rejects empty answers.
+func nonEmpty(a string) error {
+	if a == "" {
+		return errors.New("an answer is required")
+	}
+	return nil
+}
+
+// yesNo parses a yes or no answer.
+func yesNo(a string) (bool, error) {
+	switch strings.ToLower(a) {
+	case "y", "yes":
+		return true, nil
+	case "n", "no":
+		return false, nil
+	}
+	return false, errors.New("answer y or n")
+}
+
+// wizardConfig is the config the wizard writes.
+var wizardConfig = template.Must(template.New("config").Parse(`# Written by httplb-autoscale init. See config.go for every field.
+project: {{.Project}}
+{{if .Zone}}zone: {{.Zone}}{{else}}region: {{.Region}}{{end}}
+group: {{.Group}}
+template: {{.Template}}
+targetSize: {{.MinReplicas}}
+instanceTemplate:
+  machineType: {{.MachineType}}
+  imageFamily: debian-12
+  imageProject: debian-cloud
+  server:
+    bucket: {{.Bucket}}
+    burnMillis: {{.BurnMillis}}
+namedPorts:
+  http: 80
+backendService: {{.Backend}}
+autoscaler: {{.Autoscaler}}
+minReplicas: {{.MinReplicas}}
+# Each instance serves about {{printf "%.0f" .QPSPerInstance}} QPS at the CPU target; the maximum
+# leaves room for {{printf "%.0f" .PeakQPS}} QPS with 50% to spare.
+maxReplicas: {{.MaxReplicas}}
+coolDownPeriodSec: 60
+cpuUtilization: {{.CPUTarget}}
+scenario:
+  # Replace with the address setup-lb prints.
+  url: http://LOAD_BALANCER_IP/
+  phases:
+  - duration: 5m
+    qps: {{printf "%.0f" .RampQPS}}
+  - duration: 10m
+    qps: {{printf "%.0f" .PeakQPS}}
+  - duration: 5m
+    qps: {{printf "%.0f" .RampQPS}}
+`))
+
+// wizardCommands lists the commands which run the configured test.
+var wizardCommands = template.Must(template.New("commands").Parse(`
+Wrote {{.ConfigPath}}. To run the test:
+
+	httplb-autoscale generate files -bucket {{.Bucket}} -image {{.ImagePath}}
+	httplb-autoscale template create -config {{.ConfigPath}}
+	httplb-autoscale mig create -config {{.ConfigPath}}
+	httplb-autoscale autoscaler create -config {{.ConfigPath}}
+	httplb-autoscale setup-lb -config {{.ConfigPath}}
+	# Set scenario.url in {{.ConfigPath}} to the printed address, then:
+	httplb-autoscale watch -config {{.ConfigPath}} -out run.jsonl &
+	httplb-autoscale loadgen run -config {{.ConfigPath}} -out run
+	httplb-autoscale report summary run.jsonl
+	httplb-autoscale teardown -config {{.ConfigPath}}
+{{if .HTTPS}}
+For HTTPS, create an SSL certificate and list it under https.certificates
+in {{.ConfigPath}} before setup-lb, with https.redirectHTTP: true to
+redirect port 80 to it.
+{{end}}`))
+
+// initCmd asks a first-time user a few questions and writes a config which
+// is ready to run, with the commands which run it.
+func initCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	outPath := fs.String("out", "autoscaler.yaml", "Path of the config to write.")
+	force := fs.Bool("force", false, "Overwrite an existing config.")
+	fs.Parse(args)
+	if _, err := os.Stat(*outPath); err == nil && !*force {
+		return fmt.Errorf("%v exists; use -force to overwrite it", *outPath)
+	}
+
+	props := gcloudProperties()
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	a := &wizardAnswers{ConfigPath: *outPath, CPUTarget: 0.6, BurnMillis: wizardBurnMillis}
+	var err error
+	if a.Project, err = p.askValid("Project", gcloudProperty(props, "core/project"), nonEmpty); err != nil {
+		return err
+	}
+	region := gcloudProperty(props, "compute/region")
+	if region == "" {
+		region = "us-central1"
+	}
+	if a.Region, err = p.askValid("Region", region, nonEmpty); err != nil {
+		return err
+	}
+	zone := gcloudProperty(props, "compute/zone")
+	if !strings.HasPrefix(zone, a.Region+"-") {
+		zone = a.Region + "-b"
+	}
+	if a.Zone, err = p.ask("Zone, or - to spread the group over the region", zone); err != nil {
+		return err
+	}
+	if a.Zone == "-" {
+		a.Zone = ""
+	}
+	if a.MachineType, err = p.askValid("Machine type", "e2-standard-2", checkMachineType); err != nil {
+		return err
+	}
+	if a.Bucket, err = p.askValid("Cloud Storage bucket for the served files", a.Project+"-images", nonEmpty); err != nil {
+		return err
+	}
+	if a.ImagePath, err = p.askValid("Image file to serve", "scripts/eiffel.jpg", nonEmpty); err != nil {
+		return err
+	}
+	qps, err := p.askValid("Expected peak QPS", "100", func(s string) error {
+		if v, err := strconv.ParseFloat(s, 64); err != nil || v <= 0 {
+			return errors.New("enter a positive number")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.PeakQPS, _ = strconv.ParseFloat(qps, 64)
+	https, err := p.askValid("Serve HTTPS? (y/n)", "n", func(s string) error { _, err := yesNo(s); return err })
+	if err != nil {
+		return err
+	}
+	a.HTTPS, _ = yesNo(https)
+
+	vcpus, err := machineVCPUs(a.MachineType)
+	if err != nil {
+		return err
+	}
+	a.QPSPerInstance = vcpus * 1000 / float64(a.BurnMillis) * a.CPUTarget
+	a.MinReplicas = 1
+	if a.Zone == "" {
+		// One instance in each of a region's usual three zones.
+		a.MinReplicas = 3
+	}
+	a.MaxReplicas = int64(math.Ceil(1.5 * a.PeakQPS / a.QPSPerInstance))
+	if a.MaxReplicas < a.MinReplicas+1 {
+		a.MaxReplicas = a.MinReplicas + 1
+	}
+	a.RampQPS = math.Max(1, a.PeakQPS/4)
+	a.Group, a.Template = "image-processing-group", "image-processing-template"
+	a.Autoscaler, a.Backend = "image-processing-autoscaler", "image-processing-backend"
+
+	f, err := os.Create(*outPath)
+	if err != nil {
+		return err
+	}
+	if err := wizardConfig.Execute(f, a); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := validateConfigFile(*outPath); err != nil {
+		return err
+	}
+	return wizardCommands.Execute(os.Stdout, a)
+}
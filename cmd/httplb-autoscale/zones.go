@@ -0,0 +1,248 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// Scope of the requests which no backend answered, so that their errors
+// still show up in the breakdown.
+const unknownScope = "unknown"
+
+// A scopeLatency summarizes the load generator's requests served from one
+// zone or region. Rows are written as one JSON object per line.
+type scopeLatency struct {
+	Scope string `json:"scope"`
+	// ScopeType is "zone" or "region".
+	ScopeType string  `json:"scopeType"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	P50Ms     float64 `json:"p50Ms"`
+	P95Ms     float64 `json:"p95Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+}
+
+// zoneRegion returns the region of a zone, e.g. us-central1 for
+// us-central1-f.
+func zoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// scopeLatencies breaks the run down by the zone and by the region of the
+// backend which served each request: zones first, then regions, each in
+// name order.
+func scopeLatencies(r *loadgen.Result) []*scopeLatency {
+	byZone := map[string][]loadgen.Sample{}
+	byRegion := map[string][]loadgen.Sample{}
+	for _, s := range r.Samples() {
+		zone, region := s.Zone, zoneRegion(s.Zone)
+		if zone == "" {
+			zone, region = unknownScope, unknownScope
+		}
+		byZone[zone] = append(byZone[zone], s)
+		byRegion[region] = append(byRegion[region], s)
+	}
+	var rows []*scopeLatency
+	for _, g := range []struct {
+		scopeType string
+		samples   map[string][]loadgen.Sample
+	}{{"zone", byZone}, {"region", byRegion}} {
+		scopes := make([]string, 0, len(g.samples))
+		for scope := range g.samples {
+			scopes = append(scopes, scope)
+		}
+		sort.Strings(scopes)
+		for _, scope := range scopes {
+			row := &scopeLatency{Scope: scope, ScopeType: g.scopeType}
+			var latencies []time.Duration
+			for _, s := range g.samples[scope] {
+				row.Requests++
+				if !s.OK {
+					row.Errors++
+					continue
+				}
+				latencies = append(latencies, s.Latency)
+			}
+			sort.Sort(report.Durations(latencies))
+			row.P50Ms = report.Millis(report.Percentile(latencies, 0.5))
+			row.P95Ms = report.Millis(report.Percentile(latencies, 0.95))
+			row.P99Ms = report.Millis(report.Percentile(latencies, 0.99))
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// writeScopeLatencies writes rows to path as JSON lines.
+func writeScopeLatencies(path string, rows []*scopeLatency) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readScopeLatencies reads a file written by writeScopeLatencies.
+func readScopeLatencies(path string) ([]*scopeLatency, error) {
+	var rows []*scopeLatency
+	err := readJSONLines(path, func(line []byte) error {
+		row := &scopeLatency{}
+		rows = append(rows, row)
+		return json.Unmarshal(line, row)
+	})
+	return rows, err
+}
+
+// backendScopeLatencies returns the load balancer's backend latency
+// percentiles over the whole window for each backend scope: the zone of a
+// zonal group or the region of a regional one.
+func backendScopeLatencies(ctx context.Context, w *metricsWatcher, start, end time.Time) (map[string][3]float64, error) {
+	// One alignment period spanning the window yields one point per scope.
+	w.period = end.Sub(start).Truncate(time.Second)
+	if w.period < time.Minute {
+		w.period = time.Minute
+	}
+	latencies := map[string][3]float64{}
+	for i, lm := range lbMetrics[2:5] {
+		lm.GroupBy = []string{"resource.label.backend_scope"}
+		points, err := w.query(ctx, lm, start, start.Add(w.period))
+		if err != nil {
+			return nil, fmt.Errorf("unable to query %v: %v", lm.Name, err)
+		}
+		for _, p := range points {
+			scope := p.Labels["backend_scope"]
+			l := latencies[scope]
+			l[i] = p.Value
+			latencies[scope] = l
+		}
+	}
+	return latencies, nil
+}
+
+// reportZonesCmd breaks a run's latency down by serving zone and region,
+// which the global load balancer's totals hide: the load generator's view,
+// from the X-Zone header of each response, next to the load balancer's
+// backend latency from Cloud Monitoring.
+func reportZonesCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("report zones", flag.ExitOnError)
+	configPath := fs.String("config", "autoscaler.yaml", "Path to the autoscaler policy config.")
+	zonesPath := fs.String("zones", "", "Zone latency file of the run, as written by autoscaler experiment.")
+	noMetrics := fs.Bool("no-metrics", false, "Do not query Cloud Monitoring for backend latency.")
+	wf := addWindowFlags(fs)
+	fs.Parse(args)
+	if *zonesPath == "" && *noMetrics {
+		return errors.New("-zones is required with -no-metrics")
+	}
+
+	var rows []*scopeLatency
+	if *zonesPath != "" {
+		var err error
+		if rows, err = readScopeLatencies(*zonesPath); err != nil {
+			return err
+		}
+	}
+	backend := map[string][3]float64{}
+	if !*noMetrics {
+		c, err := loadPolicyConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		if c.BackendService == "" {
+			return errors.New("config does not name a backend service")
+		}
+		start, end, err := wf.window()
+		if err != nil {
+			return err
+		}
+		m, err := newMonitoringService()
+		if err != nil {
+			return fmt.Errorf("failed to create Monitoring client: %v", err)
+		}
+		w := &metricsWatcher{m: m, project: c.projectFor(monitoringProjects), filter: lbFilter(c.BackendService)}
+		if backend, err = backendScopeLatencies(ctx, w, start, end); err != nil {
+			return err
+		}
+	}
+	// Scopes only known to Cloud Monitoring get rows of their own.
+	seen := map[string]bool{}
+	for _, row := range rows {
+		seen[row.Scope] = true
+	}
+	var extra []string
+	for scope := range backend {
+		if !seen[scope] {
+			extra = append(extra, scope)
+		}
+	}
+	sort.Strings(extra)
+	for _, scope := range extra {
+		rows = append(rows, &scopeLatency{Scope: scope, ScopeType: "backend scope"})
+	}
+
+	results := []zoneResult{}
+	for _, row := range rows {
+		r := zoneResult{scopeLatency: row}
+		if l, ok := backend[row.Scope]; ok {
+			r.BackendP50Ms, r.BackendP95Ms, r.BackendP99Ms = &l[0], &l[1], &l[2]
+		}
+		results = append(results, r)
+	}
+	return printResult(results, func(w io.Writer) error {
+		tw := newTable(w)
+		fmt.Fprintln(tw, "SCOPE\tTYPE\tREQUESTS\tERRORS\tP50\tP95\tP99\tBACKEND P50\tBACKEND P95\tBACKEND P99")
+		for _, r := range results {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1fms\t%.1fms\t%.1fms", r.Scope, r.ScopeType, r.Requests,
+				r.Errors, r.P50Ms, r.P95Ms, r.P99Ms)
+			if r.BackendP50Ms != nil {
+				fmt.Fprintf(tw, "\t%.1fms\t%.1fms\t%.1fms\n", *r.BackendP50Ms, *r.BackendP95Ms, *r.BackendP99Ms)
+			} else {
+				fmt.Fprintln(tw, "\t-\t-\t-")
+			}
+		}
+		return tw.Flush()
+	})
+}
+
+// A zoneResult is one scope's row of report zones: the load generator's
+// latencies, and the load balancer's backend latencies when they are known.
+type zoneResult struct {
+	*scopeLatency
+	BackendP50Ms *float64 `json:"backendP50Ms,omitempty"`
+	BackendP95Ms *float64 `json:"backendP95Ms,omitempty"`
+	BackendP99Ms *float64 `json:"backendP99Ms,omitempty"`
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary main samples the image processing server running on this VM and
+// writes its queue length and in-flight request count to Cloud Monitoring as
+// custom metrics. The autoscaler can then scale the group on those metrics
+// rather than on CPU alone. It labels each point with this instance's
+// gce_instance resource, which is what per-instance custom metric autoscaling
+// expects.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const (
+	metadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+	// Prefix of the metric types written by this agent.
+	metricPrefix = "custom.googleapis.com/imagemagick/"
+)
+
+var (
+	statusURL = flag.String("status-url", "http://localhost/statusz", "URL of the server's status handler.")
+	interval  = flag.Duration("interval", 30*time.Second, "Time between samples.")
+)
+
+// A serverStatus is the JSON document written by the server's status handler.
+type serverStatus struct {
+	QueueLength int64 `json:"queueLength"`
+	InFlight    int64 `json:"inFlight"`
+}
+
+// metadata reads a value from the instance metadata server.
+func metadata(key string) (string, error) {
+	req, err := http.NewRequest("GET", metadataURL+key, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %v for %v", resp.Status, key)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	return strings.TrimSpace(string(b)), err
+}
+
+// instanceResource describes this VM as a monitored resource.
+func instanceResource() (*monitoring.MonitoredResource, string, error) {
+	project, err := metadata("project/project-id")
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := metadata("instance/id")
+	if err != nil {
+		return nil, "", err
+	}
+	zone, err := metadata("instance/zone")
+	if err != nil {
+		return nil, "", err
+	}
+	// The zone is returned as "projects/NUMBER/zones/ZONE".
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	return &monitoring.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  project,
+			"instance_id": id,
+			"zone":        zone,
+		},
+	}, project, nil
+}
+
+// sampleStatus fetches the server's current status.
+func sampleStatus() (*serverStatus, error) {
+	resp, err := http.Get(*statusURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	st := &serverStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// gauge builds a single point time series for one of our metrics.
+func gauge(resource *monitoring.MonitoredResource, name string, value int64, t time.Time) *monitoring.TimeSeries {
+	return &monitoring.TimeSeries{
+		Metric:     &monitoring.Metric{Type: metricPrefix + name},
+		Resource:   resource,
+		MetricKind: "GAUGE",
+		ValueType:  "INT64",
+		Points: []*monitoring.Point{{
+			Interval: &monitoring.TimeInterval{EndTime: t.UTC().Format(time.RFC3339Nano)},
+			Value:    &monitoring.TypedValue{Int64Value: &value},
+		}},
+	}
+}
+
+func main() {
+	flag.Parse()
+	resource, project, err := instanceResource()
+	if err != nil {
+		log.Fatalf("Failed to describe this instance: %v", err)
+	}
+	service, err := monitoring.New(oauth2.NewClient(oauth2.NoContext, google.ComputeTokenSource("")))
+	if err != nil {
+		log.Fatalf("Failed to create Monitoring client: %v", err)
+	}
+	log.Printf("Writing %squeue_length and %sin_flight for instance %v every %v.", metricPrefix,
+		metricPrefix, resource.Labels["instance_id"], *interval)
+	for _ = range time.Tick(*interval) {
+		st, err := sampleStatus()
+		if err != nil {
+			log.Printf("Unable to sample %v: %v", *statusURL, err)
+			continue
+		}
+		now := time.Now()
+		req := &monitoring.CreateTimeSeriesRequest{
+			TimeSeries: []*monitoring.TimeSeries{
+				gauge(resource, "queue_length", st.QueueLength, now),
+				gauge(resource, "in_flight", st.InFlight, now),
+			},
+		}
+		if _, err := service.Projects.TimeSeries.Create("projects/"+project, req).Do(); err != nil {
+			log.Printf("Unable to write metrics: %v", err)
+		}
+	}
+}
@@ -32,6 +32,16 @@ go get code.google.com/p/goauth2/compute/serviceaccount
 #Get go API client for Google Cloud Storage
 go get code.google.com/p/google-api-go-client/storage/v1
 
+#Get go API client for Cloud Monitoring, used by the custom metrics agent
+go get google.golang.org/api/monitoring/v3
+
+# Per-instance values created by "httplb-autoscale mig add-instances" (see
+# perInstanceMetadata in cmd/httplb-autoscale/perinstance.go) are ordinary metadata
+# attributes which differ between instances. They are empty on instances
+# created by resizing the group, so the programs below must not require them.
+export SHARD=$($GMV attributes/shard 2>/dev/null)
+export SEED=$($GMV attributes/seed 2>/dev/null)
+
 # Get the go code to generate our initial image load.
 #go get github.com/GoogleCloudPlatform/httplb-autoscaling-go/scripts
 go get golang.org/x/oauth2
@@ -63,3 +73,23 @@ function runServer {
   done
 }
 runServer &
+
+# Run the custom metrics agent, if the instance metadata names one, so the
+# autoscaler can scale on the server's queue length. It is restarted if it
+# fails, just like the server.
+function runAgent {
+  #Get metrics agent URL from instance Metadata
+  AGENTURL=$($GMV attributes/agentprog 2>/dev/null)
+  if [ -z "$AGENTURL" ]; then
+    return
+  fi
+  while :
+  do
+    curl -O $AGENTURL
+    AGENTPROG=${AGENTURL##*/}
+    echo "Running agent $AGENTPROG"
+    go run ./$AGENTPROG
+    sleep 5
+  done
+}
+runAgent &
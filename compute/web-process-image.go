@@ -12,10 +12,17 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// The server is fetched and run on its own by compute/scripts/startup-test-go.sh
+// against the GOPATH-era client libraries, rather than built as part of the
+// module.
+
+//go:build ignore
+
 package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +33,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/goauth2/compute/serviceaccount"
@@ -40,6 +48,8 @@ const (
 
 var (
 	hostname string
+	// The number of images currently being processed, across all processors.
+	inFlight int64
 	// A map of HTTP response codes which we consider to be retryable.
 	retryableCodes = map[int]bool{
 		http.StatusForbidden:           true,
@@ -147,6 +157,16 @@ func (h *imagemagickHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statusHandler writes the number of queued and in-flight image requests as JSON. The metrics
+// agent samples it to feed custom metric autoscaling.
+func (h *imagemagickHandler) statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"queueLength": int64(len(h.c)),
+		"inFlight":    atomic.LoadInt64(&inFlight),
+	})
+}
+
 // NewImagemagickHandler builds returns a new imagemagickHandler with the specified queueSize and
 // number of processing routines.
 func NewImagemagickHandler(queueSize, numRoutines int) (h *imagemagickHandler) {
@@ -170,9 +190,11 @@ type imageProcessor struct {
 func (p *imageProcessor) process() {
 	for r := range p.c {
 		t := time.Now()
+		atomic.AddInt64(&inFlight, 1)
 		if err := p.processImage(r); err != nil {
 			p.l.Printf("Could not process image %v: %v\n", r.saveToFilename, err)
 		}
+		atomic.AddInt64(&inFlight, -1)
 		p.l.Printf("Processing took %fs\n", time.Since(t).Seconds())
 	}
 }
@@ -299,6 +321,7 @@ func main() {
 	h := NewImagemagickHandler(ImageProcessQueueSize, NumImageProcessors)
 	http.Handle("/process", h)
 	http.HandleFunc("/healthcheck", healthHandler)
+	http.HandleFunc("/statusz", h.statusHandler)
 	err = http.ListenAndServe(":80", nil)
 
 	if err != nil {
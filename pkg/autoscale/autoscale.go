@@ -0,0 +1,112 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package autoscale manages the Compute Engine autoscalers of managed
+// instance groups, zonal or regional.
+package autoscale
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+)
+
+// An Autoscaler names an autoscaler. Its methods call the zonal or the
+// regional Compute API collection depending on its location, which should
+// be the location of the group it scales.
+type Autoscaler struct {
+	mig.Location
+	Name string
+}
+
+// wrap wraps the error of the call op on the autoscaler, if any.
+func (as *Autoscaler) wrap(err *error, op string) {
+	*err = gcperr.Wrap(*err, op, "autoscaler "+as.Name)
+}
+
+// Get fetches the autoscaler.
+func (as *Autoscaler) Get(ctx context.Context, s *compute.Service) (a *compute.Autoscaler, err error) {
+	defer as.wrap(&err, "get")
+	if as.Regional() {
+		return s.RegionAutoscalers.Get(as.Project, as.Region, as.Name).Context(ctx).Do()
+	}
+	return s.Autoscalers.Get(as.Project, as.Zone, as.Name).Context(ctx).Do()
+}
+
+// Insert creates the autoscaler from a, whose name should be the
+// autoscaler's.
+func (as *Autoscaler) Insert(ctx context.Context, s *compute.Service, a *compute.Autoscaler) (op *compute.Operation, err error) {
+	defer as.wrap(&err, "create")
+	if as.Regional() {
+		return s.RegionAutoscalers.Insert(as.Project, as.Region, a).Context(ctx).Do()
+	}
+	return s.Autoscalers.Insert(as.Project, as.Zone, a).Context(ctx).Do()
+}
+
+// Update replaces the existing autoscaler with a.
+func (as *Autoscaler) Update(ctx context.Context, s *compute.Service, a *compute.Autoscaler) (op *compute.Operation, err error) {
+	defer as.wrap(&err, "update")
+	if as.Regional() {
+		return s.RegionAutoscalers.Update(as.Project, as.Region, a).Autoscaler(as.Name).Context(ctx).Do()
+	}
+	return s.Autoscalers.Update(as.Project, as.Zone, a).Autoscaler(as.Name).Context(ctx).Do()
+}
+
+// Patch changes only the fields set in a.
+func (as *Autoscaler) Patch(ctx context.Context, s *compute.Service, a *compute.Autoscaler) (op *compute.Operation, err error) {
+	defer as.wrap(&err, "patch")
+	if as.Regional() {
+		return s.RegionAutoscalers.Patch(as.Project, as.Region, a).Autoscaler(as.Name).Context(ctx).Do()
+	}
+	return s.Autoscalers.Patch(as.Project, as.Zone, a).Autoscaler(as.Name).Context(ctx).Do()
+}
+
+// Delete deletes the autoscaler, leaving its group at its current size.
+func (as *Autoscaler) Delete(ctx context.Context, s *compute.Service) (op *compute.Operation, err error) {
+	defer as.wrap(&err, "delete")
+	if as.Regional() {
+		return s.RegionAutoscalers.Delete(as.Project, as.Region, as.Name).Context(ctx).Do()
+	}
+	return s.Autoscalers.Delete(as.Project, as.Zone, as.Name).Context(ctx).Do()
+}
+
+// Mode returns the autoscaler's mode, which the API leaves empty for the
+// default of ON.
+func Mode(a *compute.Autoscaler) string {
+	if a.AutoscalingPolicy == nil || a.AutoscalingPolicy.Mode == "" {
+		return "ON"
+	}
+	return a.AutoscalingPolicy.Mode
+}
+
+// DescribeSchedules returns one line describing each scaling schedule of a
+// policy, in name order.
+func DescribeSchedules(p *compute.AutoscalingPolicy) []string {
+	names := make([]string, 0, len(p.ScalingSchedules))
+	for name := range p.ScalingSchedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		s := p.ScalingSchedules[name]
+		lines = append(lines, fmt.Sprintf("Schedule %v: %q (%v) for %ds, at least %d replicas.", name, s.Schedule,
+			s.TimeZone, s.DurationSec, s.MinRequiredReplicas))
+	}
+	return lines
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package credentials abstracts where the API clients of this module get
+// their access tokens. A Provider is a key file, the application default
+// credentials, an impersonated service account, or any oauth2.TokenSource,
+// e.g. one reading tokens from a secret store:
+//
+//	p := credentials.Impersonation(credentials.ADC(), "loadgen@my-project.iam.gserviceaccount.com")
+//	client, err := credentials.NewClient(ctx, p, compute.ComputeScope)
+//	s, err := compute.New(client)
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	iamcredentials "google.golang.org/api/iamcredentials/v1"
+)
+
+// ImpersonatedTokenLifetime is the lifetime requested for impersonated
+// access tokens; they are minted again when they expire.
+const ImpersonatedTokenLifetime = time.Hour
+
+// A Provider supplies the access tokens of API clients.
+type Provider interface {
+	// TokenSource returns a source of tokens granting scopes.
+	TokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error)
+}
+
+// ProviderFunc adapts a function to a Provider.
+type ProviderFunc func(ctx context.Context, scopes ...string) (oauth2.TokenSource, error)
+
+func (f ProviderFunc) TokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	return f(ctx, scopes...)
+}
+
+// NewClient returns an HTTP client authorized for scopes with tokens from
+// p, reusing each token until it expires.
+func NewClient(ctx context.Context, p Provider, scopes ...string) (*http.Client, error) {
+	ts, err := p.TokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, ts)), nil
+}
+
+// KeyFile returns a Provider of the service account key or authorized user
+// file at path. The file is read on every call to TokenSource.
+func KeyFile(path string) Provider {
+	return ProviderFunc(func(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials %v: %v", path, err)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, b, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse credentials %v: %v", path, err)
+		}
+		return creds.TokenSource, nil
+	})
+}
+
+// ADC returns a Provider of the application default credentials.
+func ADC() Provider {
+	return ProviderFunc(func(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+		creds, err := google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the application default credentials: %v", err)
+		}
+		return creds.TokenSource, nil
+	})
+}
+
+// TokenSource returns a Provider of the tokens of ts, whatever the scopes
+// asked for; ts must grant all those of the clients it is used by.
+func TokenSource(ts oauth2.TokenSource) Provider {
+	return ProviderFunc(func(context.Context, ...string) (oauth2.TokenSource, error) {
+		return ts, nil
+	})
+}
+
+// Impersonation returns a Provider of short-lived tokens of the service
+// account target, minted with the IAM Credentials API by the caller's own
+// credentials from base. If delegates are given, the caller reaches target
+// through each of them in order.
+func Impersonation(base Provider, target string, delegates ...string) Provider {
+	return ProviderFunc(func(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+		client, err := NewClient(ctx, base, iamcredentials.CloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		iam, err := iamcredentials.New(client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create IAM Credentials client: %v", err)
+		}
+		ts := &impersonatedTokenSource{iam: iam, target: target, scopes: scopes}
+		for _, d := range delegates {
+			ts.delegates = append(ts.delegates, serviceAccountName(d))
+		}
+		return ts, nil
+	})
+}
+
+// An impersonatedTokenSource mints access tokens of a service account with
+// the caller's own credentials.
+type impersonatedTokenSource struct {
+	iam *iamcredentials.Service
+	// target is the impersonated account and delegates the accounts the
+	// caller goes through to reach it, in order.
+	target    string
+	delegates []string
+	scopes    []string
+}
+
+// Token implements oauth2.TokenSource, whose tokens outlive the requests
+// they are minted for, so minting one is not bound to a caller's context.
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	ctx := context.Background()
+	resp, err := ts.iam.Projects.ServiceAccounts.GenerateAccessToken(serviceAccountName(ts.target),
+		&iamcredentials.GenerateAccessTokenRequest{
+			Delegates: ts.delegates,
+			Lifetime:  fmt.Sprintf("%ds", int(ImpersonatedTokenLifetime.Seconds())),
+			Scope:     ts.scopes,
+		}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to impersonate %v: %v", ts.target, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the expiry of the token of %v: %v", ts.target, err)
+	}
+	return &oauth2.Token{AccessToken: resp.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// serviceAccountName returns the resource name of a service account, which
+// may be in any project.
+func serviceAccountName(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
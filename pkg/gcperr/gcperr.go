@@ -0,0 +1,186 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcperr classifies the errors of Google Cloud API calls and of
+// Compute Engine operations, so that callers can tell a missing resource, an
+// exhausted quota and a missing permission apart, and know which errors are
+// worth retrying:
+//
+//	err := g.Resize(ctx, s, 100)
+//	switch {
+//	case errors.Is(err, gcperr.ErrQuotaExceeded):
+//		// Ask for less.
+//	case errors.Is(err, gcperr.ErrRetryable):
+//		// Try again later.
+//	}
+//
+// The packages of this module return errors wrapped by Wrap, which names
+// the failing call and resource. KindOf and IsRetryable also classify the
+// unwrapped errors of the API clients.
+package gcperr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// The kinds of errors, matched with errors.Is. ErrRetryable matches errors
+// of any kind, or none, which may go away if the call is retried.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrPermission    = errors.New("permission denied")
+	ErrRetryable     = errors.New("retryable")
+)
+
+// An Error is an error of a call on a resource.
+type Error struct {
+	// Op is the failing call, e.g. "resize".
+	Op string
+	// Resource describes the resource called, e.g. "instance group manager
+	// web".
+	Resource string
+	// Err is the error returned by the API client.
+	Err error
+}
+
+// Wrap returns err as an *Error of the call op on resource, or nil if err is
+// nil. Errors which already are *Errors are returned unchanged, keeping the
+// innermost call.
+func Wrap(err error, op, resource string) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Op: op, Resource: resource, Err: err}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("unable to %v %v: %v", e.Op, e.Resource, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the error's kind and, if it is retryable, ErrRetryable.
+func (e *Error) Is(target error) bool {
+	return matches(e.Err, target)
+}
+
+// An OperationError is the error reported by a completed Compute Engine
+// operation.
+type OperationError struct {
+	// Operation is the operation's name.
+	Operation string
+	// Code is the error code, e.g. "QUOTA_EXCEEDED".
+	Code    string
+	Message string
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %v failed: %v: %v", e.Operation, e.Code, e.Message)
+}
+
+// Is matches the error's kind and, if it is retryable, ErrRetryable.
+func (e *OperationError) Is(target error) bool {
+	return matches(e, target)
+}
+
+// matches reports whether err is of the target kind, or retryable if target
+// is ErrRetryable.
+func matches(err, target error) bool {
+	kind, retryable := classify(err)
+	return target != nil && (target == kind || target == ErrRetryable && retryable)
+}
+
+// KindOf returns ErrNotFound, ErrQuotaExceeded or ErrPermission for errors
+// of those kinds, and nil for any other.
+func KindOf(err error) error {
+	kind, _ := classify(err)
+	return kind
+}
+
+// IsRetryable reports whether the call which returned err may succeed if
+// retried.
+func IsRetryable(err error) bool {
+	_, retryable := classify(err)
+	return retryable
+}
+
+// Operation error codes of exhausted capacity or rates, which clear up.
+var retryableCodes = map[string]bool{
+	"INTERNAL_ERROR":                            true,
+	"RATE_LIMIT_EXCEEDED":                       true,
+	"RESOURCE_NOT_READY":                        true,
+	"RESOURCE_OPERATION_RATE_EXCEEDED":          true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+}
+
+// classify returns the kind of err and whether it is retryable.
+func classify(err error) (kind error, retryable bool) {
+	var oe *OperationError
+	if errors.As(err, &oe) {
+		switch oe.Code {
+		case "QUOTA_EXCEEDED":
+			return ErrQuotaExceeded, false
+		case "RESOURCE_NOT_FOUND":
+			return ErrNotFound, false
+		case "PERMISSION_DENIED", "FORBIDDEN":
+			return ErrPermission, false
+		}
+		return nil, retryableCodes[oe.Code]
+	}
+	var ae *googleapi.Error
+	if errors.As(err, &ae) {
+		switch {
+		case ae.Code == http.StatusNotFound:
+			return ErrNotFound, false
+		case ae.Code == http.StatusTooManyRequests:
+			return ErrQuotaExceeded, true
+		case ae.Code == http.StatusForbidden && hasReason(ae, "rateLimitExceeded", "userRateLimitExceeded"):
+			return ErrQuotaExceeded, true
+		case ae.Code == http.StatusForbidden && hasReason(ae, "quotaExceeded", "dailyLimitExceeded"):
+			return ErrQuotaExceeded, false
+		case ae.Code == http.StatusForbidden || ae.Code == http.StatusUnauthorized:
+			return ErrPermission, false
+		}
+		return nil, ae.Code >= http.StatusInternalServerError
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return nil, ne.Timeout()
+	}
+	return nil, false
+}
+
+// hasReason reports whether an API error gives one of the reasons.
+func hasReason(e *googleapi.Error, reasons ...string) bool {
+	for _, item := range e.Errors {
+		for _, r := range reasons {
+			if item.Reason == r {
+				return true
+			}
+		}
+	}
+	return false
+}
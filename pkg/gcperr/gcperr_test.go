@@ -0,0 +1,112 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcperr
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// apiError returns an API error of code giving reason.
+func apiError(code int, reason string) error {
+	e := &googleapi.Error{Code: code}
+	if reason != "" {
+		e.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	return e
+}
+
+// timeout is a net.Error which timed out.
+type timeout struct{}
+
+func (timeout) Error() string   { return "i/o timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+var _ net.Error = timeout{}
+
+func TestClassify(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		err       error
+		kind      error
+		retryable bool
+	}{
+		{"404", apiError(404, "notFound"), ErrNotFound, false},
+		{"429", apiError(429, ""), ErrQuotaExceeded, true},
+		{"403 rate limit", apiError(403, "rateLimitExceeded"), ErrQuotaExceeded, true},
+		{"403 user rate limit", apiError(403, "userRateLimitExceeded"), ErrQuotaExceeded, true},
+		{"403 quota", apiError(403, "quotaExceeded"), ErrQuotaExceeded, false},
+		{"403 daily limit", apiError(403, "dailyLimitExceeded"), ErrQuotaExceeded, false},
+		{"403", apiError(403, "forbidden"), ErrPermission, false},
+		{"401", apiError(401, ""), ErrPermission, false},
+		{"409", apiError(409, "alreadyExists"), nil, false},
+		{"500", apiError(500, ""), nil, true},
+		{"503", apiError(503, ""), nil, true},
+		{"quota operation", &OperationError{Code: "QUOTA_EXCEEDED"}, ErrQuotaExceeded, false},
+		{"missing operation", &OperationError{Code: "RESOURCE_NOT_FOUND"}, ErrNotFound, false},
+		{"denied operation", &OperationError{Code: "PERMISSION_DENIED"}, ErrPermission, false},
+		{"exhausted zone", &OperationError{Code: "ZONE_RESOURCE_POOL_EXHAUSTED"}, nil, true},
+		{"invalid operation", &OperationError{Code: "INVALID_FIELD_VALUE"}, nil, false},
+		{"timeout", timeout{}, nil, true},
+		{"other", errors.New("other"), nil, false},
+		{"nil", nil, nil, false},
+	} {
+		if kind := KindOf(c.err); kind != c.kind {
+			t.Errorf("%v: KindOf = %v, want %v", c.name, kind, c.kind)
+		}
+		if retryable := IsRetryable(c.err); retryable != c.retryable {
+			t.Errorf("%v: IsRetryable = %v, want %v", c.name, retryable, c.retryable)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if err := Wrap(nil, "resize", "instance group manager web"); err != nil {
+		t.Errorf("Wrap(nil) = %v, want nil", err)
+	}
+	err := Wrap(apiError(429, ""), "resize", "instance group manager web")
+	if got, want := err.Error(), "unable to resize instance group manager web: "; !strings.HasPrefix(got, want) {
+		t.Errorf("Error() = %q, want it to start %q", got, want)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) || !errors.Is(err, ErrRetryable) || errors.Is(err, ErrNotFound) {
+		t.Errorf("%v matches the wrong kinds", err)
+	}
+	var ae *googleapi.Error
+	if !errors.As(err, &ae) || ae.Code != 429 {
+		t.Errorf("%v does not unwrap to the API error", err)
+	}
+
+	// Wrapping again keeps the innermost call.
+	outer := Wrap(err, "get", "autoscaler web-as")
+	var e *Error
+	if !errors.As(outer, &e) || e.Op != "resize" || e.Resource != "instance group manager web" {
+		t.Errorf("Wrap of a wrapped error = %v, want the resize kept", outer)
+	}
+}
+
+func TestOperationErrorIs(t *testing.T) {
+	err := Wrap(&OperationError{Operation: "op-1", Code: "RESOURCE_OPERATION_RATE_EXCEEDED", Message: "slow down"}, "insert", "instance template t")
+	if !errors.Is(err, ErrRetryable) || KindOf(err) != nil {
+		t.Errorf("%v: want a retryable error of no kind", err)
+	}
+	if errors.Is(err, nil) {
+		t.Errorf("%v matches nil", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsgen
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"google.golang.org/api/storage/v1"
+)
+
+// The grant which makes the objects of a bucket readable by anyone.
+const (
+	publicMember = "allUsers"
+	publicRole   = "roles/storage.objectViewer"
+	publicACL    = "publicRead"
+)
+
+// WithPredefinedACL sets the predefined ACL, e.g. "publicRead", of the image
+// and its copies. Buckets with uniform bucket-level access refuse ACLs; see
+// PublicAccess. Like WithKMSKey, it applies to the client given to New.
+func WithPredefinedACL(acl string) Option {
+	return func(g *Generator) { g.objectsConfig.PredefinedACL = acl }
+}
+
+// PublicAccess makes the corpus a Generator writes to bucket readable by
+// anyone, as the file servers fetch it anonymously, whichever access
+// control the bucket uses. With uniform bucket-level access, which refuses
+// object ACLs, it grants allUsers roles/storage.objectViewer on the bucket
+// at once and returns an option doing nothing; otherwise it returns the
+// option giving each object the publicRead ACL. Either way the run does not
+// fail halfway on an access call the bucket refuses. Buckets enforcing
+// public access prevention allow neither, which is an error. billingProject,
+// if set, is billed for the calls.
+func PublicAccess(ctx context.Context, s *storage.Service, bucket, billingProject string) (Option, error) {
+	get := s.Buckets.Get(bucket).Fields("iamConfiguration")
+	if billingProject != "" {
+		get = get.UserProject(billingProject)
+	}
+	b, err := get.Context(ctx).Do()
+	if err != nil {
+		return nil, gcperr.Wrap(err, "get", "bucket "+bucket)
+	}
+	ic := b.IamConfiguration
+	if ic != nil && ic.PublicAccessPrevention == "enforced" {
+		return nil, fmt.Errorf("bucket %v enforces public access prevention, so its objects cannot be made public", bucket)
+	}
+	if ic == nil || ic.UniformBucketLevelAccess == nil || !ic.UniformBucketLevelAccess.Enabled {
+		return WithPredefinedACL(publicACL), nil
+	}
+	if err := grantPublicRead(ctx, s, bucket, billingProject); err != nil {
+		return nil, err
+	}
+	return func(*Generator) {}, nil
+}
+
+// grantPublicRead adds the binding of allUsers to roles/storage.objectViewer
+// to the IAM policy of a bucket, unless it is there.
+func grantPublicRead(ctx context.Context, s *storage.Service, bucket, billingProject string) error {
+	get := s.Buckets.GetIamPolicy(bucket)
+	if billingProject != "" {
+		get = get.UserProject(billingProject)
+	}
+	p, err := get.Context(ctx).Do()
+	if err != nil {
+		return gcperr.Wrap(err, "get the IAM policy of", "bucket "+bucket)
+	}
+	var binding *storage.PolicyBindings
+	for _, b := range p.Bindings {
+		if b.Role == publicRole && b.Condition == nil {
+			binding = b
+		}
+	}
+	if binding == nil {
+		binding = &storage.PolicyBindings{Role: publicRole}
+		p.Bindings = append(p.Bindings, binding)
+	}
+	for _, m := range binding.Members {
+		if m == publicMember {
+			return nil
+		}
+	}
+	binding.Members = append(binding.Members, publicMember)
+	set := s.Buckets.SetIamPolicy(bucket, p)
+	if billingProject != "" {
+		set = set.UserProject(billingProject)
+	}
+	// The policy's etag makes the call fail rather than overwrite a
+	// concurrent change.
+	if _, err := set.Context(ctx).Do(); err != nil {
+		return gcperr.Wrap(err, "set the IAM policy of", "bucket "+bucket)
+	}
+	return nil
+}
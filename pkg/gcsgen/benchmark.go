@@ -0,0 +1,187 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsgen
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+)
+
+// DefaultBenchmarkInterval is the length of the intervals of a Benchmark's
+// timeline without WithBenchmarkInterval.
+const DefaultBenchmarkInterval = time.Second
+
+// A Benchmark reports a run as what it is, a benchmark of Cloud Storage
+// metadata writes: the copy throughput over time, the latency of each API
+// call and how often calls were retried or failed.
+type Benchmark struct {
+	Bucket      string `json:"bucket"`
+	Files       int    `json:"files"`
+	Concurrency int    `json:"concurrency"`
+	// Seconds is the length of the run, and CopiesPerSecond the copies
+	// made over it.
+	Seconds         float64 `json:"seconds"`
+	CopiesPerSecond float64 `json:"copiesPerSecond"`
+	// IntervalSeconds is the length of each interval of Timeline.
+	IntervalSeconds float64             `json:"intervalSeconds"`
+	Timeline        []BenchmarkInterval `json:"timeline"`
+	// Calls are the statistics of each API call, "upload" and "copy" or,
+	// with a Cloud KMS key, "rewrite", over every attempt.
+	Calls map[string]*CallStats `json:"calls"`
+	// Retries counts the attempts made after the first, and RetryRate
+	// them per copy.
+	Retries   int64   `json:"retries"`
+	RetryRate float64 `json:"retryRate"`
+	// Failed counts the copies which failed every attempt, and ErrorRate
+	// them per copy.
+	Failed    int     `json:"failed"`
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// A BenchmarkInterval is the copies finished in one interval of a run.
+type BenchmarkInterval struct {
+	// Start is the interval's offset from the start of the run, in seconds.
+	Start           float64 `json:"start"`
+	Copies          int     `json:"copies"`
+	Failed          int     `json:"failed"`
+	CopiesPerSecond float64 `json:"copiesPerSecond"`
+}
+
+// CallStats are the statistics of the attempts at one API call.
+type CallStats struct {
+	Calls     int64   `json:"calls"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	P50Ms     float64 `json:"p50Ms"`
+	P95Ms     float64 `json:"p95Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+	MaxMs     float64 `json:"maxMs"`
+}
+
+// WithBenchmarkInterval sets the length of the intervals of the timeline of
+// the run's Benchmark.
+func WithBenchmarkInterval(d time.Duration) Option {
+	return func(g *Generator) { g.benchmarkInterval = d }
+}
+
+// A benchmarkRecorder gathers a run's Benchmark. It is safe for concurrent
+// use.
+type benchmarkRecorder struct {
+	start    time.Time
+	interval time.Duration
+
+	mu         sync.Mutex
+	histograms map[string]*loadgen.LatencyHistogram
+	errors     map[string]int64
+	// copies and failed count the copies finished in each interval.
+	copies, failed []int
+}
+
+// newBenchmarkRecorder returns a recorder of a run starting now.
+func newBenchmarkRecorder(interval time.Duration) *benchmarkRecorder {
+	if interval <= 0 {
+		interval = DefaultBenchmarkInterval
+	}
+	return &benchmarkRecorder{start: time.Now(), interval: interval,
+		histograms: map[string]*loadgen.LatencyHistogram{}, errors: map[string]int64{}}
+}
+
+// call records an attempt at the API call op.
+func (b *benchmarkRecorder) call(op string, d time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.histograms[op]
+	if h == nil {
+		h = &loadgen.LatencyHistogram{}
+		b.histograms[op] = h
+	}
+	h.Add(d)
+	if err != nil {
+		b.errors[op]++
+	}
+}
+
+// finished records a copy finishing now.
+func (b *benchmarkRecorder) finished(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := int(time.Since(b.start) / b.interval)
+	for len(b.copies) <= i {
+		b.copies = append(b.copies, 0)
+		b.failed = append(b.failed, 0)
+	}
+	if failed {
+		b.failed[i]++
+	} else {
+		b.copies[i]++
+	}
+}
+
+// benchmark returns the Benchmark of the run of g, which made retries
+// retries.
+func (b *benchmarkRecorder) benchmark(g *Generator, res *Result, retries int64) *Benchmark {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	width := b.interval.Seconds()
+	bm := &Benchmark{Bucket: g.bucket, Files: g.files, Concurrency: g.copiers, Seconds: res.Duration.Seconds(),
+		IntervalSeconds: width, Calls: map[string]*CallStats{}, Retries: retries, Failed: len(res.Failures)}
+	copies := 0
+	for i := range b.copies {
+		bm.Timeline = append(bm.Timeline, BenchmarkInterval{Start: float64(i) * width, Copies: b.copies[i],
+			Failed: b.failed[i], CopiesPerSecond: float64(b.copies[i]) / width})
+		copies += b.copies[i]
+	}
+	if bm.Seconds > 0 {
+		bm.CopiesPerSecond = float64(copies) / bm.Seconds
+	}
+	if attempted := copies + bm.Failed; attempted > 0 {
+		bm.RetryRate = float64(retries) / float64(attempted)
+		bm.ErrorRate = float64(bm.Failed) / float64(attempted)
+	}
+	for op, h := range b.histograms {
+		cs := &CallStats{Calls: h.Count(), Errors: b.errors[op], P50Ms: report.Millis(h.Percentile(0.5)),
+			P95Ms: report.Millis(h.Percentile(0.95)), P99Ms: report.Millis(h.Percentile(0.99)), MaxMs: report.Millis(h.Max())}
+		cs.ErrorRate = float64(cs.Errors) / float64(cs.Calls)
+		bm.Calls[op] = cs
+	}
+	return bm
+}
+
+// timedObjects records the latency of every call of Objects.
+type timedObjects struct {
+	Objects
+	b *benchmarkRecorder
+	// copyOp names the copies' API call.
+	copyOp string
+}
+
+func (o timedObjects) InsertObject(ctx context.Context, bucket, name string, r io.Reader) error {
+	start := time.Now()
+	err := o.Objects.InsertObject(ctx, bucket, name, r)
+	o.b.call("upload", time.Since(start), err)
+	return err
+}
+
+func (o timedObjects) CopyObject(ctx context.Context, bucket, source, dest string) error {
+	start := time.Now()
+	err := o.Objects.CopyObject(ctx, bucket, source, dest)
+	o.b.call(o.copyOp, time.Since(start), err)
+	return err
+}
@@ -0,0 +1,451 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcsgen generates the corpus of files the file servers read: an
+// image uploaded to a Cloud Storage bucket and duplicated into many objects
+// by concurrent copiers.
+//
+// A Generator is configured with options and started with Run:
+//
+//	g := gcsgen.New(s, "my-bucket", "eiffel.jpg", f,
+//		gcsgen.WithFiles(1000),
+//		gcsgen.WithConcurrency(20),
+//		gcsgen.WithProgress(func(p gcsgen.Progress) { log.Printf("%d/%d", p.Done, p.Total) }))
+//	res, err := g.Run(ctx)
+//
+// Replicate generates the same corpus in buckets of several locations at
+// once, for load tests of a global load balancer, and returns the manifest
+// of the objects in each.
+package gcsgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/progress"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// Defaults of a Generator's options.
+const (
+	DefaultFiles       = 10000
+	DefaultConcurrency = 10
+)
+
+// DefaultRetry is the retry policy of a Generator without WithRetry. It
+// suits clients which do not retry their calls; those wrapped by package
+// retry already do, and a single attempt keeps the attempts at each object
+// from multiplying.
+var DefaultRetry = RetryPolicy{Attempts: 3}
+
+// GeneratedName returns the name of the nth copy of a file, as served by the
+// file server: the original is copy 0. It is the default naming of a
+// Generator.
+func GeneratedName(n int, name string) string {
+	return strconv.Itoa(n) + "-" + name
+}
+
+// A RetryPolicy says how often a failed copy is attempted again.
+type RetryPolicy struct {
+	// Attempts is the number of attempts made at each copy, at least one.
+	Attempts int
+	// Backoff is the wait before the second attempt, doubling before each
+	// further attempt. Zero retries at once.
+	Backoff time.Duration
+}
+
+// Progress describes a Generator's run after one copy finished.
+type Progress struct {
+	// Object is the copy which finished, and Err its error if it failed.
+	Object string
+	Err    error
+	// Done counts the copies finished so far, including the original and
+	// the failed copies, out of Total.
+	Done, Total int
+	// Failed counts the copies which failed so far.
+	Failed int
+}
+
+// A Failure is a copy which failed every attempt.
+type Failure struct {
+	Object string
+	Err    error
+}
+
+// A Result describes a completed run.
+type Result struct {
+	Bucket string
+	// Source is the uploaded original, which the copies were made from.
+	Source string
+	// Copied counts the objects which exist, including the original.
+	Copied   int
+	Failures []Failure
+	Duration time.Duration
+	// Benchmark reports the run's throughput, call latencies and error
+	// rates.
+	Benchmark *Benchmark
+}
+
+// Objects are the Cloud Storage operations a Generator makes.
+type Objects interface {
+	// InsertObject uploads an object.
+	InsertObject(ctx context.Context, bucket, name string, r io.Reader) error
+	// CopyObject copies an object within a bucket.
+	CopyObject(ctx context.Context, bucket, source, dest string) error
+}
+
+// ObjectsConfig configures the calls of the Objects of a Cloud Storage
+// client.
+type ObjectsConfig struct {
+	// KMSKey, if set, encrypts the objects written, as WithKMSKey does.
+	KMSKey string
+	// BillingProject, if set, is billed for the calls, as
+	// WithBillingProject does.
+	BillingProject string
+	// PredefinedACL, if set, is the ACL of the objects written, as
+	// WithPredefinedACL sets it.
+	PredefinedACL string
+}
+
+// with returns c with the fields set in o replacing its own, so that the
+// options of a Generator add to the config of ConfiguredObjects rather than
+// clear it.
+func (c ObjectsConfig) with(o ObjectsConfig) ObjectsConfig {
+	if o.KMSKey != "" {
+		c.KMSKey = o.KMSKey
+	}
+	if o.BillingProject != "" {
+		c.BillingProject = o.BillingProject
+	}
+	if o.PredefinedACL != "" {
+		c.PredefinedACL = o.PredefinedACL
+	}
+	return c
+}
+
+// ServiceObjects returns the Objects of a Cloud Storage client.
+func ServiceObjects(s *storage.Service) Objects {
+	return serviceObjects{s: s}
+}
+
+// ConfiguredObjects returns the Objects of a Cloud Storage client making
+// its calls as c says.
+func ConfiguredObjects(s *storage.Service, c ObjectsConfig) Objects {
+	return serviceObjects{s: s, c: c}
+}
+
+// serviceObjects implements Objects with the Cloud Storage API.
+type serviceObjects struct {
+	s *storage.Service
+	c ObjectsConfig
+}
+
+func (o serviceObjects) InsertObject(ctx context.Context, bucket, name string, r io.Reader) error {
+	call := o.s.Objects.Insert(bucket, &storage.Object{Name: name}).Media(r)
+	if o.c.KMSKey != "" {
+		call = call.KmsKeyName(o.c.KMSKey)
+	}
+	if o.c.BillingProject != "" {
+		call = call.UserProject(o.c.BillingProject)
+	}
+	if o.c.PredefinedACL != "" {
+		call = call.PredefinedAcl(o.c.PredefinedACL)
+	}
+	_, err := call.Context(ctx).Do()
+	return gcperr.Wrap(o.keyError(err), "upload", "object "+name)
+}
+
+// CopyObject copies the object, or, with a key, rewrites it: a rewrite
+// re-encrypts the copy with the key, and takes as many calls as the object
+// needs rather than failing on a large one.
+func (o serviceObjects) CopyObject(ctx context.Context, bucket, source, dest string) error {
+	if o.c.KMSKey == "" {
+		call := o.s.Objects.Copy(bucket, source, bucket, dest, nil)
+		if o.c.BillingProject != "" {
+			call = call.UserProject(o.c.BillingProject)
+		}
+		if o.c.PredefinedACL != "" {
+			call = call.DestinationPredefinedAcl(o.c.PredefinedACL)
+		}
+		_, err := call.Context(ctx).Do()
+		return gcperr.Wrap(err, "copy to", "object "+dest)
+	}
+	token := ""
+	for {
+		call := o.s.Objects.Rewrite(bucket, source, bucket, dest, nil).DestinationKmsKeyName(o.c.KMSKey)
+		if o.c.BillingProject != "" {
+			call = call.UserProject(o.c.BillingProject)
+		}
+		if o.c.PredefinedACL != "" {
+			call = call.DestinationPredefinedAcl(o.c.PredefinedACL)
+		}
+		if token != "" {
+			call = call.RewriteToken(token)
+		}
+		resp, err := call.Fields("done", "rewriteToken").Context(ctx).Do()
+		if err != nil {
+			return gcperr.Wrap(o.keyError(err), "rewrite to", "object "+dest)
+		}
+		if resp.Done {
+			return nil
+		}
+		token = resp.RewriteToken
+	}
+}
+
+// keyError returns err as a *KeyError if the call failed because the key
+// cannot be used, and err otherwise.
+func (o serviceObjects) keyError(err error) error {
+	var ae *googleapi.Error
+	if o.c.KMSKey == "" || !errors.As(err, &ae) {
+		return err
+	}
+	if gcperr.KindOf(err) == gcperr.ErrPermission || strings.Contains(ae.Message, "KMS") {
+		return &KeyError{Key: o.c.KMSKey, Err: err}
+	}
+	return err
+}
+
+// A KeyError is the error of a write the Cloud KMS key could not be used
+// for: the key does not exist, is disabled, is in another location than the
+// bucket, or the project's Cloud Storage service agent may not use it.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("Cloud KMS key %v cannot be used: %v; the key must be enabled and in the bucket's location, "+
+		"and the project's Cloud Storage service agent needs roles/cloudkms.cryptoKeyEncrypterDecrypter on it", e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// A Generator uploads an image to a bucket and duplicates it.
+type Generator struct {
+	objects  Objects
+	bucket   string
+	name     string
+	image    io.Reader
+	files    int
+	copiers  int
+	retry    RetryPolicy
+	naming   func(n int, name string) string
+	progress func(Progress)
+	reporter progress.Reporter
+	// objectsConfig configures the calls of the client given to New.
+	objectsConfig     ObjectsConfig
+	benchmarkInterval time.Duration
+}
+
+// An Option configures a Generator.
+type Option func(*Generator)
+
+// WithFiles sets the number of files to generate, including the original.
+func WithFiles(n int) Option {
+	return func(g *Generator) { g.files = n }
+}
+
+// WithConcurrency sets the number of concurrent copies.
+func WithConcurrency(n int) Option {
+	return func(g *Generator) { g.copiers = n }
+}
+
+// WithRetry sets how failed copies are retried.
+func WithRetry(p RetryPolicy) Option {
+	return func(g *Generator) { g.retry = p }
+}
+
+// WithNaming sets the name of each copy, given its number and the image's
+// name; the original is copy 0. Names must be distinct.
+func WithNaming(naming func(n int, name string) string) Option {
+	return func(g *Generator) { g.naming = naming }
+}
+
+// WithKMSKey encrypts the image and its copies with a Cloud KMS key,
+// projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY, rather
+// than the bucket's default key. The copies are then made by rewriting,
+// which re-encrypts them. Errors the key causes are *KeyErrors. It applies
+// to the Cloud Storage client given to New, and to the Objects of
+// ConfiguredObjects given to WithObjects, over their own key.
+func WithKMSKey(key string) Option {
+	return func(g *Generator) { g.objectsConfig.KMSKey = key }
+}
+
+// WithBillingProject bills the project for the Generator's calls, as their
+// userProject, rather than the bucket's owner; requester pays buckets
+// refuse calls without one. Like WithKMSKey, it applies to the client given
+// to New.
+func WithBillingProject(project string) Option {
+	return func(g *Generator) { g.objectsConfig.BillingProject = project }
+}
+
+// WithObjects makes the Generator use objects instead of the Cloud Storage
+// client it was created with, e.g. a test double.
+func WithObjects(objects Objects) Option {
+	return func(g *Generator) { g.objects = objects }
+}
+
+// WithProgress sets a function called after every copy. Calls are never
+// concurrent.
+func WithProgress(progress func(Progress)) Option {
+	return func(g *Generator) { g.progress = progress }
+}
+
+// WithReporter makes the Generator report every copy to r, as the
+// operation "generate BUCKET" counting the copies finished.
+func WithReporter(r progress.Reporter) Option {
+	return func(g *Generator) { g.reporter = progress.OrNop(r) }
+}
+
+// New returns a Generator which uploads image to bucket under name, or
+// rather the copy 0 naming gives it, and duplicates it there with the Cloud
+// Storage client s, which may be nil with WithObjects.
+func New(s *storage.Service, bucket, name string, image io.Reader, opts ...Option) *Generator {
+	g := &Generator{
+		objects:  serviceObjects{s: s},
+		bucket:   bucket,
+		name:     name,
+		image:    image,
+		files:    DefaultFiles,
+		copiers:  DefaultConcurrency,
+		retry:    DefaultRetry,
+		naming:   GeneratedName,
+		reporter: progress.Nop,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if o, ok := g.objects.(serviceObjects); ok {
+		o.c = o.c.with(g.objectsConfig)
+		g.objects = o
+	}
+	return g
+}
+
+// Run uploads the image and makes the copies. Copies which fail every
+// attempt are listed in the result rather than failing the run, unless the
+// Cloud KMS key caused the failure, which stops the run with its KeyError.
+// If ctx is done before the run completes, Run stops starting copies and
+// returns the result so far along with ctx's error.
+func (g *Generator) Run(ctx context.Context) (*Result, error) {
+	switch {
+	case g.files < 1:
+		return nil, errors.New("gcsgen: the number of files must be positive")
+	case g.copiers < 1:
+		return nil, errors.New("gcsgen: the concurrency must be positive")
+	case g.retry.Attempts < 1:
+		return nil, errors.New("gcsgen: the retry policy must make at least one attempt")
+	}
+	start := time.Now()
+	bench := newBenchmarkRecorder(g.benchmarkInterval)
+	objects := timedObjects{g.objects, bench, "copy"}
+	if o, ok := g.objects.(serviceObjects); ok && o.c.KMSKey != "" {
+		objects.copyOp = "rewrite"
+	}
+	source := g.naming(0, g.name)
+	task := "generate " + g.bucket
+	if err := objects.InsertObject(ctx, g.bucket, source, g.image); err != nil {
+		err = gcperr.Wrap(err, "upload", "object "+source)
+		g.reporter.Finish(task, err)
+		return nil, err
+	}
+	res := &Result{Bucket: g.bucket, Source: source, Copied: 1}
+
+	finished := 1
+	// keyErr is the first copy's error the key caused, which stops the run.
+	var keyErr error
+	pool := workerpool.New(ctx,
+		workerpool.WithWorkers(g.copiers),
+		workerpool.WithRetry(workerpool.RetryPolicy{
+			Attempts: g.retry.Attempts,
+			Backoff:  g.retry.Backoff,
+			// Another attempt would fail with the cancelled pool's error
+			// rather than the key's.
+			Retryable: func(err error) bool {
+				var ke *KeyError
+				return !errors.As(err, &ke)
+			},
+		}),
+		workerpool.OnDone(func(o workerpool.Outcome) {
+			finished++
+			bench.finished(o.Err != nil)
+			var ke *KeyError
+			if keyErr == nil && errors.As(o.Err, &ke) {
+				keyErr = o.Err
+			}
+			if o.Err != nil {
+				res.Failures = append(res.Failures, Failure{Object: o.Name, Err: o.Err})
+			} else {
+				res.Copied++
+			}
+			if g.progress != nil {
+				g.progress(Progress{Object: o.Name, Err: o.Err, Done: finished, Total: g.files, Failed: len(res.Failures)})
+			}
+			message := "copied " + o.Name
+			if o.Err != nil {
+				message = o.Err.Error()
+			}
+			g.reporter.Report(progress.Update{Operation: task, Done: int64(finished), Total: int64(g.files), Message: message})
+		}))
+	for i := 1; i < g.files; i++ {
+		dest := g.naming(i, g.name)
+		err := pool.Submit(dest, func(ctx context.Context) error {
+			err := objects.CopyObject(ctx, g.bucket, source, dest)
+			var ke *KeyError
+			if errors.As(err, &ke) {
+				// No other copy can succeed either.
+				pool.Cancel()
+			}
+			return gcperr.Wrap(err, "copy to", "object "+dest)
+		})
+		if err != nil {
+			break
+		}
+	}
+	_, err := pool.Wait()
+	if keyErr != nil {
+		err = keyErr
+	}
+	res.Duration = time.Since(start)
+	res.Benchmark = bench.benchmark(g, res, pool.Counters().Retries)
+	g.reporter.Finish(task, err)
+	return res, err
+}
+
+// Generated returns the names of the objects a run of the Generator left in
+// its bucket, the original first.
+func (g *Generator) Generated(res *Result) []string {
+	failed := map[string]bool{}
+	for _, f := range res.Failures {
+		failed[f.Object] = true
+	}
+	var names []string
+	for i := 0; i < g.files; i++ {
+		if object := g.naming(i, g.name); !failed[object] {
+			names = append(names, object)
+		}
+	}
+	return names
+}
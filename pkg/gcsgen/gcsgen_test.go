@@ -0,0 +1,302 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsgen_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"google.golang.org/api/storage/v1"
+)
+
+// fakeStorage is a Cloud Storage server keeping the objects uploaded,
+// copied and rewritten into its buckets, by name, with the Cloud KMS key
+// each was encrypted with.
+type fakeStorage struct {
+	mu      sync.Mutex
+	objects map[string]string
+	// failures counts the attempts still to fail at copying to each name.
+	failures map[string]int
+	copies   int
+	// rewriteCalls is the number of calls each rewrite takes, and rewrites
+	// counts them.
+	rewriteCalls int
+	rewrites     int
+	// deniedKey is a key the service agent may not use, and
+	// deniedRewriteKey one it may only encrypt uploads with.
+	deniedKey        string
+	deniedRewriteKey string
+}
+
+// newFakeStorage starts a fakeStorage and returns a client of it.
+func newFakeStorage(t *testing.T) (*fakeStorage, *storage.Service) {
+	t.Helper()
+	f := &fakeStorage{objects: map[string]string{}, failures: map[string]int{}, rewriteCalls: 1}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s, err := storage.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.BasePath = srv.URL + "/storage/v1/"
+	return f, s
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.EscapedPath()
+	key := r.URL.Query().Get("kmsKeyName")
+	var name string
+	switch {
+	case strings.HasPrefix(path, "/upload/"):
+		var err error
+		if name, err = uploadedName(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case strings.Contains(path, "/copyTo/"):
+		name, _ = url.PathUnescape(path[strings.LastIndex(path, "/")+1:])
+		f.copies++
+		if f.failures[name] > 0 {
+			f.failures[name]--
+			http.Error(w, `{"error":{"code":503,"message":"backend error"}}`, http.StatusServiceUnavailable)
+			return
+		}
+	case strings.Contains(path, "/rewriteTo/"):
+		name, _ = url.PathUnescape(path[strings.LastIndex(path, "/")+1:])
+		key = r.URL.Query().Get("destinationKmsKeyName")
+		f.rewrites++
+		// The token counts the calls made so far.
+		calls := len(r.URL.Query().Get("rewriteToken")) + 1
+		if key != "" && key == f.deniedRewriteKey {
+			http.Error(w, `{"error":{"code":403,"message":"Permission denied on Cloud KMS key."}}`, http.StatusForbidden)
+			return
+		}
+		if key != f.deniedKey && calls < f.rewriteCalls {
+			json.NewEncoder(w).Encode(&storage.RewriteResponse{RewriteToken: strings.Repeat("t", calls)})
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if key != "" && key == f.deniedKey {
+		http.Error(w, `{"error":{"code":403,"message":"Permission denied on Cloud KMS key."}}`, http.StatusForbidden)
+		return
+	}
+	f.objects[name] = key
+	if strings.Contains(path, "/rewriteTo/") {
+		json.NewEncoder(w).Encode(&storage.RewriteResponse{Done: true, Resource: &storage.Object{Name: name}})
+		return
+	}
+	json.NewEncoder(w).Encode(&storage.Object{Name: name})
+}
+
+// uploadedName returns the name of the object a multipart upload creates.
+func uploadedName(r *http.Request) (string, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return "", err
+	}
+	var o storage.Object
+	if err := json.NewDecoder(part).Decode(&o); err != nil {
+		return "", err
+	}
+	return o.Name, nil
+}
+
+// names returns the names of the objects, sorted.
+func (f *fakeStorage) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRunCopiesImage(t *testing.T) {
+	f, s := newFakeStorage(t)
+	var updates []gcsgen.Progress
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(4),
+		gcsgen.WithConcurrency(2),
+		gcsgen.WithProgress(func(p gcsgen.Progress) { updates = append(updates, p) }))
+	res, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bucket != "bucket" || res.Source != "0-eiffel.jpg" || res.Copied != 4 || len(res.Failures) != 0 {
+		t.Errorf("Run = %+v, want 4 objects copied from 0-eiffel.jpg", res)
+	}
+	if got, want := strings.Join(f.names(), ","), "0-eiffel.jpg,1-eiffel.jpg,2-eiffel.jpg,3-eiffel.jpg"; got != want {
+		t.Errorf("bucket holds %v, want %v", got, want)
+	}
+	if len(updates) != 3 {
+		t.Fatalf("%d progress updates, want one per copy", len(updates))
+	}
+	for i, p := range updates {
+		if p.Done != i+2 || p.Total != 4 || p.Failed != 0 {
+			t.Errorf("update %d = %+v, want %d of 4 done", i, p, i+2)
+		}
+	}
+}
+
+func TestRunNaming(t *testing.T) {
+	f, s := newFakeStorage(t)
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(2),
+		gcsgen.WithNaming(func(n int, name string) string { return fmt.Sprintf("copies/%d/%v", n, name) }))
+	if _, err := g.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(f.names(), ","), "copies/0/eiffel.jpg,copies/1/eiffel.jpg"; got != want {
+		t.Errorf("bucket holds %v, want %v", got, want)
+	}
+}
+
+func TestRunRetriesCopies(t *testing.T) {
+	f, s := newFakeStorage(t)
+	f.failures["1-eiffel.jpg"] = 2
+	f.failures["2-eiffel.jpg"] = 5
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(3),
+		gcsgen.WithRetry(gcsgen.RetryPolicy{Attempts: 3}))
+	res, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 2 {
+		t.Errorf("copied %d objects, want the original and the copy which succeeded on its third attempt", res.Copied)
+	}
+	if len(res.Failures) != 1 || res.Failures[0].Object != "2-eiffel.jpg" || res.Failures[0].Err == nil {
+		t.Errorf("failures = %+v, want 2-eiffel.jpg", res.Failures)
+	}
+	if f.copies != 6 {
+		t.Errorf("made %d copy calls, want 3 attempts at each copy", f.copies)
+	}
+}
+
+func TestRunRejectsBadOptions(t *testing.T) {
+	_, s := newFakeStorage(t)
+	for _, opt := range []gcsgen.Option{
+		gcsgen.WithFiles(0),
+		gcsgen.WithConcurrency(0),
+		gcsgen.WithRetry(gcsgen.RetryPolicy{}),
+	} {
+		if _, err := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"), opt).Run(context.Background()); err == nil {
+			t.Error("Run succeeded with a bad option")
+		}
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	_, s := newFakeStorage(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(100),
+		gcsgen.WithConcurrency(1),
+		gcsgen.WithProgress(func(p gcsgen.Progress) {
+			if p.Done == 3 {
+				cancel()
+			}
+		}))
+	res, err := g.Run(ctx)
+	if err != context.Canceled {
+		t.Errorf("Run = %v, want %v", err, context.Canceled)
+	}
+	if res == nil || res.Copied >= 100 {
+		t.Errorf("Run = %+v, want the result of the copies made before it was canceled", res)
+	}
+}
+
+const testKey = "projects/p/locations/us/keyRings/r/cryptoKeys/k"
+
+func TestRunRewritesWithKMSKey(t *testing.T) {
+	f, s := newFakeStorage(t)
+	// Each rewrite takes three calls.
+	f.rewriteCalls = 3
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(3),
+		gcsgen.WithKMSKey(testKey))
+	res, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 3 || len(res.Failures) != 0 {
+		t.Errorf("Run = %+v, want 3 objects", res)
+	}
+	for _, name := range f.names() {
+		if key := f.objects[name]; key != testKey {
+			t.Errorf("%v is encrypted with %q, want %q", name, key, testKey)
+		}
+	}
+	if f.copies != 0 || f.rewrites != 6 {
+		t.Errorf("made %d copy and %d rewrite calls, want the two copies rewritten in three calls each", f.copies, f.rewrites)
+	}
+}
+
+func TestRunStopsOnKeyError(t *testing.T) {
+	f, s := newFakeStorage(t)
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(3),
+		gcsgen.WithKMSKey(testKey))
+	f.deniedKey = testKey
+	_, err := g.Run(context.Background())
+	var ke *gcsgen.KeyError
+	if !errors.As(err, &ke) || ke.Key != testKey {
+		t.Fatalf("Run = %v, want a KeyError of the key", err)
+	}
+	if len(f.names()) != 0 {
+		t.Errorf("bucket holds %v, want nothing written with a key which cannot be used", f.names())
+	}
+}
+
+func TestRunStopsCopyingOnKeyError(t *testing.T) {
+	f, s := newFakeStorage(t)
+	// The key can encrypt the upload, but the copies are denied it.
+	f.deniedRewriteKey = testKey
+	g := gcsgen.New(s, "bucket", "eiffel.jpg", strings.NewReader("jpeg"),
+		gcsgen.WithFiles(50),
+		gcsgen.WithConcurrency(1),
+		gcsgen.WithKMSKey(testKey))
+	res, err := g.Run(context.Background())
+	var ke *gcsgen.KeyError
+	if !errors.As(err, &ke) {
+		t.Fatalf("Run = %v, want a KeyError", err)
+	}
+	if res.Copied != 1 || f.rewrites >= 10 {
+		t.Errorf("copied %d objects in %d rewrite calls, want the run stopped after the first", res.Copied, f.rewrites)
+	}
+}
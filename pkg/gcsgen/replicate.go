@@ -0,0 +1,128 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/storage/v1"
+)
+
+// A Replica is a bucket in a location, such as the US, EU or ASIA
+// multi-region, which a corpus is replicated into.
+type Replica struct {
+	Location string
+	Bucket   string
+	// Options further configure the Generator of the replica, such as
+	// the option PublicAccess returns for its bucket.
+	Options []Option
+}
+
+// A Manifest lists the objects of a corpus replicated into several
+// locations, so that load tests of a global load balancer can request those
+// of each location.
+type Manifest struct {
+	// Name is the image's name, and Files the number of files generated
+	// in each location, including the original.
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	// Generated is when the replication completed.
+	Generated time.Time        `json:"generated"`
+	Regions   []RegionManifest `json:"regions"`
+}
+
+// A RegionManifest lists the objects of a corpus in one location.
+type RegionManifest struct {
+	Location string `json:"location"`
+	Bucket   string `json:"bucket"`
+	// URLs are those of the objects which exist, the original first.
+	URLs []string `json:"urls"`
+	// Failed counts the copies which failed every attempt.
+	Failed   int     `json:"failed,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+	// Objects are the names of the objects, and Benchmark the benchmark of
+	// the location's run, which are not part of the manifest's JSON.
+	Objects   []string   `json:"-"`
+	Benchmark *Benchmark `json:"-"`
+}
+
+// ObjectURL returns the public URL of an object.
+func ObjectURL(bucket, object string) string {
+	return "https://storage.googleapis.com/" + bucket + "/" + url.PathEscape(object)
+}
+
+// Replicate generates the corpus of image under name in every replica's
+// bucket at once, with a Generator configured by opts for each, and returns
+// the manifest of the objects generated. Progress calls are never
+// concurrent, even across replicas. Like Run, copies which fail are counted
+// in the manifest rather than failing the replication; a replica whose
+// upload fails does.
+func Replicate(ctx context.Context, s *storage.Service, replicas []Replica, name string, image []byte, opts ...Option) (*Manifest, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("gcsgen: no replicas to generate the corpus in")
+	}
+	var mu sync.Mutex
+	m := &Manifest{Name: name, Regions: make([]RegionManifest, len(replicas))}
+	pool := workerpool.New(ctx, workerpool.WithWorkers(len(replicas)))
+	for i, r := range replicas {
+		i, r := i, r
+		g := New(s, r.Bucket, name, bytes.NewReader(image), append(append([]Option(nil), opts...), r.Options...)...)
+		if progress := g.progress; progress != nil {
+			g.progress = func(p Progress) {
+				mu.Lock()
+				defer mu.Unlock()
+				progress(p)
+			}
+		}
+		m.Files = g.files
+		err := pool.Submit(r.Location, func(ctx context.Context) error {
+			res, err := g.Run(ctx)
+			if res == nil {
+				return err
+			}
+			m.Regions[i] = g.manifest(r.Location, res)
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		return nil, failures[0].Err
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.Generated = time.Now().UTC()
+	return m, nil
+}
+
+// manifest returns the manifest of the objects a run of the Generator left
+// in its bucket.
+func (g *Generator) manifest(location string, res *Result) RegionManifest {
+	rm := RegionManifest{Location: location, Bucket: g.bucket, Objects: g.Generated(res), Failed: len(res.Failures),
+		Duration: res.Duration.Seconds(), Benchmark: res.Benchmark}
+	for _, object := range rm.Objects {
+		rm.URLs = append(rm.URLs, ObjectURL(g.bucket, object))
+	}
+	return rm
+}
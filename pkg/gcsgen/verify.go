@@ -0,0 +1,144 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+)
+
+// Failures a Verification keeps as examples.
+const maxVerifyFailures = 10
+
+// cacheHeaders are the response headers a Verification counts the values
+// of, which tell whether a cache, such as Cloud CDN, served the object.
+var cacheHeaders = []string{"Cache-Control", "X-Cache", "Via"}
+
+// A Verification reports GETs of a random sample of a corpus, made before a
+// load test to check its objects are readable end to end.
+type Verification struct {
+	// Base is the URL the objects were requested under.
+	Base        string  `json:"base"`
+	Requests    int     `json:"requests"`
+	Succeeded   int     `json:"succeeded"`
+	SuccessRate float64 `json:"successRate"`
+	P50Ms       float64 `json:"p50Ms"`
+	P95Ms       float64 `json:"p95Ms"`
+	P99Ms       float64 `json:"p99Ms"`
+	MaxMs       float64 `json:"maxMs"`
+	// CacheHeaders counts the values of the cache headers of the
+	// successful responses, by header; a missing header counts as "".
+	CacheHeaders map[string]map[string]int `json:"cacheHeaders"`
+	// Aged counts the successful responses with an Age header, which only
+	// cached responses have.
+	Aged int `json:"aged"`
+	// Failures are examples of the failed GETs.
+	Failures []string `json:"failures,omitempty"`
+}
+
+// Verify GETs n objects picked at random, with replacement, from objects
+// under base, such as https://storage.googleapis.com/BUCKET or the URL of a
+// load balancer serving the corpus, concurrency at a time, with client, or
+// http.DefaultClient if nil. Private and requester pays buckets need a
+// client authorized to read them, billing a project for the latter. Failed
+// GETs are counted in the verification rather than returned.
+func Verify(ctx context.Context, client *http.Client, base string, objects []string, n, concurrency int) (*Verification, error) {
+	if len(objects) == 0 || n < 1 {
+		return nil, errors.New("gcsgen: nothing to verify")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	base = strings.TrimSuffix(base, "/")
+	v := &Verification{Base: base, Requests: n, CacheHeaders: map[string]map[string]int{}}
+	for _, h := range cacheHeaders {
+		v.CacheHeaders[h] = map[string]int{}
+	}
+	var mu sync.Mutex
+	var latencies loadgen.LatencyHistogram
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pool := workerpool.New(ctx, workerpool.WithWorkers(concurrency))
+	for i := 0; i < n; i++ {
+		u := base + "/" + url.PathEscape(objects[rnd.Intn(len(objects))])
+		err := pool.Submit(u, func(ctx context.Context) error {
+			start := time.Now()
+			h, err := get(ctx, client, u)
+			d := time.Since(start)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if len(v.Failures) < maxVerifyFailures {
+					v.Failures = append(v.Failures, err.Error())
+				}
+				return nil
+			}
+			v.Succeeded++
+			latencies.Add(d)
+			for _, name := range cacheHeaders {
+				v.CacheHeaders[name][h.Get(name)]++
+			}
+			if h.Get("Age") != "" {
+				v.Aged++
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if _, err := pool.Wait(); err != nil {
+		return nil, err
+	}
+	v.SuccessRate = float64(v.Succeeded) / float64(v.Requests)
+	v.P50Ms = report.Millis(latencies.Percentile(0.5))
+	v.P95Ms = report.Millis(latencies.Percentile(0.95))
+	v.P99Ms = report.Millis(latencies.Percentile(0.99))
+	v.MaxMs = report.Millis(latencies.Max())
+	return v, nil
+}
+
+// get GETs a URL and reads the whole body, returning the response headers,
+// so that the latency is that of the object rather than of its first byte.
+func get(ctx context.Context, client *http.Client, u string) (http.Header, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return nil, fmt.Errorf("unable to read %v: %v", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v returned %v", u, resp.Status)
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,620 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lb sets up and tears down the external HTTP load balancer in front
+// of the file servers: a firewall rule, a health check, a backend service,
+// and one more per path rule, a URL map, a target proxy and a global
+// forwarding rule, and optionally an HTTPS frontend on a reserved address
+// with port 80 redirecting to it.
+package lb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/progress"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// SourceRanges are the source ranges of the load balancer's proxies and
+// health checkers, which the backends' firewall rule admits.
+var SourceRanges = []string{"130.211.0.0/22", "35.191.0.0/16"}
+
+// HealthCheckPath is the path the file server answers health checks on.
+const HealthCheckPath = "/healthz"
+
+// Resources names the global resources making up a load balancer. They are
+// derived from the backend service's name so that Setup and Teardown agree
+// on them.
+type Resources struct {
+	HealthCheck, BackendService, URLMap, Proxy, ForwardingRule, Firewall string
+	// Address, HTTPSProxy and HTTPSForwardingRule make up the HTTPS
+	// frontend, and RedirectURLMap and RedirectProxy the redirect of port
+	// 80 to it.
+	Address, HTTPSProxy, HTTPSForwardingRule, RedirectURLMap, RedirectProxy string
+}
+
+// Names returns the names of the resources of the load balancer in front of
+// a backend service.
+func Names(backendService string) Resources {
+	bs := backendService
+	return Resources{
+		HealthCheck:    bs + "-hc",
+		BackendService: bs,
+		URLMap:         bs + "-map",
+		Proxy:          bs + "-proxy",
+		ForwardingRule: bs + "-rule",
+		Firewall:       bs + "-allow-lb",
+
+		Address:             bs + "-ip",
+		HTTPSProxy:          bs + "-https-proxy",
+		HTTPSForwardingRule: bs + "-https-rule",
+		RedirectURLMap:      bs + "-redirect-map",
+		RedirectProxy:       bs + "-redirect-proxy",
+	}
+}
+
+// A Spec describes a load balancer.
+type Spec struct {
+	Project        string
+	BackendService string
+	// Ports are the ports the backends serve on, admitted by the firewall
+	// rule.
+	Ports []string
+	// TargetTags are the network tags of the backends.
+	TargetTags []string
+	// PathRules, if set, route paths to backend services of their own,
+	// which Setup creates next to BackendService with its health check.
+	// Requests matching no rule go to BackendService.
+	PathRules []PathRule
+	// Describe returns the description of a resource created by Setup, given
+	// what the resource is for.
+	Describe func(purpose string) string
+	// AttachBackends, if set, is called as soon as the backend services
+	// exist, while the frontend is created, so that the backends are serving
+	// by the time the forwarding rule is.
+	AttachBackends func(ctx context.Context) error
+	// Wait, if set, waits for the operations Setup and Teardown start to
+	// complete, instead of mig.WaitForOperation.
+	Wait func(ctx context.Context, op *compute.Operation) error
+	// Reporter, if set, is reported each resource Setup and Teardown are
+	// done with, and the operations they wait for without Wait.
+	Reporter progress.Reporter
+	// Parallelism bounds how many resources Setup creates at once; zero
+	// means workerpool.DefaultWorkers.
+	Parallelism int
+	// HTTPS, if set, adds an HTTPS frontend on port 443.
+	HTTPS *HTTPS
+}
+
+// HTTPS describes the HTTPS frontend of a load balancer. Both forwarding
+// rules then share a reserved global address, as a redirect needs; Setup
+// recreates the port 80 rule of a load balancer set up without HTTPS, which
+// has an ephemeral address, on the reserved one.
+type HTTPS struct {
+	// Certificates are the names, or URLs, of the existing SSL
+	// certificates the proxy presents.
+	Certificates []string
+	// RedirectHTTP makes port 80 redirect every request to HTTPS, through
+	// a URL map of its own, rather than serve the file servers.
+	RedirectHTTP bool
+}
+
+// A PathRule routes requests for some paths, such as /thumbnails/*, to a
+// backend service.
+type PathRule struct {
+	Paths          []string
+	BackendService string
+}
+
+// urlMap returns the URL map sending requests to the backend services.
+func (sp *Spec) urlMap() *compute.UrlMap {
+	n := Names(sp.BackendService)
+	services := "projects/" + sp.Project + "/global/backendServices/"
+	m := &compute.UrlMap{
+		Name:           n.URLMap,
+		Description:    sp.describe("Sends every request to the file servers."),
+		DefaultService: services + n.BackendService,
+	}
+	if len(sp.PathRules) == 0 {
+		return m
+	}
+	m.Description = sp.describe("Sends requests to the file servers by path.")
+	pm := &compute.PathMatcher{Name: "services", DefaultService: m.DefaultService}
+	for _, r := range sp.PathRules {
+		pm.PathRules = append(pm.PathRules, &compute.PathRule{Paths: r.Paths, Service: services + r.BackendService})
+	}
+	m.PathMatchers = []*compute.PathMatcher{pm}
+	m.HostRules = []*compute.HostRule{{Hosts: []string{"*"}, PathMatcher: pm.Name}}
+	return m
+}
+
+// redirectURLMap returns the URL map redirecting every request to HTTPS,
+// keeping its host, path and query.
+func (sp *Spec) redirectURLMap() *compute.UrlMap {
+	return &compute.UrlMap{
+		Name:        Names(sp.BackendService).RedirectURLMap,
+		Description: sp.describe("Redirects HTTP requests to HTTPS."),
+		DefaultUrlRedirect: &compute.HttpRedirectAction{
+			HttpsRedirect:        true,
+			RedirectResponseCode: "MOVED_PERMANENTLY_DEFAULT",
+		},
+	}
+}
+
+// certificates returns the URLs of the certificates of the HTTPS proxy.
+func (sp *Spec) certificates() []string {
+	var urls []string
+	for _, c := range sp.HTTPS.Certificates {
+		if !strings.Contains(c, "/") {
+			c = "projects/" + sp.Project + "/global/sslCertificates/" + c
+		}
+		urls = append(urls, c)
+	}
+	return urls
+}
+
+// pathRuleServices returns the backend services of the path rules, each
+// once.
+func (sp *Spec) pathRuleServices() []string {
+	var names []string
+	seen := map[string]bool{sp.BackendService: true}
+	for _, r := range sp.PathRules {
+		if !seen[r.BackendService] {
+			seen[r.BackendService] = true
+			names = append(names, r.BackendService)
+		}
+	}
+	return names
+}
+
+// backendService returns a backend service of the file servers.
+func (sp *Spec) backendService(name string) *compute.BackendService {
+	return &compute.BackendService{
+		Name:                name,
+		Description:         sp.describe("Backend service of the file servers."),
+		Protocol:            "HTTP",
+		PortName:            "http",
+		LoadBalancingScheme: "EXTERNAL",
+		HealthChecks:        []string{"projects/" + sp.Project + "/global/healthChecks/" + Names(sp.BackendService).HealthCheck},
+	}
+}
+
+// describe returns the description of a resource created for purpose.
+func (sp *Spec) describe(purpose string) string {
+	if sp.Describe == nil {
+		return purpose
+	}
+	return sp.Describe(purpose)
+}
+
+// wait waits for an operation to complete.
+func (sp *Spec) wait(ctx context.Context, s *compute.Service, op *compute.Operation) error {
+	if sp.Wait != nil {
+		return sp.Wait(ctx, op)
+	}
+	return mig.WaitForOperation(ctx, s, sp.Project, op, sp.Reporter)
+}
+
+// ensureResource creates a global resource unless get finds it, and waits
+// for the creation to finish.
+func ensureResource(ctx context.Context, s *compute.Service, sp *Spec, kind, name string, get func() error, insert func() (*compute.Operation, error)) error {
+	err := get()
+	if err == nil {
+		log.Printf("%v %v already exists.", kind, name)
+		return nil
+	}
+	if !mig.IsNotFound(err) {
+		return gcperr.Wrap(err, "get", kind+" "+name)
+	}
+	op, err := insert()
+	if err != nil {
+		return gcperr.Wrap(err, "create", kind+" "+name)
+	}
+	if err := sp.wait(ctx, s, op); err != nil {
+		return err
+	}
+	log.Printf("Created %v %v.", kind, name)
+	return nil
+}
+
+// currentRule gets the forwarding rule named like want, deleting it first if
+// it forwards to another target or, when want names a reserved address,
+// from another IP, so that it is recreated as wanted. This happens when
+// HTTPS or RedirectHTTP is turned on for a load balancer set up without
+// them, whose port 80 rule has an ephemeral IP.
+func currentRule(ctx context.Context, s *compute.Service, sp *Spec, want *compute.ForwardingRule) error {
+	p := sp.Project
+	r, err := s.GlobalForwardingRules.Get(p, want.Name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	reason := ""
+	if !strings.HasSuffix(r.Target, want.Target) {
+		reason = "forwards to " + r.Target
+	} else if want.IPAddress != "" {
+		a, err := s.GlobalAddresses.Get(p, path.Base(want.IPAddress)).Context(ctx).Do()
+		if err != nil {
+			return gcperr.Wrap(err, "get", "address "+path.Base(want.IPAddress))
+		}
+		if r.IPAddress != a.Address {
+			reason = "has the IP " + r.IPAddress + " rather than the address " + a.Address
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	log.Printf("Recreating forwarding rule %v, which %v.", want.Name, reason)
+	op, err := s.GlobalForwardingRules.Delete(p, want.Name).Context(ctx).Do()
+	if err != nil {
+		return gcperr.Wrap(err, "delete", "forwarding rule "+want.Name)
+	}
+	if err := sp.wait(ctx, s, op); err != nil {
+		return err
+	}
+	_, err = s.GlobalForwardingRules.Get(p, want.Name).Context(ctx).Do()
+	return err
+}
+
+// Setup creates the load balancer, forwarding port 80 of a global address to
+// the backend service, and returns the address. With HTTPS, port 443 of the
+// address is forwarded to the backend service too, and with RedirectHTTP
+// port 80 redirects to it instead. Forwarding rules with another target or
+// IP are recreated; other resources which already exist are kept, so it can
+// be rerun after adding backends. Resources which do not refer to each other
+// are created at the same time: the firewall rule alongside everything else,
+// and the backends are attached while the frontend is created.
+func Setup(ctx context.Context, s *compute.Service, sp *Spec) (string, error) {
+	n := Names(sp.BackendService)
+	p := sp.Project
+	global := "projects/" + p + "/global/"
+	type step struct {
+		kind, name string
+		get        func() error
+		insert     func() (*compute.Operation, error)
+		// after lists the steps the resource refers to, by kind and name.
+		after []string
+	}
+	steps := []step{
+		{"firewall rule", n.Firewall,
+			func() error { _, err := s.Firewalls.Get(p, n.Firewall).Context(ctx).Do(); return err },
+			func() (*compute.Operation, error) {
+				return s.Firewalls.Insert(p, &compute.Firewall{
+					Name:         n.Firewall,
+					Description:  sp.describe("Admits the load balancer to the backends."),
+					SourceRanges: SourceRanges,
+					TargetTags:   sp.TargetTags,
+					Allowed:      []*compute.FirewallAllowed{{IPProtocol: "tcp", Ports: sp.Ports}},
+				}).Context(ctx).Do()
+			}, nil},
+		{"health check", n.HealthCheck,
+			func() error { _, err := s.HealthChecks.Get(p, n.HealthCheck).Context(ctx).Do(); return err },
+			func() (*compute.Operation, error) {
+				return s.HealthChecks.Insert(p, &compute.HealthCheck{
+					Name:        n.HealthCheck,
+					Description: sp.describe("Health check of the file servers."),
+					Type:        "HTTP",
+					HttpHealthCheck: &compute.HTTPHealthCheck{
+						PortSpecification: "USE_SERVING_PORT",
+						RequestPath:       HealthCheckPath,
+					},
+				}).Context(ctx).Do()
+			}, nil},
+	}
+	var backendServices []string
+	for _, name := range append([]string{n.BackendService}, sp.pathRuleServices()...) {
+		name := name
+		steps = append(steps, step{"backend service", name,
+			func() error { _, err := s.BackendServices.Get(p, name).Context(ctx).Do(); return err },
+			func() (*compute.Operation, error) {
+				return s.BackendServices.Insert(p, sp.backendService(name)).Context(ctx).Do()
+			}, []string{"health check " + n.HealthCheck}})
+		backendServices = append(backendServices, "backend service "+name)
+	}
+	// backendsAfter delays the forwarding rules serving the backends.
+	var backendsAfter []string
+	if sp.AttachBackends != nil {
+		// The backends should be serving by the time the frontend is.
+		backendsAfter = []string{"backends attached"}
+	}
+	steps = append(steps, step{"URL map", n.URLMap,
+		func() error { _, err := s.UrlMaps.Get(p, n.URLMap).Context(ctx).Do(); return err },
+		func() (*compute.Operation, error) { return s.UrlMaps.Insert(p, sp.urlMap()).Context(ctx).Do() },
+		backendServices})
+	// Port 80 serves the file servers, or with RedirectHTTP redirects to
+	// port 443.
+	proxy := &compute.TargetHttpProxy{
+		Name:        n.Proxy,
+		Description: sp.describe("Proxy of the file servers."),
+		UrlMap:      global + "urlMaps/" + n.URLMap,
+	}
+	httpRule := &compute.ForwardingRule{
+		Name:                n.ForwardingRule,
+		Description:         sp.describe("Frontend of the file servers."),
+		IPProtocol:          "TCP",
+		PortRange:           "80",
+		LoadBalancingScheme: "EXTERNAL",
+	}
+	httpRuleAfter := backendsAfter
+	if sp.HTTPS != nil && sp.HTTPS.RedirectHTTP {
+		proxy = &compute.TargetHttpProxy{
+			Name:        n.RedirectProxy,
+			Description: sp.describe("Proxy redirecting HTTP to HTTPS."),
+			UrlMap:      global + "urlMaps/" + n.RedirectURLMap,
+		}
+		httpRule.Description = sp.describe("Redirects HTTP to the HTTPS frontend of the file servers.")
+		httpRuleAfter = nil
+		steps = append(steps, step{"URL map", n.RedirectURLMap,
+			func() error { _, err := s.UrlMaps.Get(p, n.RedirectURLMap).Context(ctx).Do(); return err },
+			func() (*compute.Operation, error) { return s.UrlMaps.Insert(p, sp.redirectURLMap()).Context(ctx).Do() },
+			nil})
+	}
+	httpRule.Target = global + "targetHttpProxies/" + proxy.Name
+	httpRuleAfter = append([]string{"target HTTP proxy " + proxy.Name}, httpRuleAfter...)
+	steps = append(steps, step{"target HTTP proxy", proxy.Name,
+		func() error { _, err := s.TargetHttpProxies.Get(p, proxy.Name).Context(ctx).Do(); return err },
+		func() (*compute.Operation, error) { return s.TargetHttpProxies.Insert(p, proxy).Context(ctx).Do() },
+		[]string{"URL map " + path.Base(proxy.UrlMap)}})
+	if sp.HTTPS != nil {
+		// Both forwarding rules share the reserved address.
+		address := "address " + n.Address
+		httpRule.IPAddress = global + "addresses/" + n.Address
+		httpsRule := &compute.ForwardingRule{
+			Name:                n.HTTPSForwardingRule,
+			Description:         sp.describe("HTTPS frontend of the file servers."),
+			IPProtocol:          "TCP",
+			PortRange:           "443",
+			IPAddress:           httpRule.IPAddress,
+			LoadBalancingScheme: "EXTERNAL",
+			Target:              global + "targetHttpsProxies/" + n.HTTPSProxy,
+		}
+		httpRuleAfter = append(httpRuleAfter, address)
+		steps = append(steps, []step{
+			{"address", n.Address,
+				func() error { _, err := s.GlobalAddresses.Get(p, n.Address).Context(ctx).Do(); return err },
+				func() (*compute.Operation, error) {
+					return s.GlobalAddresses.Insert(p, &compute.Address{
+						Name:        n.Address,
+						Description: sp.describe("Address of the file servers."),
+						AddressType: "EXTERNAL",
+						IpVersion:   "IPV4",
+					}).Context(ctx).Do()
+				}, nil},
+			{"target HTTPS proxy", n.HTTPSProxy,
+				func() error { _, err := s.TargetHttpsProxies.Get(p, n.HTTPSProxy).Context(ctx).Do(); return err },
+				func() (*compute.Operation, error) {
+					return s.TargetHttpsProxies.Insert(p, &compute.TargetHttpsProxy{
+						Name:            n.HTTPSProxy,
+						Description:     sp.describe("HTTPS proxy of the file servers."),
+						UrlMap:          global + "urlMaps/" + n.URLMap,
+						SslCertificates: sp.certificates(),
+					}).Context(ctx).Do()
+				}, []string{"URL map " + n.URLMap}},
+			{"forwarding rule", n.HTTPSForwardingRule,
+				func() error { return currentRule(ctx, s, sp, httpsRule) },
+				func() (*compute.Operation, error) {
+					return s.GlobalForwardingRules.Insert(p, httpsRule).Context(ctx).Do()
+				}, append([]string{"target HTTPS proxy " + n.HTTPSProxy, address}, backendsAfter...)},
+		}...)
+	}
+	steps = append(steps, step{"forwarding rule", n.ForwardingRule,
+		func() error { return currentRule(ctx, s, sp, httpRule) },
+		func() (*compute.Operation, error) {
+			return s.GlobalForwardingRules.Insert(p, httpRule).Context(ctx).Do()
+		},
+		httpRuleAfter})
+
+	g := workerpool.NewGraph()
+	for _, st := range steps {
+		st := st
+		g.Add(st.kind+" "+st.name, func(ctx context.Context) error {
+			return ensureResource(ctx, s, sp, st.kind, st.name, st.get, st.insert)
+		}, st.after...)
+	}
+	total := len(steps)
+	if sp.AttachBackends != nil {
+		g.Add("backends attached", sp.AttachBackends, backendServices...)
+		total++
+	}
+	rep := progress.OrNop(sp.Reporter)
+	task := "set up load balancer " + sp.BackendService
+	workers := sp.Parallelism
+	if workers == 0 {
+		workers = workerpool.DefaultWorkers
+	}
+	done := 0
+	failures, err := g.Run(ctx, workerpool.WithWorkers(workers), workerpool.OnDone(func(o workerpool.Outcome) {
+		if o.Err == nil {
+			done++
+			rep.Report(progress.Update{Operation: task, Done: int64(done), Total: int64(total), Message: o.Name})
+		}
+	}))
+	if len(failures) > 0 {
+		err = failures[0].Err
+	}
+	rep.Finish(task, err)
+	if err != nil {
+		return "", err
+	}
+	rule, err := s.GlobalForwardingRules.Get(p, n.ForwardingRule).Context(ctx).Do()
+	if err != nil {
+		return "", gcperr.Wrap(err, "get", "forwarding rule "+n.ForwardingRule)
+	}
+	return rule.IPAddress, nil
+}
+
+// Teardown deletes the load balancer's resources in the reverse order of
+// Setup, those of the HTTPS frontend and redirect whether or not sp has
+// HTTPS, so that none outlive turning it off. Resources which are missing
+// are skipped, and so are those whose description owned rejects, which
+// Setup did not create.
+func Teardown(ctx context.Context, s *compute.Service, sp *Spec, owned func(description string) bool) (err error) {
+	rep := progress.OrNop(sp.Reporter)
+	task := "tear down load balancer " + sp.BackendService
+	defer func() { rep.Finish(task, err) }()
+	n := Names(sp.BackendService)
+	p := sp.Project
+	type step struct {
+		kind, name string
+		// description returns the resource's description, or an error.
+		description func() (string, error)
+		delete      func() (*compute.Operation, error)
+	}
+	steps := []step{
+		{"forwarding rule", n.HTTPSForwardingRule,
+			func() (string, error) {
+				r, err := s.GlobalForwardingRules.Get(p, n.HTTPSForwardingRule).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) {
+				return s.GlobalForwardingRules.Delete(p, n.HTTPSForwardingRule).Context(ctx).Do()
+			}},
+		{"forwarding rule", n.ForwardingRule,
+			func() (string, error) {
+				r, err := s.GlobalForwardingRules.Get(p, n.ForwardingRule).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) {
+				return s.GlobalForwardingRules.Delete(p, n.ForwardingRule).Context(ctx).Do()
+			}},
+		{"target HTTP proxy", n.Proxy,
+			func() (string, error) {
+				r, err := s.TargetHttpProxies.Get(p, n.Proxy).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.TargetHttpProxies.Delete(p, n.Proxy).Context(ctx).Do() }},
+		{"target HTTP proxy", n.RedirectProxy,
+			func() (string, error) {
+				r, err := s.TargetHttpProxies.Get(p, n.RedirectProxy).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) {
+				return s.TargetHttpProxies.Delete(p, n.RedirectProxy).Context(ctx).Do()
+			}},
+		{"target HTTPS proxy", n.HTTPSProxy,
+			func() (string, error) {
+				r, err := s.TargetHttpsProxies.Get(p, n.HTTPSProxy).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) {
+				return s.TargetHttpsProxies.Delete(p, n.HTTPSProxy).Context(ctx).Do()
+			}},
+		{"URL map", n.RedirectURLMap,
+			func() (string, error) {
+				r, err := s.UrlMaps.Get(p, n.RedirectURLMap).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.UrlMaps.Delete(p, n.RedirectURLMap).Context(ctx).Do() }},
+		{"URL map", n.URLMap,
+			func() (string, error) {
+				r, err := s.UrlMaps.Get(p, n.URLMap).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.UrlMaps.Delete(p, n.URLMap).Context(ctx).Do() }},
+	}
+	for _, name := range sp.pathRuleServices() {
+		name := name
+		steps = append(steps, step{"backend service", name,
+			func() (string, error) {
+				r, err := s.BackendServices.Get(p, name).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.BackendServices.Delete(p, name).Context(ctx).Do() }})
+	}
+	steps = append(steps, []step{
+		{"backend service", n.BackendService,
+			func() (string, error) {
+				r, err := s.BackendServices.Get(p, n.BackendService).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) {
+				return s.BackendServices.Delete(p, n.BackendService).Context(ctx).Do()
+			}},
+		{"health check", n.HealthCheck,
+			func() (string, error) {
+				r, err := s.HealthChecks.Get(p, n.HealthCheck).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.HealthChecks.Delete(p, n.HealthCheck).Context(ctx).Do() }},
+		{"firewall rule", n.Firewall,
+			func() (string, error) {
+				r, err := s.Firewalls.Get(p, n.Firewall).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.Firewalls.Delete(p, n.Firewall).Context(ctx).Do() }},
+		{"address", n.Address,
+			func() (string, error) {
+				r, err := s.GlobalAddresses.Get(p, n.Address).Context(ctx).Do()
+				return descriptionOf(r, err)
+			},
+			func() (*compute.Operation, error) { return s.GlobalAddresses.Delete(p, n.Address).Context(ctx).Do() }},
+	}...)
+	for i, step := range steps {
+		rep.Report(progress.Update{Operation: task, Done: int64(i), Total: int64(len(steps)), Message: step.kind + " " + step.name})
+		desc, err := step.description()
+		switch {
+		case mig.IsNotFound(err):
+			log.Printf("%v %v does not exist.", step.kind, step.name)
+			continue
+		case err != nil:
+			return gcperr.Wrap(err, "get", step.kind+" "+step.name)
+		}
+		if owned != nil && !owned(desc) {
+			log.Printf("Keeping %v %v, which setup-lb did not create.", step.kind, step.name)
+			continue
+		}
+		op, err := step.delete()
+		if err != nil {
+			return gcperr.Wrap(err, "delete", step.kind+" "+step.name)
+		}
+		if err := sp.wait(ctx, s, op); err != nil {
+			return err
+		}
+		log.Printf("Deleted %v %v.", step.kind, step.name)
+	}
+	return nil
+}
+
+// descriptionOf returns the description of one of the load balancer's
+// resources, or the error from getting it.
+func descriptionOf(r interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch r := r.(type) {
+	case *compute.ForwardingRule:
+		return r.Description, nil
+	case *compute.TargetHttpProxy:
+		return r.Description, nil
+	case *compute.TargetHttpsProxy:
+		return r.Description, nil
+	case *compute.Address:
+		return r.Description, nil
+	case *compute.UrlMap:
+		return r.Description, nil
+	case *compute.BackendService:
+		return r.Description, nil
+	case *compute.HealthCheck:
+		return r.Description, nil
+	case *compute.Firewall:
+		return r.Description, nil
+	}
+	return "", fmt.Errorf("unexpected resource %T", r)
+}
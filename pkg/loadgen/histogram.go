@@ -0,0 +1,106 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadgen
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// histogramMin is the upper bound of a LatencyHistogram's first bucket.
+	histogramMin = 100 * time.Microsecond
+	// histogramGrowth is the ratio of the bounds of consecutive buckets.
+	histogramGrowth = 1.05
+	// histogramBuckets covers latencies up to about 16 minutes; the last
+	// bucket holds any longer.
+	histogramBuckets = 330
+)
+
+// A LatencyHistogram counts latencies in buckets 5% wider than the one
+// before, so that percentiles of any number of requests are known within 5%
+// in constant memory. The zero value is empty and ready to use. It is not
+// safe for concurrent use.
+type LatencyHistogram struct {
+	counts [histogramBuckets]int64
+	n      int64
+	max    time.Duration
+}
+
+// histogramBucket returns the index of the bucket holding d.
+func histogramBucket(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(histogramMin)) / math.Log(histogramGrowth)))
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+// Add counts one latency.
+func (h *LatencyHistogram) Add(d time.Duration) {
+	h.counts[histogramBucket(d)]++
+	h.n++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Merge adds the counts of o.
+func (h *LatencyHistogram) Merge(o *LatencyHistogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.n += o.n
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// Count returns the number of latencies counted.
+func (h *LatencyHistogram) Count() int64 {
+	return h.n
+}
+
+// Max returns the longest latency counted.
+func (h *LatencyHistogram) Max() time.Duration {
+	return h.max
+}
+
+// Percentile returns the upper bound of the bucket holding the latency below
+// which the given fraction of the counted latencies falls, like
+// report.Percentile of them all, or zero if there are none.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(h.n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		if seen += n; seen >= rank {
+			bound := time.Duration(float64(histogramMin) * math.Pow(histogramGrowth, float64(i)))
+			if bound > h.max {
+				return h.max
+			}
+			return bound
+		}
+	}
+	return h.max
+}
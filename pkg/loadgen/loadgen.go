@@ -0,0 +1,404 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loadgen offers open loop HTTP load, described by a Scenario of
+// constant rate phases, and records the latency and serving zone of every
+// request.
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/report"
+	"gopkg.in/yaml.v2"
+)
+
+// A Scenario describes the load offered to the load balancer during a run.
+type Scenario struct {
+	// URL is requested with GET by every simulated client.
+	URL    string  `yaml:"url"`
+	Phases []Phase `yaml:"phases"`
+	// Paths, if set, spreads the requests over several paths resolved
+	// against URL, such as those of the services behind a URL map, in
+	// proportion to their weights.
+	Paths []PathWeight `yaml:"paths"`
+	// FlashCrowd or Diurnal, if set, is run instead of phases.
+	FlashCrowd *FlashCrowd `yaml:"flashCrowd"`
+	Diurnal    *Diurnal    `yaml:"diurnal"`
+	// TraceSampleRate is the fraction of requests sent with a sampled trace
+	// context, so that backends running with server.trace write their spans
+	// to Cloud Trace.
+	TraceSampleRate float64 `yaml:"traceSampleRate"`
+}
+
+// A Phase offers a constant request rate for a fixed duration.
+type Phase struct {
+	Duration time.Duration `yaml:"duration"`
+	QPS      float64       `yaml:"qps"`
+}
+
+// A PathWeight is one path of a scenario's traffic mix.
+type PathWeight struct {
+	Path   string  `yaml:"path"`
+	Weight float64 `yaml:"weight"`
+}
+
+// Check verifies the scenario can be run.
+func (sc *Scenario) Check() error {
+	if sc.URL == "" {
+		return errors.New("scenario has no url")
+	}
+	if _, err := url.Parse(sc.URL); err != nil {
+		return fmt.Errorf("scenario url %q is invalid: %v", sc.URL, err)
+	}
+	for _, p := range sc.Paths {
+		if !strings.HasPrefix(p.Path, "/") || p.Weight <= 0 {
+			return fmt.Errorf("path %q needs to start with / and have a positive weight", p.Path)
+		}
+	}
+	if sc.TraceSampleRate < 0 || sc.TraceSampleRate > 1 {
+		return errors.New("traceSampleRate must be between 0 and 1")
+	}
+	switch {
+	case sc.FlashCrowd != nil && sc.Diurnal != nil:
+		return errors.New("scenario has both a flashCrowd and a diurnal pattern")
+	case (sc.FlashCrowd != nil || sc.Diurnal != nil) && len(sc.Phases) > 0:
+		return errors.New("scenario has both phases and a pattern")
+	case sc.FlashCrowd != nil:
+		return sc.FlashCrowd.Check()
+	case sc.Diurnal != nil:
+		return sc.Diurnal.Check()
+	}
+	if len(sc.Phases) == 0 {
+		return errors.New("scenario has no phases")
+	}
+	for _, p := range sc.Phases {
+		if p.Duration <= 0 || p.QPS <= 0 {
+			return errors.New("every phase needs a positive duration and qps")
+		}
+	}
+	return nil
+}
+
+// Schedule returns the phases the scenario is run as, those of its pattern
+// if it has one.
+func (sc *Scenario) Schedule() []Phase {
+	switch {
+	case sc.FlashCrowd != nil:
+		return sc.FlashCrowd.Phases()
+	case sc.Diurnal != nil:
+		return sc.Diurnal.Phases()
+	}
+	return sc.Phases
+}
+
+// Duration returns the total length of the scenario's phases.
+func (sc *Scenario) Duration() time.Duration {
+	var d time.Duration
+	for _, p := range sc.Schedule() {
+		d += p.Duration
+	}
+	return d
+}
+
+// target returns a function choosing the URL of each request: URL itself,
+// or one of the paths picked at random by weight and resolved against it.
+func (sc *Scenario) target() func() (url, path string) {
+	if len(sc.Paths) == 0 {
+		return func() (string, string) { return sc.URL, "" }
+	}
+	base, _ := url.Parse(sc.URL)
+	urls := make([]string, len(sc.Paths))
+	cumulative := make([]float64, len(sc.Paths))
+	total := 0.0
+	for i, p := range sc.Paths {
+		ref, err := url.Parse(p.Path)
+		if err != nil {
+			urls[i] = sc.URL + p.Path
+		} else {
+			urls[i] = base.ResolveReference(ref).String()
+		}
+		total += p.Weight
+		cumulative[i] = total
+	}
+	return func() (string, string) {
+		i := sort.SearchFloat64s(cumulative, rand.Float64()*total)
+		if i == len(urls) {
+			i--
+		}
+		return urls[i], sc.Paths[i].Path
+	}
+}
+
+// LoadScenario reads a scenario from a YAML file with the same fields as an
+// experiment's scenario.
+func LoadScenario(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &Scenario{}
+	if err := yaml.Unmarshal(b, sc); err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %v", path, err)
+	}
+	return sc, nil
+}
+
+// A Result records the outcome of every request sent during a scenario. It
+// is safe for concurrent use.
+type Result struct {
+	mu       sync.Mutex
+	requests int
+	errors   int
+	// samples holds every request in the order it completed, so the run can
+	// be broken into intervals, or only the recent ones with retain set.
+	samples []Sample
+	// retain, if set, is how long samples are kept after their start.
+	retain time.Duration
+	// onSample, if set, is called with every sample as it is recorded.
+	onSample func(Sample)
+}
+
+// A Sample is the outcome of one request.
+type Sample struct {
+	Start   time.Time
+	Latency time.Duration
+	OK      bool
+	// Zone is the serving backend's zone, from the X-Zone header set by the
+	// generated file server, or empty if no backend answered.
+	Zone string
+	// Path is the path of the scenario's traffic mix requested, or empty
+	// without one.
+	Path string
+}
+
+// record adds the outcome of a single request to path started at the given
+// time and served from the given zone.
+func (r *Result) record(start time.Time, d time.Duration, ok bool, zone, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if !ok {
+		r.errors++
+	}
+	sample := Sample{Start: start, Latency: d, OK: ok, Zone: zone, Path: path}
+	r.samples = append(r.samples, sample)
+	if r.onSample != nil {
+		r.onSample(sample)
+	}
+	if r.retain > 0 {
+		// Samples are in completion order, so a slow request may outlive
+		// faster ones started after it; it is dropped with them.
+		cutoff := time.Now().Add(-r.retain)
+		i := 0
+		for i < len(r.samples) && r.samples[i].Start.Before(cutoff) {
+			i++
+		}
+		r.samples = r.samples[i:]
+	}
+}
+
+// Requests returns how many requests were sent.
+func (r *Result) Requests() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+// ErrorRate returns the fraction of requests which failed.
+func (r *Result) ErrorRate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.requests == 0 {
+		return 0
+	}
+	return float64(r.errors) / float64(r.requests)
+}
+
+// Percentile returns the latency below which the given fraction of
+// successful requests completed. With Retain, only the retained requests
+// count.
+func (r *Result) Percentile(p float64) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sorted []time.Duration
+	for _, s := range r.samples {
+		if s.OK {
+			sorted = append(sorted, s.Latency)
+		}
+	}
+	sort.Sort(report.Durations(sorted))
+	return report.Percentile(sorted, p)
+}
+
+// Samples returns every request in the order it completed, or with Retain
+// only those retained.
+func (r *Result) Samples() []Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	samples := make([]Sample, len(r.samples))
+	copy(samples, r.samples)
+	return samples
+}
+
+// An Interval summarizes the requests started during one interval of a run.
+// Intervals are written as one JSON object per line.
+type Interval struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+	P50Ms    float64   `json:"p50Ms"`
+	P95Ms    float64   `json:"p95Ms"`
+	P99Ms    float64   `json:"p99Ms"`
+}
+
+// Intervals breaks the run into consecutive intervals of the given width,
+// aligned to multiples of it, each summarizing the requests started in it.
+func (r *Result) Intervals(width time.Duration) []*Interval {
+	buckets := map[time.Time][]Sample{}
+	var starts []time.Time
+	for _, s := range r.Samples() {
+		t := s.Start.UTC().Truncate(width)
+		if _, ok := buckets[t]; !ok {
+			starts = append(starts, t)
+		}
+		buckets[t] = append(buckets[t], s)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	var intervals []*Interval
+	for _, t := range starts {
+		intervals = append(intervals, summarize(buckets[t], t, width))
+	}
+	return intervals
+}
+
+// interval summarizes the requests started during the interval from start,
+// which have completed so far.
+func (r *Result) interval(start time.Time, width time.Duration) *Interval {
+	var samples []Sample
+	end := start.Add(width)
+	for _, s := range r.Samples() {
+		if !s.Start.Before(start) && s.Start.Before(end) {
+			samples = append(samples, s)
+		}
+	}
+	return summarize(samples, start, width)
+}
+
+// summarize returns the interval from start holding samples.
+func summarize(samples []Sample, start time.Time, width time.Duration) *Interval {
+	in := &Interval{Start: start, End: start.Add(width)}
+	var latencies []time.Duration
+	for _, s := range samples {
+		in.Requests++
+		if !s.OK {
+			in.Errors++
+			continue
+		}
+		latencies = append(latencies, s.Latency)
+	}
+	sort.Sort(report.Durations(latencies))
+	in.P50Ms = report.Millis(report.Percentile(latencies, 0.5))
+	in.P95Ms = report.Millis(report.Percentile(latencies, 0.95))
+	in.P99Ms = report.Millis(report.Percentile(latencies, 0.99))
+	return in
+}
+
+// WriteIntervals writes intervals to path as JSON lines.
+func WriteIntervals(path string, intervals []*Interval) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, in := range intervals {
+		if err := enc.Encode(in); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// A RequestSample is one request of a run, as written to
+// PREFIX.requests.jsonl by autoscaler experiment -requests.
+type RequestSample struct {
+	Start     time.Time `json:"start"`
+	LatencyMs float64   `json:"latencyMs"`
+	OK        bool      `json:"ok"`
+	Zone      string    `json:"zone,omitempty"`
+	Path      string    `json:"path,omitempty"`
+}
+
+// WriteRequestSamples writes every request of the run to path as JSON
+// lines, in the order they completed.
+func (r *Result) WriteRequestSamples(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, s := range r.Samples() {
+		rs := &RequestSample{Start: s.Start.UTC(), LatencyMs: report.Millis(s.Latency), OK: s.OK, Zone: s.Zone, Path: s.Path}
+		if err := enc.Encode(rs); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// sendRequest issues a single GET and records its outcome under path. The given
+// fraction of requests carry a sampled trace context, in both the W3C and
+// the Cloud Trace header formats. Requests cut short by ctx are not
+// recorded.
+func sendRequest(ctx context.Context, client *http.Client, url, path string, traceRate float64, res *Result) {
+	start := time.Now()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		res.record(start, 0, false, "", path)
+		return
+	}
+	req = req.WithContext(ctx)
+	if traceRate > 0 && rand.Float64() < traceRate {
+		traceID := fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+		spanID := rand.Uint64() | 1
+		req.Header.Set("traceparent", fmt.Sprintf("00-%s-%016x-01", traceID, spanID))
+		req.Header.Set("X-Cloud-Trace-Context", fmt.Sprintf("%s/%d;o=1", traceID, spanID))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			res.record(start, 0, false, "", path)
+		}
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	res.record(start, time.Since(start), resp.StatusCode < http.StatusInternalServerError, resp.Header.Get("X-Zone"), path)
+}
@@ -0,0 +1,231 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadgen
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// A FlashCrowd is a built-in traffic pattern: a baseline load which jumps
+// at once to a multiple of itself, holds there and drops back, like a link
+// going viral. It tests how the autoscaler copes with load that arrives
+// faster than instances boot:
+//
+//	flashCrowd:
+//	  baseline: 20
+//	  magnitude: 10
+//	  before: 5m
+//	  hold: 10m
+//	  after: 10m
+type FlashCrowd struct {
+	// Baseline is the request rate before and after the crowd.
+	Baseline float64 `yaml:"baseline"`
+	// Magnitude multiplies the baseline while the crowd holds.
+	Magnitude float64 `yaml:"magnitude"`
+	// Before is how long the baseline runs first, so that there is a
+	// latency to compare the crowd's with.
+	Before time.Duration `yaml:"before"`
+	Hold   time.Duration `yaml:"hold"`
+	// After is how long the baseline runs once the crowd is gone; zero
+	// ends the scenario with the drop.
+	After time.Duration `yaml:"after"`
+}
+
+// Check verifies the flash crowd can be run.
+func (f *FlashCrowd) Check() error {
+	switch {
+	case f.Baseline <= 0:
+		return errors.New("flashCrowd needs a positive baseline")
+	case f.Magnitude <= 1:
+		return errors.New("flashCrowd magnitude must be more than 1")
+	case f.Before <= 0 || f.Hold <= 0:
+		return errors.New("flashCrowd needs positive before and hold durations")
+	case f.After < 0:
+		return errors.New("flashCrowd after must not be negative")
+	}
+	return nil
+}
+
+// Phases returns the phases the flash crowd is run as.
+func (f *FlashCrowd) Phases() []Phase {
+	phases := []Phase{
+		{Duration: f.Before, QPS: f.Baseline},
+		{Duration: f.Hold, QPS: f.Baseline * f.Magnitude},
+	}
+	if f.After > 0 {
+		phases = append(phases, Phase{Duration: f.After, QPS: f.Baseline})
+	}
+	return phases
+}
+
+// A Diurnal is a built-in traffic pattern: a day of load, rising and
+// falling as a sinusoid peaking at PeakHour with random noise, compressed
+// into Duration of wall clock time. It tests scheduled and reactive
+// scaling together; autoscaler experiment compresses the policy's daily
+// scaling schedules the same way, so that they fire at the same simulated
+// hours:
+//
+//	diurnal:
+//	  min: 10
+//	  max: 100
+//	  peakHour: 14
+//	  duration: 2h
+//	  noise: 0.1
+type Diurnal struct {
+	// Min and Max are the request rates at the trough and the peak.
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+	// PeakHour is the simulated hour of the peak, and StartHour the
+	// simulated hour the run starts at.
+	PeakHour  float64 `yaml:"peakHour"`
+	StartHour float64 `yaml:"startHour"`
+	// Duration is the wall clock time the simulated 24 hours take.
+	Duration time.Duration `yaml:"duration"`
+	// Step is the wall clock length of each constant rate phase; it
+	// defaults to 15 simulated minutes.
+	Step time.Duration `yaml:"step"`
+	// Noise is the standard deviation of the random factor each phase's
+	// rate is multiplied by, as a fraction; zero follows the sinusoid.
+	Noise float64 `yaml:"noise"`
+	// Seed makes the noise repeatable; zero seeds from the clock.
+	Seed int64 `yaml:"seed"`
+}
+
+// Check verifies the diurnal pattern can be run.
+func (d *Diurnal) Check() error {
+	switch {
+	case d.Min <= 0 || d.Max < d.Min:
+		return errors.New("diurnal needs a positive min and a max of at least min")
+	case d.PeakHour < 0 || d.PeakHour >= 24 || d.StartHour < 0 || d.StartHour >= 24:
+		return errors.New("diurnal peakHour and startHour must be between 0 and 24")
+	case d.Duration <= 0:
+		return errors.New("diurnal needs a positive duration")
+	case d.Step < 0 || d.Step > d.Duration:
+		return errors.New("diurnal step must be positive and at most its duration")
+	case d.Noise < 0:
+		return errors.New("diurnal noise must not be negative")
+	}
+	return nil
+}
+
+// step returns the wall clock length of each phase.
+func (d *Diurnal) step() time.Duration {
+	if d.Step > 0 {
+		return d.Step
+	}
+	return d.Duration / 96
+}
+
+// Rate returns the request rate of the sinusoid, without noise, at a
+// simulated hour of the day.
+func (d *Diurnal) Rate(hour float64) float64 {
+	return d.Min + (d.Max-d.Min)*(1+math.Cos(2*math.Pi*(hour-d.PeakHour)/24))/2
+}
+
+// SimulatedHour returns the simulated hour of the day at a wall clock
+// offset from the start of the run.
+func (d *Diurnal) SimulatedHour(offset time.Duration) float64 {
+	return math.Mod(d.StartHour+24*float64(offset)/float64(d.Duration), 24)
+}
+
+// Offset returns the wall clock offset from the start of the run at which
+// a simulated hour of the day is reached.
+func (d *Diurnal) Offset(hour float64) time.Duration {
+	return time.Duration(math.Mod(hour-d.StartHour+24, 24) / 24 * float64(d.Duration))
+}
+
+// Compress returns the wall clock length of a simulated duration.
+func (d *Diurnal) Compress(simulated time.Duration) time.Duration {
+	return time.Duration(float64(simulated) * float64(d.Duration) / float64(24*time.Hour))
+}
+
+// Phases returns the phases the diurnal pattern is run as, each at the
+// noisy rate of its middle.
+func (d *Diurnal) Phases() []Phase {
+	seed := d.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	step := d.step()
+	var phases []Phase
+	for offset := time.Duration(0); offset < d.Duration; offset += step {
+		length := step
+		if offset+length > d.Duration {
+			length = d.Duration - offset
+		}
+		qps := d.Rate(d.SimulatedHour(offset+length/2)) * (1 + d.Noise*rnd.NormFloat64())
+		// Noise must not stop the load altogether.
+		phases = append(phases, Phase{Duration: length, QPS: math.Max(qps, d.Min/10)})
+	}
+	return phases
+}
+
+// An OverloadWindow is the stretch of a run during which the backends fell
+// behind the load.
+type OverloadWindow struct {
+	// Start is the start of the first overloaded interval ending after the
+	// reference time, and End the end of the last; both are zero if no
+	// interval was overloaded.
+	Start, End time.Time
+	// Overloaded counts the overloaded intervals between them.
+	Overloaded int
+	// BaselineP95Ms is the median p95 of the intervals before the
+	// reference time, which overloaded intervals are compared with.
+	BaselineP95Ms float64
+}
+
+// Length returns how long the overload lasted.
+func (w *OverloadWindow) Length() time.Duration {
+	return w.End.Sub(w.Start)
+}
+
+// FindOverload returns the overload window of a run's intervals from a
+// reference time, such as a flash crowd's jump. An interval is overloaded if
+// more than maxErrorRate of its requests failed, or its p95 was more than
+// latencyFactor times the median p95 of the intervals ending before from.
+func FindOverload(intervals []*Interval, from time.Time, latencyFactor, maxErrorRate float64) *OverloadWindow {
+	w := &OverloadWindow{}
+	var before []float64
+	for _, in := range intervals {
+		if !in.End.After(from) && in.Requests > 0 {
+			before = append(before, in.P95Ms)
+		}
+	}
+	if len(before) > 0 {
+		sort.Float64s(before)
+		w.BaselineP95Ms = before[len(before)/2]
+	}
+	for _, in := range intervals {
+		if !in.End.After(from) || in.Requests == 0 {
+			continue
+		}
+		slow := w.BaselineP95Ms > 0 && in.P95Ms > latencyFactor*w.BaselineP95Ms
+		failing := float64(in.Errors)/float64(in.Requests) > maxErrorRate
+		if !slow && !failing {
+			continue
+		}
+		if w.Overloaded == 0 {
+			w.Start = in.Start
+		}
+		w.End = in.End
+		w.Overloaded++
+	}
+	return w
+}
@@ -0,0 +1,203 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/progress"
+)
+
+// DefaultIntervalWidth is the width of the intervals a Runner reports
+// without WithIntervalWidth.
+const DefaultIntervalWidth = 10 * time.Second
+
+// A Runner offers a scenario's load open loop: requests are started on
+// schedule regardless of how long earlier ones take, so a slow backend
+// shows up as latency rather than as reduced load. Its hooks let callers
+// stream the run into their own systems as it happens.
+type Runner struct {
+	client       *http.Client
+	scenario     *Scenario
+	width        time.Duration
+	onPhaseStart func(i int, p Phase)
+	onInterval   func(*Interval)
+	onComplete   func(*Result)
+	onSample     func(Sample)
+	retain       time.Duration
+	reporter     progress.Reporter
+}
+
+// A RunnerOption configures a Runner.
+type RunnerOption func(*Runner)
+
+// WithIntervalWidth sets the width of the intervals passed to OnInterval.
+func WithIntervalWidth(width time.Duration) RunnerOption {
+	return func(r *Runner) { r.width = width }
+}
+
+// OnPhaseStart sets a function called as each phase of the scenario starts,
+// with its index.
+func OnPhaseStart(f func(i int, p Phase)) RunnerOption {
+	return func(r *Runner) { r.onPhaseStart = f }
+}
+
+// OnInterval sets a function called as each interval of the run ends, with
+// the requests started in it which have completed by then; those still
+// running are only counted by Result.Intervals. Intervals are aligned to
+// multiples of their width like Result.Intervals.
+func OnInterval(f func(*Interval)) RunnerOption {
+	return func(r *Runner) { r.onInterval = f }
+}
+
+// OnComplete sets a function called with the result once every request has
+// completed, even if the run was cancelled.
+func OnComplete(f func(*Result)) RunnerOption {
+	return func(r *Runner) { r.onComplete = f }
+}
+
+// OnSample sets a function called with every request as it completes.
+// Calls are never concurrent, and should return quickly as they hold up
+// the recording of other requests.
+func OnSample(f func(Sample)) RunnerOption {
+	return func(r *Runner) { r.onSample = f }
+}
+
+// Retain makes the Result keep only the requests started in the last d, so
+// that a run of any length uses bounded memory. Requests and ErrorRate
+// still count every request, but Percentile, Samples and Intervals only
+// cover those retained; OnInterval and OnSample see them all. At least two
+// interval widths are retained.
+func Retain(d time.Duration) RunnerOption {
+	return func(r *Runner) { r.retain = d }
+}
+
+// WithReporter makes the Runner report the start of each phase and the end
+// of each interval to r.
+func WithReporter(r progress.Reporter) RunnerOption {
+	return func(rn *Runner) { rn.reporter = progress.OrNop(r) }
+}
+
+// NewRunner returns a Runner offering a scenario's load with client. The
+// scenario should pass Check.
+func NewRunner(client *http.Client, sc *Scenario, opts ...RunnerOption) *Runner {
+	r := &Runner{client: client, scenario: sc, width: DefaultIntervalWidth, reporter: progress.Nop}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run offers the load and returns the outcome of every request, once they
+// have all completed. If ctx is done first, Run stops offering load, cancels
+// the requests in flight and returns the result so far along with ctx's
+// error.
+func (r *Runner) Run(ctx context.Context) (*Result, error) {
+	if err := r.scenario.Check(); err != nil {
+		return nil, err
+	}
+	task := "offer load to " + r.scenario.URL
+	res := &Result{retain: r.retain, onSample: r.onSample}
+	if res.retain > 0 && res.retain < 2*r.width {
+		res.retain = 2 * r.width
+	}
+	stopIntervals := make(chan struct{})
+	intervalsDone := make(chan struct{})
+	go func() {
+		defer close(intervalsDone)
+		r.reportIntervals(task, res, stopIntervals)
+	}()
+
+	wg := &sync.WaitGroup{}
+	sc := r.scenario
+	schedule := sc.Schedule()
+	target := sc.target()
+phases:
+	for i, p := range schedule {
+		if r.onPhaseStart != nil {
+			r.onPhaseStart(i, p)
+		}
+		r.reporter.Report(progress.Update{
+			Operation: task,
+			Done:      int64(i),
+			Total:     int64(len(schedule)),
+			Message:   fmt.Sprintf("phase at %v QPS for %v", p.QPS, p.Duration),
+		})
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / p.QPS))
+		end := time.After(p.Duration)
+	phase:
+		for {
+			select {
+			case <-ticker.C:
+				wg.Add(1)
+				url, path := target()
+				go func() {
+					defer wg.Done()
+					sendRequest(ctx, r.client, url, path, sc.TraceSampleRate, res)
+				}()
+			case <-end:
+				break phase
+			case <-ctx.Done():
+				ticker.Stop()
+				break phases
+			}
+		}
+		ticker.Stop()
+	}
+	wg.Wait()
+	close(stopIntervals)
+	<-intervalsDone
+	if r.onComplete != nil {
+		r.onComplete(res)
+	}
+	r.reporter.Finish(task, ctx.Err())
+	return res, ctx.Err()
+}
+
+// reportIntervals passes each interval to the OnInterval hook and the
+// Reporter as it ends, until stop is closed, then passes the last, partial
+// one.
+func (r *Runner) reportIntervals(task string, res *Result, stop <-chan struct{}) {
+	if r.onInterval == nil && r.reporter == progress.Nop {
+		return
+	}
+	report := func(in *Interval) {
+		if r.onInterval != nil {
+			r.onInterval(in)
+		}
+		r.reporter.Report(progress.Update{
+			Operation: task,
+			Message: fmt.Sprintf("%d requests, %d errors, p95 %.0fms in the interval ending %v",
+				in.Requests, in.Errors, in.P95Ms, in.End.Format("15:04:05")),
+		})
+	}
+	start := time.Now().UTC().Truncate(r.width)
+	for {
+		select {
+		case <-time.After(time.Until(start.Add(r.width))):
+			report(res.interval(start, r.width))
+			start = start.Add(r.width)
+		case <-stop:
+			if in := res.interval(start, r.width); in.Requests > 0 {
+				report(in)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadgen_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/loadgen"
+)
+
+// newServer starts a file server answering with status from
+// us-central1-f, and returns it with the count of requests it received.
+func newServer(t *testing.T, status int) (*httptest.Server, *int64) {
+	t.Helper()
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("X-Zone", "us-central1-f")
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestRunnerOffersLoad(t *testing.T) {
+	srv, received := newServer(t, http.StatusOK)
+	sc := &loadgen.Scenario{URL: srv.URL, Phases: []loadgen.Phase{
+		{Duration: 200 * time.Millisecond, QPS: 50},
+		{Duration: 200 * time.Millisecond, QPS: 100},
+	}}
+	var phases []int
+	var completed *loadgen.Result
+	r := loadgen.NewRunner(srv.Client(), sc,
+		loadgen.OnPhaseStart(func(i int, p loadgen.Phase) { phases = append(phases, i) }),
+		loadgen.OnComplete(func(res *loadgen.Result) { completed = res }))
+	res, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(phases) != 2 || phases[0] != 0 || phases[1] != 1 {
+		t.Errorf("phases started %v, want 0 then 1", phases)
+	}
+	if completed != res {
+		t.Error("OnComplete was not called with the result")
+	}
+	// The phases offer 10 and 20 requests.
+	if n := res.Requests(); n < 20 || n > 30 {
+		t.Errorf("sent %d requests, want about 30", n)
+	}
+	if n := atomic.LoadInt64(received); int(n) != res.Requests() {
+		t.Errorf("the server received %d requests, the result counts %d", n, res.Requests())
+	}
+	if rate := res.ErrorRate(); rate != 0 {
+		t.Errorf("error rate = %v, want 0", rate)
+	}
+	for _, s := range res.Samples() {
+		if !s.OK || s.Zone != "us-central1-f" || s.Latency <= 0 {
+			t.Errorf("sample %+v, want a success served from us-central1-f", s)
+		}
+	}
+}
+
+func TestRunnerCountsServerErrors(t *testing.T) {
+	srv, _ := newServer(t, http.StatusServiceUnavailable)
+	sc := &loadgen.Scenario{URL: srv.URL, Phases: []loadgen.Phase{{Duration: 100 * time.Millisecond, QPS: 50}}}
+	res, err := loadgen.NewRunner(srv.Client(), sc).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Requests() == 0 || res.ErrorRate() != 1 {
+		t.Errorf("%d requests with error rate %v, want every request to fail", res.Requests(), res.ErrorRate())
+	}
+}
+
+func TestRunnerReportsIntervals(t *testing.T) {
+	srv, _ := newServer(t, http.StatusOK)
+	width := 50 * time.Millisecond
+	sc := &loadgen.Scenario{URL: srv.URL, Phases: []loadgen.Phase{{Duration: 300 * time.Millisecond, QPS: 100}}}
+	var intervals []*loadgen.Interval
+	r := loadgen.NewRunner(srv.Client(), sc,
+		loadgen.WithIntervalWidth(width),
+		loadgen.OnInterval(func(in *loadgen.Interval) { intervals = append(intervals, in) }))
+	res, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intervals) < 5 {
+		t.Fatalf("reported %d intervals of a 300ms run, want one each 50ms", len(intervals))
+	}
+	requests := 0
+	for i, in := range intervals {
+		if !in.Start.Equal(in.Start.Truncate(width)) || !in.End.Equal(in.Start.Add(width)) {
+			t.Errorf("interval %d is %v to %v, want one aligned to a multiple of %v", i, in.Start, in.End, width)
+		}
+		if i > 0 && !in.Start.Equal(intervals[i-1].End) {
+			t.Errorf("interval %d starts at %v, want the end of the one before", i, in.Start)
+		}
+		requests += in.Requests
+	}
+	if requests == 0 || requests > res.Requests() {
+		t.Errorf("the intervals hold %d requests of %d", requests, res.Requests())
+	}
+}
+
+func TestRunnerCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	sc := &loadgen.Scenario{URL: srv.URL, Phases: []loadgen.Phase{{Duration: 10 * time.Second, QPS: 20}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	completed := false
+	start := time.Now()
+	res, err := loadgen.NewRunner(srv.Client(), sc, loadgen.OnComplete(func(*loadgen.Result) { completed = true })).Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Run = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run took %v after it was cancelled", elapsed)
+	}
+	if !completed || res == nil {
+		t.Error("OnComplete was not called with the result of the cancelled run")
+	}
+	if n := res.Requests(); n != 0 {
+		t.Errorf("recorded %d requests cut short by the cancellation, want none", n)
+	}
+}
+
+func TestRunnerRejectsBadScenario(t *testing.T) {
+	sc := &loadgen.Scenario{URL: "http://localhost", Phases: []loadgen.Phase{{Duration: time.Second}}}
+	if _, err := loadgen.NewRunner(http.DefaultClient, sc).Run(context.Background()); err == nil {
+		t.Error("Run offered a phase without a rate")
+	}
+}
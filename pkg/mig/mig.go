@@ -0,0 +1,286 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mig manages Compute Engine managed instance groups, hiding whether
+// a group is zonal or regional, and waits on the Compute Engine operations
+// which change groups and the resources around them.
+package mig
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/progress"
+	"google.golang.org/api/compute/v1"
+)
+
+// PollInterval is the time between polls of a pending operation or of a
+// group being waited on.
+var PollInterval = 2 * time.Second
+
+// A Location is the zone, or for regional resources the region, of a
+// project which a group or autoscaler lives in.
+type Location struct {
+	Project string
+	Zone    string
+	// Region is set instead of Zone for regional resources.
+	Region string
+}
+
+// Regional reports whether the location is a region.
+func (l Location) Regional() bool {
+	return l.Region != ""
+}
+
+// String returns the zone or region.
+func (l Location) String() string {
+	if l.Regional() {
+		return l.Region
+	}
+	return l.Zone
+}
+
+// A Group names a managed instance group. Its methods call the zonal or the
+// regional Compute API collection depending on its location.
+type Group struct {
+	Location
+	Name string
+}
+
+// wrap wraps the error of the call op on the group, if any.
+func (g *Group) wrap(err *error, op string) {
+	*err = gcperr.Wrap(*err, op, "instance group manager "+g.Name)
+}
+
+// Get fetches the group's instance group manager.
+func (g *Group) Get(ctx context.Context, s *compute.Service) (m *compute.InstanceGroupManager, err error) {
+	defer g.wrap(&err, "get")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.Get(g.Project, g.Region, g.Name).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.Get(g.Project, g.Zone, g.Name).Context(ctx).Do()
+}
+
+// Insert creates the group from m, whose name should be the group's.
+func (g *Group) Insert(ctx context.Context, s *compute.Service, m *compute.InstanceGroupManager) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "create")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.Insert(g.Project, g.Region, m).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.Insert(g.Project, g.Zone, m).Context(ctx).Do()
+}
+
+// Delete deletes the group along with all of its instances.
+func (g *Group) Delete(ctx context.Context, s *compute.Service) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "delete")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.Delete(g.Project, g.Region, g.Name).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.Delete(g.Project, g.Zone, g.Name).Context(ctx).Do()
+}
+
+// ListManagedInstances returns every instance in the group.
+func (g *Group) ListManagedInstances(ctx context.Context, s *compute.Service) (instances []*compute.ManagedInstance, err error) {
+	defer g.wrap(&err, "list instances of")
+	if g.Regional() {
+		resp, err := s.RegionInstanceGroupManagers.ListManagedInstances(g.Project, g.Region, g.Name).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.ManagedInstances, nil
+	}
+	resp, err := s.InstanceGroupManagers.ListManagedInstances(g.Project, g.Zone, g.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.ManagedInstances, nil
+}
+
+// Resize sets the target size of the group.
+func (g *Group) Resize(ctx context.Context, s *compute.Service, size int64) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "resize")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.Resize(g.Project, g.Region, g.Name, size).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.Resize(g.Project, g.Zone, g.Name, size).Context(ctx).Do()
+}
+
+// Patch changes only the fields set in m.
+func (g *Group) Patch(ctx context.Context, s *compute.Service, m *compute.InstanceGroupManager) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "patch")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.Patch(g.Project, g.Region, g.Name, m).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.Patch(g.Project, g.Zone, g.Name, m).Context(ctx).Do()
+}
+
+// DeleteInstances deletes instances of the group, given by URL, and lowers
+// its target size to match.
+func (g *Group) DeleteInstances(ctx context.Context, s *compute.Service, instances []string) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "delete instances of")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.DeleteInstances(g.Project, g.Region, g.Name,
+			&compute.RegionInstanceGroupManagersDeleteInstancesRequest{Instances: instances}).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.DeleteInstances(g.Project, g.Zone, g.Name,
+		&compute.InstanceGroupManagersDeleteInstancesRequest{Instances: instances}).Context(ctx).Do()
+}
+
+// AbandonInstances removes instances, given by URL, from the group without
+// deleting them, and lowers its target size to match.
+func (g *Group) AbandonInstances(ctx context.Context, s *compute.Service, instances []string) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "abandon instances of")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.AbandonInstances(g.Project, g.Region, g.Name,
+			&compute.RegionInstanceGroupManagersAbandonInstancesRequest{Instances: instances}).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.AbandonInstances(g.Project, g.Zone, g.Name,
+		&compute.InstanceGroupManagersAbandonInstancesRequest{Instances: instances}).Context(ctx).Do()
+}
+
+// CreateInstances creates named instances in the group, each with its own
+// per-instance config, and raises the target size to match.
+func (g *Group) CreateInstances(ctx context.Context, s *compute.Service, configs []*compute.PerInstanceConfig) (op *compute.Operation, err error) {
+	defer g.wrap(&err, "create instances in")
+	if g.Regional() {
+		return s.RegionInstanceGroupManagers.CreateInstances(g.Project, g.Region, g.Name,
+			&compute.RegionInstanceGroupManagersCreateInstancesRequest{Instances: configs}).Context(ctx).Do()
+	}
+	return s.InstanceGroupManagers.CreateInstances(g.Project, g.Zone, g.Name,
+		&compute.InstanceGroupManagersCreateInstancesRequest{Instances: configs}).Context(ctx).Do()
+}
+
+// WaitForStable polls the group until it reports itself stable, meaning no
+// instances are being created, deleted or otherwise acted upon. Every poll
+// which finds the group busy is reported to r, which may be nil. It gives up
+// with the context's error once ctx is done.
+func (g *Group) WaitForStable(ctx context.Context, s *compute.Service, timeout time.Duration, r progress.Reporter) (err error) {
+	r = progress.OrNop(r)
+	task := "wait for " + g.Name + " to be stable"
+	defer func() { r.Finish(task, err) }()
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := g.Get(ctx, s)
+		if err != nil {
+			return err
+		}
+		if m.Status != nil && m.Status.IsStable {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("group %v was not stable after %v", g.Name, timeout)
+		}
+		r.Report(progress.Update{
+			Operation: task,
+			Message:   fmt.Sprintf("target size %d", m.TargetSize),
+			Remaining: time.Until(deadline),
+		})
+		if err := sleep(ctx, PollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// CountAutohealingHealthy returns how many instances pass the group's
+// autohealing health check. This works before the group is attached to a
+// backend service.
+func CountAutohealingHealthy(instances []*compute.ManagedInstance) int64 {
+	var n int64
+	for _, i := range instances {
+		for _, h := range i.InstanceHealth {
+			if h.DetailedHealthState == "HEALTHY" {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// WaitForOperation polls an operation until it completes and returns any
+// error it reports. Zonal, regional and global operations are all
+// supported. Every poll is reported to r, which may be nil, as the
+// operation's type and target, with its percentage done. It gives up with
+// the context's error once ctx is done.
+func WaitForOperation(ctx context.Context, s *compute.Service, project string, op *compute.Operation, r progress.Reporter) (err error) {
+	r = progress.OrNop(r)
+	task := op.OperationType + " " + path.Base(op.TargetLink)
+	defer func() { r.Finish(task, err) }()
+	name, zone, region := op.Name, op.Zone, op.Region
+	for op.Status != "DONE" {
+		if err := sleep(ctx, PollInterval); err != nil {
+			return err
+		}
+		var err error
+		switch {
+		case zone != "":
+			op, err = s.ZoneOperations.Get(project, path.Base(zone), name).Context(ctx).Do()
+		case region != "":
+			op, err = s.RegionOperations.Get(project, path.Base(region), name).Context(ctx).Do()
+		default:
+			op, err = s.GlobalOperations.Get(project, name).Context(ctx).Do()
+		}
+		if err != nil {
+			return gcperr.Wrap(err, "get", "operation "+name)
+		}
+		r.Report(progress.Update{Operation: task, Done: op.Progress, Total: 100, Message: op.Status})
+	}
+	return OperationError(op)
+}
+
+// sleep waits for d, or returns the context's error if it is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OperationError converts the errors reported by a completed operation into
+// a single *gcperr.OperationError.
+func OperationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	e := op.Error.Errors[0]
+	return &gcperr.OperationError{Operation: op.Name, Code: e.Code, Message: e.Message}
+}
+
+// IsNotFound reports whether err is an error for a missing resource,
+// wrapped or not.
+func IsNotFound(err error) bool {
+	return gcperr.KindOf(err) == gcperr.ErrNotFound
+}
+
+// TemplateURL returns the partial URL of a global instance template. Values
+// which already look like URLs are returned unchanged.
+func TemplateURL(project, template string) string {
+	if strings.Contains(template, "/") {
+		return template
+	}
+	return fmt.Sprintf("projects/%s/global/instanceTemplates/%s", project, template)
+}
+
+// ZoneURL returns the partial URL of a zone.
+func ZoneURL(project, zone string) string {
+	return fmt.Sprintf("projects/%s/zones/%s", project, zone)
+}
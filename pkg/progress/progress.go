@@ -0,0 +1,161 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress defines the Reporter the long-running operations of this
+// module report their progress to, so that each frontend can show it its own
+// way. NewText writes human readable lines, e.g. to os.Stdout, NewJSON writes
+// one JSON object per update for other programs, and Nop discards it all:
+//
+//	err := g.WaitForStable(ctx, s, 10*time.Minute, progress.NewText(os.Stdout))
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// An Update is the state of a running operation.
+type Update struct {
+	// Operation names the operation, e.g. "resize web". It is the same in
+	// every update of the operation and in its Finish call.
+	Operation string
+	// Done and Total count the work done so far out of all of it, in units
+	// of the operation's choosing. Total is zero if unknown.
+	Done, Total int64
+	// Message describes the latest step, if any.
+	Message string
+	// Remaining is the time left before the operation times out, or zero if
+	// it has no deadline.
+	Remaining time.Duration
+}
+
+// A Reporter receives the progress of operations. Implementations must be
+// safe for concurrent use, as several operations may run at once.
+type Reporter interface {
+	// Report is called whenever an operation moves on.
+	Report(u Update)
+	// Finish is called once when an operation ends, with its error if it
+	// failed.
+	Finish(operation string, err error)
+}
+
+// Nop is a Reporter which discards everything, and what the operations of
+// this module report to when given a nil Reporter.
+var Nop Reporter = nop{}
+
+type nop struct{}
+
+func (nop) Report(Update)        {}
+func (nop) Finish(string, error) {}
+
+// OrNop returns r, or Nop if r is nil.
+func OrNop(r Reporter) Reporter {
+	if r == nil {
+		return Nop
+	}
+	return r
+}
+
+// NewText returns a Reporter writing one line per update and finish to w,
+// e.g. "resize web: 3/10 instances running (4m0s left)".
+func NewText(w io.Writer) Reporter {
+	return &text{w: w}
+}
+
+type text struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *text) Report(u Update) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	line := u.Operation + ":"
+	if u.Total > 0 {
+		line += fmt.Sprintf(" %d/%d", u.Done, u.Total)
+	} else if u.Done > 0 {
+		line += fmt.Sprintf(" %d", u.Done)
+	}
+	if u.Message != "" {
+		line += " " + u.Message
+	}
+	if u.Remaining > 0 {
+		line += fmt.Sprintf(" (%v left)", u.Remaining.Round(time.Second))
+	}
+	fmt.Fprintln(t.w, line)
+}
+
+func (t *text) Finish(operation string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(t.w, "%v: failed: %v\n", operation, err)
+		return
+	}
+	fmt.Fprintf(t.w, "%v: done\n", operation)
+}
+
+// NewJSON returns a Reporter writing every update and finish to w as a JSON
+// object on its own line, with the fields of Event.
+func NewJSON(w io.Writer) Reporter {
+	return &jsonLines{enc: json.NewEncoder(w)}
+}
+
+// An Event is a line written by the Reporter of NewJSON.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Done      int64     `json:"done,omitempty"`
+	Total     int64     `json:"total,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	// RemainingSeconds is the time left before the operation times out.
+	RemainingSeconds float64 `json:"remainingSeconds,omitempty"`
+	// Finished is set on the last event of an operation, along with Error
+	// if it failed.
+	Finished bool   `json:"finished,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type jsonLines struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (j *jsonLines) Report(u Update) {
+	j.write(&Event{
+		Time:             time.Now().UTC(),
+		Operation:        u.Operation,
+		Done:             u.Done,
+		Total:            u.Total,
+		Message:          u.Message,
+		RemainingSeconds: u.Remaining.Seconds(),
+	})
+}
+
+func (j *jsonLines) Finish(operation string, err error) {
+	e := &Event{Time: time.Now().UTC(), Operation: operation, Finished: true}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.write(e)
+}
+
+func (j *jsonLines) write(e *Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(e)
+}
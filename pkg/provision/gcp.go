@@ -0,0 +1,120 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provision
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/storage/v1"
+)
+
+// NewCompute returns the Compute of a Compute Engine client.
+func NewCompute(s *compute.Service) Compute {
+	return &gcpCompute{s}
+}
+
+// gcpCompute implements Compute with the Compute Engine API.
+type gcpCompute struct {
+	s *compute.Service
+}
+
+func (c *gcpCompute) GetGroup(ctx context.Context, g *mig.Group) (*compute.InstanceGroupManager, error) {
+	return g.Get(ctx, c.s)
+}
+
+func (c *gcpCompute) InsertGroup(ctx context.Context, g *mig.Group, m *compute.InstanceGroupManager) (*compute.Operation, error) {
+	return g.Insert(ctx, c.s, m)
+}
+
+func (c *gcpCompute) ResizeGroup(ctx context.Context, g *mig.Group, size int64) (*compute.Operation, error) {
+	return g.Resize(ctx, c.s, size)
+}
+
+func (c *gcpCompute) DeleteGroup(ctx context.Context, g *mig.Group) (*compute.Operation, error) {
+	return g.Delete(ctx, c.s)
+}
+
+func (c *gcpCompute) ListManagedInstances(ctx context.Context, g *mig.Group) ([]*compute.ManagedInstance, error) {
+	return g.ListManagedInstances(ctx, c.s)
+}
+
+func (c *gcpCompute) GetAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Autoscaler, error) {
+	return as.Get(ctx, c.s)
+}
+
+func (c *gcpCompute) InsertAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error) {
+	return as.Insert(ctx, c.s, a)
+}
+
+func (c *gcpCompute) UpdateAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error) {
+	return as.Update(ctx, c.s, a)
+}
+
+func (c *gcpCompute) DeleteAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Operation, error) {
+	return as.Delete(ctx, c.s)
+}
+
+func (c *gcpCompute) WaitForOperation(ctx context.Context, project string, op *compute.Operation) error {
+	return mig.WaitForOperation(ctx, c.s, project, op, nil)
+}
+
+// NewStorage returns the Storage of a Cloud Storage client making its calls
+// as c says; the listings and deletions bill c.BillingProject too.
+func NewStorage(s *storage.Service, c gcsgen.ObjectsConfig) Storage {
+	return &gcpStorage{gcsgen.ConfiguredObjects(s, c), s, c.BillingProject}
+}
+
+// gcpStorage implements Storage with the Cloud Storage API.
+type gcpStorage struct {
+	gcsgen.Objects
+	s *storage.Service
+	// userProject, if set, is billed for the calls.
+	userProject string
+}
+
+// Objects listed per page, the most Cloud Storage returns.
+const listPageSize = 1000
+
+func (st *gcpStorage) ListObjects(ctx context.Context, bucket, prefix string, page func([]ObjectVersion) error) error {
+	call := st.s.Objects.List(bucket).Prefix(prefix).Versions(true).MaxResults(listPageSize).
+		Fields("items/name", "items/generation", "nextPageToken")
+	if st.userProject != "" {
+		call = call.UserProject(st.userProject)
+	}
+	err := call.Pages(ctx, func(objs *storage.Objects) error {
+		versions := make([]ObjectVersion, 0, len(objs.Items))
+		for _, o := range objs.Items {
+			versions = append(versions, ObjectVersion{o.Name, o.Generation})
+		}
+		return page(versions)
+	})
+	return gcperr.Wrap(err, "list", "bucket "+bucket)
+}
+
+func (st *gcpStorage) DeleteObject(ctx context.Context, bucket string, o ObjectVersion) error {
+	call := st.s.Objects.Delete(bucket, o.Name)
+	if o.Generation != 0 {
+		call = call.Generation(o.Generation)
+	}
+	if st.userProject != "" {
+		call = call.UserProject(st.userProject)
+	}
+	return gcperr.Wrap(call.Context(ctx).Do(), "delete", "object "+o.Name)
+}
@@ -0,0 +1,340 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package provision creates, resizes and deletes the serving stack of an
+// autoscaling experiment: the file corpus, the managed instance group and
+// its autoscaler. The Compute Engine and Cloud Storage operations it needs
+// are behind the Compute and Storage interfaces, implemented for GCP by
+// NewCompute and NewStorage, and in memory by package provisiontest, so
+// that orchestration built on a Provisioner can be tested hermetically.
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/progress"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+	"google.golang.org/api/compute/v1"
+)
+
+// Compute are the Compute Engine operations a Provisioner makes. Errors for
+// missing resources must satisfy mig.IsNotFound.
+type Compute interface {
+	GetGroup(ctx context.Context, g *mig.Group) (*compute.InstanceGroupManager, error)
+	InsertGroup(ctx context.Context, g *mig.Group, m *compute.InstanceGroupManager) (*compute.Operation, error)
+	ResizeGroup(ctx context.Context, g *mig.Group, size int64) (*compute.Operation, error)
+	DeleteGroup(ctx context.Context, g *mig.Group) (*compute.Operation, error)
+	ListManagedInstances(ctx context.Context, g *mig.Group) ([]*compute.ManagedInstance, error)
+
+	GetAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Autoscaler, error)
+	InsertAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error)
+	UpdateAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error)
+	DeleteAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Operation, error)
+
+	// WaitForOperation waits for an operation to complete and returns the
+	// error it reports.
+	WaitForOperation(ctx context.Context, project string, op *compute.Operation) error
+}
+
+// An ObjectVersion is a generation of an object. Generation zero is the
+// live version of an object in a bucket without versioning.
+type ObjectVersion struct {
+	Name       string
+	Generation int64
+}
+
+// Storage are the Cloud Storage operations a Provisioner makes. Errors for
+// missing objects must satisfy mig.IsNotFound.
+type Storage interface {
+	gcsgen.Objects
+	// ListObjects calls page with each page of the objects of a bucket
+	// starting with prefix, every generation of versioned objects included,
+	// until page returns an error, which ListObjects returns.
+	ListObjects(ctx context.Context, bucket, prefix string, page func([]ObjectVersion) error) error
+	// DeleteObject deletes a generation of an object.
+	DeleteObject(ctx context.Context, bucket string, o ObjectVersion) error
+}
+
+// A Provisioner creates and deletes a serving stack.
+type Provisioner struct {
+	Compute Compute
+	Storage Storage
+	// PollInterval is the time between polls of a group being waited on,
+	// by default mig.PollInterval.
+	PollInterval time.Duration
+	// Concurrency is the number of calls CreateGroups and DeleteCorpus make
+	// at once, by default workerpool.DefaultWorkers.
+	Concurrency int
+	// Reporter receives the progress of the waits for groups and the
+	// generation of the corpus. It may be nil.
+	Reporter progress.Reporter
+}
+
+// pollInterval returns the time between polls of a group.
+func (p *Provisioner) pollInterval() time.Duration {
+	if p.PollInterval > 0 {
+		return p.PollInterval
+	}
+	return mig.PollInterval
+}
+
+// deleteRetry is how the calls fanned out by a Provisioner are retried.
+// Only the errors of operations are: those of the calls starting them are
+// retried by the client, see package retry.
+var deleteRetry = workerpool.RetryPolicy{Attempts: 3, Backoff: time.Second, Retryable: func(err error) bool {
+	var oe *gcperr.OperationError
+	return errors.As(err, &oe) && gcperr.IsRetryable(err)
+}}
+
+// pool returns a worker pool for fanning calls out, further configured by
+// opts.
+func (p *Provisioner) pool(ctx context.Context, opts ...workerpool.Option) *workerpool.Pool {
+	workers := p.Concurrency
+	if workers <= 0 {
+		workers = workerpool.DefaultWorkers
+	}
+	opts = append([]workerpool.Option{workerpool.WithWorkers(workers), workerpool.WithRetry(deleteRetry)}, opts...)
+	return workerpool.New(ctx, opts...)
+}
+
+// do waits for the operation started by a call, returning the call's error
+// if it failed to start.
+func (p *Provisioner) do(ctx context.Context, project string, op *compute.Operation, err error) error {
+	if err != nil {
+		return err
+	}
+	return p.Compute.WaitForOperation(ctx, project, op)
+}
+
+// GenerateCorpus uploads image to bucket under name and duplicates it into
+// the corpus the file servers read, using the Provisioner's Storage.
+func (p *Provisioner) GenerateCorpus(ctx context.Context, bucket, name string, image io.Reader, opts ...gcsgen.Option) (*gcsgen.Result, error) {
+	opts = append([]gcsgen.Option{gcsgen.WithObjects(p.Storage), gcsgen.WithReporter(p.Reporter)}, opts...)
+	return gcsgen.New(nil, bucket, name, image, opts...).Run(ctx)
+}
+
+// CreateGroup creates the group from m unless it already exists, and waits
+// for the creation to finish. It reports whether it created the group.
+func (p *Provisioner) CreateGroup(ctx context.Context, g *mig.Group, m *compute.InstanceGroupManager) (bool, error) {
+	_, err := p.Compute.GetGroup(ctx, g)
+	switch {
+	case err == nil:
+		return false, nil
+	case !mig.IsNotFound(err):
+		return false, gcperr.Wrap(err, "get", "instance group manager "+g.Name)
+	}
+	op, err := p.Compute.InsertGroup(ctx, g, m)
+	if err := p.do(ctx, g.Project, op, err); err != nil {
+		return false, gcperr.Wrap(err, "create", "instance group manager "+g.Name)
+	}
+	return true, nil
+}
+
+// A GroupSpec is a group to create and the manager to create it from.
+type GroupSpec struct {
+	Group   *mig.Group
+	Manager *compute.InstanceGroupManager
+}
+
+// CreateGroups creates the groups which do not exist yet, Concurrency at a
+// time, and returns how many it created. It goes on after a failure and
+// returns the error of the first.
+func (p *Provisioner) CreateGroups(ctx context.Context, specs []GroupSpec) (int, error) {
+	var mu sync.Mutex
+	created := 0
+	pool := p.pool(ctx)
+	for _, spec := range specs {
+		spec := spec
+		err := pool.Submit(spec.Group.Name, func(ctx context.Context) error {
+			ok, err := p.CreateGroup(ctx, spec.Group, spec.Manager)
+			if ok {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	failures, err := pool.Wait()
+	if len(failures) > 0 {
+		return created, failures[0].Err
+	}
+	return created, err
+}
+
+// ResizeGroup sets the group's target size and waits until it is stable
+// with size instances, for at most timeout.
+func (p *Provisioner) ResizeGroup(ctx context.Context, g *mig.Group, size int64, timeout time.Duration) error {
+	op, err := p.Compute.ResizeGroup(ctx, g, size)
+	if err := p.do(ctx, g.Project, op, err); err != nil {
+		return gcperr.Wrap(err, "resize", "instance group manager "+g.Name)
+	}
+	return p.WaitForSize(ctx, g, size, timeout)
+}
+
+// WaitForSize polls the group until it is stable with size running
+// instances, for at most timeout.
+func (p *Provisioner) WaitForSize(ctx context.Context, g *mig.Group, size int64, timeout time.Duration) (err error) {
+	r := progress.OrNop(p.Reporter)
+	task := "wait for " + g.Name + " to be serving"
+	defer func() { r.Finish(task, err) }()
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := p.Compute.GetGroup(ctx, g)
+		if err != nil {
+			return gcperr.Wrap(err, "get", "instance group manager "+g.Name)
+		}
+		instances, err := p.Compute.ListManagedInstances(ctx, g)
+		if err != nil {
+			return gcperr.Wrap(err, "list instances of", "instance group manager "+g.Name)
+		}
+		var running int64
+		for _, i := range instances {
+			if i.InstanceStatus == "RUNNING" && i.CurrentAction == "NONE" {
+				running++
+			}
+		}
+		if m.Status != nil && m.Status.IsStable && int64(len(instances)) == size && running == size {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("group %v did not reach %d running instances within %v", g.Name, size, timeout)
+		}
+		r.Report(progress.Update{Operation: task, Done: running, Total: size, Message: "instances running", Remaining: time.Until(deadline)})
+		select {
+		case <-time.After(p.pollInterval()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ApplyAutoscaler creates the autoscaler from a, or replaces its policy if
+// it already exists.
+func (p *Provisioner) ApplyAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) error {
+	_, err := p.Compute.GetAutoscaler(ctx, as)
+	var op *compute.Operation
+	switch {
+	case err == nil:
+		op, err = p.Compute.UpdateAutoscaler(ctx, as, a)
+	case mig.IsNotFound(err):
+		op, err = p.Compute.InsertAutoscaler(ctx, as, a)
+	default:
+		return gcperr.Wrap(err, "get", "autoscaler "+as.Name)
+	}
+	if err := p.do(ctx, as.Project, op, err); err != nil {
+		return gcperr.Wrap(err, "apply", "autoscaler "+as.Name)
+	}
+	return nil
+}
+
+// Teardown deletes the autoscaler, then the group and its instances.
+// Either may already be missing.
+func (p *Provisioner) Teardown(ctx context.Context, as *autoscale.Autoscaler, g *mig.Group) error {
+	op, err := p.Compute.DeleteAutoscaler(ctx, as)
+	if err := p.do(ctx, as.Project, op, err); err != nil && !mig.IsNotFound(err) {
+		return gcperr.Wrap(err, "delete", "autoscaler "+as.Name)
+	}
+	op, err = p.Compute.DeleteGroup(ctx, g)
+	if err := p.do(ctx, g.Project, op, err); err != nil && !mig.IsNotFound(err) {
+		return gcperr.Wrap(err, "delete", "instance group manager "+g.Name)
+	}
+	return nil
+}
+
+// Deletions between the progress reports of DeleteCorpus.
+const purgeReportEvery = 1000
+
+// A PurgeResult describes a DeleteCorpus.
+type PurgeResult struct {
+	// Listed counts the object generations found, Deleted those deleted or
+	// already gone, and Failed those which could not be deleted.
+	Listed, Deleted, Failed int
+	Duration                time.Duration
+}
+
+// Rate returns the deletions per second.
+func (r *PurgeResult) Rate() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Deleted) / r.Duration.Seconds()
+}
+
+// DeleteCorpus deletes every generation of the objects of bucket starting
+// with prefix, Concurrency at a time. The deletions start with the first
+// page of the listing rather than after all of it, so that buckets of
+// millions of objects are purged at the rate of the deleters. Progress and
+// the deletion rate are reported as the operation "purge BUCKET". It goes
+// on after a failure and returns the error of the first, along with the
+// result so far.
+func (p *Provisioner) DeleteCorpus(ctx context.Context, bucket, prefix string) (*PurgeResult, error) {
+	start := time.Now()
+	task := "purge " + bucket
+	reporter := progress.OrNop(p.Reporter)
+	res := &PurgeResult{}
+	var listed int64
+	pool := p.pool(ctx, workerpool.OnDone(func(o workerpool.Outcome) {
+		if o.Err != nil {
+			res.Failed++
+		} else {
+			res.Deleted++
+		}
+		if done := res.Deleted + res.Failed; done%purgeReportEvery == 0 {
+			rate := float64(res.Deleted) / time.Since(start).Seconds()
+			reporter.Report(progress.Update{Operation: task, Done: int64(done), Total: atomic.LoadInt64(&listed),
+				Message: fmt.Sprintf("%.0f deletions/s", rate)})
+		}
+	}))
+	lerr := p.Storage.ListObjects(ctx, bucket, prefix, func(page []ObjectVersion) error {
+		for _, o := range page {
+			o := o
+			atomic.AddInt64(&listed, 1)
+			err := pool.Submit(o.Name, func(ctx context.Context) error {
+				if err := p.Storage.DeleteObject(ctx, bucket, o); err != nil && !mig.IsNotFound(err) {
+					return gcperr.Wrap(err, "delete", "object "+o.Name)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	failures, err := pool.Wait()
+	res.Listed = int(listed)
+	res.Duration = time.Since(start)
+	switch {
+	case len(failures) > 0:
+		err = failures[0].Err
+	case lerr != nil:
+		err = gcperr.Wrap(lerr, "list", "bucket "+bucket)
+	}
+	reporter.Finish(task, err)
+	return res, err
+}
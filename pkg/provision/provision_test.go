@@ -0,0 +1,341 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provision_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcsgen"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision/provisiontest"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+var location = mig.Location{Project: "p", Zone: "us-central1-f"}
+
+// errBackend is an error of the API which is neither retryable nor a
+// missing resource.
+var errBackend = &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid"}
+
+func group(name string) *mig.Group {
+	return &mig.Group{Location: location, Name: name}
+}
+
+func autoscaler(name string) *autoscale.Autoscaler {
+	return &autoscale.Autoscaler{Location: location, Name: name}
+}
+
+// newProvisioner returns a Provisioner over empty doubles, polling at once.
+func newProvisioner() (*provision.Provisioner, *provisiontest.Compute, *provisiontest.Storage) {
+	c, s := provisiontest.NewCompute(), provisiontest.NewStorage()
+	return &provision.Provisioner{Compute: c, Storage: s, PollInterval: time.Millisecond}, c, s
+}
+
+// count returns how many of calls are of method.
+func count(calls []string, method string) int {
+	n := 0
+	for _, c := range calls {
+		if strings.HasPrefix(c, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCreateGroupsCreatesMissingGroups(t *testing.T) {
+	p, c, _ := newProvisioner()
+	c.Groups["web"] = &compute.InstanceGroupManager{Name: "web", TargetSize: 2}
+	specs := []provision.GroupSpec{
+		{Group: group("web"), Manager: &compute.InstanceGroupManager{TargetSize: 5}},
+		{Group: group("thumbs"), Manager: &compute.InstanceGroupManager{TargetSize: 3}},
+		{Group: group("video"), Manager: &compute.InstanceGroupManager{TargetSize: 1}},
+	}
+	created, err := p.CreateGroups(context.Background(), specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 {
+		t.Errorf("created %d groups, want 2", created)
+	}
+	if got := c.Groups["web"].TargetSize; got != 2 {
+		t.Errorf("existing group has target size %d, want it kept at 2", got)
+	}
+	for _, name := range []string{"thumbs", "video"} {
+		if c.Groups[name] == nil {
+			t.Errorf("group %v was not created", name)
+		}
+	}
+	if n := count(c.Calls(), "InsertGroup"); n != 2 {
+		t.Errorf("made %d InsertGroup calls, want 2", n)
+	}
+}
+
+func TestCreateGroupsReturnsFirstFailure(t *testing.T) {
+	p, c, _ := newProvisioner()
+	c.Fail("InsertGroup", errBackend)
+	created, err := p.CreateGroups(context.Background(), []provision.GroupSpec{
+		{Group: group("web"), Manager: &compute.InstanceGroupManager{}},
+		{Group: group("thumbs"), Manager: &compute.InstanceGroupManager{}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatalf("err = %v, want the injected error", err)
+	}
+	if created != 0 {
+		t.Errorf("created %d groups, want 0", created)
+	}
+	// The failure of one group does not stop the other.
+	if n := count(c.Calls(), "InsertGroup"); n != 2 {
+		t.Errorf("made %d InsertGroup calls, want 2", n)
+	}
+}
+
+func TestGenerateCorpus(t *testing.T) {
+	p, _, s := newProvisioner()
+	res, err := p.GenerateCorpus(context.Background(), "corpus", "eiffel.jpg", strings.NewReader("jpeg"), gcsgen.WithFiles(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 3 {
+		t.Errorf("copied %d objects, want 3", res.Copied)
+	}
+	for _, name := range []string{"0-eiffel.jpg", "1-eiffel.jpg", "2-eiffel.jpg"} {
+		if string(s.Objects["corpus/"+name]) != "jpeg" {
+			t.Errorf("corpus/%v = %q, want a copy of the image", name, s.Objects["corpus/"+name])
+		}
+	}
+}
+
+func TestCreateGroupGetFailure(t *testing.T) {
+	p, c, _ := newProvisioner()
+	c.Fail("GetGroup", errBackend)
+	if _, err := p.CreateGroup(context.Background(), group("web"), &compute.InstanceGroupManager{}); err == nil {
+		t.Fatal("CreateGroup succeeded although the group could not be got")
+	}
+	if n := count(c.Calls(), "InsertGroup"); n != 0 {
+		t.Errorf("made %d InsertGroup calls after the failed get, want 0", n)
+	}
+}
+
+func TestCreateGroupOperationFailure(t *testing.T) {
+	p, c, _ := newProvisioner()
+	c.Fail("WaitForOperation", errBackend)
+	created, err := p.CreateGroup(context.Background(), group("web"), &compute.InstanceGroupManager{})
+	if err == nil || created {
+		t.Fatalf("CreateGroup = %v, %v; want the operation's error", created, err)
+	}
+}
+
+func TestResizeGroupWaitsForSize(t *testing.T) {
+	p, c, _ := newProvisioner()
+	c.Groups["web"] = &compute.InstanceGroupManager{Name: "web", TargetSize: 1, Status: &compute.InstanceGroupManagerStatus{IsStable: true}}
+	if err := p.ResizeGroup(context.Background(), group("web"), 4, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Groups["web"].TargetSize; got != 4 {
+		t.Errorf("target size = %d, want 4", got)
+	}
+}
+
+func TestResizeGroupNotFound(t *testing.T) {
+	p, _, _ := newProvisioner()
+	err := p.ResizeGroup(context.Background(), group("web"), 4, time.Second)
+	if !mig.IsNotFound(err) {
+		t.Errorf("err = %v, want a not found error", err)
+	}
+}
+
+func TestWaitForSize(t *testing.T) {
+	ctx := context.Background()
+	p, c, _ := newProvisioner()
+	if _, err := p.CreateGroup(ctx, group("web"), &compute.InstanceGroupManager{TargetSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WaitForSize(ctx, group("web"), 3, time.Second); err != nil {
+		t.Errorf("WaitForSize(3) = %v, want nil", err)
+	}
+	err := p.WaitForSize(ctx, group("web"), 5, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "did not reach 5") {
+		t.Errorf("WaitForSize(5) = %v, want a timeout", err)
+	}
+	c.Groups["web"].Status.IsStable = false
+	if err := p.WaitForSize(ctx, group("web"), 3, 10*time.Millisecond); err == nil {
+		t.Error("WaitForSize returned although the group is not stable")
+	}
+}
+
+func TestWaitForSizeErrors(t *testing.T) {
+	ctx := context.Background()
+	p, c, _ := newProvisioner()
+	if err := p.WaitForSize(ctx, group("web"), 1, time.Second); !mig.IsNotFound(err) {
+		t.Errorf("WaitForSize of a missing group = %v, want a not found error", err)
+	}
+	c.Groups["web"] = &compute.InstanceGroupManager{Name: "web", TargetSize: 1}
+	c.Fail("ListManagedInstances", errBackend)
+	if err := p.WaitForSize(ctx, group("web"), 1, time.Second); err == nil || !strings.Contains(err.Error(), "list instances") {
+		t.Errorf("WaitForSize = %v, want the listing's error", err)
+	}
+}
+
+func TestWaitForSizeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p, c, _ := newProvisioner()
+	c.Groups["web"] = &compute.InstanceGroupManager{Name: "web", TargetSize: 1}
+	cancel()
+	if err := p.WaitForSize(ctx, group("web"), 2, time.Minute); err != context.Canceled {
+		t.Errorf("WaitForSize = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestApplyAutoscalerInsertsThenUpdates(t *testing.T) {
+	ctx := context.Background()
+	p, c, _ := newProvisioner()
+	as := autoscaler("web-as")
+	if err := p.ApplyAutoscaler(ctx, as, &compute.Autoscaler{Name: "web-as", AutoscalingPolicy: &compute.AutoscalingPolicy{MaxNumReplicas: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ApplyAutoscaler(ctx, as, &compute.Autoscaler{Name: "web-as", AutoscalingPolicy: &compute.AutoscalingPolicy{MaxNumReplicas: 9}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Autoscalers["web-as"].AutoscalingPolicy.MaxNumReplicas; got != 9 {
+		t.Errorf("max replicas = %d, want the update's 9", got)
+	}
+	calls := c.Calls()
+	if count(calls, "InsertAutoscaler") != 1 || count(calls, "UpdateAutoscaler") != 1 {
+		t.Errorf("calls = %v, want one insert and one update", calls)
+	}
+}
+
+func TestApplyAutoscalerErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, method := range []string{"GetAutoscaler", "InsertAutoscaler", "WaitForOperation"} {
+		p, c, _ := newProvisioner()
+		c.Fail(method, errBackend)
+		if err := p.ApplyAutoscaler(ctx, autoscaler("web-as"), &compute.Autoscaler{}); err == nil {
+			t.Errorf("ApplyAutoscaler succeeded although %v failed", method)
+		}
+		if c.Autoscalers["web-as"] != nil && method != "WaitForOperation" {
+			t.Errorf("the autoscaler was created although %v failed", method)
+		}
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	ctx := context.Background()
+	p, c, _ := newProvisioner()
+	c.Groups["web"] = &compute.InstanceGroupManager{Name: "web"}
+	c.Autoscalers["web-as"] = &compute.Autoscaler{Name: "web-as"}
+	if err := p.Teardown(ctx, autoscaler("web-as"), group("web")); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Groups) != 0 || len(c.Autoscalers) != 0 {
+		t.Errorf("left %d groups and %d autoscalers", len(c.Groups), len(c.Autoscalers))
+	}
+	calls := c.Calls()
+	if calls[0] != "DeleteAutoscaler web-as" {
+		t.Errorf("first call = %q, want the autoscaler deleted before the group", calls[0])
+	}
+	// Both are gone now, which is not an error.
+	if err := p.Teardown(ctx, autoscaler("web-as"), group("web")); err != nil {
+		t.Errorf("second Teardown = %v, want nil", err)
+	}
+}
+
+func TestTeardownErrors(t *testing.T) {
+	ctx := context.Background()
+	p, c, _ := newProvisioner()
+	c.Groups["web"] = &compute.InstanceGroupManager{Name: "web"}
+	c.Fail("DeleteAutoscaler", errBackend)
+	if err := p.Teardown(ctx, autoscaler("web-as"), group("web")); err == nil {
+		t.Fatal("Teardown succeeded although the autoscaler could not be deleted")
+	}
+	if c.Groups["web"] == nil {
+		t.Error("the group was deleted although its autoscaler was not")
+	}
+	c.Fail("DeleteAutoscaler", provisiontest.NotFound("autoscaler", "web-as"))
+	c.Fail("DeleteGroup", errBackend)
+	if err := p.Teardown(ctx, autoscaler("web-as"), group("web")); err == nil || !strings.Contains(err.Error(), "instance group manager web") {
+		t.Errorf("Teardown = %v, want the group's error", err)
+	}
+}
+
+func TestDeleteCorpus(t *testing.T) {
+	p, _, s := newProvisioner()
+	for i := 0; i < 25; i++ {
+		s.Objects[fmt.Sprintf("corpus/%d-eiffel.jpg", i)] = []byte("x")
+	}
+	s.Objects["corpus/keep.txt"] = []byte("x")
+	s.Objects["other/0-eiffel.jpg"] = []byte("x")
+	res, err := p.DeleteCorpus(context.Background(), "corpus", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Listed != 26 || res.Deleted != 26 || res.Failed != 0 {
+		t.Errorf("result = %+v, want 26 listed and deleted", res)
+	}
+	if len(s.Objects) != 1 || s.Objects["other/0-eiffel.jpg"] == nil {
+		t.Errorf("left %v, want only the other bucket's object", s.Objects)
+	}
+}
+
+func TestDeleteCorpusPrefix(t *testing.T) {
+	p, _, s := newProvisioner()
+	s.Objects["corpus/1-a.jpg"] = []byte("x")
+	s.Objects["corpus/2-a.jpg"] = []byte("x")
+	s.Objects["corpus/keep.txt"] = []byte("x")
+	res, err := p.DeleteCorpus(context.Background(), "corpus", "1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Deleted != 1 || len(s.Objects) != 2 {
+		t.Errorf("deleted %d, left %d objects; want 1 and 2", res.Deleted, len(s.Objects))
+	}
+}
+
+func TestDeleteCorpusErrors(t *testing.T) {
+	ctx := context.Background()
+	p, _, s := newProvisioner()
+	s.Objects["corpus/a"] = []byte("x")
+	s.Objects["corpus/b"] = []byte("x")
+	s.Fail("DeleteObject", errBackend)
+	res, err := p.DeleteCorpus(ctx, "corpus", "")
+	if err == nil {
+		t.Fatal("DeleteCorpus succeeded although every deletion failed")
+	}
+	if res.Failed != 2 || res.Deleted != 0 {
+		t.Errorf("result = %+v, want 2 failed", res)
+	}
+
+	// Objects deleted meanwhile count as deleted.
+	s.Fail("DeleteObject", provisiontest.NotFound("object", "a"))
+	if res, err := p.DeleteCorpus(ctx, "corpus", ""); err != nil || res.Deleted != 2 {
+		t.Errorf("DeleteCorpus = %+v, %v; want 2 deleted", res, err)
+	}
+
+	listErr := errors.New("listing failed")
+	s.Fail("DeleteObject", nil)
+	s.Fail("ListObjects", listErr)
+	if _, err := p.DeleteCorpus(ctx, "corpus", ""); err == nil || !strings.Contains(err.Error(), "listing failed") {
+		t.Errorf("DeleteCorpus = %v, want the listing's error", err)
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package provisiontest provides in-memory test doubles of the provision
+// package's Compute and Storage interfaces. They record every call, keep the
+// resources created through them, complete every operation at once and
+// return the errors a test injects:
+//
+//	c := provisiontest.NewCompute()
+//	c.Fail("ResizeGroup", errors.New("quota exceeded"))
+//	p := &provision.Provisioner{Compute: c, Storage: provisiontest.NewStorage()}
+//	err := p.ResizeGroup(ctx, g, 10, time.Minute)
+//
+// Simulator is a slower double for exercising the waiting and watching code
+// paths, simulating operation latency, instance boots and autoscalers.
+package provisiontest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// NotFound returns the error the doubles return for a missing resource,
+// which satisfies mig.IsNotFound.
+func NotFound(kind, name string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("%v %v was not found", kind, name)}
+}
+
+// calls records calls and the errors injected into them.
+type calls struct {
+	mu     sync.Mutex
+	calls  []string
+	errors map[string]error
+}
+
+// Fail makes every later call of the named method return err, or succeed
+// again if err is nil.
+func (c *calls) Fail(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.errors == nil {
+		c.errors = map[string]error{}
+	}
+	if err == nil {
+		delete(c.errors, method)
+		return
+	}
+	c.errors[method] = err
+}
+
+// Calls returns each call made so far, in order, as the method name followed
+// by the name of the resource it was made on, e.g. "ResizeGroup web".
+func (c *calls) Calls() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+// record adds a call and returns the error injected into its method. It
+// must be called with mu held.
+func (c *calls) record(method, name string) error {
+	c.calls = append(c.calls, method+" "+name)
+	return c.errors[method]
+}
+
+// A Compute is an in-memory provision.Compute. Groups and autoscalers are
+// keyed by name alone, and groups report themselves stable at their target
+// size as soon as they are created or resized, with every instance running.
+type Compute struct {
+	calls
+	Groups      map[string]*compute.InstanceGroupManager
+	Autoscalers map[string]*compute.Autoscaler
+	ops         int
+}
+
+// NewCompute returns a Compute without resources.
+func NewCompute() *Compute {
+	return &Compute{
+		Groups:      map[string]*compute.InstanceGroupManager{},
+		Autoscalers: map[string]*compute.Autoscaler{},
+	}
+}
+
+// done returns a completed operation on a resource.
+func (c *Compute) done(kind, target string) *compute.Operation {
+	c.ops++
+	return &compute.Operation{
+		Name:          fmt.Sprintf("operation-%d", c.ops),
+		OperationType: kind,
+		TargetLink:    target,
+		Status:        "DONE",
+	}
+}
+
+func (c *Compute) GetGroup(ctx context.Context, g *mig.Group) (*compute.InstanceGroupManager, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("GetGroup", g.Name); err != nil {
+		return nil, err
+	}
+	m, ok := c.Groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	copy := *m
+	return &copy, nil
+}
+
+func (c *Compute) InsertGroup(ctx context.Context, g *mig.Group, m *compute.InstanceGroupManager) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("InsertGroup", g.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Groups[g.Name]; ok {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: g.Name + " already exists"}
+	}
+	copy := *m
+	copy.Name = g.Name
+	copy.SelfLink = "projects/" + g.Project + "/" + g.String() + "/instanceGroupManagers/" + g.Name
+	copy.Status = &compute.InstanceGroupManagerStatus{IsStable: true}
+	c.Groups[g.Name] = &copy
+	return c.done("insert", copy.SelfLink), nil
+}
+
+func (c *Compute) ResizeGroup(ctx context.Context, g *mig.Group, size int64) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("ResizeGroup", g.Name); err != nil {
+		return nil, err
+	}
+	m, ok := c.Groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	m.TargetSize = size
+	return c.done("compute.instanceGroupManagers.resize", m.SelfLink), nil
+}
+
+func (c *Compute) DeleteGroup(ctx context.Context, g *mig.Group) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("DeleteGroup", g.Name); err != nil {
+		return nil, err
+	}
+	m, ok := c.Groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	delete(c.Groups, g.Name)
+	return c.done("delete", m.SelfLink), nil
+}
+
+// ListManagedInstances returns one running instance for each unit of the
+// group's target size.
+func (c *Compute) ListManagedInstances(ctx context.Context, g *mig.Group) ([]*compute.ManagedInstance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("ListManagedInstances", g.Name); err != nil {
+		return nil, err
+	}
+	m, ok := c.Groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	var instances []*compute.ManagedInstance
+	for i := int64(0); i < m.TargetSize; i++ {
+		instances = append(instances, &compute.ManagedInstance{
+			Instance:       fmt.Sprintf("projects/%s/zones/%s/instances/%s-%d", g.Project, g.String(), g.Name, i),
+			InstanceStatus: "RUNNING",
+			CurrentAction:  "NONE",
+		})
+	}
+	return instances, nil
+}
+
+func (c *Compute) GetAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Autoscaler, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("GetAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	a, ok := c.Autoscalers[as.Name]
+	if !ok {
+		return nil, NotFound("autoscaler", as.Name)
+	}
+	copy := *a
+	return &copy, nil
+}
+
+func (c *Compute) InsertAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("InsertAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Autoscalers[as.Name]; ok {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: as.Name + " already exists"}
+	}
+	copy := *a
+	c.Autoscalers[as.Name] = &copy
+	return c.done("insert", as.Name), nil
+}
+
+func (c *Compute) UpdateAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("UpdateAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Autoscalers[as.Name]; !ok {
+		return nil, NotFound("autoscaler", as.Name)
+	}
+	copy := *a
+	c.Autoscalers[as.Name] = &copy
+	return c.done("update", as.Name), nil
+}
+
+func (c *Compute) DeleteAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("DeleteAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Autoscalers[as.Name]; !ok {
+		return nil, NotFound("autoscaler", as.Name)
+	}
+	delete(c.Autoscalers, as.Name)
+	return c.done("delete", as.Name), nil
+}
+
+// WaitForOperation returns the error injected into it, or that of the
+// operation.
+func (c *Compute) WaitForOperation(ctx context.Context, project string, op *compute.Operation) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record("WaitForOperation", op.Name); err != nil {
+		return err
+	}
+	return mig.OperationError(op)
+}
+
+// A Storage is an in-memory provision.Storage, keeping objects in Objects
+// keyed by "BUCKET/NAME".
+type Storage struct {
+	calls
+	Objects map[string][]byte
+}
+
+// NewStorage returns a Storage without objects.
+func NewStorage() *Storage {
+	return &Storage{Objects: map[string][]byte{}}
+}
+
+func (st *Storage) InsertObject(ctx context.Context, bucket, name string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.record("InsertObject", name); err != nil {
+		return err
+	}
+	st.Objects[bucket+"/"+name] = b
+	return nil
+}
+
+func (st *Storage) CopyObject(ctx context.Context, bucket, source, dest string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.record("CopyObject", dest); err != nil {
+		return err
+	}
+	b, ok := st.Objects[bucket+"/"+source]
+	if !ok {
+		return NotFound("object", source)
+	}
+	st.Objects[bucket+"/"+dest] = append([]byte(nil), b...)
+	return nil
+}
+
+// ListObjects lists the objects in name order, as a single page of
+// generation zero versions: the objects are not versioned.
+func (st *Storage) ListObjects(ctx context.Context, bucket, prefix string, page func([]provision.ObjectVersion) error) error {
+	st.mu.Lock()
+	if err := st.record("ListObjects", bucket); err != nil {
+		st.mu.Unlock()
+		return err
+	}
+	var versions []provision.ObjectVersion
+	for key := range st.Objects {
+		if name := strings.TrimPrefix(key, bucket+"/"); name != key && strings.HasPrefix(name, prefix) {
+			versions = append(versions, provision.ObjectVersion{Name: name})
+		}
+	}
+	// page deletes the objects through st.
+	st.mu.Unlock()
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Name < versions[j].Name })
+	return page(versions)
+}
+
+// DeleteObject deletes the object whatever the generation.
+func (st *Storage) DeleteObject(ctx context.Context, bucket string, o provision.ObjectVersion) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.record("DeleteObject", o.Name); err != nil {
+		return err
+	}
+	if _, ok := st.Objects[bucket+"/"+o.Name]; !ok {
+		return NotFound("object", o.Name)
+	}
+	delete(st.Objects, bucket+"/"+o.Name)
+	return nil
+}
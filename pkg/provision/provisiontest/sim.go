@@ -0,0 +1,542 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisiontest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// A Simulator is an in-memory provision.Compute which, unlike Compute, takes
+// time: operations complete after a latency, created instances boot before
+// they run, deleted ones take time to go away, and autoscalers resize their
+// group from a simulated CPU load, with the same scale-in stabilization as
+// autoscaler simulate. Time is the wall clock unless WithClock gives
+// another, so tests run it with latencies of milliseconds:
+//
+//	sim := provisiontest.NewSimulator(
+//		provisiontest.WithBootTime(50*time.Millisecond, 10*time.Millisecond),
+//		provisiontest.WithLoad(func(time.Time) float64 { return 3 }))
+//	p := &provision.Provisioner{Compute: sim, PollInterval: 10 * time.Millisecond}
+//
+// The Simulator's state only advances when it is called.
+type Simulator struct {
+	calls
+	opLatency      time.Duration
+	bootTime       time.Duration
+	bootJitter     time.Duration
+	deleteTime     time.Duration
+	interval       time.Duration
+	stabilization  time.Duration
+	load           func(time.Time) float64
+	rand           *rand.Rand
+	now            func() time.Time
+	groups         map[string]*simGroup
+	autoscalers    map[string]*compute.Autoscaler
+	ops            map[string]*simOp
+	opCount        int
+	instanceCount  int
+	lastAutoscaled time.Time
+}
+
+// A SimOption configures a Simulator.
+type SimOption func(*Simulator)
+
+// WithOperationLatency sets how long operations take to complete, by
+// default 100ms.
+func WithOperationLatency(d time.Duration) SimOption {
+	return func(s *Simulator) { s.opLatency = d }
+}
+
+// WithBootTime sets how long created instances take to run, plus a random
+// extra of up to jitter, by default 200ms without jitter.
+func WithBootTime(d, jitter time.Duration) SimOption {
+	return func(s *Simulator) { s.bootTime, s.bootJitter = d, jitter }
+}
+
+// WithDeleteTime sets how long deleted instances are listed as deleting,
+// by default 50ms.
+func WithDeleteTime(d time.Duration) SimOption {
+	return func(s *Simulator) { s.deleteTime = d }
+}
+
+// WithAutoscalerInterval sets the time between autoscaler decisions, by
+// default 100ms.
+func WithAutoscalerInterval(d time.Duration) SimOption {
+	return func(s *Simulator) { s.interval = d }
+}
+
+// WithStabilization sets the window whose largest recommendation an
+// autoscaler scales in to, by default 1s.
+func WithStabilization(d time.Duration) SimOption {
+	return func(s *Simulator) { s.stabilization = d }
+}
+
+// WithLoad sets the CPU demand on every group at a given time, in fully
+// busy instances, by default none.
+func WithLoad(load func(time.Time) float64) SimOption {
+	return func(s *Simulator) { s.load = load }
+}
+
+// WithSeed seeds the boot jitter.
+func WithSeed(seed int64) SimOption {
+	return func(s *Simulator) { s.rand = rand.New(rand.NewSource(seed)) }
+}
+
+// WithClock sets the time the Simulator runs at, by default time.Now.
+func WithClock(now func() time.Time) SimOption {
+	return func(s *Simulator) { s.now = now }
+}
+
+// A Clock keeps the wall clock's time until it is advanced, which skips it
+// ahead. Tests checking that a Simulator leaves something alone advance
+// its Clock rather than waiting.
+type Clock struct {
+	mu      sync.Mutex
+	skipped time.Duration
+}
+
+// Now returns the time, the wall clock's plus what c has been advanced by.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.skipped)
+}
+
+// Advance skips c ahead by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skipped += d
+}
+
+// NewSimulator returns a Simulator without resources.
+func NewSimulator(opts ...SimOption) *Simulator {
+	s := &Simulator{
+		opLatency:     100 * time.Millisecond,
+		bootTime:      200 * time.Millisecond,
+		deleteTime:    50 * time.Millisecond,
+		interval:      100 * time.Millisecond,
+		stabilization: time.Second,
+		load:          func(time.Time) float64 { return 0 },
+		rand:          rand.New(rand.NewSource(1)),
+		now:           time.Now,
+		groups:        map[string]*simGroup{},
+		autoscalers:   map[string]*compute.Autoscaler{},
+		ops:           map[string]*simOp{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// A simGroup is a simulated managed instance group.
+type simGroup struct {
+	m         *compute.InstanceGroupManager
+	instances []*simInstance
+	// recommendations holds the autoscaler's recent recommendations, oldest
+	// first.
+	recommendations []simRecommendation
+}
+
+// A simInstance is an instance of a simulated group.
+type simInstance struct {
+	name    string
+	readyAt time.Time
+	// deletedAt is set once the instance is being deleted.
+	deletedAt time.Time
+}
+
+// A simRecommendation is a size an autoscaler recommended at some time.
+type simRecommendation struct {
+	at   time.Time
+	size int64
+}
+
+// A simOp is a pending operation, applied when it completes.
+type simOp struct {
+	op     *compute.Operation
+	doneAt time.Time
+	apply  func(now time.Time)
+}
+
+// SetLoad replaces the CPU demand on every group.
+func (s *Simulator) SetLoad(load func(time.Time) float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load = load
+}
+
+// Serving returns how many instances of the named group are running, and
+// its target size.
+func (s *Simulator) Serving(name string) (serving, target int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.advance(now)
+	g, ok := s.groups[name]
+	if !ok {
+		return 0, 0
+	}
+	return g.serving(now), g.m.TargetSize
+}
+
+// advance applies the operations completed and the autoscaler decisions
+// made up to now, in time order. It must be called with mu held.
+func (s *Simulator) advance(now time.Time) {
+	for {
+		var next *simOp
+		for _, o := range s.ops {
+			if o.apply != nil && !o.doneAt.After(now) && (next == nil || o.doneAt.Before(next.doneAt)) {
+				next = o
+			}
+		}
+		tick := s.lastAutoscaled.Add(s.interval)
+		if s.lastAutoscaled.IsZero() {
+			tick = now
+		}
+		switch {
+		case next != nil && (next.doneAt.Before(tick) || tick.After(now)):
+			next.apply(next.doneAt)
+			next.apply = nil
+			next.op.Status = "DONE"
+		case !tick.After(now):
+			s.autoscale(tick)
+			s.lastAutoscaled = tick
+		default:
+			for _, g := range s.groups {
+				g.prune(now, s.deleteTime)
+			}
+			return
+		}
+	}
+}
+
+// autoscale makes the decision of every autoscaler at the given time.
+func (s *Simulator) autoscale(now time.Time) {
+	for _, a := range s.autoscalers {
+		g := s.target(a)
+		if g == nil || a.AutoscalingPolicy == nil {
+			continue
+		}
+		p := a.AutoscalingPolicy
+		utilization := 0.6
+		if p.CpuUtilization != nil && p.CpuUtilization.UtilizationTarget > 0 {
+			utilization = p.CpuUtilization.UtilizationTarget
+		}
+		recommended := int64(math.Ceil(s.load(now) / utilization))
+		if recommended < p.MinNumReplicas {
+			recommended = p.MinNumReplicas
+		}
+		if p.MaxNumReplicas > 0 && recommended > p.MaxNumReplicas {
+			recommended = p.MaxNumReplicas
+		}
+		a.RecommendedSize = recommended
+		// Scale in only as far as the largest recent recommendation allows.
+		size := recommended
+		recent := g.recommendations[:0]
+		for _, r := range g.recommendations {
+			if now.Sub(r.at) < s.stabilization {
+				recent = append(recent, r)
+				if r.size > size {
+					size = r.size
+				}
+			}
+		}
+		g.recommendations = append(recent, simRecommendation{at: now, size: recommended})
+		switch mode := autoscale.Mode(a); {
+		case mode == "OFF":
+		case size > g.m.TargetSize:
+			s.resize(g, size, now)
+		case size < g.m.TargetSize && mode == "ON":
+			s.resize(g, size, now)
+		}
+	}
+}
+
+// target returns the group an autoscaler scales, or nil if it is missing.
+func (s *Simulator) target(a *compute.Autoscaler) *simGroup {
+	for name, g := range s.groups {
+		if a.Target == name || strings.HasSuffix(a.Target, "/"+name) {
+			return g
+		}
+	}
+	return nil
+}
+
+// resize sets the group's target size at the given time, creating the
+// missing instances or deleting the newest ones.
+func (s *Simulator) resize(g *simGroup, size int64, now time.Time) {
+	g.m.TargetSize = size
+	live := g.live()
+	for n := int64(len(live)); n < size; n++ {
+		s.instanceCount++
+		boot := s.bootTime
+		if s.bootJitter > 0 {
+			boot += time.Duration(s.rand.Int63n(int64(s.bootJitter)))
+		}
+		g.instances = append(g.instances, &simInstance{
+			name:    fmt.Sprintf("%s-%04d", g.m.Name, s.instanceCount),
+			readyAt: now.Add(boot),
+		})
+	}
+	for i := len(live) - 1; int64(i) >= size; i-- {
+		live[i].deletedAt = now
+	}
+}
+
+// live returns the instances which are not being deleted, oldest first.
+func (g *simGroup) live() []*simInstance {
+	var live []*simInstance
+	for _, i := range g.instances {
+		if i.deletedAt.IsZero() {
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// serving returns how many instances are running at the given time.
+func (g *simGroup) serving(now time.Time) int64 {
+	var n int64
+	for _, i := range g.live() {
+		if !i.readyAt.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// prune forgets the instances deleted for at least deleteTime.
+func (g *simGroup) prune(now time.Time, deleteTime time.Duration) {
+	kept := g.instances[:0]
+	for _, i := range g.instances {
+		if i.deletedAt.IsZero() || now.Sub(i.deletedAt) < deleteTime {
+			kept = append(kept, i)
+		}
+	}
+	g.instances = kept
+}
+
+// start returns a pending operation on a resource, applying apply once it
+// completes.
+func (s *Simulator) start(kind, target string, now time.Time, apply func(time.Time)) *compute.Operation {
+	s.opCount++
+	op := &compute.Operation{
+		Name:          fmt.Sprintf("operation-%d", s.opCount),
+		OperationType: kind,
+		TargetLink:    target,
+		Status:        "RUNNING",
+	}
+	s.ops[op.Name] = &simOp{op: op, doneAt: now.Add(s.opLatency), apply: apply}
+	copy := *op
+	return &copy
+}
+
+func (s *Simulator) GetGroup(ctx context.Context, g *mig.Group) (*compute.InstanceGroupManager, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("GetGroup", g.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	sg, ok := s.groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	m := *sg.m
+	stable := int64(len(sg.instances)) == m.TargetSize && sg.serving(now) == m.TargetSize
+	m.Status = &compute.InstanceGroupManagerStatus{IsStable: stable}
+	return &m, nil
+}
+
+func (s *Simulator) InsertGroup(ctx context.Context, g *mig.Group, m *compute.InstanceGroupManager) (*compute.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("InsertGroup", g.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	if _, ok := s.groups[g.Name]; ok {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: g.Name + " already exists"}
+	}
+	copy := *m
+	copy.Name = g.Name
+	copy.SelfLink = "projects/" + g.Project + "/" + g.String() + "/instanceGroupManagers/" + g.Name
+	size := copy.TargetSize
+	copy.TargetSize = 0
+	sg := &simGroup{m: &copy}
+	s.groups[g.Name] = sg
+	return s.start("insert", copy.SelfLink, now, func(at time.Time) { s.resize(sg, size, at) }), nil
+}
+
+func (s *Simulator) ResizeGroup(ctx context.Context, g *mig.Group, size int64) (*compute.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("ResizeGroup", g.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	sg, ok := s.groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	return s.start("compute.instanceGroupManagers.resize", sg.m.SelfLink, now, func(at time.Time) { s.resize(sg, size, at) }), nil
+}
+
+func (s *Simulator) DeleteGroup(ctx context.Context, g *mig.Group) (*compute.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("DeleteGroup", g.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	sg, ok := s.groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	return s.start("delete", sg.m.SelfLink, now, func(time.Time) { delete(s.groups, g.Name) }), nil
+}
+
+// ListManagedInstances reports instances which have not booted yet as
+// creating, and those being deleted as deleting.
+func (s *Simulator) ListManagedInstances(ctx context.Context, g *mig.Group) ([]*compute.ManagedInstance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("ListManagedInstances", g.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	sg, ok := s.groups[g.Name]
+	if !ok {
+		return nil, NotFound("instance group manager", g.Name)
+	}
+	var instances []*compute.ManagedInstance
+	for _, i := range sg.instances {
+		mi := &compute.ManagedInstance{
+			Instance:       fmt.Sprintf("projects/%s/zones/%s/instances/%s", g.Project, g.String(), i.name),
+			InstanceStatus: "RUNNING",
+			CurrentAction:  "NONE",
+		}
+		switch {
+		case !i.deletedAt.IsZero():
+			mi.InstanceStatus, mi.CurrentAction = "STOPPING", "DELETING"
+		case i.readyAt.After(now):
+			mi.InstanceStatus, mi.CurrentAction = "STAGING", "CREATING"
+		}
+		instances = append(instances, mi)
+	}
+	return instances, nil
+}
+
+func (s *Simulator) GetAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Autoscaler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("GetAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	s.advance(s.now())
+	a, ok := s.autoscalers[as.Name]
+	if !ok {
+		return nil, NotFound("autoscaler", as.Name)
+	}
+	copy := *a
+	return &copy, nil
+}
+
+// InsertAutoscaler makes its first decision once the insertion completes.
+func (s *Simulator) InsertAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("InsertAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	if _, ok := s.autoscalers[as.Name]; ok {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: as.Name + " already exists"}
+	}
+	copy := *a
+	return s.start("insert", as.Name, now, func(time.Time) { s.autoscalers[as.Name] = &copy }), nil
+}
+
+func (s *Simulator) UpdateAutoscaler(ctx context.Context, as *autoscale.Autoscaler, a *compute.Autoscaler) (*compute.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("UpdateAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	if _, ok := s.autoscalers[as.Name]; !ok {
+		return nil, NotFound("autoscaler", as.Name)
+	}
+	copy := *a
+	return s.start("update", as.Name, now, func(time.Time) { s.autoscalers[as.Name] = &copy }), nil
+}
+
+func (s *Simulator) DeleteAutoscaler(ctx context.Context, as *autoscale.Autoscaler) (*compute.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("DeleteAutoscaler", as.Name); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.advance(now)
+	if _, ok := s.autoscalers[as.Name]; !ok {
+		return nil, NotFound("autoscaler", as.Name)
+	}
+	return s.start("delete", as.Name, now, func(time.Time) { delete(s.autoscalers, as.Name) }), nil
+}
+
+// WaitForOperation sleeps until the operation completes.
+func (s *Simulator) WaitForOperation(ctx context.Context, project string, op *compute.Operation) error {
+	s.mu.Lock()
+	err := s.record("WaitForOperation", op.Name)
+	o, ok := s.ops[op.Name]
+	s.mu.Unlock()
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return NotFound("operation", op.Name)
+	}
+	select {
+	case <-time.After(o.doneAt.Sub(s.now())):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(s.now())
+	return mig.OperationError(o.op)
+}
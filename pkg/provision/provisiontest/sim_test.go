@@ -0,0 +1,185 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provisiontest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/autoscale"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/mig"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/provision/provisiontest"
+	"google.golang.org/api/compute/v1"
+)
+
+var location = mig.Location{Project: "p", Zone: "us-central1-f"}
+
+// The time the tests give a group to reach a size.
+const settle = 5 * time.Second
+
+// newSimulator returns a Provisioner over a Simulator whose instances boot
+// in 200ms and whose autoscalers scale in after 300ms, further configured by
+// opts.
+func newSimulator(opts ...provisiontest.SimOption) (*provision.Provisioner, *provisiontest.Simulator) {
+	sim := provisiontest.NewSimulator(append([]provisiontest.SimOption{
+		provisiontest.WithOperationLatency(5 * time.Millisecond),
+		provisiontest.WithBootTime(200*time.Millisecond, 0),
+		provisiontest.WithDeleteTime(10 * time.Millisecond),
+		provisiontest.WithAutoscalerInterval(10 * time.Millisecond),
+		provisiontest.WithStabilization(300 * time.Millisecond),
+	}, opts...)...)
+	return &provision.Provisioner{Compute: sim, PollInterval: 5 * time.Millisecond}, sim
+}
+
+// createGroup creates the group web of size instances and waits for them
+// to serve.
+func createGroup(t *testing.T, p *provision.Provisioner, size int64) *mig.Group {
+	t.Helper()
+	ctx := context.Background()
+	g := &mig.Group{Location: location, Name: "web"}
+	if _, err := p.CreateGroup(ctx, g, &compute.InstanceGroupManager{TargetSize: size}); err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if err := p.WaitForSize(ctx, g, size, settle); err != nil {
+		t.Fatalf("WaitForSize: %v", err)
+	}
+	return g
+}
+
+// applyAutoscaler scales the group web in mode between one and max
+// instances at 60% CPU.
+func applyAutoscaler(t *testing.T, p *provision.Provisioner, mode string, max int64) {
+	t.Helper()
+	as := &autoscale.Autoscaler{Location: location, Name: "web-as"}
+	a := &compute.Autoscaler{
+		Target: "projects/p/zones/us-central1-f/instanceGroupManagers/web",
+		AutoscalingPolicy: &compute.AutoscalingPolicy{
+			Mode:           mode,
+			MinNumReplicas: 1,
+			MaxNumReplicas: max,
+			CpuUtilization: &compute.AutoscalingPolicyCpuUtilization{UtilizationTarget: 0.6},
+		},
+	}
+	if err := p.ApplyAutoscaler(context.Background(), as, a); err != nil {
+		t.Fatalf("ApplyAutoscaler: %v", err)
+	}
+}
+
+// constant returns a load which never changes.
+func constant(load float64) func(time.Time) float64 {
+	return func(time.Time) float64 { return load }
+}
+
+func TestSimulatorBootsResizedGroup(t *testing.T) {
+	ctx := context.Background()
+	p, sim := newSimulator()
+	g := &mig.Group{Location: location, Name: "web"}
+	if _, err := p.CreateGroup(ctx, g, &compute.InstanceGroupManager{TargetSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if serving, target := sim.Serving("web"); serving != 0 || target != 3 {
+		t.Errorf("just created, %d of %d instances serve; want 0 of 3", serving, target)
+	}
+	instances, err := sim.ListManagedInstances(ctx, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range instances {
+		if i.CurrentAction != "CREATING" {
+			t.Errorf("booting instance %v is %v, want CREATING", i.Instance, i.CurrentAction)
+		}
+	}
+	if m, err := sim.GetGroup(ctx, g); err != nil || m.Status.IsStable {
+		t.Errorf("GetGroup = %+v, %v; want a booting group which is not stable", m, err)
+	}
+
+	if err := p.WaitForSize(ctx, g, 3, settle); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ResizeGroup(ctx, g, 5, settle); err != nil {
+		t.Fatal(err)
+	}
+	if serving, target := sim.Serving("web"); serving != 5 || target != 5 {
+		t.Errorf("after scaling out, %d of %d instances serve; want 5 of 5", serving, target)
+	}
+	if err := p.ResizeGroup(ctx, g, 2, settle); err != nil {
+		t.Fatal(err)
+	}
+	if serving, target := sim.Serving("web"); serving != 2 || target != 2 {
+		t.Errorf("after scaling in, %d of %d instances serve; want 2 of 2", serving, target)
+	}
+}
+
+func TestSimulatorAutoscalesWithLoad(t *testing.T) {
+	ctx := context.Background()
+	// 2.7 busy instances at 60% need 5.
+	p, sim := newSimulator(provisiontest.WithLoad(constant(2.7)))
+	g := createGroup(t, p, 1)
+	applyAutoscaler(t, p, "ON", 8)
+	if err := p.WaitForSize(ctx, g, 5, settle); err != nil {
+		t.Fatalf("under load: %v", err)
+	}
+
+	sim.SetLoad(constant(0.3))
+	if _, target := sim.Serving("web"); target != 5 {
+		t.Errorf("target size = %d as the load drops, want 5 until the stabilization window passes", target)
+	}
+	if err := p.WaitForSize(ctx, g, 1, settle); err != nil {
+		t.Fatalf("without load: %v", err)
+	}
+}
+
+func TestSimulatorAutoscalerCappedAtMax(t *testing.T) {
+	clock := &provisiontest.Clock{}
+	p, sim := newSimulator(provisiontest.WithLoad(constant(2.7)), provisiontest.WithClock(clock.Now))
+	g := createGroup(t, p, 1)
+	applyAutoscaler(t, p, "ON", 3)
+	if err := p.WaitForSize(context.Background(), g, 3, settle); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	if _, target := sim.Serving("web"); target != 3 {
+		t.Errorf("target size = %d, want the maximum of 3", target)
+	}
+}
+
+func TestSimulatorAutoscalerOnlyScalesOut(t *testing.T) {
+	clock := &provisiontest.Clock{}
+	p, sim := newSimulator(provisiontest.WithLoad(constant(1.5)), provisiontest.WithClock(clock.Now))
+	g := createGroup(t, p, 1)
+	applyAutoscaler(t, p, "ONLY_SCALE_OUT", 8)
+	if err := p.WaitForSize(context.Background(), g, 3, settle); err != nil {
+		t.Fatal(err)
+	}
+	sim.SetLoad(constant(0))
+	// Well past the stabilization window of 300ms.
+	clock.Advance(time.Second)
+	if _, target := sim.Serving("web"); target != 3 {
+		t.Errorf("target size = %d without load, want to stay at 3", target)
+	}
+}
+
+func TestSimulatorAutoscalerOff(t *testing.T) {
+	clock := &provisiontest.Clock{}
+	p, sim := newSimulator(provisiontest.WithLoad(constant(2.7)), provisiontest.WithClock(clock.Now))
+	createGroup(t, p, 2)
+	applyAutoscaler(t, p, "OFF", 8)
+	clock.Advance(time.Second)
+	if _, target := sim.Serving("web"); target != 2 {
+		t.Errorf("target size = %d, want the 2 it was created with", target)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report reads the events recorded while watching an autoscaler and
+// summarizes them, along with the latency statistics shared by the load
+// generator and the report commands.
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"time"
+)
+
+// A WatchEvent records the state of the autoscaler and its group at a point
+// in time. Events are written as one JSON object per line.
+type WatchEvent struct {
+	Time             time.Time      `json:"time"`
+	Type             string         `json:"type"`
+	Autoscaler       string         `json:"autoscaler"`
+	Group            string         `json:"group"`
+	Status           string         `json:"status"`
+	Mode             string         `json:"mode"`
+	PredictiveMethod string         `json:"predictiveMethod"`
+	StatusDetails    []StatusDetail `json:"statusDetails,omitempty"`
+	RecommendedSize  int64          `json:"recommendedSize"`
+	TargetSize       int64          `json:"targetSize"`
+	ActualSize       int64          `json:"actualSize"`
+	RunningSize      int64          `json:"runningSize"`
+	MaxSize          int64          `json:"maxSize"`
+	// ZoneSizes counts the instances in each zone of a regional group.
+	ZoneSizes map[string]int64 `json:"zoneSizes,omitempty"`
+	// PreservedState holds the disks, metadata and addresses preserved for
+	// each instance of a stateful group, keyed by instance name.
+	PreservedState map[string]*PreservedState `json:"preservedState,omitempty"`
+	// Message explains events other than plain state samples.
+	Message string `json:"message,omitempty"`
+	// Instance and ServingSeconds describe "instance-serving" events: how long
+	// a new instance took from creation to passing the health check.
+	Instance       string  `json:"instance,omitempty"`
+	ServingSeconds float64 `json:"servingSeconds,omitempty"`
+}
+
+// A StatusDetail is one of the reasons the autoscaler gives for its current
+// recommendation, such as hitting its maximum size or missing metrics.
+type StatusDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// A PreservedState summarizes what a stateful group preserves for one
+// instance, from both the stateful policy and its per-instance config.
+type PreservedState struct {
+	Disks       map[string]string `json:"disks,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	InternalIPs map[string]string `json:"internalIPs,omitempty"`
+	ExternalIPs map[string]string `json:"externalIPs,omitempty"`
+}
+
+// SameState reports whether two events describe the same observed state,
+// ignoring when they were taken.
+func (e *WatchEvent) SameState(o *WatchEvent) bool {
+	return o != nil &&
+		e.Status == o.Status &&
+		e.Mode == o.Mode &&
+		e.PredictiveMethod == o.PredictiveMethod &&
+		reflect.DeepEqual(e.StatusDetails, o.StatusDetails) &&
+		e.RecommendedSize == o.RecommendedSize &&
+		e.TargetSize == o.TargetSize &&
+		e.ActualSize == o.ActualSize &&
+		e.RunningSize == o.RunningSize &&
+		e.MaxSize == o.MaxSize &&
+		reflect.DeepEqual(e.ZoneSizes, o.ZoneSizes) &&
+		reflect.DeepEqual(e.PreservedState, o.PreservedState)
+}
+
+// ReadWatchEvents reads the JSON lines written by the watch command.
+func ReadWatchEvents(path string) ([]*WatchEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []*WatchEvent
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		e := &WatchEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, line, err)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// A ModeSummary aggregates the watch events recorded while the autoscaler
+// used a given predictive method.
+type ModeSummary struct {
+	Mode          string
+	Runs          int
+	Duration      time.Duration
+	PeakTarget    int64
+	InstanceHours float64
+	ScaleOuts     int
+	ScaleIns      int
+	// BootTimes holds the creation to serving latency of each new instance.
+	BootTimes []time.Duration
+	// Flapping holds the instances reported as flapping.
+	Flapping map[string]bool
+}
+
+// MeanSize returns the time weighted mean number of instances in the group.
+func (m *ModeSummary) MeanSize() float64 {
+	if m.Duration == 0 {
+		return 0
+	}
+	return m.InstanceHours / m.Duration.Hours()
+}
+
+// SummarizeRun folds the events of a single watch run into the per mode
+// summaries, keyed by predictive method. The group's size is assumed
+// constant between events.
+func SummarizeRun(summaries map[string]*ModeSummary, events []*WatchEvent) {
+	seen := map[string]bool{}
+	for i, e := range events {
+		m, ok := summaries[e.PredictiveMethod]
+		if !ok {
+			m = &ModeSummary{Mode: e.PredictiveMethod}
+			summaries[e.PredictiveMethod] = m
+		}
+		if !seen[m.Mode] {
+			seen[m.Mode] = true
+			m.Runs++
+		}
+		if e.TargetSize > m.PeakTarget {
+			m.PeakTarget = e.TargetSize
+		}
+		switch e.Type {
+		case "instance-serving":
+			m.BootTimes = append(m.BootTimes, time.Duration(e.ServingSeconds*float64(time.Second)))
+		case "instance-flapping":
+			if m.Flapping == nil {
+				m.Flapping = make(map[string]bool)
+			}
+			m.Flapping[e.Instance] = true
+		}
+		if i == 0 {
+			continue
+		}
+		prev := events[i-1]
+		d := e.Time.Sub(prev.Time)
+		m.Duration += d
+		m.InstanceHours += float64(prev.ActualSize) * d.Hours()
+		switch {
+		case e.TargetSize > prev.TargetSize:
+			m.ScaleOuts++
+		case e.TargetSize < prev.TargetSize:
+			m.ScaleIns++
+		}
+	}
+}
+
+// Durations implements sort.Interface.
+type Durations []time.Duration
+
+func (d Durations) Len() int           { return len(d) }
+func (d Durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d Durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Percentile returns the value below which the given fraction of a sorted
+// slice of durations falls.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Millis converts a duration to fractional milliseconds.
+func Millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
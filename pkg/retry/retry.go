@@ -0,0 +1,372 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry retries the calls of Google Cloud API clients under one
+// policy. A Transport wraps a client's transport, so that every call made
+// with the client is retried the same way, whichever API it belongs to:
+//
+//	client = retry.Wrap(client, &retry.Transport{Policy: retry.DefaultPolicy,
+//		Operations: map[string]retry.Policy{
+//			"compute.instanceGroupManagers.resize": {Attempts: 10, Backoff: time.Second, Budget: 5 * time.Minute},
+//		}})
+//	s, err := compute.New(client)
+//
+// Calls are retried if gcperr.IsRetryable classifies their error as
+// retryable, waiting at least as long as the server asks with Retry-After.
+// Calls which might have been carried out before they failed, that is
+// mutations other than Compute Engine calls carrying a requestId, are only
+// retried if the server certainly rejected them. The Transport gives every
+// Compute Engine mutation taking a requestId one of its own, kept across its
+// attempts, unless the caller set it.
+package retry
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/gcperr"
+	"google.golang.org/api/googleapi"
+)
+
+// A Policy says how often, and for how long, a failed call is attempted
+// again.
+type Policy struct {
+	// Attempts is the number of attempts made at a call; fewer than one
+	// counts as one.
+	Attempts int
+	// Backoff is the wait before the second attempt, doubling before each
+	// further attempt up to MaxBackoff, if set. Up to half of each wait is
+	// added at random, so that clients failing together do not retry
+	// together.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Budget bounds the time from a call's first attempt to the start of
+	// its last; a retry which would start later is not made. Zero is
+	// unbounded.
+	Budget time.Duration
+}
+
+// DefaultPolicy is the policy of calls for which a Transport has no other.
+var DefaultPolicy = Policy{Attempts: 5, Backoff: time.Second, MaxBackoff: 30 * time.Second, Budget: 2 * time.Minute}
+
+// wait returns the wait before attempt n, counting from 1, and after a
+// response asking for at least retryAfter.
+func (p *Policy) wait(n int, retryAfter time.Duration) time.Duration {
+	d := p.Backoff
+	for i := 2; i < n && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d > 0 {
+		d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+	}
+	if d < retryAfter {
+		d = retryAfter
+	}
+	return d
+}
+
+// A Transport retries the requests it sends through Base.
+type Transport struct {
+	// Base sends every attempt; nil means http.DefaultTransport.
+	Base http.RoundTripper
+	// Policy is the policy of calls not in Operations.
+	Policy Policy
+	// Operations overrides Policy for calls by their method ID, as returned
+	// by Operation.
+	Operations map[string]Policy
+	// OnRetry, if set, is called before every retry with the call's method
+	// ID, the attempt about to be made, the wait before it and why the last
+	// attempt failed.
+	OnRetry func(req *http.Request, op string, attempt int, wait time.Duration, reason string)
+}
+
+// Wrap makes a client send its requests through t, which sends them
+// through the client's transport unless t.Base is set.
+func Wrap(client *http.Client, t *Transport) *http.Client {
+	if t.Base == nil {
+		t.Base = client.Transport
+	}
+	if t.Base == nil {
+		t.Base = http.DefaultTransport
+	}
+	client.Transport = t
+	return client
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := Operation(req)
+	p, ok := t.Operations[op]
+	if !ok {
+		p = t.Policy
+	}
+	if p.Attempts < 1 {
+		p.Attempts = 1
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	req = withRequestID(req, op)
+	idempotent := Idempotent(req)
+	start := time.Now()
+	for n := 1; ; n++ {
+		attempt := req
+		if body != nil {
+			attempt = req.Clone(req.Context())
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.Base.RoundTrip(attempt)
+		reason, retryAfter, retryable := classify(resp, err, idempotent)
+		if !retryable || n >= p.Attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		wait := p.wait(n+1, retryAfter)
+		if p.Budget > 0 && time.Since(start)+wait > p.Budget {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if t.OnRetry != nil {
+			t.OnRetry(req, op, n+1, wait, reason)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// readBody reads the request's body, so that it can be sent again, and
+// closes it.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return ioutil.ReadAll(req.Body)
+}
+
+// classify returns why an attempt failed, how long the server asked to wait
+// before the next, and whether the call is worth retrying.
+func classify(resp *http.Response, err error, idempotent bool) (reason string, retryAfter time.Duration, retryable bool) {
+	if err != nil {
+		// A request which could not connect was never sent.
+		var oe *net.OpError
+		refused := errors.As(err, &oe) && oe.Op == "dial"
+		return err.Error(), 0, refused || idempotent && gcperr.IsRetryable(err)
+	}
+	if resp.StatusCode < 400 {
+		return "", 0, false
+	}
+	b, rerr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if rerr != nil {
+		return rerr.Error(), 0, idempotent
+	}
+	apiErr := googleapi.CheckResponse(&http.Response{StatusCode: resp.StatusCode, Header: resp.Header,
+		Body: ioutil.NopCloser(bytes.NewReader(b))})
+	// Rate limited calls were rejected, and so can always be retried.
+	rejected := resp.StatusCode == http.StatusTooManyRequests ||
+		gcperr.KindOf(apiErr) == gcperr.ErrQuotaExceeded && gcperr.IsRetryable(apiErr)
+	return resp.Status, parseRetryAfter(resp.Header.Get("Retry-After")), rejected || idempotent && gcperr.IsRetryable(apiErr)
+}
+
+// parseRetryAfter returns the wait asked for by a Retry-After header, in
+// seconds or as a date, or zero.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// idempotentPosts are the method IDs of POST calls which only read.
+var idempotentPosts = map[string]bool{
+	"compute.instanceGroupManagers.listManagedInstances":       true,
+	"compute.regionInstanceGroupManagers.listManagedInstances": true,
+	"compute.instanceGroups.listInstances":                     true,
+	"compute.regionInstanceGroups.listInstances":               true,
+	"compute.backendServices.getHealth":                        true,
+	"compute.regionBackendServices.getHealth":                  true,
+	"compute.zoneOperations.wait":                              true,
+	"compute.regionOperations.wait":                            true,
+	"compute.globalOperations.wait":                            true,
+}
+
+// noRequestID are the method IDs of Compute Engine mutations which take no
+// requestId, besides those of IAM policies; Compute Engine rejects unknown
+// parameters.
+var noRequestID = map[string]bool{
+	"compute.externalVpnGateways.setLabels":                        true,
+	"compute.globalAddresses.setLabels":                            true,
+	"compute.globalForwardingRules.setLabels":                      true,
+	"compute.globalOperations.delete":                              true,
+	"compute.globalOrganizationOperations.delete":                  true,
+	"compute.images.setLabels":                                     true,
+	"compute.instanceGroupManagers.applyUpdatesToInstances":        true,
+	"compute.instanceGroupManagers.deletePerInstanceConfigs":       true,
+	"compute.instances.sendDiagnosticInterrupt":                    true,
+	"compute.interconnectGroups.createMembers":                     true,
+	"compute.interconnects.setLabels":                              true,
+	"compute.machineImages.setLabels":                              true,
+	"compute.regionInstanceGroupManagers.applyUpdatesToInstances":  true,
+	"compute.regionInstanceGroupManagers.deletePerInstanceConfigs": true,
+	"compute.regionOperations.delete":                              true,
+	"compute.regionSecurityPolicies.addRule":                       true,
+	"compute.regionSecurityPolicies.patchRule":                     true,
+	"compute.regionSecurityPolicies.removeRule":                    true,
+	"compute.regionUrlMaps.validate":                               true,
+	"compute.reservationSlots.update":                              true,
+	"compute.routers.preview":                                      true,
+	"compute.securityPolicies.addRule":                             true,
+	"compute.securityPolicies.patchRule":                           true,
+	"compute.securityPolicies.removeRule":                          true,
+	"compute.securityPolicies.setLabels":                           true,
+	"compute.snapshots.setLabels":                                  true,
+	"compute.urlMaps.validate":                                     true,
+	"compute.zoneOperations.delete":                                true,
+}
+
+// withRequestID returns req, the call op, with a requestId of its own if it
+// is a Compute Engine mutation taking one without it, so that it may be
+// retried like a read: Compute Engine carries out the requests with the
+// same requestId once.
+func withRequestID(req *http.Request, op string) *http.Request {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return req
+	}
+	if !strings.HasPrefix(req.URL.Host, "compute.") || req.URL.Query().Get("requestId") != "" ||
+		idempotentPosts[op] || noRequestID[op] ||
+		strings.HasSuffix(op, ".setIamPolicy") || strings.HasSuffix(op, ".testIamPermissions") {
+		return req
+	}
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	q.Set("requestId", newRequestID())
+	req.URL.RawQuery = q.Encode()
+	return req
+}
+
+// newRequestID returns a random UUID, the form of requestId Compute Engine
+// accepts.
+func newRequestID() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Idempotent reports whether a request may be sent again even if it was
+// carried out: it only reads, or it is a Compute Engine mutation with a
+// requestId, which Compute Engine carries out once.
+func Idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if strings.HasPrefix(req.URL.Host, "compute.") && req.URL.Query().Get("requestId") != "" {
+		return true
+	}
+	return req.Method == "POST" && idempotentPosts[Operation(req)]
+}
+
+// version matches the API version segment of a request path, e.g. v1 or
+// v2beta1.
+var version = regexp.MustCompile(`^v[0-9]+([a-z]+[0-9]*)?$`)
+
+// parents are the collections under whose resources other collections
+// are found, rather than custom methods.
+var parents = map[string]bool{"projects": true, "zones": true, "regions": true, "locations": true, "b": true, "datasets": true}
+
+// Operation returns the method ID of a request to a Google Cloud API, e.g.
+// "compute.instanceGroupManagers.resize" for a POST to
+// .../instanceGroupManagers/NAME/resize. It is derived from the path, whose
+// segments after the API version alternate between collections and
+// resource names: a request ending in a collection lists it or inserts into
+// it, one ending in a name gets, updates or deletes the resource, and a
+// segment after a name, unless the name's collection is one of parents, is
+// a custom method of that collection.
+func Operation(req *http.Request) string {
+	service := strings.TrimSuffix(req.URL.Host, ".googleapis.com")
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(req.URL.EscapedPath(), "/"), "/") {
+		switch {
+		case version.MatchString(s):
+			segments = nil
+		case s != "global" && s != "aggregated":
+			// Compute Engine scopes without a name would break the pairs.
+			segments = append(segments, s)
+		}
+	}
+	method := strings.ToLower(req.Method)
+	if len(segments) == 0 {
+		return service + "." + method
+	}
+	last := len(segments) - 1
+	if i := strings.LastIndex(segments[last], ":"); i >= 0 {
+		// A custom method named after the resource, as in NAME:verb.
+		return service + "." + segments[last&^1] + "." + segments[last][i+1:]
+	}
+	if last%2 == 1 {
+		switch req.Method {
+		case "GET":
+			method = "get"
+		case "PUT":
+			method = "update"
+		}
+		return service + "." + segments[last-1] + "." + method
+	}
+	if last > 0 && !parents[segments[last-2]] {
+		return service + "." + segments[last-2] + "." + segments[last]
+	}
+	switch req.Method {
+	case "GET":
+		method = "list"
+	case "POST":
+		method = "insert"
+	}
+	return service + "." + segments[last] + "." + method
+}
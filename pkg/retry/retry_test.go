@@ -0,0 +1,108 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// failingTransport answers the first failures requests with 503 and the
+// rest with 200, recording the requests.
+type failingTransport struct {
+	failures int
+	requests []*http.Request
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	code := http.StatusOK
+	if len(t.requests) <= t.failures {
+		code = http.StatusServiceUnavailable
+	}
+	return &http.Response{StatusCode: code, Status: http.StatusText(code), Header: http.Header{},
+		Body: ioutil.NopCloser(strings.NewReader(`{}`)), Request: req}, nil
+}
+
+// send sends a request through a Transport over base making three attempts
+// at once.
+func send(t *testing.T, base http.RoundTripper, method, url string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(`{"name":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&Transport{Base: base, Policy: Policy{Attempts: 3}}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestComputeMutationRetriedWithOneRequestID(t *testing.T) {
+	base := &failingTransport{failures: 2}
+	resp := send(t, base, "POST", "https://compute.googleapis.com/compute/v1/projects/p/zones/z/instanceGroupManagers/g/resize?size=3")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want 200 after retries", resp.StatusCode)
+	}
+	if len(base.requests) != 3 {
+		t.Fatalf("made %d attempts, want 3", len(base.requests))
+	}
+	id := base.requests[0].URL.Query().Get("requestId")
+	if id == "" {
+		t.Fatal("the resize has no requestId")
+	}
+	for i, req := range base.requests {
+		if got := req.URL.Query().Get("requestId"); got != id {
+			t.Errorf("attempt %d has requestId %q, want %q", i+1, got, id)
+		}
+		if got := req.URL.Query().Get("size"); got != "3" {
+			t.Errorf("attempt %d has size %q, want 3", i+1, got)
+		}
+	}
+}
+
+func TestCallerRequestIDKept(t *testing.T) {
+	base := &failingTransport{}
+	send(t, base, "DELETE", "https://compute.googleapis.com/compute/v1/projects/p/global/urlMaps/m?requestId=mine")
+	if got := base.requests[0].URL.Query().Get("requestId"); got != "mine" {
+		t.Errorf("requestId = %q, want the caller's", got)
+	}
+}
+
+func TestNoRequestIDOutsideComputeMutations(t *testing.T) {
+	for _, c := range []struct{ method, url string }{
+		{"GET", "https://compute.googleapis.com/compute/v1/projects/p/global/urlMaps/m"},
+		{"POST", "https://compute.googleapis.com/compute/v1/projects/p/zones/z/instanceGroupManagers/g/listManagedInstances"},
+		{"POST", "https://compute.googleapis.com/compute/v1/projects/p/zones/z/instanceGroupManagers/g/applyUpdatesToInstances"},
+		{"POST", "https://storage.googleapis.com/storage/v1/b/bucket/o"},
+	} {
+		base := &failingTransport{}
+		send(t, base, c.method, c.url)
+		if id := base.requests[0].URL.Query().Get("requestId"); id != "" {
+			t.Errorf("%v %v was given requestId %q", c.method, c.url, id)
+		}
+	}
+}
+
+func TestMutationWithoutRequestIDNotRetried(t *testing.T) {
+	base := &failingTransport{failures: 1}
+	resp := send(t, base, "POST", "https://storage.googleapis.com/storage/v1/b/bucket/o")
+	if resp.StatusCode != http.StatusServiceUnavailable || len(base.requests) != 1 {
+		t.Errorf("got %v after %d attempts, want the 503 of the only attempt", resp.StatusCode, len(base.requests))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDependencyFailed is the error of a graph's tasks which were not run
+// because a task they depend on failed.
+var ErrDependencyFailed = errors.New("workerpool: a dependency failed")
+
+// A Graph runs tasks which depend on others, such as cloud resources which
+// refer to each other, each as soon as every task it depends on has
+// succeeded, on a Pool bounding how many run at once:
+//
+//	g := workerpool.NewGraph()
+//	g.Add("health check", createHealthCheck)
+//	g.Add("backend service", createBackendService, "health check")
+//	g.Add("firewall", createFirewall)
+//	failures, err := g.Run(ctx, workerpool.WithWorkers(4))
+type Graph struct {
+	order []string
+	nodes map[string]*graphNode
+}
+
+// A graphNode is one task of a Graph.
+type graphNode struct {
+	task       Task
+	deps       []string
+	dependents []string
+}
+
+// NewGraph returns an empty Graph.
+func NewGraph() *Graph {
+	return &Graph{nodes: map[string]*graphNode{}}
+}
+
+// Add adds a task which runs once the tasks named by deps have succeeded.
+// The dependencies may be added later, but before Run. Adding a name twice
+// replaces its task.
+func (g *Graph) Add(name string, t Task, deps ...string) {
+	if _, ok := g.nodes[name]; !ok {
+		g.order = append(g.order, name)
+	}
+	g.nodes[name] = &graphNode{task: t, deps: deps}
+}
+
+// link records each node's dependents and checks that every dependency
+// exists and that the dependencies have no cycle.
+func (g *Graph) link() error {
+	unmet := map[string]int{}
+	for _, name := range g.order {
+		g.nodes[name].dependents = nil
+	}
+	for _, name := range g.order {
+		n := g.nodes[name]
+		for _, d := range n.deps {
+			dep, ok := g.nodes[d]
+			if !ok {
+				return fmt.Errorf("workerpool: %v depends on unknown task %v", name, d)
+			}
+			dep.dependents = append(dep.dependents, name)
+		}
+		unmet[name] = len(n.deps)
+	}
+	var ready []string
+	for _, name := range g.order {
+		if unmet[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	sorted := 0
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		sorted++
+		for _, d := range g.nodes[name].dependents {
+			if unmet[d]--; unmet[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if sorted < len(g.order) {
+		return errors.New("workerpool: the task dependencies have a cycle")
+	}
+	return nil
+}
+
+// Run runs the graph's tasks on a Pool made with opts and returns the
+// outcomes of those which failed, followed by those which never ran: with
+// ErrDependencyFailed if a task they depend on failed, or with the
+// context's error, which Run also returns, if the pool was cancelled first.
+func (g *Graph) Run(ctx context.Context, opts ...Option) ([]Outcome, error) {
+	if err := g.link(); err != nil {
+		return nil, err
+	}
+	// The caller's OnDone, if any, still sees every outcome.
+	scratch := &Pool{}
+	for _, opt := range opts {
+		opt(scratch)
+	}
+	onDone := scratch.onDone
+	done := make(chan Outcome, len(g.order))
+	p := New(ctx, append(opts, OnDone(func(o Outcome) {
+		if onDone != nil {
+			onDone(o)
+		}
+		done <- o
+	}))...)
+
+	unmet := map[string]int{}
+	for _, name := range g.order {
+		unmet[name] = len(g.nodes[name].deps)
+	}
+	finished := map[string]bool{}
+	inFlight := 0
+	submit := func(name string) {
+		if err := p.Submit(name, g.nodes[name].task); err == nil {
+			inFlight++
+		}
+	}
+	for _, name := range g.order {
+		if unmet[name] == 0 {
+			submit(name)
+		}
+	}
+	var skipped []Outcome
+	// skip marks the dependents of a failed task as never run.
+	var skip func(name string)
+	skip = func(name string) {
+		for _, d := range g.nodes[name].dependents {
+			if !finished[d] {
+				finished[d] = true
+				skipped = append(skipped, Outcome{Name: d, Err: ErrDependencyFailed})
+				skip(d)
+			}
+		}
+	}
+	for inFlight > 0 {
+		o := <-done
+		inFlight--
+		finished[o.Name] = true
+		if o.Err != nil {
+			skip(o.Name)
+			continue
+		}
+		for _, d := range g.nodes[o.Name].dependents {
+			if unmet[d]--; unmet[d] == 0 && !finished[d] {
+				submit(d)
+			}
+		}
+	}
+	failures, err := p.Wait()
+	for _, name := range g.order {
+		if !finished[name] {
+			skipped = append(skipped, Outcome{Name: name, Err: ctx.Err()})
+		}
+	}
+	return append(failures, skipped...), err
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerpool_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+)
+
+// recorder records the order tasks run in.
+type recorder struct {
+	mu  sync.Mutex
+	ran []string
+}
+
+// task returns a task recording name, failing with err.
+func (r *recorder) task(name string, err error) workerpool.Task {
+	return func(context.Context) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.ran = append(r.ran, name)
+		return err
+	}
+}
+
+// index returns where name is in the order, or -1.
+func (r *recorder) index(name string) int {
+	for i, n := range r.ran {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestGraphRunsDependenciesFirst(t *testing.T) {
+	r := &recorder{}
+	g := workerpool.NewGraph()
+	// The rule is added before what it depends on.
+	g.Add("rule", r.task("rule", nil), "proxy", "address")
+	g.Add("health check", r.task("health check", nil))
+	g.Add("backend service", r.task("backend service", nil), "health check")
+	g.Add("url map", r.task("url map", nil), "backend service")
+	g.Add("proxy", r.task("proxy", nil), "url map")
+	g.Add("address", r.task("address", nil))
+	failures, err := g.Run(context.Background(), workerpool.WithWorkers(3))
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Run = %v, %v; want no failures", failures, err)
+	}
+	if len(r.ran) != 6 {
+		t.Fatalf("ran %v, want every task once", r.ran)
+	}
+	for _, dep := range [][2]string{
+		{"health check", "backend service"},
+		{"backend service", "url map"},
+		{"url map", "proxy"},
+		{"proxy", "rule"},
+		{"address", "rule"},
+	} {
+		if r.index(dep[0]) > r.index(dep[1]) {
+			t.Errorf("%v ran before %v, which it depends on: %v", dep[1], dep[0], r.ran)
+		}
+	}
+}
+
+func TestGraphSkipsDependentsOfFailures(t *testing.T) {
+	r := &recorder{}
+	g := workerpool.NewGraph()
+	g.Add("a", r.task("a", errTask))
+	g.Add("b", r.task("b", nil), "a")
+	g.Add("c", r.task("c", nil), "b")
+	g.Add("d", r.task("d", nil))
+	failures, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, o := range failures {
+		got = append(got, o.Name)
+		want := workerpool.ErrDependencyFailed
+		if o.Name == "a" {
+			want = errTask
+		}
+		if !errors.Is(o.Err, want) {
+			t.Errorf("%v failed with %v, want %v", o.Name, o.Err, want)
+		}
+	}
+	if strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("failures %v, want a then its dependents b and c", got)
+	}
+	sort.Strings(r.ran)
+	if strings.Join(r.ran, ",") != "a,d" {
+		t.Errorf("ran %v, want only a and the independent d", r.ran)
+	}
+}
+
+func TestGraphRejectsCycles(t *testing.T) {
+	r := &recorder{}
+	g := workerpool.NewGraph()
+	g.Add("a", r.task("a", nil), "c")
+	g.Add("b", r.task("b", nil), "a")
+	g.Add("c", r.task("c", nil), "b")
+	g.Add("d", r.task("d", nil))
+	if _, err := g.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Run = %v, want a cycle error", err)
+	}
+	if len(r.ran) != 0 {
+		t.Errorf("ran %v, want nothing run from a graph with a cycle", r.ran)
+	}
+}
+
+func TestGraphRejectsUnknownDependencies(t *testing.T) {
+	g := workerpool.NewGraph()
+	g.Add("a", func(context.Context) error { return nil }, "missing")
+	if _, err := g.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Run = %v, want an error naming the unknown task", err)
+	}
+}
+
+func TestGraphCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := workerpool.NewGraph()
+	g.Add("a", func(context.Context) error {
+		cancel()
+		return nil
+	})
+	g.Add("b", func(context.Context) error {
+		t.Error("b ran after the graph was cancelled")
+		return nil
+	}, "a")
+	failures, err := g.Run(ctx)
+	if err != context.Canceled {
+		t.Errorf("Run = %v, want %v", err, context.Canceled)
+	}
+	if len(failures) != 1 || failures[0].Name != "b" || failures[0].Err != context.Canceled {
+		t.Errorf("failures = %+v, want b never run", failures)
+	}
+}
+
+func TestGraphKeepsOnDone(t *testing.T) {
+	var mu sync.Mutex
+	var done []string
+	g := workerpool.NewGraph()
+	g.Add("a", func(context.Context) error { return nil })
+	g.Add("b", func(context.Context) error { return nil }, "a")
+	_, err := g.Run(context.Background(), workerpool.OnDone(func(o workerpool.Outcome) {
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, o.Name)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(done, ",") != "a,b" {
+		t.Errorf("OnDone saw %v, want a then b", done)
+	}
+}
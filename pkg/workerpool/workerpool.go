@@ -0,0 +1,275 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workerpool runs many small tasks, such as object copies or
+// resource deletions, on a fixed number of workers fed by a bounded queue.
+// Failed tasks are retried under a RetryPolicy, the pool counts its tasks as
+// they go, and cancelling the pool's context stops it:
+//
+//	p := workerpool.New(ctx, workerpool.WithWorkers(20),
+//		workerpool.WithRetry(workerpool.RetryPolicy{Attempts: 3, Backoff: time.Second}))
+//	for _, name := range names {
+//		name := name
+//		if err := p.Submit(name, func(ctx context.Context) error { return del(ctx, name) }); err != nil {
+//			break
+//		}
+//	}
+//	failures, err := p.Wait()
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWorkers is the number of workers of a Pool without WithWorkers.
+const DefaultWorkers = 10
+
+// ErrClosed is returned by Submit once Wait has been called.
+var ErrClosed = errors.New("workerpool: the pool is closed")
+
+// A Task is a unit of work. It should return promptly once ctx is done.
+type Task func(ctx context.Context) error
+
+// A RetryPolicy says how often a failed task is attempted again.
+type RetryPolicy struct {
+	// Attempts is the number of attempts made at each task, at least one.
+	Attempts int
+	// Backoff is the wait before the second attempt, doubling before each
+	// further attempt. Zero retries at once.
+	Backoff time.Duration
+	// Retryable reports whether an error is worth another attempt. Nil
+	// retries every error.
+	Retryable func(error) bool
+}
+
+// NoRetry is the retry policy of a Pool without WithRetry.
+var NoRetry = RetryPolicy{Attempts: 1}
+
+// An Outcome describes a finished task.
+type Outcome struct {
+	Name string
+	// Err is the error of the last attempt, or the context's error if the
+	// pool was cancelled before the task started.
+	Err error
+	// Attempts counts the attempts made, zero if the task never started.
+	Attempts int
+	Duration time.Duration
+}
+
+// Counters count a pool's tasks at one point in time.
+type Counters struct {
+	// Queued counts the tasks submitted but not yet started.
+	Queued int64
+	// Running counts the tasks being attempted or waiting to be retried.
+	Running int64
+	// Succeeded and Failed count the finished tasks.
+	Succeeded, Failed int64
+	// Retries counts the attempts made after the first, over all tasks.
+	Retries int64
+}
+
+// A Pool runs tasks on its workers until Wait is called.
+type Pool struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	workers   int
+	queueSize int
+	retry     RetryPolicy
+	onDone    func(Outcome)
+
+	queue chan job
+	wg    sync.WaitGroup
+	// closeMu guards closed, which is set once queue is closed.
+	closeMu sync.RWMutex
+	closed  bool
+	// mu serializes the OnDone calls and guards failures.
+	mu       sync.Mutex
+	failures []Outcome
+
+	queued, running, succeeded, failed, retries int64
+}
+
+// A job is a submitted task.
+type job struct {
+	name string
+	task Task
+}
+
+// An Option configures a Pool.
+type Option func(*Pool)
+
+// WithWorkers sets the number of tasks run at once.
+func WithWorkers(n int) Option {
+	return func(p *Pool) { p.workers = n }
+}
+
+// WithQueueSize sets the number of tasks which may wait for a worker before
+// Submit blocks. It defaults to the number of workers.
+func WithQueueSize(n int) Option {
+	return func(p *Pool) { p.queueSize = n }
+}
+
+// WithRetry sets how failed tasks are retried.
+func WithRetry(r RetryPolicy) Option {
+	return func(p *Pool) { p.retry = r }
+}
+
+// OnDone sets a function called with the outcome of every task as it
+// finishes. Calls are never concurrent.
+func OnDone(f func(Outcome)) Option {
+	return func(p *Pool) { p.onDone = f }
+}
+
+// New returns a Pool running tasks with ctx, whose workers have started.
+// Fewer than one worker or attempt counts as one.
+func New(ctx context.Context, opts ...Option) *Pool {
+	p := &Pool{workers: DefaultWorkers, queueSize: -1, retry: NoRetry}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.workers < 1 {
+		p.workers = 1
+	}
+	if p.queueSize < 0 {
+		p.queueSize = p.workers
+	}
+	if p.retry.Attempts < 1 {
+		p.retry.Attempts = 1
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.queue = make(chan job, p.queueSize)
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range p.queue {
+				atomic.AddInt64(&p.queued, -1)
+				p.run(j)
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues a task, waiting while the queue is full. It returns the
+// context's error once the pool is cancelled, and ErrClosed after Wait.
+func (p *Pool) Submit(name string, t Task) error {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&p.queued, 1)
+	select {
+	case p.queue <- job{name, t}:
+		return nil
+	case <-p.ctx.Done():
+		atomic.AddInt64(&p.queued, -1)
+		return p.ctx.Err()
+	}
+}
+
+// Cancel cancels the pool's context: running tasks are asked to stop, and
+// those still queued fail without being started.
+func (p *Pool) Cancel() {
+	p.cancel()
+}
+
+// Counters returns the pool's counters.
+func (p *Pool) Counters() Counters {
+	return Counters{
+		Queued:    atomic.LoadInt64(&p.queued),
+		Running:   atomic.LoadInt64(&p.running),
+		Succeeded: atomic.LoadInt64(&p.succeeded),
+		Failed:    atomic.LoadInt64(&p.failed),
+		Retries:   atomic.LoadInt64(&p.retries),
+	}
+}
+
+// Wait closes the pool to new tasks, waits for the submitted ones to finish
+// and returns the outcomes of those which failed, in the order they
+// finished, along with the context's error if the pool was cancelled.
+func (p *Pool) Wait() ([]Outcome, error) {
+	p.closeMu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.closeMu.Unlock()
+	p.wg.Wait()
+	err := p.ctx.Err()
+	p.cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Outcome(nil), p.failures...), err
+}
+
+// run runs a task under the retry policy and records its outcome.
+func (p *Pool) run(j job) {
+	start := time.Now()
+	o := Outcome{Name: j.name}
+	if o.Err = p.ctx.Err(); o.Err == nil {
+		atomic.AddInt64(&p.running, 1)
+		o.Attempts, o.Err = p.attempt(j.task)
+		atomic.AddInt64(&p.running, -1)
+	}
+	o.Duration = time.Since(start)
+	if o.Err != nil {
+		atomic.AddInt64(&p.failed, 1)
+	} else {
+		atomic.AddInt64(&p.succeeded, 1)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if o.Err != nil {
+		p.failures = append(p.failures, o)
+	}
+	if p.onDone != nil {
+		p.onDone(o)
+	}
+}
+
+// attempt makes the attempts at a task and returns how many it made, with
+// the error of the last.
+func (p *Pool) attempt(t Task) (int, error) {
+	var err error
+	backoff := p.retry.Backoff
+	for i := 0; i < p.retry.Attempts; i++ {
+		if i > 0 {
+			if p.retry.Retryable != nil && !p.retry.Retryable(err) {
+				return i, err
+			}
+			atomic.AddInt64(&p.retries, 1)
+			if backoff > 0 {
+				select {
+				case <-time.After(backoff):
+				case <-p.ctx.Done():
+					return i, p.ctx.Err()
+				}
+				backoff *= 2
+			}
+		}
+		if err = t(p.ctx); err == nil {
+			return i + 1, nil
+		}
+	}
+	return p.retry.Attempts, err
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerpool_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/pkg/workerpool"
+)
+
+var errTask = errors.New("task failed")
+
+func TestPoolRunsEveryTask(t *testing.T) {
+	var ran int64
+	p := workerpool.New(context.Background(), workerpool.WithWorkers(4))
+	for i := 0; i < 50; i++ {
+		if err := p.Submit(fmt.Sprint(i), func(context.Context) error {
+			atomic.AddInt64(&ran, 1)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failures, err := p.Wait()
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Wait = %v, %v; want no failures", failures, err)
+	}
+	if ran != 50 {
+		t.Errorf("ran %d tasks, want 50", ran)
+	}
+	if c := p.Counters(); c.Succeeded != 50 || c.Failed != 0 || c.Queued != 0 || c.Running != 0 {
+		t.Errorf("Counters = %+v, want 50 succeeded", c)
+	}
+}
+
+func TestPoolBoundsConcurrency(t *testing.T) {
+	var running, peak int64
+	var mu sync.Mutex
+	release := make(chan struct{})
+	p := workerpool.New(context.Background(), workerpool.WithWorkers(3), workerpool.WithQueueSize(20))
+	for i := 0; i < 20; i++ {
+		p.Submit(fmt.Sprint(i), func(context.Context) error {
+			n := atomic.AddInt64(&running, 1)
+			mu.Lock()
+			if n > peak {
+				peak = n
+			}
+			mu.Unlock()
+			<-release
+			atomic.AddInt64(&running, -1)
+			return nil
+		})
+	}
+	close(release)
+	p.Wait()
+	if peak > 3 {
+		t.Errorf("%d tasks ran at once, want at most 3", peak)
+	}
+}
+
+func TestPoolRetriesFailedTasks(t *testing.T) {
+	attempts := 0
+	var outcomes []workerpool.Outcome
+	p := workerpool.New(context.Background(),
+		workerpool.WithRetry(workerpool.RetryPolicy{Attempts: 3}),
+		workerpool.OnDone(func(o workerpool.Outcome) { outcomes = append(outcomes, o) }))
+	p.Submit("flaky", func(context.Context) error {
+		if attempts++; attempts < 3 {
+			return errTask
+		}
+		return nil
+	})
+	failures, err := p.Wait()
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Wait = %v, %v; want the third attempt to succeed", failures, err)
+	}
+	if len(outcomes) != 1 || outcomes[0].Attempts != 3 || outcomes[0].Err != nil {
+		t.Errorf("outcomes = %+v, want one success after 3 attempts", outcomes)
+	}
+	if c := p.Counters(); c.Retries != 2 || c.Succeeded != 1 {
+		t.Errorf("Counters = %+v, want 2 retries and 1 success", c)
+	}
+}
+
+func TestPoolReportsFailures(t *testing.T) {
+	p := workerpool.New(context.Background(), workerpool.WithRetry(workerpool.RetryPolicy{Attempts: 2}))
+	p.Submit("ok", func(context.Context) error { return nil })
+	p.Submit("broken", func(context.Context) error { return errTask })
+	failures, err := p.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 || failures[0].Name != "broken" || failures[0].Attempts != 2 || !errors.Is(failures[0].Err, errTask) {
+		t.Errorf("failures = %+v, want broken after 2 attempts", failures)
+	}
+	if c := p.Counters(); c.Failed != 1 || c.Succeeded != 1 {
+		t.Errorf("Counters = %+v, want 1 failed and 1 succeeded", c)
+	}
+}
+
+func TestPoolRetryableStopsRetries(t *testing.T) {
+	permanent := errors.New("permanent")
+	attempts := 0
+	p := workerpool.New(context.Background(), workerpool.WithRetry(workerpool.RetryPolicy{
+		Attempts:  5,
+		Retryable: func(err error) bool { return err != permanent },
+	}))
+	p.Submit("task", func(context.Context) error {
+		attempts++
+		return permanent
+	})
+	failures, _ := p.Wait()
+	if attempts != 1 || len(failures) != 1 || failures[0].Attempts != 1 {
+		t.Errorf("made %d attempts, failures %+v; want 1 attempt at an error which is not retryable", attempts, failures)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	p := workerpool.New(ctx, workerpool.WithWorkers(1), workerpool.WithQueueSize(5))
+	p.Submit("running", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	for i := 0; i < 3; i++ {
+		p.Submit(fmt.Sprint("queued ", i), func(context.Context) error {
+			t.Error("a queued task started after the pool was cancelled")
+			return nil
+		})
+	}
+	<-started
+	cancel()
+	if err := p.Submit("late", func(context.Context) error { return nil }); err != context.Canceled {
+		t.Errorf("Submit after cancelling = %v, want %v", err, context.Canceled)
+	}
+	failures, err := p.Wait()
+	if err != context.Canceled {
+		t.Errorf("Wait = %v, want %v", err, context.Canceled)
+	}
+	if len(failures) != 4 {
+		t.Fatalf("%d failures, want the running and the 3 queued tasks", len(failures))
+	}
+	for _, o := range failures[1:] {
+		if o.Attempts != 0 || o.Err != context.Canceled {
+			t.Errorf("queued task outcome %+v, want never attempted and cancelled", o)
+		}
+	}
+}
+
+func TestSubmitAfterWait(t *testing.T) {
+	p := workerpool.New(context.Background())
+	p.Wait()
+	if err := p.Submit("late", func(context.Context) error { return nil }); err != workerpool.ErrClosed {
+		t.Errorf("Submit after Wait = %v, want ErrClosed", err)
+	}
+}
@@ -14,7 +14,11 @@
 
 // Binary main uses the provided service account key to duplicate all of
 // the files in the indicated bucket. It uses several concurrent copiers and
-// provides for a naive retry mechanism.
+// provides for a naive retry mechanism. Instances fetch this file directly;
+// elsewhere, "httplb-autoscale generate files" does the same using the
+// application default credentials. It is kept self-contained so that it can
+// be fetched and run as a single file; programs should import
+// pkg/gcsgen, which cmd/generate-files wraps, instead.
 package main
 
 import (